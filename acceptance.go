@@ -0,0 +1,144 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+var acceptanceLatency = newSummary(
+	"order_acceptance_latency_seconds",
+	"Time between an order being placed and accepted.",
+	"mode",
+)
+
+type AcceptanceSettings struct {
+	AutoAccept    bool `json:"auto_accept"`
+	MaxOpenOrders *int `json:"max_open_orders"`
+	// AutoCancelMinutes cancels and refunds orders still pending after this
+	// many minutes; nil disables auto-cancel.
+	AutoCancelMinutes *int `json:"auto_cancel_minutes"`
+}
+
+func updateAcceptanceSettings(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	if !requireRole(w, r, db, establishmentID, "manager") {
+		return
+	}
+	var s AcceptanceSettings
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s.MaxOpenOrders != nil && *s.MaxOpenOrders <= 0 {
+		http.Error(w, "max_open_orders must be positive", http.StatusUnprocessableEntity)
+		return
+	}
+	if s.AutoCancelMinutes != nil && (*s.AutoCancelMinutes < 1 || *s.AutoCancelMinutes > 1440) {
+		http.Error(w, "auto_cancel_minutes must be between 1 and 1440", http.StatusUnprocessableEntity)
+		return
+	}
+	_, err := db.Exec(
+		`UPDATE establishments SET auto_accept=$1, auto_accept_max_open=$2, auto_cancel_minutes=$3, updated_at=now() WHERE id=$4`,
+		s.AutoAccept, s.MaxOpenOrders, s.AutoCancelMinutes, establishmentID,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := recordAudit(db, r, establishmentID, "establishment.acceptance_updated", "establishment", establishmentID, s); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// acceptOrder moves a pending order to PROCESSING. It returns false when the
+// order was no longer pending, e.g. because someone accepted it first.
+func acceptOrder(db *sql.DB, orderID, mode string) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var establishmentID string
+	var orderedAt, processedAt time.Time
+	err = tx.QueryRow(
+		`UPDATE orders SET status='PROCESSING', processed_at=now(), updated_at=now()
+		 WHERE id=$1 AND status='PENDING'
+		 RETURNING establishment_id, ordered_at, processed_at`,
+		orderID,
+	).Scan(&establishmentID, &orderedAt, &processedAt)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	payload, _ := json.Marshal(map[string]string{"mode": mode})
+	if _, err := tx.Exec(`INSERT INTO order_events (order_id, event_type, payload) VALUES ($1,'ACCEPTED',$2)`, orderID, payload); err != nil {
+		return false, err
+	}
+	if err := enqueueEvent(tx, Event{Type: eventOrderAccepted, OrderID: orderID, EstablishmentID: establishmentID}); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	acceptanceLatency.Observe(mode, processedAt.Sub(orderedAt).Seconds())
+	return true, nil
+}
+
+// autoAcceptOrders accepts new orders for establishments that opted in, as long
+// as they are below their open-orders threshold.
+func autoAcceptOrders(db *sql.DB) func(Event) {
+	return func(e Event) {
+		var eligible bool
+		err := db.QueryRow(
+			`SELECT e.auto_accept AND (e.auto_accept_max_open IS NULL OR
+			   (SELECT COUNT(*) FROM orders o WHERE o.establishment_id=e.id AND o.status='PROCESSING') < e.auto_accept_max_open)
+			   AND (SELECT risk_score FROM orders WHERE id=$2) < $3
+			 FROM establishments e WHERE e.id=$1`,
+			e.EstablishmentID, e.OrderID, riskReviewThreshold,
+		).Scan(&eligible)
+		if err != nil {
+			log.Printf("auto-accept %s: %v", e.OrderID, err)
+			return
+		}
+		if !eligible {
+			return
+		}
+		if _, err := acceptOrder(db, e.OrderID, "auto"); err != nil {
+			log.Printf("auto-accept %s: %v", e.OrderID, err)
+		}
+	}
+}
+
+func manualAcceptOrder(w http.ResponseWriter, r *http.Request, db *sql.DB, orderID string) {
+	var establishmentID string
+	err := db.QueryRow(`SELECT establishment_id FROM orders WHERE id=$1`, orderID).Scan(&establishmentID)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, nil)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !requireRole(w, r, db, establishmentID, "staff") {
+		return
+	}
+	ok, err := acceptOrder(db, orderID, "manual")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, "order is not pending", http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
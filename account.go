@@ -0,0 +1,299 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const (
+	passwordResetTTL = time.Hour
+	emailChangeTTL   = 24 * time.Hour
+)
+
+var appBaseURL = "http://localhost:3000"
+
+func requestPasswordReset(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var req struct {
+		Email string `json:"email"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	email := strings.ToLower(strings.TrimSpace(req.Email))
+
+	// Always answer 202 so the endpoint can't be used to discover accounts.
+	var ownerID string
+	err := db.QueryRow(`SELECT id FROM owners WHERE email=$1`, email).Scan(&ownerID)
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusAccepted)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	token, err := randomToken(32)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = db.Exec(
+		`INSERT INTO password_reset_tokens (token_hash, owner_id, expires_at) VALUES ($1,$2,now() + $3 * interval '1 second')`,
+		hashToken(token), ownerID, int(passwordResetTTL.Seconds()),
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	body := "Use o link abaixo para redefinir sua senha (válido por 1 hora):\n\n" + appBaseURL + "/reset-password?token=" + token
+	if err := mailer.Send(email, "Redefinição de senha", body); err != nil {
+		log.Printf("password reset mail to %s failed: %v", email, err)
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func confirmPasswordReset(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var req struct {
+		Token    string `json:"token"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var ownerID, email string
+	err = tx.QueryRow(
+		`UPDATE password_reset_tokens t SET used_at=now() FROM owners o
+		 WHERE t.token_hash=$1 AND t.used_at IS NULL AND t.expires_at > now() AND o.id=t.owner_id
+		 RETURNING o.id, o.email`,
+		hashToken(req.Token),
+	).Scan(&ownerID, &email)
+	if err == sql.ErrNoRows {
+		http.Error(w, "invalid or expired token", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := validatePasswordStrength(req.Password, email); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec(
+		`UPDATE owners SET password_hash=$1, failed_logins=0, locked_until=NULL, tokens_valid_after=date_trunc('second', now()), updated_at=now() WHERE id=$2`,
+		hash, ownerID,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec(`UPDATE owner_sessions SET revoked_at=now() WHERE owner_id=$1 AND revoked_at IS NULL`, ownerID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// changePassword replaces the caller's password, ends every other session
+// and answers with fresh tokens for the current one, since tokens issued
+// before the change are no longer accepted.
+func changePassword(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var req struct {
+		CurrentPassword string `json:"current_password"`
+		NewPassword     string `json:"new_password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c := currentClaims(r)
+	id := c.Sub
+	var hash, email string
+	if err := db.QueryRow(`SELECT password_hash, email FROM owners WHERE id=$1`, id).Scan(&hash, &email); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !checkPassword(hash, req.CurrentPassword) {
+		http.Error(w, "current password is incorrect", http.StatusForbidden)
+		return
+	}
+	if err := validatePasswordStrength(req.NewPassword, email); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	newHash, err := hashPassword(req.NewPassword)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(
+		`UPDATE owners SET password_hash=$1, tokens_valid_after=date_trunc('second', now()), updated_at=now() WHERE id=$2`,
+		newHash, id,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec(
+		`UPDATE owner_sessions SET revoked_at=now() WHERE owner_id=$1 AND id::text <> $2 AND revoked_at IS NULL`,
+		id, c.Sid,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var tok TokenResponse
+	if c.Sid != "" {
+		// Refresh tokens handed out before the change must not outlive it.
+		if _, err := tx.Exec(`DELETE FROM refresh_tokens WHERE session_id=$1`, c.Sid); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		tok, err = issueSessionTokens(tx, id, c.Sid)
+	} else {
+		tok, err = issueAccessToken(id, "owner")
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tok)
+}
+
+func requestEmailChange(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var req struct {
+		NewEmail string `json:"new_email"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	newEmail := strings.ToLower(strings.TrimSpace(req.NewEmail))
+	if !strings.Contains(newEmail, "@") {
+		http.Error(w, "a valid email is required", http.StatusBadRequest)
+		return
+	}
+	id := currentClaims(r).Sub
+	var hash string
+	var taken bool
+	err := db.QueryRow(
+		`SELECT password_hash, EXISTS(SELECT 1 FROM owners WHERE email=$2) FROM owners WHERE id=$1`, id, newEmail,
+	).Scan(&hash, &taken)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !checkPassword(hash, req.Password) {
+		http.Error(w, "password is incorrect", http.StatusForbidden)
+		return
+	}
+	if taken {
+		http.Error(w, "email already registered", http.StatusConflict)
+		return
+	}
+
+	token, err := randomToken(32)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = db.Exec(
+		`INSERT INTO email_change_requests (token_hash, owner_id, new_email, expires_at) VALUES ($1,$2,$3,now() + $4 * interval '1 second')`,
+		hashToken(token), id, newEmail, int(emailChangeTTL.Seconds()),
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	body := "Confirme seu novo e-mail acessando o link abaixo:\n\n" + appBaseURL + "/confirm-email?token=" + token
+	if err := mailer.Send(newEmail, "Confirmação de e-mail", body); err != nil {
+		log.Printf("email change mail to %s failed: %v", newEmail, err)
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+func confirmEmailChange(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var req struct {
+		Token string `json:"token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var ownerID, newEmail string
+	err = tx.QueryRow(
+		`UPDATE email_change_requests SET confirmed_at=now()
+		 WHERE token_hash=$1 AND confirmed_at IS NULL AND expires_at > now()
+		 RETURNING owner_id, new_email`,
+		hashToken(req.Token),
+	).Scan(&ownerID, &newEmail)
+	if err == sql.ErrNoRows {
+		http.Error(w, "invalid or expired token", http.StatusBadRequest)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res, err := tx.Exec(
+		`UPDATE owners SET email=$1, updated_at=now() WHERE id=$2 AND NOT EXISTS (SELECT 1 FROM owners WHERE email=$1)`,
+		newEmail, ownerID,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "email already registered", http.StatusConflict)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
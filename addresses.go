@@ -0,0 +1,234 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+)
+
+type Address struct {
+	CEP          string `json:"cep"`
+	Street       string `json:"street"`
+	Number       string `json:"number"`
+	Complement   string `json:"complement"`
+	Neighborhood string `json:"neighborhood"`
+	City         string `json:"city"`
+	State        string `json:"state"`
+	// Lat and Lng are optional WGS84 coordinates used for distance-based fees.
+	Lat *float64 `json:"lat,omitempty"`
+	Lng *float64 `json:"lng,omitempty"`
+}
+
+type CustomerAddress struct {
+	ID    string `json:"id"`
+	Label string `json:"label"`
+	Address
+}
+
+type CEPLookup interface {
+	Lookup(ctx context.Context, cep string) (*Address, error)
+}
+
+var cepLookup CEPLookup = viaCEP{baseURL: "https://viacep.com.br/ws"}
+
+var errCEPNotFound = errors.New("cep not found")
+
+type viaCEP struct {
+	baseURL string
+}
+
+func (v viaCEP) Lookup(ctx context.Context, cep string) (*Address, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, v.baseURL+"/"+cep+"/json/", nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusBadRequest {
+		return nil, errCEPNotFound
+	}
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("viacep: status %d", resp.StatusCode)
+	}
+	var body struct {
+		CEP         string `json:"cep"`
+		Logradouro  string `json:"logradouro"`
+		Complemento string `json:"complemento"`
+		Bairro      string `json:"bairro"`
+		Localidade  string `json:"localidade"`
+		UF          string `json:"uf"`
+		Erro        any    `json:"erro"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&body); err != nil {
+		return nil, err
+	}
+	if body.Erro != nil {
+		return nil, errCEPNotFound
+	}
+	return &Address{
+		CEP:          digitsOnly(body.CEP),
+		Street:       body.Logradouro,
+		Complement:   body.Complemento,
+		Neighborhood: body.Bairro,
+		City:         body.Localidade,
+		State:        body.UF,
+	}, nil
+}
+
+// normalizeAddress canonicalizes the CEP and state and reports what is
+// missing; an entirely empty address is valid.
+func normalizeAddress(a *Address) []string {
+	if *a == (Address{}) {
+		return nil
+	}
+	problems := []string{}
+	sanitizeFields(&a.Street, &a.Number, &a.Complement, &a.Neighborhood, &a.City)
+	a.CEP = digitsOnly(a.CEP)
+	if len(a.CEP) != 8 {
+		problems = append(problems, "cep must have 8 digits")
+	}
+	a.State = strings.ToUpper(strings.TrimSpace(a.State))
+	if len(a.State) != 2 {
+		problems = append(problems, "state must be a two-letter UF")
+	}
+	if strings.TrimSpace(a.Street) == "" {
+		problems = append(problems, "street is required")
+	}
+	if strings.TrimSpace(a.City) == "" {
+		problems = append(problems, "city is required")
+	}
+	if (a.Lat == nil) != (a.Lng == nil) {
+		problems = append(problems, "lat and lng must be given together")
+	} else if a.Lat != nil && (*a.Lat < -90 || *a.Lat > 90 || *a.Lng < -180 || *a.Lng > 180) {
+		problems = append(problems, "lat/lng are out of range")
+	}
+	return problems
+}
+
+func (a Address) String() string {
+	if a == (Address{}) {
+		return ""
+	}
+	s := a.Street
+	if a.Number != "" {
+		s += ", " + a.Number
+	}
+	if a.Complement != "" {
+		s += " - " + a.Complement
+	}
+	if a.Neighborhood != "" {
+		s += ", " + a.Neighborhood
+	}
+	s += ", " + a.City + " - " + a.State
+	if len(a.CEP) == 8 {
+		s += ", " + a.CEP[:5] + "-" + a.CEP[5:]
+	}
+	return s
+}
+
+func addressLookupHandler() http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost && r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		cep := digitsOnly(r.URL.Query().Get("cep"))
+		if len(cep) != 8 {
+			http.Error(w, "cep must have 8 digits", http.StatusBadRequest)
+			return
+		}
+		a, err := cepLookup.Lookup(r.Context(), cep)
+		if err == errCEPNotFound {
+			http.NotFound(w, nil)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadGateway)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(a)
+	}
+}
+
+func customerAddressesHandler(db *sql.DB) http.HandlerFunc {
+	return authenticateCustomer(db, func(w http.ResponseWriter, r *http.Request) {
+		id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/customers/me/addresses"), "/")
+		switch {
+		case id == "" && r.Method == http.MethodGet:
+			listCustomerAddresses(w, r, db)
+		case id == "" && r.Method == http.MethodPost:
+			createCustomerAddress(w, r, db)
+		case id != "" && r.Method == http.MethodDelete:
+			_, err := db.Exec(`DELETE FROM customer_addresses WHERE id=$1 AND customer_id=$2`, id, currentClaims(r).Sub)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func listCustomerAddresses(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	rows, err := db.Query(
+		`SELECT id, label, cep, street, number, complement, neighborhood, city, state, lat, lng FROM customer_addresses WHERE customer_id=$1 ORDER BY created_at`,
+		currentClaims(r).Sub,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	list := []CustomerAddress{}
+	for rows.Next() {
+		var a CustomerAddress
+		if err := rows.Scan(&a.ID, &a.Label, &a.CEP, &a.Street, &a.Number, &a.Complement, &a.Neighborhood, &a.City, &a.State, &a.Lat, &a.Lng); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		list = append(list, a)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func createCustomerAddress(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var a CustomerAddress
+	if err := json.NewDecoder(r.Body).Decode(&a); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	a.Label = sanitizeText(a.Label)
+	if a.Address == (Address{}) {
+		http.Error(w, "address is required", http.StatusBadRequest)
+		return
+	}
+	if problems := normalizeAddress(&a.Address); len(problems) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string][]string{"problems": problems})
+		return
+	}
+	err := db.QueryRow(
+		`INSERT INTO customer_addresses (customer_id, label, cep, street, number, complement, neighborhood, city, state, lat, lng) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11) RETURNING id`,
+		currentClaims(r).Sub, a.Label, a.CEP, a.Street, a.Number, a.Complement, a.Neighborhood, a.City, a.State, a.Lat, a.Lng,
+	).Scan(&a.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(a)
+}
@@ -0,0 +1,64 @@
+package main
+
+import (
+	"embed"
+	"io/fs"
+	"net/http"
+	"path"
+	"strings"
+)
+
+// The admin frontend build is copied into admin/dist before compiling; the
+// committed index.html is only a placeholder.
+//
+//go:embed all:admin/dist
+var adminDist embed.FS
+
+// adminHandler serves the embedded admin SPA under /admin/. Paths that don't
+// name a file fall back to index.html so client-side routes survive reloads.
+// Fingerprinted files under assets/ are cached for a year; everything else is
+// revalidated so new deployments show up immediately.
+func adminHandler() http.Handler {
+	dist, err := fs.Sub(adminDist, "admin/dist")
+	if err != nil {
+		panic(err)
+	}
+	files := http.FileServer(http.FS(dist))
+	return http.StripPrefix("/admin", http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name := strings.TrimPrefix(path.Clean(r.URL.Path), "/")
+		if name == "" || name == "index.html" {
+			serveAdminIndex(w, r, dist)
+			return
+		}
+		if st, err := fs.Stat(dist, name); err != nil || st.IsDir() {
+			// Missing files with an extension are real 404s, not app routes.
+			if path.Ext(name) != "" {
+				http.NotFound(w, r)
+				return
+			}
+			serveAdminIndex(w, r, dist)
+			return
+		}
+		if strings.HasPrefix(name, "assets/") {
+			w.Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+		} else {
+			w.Header().Set("Cache-Control", "no-cache")
+		}
+		files.ServeHTTP(w, r)
+	}))
+}
+
+func serveAdminIndex(w http.ResponseWriter, r *http.Request, dist fs.FS) {
+	index, err := fs.ReadFile(dist, "index.html")
+	if err != nil {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Write(index)
+}
@@ -0,0 +1,198 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+)
+
+// Platform statistics for admins. Every figure is a GROUP BY over orders
+// and payments, with archived orders read from order_daily_aggregates, so
+// the endpoint stays cheap no matter how many orders there are. Days are
+// each establishment's local calendar days, as in the establishment reports.
+
+const adminStatsTopEstablishments = 20
+
+type AdminStats struct {
+	From time.Time `json:"from"`
+	To   time.Time `json:"to"`
+	// EstablishmentID and OrganizationID echo the drill-down filters.
+	EstablishmentID string `json:"establishment_id,omitempty"`
+	OrganizationID  string `json:"organization_id,omitempty"`
+
+	Establishments          int `json:"establishments"`
+	PublishedEstablishments int `json:"published_establishments"`
+	// ActiveMenus counts published establishments with at least one active
+	// product.
+	ActiveMenus       int                       `json:"active_menus"`
+	Orders            int                       `json:"orders"`
+	GMVCents          int64                     `json:"gmv_cents"`
+	Days              []AdminStatsDay           `json:"days"`
+	Payments          []AdminPaymentStats       `json:"payments"`
+	TopEstablishments []AdminEstablishmentStats `json:"top_establishments"`
+}
+
+type AdminStatsDay struct {
+	Day             string `json:"day"`
+	Orders          int    `json:"orders"`
+	CompletedOrders int    `json:"completed_orders"`
+	GMVCents        int64  `json:"gmv_cents"`
+}
+
+type AdminPaymentStats struct {
+	Gateway     string  `json:"gateway"`
+	Attempts    int     `json:"attempts"`
+	Paid        int     `json:"paid"`
+	Failed      int     `json:"failed"`
+	SuccessRate float64 `json:"success_rate"`
+}
+
+type AdminEstablishmentStats struct {
+	EstablishmentID string `json:"establishment_id"`
+	Name            string `json:"name"`
+	Orders          int    `json:"orders"`
+	GMVCents        int64  `json:"gmv_cents"`
+}
+
+// adminStatsScope restricts establishments aliased e to the drill-down
+// filters, $1 (establishment) and $2 (organization), either may be empty.
+const adminStatsScope = `($1='' OR e.id::text=$1) AND ($2='' OR e.organization_id::text=$2)`
+
+// adminStatsHandler serves GET /admin/stats over ?from=&to=, narrowed with
+// ?establishment_id= or ?organization_id=.
+func adminStatsHandler(db *sql.DB) http.HandlerFunc {
+	return authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !requirePlatformAdmin(w, r, db) {
+			return
+		}
+		loc, err := time.LoadLocation(defaultTimezone)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		from, to, err := reportRange(r, loc)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		st := AdminStats{
+			From: from, To: to,
+			EstablishmentID: r.URL.Query().Get("establishment_id"),
+			OrganizationID:  r.URL.Query().Get("organization_id"),
+		}
+		if err := loadAdminStats(db, &st); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		respond(w, r, "admin_stats", st)
+	})
+}
+
+func loadAdminStats(db *sql.DB, st *AdminStats) error {
+	args := []any{st.EstablishmentID, st.OrganizationID, st.From, st.To}
+	err := db.QueryRow(
+		`SELECT COUNT(*), COUNT(*) FILTER (WHERE e.status='published'),
+		   COUNT(*) FILTER (WHERE e.status='published' AND EXISTS (SELECT 1 FROM products p WHERE p.establishment_id=e.id AND p.is_active))
+		 FROM establishments e WHERE `+adminStatsScope,
+		args[:2]...,
+	).Scan(&st.Establishments, &st.PublishedEstablishments, &st.ActiveMenus)
+	if err != nil {
+		return err
+	}
+
+	// Live orders and the daily aggregates of archived ones, per local day.
+	rows, err := db.Query(
+		`SELECT day::text, SUM(orders), SUM(completed), SUM(gmv) FROM (
+		   SELECT (o.ordered_at AT TIME ZONE 'UTC' AT TIME ZONE e.timezone)::date AS day, COUNT(*) AS orders,
+		     COUNT(*) FILTER (WHERE o.status='COMPLETED') AS completed, COALESCE(SUM(o.total_cents) FILTER (WHERE o.status='COMPLETED'),0) AS gmv
+		   FROM orders o JOIN establishments e ON e.id=o.establishment_id
+		   WHERE `+adminStatsScope+` AND o.ordered_at >= $3 AND o.ordered_at < $4
+		   GROUP BY 1
+		   UNION ALL
+		   SELECT a.day, SUM(a.orders), SUM(a.completed_orders), SUM(a.revenue_cents)
+		   FROM order_daily_aggregates a JOIN establishments e ON e.id=a.establishment_id
+		   WHERE `+adminStatsScope+` AND a.day >= ($3 AT TIME ZONE 'UTC' AT TIME ZONE e.timezone)::date AND a.day < ($4 AT TIME ZONE 'UTC' AT TIME ZONE e.timezone)::date
+		   GROUP BY 1
+		 ) d GROUP BY day ORDER BY day`,
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+	st.Days = []AdminStatsDay{}
+	for rows.Next() {
+		var d AdminStatsDay
+		if err := rows.Scan(&d.Day, &d.Orders, &d.CompletedOrders, &d.GMVCents); err != nil {
+			rows.Close()
+			return err
+		}
+		st.Orders += d.Orders
+		st.GMVCents += d.GMVCents
+		st.Days = append(st.Days, d)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	// Payments still pending are left out of the success rate.
+	rows, err = db.Query(
+		`SELECT p.gateway, COUNT(*) FILTER (WHERE p.status<>'pending'), COUNT(*) FILTER (WHERE p.status IN ('paid','refunded')), COUNT(*) FILTER (WHERE p.status='failed')
+		 FROM payments p JOIN orders o ON o.id=p.order_id JOIN establishments e ON e.id=o.establishment_id
+		 WHERE `+adminStatsScope+` AND p.created_at >= $3 AND p.created_at < $4
+		 GROUP BY p.gateway ORDER BY p.gateway`,
+		args...,
+	)
+	if err != nil {
+		return err
+	}
+	st.Payments = []AdminPaymentStats{}
+	for rows.Next() {
+		var p AdminPaymentStats
+		if err := rows.Scan(&p.Gateway, &p.Attempts, &p.Paid, &p.Failed); err != nil {
+			rows.Close()
+			return err
+		}
+		if p.Attempts > 0 {
+			p.SuccessRate = float64(p.Paid) / float64(p.Attempts)
+		}
+		st.Payments = append(st.Payments, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = db.Query(
+		`SELECT e.id, e.name, SUM(t.orders), SUM(t.gmv) FROM (
+		   SELECT o.establishment_id, COUNT(*) AS orders, SUM(o.total_cents) AS gmv
+		   FROM orders o JOIN establishments e ON e.id=o.establishment_id
+		   WHERE `+adminStatsScope+` AND o.status='COMPLETED' AND o.ordered_at >= $3 AND o.ordered_at < $4
+		   GROUP BY 1
+		   UNION ALL
+		   SELECT a.establishment_id, SUM(a.completed_orders), SUM(a.revenue_cents)
+		   FROM order_daily_aggregates a JOIN establishments e ON e.id=a.establishment_id
+		   WHERE `+adminStatsScope+` AND a.day >= ($3 AT TIME ZONE 'UTC' AT TIME ZONE e.timezone)::date AND a.day < ($4 AT TIME ZONE 'UTC' AT TIME ZONE e.timezone)::date
+		   GROUP BY 1
+		 ) t JOIN establishments e ON e.id=t.establishment_id
+		 GROUP BY e.id, e.name ORDER BY 4 DESC, e.name LIMIT $5`,
+		append(args, adminStatsTopEstablishments)...,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	st.TopEstablishments = []AdminEstablishmentStats{}
+	for rows.Next() {
+		var e AdminEstablishmentStats
+		if err := rows.Scan(&e.EstablishmentID, &e.Name, &e.Orders, &e.GMVCents); err != nil {
+			return err
+		}
+		st.TopEstablishments = append(st.TopEstablishments, e)
+	}
+	return rows.Err()
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"unicode/utf8"
+)
+
+// Product and category images carry alt text for screen readers. It is
+// optional while editing, but an establishment can't be published while an
+// active product or a category shows an image without it; the
+// missing_alt_text report lists what still needs it.
+
+const maxAltText = 250
+
+type MissingAltText struct {
+	EntityType string `json:"entity_type"`
+	ID         string `json:"id"`
+	Name       string `json:"name"`
+	ImageKey   string `json:"image_key"`
+	ImageURL   string `json:"image_url"`
+}
+
+// normalizeAltText sanitizes the alt text and returns a message when it is
+// too long.
+func normalizeAltText(s *string) string {
+	sanitizeFields(s)
+	if utf8.RuneCountInString(*s) > maxAltText {
+		return fmt.Sprintf("alt_text must have at most %d characters", maxAltText)
+	}
+	return ""
+}
+
+// missingAltTextSQL lists images shown in the menu without alt text:
+// categories' and active products' images, not banners.
+const missingAltTextSQL = `
+	SELECT 'category', id, name, image_key FROM product_categories
+	WHERE establishment_id=$1 AND COALESCE(image_key,'') <> '' AND image_alt_text = ''
+	UNION ALL
+	SELECT 'product', id, name, image_key FROM products
+	WHERE establishment_id=$1 AND is_active AND COALESCE(image_key,'') <> '' AND image_alt_text = ''`
+
+func countMissingAltText(q queryer, establishmentID string) (int, error) {
+	var n int
+	err := q.QueryRow(`SELECT COUNT(*) FROM (`+missingAltTextSQL+`) m`, establishmentID).Scan(&n)
+	return n, err
+}
+
+// missingAltTextReport serves GET /establishments/{id}/reports/missing_alt_text.
+func missingAltTextReport(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	rows, err := db.Query(missingAltTextSQL+` ORDER BY 1, 3`, establishmentID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	list := []MissingAltText{}
+	for rows.Next() {
+		var m MissingAltText
+		if err := rows.Scan(&m.EntityType, &m.ID, &m.Name, &m.ImageKey); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		m.ImageURL = assetURL(m.ImageKey)
+		list = append(list, m)
+	}
+	respond(w, r, "missing_alt_text", list)
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	maxAnalyticsBatch = 100
+	// analyticsMaxAge bounds how old a buffered event may be; frontends that
+	// were offline longer just lose those events.
+	analyticsMaxAge = 24 * time.Hour
+)
+
+var analyticsKinds = map[string]bool{"menu_view": true, "product_view": true, "add_to_cart": true, "experiment_exposure": true}
+
+type AnalyticsEvent struct {
+	Kind            string `json:"kind"`
+	EstablishmentID string `json:"establishment_id"`
+	ProductID       string `json:"product_id,omitempty"`
+	// ExperimentID and Variant are only used by experiment_exposure.
+	ExperimentID string     `json:"experiment_id,omitempty"`
+	Variant      string     `json:"variant,omitempty"`
+	OccurredAt   *time.Time `json:"occurred_at,omitempty"`
+}
+
+// analyticsEventsHandler takes batches of storefront events. It needs no
+// login and stores nothing that identifies the visitor: the optional
+// session_id is kept only as a hash, to count distinct sessions.
+func analyticsEventsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !trackingLimiter.allow(clientIP(r)) {
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		var req struct {
+			SessionID string           `json:"session_id"`
+			Events    []AnalyticsEvent `json:"events"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if len(req.Events) > maxAnalyticsBatch {
+			http.Error(w, fmt.Sprintf("at most %d events per batch", maxAnalyticsBatch), http.StatusUnprocessableEntity)
+			return
+		}
+		n, err := recordAnalyticsEvents(db, req.SessionID, req.Events)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]int64{"accepted": n})
+	}
+}
+
+// recordAnalyticsEvents validates the batch and inserts it in one statement.
+// Events for unknown establishments, or for products outside the given
+// establishment, are dropped rather than failing the batch, so a stale
+// frontend cache doesn't lose the rest. Exposures to experiments that aren't
+// running, or to variants they don't have, are dropped the same way. It
+// returns how many were stored.
+func recordAnalyticsEvents(db *sql.DB, sessionID string, events []AnalyticsEvent) (int64, error) {
+	now := time.Now().UTC()
+	var kinds, establishments, products, experiments, variants, times []string
+	for _, e := range events {
+		if !analyticsKinds[e.Kind] {
+			return 0, fmt.Errorf("kind must be menu_view, product_view, add_to_cart or experiment_exposure")
+		}
+		if e.Kind != "experiment_exposure" {
+			e.ExperimentID, e.Variant = "", ""
+		} else if !uuidPattern.MatchString(e.ExperimentID) || e.Variant == "" {
+			return 0, fmt.Errorf("experiment_exposure needs an experiment_id and a variant")
+		}
+		if !uuidPattern.MatchString(e.EstablishmentID) || (e.ProductID != "" && !uuidPattern.MatchString(e.ProductID)) {
+			return 0, fmt.Errorf("establishment_id and product_id must be UUIDs")
+		}
+		if e.Kind != "menu_view" && e.ProductID == "" {
+			return 0, fmt.Errorf("%s needs a product_id", e.Kind)
+		}
+		at := now
+		if e.OccurredAt != nil && e.OccurredAt.Before(now) {
+			at = e.OccurredAt.UTC()
+		}
+		if now.Sub(at) > analyticsMaxAge {
+			continue
+		}
+		kinds = append(kinds, e.Kind)
+		establishments = append(establishments, e.EstablishmentID)
+		products = append(products, e.ProductID)
+		experiments = append(experiments, e.ExperimentID)
+		variants = append(variants, e.Variant)
+		times = append(times, at.Format("2006-01-02 15:04:05.999999"))
+	}
+	if len(kinds) == 0 {
+		return 0, nil
+	}
+	var session string
+	if sessionID != "" {
+		sum := sha256.Sum256([]byte(sessionID))
+		session = hex.EncodeToString(sum[:])
+	}
+	res, err := db.Exec(
+		`INSERT INTO analytics_events (establishment_id, product_id, kind, session_hash, occurred_at, experiment_id, variant)
+		 SELECT est.id, p.id, e.kind, $5, e.occurred_at, x.id, NULLIF(e.variant, '')
+		 FROM unnest($1::text[], $2::uuid[], $3::text[], $4::timestamp[], $6::text[], $7::text[]) AS e(kind, establishment_id, product_id, occurred_at, experiment_id, variant)
+		 JOIN establishments est ON est.id=e.establishment_id
+		 LEFT JOIN products p ON p.id=NULLIF(e.product_id, '')::uuid AND p.establishment_id=est.id
+		 LEFT JOIN experiments x ON x.id=NULLIF(e.experiment_id, '')::uuid AND x.product_id=p.id AND x.status='running'
+		 WHERE (e.product_id='' OR p.id IS NOT NULL)
+		   AND (e.experiment_id='' OR x.variants @> jsonb_build_array(jsonb_build_object('key', e.variant)))`,
+		pq.Array(kinds), pq.Array(establishments), pq.Array(products), pq.Array(times), session, pq.Array(experiments), pq.Array(variants),
+	)
+	if err != nil {
+		return 0, err
+	}
+	return res.RowsAffected()
+}
+
+type ConversionReport struct {
+	From           time.Time `json:"from"`
+	To             time.Time `json:"to"`
+	Sessions       int       `json:"sessions"`
+	MenuViews      int       `json:"menu_views"`
+	ProductViews   int       `json:"product_views"`
+	AddToCarts     int       `json:"add_to_carts"`
+	Orders         int       `json:"orders"`
+	ConversionRate float64   `json:"conversion_rate"`
+}
+
+// conversionReport is the storefront funnel over ?from=&to=. Conversion is
+// orders per session that viewed the menu; sessions only count events sent
+// with a session_id.
+func conversionReport(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	loc, err := establishmentLocation(db, establishmentID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	from, to, err := reportRange(r, loc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rep := ConversionReport{From: from, To: to}
+	err = db.QueryRow(
+		`SELECT COUNT(DISTINCT session_hash) FILTER (WHERE kind='menu_view' AND session_hash<>''),
+		   COUNT(*) FILTER (WHERE kind='menu_view'), COUNT(*) FILTER (WHERE kind='product_view'), COUNT(*) FILTER (WHERE kind='add_to_cart'),
+		   (SELECT COUNT(*) FROM orders WHERE establishment_id=$1 AND status NOT IN ('CANCELLED','FAILED') AND ordered_at >= $2 AND ordered_at < $3)
+		 FROM analytics_events WHERE establishment_id=$1 AND occurred_at >= $2 AND occurred_at < $3`,
+		establishmentID, from, to,
+	).Scan(&rep.Sessions, &rep.MenuViews, &rep.ProductViews, &rep.AddToCarts, &rep.Orders)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if rep.Sessions > 0 {
+		rep.ConversionRate = float64(rep.Orders) / float64(rep.Sessions)
+	}
+	respond(w, r, "conversion_report", rep)
+}
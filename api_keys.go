@@ -0,0 +1,165 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// API keys let integrators call the API as the owner who created them,
+// without a login. Only the hash is stored; the key is shown once. Sandbox
+// keys ("ck_test_") are served against the sandbox schema, see sandbox.go.
+
+const (
+	liveKeyPrefix    = "ck_live_"
+	sandboxKeyPrefix = "ck_test_"
+)
+
+type APIKey struct {
+	ID         string     `json:"id"`
+	Name       string     `json:"name"`
+	Prefix     string     `json:"prefix"`
+	Sandbox    bool       `json:"sandbox"`
+	Key        string     `json:"key,omitempty"`
+	CreatedAt  time.Time  `json:"created_at"`
+	LastUsedAt *time.Time `json:"last_used_at"`
+}
+
+func apiKeysHandler(db *sql.DB) http.HandlerFunc {
+	return authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) {
+		// Keys can't mint or revoke keys.
+		if currentClaims(r).KeyID != "" {
+			http.Error(w, "api keys can only be managed after logging in", http.StatusForbidden)
+			return
+		}
+		ownerID := currentClaims(r).Sub
+		id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/api_keys"), "/")
+		switch {
+		case id == "" && r.Method == http.MethodGet:
+			listAPIKeys(w, db, ownerID)
+		case id == "" && r.Method == http.MethodPost:
+			createAPIKey(w, r, db, ownerID)
+		case id != "" && r.Method == http.MethodDelete:
+			res, err := db.Exec(`UPDATE api_keys SET revoked_at=now() WHERE id::text=$1 AND owner_id=$2 AND revoked_at IS NULL`, id, ownerID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				http.NotFound(w, nil)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func listAPIKeys(w http.ResponseWriter, db *sql.DB, ownerID string) {
+	rows, err := db.Query(
+		`SELECT id, name, prefix, sandbox, created_at, last_used_at FROM api_keys WHERE owner_id=$1 AND revoked_at IS NULL ORDER BY created_at`,
+		ownerID,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	list := []APIKey{}
+	for rows.Next() {
+		var k APIKey
+		if err := rows.Scan(&k.ID, &k.Name, &k.Prefix, &k.Sandbox, &k.CreatedAt, &k.LastUsedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		list = append(list, k)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func createAPIKey(w http.ResponseWriter, r *http.Request, db *sql.DB, ownerID string) {
+	var req struct {
+		Name    string `json:"name"`
+		Sandbox bool   `json:"sandbox"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Name = sanitizeText(req.Name)
+	if req.Name == "" {
+		http.Error(w, "name is required", http.StatusUnprocessableEntity)
+		return
+	}
+	if req.Sandbox && sandboxDB == nil {
+		http.Error(w, "the sandbox is not enabled on this server", http.StatusUnprocessableEntity)
+		return
+	}
+	secret, err := randomToken(24)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	k := APIKey{Name: req.Name, Sandbox: req.Sandbox, Key: liveKeyPrefix + secret}
+	if req.Sandbox {
+		k.Key = sandboxKeyPrefix + secret
+		if err := ensureSandboxOwner(db, ownerID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	k.Prefix = k.Key[:len(liveKeyPrefix)+4]
+	err = db.QueryRow(
+		`INSERT INTO api_keys (owner_id, name, prefix, key_hash, sandbox) VALUES ($1,$2,$3,$4,$5) RETURNING id, created_at`,
+		ownerID, k.Name, k.Prefix, hashToken(k.Key), k.Sandbox,
+	).Scan(&k.ID, &k.CreatedAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(k)
+}
+
+// withAPIKeys resolves "Authorization: Bearer ck_..." against the key table
+// and serves the request as the key's owner, on the sandbox handler for
+// sandbox keys. Anything else goes to live unchanged.
+func withAPIKeys(db *sql.DB, live, sandbox http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		raw := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if !strings.HasPrefix(raw, liveKeyPrefix) && !strings.HasPrefix(raw, sandboxKeyPrefix) {
+			live.ServeHTTP(w, r)
+			return
+		}
+		c := Claims{Typ: "owner"}
+		err := db.QueryRow(
+			`UPDATE api_keys SET last_used_at=now() WHERE key_hash=$1 AND revoked_at IS NULL RETURNING id, owner_id, sandbox`,
+			hashToken(raw),
+		).Scan(&c.KeyID, &c.Sub, &c.Sandbox)
+		if err == sql.ErrNoRows {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		r = r.WithContext(context.WithValue(r.Context(), claimsKey{}, &c))
+		if !c.Sandbox {
+			live.ServeHTTP(w, r)
+			return
+		}
+		if sandbox == nil {
+			http.Error(w, "the sandbox is not enabled on this server", http.StatusServiceUnavailable)
+			return
+		}
+		sandbox.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,132 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"log"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const archiveBatchSize = 500
+
+// Tables whose rows follow their order into the archive, in insert order.
+var archivedOrderChildren = []string{"order_items", "order_events", "order_amendments", "payment_adjustments", "payments"}
+
+// startArchiver periodically moves finished orders older than the retention
+// period into the *_archive tables, folding them into daily aggregates first
+// so revenue reports keep covering archived periods.
+func startArchiver(db *sql.DB, retentionMonths int, export bool) {
+	go func() {
+		for {
+			n, err := archiveOrders(db, time.Now().AddDate(0, -retentionMonths, 0), export)
+			if err != nil {
+				log.Printf("order archival: %v", err)
+			} else if n > 0 {
+				log.Printf("order archival: archived %d orders", n)
+			}
+			time.Sleep(24 * time.Hour)
+		}
+	}()
+}
+
+func archiveOrders(db *sql.DB, cutoff time.Time, export bool) (int, error) {
+	total := 0
+	for {
+		n, err := archiveBatch(db, cutoff, export)
+		total += n
+		if err != nil || n < archiveBatchSize {
+			return total, err
+		}
+	}
+}
+
+func archiveBatch(db *sql.DB, cutoff time.Time, export bool) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	// Orders with disputes stay live until the dispute history is no longer
+	// needed; they reference the order for evidence and reporting.
+	rows, err := tx.Query(
+		`SELECT id FROM orders o
+		 WHERE ordered_at < $1 AND status IN ('COMPLETED','CANCELLED','FAILED')
+		   AND NOT EXISTS (SELECT 1 FROM disputes d WHERE d.order_id=o.id)
+		 ORDER BY ordered_at LIMIT $2 FOR UPDATE SKIP LOCKED`,
+		cutoff, archiveBatchSize,
+	)
+	if err != nil {
+		return 0, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if len(ids) == 0 {
+		return 0, nil
+	}
+	batch := pq.Array(ids)
+
+	_, err = tx.Exec(
+		`INSERT INTO order_daily_aggregates (establishment_id, day, orders, completed_orders, revenue_cents)
+		 SELECT o.establishment_id, (o.ordered_at AT TIME ZONE 'UTC' AT TIME ZONE e.timezone)::date, COUNT(*),
+		   COUNT(*) FILTER (WHERE o.status='COMPLETED'), COALESCE(SUM(o.total_cents) FILTER (WHERE o.status='COMPLETED'),0)
+		 FROM orders o JOIN establishments e ON e.id=o.establishment_id WHERE o.id = ANY($1) GROUP BY 1, 2
+		 ON CONFLICT (establishment_id, day) DO UPDATE SET
+		   orders=order_daily_aggregates.orders+EXCLUDED.orders,
+		   completed_orders=order_daily_aggregates.completed_orders+EXCLUDED.completed_orders,
+		   revenue_cents=order_daily_aggregates.revenue_cents+EXCLUDED.revenue_cents`,
+		batch,
+	)
+	if err != nil {
+		return 0, err
+	}
+	if _, err := tx.Exec(`INSERT INTO orders_archive SELECT o.*, now() FROM orders o WHERE id = ANY($1)`, batch); err != nil {
+		return 0, err
+	}
+	for _, t := range archivedOrderChildren {
+		if _, err := tx.Exec(`INSERT INTO `+t+`_archive SELECT * FROM `+t+` WHERE order_id = ANY($1)`, batch); err != nil {
+			return 0, err
+		}
+	}
+	if export {
+		if err := exportArchivedOrders(tx, batch); err != nil {
+			return 0, err
+		}
+	}
+	if _, err := tx.Exec(`DELETE FROM orders WHERE id = ANY($1)`, batch); err != nil {
+		return 0, err
+	}
+	return len(ids), tx.Commit()
+}
+
+// exportArchivedOrders writes the batch, items included, as JSON to the
+// configured storage so it can be queried outside the database.
+func exportArchivedOrders(tx *sql.Tx, batch any) error {
+	var data []byte
+	err := tx.QueryRow(
+		`SELECT jsonb_agg(to_jsonb(o) || jsonb_build_object('items',
+		   (SELECT COALESCE(jsonb_agg(to_jsonb(i)), '[]'::jsonb) FROM order_items_archive i WHERE i.order_id=o.id)))
+		 FROM orders_archive o WHERE o.id = ANY($1)`,
+		batch,
+	).Scan(&data)
+	if err != nil {
+		return err
+	}
+	name, err := randomToken(8)
+	if err != nil {
+		return err
+	}
+	key := fmt.Sprintf("archive/orders/%s-%s.json", time.Now().Format("2006-01-02"), name)
+	return storage.Put(context.Background(), key, "application/json", data)
+}
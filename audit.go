@@ -0,0 +1,103 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+type AuditEntry struct {
+	ID              string          `json:"id"`
+	EstablishmentID *string         `json:"establishment_id"`
+	ActorID         *string         `json:"actor_id"`
+	ActorType       string          `json:"actor_type"`
+	ImpersonatorID  *string         `json:"impersonator_id"`
+	Action          string          `json:"action"`
+	EntityType      string          `json:"entity_type"`
+	EntityID        string          `json:"entity_id"`
+	Details         json.RawMessage `json:"details"`
+	CreatedAt       time.Time       `json:"created_at"`
+}
+
+type execer interface {
+	Exec(query string, args ...any) (sql.Result, error)
+}
+
+// recordAudit appends an entry attributed to the authenticated caller, if
+// any. Failures are returned so callers inside a transaction can abort.
+func recordAudit(q execer, r *http.Request, establishmentID, action, entityType, entityID string, details any) error {
+	var actorID, impersonatorID *string
+	actorType := "anonymous"
+	if c := currentClaims(r); c != nil {
+		actorID, actorType = &c.Sub, c.Typ
+		if c.Act != "" {
+			impersonatorID = &c.Act
+		}
+	}
+	var estID *string
+	if establishmentID != "" {
+		estID = &establishmentID
+	}
+	payload, err := json.Marshal(details)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec(
+		`INSERT INTO audit_log (establishment_id, actor_id, actor_type, impersonator_id, action, entity_type, entity_id, details) VALUES ($1,$2,$3,$4,$5,$6,$7,$8)`,
+		estID, actorID, actorType, impersonatorID, action, entityType, entityID, payload,
+	)
+	return err
+}
+
+func auditLogHandler(db *sql.DB) http.HandlerFunc {
+	return authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		establishmentID := r.URL.Query().Get("establishment_id")
+		if establishmentID == "" {
+			http.Error(w, "establishment_id is required", http.StatusBadRequest)
+			return
+		}
+		if !requireRole(w, r, db, establishmentID, "manager") {
+			return
+		}
+		listAuditLog(w, r, db, establishmentID)
+	})
+}
+
+func listAuditLog(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	cursor, limit, err := pageParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	at, id := keysetArgs(cursor)
+	rows, err := db.Query(
+		`SELECT id, establishment_id, actor_id, actor_type, impersonator_id, action, entity_type, entity_id, details, created_at FROM audit_log
+		 WHERE establishment_id=$1 AND (created_at, id) < ($2, $3::uuid)
+		 ORDER BY created_at DESC, id DESC LIMIT $4`,
+		establishmentID, at, id, limit+1,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	list := []AuditEntry{}
+	for rows.Next() {
+		var e AuditEntry
+		var details []byte
+		if err := rows.Scan(&e.ID, &e.EstablishmentID, &e.ActorID, &e.ActorType, &e.ImpersonatorID, &e.Action, &e.EntityType, &e.EntityID, &details, &e.CreatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		e.Details = details
+		list = append(list, e)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newPage(list, limit, func(e AuditEntry) pageCursor { return pageCursor{e.CreatedAt, e.ID} }))
+}
@@ -0,0 +1,474 @@
+package main
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	accessTokenTTL   = time.Hour
+	maxFailedLogins  = 5
+	loginLockout     = 15 * time.Minute
+	loginIPWindow    = time.Minute
+	loginIPMaxInWind = 20
+)
+
+var jwtSecret []byte
+
+type Claims struct {
+	Sub string `json:"sub"`
+	Typ string `json:"typ"`
+	JTI string `json:"jti"`
+	Iat int64  `json:"iat"`
+	Exp int64  `json:"exp"`
+	// Act is the platform admin acting as Sub during a support session.
+	Act string `json:"act,omitempty"`
+	// Sid is the owner session (device) the token belongs to.
+	Sid string `json:"sid,omitempty"`
+	// Dev is the courier device a courier app token is bound to.
+	Dev string `json:"dev,omitempty"`
+	// KeyID and Sandbox are set when the request was made with an API key
+	// rather than a token.
+	KeyID   string `json:"-"`
+	Sandbox bool   `json:"-"`
+}
+
+type Owner struct {
+	ID    string `json:"id"`
+	Name  string `json:"name"`
+	Email string `json:"email"`
+}
+
+type TokenResponse struct {
+	AccessToken string    `json:"access_token"`
+	TokenType   string    `json:"token_type"`
+	ExpiresAt   time.Time `json:"expires_at"`
+	// RefreshToken is set for owner sessions; it can be exchanged once at
+	// POST /auth/refresh for a new pair.
+	RefreshToken string `json:"refresh_token,omitempty"`
+}
+
+type claimsKey struct{}
+
+var errInvalidToken = errors.New("invalid token")
+
+func randomToken(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return base64.RawURLEncoding.EncodeToString(b), nil
+}
+
+func hashToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func signJWT(c Claims) (string, error) {
+	header := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`))
+	body, err := json.Marshal(c)
+	if err != nil {
+		return "", err
+	}
+	unsigned := header + "." + base64.RawURLEncoding.EncodeToString(body)
+	mac := hmac.New(sha256.New, jwtSecret)
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+func parseJWT(token string) (*Claims, error) {
+	parts := strings.Split(token, ".")
+	if len(parts) != 3 {
+		return nil, errInvalidToken
+	}
+	mac := hmac.New(sha256.New, jwtSecret)
+	mac.Write([]byte(parts[0] + "." + parts[1]))
+	sig, err := base64.RawURLEncoding.DecodeString(parts[2])
+	if err != nil || !hmac.Equal(sig, mac.Sum(nil)) {
+		return nil, errInvalidToken
+	}
+	body, err := base64.RawURLEncoding.DecodeString(parts[1])
+	if err != nil {
+		return nil, errInvalidToken
+	}
+	var c Claims
+	if err := json.Unmarshal(body, &c); err != nil {
+		return nil, errInvalidToken
+	}
+	if time.Now().Unix() >= c.Exp {
+		return nil, errInvalidToken
+	}
+	return &c, nil
+}
+
+func issueAccessToken(sub, typ string) (TokenResponse, error) {
+	return issueToken(sub, typ, accessTokenTTL)
+}
+
+func issueToken(sub, typ string, ttl time.Duration) (TokenResponse, error) {
+	return issueClaims(Claims{Sub: sub, Typ: typ}, ttl)
+}
+
+// issueClaims signs c with a fresh JTI, valid for ttl from now.
+func issueClaims(c Claims, ttl time.Duration) (TokenResponse, error) {
+	jti, err := randomToken(16)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	now := time.Now()
+	exp := now.Add(ttl)
+	c.JTI, c.Iat, c.Exp = jti, now.Unix(), exp.Unix()
+	token, err := signJWT(c)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	return TokenResponse{AccessToken: token, TokenType: "Bearer", ExpiresAt: exp}, nil
+}
+
+// authenticate validates the bearer token, rejects revoked tokens, tokens of
+// revoked sessions and tokens issued before the account's last global
+// sign-out, and stores the claims in the request context.
+func authenticate(db *sql.DB, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if c := currentClaims(r); c != nil && c.KeyID != "" {
+			next(w, r)
+			return
+		}
+		raw := strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")
+		c, err := parseJWT(raw)
+		if err != nil {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var revoked bool
+		err = db.QueryRow(
+			`SELECT EXISTS(SELECT 1 FROM revoked_tokens WHERE jti=$1)
+			   OR ($2 IN ('owner','owner_enroll','legal') AND COALESCE((SELECT tokens_valid_after > to_timestamp($3)::timestamp FROM owners WHERE id=$4), true))
+			   OR ($5 <> '' AND NOT EXISTS(SELECT 1 FROM owner_sessions WHERE id::text=$5 AND owner_id::text=$4 AND revoked_at IS NULL))`,
+			c.JTI, c.Typ, c.Iat, c.Sub, c.Sid,
+		).Scan(&revoked)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if revoked {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		if c.Act != "" && !checkImpersonation(w, r, db, c) {
+			return
+		}
+		if c.Sid != "" {
+			touchSession(db, r, c.Sid)
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), claimsKey{}, c)))
+	}
+}
+
+func authenticateOwner(db *sql.DB, next http.HandlerFunc) http.HandlerFunc {
+	return authenticate(db, func(w http.ResponseWriter, r *http.Request) {
+		if currentClaims(r).Typ != "owner" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	})
+}
+
+func authenticateCustomer(db *sql.DB, next http.HandlerFunc) http.HandlerFunc {
+	return authenticate(db, func(w http.ResponseWriter, r *http.Request) {
+		if currentClaims(r).Typ != "customer" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		next(w, r)
+	})
+}
+
+func currentClaims(r *http.Request) *Claims {
+	c, _ := r.Context().Value(claimsKey{}).(*Claims)
+	return c
+}
+
+func clientIP(r *http.Request) string {
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// windowLimiter allows at most max calls per key within a sliding window.
+// Keys whose calls all left the window are dropped, on their next call or by
+// a sweep once per window, so per-IP limiters don't grow without bound.
+type windowLimiter struct {
+	window    time.Duration
+	max       int
+	mu        sync.Mutex
+	attempts  map[string][]time.Time
+	lastSweep time.Time
+}
+
+func newWindowLimiter(window time.Duration, max int) *windowLimiter {
+	return &windowLimiter{window: window, max: max, attempts: map[string][]time.Time{}}
+}
+
+var loginAttempts = newWindowLimiter(loginIPWindow, loginIPMaxInWind)
+
+func (l *windowLimiter) allow(key string) bool {
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	now := time.Now()
+	if now.Sub(l.lastSweep) >= l.window {
+		for k := range l.attempts {
+			l.prune(k, now)
+		}
+		l.lastSweep = now
+	}
+	recent := l.prune(key, now)
+	if len(recent) >= l.max {
+		return false
+	}
+	l.attempts[key] = append(recent, now)
+	return true
+}
+
+// prune drops key's calls that left the window, and key itself when none
+// are left, returning the calls still inside it. l.mu must be held.
+func (l *windowLimiter) prune(key string, now time.Time) []time.Time {
+	recent := l.attempts[key][:0]
+	for _, t := range l.attempts[key] {
+		if now.Sub(t) < l.window {
+			recent = append(recent, t)
+		}
+	}
+	if len(recent) == 0 {
+		delete(l.attempts, key)
+		return nil
+	}
+	l.attempts[key] = recent
+	return recent
+}
+
+func authHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/auth/")
+		switch {
+		case path == "register" && r.Method == http.MethodPost:
+			registerOwner(w, r, db)
+		case path == "login" && r.Method == http.MethodPost:
+			loginOwner(w, r, db)
+		case path == "refresh" && r.Method == http.MethodPost:
+			refreshSession(w, r, db)
+		case path == "logout" && r.Method == http.MethodPost && r.Header.Get("Authorization") == "":
+			logoutRefreshToken(w, r, db)
+		case path == "logout" && r.Method == http.MethodPost:
+			authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { logout(w, r, db) })(w, r)
+		case path == "logout_all" && r.Method == http.MethodPost:
+			authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { logoutAll(w, r, db) })(w, r)
+		case path == "sessions" || strings.HasPrefix(path, "sessions/"):
+			authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) {
+				sessionsRoute(w, r, db, strings.TrimPrefix(strings.TrimPrefix(path, "sessions"), "/"))
+			})(w, r)
+		case path == "me" && r.Method == http.MethodGet:
+			authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { getMe(w, r, db) })(w, r)
+		case path == "password" && r.Method == http.MethodPut:
+			authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { changePassword(w, r, db) })(w, r)
+		case path == "password_reset" && r.Method == http.MethodPost:
+			requestPasswordReset(w, r, db)
+		case path == "password_reset/confirm" && r.Method == http.MethodPost:
+			confirmPasswordReset(w, r, db)
+		case path == "email_change" && r.Method == http.MethodPost:
+			authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { requestEmailChange(w, r, db) })(w, r)
+		case path == "email_change/confirm" && r.Method == http.MethodPost:
+			confirmEmailChange(w, r, db)
+		case strings.HasPrefix(path, "2fa/"):
+			twoFactorRoute(w, r, db, strings.TrimPrefix(path, "2fa/"))
+		case strings.HasPrefix(path, "oauth/"):
+			oauthRoute(w, r, db, strings.TrimPrefix(path, "oauth/"))
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func registerOwner(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var req struct {
+		Name     string `json:"name"`
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Email = strings.ToLower(strings.TrimSpace(req.Email))
+	if req.Name == "" || !strings.Contains(req.Email, "@") {
+		http.Error(w, "name and a valid email are required", http.StatusBadRequest)
+		return
+	}
+	if err := validatePasswordStrength(req.Password, req.Email); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	hash, err := hashPassword(req.Password)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	o := Owner{Name: req.Name, Email: req.Email}
+	err = db.QueryRow(
+		`INSERT INTO owners (name, email, password_hash) VALUES ($1,$2,$3) ON CONFLICT (email) DO NOTHING RETURNING id`,
+		o.Name, o.Email, hash,
+	).Scan(&o.ID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "email already registered", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(o)
+}
+
+func loginOwner(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if !loginAttempts.allow(clientIP(r)) {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "too many login attempts", http.StatusTooManyRequests)
+		return
+	}
+	var req struct {
+		Email    string `json:"email"`
+		Password string `json:"password"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	var id, hash string
+	var locked bool
+	err := db.QueryRow(
+		`SELECT id, password_hash, COALESCE(locked_until > now(), false) FROM owners WHERE email=$1`,
+		strings.ToLower(strings.TrimSpace(req.Email)),
+	).Scan(&id, &hash, &locked)
+	if err == sql.ErrNoRows {
+		http.Error(w, "invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if locked {
+		http.Error(w, "account temporarily locked", http.StatusLocked)
+		return
+	}
+	if !checkPassword(hash, req.Password) {
+		if _, err := recordFailedLogin(db, id); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, "invalid credentials", http.StatusUnauthorized)
+		return
+	}
+	if _, err := db.Exec(`UPDATE owners SET failed_logins=0, locked_until=NULL WHERE id=$1`, id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if !requireLegalAcceptance(w, r, db, "owner", id) {
+		return
+	}
+	resp, err := ownerLoginResponse(db, r, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// recordFailedLogin counts a failed password or 2FA check against the owner
+// and locks the account for loginLockout after maxFailedLogins in a row. It
+// reports whether the account is now locked.
+func recordFailedLogin(db *sql.DB, ownerID string) (bool, error) {
+	var locked bool
+	err := db.QueryRow(
+		`UPDATE owners SET failed_logins=failed_logins+1,
+		   locked_until=CASE WHEN failed_logins+1 >= $1 THEN now() + $2 * interval '1 second' ELSE locked_until END
+		 WHERE id=$3
+		 RETURNING COALESCE(locked_until > now(), false)`,
+		maxFailedLogins, int(loginLockout.Seconds()), ownerID,
+	).Scan(&locked)
+	return locked, err
+}
+
+// revokeToken blocks c's token until it expires.
+func revokeToken(db *sql.DB, c *Claims) error {
+	_, err := db.Exec(
+		`INSERT INTO revoked_tokens (jti, subject_id, expires_at) VALUES ($1,$2,to_timestamp($3)::timestamp) ON CONFLICT (jti) DO NOTHING`,
+		c.JTI, c.Sub, c.Exp,
+	)
+	return err
+}
+
+func logout(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	c := currentClaims(r)
+	err := revokeToken(db, c)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	db.Exec(`DELETE FROM revoked_tokens WHERE expires_at < now()`)
+	if c.Sid != "" {
+		if _, err := db.Exec(`UPDATE owner_sessions SET revoked_at=now() WHERE id=$1 AND revoked_at IS NULL`, c.Sid); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func logoutAll(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if _, err := db.Exec(`UPDATE owners SET tokens_valid_after=now() WHERE id=$1`, currentClaims(r).Sub); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := db.Exec(`UPDATE owner_sessions SET revoked_at=now() WHERE owner_id=$1 AND revoked_at IS NULL`, currentClaims(r).Sub); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func getMe(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var o Owner
+	err := db.QueryRow(`SELECT id, name, email FROM owners WHERE id=$1`, currentClaims(r).Sub).Scan(&o.ID, &o.Name, &o.Email)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, nil)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(o)
+}
@@ -0,0 +1,28 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestWindowLimiter(t *testing.T) {
+	l := newWindowLimiter(50*time.Millisecond, 2)
+	if !l.allow("a") || !l.allow("a") || l.allow("a") {
+		t.Fatal("limiter didn't stop the third call in the window")
+	}
+	time.Sleep(60 * time.Millisecond)
+	if !l.allow("a") {
+		t.Fatal("limiter still blocking after the window")
+	}
+
+	for _, k := range []string{"b", "c", "d"} {
+		l.allow(k)
+	}
+	time.Sleep(60 * time.Millisecond)
+	l.allow("e")
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if len(l.attempts) != 1 {
+		t.Fatalf("%d keys kept after their window, want only e", len(l.attempts))
+	}
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"time"
+)
+
+const autoCancelEvery = time.Minute
+
+var (
+	ordersPlaced        = newCounter("orders_placed_total", "Orders placed through checkout.", "establishment_id")
+	ordersAutoCancelled = newCounter("orders_auto_cancelled_total", "Orders cancelled because nobody accepted them in time.", "establishment_id")
+)
+
+// Payment methods charged at checkout, which need a refund on cancellation.
+var prepaidMethods = map[string]bool{"pix": true, "online_card": true}
+
+func startAutoCanceller(db *sql.DB) {
+	go func() {
+		for {
+			if n, err := autoCancelOrders(db); err != nil {
+				log.Printf("auto-cancel: %v", err)
+			} else if n > 0 {
+				log.Printf("auto-cancel: cancelled %d orders", n)
+			}
+			time.Sleep(autoCancelEvery)
+		}
+	}()
+}
+
+// autoCancelOrders cancels pending orders older than their establishment's
+// auto_cancel_minutes, one transaction per order so a failure only affects
+// that order.
+func autoCancelOrders(db *sql.DB) (int, error) {
+	rows, err := db.Query(
+		`SELECT o.id FROM orders o JOIN establishments e ON e.id=o.establishment_id
+		 WHERE o.status='PENDING' AND e.auto_cancel_minutes IS NOT NULL
+		   AND o.ordered_at < now() - make_interval(mins => e.auto_cancel_minutes)
+		 ORDER BY o.ordered_at LIMIT 500`,
+	)
+	if err != nil {
+		return 0, err
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	n := 0
+	for _, id := range ids {
+		ok, err := autoCancelOrder(db, id)
+		if err != nil {
+			log.Printf("auto-cancel %s: %v", id, err)
+			continue
+		}
+		if ok {
+			n++
+		}
+	}
+	return n, nil
+}
+
+func autoCancelOrder(db *sql.DB, orderID string) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	// The status condition makes a concurrent manual accept win the race.
+	var establishmentID, customerID, paymentMethod string
+	var total, credit, giftCards int64
+	var slotID *string
+	var minutes int
+	err = tx.QueryRow(
+		`UPDATE orders o SET status='CANCELLED', updated_at=now()
+		 FROM establishments e
+		 WHERE o.id=$1 AND o.status='PENDING' AND e.id=o.establishment_id
+		 RETURNING o.establishment_id, o.customer_id, o.payment_method, o.total_cents, o.store_credit_cents, o.gift_card_cents, o.slot_id, e.auto_cancel_minutes`,
+		orderID,
+	).Scan(&establishmentID, &customerID, &paymentMethod, &total, &credit, &giftCards, &slotID, &minutes)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	payload, _ := json.Marshal(map[string]any{"reason": "not_accepted", "timeout_minutes": minutes})
+	if _, err := tx.Exec(`INSERT INTO order_events (order_id, event_type, payload) VALUES ($1,'AUTO_CANCELLED',$2)`, orderID, payload); err != nil {
+		return false, err
+	}
+	// Store credit and gift card balances are given back; only the rest is
+	// refunded.
+	if credit > 0 {
+		if err := postStoreCredit(tx, customerID, establishmentID, credit, "cancellation", &orderID, ""); err != nil {
+			return false, err
+		}
+	}
+	if giftCards > 0 {
+		if err := restoreGiftCards(tx, orderID); err != nil {
+			return false, err
+		}
+	}
+	if due := total - credit - giftCards; prepaidMethods[paymentMethod] && due > 0 {
+		if _, err := tx.Exec(`INSERT INTO payment_adjustments (order_id, kind, amount_cents) VALUES ($1,'refund',$2)`, orderID, due); err != nil {
+			return false, err
+		}
+	}
+	if err := releaseOrderResources(tx, orderID, establishmentID, slotID); err != nil {
+		return false, err
+	}
+	if err := enqueueEvent(tx, Event{Type: eventOrderCancelled, OrderID: orderID, EstablishmentID: establishmentID}); err != nil {
+		return false, err
+	}
+	if err := tx.Commit(); err != nil {
+		return false, err
+	}
+	ordersAutoCancelled.Inc(establishmentID)
+	notifyAutoCancelled(db, orderID, prepaidMethods[paymentMethod])
+	return true, nil
+}
+
+// releaseOrderResources returns tracked stock and the booked delivery slot
+// held by a cancelled order.
+func releaseOrderResources(tx *sql.Tx, orderID, establishmentID string, slotID *string) error {
+	rows, err := tx.Query(
+		`UPDATE products p SET stock_quantity=p.stock_quantity+i.quantity, updated_at=now()
+		 FROM order_items i WHERE i.order_id=$1 AND p.id=i.product_id AND p.stock_quantity IS NOT NULL
+		 RETURNING p.id, p.stock_quantity`,
+		orderID,
+	)
+	if err != nil {
+		return err
+	}
+	type level struct {
+		id    string
+		stock int
+	}
+	var levels []level
+	for rows.Next() {
+		var l level
+		if err := rows.Scan(&l.id, &l.stock); err != nil {
+			rows.Close()
+			return err
+		}
+		levels = append(levels, l)
+	}
+	rows.Close()
+	for _, l := range levels {
+		if err := enqueueStockEvents(tx, establishmentID, l.id, l.stock); err != nil {
+			return err
+		}
+	}
+	if slotID != nil {
+		if _, err := tx.Exec(`UPDATE delivery_slots SET booked=GREATEST(booked-1, 0) WHERE id=$1`, *slotID); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func notifyAutoCancelled(db *sql.DB, orderID string, refunded bool) {
+	var email, establishment string
+	var number int
+	err := db.QueryRow(
+		`SELECT c.email, e.name, o.order_number FROM orders o JOIN customers c ON c.id=o.customer_id JOIN establishments e ON e.id=o.establishment_id WHERE o.id=$1`,
+		orderID,
+	).Scan(&email, &establishment, &number)
+	if err != nil {
+		log.Printf("auto-cancel notify %s: %v", orderID, err)
+		return
+	}
+	body := fmt.Sprintf("Seu pedido %s em %s foi cancelado porque o estabelecimento não o aceitou a tempo.", formatOrderNumber(number), establishment)
+	if refunded {
+		body += "\n\nO valor pago será estornado automaticamente."
+	}
+	if err := mailer.Send(email, "Pedido "+formatOrderNumber(number)+" cancelado", body); err != nil {
+		log.Printf("auto-cancel notify %s: %v", orderID, err)
+	}
+}
@@ -0,0 +1,374 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Badges are short labels shown on product cards ("Novo", "Mais pedido",
+// "-20%"). Managers assign manual badges to products; badges with a rule are
+// assigned by startBadgeRefresher instead: top_sellers marks the best sellers
+// of the last rule_days days and new_products the products created in them.
+// A badge past its expires_at, or an assignment past its own, is no longer
+// shown.
+
+const (
+	badgeRefreshEvery = time.Hour
+	maxProductBadges  = 3
+	maxBadgeLabel     = 20
+)
+
+var (
+	badgeRules        = map[string]bool{"top_sellers": true, "new_products": true}
+	badgeColorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+)
+
+type Badge struct {
+	ID              string `json:"id"`
+	EstablishmentID string `json:"establishment_id"`
+	Label           string `json:"label"`
+	// Color and TextColor are hex colors like #e53935.
+	Color     string `json:"color"`
+	TextColor string `json:"text_color"`
+	// Rule is top_sellers, new_products or nil for a manual badge.
+	Rule *string `json:"rule"`
+	// RuleDays is the window the rule looks at and RuleLimit how many
+	// products top_sellers marks.
+	RuleDays  int        `json:"rule_days,omitempty"`
+	RuleLimit int        `json:"rule_limit,omitempty"`
+	ExpiresAt *time.Time `json:"expires_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+// ProductBadge is a badge as shown with a product in the menu.
+type ProductBadge struct {
+	ID        string `json:"id"`
+	Label     string `json:"label"`
+	Color     string `json:"color"`
+	TextColor string `json:"text_color"`
+}
+
+type BadgeAssignment struct {
+	BadgeID   string     `json:"badge_id"`
+	ExpiresAt *time.Time `json:"expires_at"`
+}
+
+func establishmentBadgesRoute(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID, badgeID string) {
+	if !requireRole(w, r, db, establishmentID, "manager") {
+		return
+	}
+	switch {
+	case badgeID == "" && r.Method == http.MethodGet:
+		listBadges(w, db, establishmentID)
+	case badgeID == "" && r.Method == http.MethodPost:
+		saveBadge(w, r, db, establishmentID, "")
+	case badgeID != "" && r.Method == http.MethodPut:
+		saveBadge(w, r, db, establishmentID, badgeID)
+	case badgeID != "" && r.Method == http.MethodDelete:
+		res, err := db.Exec(`DELETE FROM badges WHERE id::text=$1 AND establishment_id=$2`, badgeID, establishmentID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.NotFound(w, nil)
+			return
+		}
+		responseCache.Invalidate(establishmentID)
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+const badgeColumns = `id, establishment_id, label, color, text_color, rule, rule_days, rule_limit, expires_at, created_at`
+
+func scanBadge(row interface{ Scan(...any) error }) (Badge, error) {
+	var b Badge
+	err := row.Scan(&b.ID, &b.EstablishmentID, &b.Label, &b.Color, &b.TextColor, &b.Rule, &b.RuleDays, &b.RuleLimit, &b.ExpiresAt, &b.CreatedAt)
+	return b, err
+}
+
+func listBadges(w http.ResponseWriter, db *sql.DB, establishmentID string) {
+	rows, err := db.Query(`SELECT `+badgeColumns+` FROM badges WHERE establishment_id=$1 ORDER BY created_at`, establishmentID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	list := []Badge{}
+	for rows.Next() {
+		b, err := scanBadge(rows)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		list = append(list, b)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// saveBadge creates a badge, or replaces one when badgeID is set. Rule
+// badges are refreshed right away so they show without waiting for the
+// next run.
+func saveBadge(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID, badgeID string) {
+	var b Badge
+	if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if msg := validateBadge(&b); msg != "" {
+		http.Error(w, msg, http.StatusUnprocessableEntity)
+		return
+	}
+	var err error
+	if badgeID == "" {
+		b, err = scanBadge(db.QueryRow(
+			`INSERT INTO badges (establishment_id, label, color, text_color, rule, rule_days, rule_limit, expires_at)
+			 VALUES ($1,$2,$3,$4,$5,$6,$7,$8) RETURNING `+badgeColumns,
+			establishmentID, b.Label, b.Color, b.TextColor, b.Rule, b.RuleDays, b.RuleLimit, b.ExpiresAt,
+		))
+	} else {
+		b, err = scanBadge(db.QueryRow(
+			`UPDATE badges SET label=$3, color=$4, text_color=$5, rule=$6, rule_days=$7, rule_limit=$8, expires_at=$9
+			 WHERE id::text=$1 AND establishment_id=$2 RETURNING `+badgeColumns,
+			badgeID, establishmentID, b.Label, b.Color, b.TextColor, b.Rule, b.RuleDays, b.RuleLimit, b.ExpiresAt,
+		))
+	}
+	if err == sql.ErrNoRows {
+		http.NotFound(w, nil)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := refreshBadge(db, b); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	responseCache.Invalidate(establishmentID)
+	w.Header().Set("Content-Type", "application/json")
+	if badgeID == "" {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(b)
+}
+
+func validateBadge(b *Badge) string {
+	if b.Label = sanitizeText(b.Label); b.Label == "" || len([]rune(b.Label)) > maxBadgeLabel {
+		return "label must have between 1 and 20 characters"
+	}
+	if b.TextColor == "" {
+		b.TextColor = "#ffffff"
+	}
+	if !badgeColorPattern.MatchString(b.Color) || !badgeColorPattern.MatchString(b.TextColor) {
+		return "color and text_color must be hex colors like #e53935"
+	}
+	b.Color, b.TextColor = strings.ToLower(b.Color), strings.ToLower(b.TextColor)
+	if b.Rule == nil {
+		b.RuleDays, b.RuleLimit = 0, 0
+		return ""
+	}
+	if !badgeRules[*b.Rule] {
+		return "rule must be top_sellers or new_products"
+	}
+	if b.RuleDays == 0 {
+		b.RuleDays = 7
+	}
+	if b.RuleDays < 1 || b.RuleDays > 90 {
+		return "rule_days must be between 1 and 90"
+	}
+	if *b.Rule == "new_products" {
+		b.RuleLimit = 0
+		return ""
+	}
+	if b.RuleLimit == 0 {
+		b.RuleLimit = 3
+	}
+	if b.RuleLimit < 1 || b.RuleLimit > 20 {
+		return "rule_limit must be between 1 and 20"
+	}
+	return ""
+}
+
+// setProductBadges serves PUT /products/{id}/badges, replacing the
+// product's manual badges. Rule badges are left to the refresher.
+func setProductBadges(w http.ResponseWriter, r *http.Request, db *sql.DB, productID string) {
+	var establishmentID string
+	err := db.QueryRow(`SELECT establishment_id FROM products WHERE id::text=$1`, productID).Scan(&establishmentID)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, nil)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !requireRole(w, r, db, establishmentID, "manager") {
+		return
+	}
+	var assignments []BadgeAssignment
+	if err := json.NewDecoder(r.Body).Decode(&assignments); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(assignments) > maxProductBadges {
+		http.Error(w, "a product can have at most 3 manual badges", http.StatusUnprocessableEntity)
+		return
+	}
+	ids := make([]string, len(assignments))
+	expires := make([]*time.Time, len(assignments))
+	for i, a := range assignments {
+		ids[i], expires[i] = a.BadgeID, a.ExpiresAt
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	var valid int
+	err = tx.QueryRow(
+		`SELECT COUNT(*) FROM badges WHERE id::text = ANY($1) AND establishment_id=$2 AND rule IS NULL`,
+		pq.Array(ids), establishmentID,
+	).Scan(&valid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if valid != len(ids) {
+		http.Error(w, "badges must be manual badges of the product's establishment, listed once", http.StatusUnprocessableEntity)
+		return
+	}
+	if _, err := tx.Exec(`DELETE FROM product_badges WHERE product_id=$1 AND NOT automatic`, productID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i := range ids {
+		_, err := tx.Exec(`INSERT INTO product_badges (product_id, badge_id, expires_at) VALUES ($1,$2,$3)`, productID, ids[i], expires[i])
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	responseCache.Invalidate(establishmentID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// loadMenuBadges returns the badges currently shown for the
+// establishment's products, by product id.
+func loadMenuBadges(db *sql.DB, establishmentID string) (map[string][]ProductBadge, error) {
+	rows, err := db.Query(
+		`SELECT pb.product_id, b.id, b.label, b.color, b.text_color FROM product_badges pb JOIN badges b ON b.id=pb.badge_id
+		 WHERE b.establishment_id=$1 AND (b.expires_at IS NULL OR b.expires_at > now()) AND (pb.expires_at IS NULL OR pb.expires_at > now())
+		 ORDER BY pb.automatic DESC, b.created_at`,
+		establishmentID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	byProduct := map[string][]ProductBadge{}
+	for rows.Next() {
+		var productID string
+		var b ProductBadge
+		if err := rows.Scan(&productID, &b.ID, &b.Label, &b.Color, &b.TextColor); err != nil {
+			return nil, err
+		}
+		byProduct[productID] = append(byProduct[productID], b)
+	}
+	return byProduct, rows.Err()
+}
+
+// startBadgeRefresher reassigns rule badges periodically, as sales and the
+// catalog change.
+func startBadgeRefresher(db *sql.DB) {
+	go func() {
+		for {
+			if err := refreshRuleBadges(db); err != nil {
+				log.Printf("badge refresh: %v", err)
+			}
+			time.Sleep(badgeRefreshEvery)
+		}
+	}()
+}
+
+func refreshRuleBadges(db *sql.DB) error {
+	rows, err := db.Query(`SELECT ` + badgeColumns + ` FROM badges WHERE rule IS NOT NULL AND (expires_at IS NULL OR expires_at > now())`)
+	if err != nil {
+		return err
+	}
+	var list []Badge
+	for rows.Next() {
+		b, err := scanBadge(rows)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		list = append(list, b)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, b := range list {
+		if err := refreshBadge(db, b); err != nil {
+			return err
+		}
+		responseCache.Invalidate(b.EstablishmentID)
+	}
+	return nil
+}
+
+// refreshBadge replaces a rule badge's assignments. A manual badge only
+// loses the automatic ones it had while it had a rule.
+func refreshBadge(db *sql.DB, b Badge) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	if b.Rule == nil {
+		if _, err := tx.Exec(`DELETE FROM product_badges WHERE badge_id=$1 AND automatic`, b.ID); err != nil {
+			return err
+		}
+		return tx.Commit()
+	}
+	if _, err := tx.Exec(`DELETE FROM product_badges WHERE badge_id=$1`, b.ID); err != nil {
+		return err
+	}
+	switch *b.Rule {
+	case "top_sellers":
+		_, err = tx.Exec(
+			`INSERT INTO product_badges (product_id, badge_id, automatic)
+			 SELECT oi.product_id, $1, true FROM order_items oi
+			 JOIN orders o ON o.id=oi.order_id JOIN products p ON p.id=oi.product_id AND p.is_active
+			 WHERE o.establishment_id=$2 AND o.status='COMPLETED' AND o.ordered_at >= now() - make_interval(days => $3)
+			 GROUP BY oi.product_id ORDER BY SUM(oi.quantity) DESC, oi.product_id LIMIT $4`,
+			b.ID, b.EstablishmentID, b.RuleDays, b.RuleLimit,
+		)
+	case "new_products":
+		_, err = tx.Exec(
+			`INSERT INTO product_badges (product_id, badge_id, automatic)
+			 SELECT id, $1, true FROM products WHERE establishment_id=$2 AND is_active AND created_at >= now() - make_interval(days => $3)`,
+			b.ID, b.EstablishmentID, b.RuleDays,
+		)
+	}
+	if err != nil {
+		return err
+	}
+	return tx.Commit()
+}
@@ -0,0 +1,176 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// normalizeBarcode trims the barcode, clears it when empty and checks that it
+// is a GTIN (EAN-8, UPC-A, EAN-13 or GTIN-14) with a valid check digit.
+func normalizeBarcode(code **string) string {
+	if *code == nil {
+		return ""
+	}
+	c := strings.TrimSpace(**code)
+	if c == "" {
+		*code = nil
+		return ""
+	}
+	if !validGTIN(c) {
+		return "barcode must be a valid EAN-8, UPC-A, EAN-13 or GTIN-14"
+	}
+	*code = &c
+	return ""
+}
+
+func validGTIN(code string) bool {
+	switch len(code) {
+	case 8, 12, 13, 14:
+	default:
+		return false
+	}
+	sum := 0
+	for i := len(code) - 1; i >= 0; i-- {
+		d := int(code[i] - '0')
+		if d < 0 || d > 9 {
+			return false
+		}
+		// Weights alternate 3,1 from the digit left of the check digit.
+		if (len(code)-1-i)%2 == 1 {
+			d *= 3
+		}
+		sum += d
+	}
+	return sum%10 == 0
+}
+
+func isUniqueViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23505"
+}
+
+func isForeignKeyViolation(err error) bool {
+	var pqErr *pq.Error
+	return errors.As(err, &pqErr) && pqErr.Code == "23503"
+}
+
+type BarcodeInfo struct {
+	Name        string
+	Description string
+}
+
+// ProductDatabase looks up catalog data for a barcode. Lookup returns nil
+// when the code is unknown.
+type ProductDatabase interface {
+	Name() string
+	Lookup(ctx context.Context, code string) (*BarcodeInfo, error)
+}
+
+// productDatabase is nil when barcode enrichment is disabled.
+var productDatabase ProductDatabase
+
+// newProductDatabaseFromEnv enables enrichment with
+// BARCODE_LOOKUP_PROVIDER=openfoodfacts.
+func newProductDatabaseFromEnv() ProductDatabase {
+	switch os.Getenv("BARCODE_LOOKUP_PROVIDER") {
+	case "openfoodfacts":
+		return openFoodFacts{}
+	case "":
+		return nil
+	default:
+		log.Printf("unknown BARCODE_LOOKUP_PROVIDER %q, barcode enrichment disabled", os.Getenv("BARCODE_LOOKUP_PROVIDER"))
+		return nil
+	}
+}
+
+type openFoodFacts struct{}
+
+func (openFoodFacts) Name() string { return "openfoodfacts" }
+
+func (openFoodFacts) Lookup(ctx context.Context, code string) (*BarcodeInfo, error) {
+	var body struct {
+		Status  int `json:"status"`
+		Product struct {
+			Name     string `json:"product_name_pt"`
+			NameAny  string `json:"product_name"`
+			Brands   string `json:"brands"`
+			Quantity string `json:"quantity"`
+		} `json:"product"`
+	}
+	endpoint := "https://world.openfoodfacts.org/api/v2/product/" + url.PathEscape(code) + ".json?fields=product_name_pt,product_name,brands,quantity"
+	if err := getJSON(ctx, endpoint, &body); err != nil {
+		return nil, err
+	}
+	if body.Status != 1 {
+		return nil, nil
+	}
+	info := &BarcodeInfo{Name: body.Product.Name}
+	if info.Name == "" {
+		info.Name = body.Product.NameAny
+	}
+	var details []string
+	for _, s := range []string{body.Product.Brands, body.Product.Quantity} {
+		if s != "" {
+			details = append(details, s)
+		}
+	}
+	info.Description = strings.Join(details, " · ")
+	return info, nil
+}
+
+// enrichFromBarcode fills a new product's empty name and description from the
+// product database. Lookup failures are logged and leave the product as is.
+func enrichFromBarcode(ctx context.Context, p *Product) {
+	if productDatabase == nil || p.Barcode == nil || p.Name != "" {
+		return
+	}
+	info, err := productDatabase.Lookup(ctx, *p.Barcode)
+	if err != nil {
+		log.Printf("barcode lookup via %s failed: %v", productDatabase.Name(), err)
+		return
+	}
+	if info == nil {
+		return
+	}
+	p.Name = info.Name
+	if p.Description == "" {
+		p.Description = info.Description
+	}
+}
+
+// getProductByBarcode finds an establishment's product by barcode, for POS
+// integrations that scan items.
+func getProductByBarcode(w http.ResponseWriter, r *http.Request, db *sql.DB, code string) {
+	establishmentID := r.URL.Query().Get("establishment_id")
+	if establishmentID == "" {
+		http.Error(w, "establishment_id is required", http.StatusBadRequest)
+		return
+	}
+	if !requireRole(w, r, db, establishmentID, "staff") {
+		return
+	}
+	var p Product
+	err := db.QueryRow(`SELECT id, establishment_id, category_id, name, description, price_cents, image_key, image_alt_text, banner_key, is_active, fulfillment_types, stock_quantity, barcode FROM products WHERE establishment_id=$1 AND barcode=$2`, establishmentID, code).Scan(
+		&p.ID, &p.EstablishmentID, &p.CategoryID, &p.Name, &p.Description, &p.PriceCents, &p.ImageKey, &p.AltText, &p.BannerKey, &p.IsActive, pq.Array(&p.FulfillmentTypes), &p.Stock, &p.Barcode,
+	)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, nil)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p.ImageURL, p.BannerURL = assetURL(p.ImageKey), assetURL(p.BannerKey)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(p)
+}
@@ -0,0 +1,516 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	maxBatchStops = 8
+	// stopHandoverTime is added per stop ahead in the route when estimating
+	// a customer's arrival: parking, stairs, payment at the door.
+	stopHandoverTime = 3 * time.Minute
+)
+
+// DeliveryBatch is one courier trip with several drop-offs, delivered in
+// Sequence order.
+type DeliveryBatch struct {
+	ID          string      `json:"id"`
+	CourierID   string      `json:"courier_id"`
+	Status      string      `json:"status"` // planned, in_progress, completed or cancelled
+	Stops       []BatchStop `json:"stops"`
+	CreatedAt   time.Time   `json:"created_at"`
+	StartedAt   *time.Time  `json:"started_at"`
+	CompletedAt *time.Time  `json:"completed_at"`
+}
+
+// BatchStop is one order in a batch. The leg is the way from the previous
+// stop, or from the establishment for the first one.
+type BatchStop struct {
+	OrderID         string     `json:"order_id"`
+	DisplayNumber   string     `json:"display_number"`
+	Sequence        int        `json:"sequence"`
+	Status          string     `json:"status"` // pending, en_route, delivered, failed or cancelled
+	DeliveryAddress string     `json:"delivery_address"`
+	LegMeters       int        `json:"leg_meters"`
+	LegSeconds      int        `json:"leg_seconds"`
+	DeliveredAt     *time.Time `json:"delivered_at"`
+}
+
+func batchesRoute(w http.ResponseWriter, r *http.Request, db *sql.DB, c *Courier, rest []string) {
+	switch {
+	case len(rest) == 0 && r.Method == http.MethodGet:
+		listBatches(w, db, c)
+	case len(rest) == 0 && r.Method == http.MethodPost:
+		createBatch(w, r, db, c)
+	case len(rest) == 1 && r.Method == http.MethodGet:
+		b, err := loadBatch(db, c.ID, rest[0])
+		if err == sql.ErrNoRows {
+			http.NotFound(w, nil)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(b)
+	case len(rest) == 2 && rest[1] == "start" && r.Method == http.MethodPost:
+		startBatch(w, db, c, rest[0])
+	case len(rest) == 2 && rest[1] == "cancel" && r.Method == http.MethodPost:
+		cancelBatch(w, db, c, rest[0])
+	case len(rest) == 3 && rest[1] == "stops" && r.Method == http.MethodPut:
+		updateBatchStop(w, r, db, c, rest[0], rest[2])
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+type batchCandidate struct {
+	id, address string
+	number      int
+	to          Address
+}
+
+// sequenceStops orders the drop-offs by repeatedly going to the nearest
+// remaining one. Orders without coordinates can't be placed and go last, in
+// the order they were given.
+func sequenceStops(origin Address, stops []batchCandidate) []batchCandidate {
+	var located, unlocated []batchCandidate
+	for _, s := range stops {
+		if s.to.Lat != nil && s.to.Lng != nil {
+			located = append(located, s)
+		} else {
+			unlocated = append(unlocated, s)
+		}
+	}
+	if origin.Lat == nil || origin.Lng == nil {
+		return stops
+	}
+	out := make([]batchCandidate, 0, len(stops))
+	at := origin
+	for len(located) > 0 {
+		best := 0
+		for i := range located {
+			if straightLineMeters(at, located[i].to) < straightLineMeters(at, located[best].to) {
+				best = i
+			}
+		}
+		at = located[best].to
+		out = append(out, located[best])
+		located = append(located[:best], located[best+1:]...)
+	}
+	return append(out, unlocated...)
+}
+
+func createBatch(w http.ResponseWriter, r *http.Request, db *sql.DB, c *Courier) {
+	var req struct {
+		OrderIDs []string `json:"order_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.OrderIDs) == 0 || len(req.OrderIDs) > maxBatchStops {
+		http.Error(w, fmt.Sprintf("a batch takes between 1 and %d orders", maxBatchStops), http.StatusUnprocessableEntity)
+		return
+	}
+	if !c.Active {
+		http.Error(w, "courier is inactive", http.StatusConflict)
+		return
+	}
+	if c.Availability == "offline" {
+		http.Error(w, "courier is not on shift", http.StatusConflict)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	candidates, err := lockBatchCandidates(tx, c.EstablishmentID, req.OrderIDs)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(candidates) != len(req.OrderIDs) {
+		http.Error(w, "some orders are not open deliveries of this establishment, or are already batched", http.StatusUnprocessableEntity)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+	defer cancel()
+	batchID, err := insertBatch(ctx, tx, c, candidates)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	b, err := loadBatch(db, c.ID, batchID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(b)
+}
+
+// lockBatchCandidates locks the given orders that can go on a batch: only
+// undelivered delivery orders that aren't already on an open batch qualify,
+// and the row locks keep two dispatchers from batching one order twice.
+func lockBatchCandidates(tx *sql.Tx, establishmentID string, orderIDs []string) ([]batchCandidate, error) {
+	rows, err := tx.Query(
+		`SELECT id, order_number, delivery_address, delivery_lat, delivery_lng FROM orders o
+		 WHERE id = ANY($1::uuid[]) AND establishment_id=$2 AND fulfillment_type='delivery' AND status IN ('PENDING','PROCESSING')
+		   AND NOT EXISTS (SELECT 1 FROM deliveries WHERE order_id=o.id)
+		   AND NOT EXISTS (SELECT 1 FROM delivery_batch_stops WHERE order_id=o.id AND status IN ('pending','en_route'))
+		 FOR UPDATE`,
+		pq.Array(orderIDs), establishmentID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var candidates []batchCandidate
+	for rows.Next() {
+		var s batchCandidate
+		if err := rows.Scan(&s.id, &s.number, &s.address, &s.to.Lat, &s.to.Lng); err != nil {
+			return nil, err
+		}
+		candidates = append(candidates, s)
+	}
+	return candidates, rows.Err()
+}
+
+// insertBatch plans a batch for the courier with the stops in route order.
+func insertBatch(ctx context.Context, tx *sql.Tx, c *Courier, candidates []batchCandidate) (string, error) {
+	var origin Address
+	if err := tx.QueryRow(`SELECT address_lat, address_lng FROM establishments WHERE id=$1`, c.EstablishmentID).Scan(&origin.Lat, &origin.Lng); err != nil {
+		return "", err
+	}
+	var batchID string
+	if err := tx.QueryRow(`INSERT INTO delivery_batches (establishment_id, courier_id) VALUES ($1,$2) RETURNING id`, c.EstablishmentID, c.ID).Scan(&batchID); err != nil {
+		return "", err
+	}
+	from := origin
+	for i, s := range sequenceStops(origin, candidates) {
+		var legMeters, legSeconds int
+		if from.Lat != nil && s.to.Lat != nil {
+			if route, err := router.Route(ctx, from, s.to); err == nil {
+				legMeters, legSeconds = route.DistanceMeters, route.DurationSeconds
+			}
+			from = s.to
+		}
+		_, err := tx.Exec(
+			`INSERT INTO delivery_batch_stops (batch_id, order_id, sequence, leg_meters, leg_seconds) VALUES ($1,$2,$3,$4,$5)`,
+			batchID, s.id, i+1, legMeters, legSeconds,
+		)
+		if err != nil {
+			return "", err
+		}
+	}
+	return batchID, nil
+}
+
+func loadBatch(db *sql.DB, courierID, id string) (*DeliveryBatch, error) {
+	b := DeliveryBatch{Stops: []BatchStop{}}
+	err := db.QueryRow(
+		`SELECT id, courier_id, status, created_at, started_at, completed_at FROM delivery_batches WHERE id=$1 AND courier_id=$2`,
+		id, courierID,
+	).Scan(&b.ID, &b.CourierID, &b.Status, &b.CreatedAt, &b.StartedAt, &b.CompletedAt)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(
+		`SELECT s.order_id, o.order_number, s.sequence, s.status, o.delivery_address, s.leg_meters, s.leg_seconds, s.delivered_at
+		 FROM delivery_batch_stops s JOIN orders o ON o.id=s.order_id WHERE s.batch_id=$1 ORDER BY s.sequence`,
+		id,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var s BatchStop
+		var number int
+		if err := rows.Scan(&s.OrderID, &number, &s.Sequence, &s.Status, &s.DeliveryAddress, &s.LegMeters, &s.LegSeconds, &s.DeliveredAt); err != nil {
+			return nil, err
+		}
+		s.DisplayNumber = formatOrderNumber(number)
+		b.Stops = append(b.Stops, s)
+	}
+	return &b, rows.Err()
+}
+
+// listBatches returns the courier's planned and in-progress batches.
+func listBatches(w http.ResponseWriter, db *sql.DB, c *Courier) {
+	rows, err := db.Query(`SELECT id FROM delivery_batches WHERE courier_id=$1 AND status IN ('planned','in_progress') ORDER BY created_at`, c.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+
+	list := []DeliveryBatch{}
+	for _, id := range ids {
+		b, err := loadBatch(db, c.ID, id)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		list = append(list, *b)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// startBatch marks the courier as out with the batch; the first stop is
+// en route from then on.
+func startBatch(w http.ResponseWriter, db *sql.DB, c *Courier, id string) {
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`UPDATE delivery_batches SET status='in_progress', started_at=now() WHERE id=$1 AND courier_id=$2 AND status='planned'`, id, c.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "batch is not planned", http.StatusConflict)
+		return
+	}
+	if err := advanceBatch(tx, id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeBatch(w, db, c, id)
+}
+
+// cancelBatch gives the stops not yet handed over back to the pool, so the
+// orders can be batched again.
+func cancelBatch(w http.ResponseWriter, db *sql.DB, c *Courier, id string) {
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	res, err := tx.Exec(`UPDATE delivery_batches SET status='cancelled', completed_at=now() WHERE id=$1 AND courier_id=$2 AND status IN ('planned','in_progress')`, id, c.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "batch is already closed", http.StatusConflict)
+		return
+	}
+	if _, err := tx.Exec(`UPDATE delivery_batch_stops SET status='cancelled' WHERE batch_id=$1 AND status IN ('pending','en_route')`, id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeBatch(w, db, c, id)
+}
+
+// updateBatchStop closes a stop as delivered or failed. Delivered stops are
+// recorded for the courier's payout with the leg's distance, like a single
+// delivery. The next stop becomes en route, and the batch completes after
+// the last one.
+func updateBatchStop(w http.ResponseWriter, r *http.Request, db *sql.DB, c *Courier, batchID, orderID string) {
+	var req struct {
+		Status string         `json:"status"`
+		Zone   string         `json:"zone"`
+		Proof  *DeliveryProof `json:"proof"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Status != "delivered" && req.Status != "failed" {
+		http.Error(w, "status must be delivered or failed", http.StatusUnprocessableEntity)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	var legMeters int
+	err = tx.QueryRow(
+		`UPDATE delivery_batch_stops s SET status=$1, delivered_at=CASE WHEN $1='delivered' THEN now() END
+		 FROM delivery_batches b
+		 WHERE s.batch_id=$2 AND s.order_id=$3 AND b.id=s.batch_id AND b.courier_id=$4 AND b.status='in_progress' AND s.status IN ('pending','en_route')
+		 RETURNING s.leg_meters`,
+		req.Status, batchID, orderID, c.ID,
+	).Scan(&legMeters)
+	if err == sql.ErrNoRows {
+		http.Error(w, "stop is not open on an in-progress batch", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if req.Status == "delivered" {
+		fee, msg := c.deliveryFee(legMeters, req.Zone)
+		if msg != "" {
+			http.Error(w, msg, http.StatusUnprocessableEntity)
+			return
+		}
+		d := Delivery{OrderID: orderID, CourierID: c.ID, DistanceMeters: legMeters, Zone: req.Zone, FeeCents: fee, Proof: req.Proof}
+		err := insertDelivery(tx, c, &d)
+		if _, ok := err.(deliveryProofError); ok {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := advanceBatch(tx, batchID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	writeBatch(w, db, c, batchID)
+}
+
+// advanceBatch puts the next pending stop en route, or completes the batch
+// when none is left.
+func advanceBatch(tx *sql.Tx, batchID string) error {
+	res, err := tx.Exec(
+		`UPDATE delivery_batch_stops SET status='en_route'
+		 WHERE batch_id=$1 AND status='pending' AND NOT EXISTS (SELECT 1 FROM delivery_batch_stops WHERE batch_id=$1 AND status='en_route')
+		   AND sequence=(SELECT MIN(sequence) FROM delivery_batch_stops WHERE batch_id=$1 AND status='pending')`,
+		batchID,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n > 0 {
+		return nil
+	}
+	_, err = tx.Exec(
+		`UPDATE delivery_batches SET status='completed', completed_at=now()
+		 WHERE id=$1 AND NOT EXISTS (SELECT 1 FROM delivery_batch_stops WHERE batch_id=$1 AND status IN ('pending','en_route'))`,
+		batchID,
+	)
+	return err
+}
+
+func writeBatch(w http.ResponseWriter, db *sql.DB, c *Courier, id string) {
+	b, err := loadBatch(db, c.ID, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(b)
+}
+
+// OrderTracking tells a customer where their order is in the courier's
+// route. StopsBefore counts the drop-offs still ahead of theirs; Courier is
+// only set while their stop hasn't been reached.
+type OrderTracking struct {
+	OrderID     string           `json:"order_id"`
+	Status      string           `json:"status"`
+	BatchStatus string           `json:"batch_status,omitempty"`
+	StopStatus  string           `json:"stop_status,omitempty"`
+	StopsBefore *int             `json:"stops_before,omitempty"`
+	Courier     *CourierPosition `json:"courier,omitempty"`
+	EstimatedAt *time.Time       `json:"estimated_at"`
+	DeliveredAt *time.Time       `json:"delivered_at"`
+	// DeliveryPIN is what the customer tells the courier when the
+	// establishment asks for a PIN, until the order is delivered.
+	DeliveryPIN string `json:"delivery_pin,omitempty"`
+}
+
+// orderTracking estimates arrival from the remaining legs up to the
+// customer's stop once the batch is under way; before that it falls back to
+// the checkout estimate.
+func orderTracking(w http.ResponseWriter, r *http.Request, db *sql.DB, orderID string) {
+	t := OrderTracking{OrderID: orderID}
+	var customerID string
+	var batchID sql.NullString
+	var sequence sql.NullInt64
+	var batchStatus, stopStatus sql.NullString
+	err := db.QueryRow(
+		`SELECT o.customer_id, o.status, o.estimated_delivery_at, d.delivered_at, s.batch_id, s.sequence, s.status, s.batch_status,
+		   CASE WHEN e.delivery_proof='pin' AND d.id IS NULL AND o.fulfillment_type='delivery' THEN o.delivery_pin ELSE '' END
+		 FROM orders o
+		 JOIN establishments e ON e.id=o.establishment_id
+		 LEFT JOIN deliveries d ON d.order_id=o.id
+		 LEFT JOIN LATERAL (
+		   SELECT s.batch_id, s.sequence, s.status, b.status AS batch_status FROM delivery_batch_stops s JOIN delivery_batches b ON b.id=s.batch_id
+		   WHERE s.order_id=o.id AND s.status<>'cancelled' ORDER BY b.created_at DESC LIMIT 1
+		 ) s ON true
+		 WHERE o.id=$1`,
+		orderID,
+	).Scan(&customerID, &t.Status, &t.EstimatedAt, &t.DeliveredAt, &batchID, &sequence, &stopStatus, &batchStatus, &t.DeliveryPIN)
+	if err == sql.ErrNoRows || (err == nil && customerID != currentClaims(r).Sub) {
+		http.NotFound(w, nil)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	t.BatchStatus, t.StopStatus = batchStatus.String, stopStatus.String
+	if batchStatus.String == "in_progress" && (stopStatus.String == "pending" || stopStatus.String == "en_route") {
+		var before, seconds int
+		err := db.QueryRow(
+			`SELECT COUNT(*) FILTER (WHERE sequence < $2), COALESCE(SUM(leg_seconds),0)
+			 FROM delivery_batch_stops WHERE batch_id=$1 AND sequence <= $2 AND status IN ('pending','en_route')`,
+			batchID.String, sequence.Int64,
+		).Scan(&before, &seconds)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		eta := time.Now().Add(time.Duration(seconds)*time.Second + time.Duration(before)*stopHandoverTime)
+		t.StopsBefore, t.EstimatedAt = &before, &eta
+		if t.Courier, err = latestCourierPosition(db, batchID.String); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
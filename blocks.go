@@ -0,0 +1,210 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+const (
+	flagWindowDays    = 30
+	flagCancellations = 3
+	flagPaymentFails  = 3
+)
+
+type CustomerBlock struct {
+	ID              string    `json:"id"`
+	EstablishmentID string    `json:"establishment_id"`
+	Kind            string    `json:"kind"`
+	Value           string    `json:"value"`
+	Reason          string    `json:"reason"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+type CustomerFlag struct {
+	ID              string    `json:"id"`
+	EstablishmentID string    `json:"establishment_id"`
+	CustomerID      string    `json:"customer_id"`
+	Reason          string    `json:"reason"`
+	Occurrences     int       `json:"occurrences"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+func checkCustomerAllowed(tx *sql.Tx, establishmentID, customerID, phone, device string) error {
+	phone = normalizePhone(phone)
+	var blocked, flagged bool
+	err := tx.QueryRow(
+		`SELECT
+		   EXISTS(SELECT 1 FROM customer_blocks WHERE establishment_id=$1 AND (
+		     (kind='customer' AND value=$2) OR (kind='phone' AND value=$3 AND $3 <> '') OR (kind='device' AND value=$4 AND $4 <> ''))),
+		   EXISTS(SELECT 1 FROM customer_flags WHERE establishment_id=$1 AND customer_id=$2 AND cleared_at IS NULL)`,
+		establishmentID, customerID, phone, device,
+	).Scan(&blocked, &flagged)
+	if err != nil {
+		return err
+	}
+	if blocked {
+		return &checkoutError{http.StatusForbidden, "customer_blocked", "this establishment is not accepting orders from this customer"}
+	}
+	if flagged {
+		return &checkoutError{http.StatusForbidden, "customer_flagged", "orders from this customer are on hold; please contact the establishment"}
+	}
+	return nil
+}
+
+// refreshCustomerFlags raises automatic flags for customers with repeated
+// cancellations or payment failures. Only orders placed after the last time an
+// owner cleared the same flag are counted, and orders the establishment let
+// time out (AUTO_CANCELLED) are not held against the customer.
+func refreshCustomerFlags(db *sql.DB, establishmentID, customerID string) error {
+	for _, f := range []struct {
+		reason    string
+		status    string
+		threshold int
+	}{
+		{"repeated_cancellations", "CANCELLED", flagCancellations},
+		{"payment_failures", "FAILED", flagPaymentFails},
+	} {
+		_, err := db.Exec(
+			`INSERT INTO customer_flags (establishment_id, customer_id, reason, occurrences)
+			 SELECT $1, $2, $3, COUNT(*) FROM orders
+			 WHERE establishment_id=$1 AND customer_id=$2 AND status=$4
+			   AND NOT EXISTS (SELECT 1 FROM order_events ev WHERE ev.order_id=orders.id AND ev.event_type='AUTO_CANCELLED')
+			   AND ordered_at > GREATEST(now() - $5 * interval '1 day',
+			     COALESCE((SELECT MAX(cleared_at) FROM customer_flags WHERE establishment_id=$1 AND customer_id=$2 AND reason=$3), '-infinity'))
+			 HAVING COUNT(*) >= $6
+			 ON CONFLICT (establishment_id, customer_id, reason) WHERE cleared_at IS NULL
+			 DO UPDATE SET occurrences=EXCLUDED.occurrences`,
+			establishmentID, customerID, f.reason, f.status, flagWindowDays, f.threshold,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func customerBlocksRoute(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID, blockID string) {
+	if !requireRole(w, r, db, establishmentID, "manager") {
+		return
+	}
+	switch {
+	case blockID == "" && r.Method == http.MethodGet:
+		listCustomerBlocks(w, db, establishmentID)
+	case blockID == "" && r.Method == http.MethodPost:
+		createCustomerBlock(w, r, db, establishmentID)
+	case blockID != "" && r.Method == http.MethodDelete:
+		_, err := db.Exec(`DELETE FROM customer_blocks WHERE id=$1 AND establishment_id=$2`, blockID, establishmentID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func listCustomerBlocks(w http.ResponseWriter, db *sql.DB, establishmentID string) {
+	rows, err := db.Query(`SELECT id, establishment_id, kind, value, reason, created_at FROM customer_blocks WHERE establishment_id=$1 ORDER BY created_at DESC`, establishmentID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	list := []CustomerBlock{}
+	for rows.Next() {
+		var b CustomerBlock
+		if err := rows.Scan(&b.ID, &b.EstablishmentID, &b.Kind, &b.Value, &b.Reason, &b.CreatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		list = append(list, b)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func createCustomerBlock(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	var b CustomerBlock
+	if err := json.NewDecoder(r.Body).Decode(&b); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	b.Reason = sanitizeText(b.Reason)
+	if b.Kind != "customer" && b.Kind != "phone" && b.Kind != "device" {
+		http.Error(w, "kind must be customer, phone or device", http.StatusBadRequest)
+		return
+	}
+	if b.Value == "" {
+		http.Error(w, "value is required", http.StatusBadRequest)
+		return
+	}
+	// Phone blocks are stored in E.164, as checkCustomerAllowed compares
+	// them, so the same number typed differently still matches.
+	if b.Kind == "phone" {
+		if b.Value = normalizePhone(b.Value); !validE164(b.Value) {
+			http.Error(w, "value must be a phone number, e.g. +5511999998888", http.StatusBadRequest)
+			return
+		}
+	}
+	b.EstablishmentID = establishmentID
+	err := db.QueryRow(
+		`INSERT INTO customer_blocks (establishment_id, kind, value, reason) VALUES ($1,$2,$3,$4)
+		 ON CONFLICT (establishment_id, kind, value) DO UPDATE SET reason=EXCLUDED.reason
+		 RETURNING id, created_at`,
+		b.EstablishmentID, b.Kind, b.Value, b.Reason,
+	).Scan(&b.ID, &b.CreatedAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(b)
+}
+
+func customerFlagsRoute(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID, flagID string) {
+	if !requireRole(w, r, db, establishmentID, "manager") {
+		return
+	}
+	switch {
+	case flagID == "" && r.Method == http.MethodGet:
+		listCustomerFlags(w, db, establishmentID)
+	case flagID != "" && r.Method == http.MethodDelete:
+		_, err := db.Exec(`UPDATE customer_flags SET cleared_at=now() WHERE id=$1 AND establishment_id=$2 AND cleared_at IS NULL`, flagID, establishmentID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func listCustomerFlags(w http.ResponseWriter, db *sql.DB, establishmentID string) {
+	rows, err := db.Query(
+		`SELECT id, establishment_id, customer_id, reason, occurrences, created_at FROM customer_flags WHERE establishment_id=$1 AND cleared_at IS NULL ORDER BY created_at DESC`,
+		establishmentID,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	list := []CustomerFlag{}
+	for rows.Next() {
+		var f CustomerFlag
+		if err := rows.Scan(&f.ID, &f.EstablishmentID, &f.CustomerID, &f.Reason, &f.Occurrences, &f.CreatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		list = append(list, f)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+var errCircuitOpen = errors.New("circuit open")
+
+// circuitBreaker stops calling a dependency after threshold consecutive
+// failures. After cooldown one call is let through; its outcome closes the
+// breaker again or restarts the cooldown.
+type circuitBreaker struct {
+	name      string
+	threshold int
+	cooldown  time.Duration
+
+	mu       sync.Mutex
+	state    string // closed, open or half_open
+	failures int
+	openedAt time.Time
+}
+
+func newCircuitBreaker(name string, threshold int, cooldown time.Duration) *circuitBreaker {
+	return &circuitBreaker{name: name, threshold: threshold, cooldown: cooldown, state: "closed"}
+}
+
+// allow reports whether a call may go ahead. While half-open only the
+// single probe is allowed.
+func (b *circuitBreaker) allow() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case "open":
+		if time.Since(b.openedAt) < b.cooldown {
+			return false
+		}
+		b.state = "half_open"
+		return true
+	case "half_open":
+		return false
+	default:
+		return true
+	}
+}
+
+// record feeds the outcome of an allowed call back into the breaker.
+func (b *circuitBreaker) record(err error) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if err == nil {
+		if b.state != "closed" {
+			log.Printf("%s: circuit closed", b.name)
+		}
+		b.state, b.failures = "closed", 0
+		return
+	}
+	b.failures++
+	if b.state == "closed" && b.failures < b.threshold {
+		return
+	}
+	// A failure while already open (from a caller that doesn't go through
+	// allow, like a health check) extends the cooldown.
+	if b.state != "open" {
+		log.Printf("%s: circuit open after %d failures: %v", b.name, b.failures, err)
+	}
+	b.state, b.openedAt = "open", time.Now()
+}
+
+// isOpen reports whether calls are currently being refused, without
+// claiming the half-open probe.
+func (b *circuitBreaker) isOpen() bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	return b.state != "closed" && time.Since(b.openedAt) < b.cooldown
+}
+
+// do runs fn through the breaker, returning errCircuitOpen without calling
+// it while the breaker is open.
+func (b *circuitBreaker) do(fn func() error) error {
+	if !b.allow() {
+		return errCircuitOpen
+	}
+	err := fn()
+	b.record(err)
+	return err
+}
+
+// breakerSettings are the per-provider thresholds. Payment gateways trip
+// sooner and stay open longer; anything not listed uses the default.
+var breakerSettings = map[string]struct {
+	threshold int
+	cooldown  time.Duration
+}{
+	"default":     {5, 30 * time.Second},
+	"stripe":      {3, time.Minute},
+	"mercadopago": {3, time.Minute},
+	"pagseguro":   {3, time.Minute},
+	"google_maps": {5, 30 * time.Second},
+	"mapbox":      {5, 30 * time.Second},
+	"osrm":        {5, 30 * time.Second},
+}
+
+// providerHosts names the providers behind known hosts so hosts of the same
+// provider share a breaker. Other hosts get a breaker of their own.
+var providerHosts = map[string]string{
+	"api.stripe.com":               "stripe",
+	"files.stripe.com":             "stripe",
+	"api.mercadopago.com":          "mercadopago",
+	"api.pagseguro.com":            "pagseguro",
+	"sandbox.api.pagseguro.com":    "pagseguro",
+	"maps.googleapis.com":          "google_maps",
+	"api.mapbox.com":               "mapbox",
+	"router.project-osrm.org":      "osrm",
+	"vision.googleapis.com":        "google_vision",
+	"accounts.google.com":          "google_oauth",
+	"oauth2.googleapis.com":        "google_oauth",
+	"openidconnect.googleapis.com": "google_oauth",
+	"api.openai.com":               "openai",
+	"api.anthropic.com":            "anthropic",
+	"api.hcaptcha.com":             "hcaptcha",
+	"challenges.cloudflare.com":    "turnstile",
+	"viacep.com.br":                "viacep",
+	"world.openfoodfacts.org":      "openfoodfacts",
+}
+
+var (
+	breakersMu sync.Mutex
+	breakers   = map[string]*circuitBreaker{}
+
+	breakerRejections = newCounter("circuit_breaker_rejections_total", "Calls refused because the provider's circuit was open.", "provider")
+)
+
+func init() {
+	registerMetric(breakerStates{})
+}
+
+// providerName is the provider behind a host, or the host itself.
+func providerName(host string) string {
+	if name, ok := providerHosts[host]; ok {
+		return name
+	}
+	return host
+}
+
+// providerBreaker returns the shared breaker for a host's provider.
+func providerBreaker(host string) *circuitBreaker {
+	name := providerName(host)
+	breakersMu.Lock()
+	defer breakersMu.Unlock()
+	b, ok := breakers[name]
+	if !ok {
+		s, ok := breakerSettings[name]
+		if !ok {
+			s = breakerSettings["default"]
+		}
+		b = newCircuitBreaker(name, s.threshold, s.cooldown)
+		breakers[name] = b
+	}
+	return b
+}
+
+// breakerTransport puts every outbound request through its provider's
+// breaker. Connection errors, 5xx and 429 count as failures. While a circuit
+// is open calls fail at once with errCircuitOpen, and callers fall back the
+// way they already do for provider errors: routing uses the straight-line
+// estimate, refunds and webhooks stay queued for the next run.
+type breakerTransport struct {
+	next http.RoundTripper
+}
+
+func (t breakerTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	b := providerBreaker(req.URL.Hostname())
+	if !b.allow() {
+		breakerRejections.Inc(b.name)
+		return nil, fmt.Errorf("%s: %w", b.name, errCircuitOpen)
+	}
+	resp, err := t.next.RoundTrip(req)
+	switch {
+	case err != nil && req.Context().Err() == context.Canceled:
+		// The caller gave up; that says nothing about the provider.
+		b.record(nil)
+	case err != nil:
+		b.record(err)
+	case resp.StatusCode >= 500 || resp.StatusCode == http.StatusTooManyRequests:
+		b.record(fmt.Errorf("responded %d", resp.StatusCode))
+	default:
+		b.record(nil)
+	}
+	return resp, err
+}
+
+// breakerStates exports each provider breaker's state: 0 closed, 1 half
+// open, 2 open.
+type breakerStates struct{}
+
+func (breakerStates) write(b *strings.Builder) {
+	breakersMu.Lock()
+	list := make([]*circuitBreaker, 0, len(breakers)+1)
+	for _, cb := range breakers {
+		list = append(list, cb)
+	}
+	breakersMu.Unlock()
+	list = append(list, dbBreaker)
+	sort.Slice(list, func(i, j int) bool { return list[i].name < list[j].name })
+
+	b.WriteString("# HELP circuit_breaker_state Circuit state per provider: 0 closed, 1 half open, 2 open.\n# TYPE circuit_breaker_state gauge\n")
+	for _, cb := range list {
+		cb.mu.Lock()
+		state := map[string]int{"closed": 0, "half_open": 1, "open": 2}[cb.state]
+		cb.mu.Unlock()
+		fmt.Fprintf(b, "circuit_breaker_state{provider=%q} %d\n", cb.name, state)
+	}
+}
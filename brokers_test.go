@@ -0,0 +1,123 @@
+package main
+
+import (
+	"bufio"
+	"context"
+	"errors"
+	"net"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestMemoryPublisher(t *testing.T) {
+	p := &memoryPublisher{}
+	payload := []byte(`{"type":"order.created"}`)
+	if err := p.Publish(context.Background(), eventOrderCreated, payload); err != nil {
+		t.Fatal(err)
+	}
+	payload[0] = 'x'
+	got := p.Messages()
+	if len(got) != 1 || got[0].Topic != eventOrderCreated || string(got[0].Payload) != `{"type":"order.created"}` {
+		t.Fatalf("messages = %+v", got)
+	}
+
+	p.Fail = errors.New("down")
+	if err := p.Publish(context.Background(), eventOrderCreated, payload); !errors.Is(err, p.Fail) {
+		t.Fatalf("err = %v, want %v", err, p.Fail)
+	}
+	if n := len(p.Messages()); n != 1 {
+		t.Fatalf("failed publish was recorded, %d messages", n)
+	}
+}
+
+// fakeNATS accepts one connection and answers each PING with PONG, sending
+// the subjects it saw on the returned channel.
+func fakeNATS(t *testing.T) (string, <-chan string) {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	subjects := make(chan string, 10)
+	go func() {
+		conn, err := ln.Accept()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		conn.Write([]byte("INFO {}\r\n"))
+		rd := bufio.NewReader(conn)
+		for {
+			line, err := rd.ReadString('\n')
+			if err != nil {
+				return
+			}
+			switch f := strings.Fields(line); {
+			case len(f) == 3 && f[0] == "PUB":
+				rd.ReadString('\n')
+				subjects <- f[1]
+			case len(f) == 1 && f[0] == "PING":
+				conn.Write([]byte("PONG\r\n"))
+			}
+		}
+	}()
+	return "nats://" + ln.Addr().String(), subjects
+}
+
+func TestNATSPublisher(t *testing.T) {
+	u, subjects := fakeNATS(t)
+	p := &natsPublisher{url: u}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.Publish(ctx, eventOrderAccepted, []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	if got := <-subjects; got != brokerSubjectPrefix+eventOrderAccepted {
+		t.Fatalf("subject = %q", got)
+	}
+}
+
+// TestRabbitPublisher needs a broker at RABBITMQ_URL with the exchange
+// RABBITMQ_EXCHANGE (cardapio.events by default) bound to a queue that
+// takes cardapio.#.
+func TestRabbitPublisher(t *testing.T) {
+	u := os.Getenv("RABBITMQ_URL")
+	if u == "" {
+		t.Skip("RABBITMQ_URL not set")
+	}
+	exchange := os.Getenv("RABBITMQ_EXCHANGE")
+	if exchange == "" {
+		exchange = "cardapio.events"
+	}
+	p := &rabbitPublisher{url: u, exchange: exchange}
+	ctx, cancel := context.WithTimeout(context.Background(), 10*time.Second)
+	defer cancel()
+	if err := p.Publish(ctx, eventOrderCreated, []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+	// A second publish reuses the confirmed channel.
+	if err := p.Publish(ctx, eventOrderCreated, []byte(`{}`)); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRabbitPublisherUnreachable(t *testing.T) {
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	addr := ln.Addr().String()
+	ln.Close()
+	p := &rabbitPublisher{url: "amqp://guest:guest@" + addr + "/", exchange: "cardapio.events"}
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
+	defer cancel()
+	if err := p.Publish(ctx, eventOrderCreated, []byte(`{}`)); err == nil {
+		t.Fatal("publish to a closed port succeeded")
+	}
+	if p.conn != nil {
+		t.Fatal("connection kept after a failed dial")
+	}
+}
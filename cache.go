@@ -0,0 +1,214 @@
+package main
+
+import (
+	"bytes"
+	"container/list"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"sync"
+	"time"
+)
+
+const (
+	defaultResponseCacheSize = 1000
+	defaultResponseCacheTTL  = 30 * time.Second
+	// maxCachedBody bounds what one entry may hold; larger responses are
+	// passed through uncached.
+	maxCachedBody = 1 << 20
+)
+
+var (
+	cacheHits      = newCounter("response_cache_hits_total", "Responses served from the in-process cache.", "endpoint")
+	cacheMisses    = newCounter("response_cache_misses_total", "Cacheable requests that had to be rendered.", "endpoint")
+	cacheEvictions = newCounter("response_cache_evictions_total", "Entries removed from the response cache.", "reason")
+)
+
+// responseCache holds rendered public responses. It is nil when disabled, and
+// all methods are safe to call on a nil cache.
+var responseCache *lruCache
+
+// newResponseCacheFromEnv sizes the cache from RESPONSE_CACHE_SIZE (entries,
+// 0 disables it) and RESPONSE_CACHE_TTL (a Go duration). The TTL should stay
+// well below assetURLTTL since, without a CDN, cached bodies embed presigned
+// asset URLs.
+func newResponseCacheFromEnv() *lruCache {
+	size := defaultResponseCacheSize
+	if v := os.Getenv("RESPONSE_CACHE_SIZE"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 0 {
+			log.Printf("invalid RESPONSE_CACHE_SIZE %q, using %d", v, size)
+		} else {
+			size = n
+		}
+	}
+	if size == 0 {
+		return nil
+	}
+	ttl := defaultResponseCacheTTL
+	if v := os.Getenv("RESPONSE_CACHE_TTL"); v != "" {
+		d, err := time.ParseDuration(v)
+		if err != nil || d <= 0 {
+			log.Printf("invalid RESPONSE_CACHE_TTL %q, using %s", v, ttl)
+		} else {
+			ttl = d
+		}
+	}
+	return newLRUCache(size, ttl)
+}
+
+type cachedResponse struct {
+	header http.Header
+	body   []byte
+}
+
+type cacheEntry struct {
+	key, group string
+	resp       cachedResponse
+	expires    time.Time
+}
+
+// lruCache is a size-bounded LRU of responses with a fixed TTL. Entries are
+// grouped by establishment so every response derived from it can be dropped
+// at once.
+type lruCache struct {
+	mu    sync.Mutex
+	size  int
+	ttl   time.Duration
+	order *list.List
+	items map[string]*list.Element
+}
+
+func newLRUCache(size int, ttl time.Duration) *lruCache {
+	return &lruCache{size: size, ttl: ttl, order: list.New(), items: map[string]*list.Element{}}
+}
+
+func (c *lruCache) get(key string) (cachedResponse, bool) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	el, ok := c.items[key]
+	if !ok {
+		return cachedResponse{}, false
+	}
+	e := el.Value.(*cacheEntry)
+	if time.Now().After(e.expires) {
+		c.remove(el, "expired")
+		return cachedResponse{}, false
+	}
+	c.order.MoveToFront(el)
+	return e.resp, true
+}
+
+func (c *lruCache) set(key, group string, resp cachedResponse) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if el, ok := c.items[key]; ok {
+		c.order.Remove(el)
+		delete(c.items, key)
+	}
+	c.items[key] = c.order.PushFront(&cacheEntry{key: key, group: group, resp: resp, expires: time.Now().Add(c.ttl)})
+	for c.order.Len() > c.size {
+		c.remove(c.order.Back(), "capacity")
+	}
+}
+
+func (c *lruCache) remove(el *list.Element, reason string) {
+	c.order.Remove(el)
+	delete(c.items, el.Value.(*cacheEntry).key)
+	cacheEvictions.Inc(reason)
+}
+
+// Invalidate drops every cached response for the given establishments.
+func (c *lruCache) Invalidate(establishmentIDs ...string) {
+	if c == nil {
+		return
+	}
+	groups := map[string]bool{}
+	for _, id := range establishmentIDs {
+		groups[id] = true
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	for el := c.order.Front(); el != nil; {
+		next := el.Next()
+		if groups[el.Value.(*cacheEntry).group] {
+			c.remove(el, "invalidated")
+		}
+		el = next
+	}
+}
+
+// invalidateOnEvents keeps the cache consistent with writes that only surface
+// as domain events, such as stock taken at checkout. It listens to
+// liveEvents since every instance has its own cache.
+func invalidateOnEvents() {
+	for _, t := range []string{eventProductCreated, eventProductUpdated, eventProductDeleted, eventStockChanged, eventProductSoldOut} {
+		liveEvents.Subscribe(t, func(e Event) { responseCache.Invalidate(e.EstablishmentID) })
+	}
+}
+
+// Serve answers anonymous GETs for an establishment-scoped endpoint from the
+// cache, rendering with h and storing the result on a miss. Only 200
+// responses are cached; the key includes the query string, which carries the
+// preview token and rendering options.
+func (c *lruCache) Serve(w http.ResponseWriter, r *http.Request, endpoint, establishmentID string, h http.HandlerFunc) {
+	if c == nil || r.Method != http.MethodGet || r.Header.Get("Authorization") != "" {
+		h(w, r)
+		return
+	}
+	key := endpoint + ":" + establishmentID + "?" + r.URL.Query().Encode()
+	if resp, ok := c.get(key); ok {
+		cacheHits.Inc(endpoint)
+		for k, v := range resp.header {
+			w.Header()[k] = v
+		}
+		w.Header().Set("X-Cache", "HIT")
+		w.Write(resp.body)
+		return
+	}
+	cacheMisses.Inc(endpoint)
+	rec := &recordingWriter{ResponseWriter: w, status: http.StatusOK}
+	w.Header().Set("X-Cache", "MISS")
+	h(rec, r)
+	if rec.status == http.StatusOK && !rec.overflow {
+		header := w.Header().Clone()
+		header.Del("X-Cache")
+		c.set(key, establishmentID, cachedResponse{header: header, body: rec.body.Bytes()})
+	}
+}
+
+// recordingWriter passes a response through while keeping a copy of it,
+// giving up on the copy once it passes maxCachedBody. It flushes, so
+// streamed responses still reach the client as they are written.
+type recordingWriter struct {
+	http.ResponseWriter
+	status   int
+	body     bytes.Buffer
+	overflow bool
+}
+
+func (rw *recordingWriter) WriteHeader(status int) {
+	rw.status = status
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *recordingWriter) Write(b []byte) (int, error) {
+	if !rw.overflow {
+		if rw.body.Len()+len(b) > maxCachedBody {
+			rw.overflow = true
+			rw.body = bytes.Buffer{}
+		} else {
+			rw.body.Write(b)
+		}
+	}
+	return rw.ResponseWriter.Write(b)
+}
+
+func (rw *recordingWriter) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+func (rw *recordingWriter) Unwrap() http.ResponseWriter { return rw.ResponseWriter }
@@ -0,0 +1,481 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/base32"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+const campaignDispatchEvery = time.Minute
+
+// Segment selects an establishment's customers from their non-cancelled
+// orders. Kind picks sensible defaults; every criterion that is set applies:
+// at least MinOrders orders and MinSpentCents spent within the last
+// LookbackDays (0 means all time), and no order in the last InactiveDays.
+type Segment struct {
+	ID              string    `json:"id"`
+	EstablishmentID string    `json:"establishment_id"`
+	Name            string    `json:"name"`
+	Kind            string    `json:"kind"`
+	MinOrders       int       `json:"min_orders"`
+	MinSpentCents   int64     `json:"min_spent_cents"`
+	InactiveDays    int       `json:"inactive_days"`
+	LookbackDays    int       `json:"lookback_days"`
+	MemberCount     *int      `json:"member_count,omitempty"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// segmentMembersSQL selects the customer_id of every member of the segment
+// bound to $1.
+const segmentMembersSQL = `SELECT o.customer_id FROM orders o JOIN customer_segments s ON s.id=$1 AND s.establishment_id=o.establishment_id
+	WHERE o.status NOT IN ('CANCELLED','FAILED') AND (s.lookback_days = 0 OR o.ordered_at >= now() - make_interval(days => s.lookback_days))
+	GROUP BY o.customer_id
+	HAVING COUNT(*) >= MIN(s.min_orders) AND SUM(o.total_cents) >= MIN(s.min_spent_cents)
+	   AND (MIN(s.inactive_days) = 0 OR MAX(o.ordered_at) < now() - make_interval(days => MIN(s.inactive_days)))`
+
+type Campaign struct {
+	ID              string `json:"id"`
+	EstablishmentID string `json:"establishment_id"`
+	SegmentID       string `json:"segment_id"`
+	Name            string `json:"name"`
+	Message         string `json:"message"`
+	Channel         string `json:"channel"`
+	// DiscountType and DiscountValue describe the coupon created for the
+	// campaign when it is sent; without them the campaign has no coupon.
+	DiscountType    *string        `json:"discount_type"`
+	DiscountValue   *int           `json:"discount_value"`
+	CouponValidDays int            `json:"coupon_valid_days"`
+	CouponCode      *string        `json:"coupon_code"`
+	Status          string         `json:"status"`
+	SendAt          *time.Time     `json:"send_at"`
+	SentAt          *time.Time     `json:"sent_at"`
+	CreatedAt       time.Time      `json:"created_at"`
+	Stats           *CampaignStats `json:"stats,omitempty"`
+}
+
+type CampaignStats struct {
+	Recipients      int   `json:"recipients"`
+	Delivered       int   `json:"delivered"`
+	Redeemed        int   `json:"redeemed"`
+	RedeemedRevenue int64 `json:"redeemed_revenue_cents"`
+}
+
+func segmentsRoute(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID, segmentID string) {
+	if !requireRole(w, r, db, establishmentID, "manager") {
+		return
+	}
+	switch {
+	case segmentID == "" && r.Method == http.MethodGet:
+		listSegments(w, db, establishmentID)
+	case segmentID == "" && r.Method == http.MethodPost:
+		createSegment(w, r, db, establishmentID)
+	case segmentID != "" && r.Method == http.MethodGet:
+		getSegment(w, db, establishmentID, segmentID)
+	case segmentID != "" && r.Method == http.MethodDelete:
+		_, err := db.Exec(`DELETE FROM customer_segments WHERE id=$1 AND establishment_id=$2`, segmentID, establishmentID)
+		if isForeignKeyViolation(err) {
+			http.Error(w, "segment is used by a campaign", http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// normalizeSegment applies the kind's defaults and returns a problem, if any.
+func normalizeSegment(s *Segment) string {
+	s.Name = sanitizeText(s.Name)
+	if s.Name == "" {
+		return "name is required"
+	}
+	if s.MinOrders < 0 || s.MinSpentCents < 0 || s.InactiveDays < 0 || s.LookbackDays < 0 {
+		return "criteria must not be negative"
+	}
+	switch s.Kind {
+	case "frequent":
+		if s.MinOrders == 0 {
+			s.MinOrders = 5
+		}
+	case "inactive":
+		if s.InactiveDays == 0 {
+			s.InactiveDays = 30
+		}
+	case "big_spender":
+		if s.MinSpentCents == 0 {
+			return "min_spent_cents is required for big_spender segments"
+		}
+		if s.LookbackDays == 0 {
+			s.LookbackDays = 90
+		}
+	default:
+		return "kind must be frequent, inactive or big_spender"
+	}
+	if s.MinOrders == 0 {
+		s.MinOrders = 1
+	}
+	return ""
+}
+
+func createSegment(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	var s Segment
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if problem := normalizeSegment(&s); problem != "" {
+		http.Error(w, problem, http.StatusUnprocessableEntity)
+		return
+	}
+	s.EstablishmentID = establishmentID
+	err := db.QueryRow(
+		`INSERT INTO customer_segments (establishment_id, name, kind, min_orders, min_spent_cents, inactive_days, lookback_days)
+		 VALUES ($1,$2,$3,$4,$5,$6,$7) RETURNING id, created_at`,
+		s.EstablishmentID, s.Name, s.Kind, s.MinOrders, s.MinSpentCents, s.InactiveDays, s.LookbackDays,
+	).Scan(&s.ID, &s.CreatedAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(s)
+}
+
+func listSegments(w http.ResponseWriter, db *sql.DB, establishmentID string) {
+	rows, err := db.Query(
+		`SELECT id, establishment_id, name, kind, min_orders, min_spent_cents, inactive_days, lookback_days, created_at
+		 FROM customer_segments WHERE establishment_id=$1 ORDER BY name`,
+		establishmentID,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	list := []Segment{}
+	for rows.Next() {
+		var s Segment
+		if err := rows.Scan(&s.ID, &s.EstablishmentID, &s.Name, &s.Kind, &s.MinOrders, &s.MinSpentCents, &s.InactiveDays, &s.LookbackDays, &s.CreatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		list = append(list, s)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// getSegment returns the segment with its current member count.
+func getSegment(w http.ResponseWriter, db *sql.DB, establishmentID, segmentID string) {
+	var s Segment
+	err := db.QueryRow(
+		`SELECT id, establishment_id, name, kind, min_orders, min_spent_cents, inactive_days, lookback_days, created_at
+		 FROM customer_segments WHERE id=$1 AND establishment_id=$2`,
+		segmentID, establishmentID,
+	).Scan(&s.ID, &s.EstablishmentID, &s.Name, &s.Kind, &s.MinOrders, &s.MinSpentCents, &s.InactiveDays, &s.LookbackDays, &s.CreatedAt)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, nil)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var n int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM (`+segmentMembersSQL+`) m`, segmentID).Scan(&n); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.MemberCount = &n
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+func campaignsRoute(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID, campaignID string) {
+	if !requireRole(w, r, db, establishmentID, "manager") {
+		return
+	}
+	switch {
+	case campaignID == "" && r.Method == http.MethodGet:
+		listCampaigns(w, db, establishmentID)
+	case campaignID == "" && r.Method == http.MethodPost:
+		createCampaign(w, r, db, establishmentID)
+	case campaignID != "" && r.Method == http.MethodGet:
+		getCampaign(w, db, establishmentID, campaignID)
+	case campaignID != "" && r.Method == http.MethodPatch:
+		scheduleCampaign(w, r, db, establishmentID, campaignID)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func createCampaign(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	var c Campaign
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.Name, c.Message = sanitizeText(c.Name), sanitizeText(c.Message)
+	if c.Name == "" || c.Message == "" {
+		http.Error(w, "name and message are required", http.StatusUnprocessableEntity)
+		return
+	}
+	if c.Channel == "" {
+		c.Channel = "push"
+	}
+	if c.Channel != "push" && c.Channel != "whatsapp" && c.Channel != "email" {
+		http.Error(w, "channel must be push, whatsapp or email", http.StatusUnprocessableEntity)
+		return
+	}
+	if (c.DiscountType == nil) != (c.DiscountValue == nil) {
+		http.Error(w, "discount_type and discount_value go together", http.StatusUnprocessableEntity)
+		return
+	}
+	if c.DiscountType != nil {
+		if *c.DiscountType != "percent" && *c.DiscountType != "fixed" {
+			http.Error(w, "discount_type must be percent or fixed", http.StatusUnprocessableEntity)
+			return
+		}
+		if *c.DiscountValue <= 0 || (*c.DiscountType == "percent" && *c.DiscountValue > 100) {
+			http.Error(w, "discount_value is out of range", http.StatusUnprocessableEntity)
+			return
+		}
+		if !requirePermission(w, r, db, establishmentID, "coupons") {
+			return
+		}
+	}
+	if c.CouponValidDays == 0 {
+		c.CouponValidDays = 7
+	}
+	if c.CouponValidDays < 1 || c.CouponValidDays > 90 {
+		http.Error(w, "coupon_valid_days must be between 1 and 90", http.StatusUnprocessableEntity)
+		return
+	}
+	c.EstablishmentID, c.Status = establishmentID, "draft"
+	err := db.QueryRow(
+		`INSERT INTO campaigns (establishment_id, segment_id, name, message, channel, discount_type, discount_value, coupon_valid_days)
+		 SELECT $1, id, $3, $4, $5, $6, $7, $8 FROM customer_segments WHERE id::text=$2 AND establishment_id=$1
+		 RETURNING id, created_at`,
+		c.EstablishmentID, c.SegmentID, c.Name, c.Message, c.Channel, c.DiscountType, c.DiscountValue, c.CouponValidDays,
+	).Scan(&c.ID, &c.CreatedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "segment not found", http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := recordAudit(db, r, establishmentID, "campaign.created", "campaign", c.ID, c); err != nil {
+		log.Printf("audit campaign.created %s: %v", c.ID, err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(c)
+}
+
+const campaignColumns = `c.id, c.establishment_id, c.segment_id, c.name, c.message, c.channel, c.discount_type, c.discount_value, c.coupon_valid_days, c.coupon_code, c.status, c.send_at, c.sent_at, c.created_at,
+	(SELECT COUNT(*) FROM campaign_recipients r WHERE r.campaign_id=c.id),
+	(SELECT COUNT(*) FROM campaign_recipients r JOIN notifications n ON n.id=r.notification_id WHERE r.campaign_id=c.id AND n.sent_at IS NOT NULL),
+	(SELECT COUNT(*) FROM campaign_recipients r WHERE r.campaign_id=c.id AND r.redeemed_at IS NOT NULL),
+	(SELECT COALESCE(SUM(o.total_cents),0) FROM campaign_recipients r JOIN orders o ON o.id=r.order_id WHERE r.campaign_id=c.id)`
+
+func scanCampaign(row interface{ Scan(...any) error }) (Campaign, error) {
+	var c Campaign
+	var st CampaignStats
+	err := row.Scan(&c.ID, &c.EstablishmentID, &c.SegmentID, &c.Name, &c.Message, &c.Channel, &c.DiscountType, &c.DiscountValue, &c.CouponValidDays, &c.CouponCode, &c.Status, &c.SendAt, &c.SentAt, &c.CreatedAt,
+		&st.Recipients, &st.Delivered, &st.Redeemed, &st.RedeemedRevenue)
+	c.Stats = &st
+	return c, err
+}
+
+func listCampaigns(w http.ResponseWriter, db *sql.DB, establishmentID string) {
+	rows, err := db.Query(`SELECT `+campaignColumns+` FROM campaigns c WHERE c.establishment_id=$1 ORDER BY c.created_at DESC`, establishmentID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	list := []Campaign{}
+	for rows.Next() {
+		c, err := scanCampaign(rows)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		list = append(list, c)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func getCampaign(w http.ResponseWriter, db *sql.DB, establishmentID, campaignID string) {
+	c, err := scanCampaign(db.QueryRow(`SELECT `+campaignColumns+` FROM campaigns c WHERE c.id=$1 AND c.establishment_id=$2`, campaignID, establishmentID))
+	if err == sql.ErrNoRows {
+		http.NotFound(w, nil)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
+
+// scheduleCampaign moves a draft to "scheduled" (sent at send_at, or right
+// away) or a scheduled campaign back to "draft". Sent campaigns can't change.
+func scheduleCampaign(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID, campaignID string) {
+	var req struct {
+		Status string     `json:"status"`
+		SendAt *time.Time `json:"send_at"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Status != "scheduled" && req.Status != "draft" {
+		http.Error(w, "status must be scheduled or draft", http.StatusUnprocessableEntity)
+		return
+	}
+	sendAt := time.Now().UTC()
+	if req.SendAt != nil {
+		sendAt = req.SendAt.UTC()
+	}
+	res, err := db.Exec(
+		`UPDATE campaigns SET status=$3, send_at=CASE WHEN $3='scheduled' THEN $4::timestamp END
+		 WHERE id=$1 AND establishment_id=$2 AND status IN ('draft','scheduled')`,
+		campaignID, establishmentID, req.Status, sendAt,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "campaign not found or already sent", http.StatusConflict)
+		return
+	}
+	if err := recordAudit(db, r, establishmentID, "campaign."+req.Status, "campaign", campaignID, req); err != nil {
+		log.Printf("audit campaign.%s %s: %v", req.Status, campaignID, err)
+	}
+	getCampaign(w, db, establishmentID, campaignID)
+}
+
+func startCampaignDispatcher(db *sql.DB) {
+	go func() {
+		for {
+			if n, err := dispatchDueCampaigns(db); err != nil {
+				log.Printf("campaigns: %v", err)
+			} else if n > 0 {
+				log.Printf("campaigns: sent %d campaigns", n)
+			}
+			time.Sleep(campaignDispatchEvery)
+		}
+	}()
+}
+
+// dispatchDueCampaigns sends scheduled campaigns whose time has come, one
+// transaction per campaign.
+func dispatchDueCampaigns(db *sql.DB) (int, error) {
+	sent := 0
+	for {
+		ok, err := dispatchNextCampaign(db)
+		if err != nil || !ok {
+			return sent, err
+		}
+		sent++
+	}
+}
+
+// dispatchNextCampaign snapshots the segment's members who consented to the
+// campaign's channel as recipients, creates the campaign coupon and queues a
+// CAMPAIGN notification for each recipient.
+func dispatchNextCampaign(db *sql.DB) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+	var c Campaign
+	var establishment string
+	err = tx.QueryRow(
+		`SELECT c.id, c.establishment_id, c.segment_id, c.message, c.channel, c.discount_type, c.discount_value, c.coupon_valid_days, e.name
+		 FROM campaigns c JOIN establishments e ON e.id=c.establishment_id
+		 WHERE c.status='scheduled' AND c.send_at <= now() ORDER BY c.send_at LIMIT 1 FOR UPDATE OF c SKIP LOCKED`,
+	).Scan(&c.ID, &c.EstablishmentID, &c.SegmentID, &c.Message, &c.Channel, &c.DiscountType, &c.DiscountValue, &c.CouponValidDays, &establishment)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	if c.DiscountType != nil {
+		code, err := newCampaignCouponCode()
+		if err != nil {
+			return false, err
+		}
+		_, err = tx.Exec(
+			`INSERT INTO coupons (code, description, discount_type, discount_value, valid_from, valid_until, establishment_id, campaign_id)
+			 VALUES ($1,$2,$3,$4,current_date,current_date + $5::int,$6,$7)`,
+			code, c.Message, *c.DiscountType, *c.DiscountValue, c.CouponValidDays, c.EstablishmentID, c.ID,
+		)
+		if err != nil {
+			return false, err
+		}
+		c.CouponCode = &code
+	}
+	payload, err := json.Marshal(map[string]any{
+		"campaign_id":        c.ID,
+		"establishment_id":   c.EstablishmentID,
+		"establishment_name": establishment,
+		"message":            c.Message,
+		"coupon_code":        c.CouponCode,
+	})
+	if err != nil {
+		return false, err
+	}
+	_, err = tx.Exec(
+		`WITH members AS (`+segmentMembersSQL+`),
+		 sent AS (INSERT INTO notifications (customer_id, kind, channel, payload) SELECT customer_id, 'CAMPAIGN', $2, $3 FROM members
+		   WHERE `+marketingConsent("members.customer_id", "$2")+` RETURNING id, customer_id)
+		 INSERT INTO campaign_recipients (campaign_id, customer_id, notification_id) SELECT $4, customer_id, id FROM sent`,
+		c.SegmentID, c.Channel, payload, c.ID,
+	)
+	if err != nil {
+		return false, err
+	}
+	if _, err := tx.Exec(`UPDATE campaigns SET status='sent', sent_at=now(), coupon_code=$2 WHERE id=$1`, c.ID, c.CouponCode); err != nil {
+		return false, err
+	}
+	return true, tx.Commit()
+}
+
+// recordCampaignRedemption attributes an order to the campaign whose coupon
+// it used.
+func recordCampaignRedemption(tx *sql.Tx, couponCode, customerID, orderID string) error {
+	_, err := tx.Exec(
+		`UPDATE campaign_recipients r SET order_id=$3, redeemed_at=now() FROM coupons c
+		 WHERE c.code=$1 AND r.campaign_id=c.campaign_id AND r.customer_id=$2 AND r.redeemed_at IS NULL`,
+		couponCode, customerID, orderID,
+	)
+	return err
+}
+
+func newCampaignCouponCode() (string, error) {
+	b := make([]byte, 5)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return "CAMP" + base32.StdEncoding.EncodeToString(b), nil
+}
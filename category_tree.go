@@ -0,0 +1,177 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+
+	"github.com/lib/pq"
+)
+
+const maxCategoryDepth = 3
+
+var (
+	errCategoryParent = errors.New("parent category not found in this establishment")
+	errCategoryCycle  = errors.New("category cannot be moved under itself or its descendants")
+	errCategoryDepth  = errors.New("category tree is too deep")
+)
+
+type queryer interface {
+	QueryRow(query string, args ...any) *sql.Row
+}
+
+// validateCategoryParent checks that placing category id (empty when creating)
+// under parentID keeps the tree within one establishment, acyclic and no
+// deeper than maxCategoryDepth.
+func validateCategoryParent(q queryer, id, establishmentID string, parentID *string) error {
+	if parentID == nil {
+		if id == "" {
+			return nil
+		}
+		return checkSubtreeHeight(q, id, 1)
+	}
+
+	var parentDepth int
+	var isDescendant bool
+	err := q.QueryRow(
+		`WITH RECURSIVE ancestors AS (
+		   SELECT id, parent_id, 1 AS depth FROM product_categories WHERE id=$1 AND establishment_id=$2
+		   UNION ALL
+		   SELECT c.id, c.parent_id, a.depth+1 FROM product_categories c JOIN ancestors a ON c.id=a.parent_id
+		 )
+		 SELECT COALESCE(MAX(depth),0), COALESCE(bool_or(id::text=$3),false) FROM ancestors`,
+		*parentID, establishmentID, id,
+	).Scan(&parentDepth, &isDescendant)
+	if err != nil {
+		return err
+	}
+	if parentDepth == 0 {
+		return errCategoryParent
+	}
+	if isDescendant {
+		return errCategoryCycle
+	}
+	if id == "" {
+		if parentDepth+1 > maxCategoryDepth {
+			return errCategoryDepth
+		}
+		return nil
+	}
+	return checkSubtreeHeight(q, id, parentDepth+1)
+}
+
+func checkSubtreeHeight(q queryer, id string, depth int) error {
+	var height int
+	err := q.QueryRow(
+		`WITH RECURSIVE subtree AS (
+		   SELECT id, 1 AS height FROM product_categories WHERE id=$1
+		   UNION ALL
+		   SELECT c.id, s.height+1 FROM product_categories c JOIN subtree s ON c.parent_id=s.id
+		 )
+		 SELECT COALESCE(MAX(height),1) FROM subtree`,
+		id,
+	).Scan(&height)
+	if err != nil {
+		return err
+	}
+	if depth+height-1 > maxCategoryDepth {
+		return errCategoryDepth
+	}
+	return nil
+}
+
+func categoryTreeError(w http.ResponseWriter, err error) {
+	switch err {
+	case errCategoryParent, errCategoryCycle, errCategoryDepth:
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+	default:
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func moveCategoryProducts(w http.ResponseWriter, r *http.Request, db *sql.DB, targetID string) {
+	var req struct {
+		ProductIDs     []string `json:"product_ids"`
+		FromCategoryID string   `json:"from_category_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if (len(req.ProductIDs) == 0) == (req.FromCategoryID == "") {
+		http.Error(w, "provide either product_ids or from_category_id", http.StatusBadRequest)
+		return
+	}
+	seen := map[string]bool{}
+	ids := req.ProductIDs[:0]
+	for _, id := range req.ProductIDs {
+		if !seen[id] {
+			seen[id] = true
+			ids = append(ids, id)
+		}
+	}
+	req.ProductIDs = ids
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var establishmentID string
+	err = tx.QueryRow(`SELECT establishment_id FROM product_categories WHERE id=$1`, targetID).Scan(&establishmentID)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, nil)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	var res sql.Result
+	if req.FromCategoryID != "" {
+		var sourceEstablishment string
+		err := tx.QueryRow(`SELECT establishment_id FROM product_categories WHERE id=$1`, req.FromCategoryID).Scan(&sourceEstablishment)
+		if err == sql.ErrNoRows {
+			http.Error(w, "source category not found", http.StatusUnprocessableEntity)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if sourceEstablishment != establishmentID {
+			http.Error(w, "source and target categories belong to different establishments", http.StatusUnprocessableEntity)
+			return
+		}
+		res, err = tx.Exec(`UPDATE products SET category_id=$1, updated_at=now() WHERE category_id=$2`, targetID, req.FromCategoryID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else {
+		res, err = tx.Exec(
+			`UPDATE products SET category_id=$1, updated_at=now() WHERE id = ANY($2) AND establishment_id=$3`,
+			targetID, pq.Array(req.ProductIDs), establishmentID,
+		)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); int(n) != len(req.ProductIDs) {
+			http.Error(w, "some products were not found in the target category's establishment", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	responseCache.Invalidate(establishmentID)
+	moved, _ := res.RowsAffected()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int64{"moved": moved})
+}
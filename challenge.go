@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+)
+
+// ChallengeVerifier checks a token solved by the client in a CAPTCHA widget.
+type ChallengeVerifier interface {
+	Name() string
+	Verify(ctx context.Context, token, remoteIP string) (bool, error)
+}
+
+// challengeVerifier is nil when no provider is configured; establishments
+// can't turn the checkout challenge on in that case.
+var challengeVerifier ChallengeVerifier
+
+var challengesFailed = newCounter("challenges_failed_total", "Requests refused or let through because of a CAPTCHA challenge.", "reason")
+
+// newChallengeVerifierFromEnv picks the provider from CHALLENGE_PROVIDER,
+// "hcaptcha" or "turnstile", with its secret in CHALLENGE_SECRET.
+func newChallengeVerifierFromEnv() ChallengeVerifier {
+	secret := os.Getenv("CHALLENGE_SECRET")
+	switch os.Getenv("CHALLENGE_PROVIDER") {
+	case "hcaptcha":
+		return siteverifyChallenge{name: "hcaptcha", url: "https://api.hcaptcha.com/siteverify", secret: secret}
+	case "turnstile":
+		return siteverifyChallenge{name: "turnstile", url: "https://challenges.cloudflare.com/turnstile/v0/siteverify", secret: secret}
+	case "":
+		return nil
+	default:
+		log.Printf("unknown CHALLENGE_PROVIDER %q, challenges disabled", os.Getenv("CHALLENGE_PROVIDER"))
+		return nil
+	}
+}
+
+// siteverifyChallenge speaks the siteverify protocol shared by hCaptcha and
+// Cloudflare Turnstile: a form POST answered with {"success": bool}.
+type siteverifyChallenge struct {
+	name, url, secret string
+}
+
+func (c siteverifyChallenge) Name() string { return c.name }
+
+func (c siteverifyChallenge) Verify(ctx context.Context, token, remoteIP string) (bool, error) {
+	form := url.Values{"secret": {c.secret}, "response": {token}, "remoteip": {remoteIP}}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, c.url, strings.NewReader(form.Encode()))
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return false, fmt.Errorf("%s siteverify responded %d", c.name, resp.StatusCode)
+	}
+	var out struct {
+		Success bool `json:"success"`
+	}
+	err = json.NewDecoder(resp.Body).Decode(&out)
+	return out.Success, err
+}
+
+// passChallenge checks the X-Challenge-Token header and writes a
+// challenge_required error when it is missing or rejected. If the provider
+// itself can't be reached the request is let through: an outage there
+// shouldn't stop a restaurant from taking orders.
+func passChallenge(w http.ResponseWriter, r *http.Request) bool {
+	if challengeVerifier == nil {
+		return true
+	}
+	token := r.Header.Get("X-Challenge-Token")
+	if token == "" {
+		challengesFailed.Inc("missing")
+		writeCodedError(w, r, http.StatusForbidden, "challenge_required", "a CAPTCHA challenge must be solved")
+		return false
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 5*time.Second)
+	defer cancel()
+	ok, err := challengeVerifier.Verify(ctx, token, clientIP(r))
+	if err != nil {
+		log.Printf("challenge %s: %v", challengeVerifier.Name(), err)
+		challengesFailed.Inc("unavailable")
+		return true
+	}
+	if !ok {
+		challengesFailed.Inc("rejected")
+		writeCodedError(w, r, http.StatusForbidden, "challenge_required", "a CAPTCHA challenge must be solved")
+		return false
+	}
+	return true
+}
+
+// checkoutChallengeRequired reports whether the establishment asks for a
+// challenge on checkout.
+func checkoutChallengeRequired(db *sql.DB, establishmentID string) (bool, error) {
+	return settingBool(db, establishmentID, "require_checkout_challenge")
+}
+
+func updateCheckoutChallenge(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	if !requireRole(w, r, db, establishmentID, "manager") {
+		return
+	}
+	var req struct {
+		Required bool `json:"required"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Required && challengeVerifier == nil {
+		http.Error(w, "no challenge provider is configured", http.StatusUnprocessableEntity)
+		return
+	}
+	d, _ := findSetting("require_checkout_challenge")
+	if err := storeSetting(db, establishmentID, d, req.Required); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := recordAudit(db, r, establishmentID, "establishment.checkout_challenge_updated", "establishment", establishmentID, req); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(req)
+}
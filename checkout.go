@@ -0,0 +1,328 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+type CheckoutItem struct {
+	ProductID string `json:"product_id"`
+	Quantity  int    `json:"quantity"`
+}
+
+type CheckoutRequest struct {
+	EstablishmentID   string         `json:"establishment_id"`
+	Items             []CheckoutItem `json:"items"`
+	CouponCode        *string        `json:"coupon_code"`
+	Phone             string         `json:"phone"`
+	DeviceFingerprint string         `json:"device_fingerprint"`
+	PaymentMethod     string         `json:"payment_method"`
+	CardBrand         string         `json:"card_brand"`
+	ChangeForCents    *int64         `json:"change_for_cents"`
+	SlotID            *string        `json:"slot_id"`
+	FulfillmentType   string         `json:"fulfillment_type"`
+	// DeliveryAddressID is one of the customer's saved addresses; required
+	// for deliveries from establishments that charge a delivery fee.
+	DeliveryAddressID *string `json:"delivery_address_id"`
+	// PaymentToken is the card token from the establishment's gateway SDK,
+	// for online_card payments.
+	PaymentToken string `json:"payment_token"`
+	// StoreCreditCents pays part of the order from the customer's store
+	// credit at this establishment; it is capped at the order total.
+	StoreCreditCents int64 `json:"store_credit_cents"`
+	// GiftCardCode pays up to the rest of the order with a gift card of this
+	// establishment.
+	GiftCardCode *string `json:"gift_card_code"`
+	// DeviceLocation is where the customer's device is, if it shares it;
+	// only lat and lng are used, for risk scoring.
+	DeviceLocation *Address `json:"device_location"`
+	clientIP       string
+}
+
+// checkoutError carries a machine-readable code so clients can tell apart the
+// reasons a checkout was refused.
+type checkoutError struct {
+	status int
+	code   string
+	msg    string
+}
+
+func (e *checkoutError) Error() string { return e.msg }
+
+func writeCodedError(w http.ResponseWriter, r *http.Request, status int, code, msg string) {
+	msg = localize(r, code, msg)
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Content-Language", preferredLanguage(r))
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(map[string]string{"error": msg, "code": code})
+}
+
+func ordersHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodPost:
+			authenticateCustomer(db, func(w http.ResponseWriter, r *http.Request) { checkout(w, r, db) })(w, r)
+		case http.MethodGet:
+			authenticate(db, func(w http.ResponseWriter, r *http.Request) { listOrders(w, r, db) })(w, r)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func checkout(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var req CheckoutRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Items) == 0 {
+		http.Error(w, "items must not be empty", http.StatusBadRequest)
+		return
+	}
+	if req.DeviceFingerprint == "" {
+		req.DeviceFingerprint = r.Header.Get("X-Device-Fingerprint")
+	}
+	req.clientIP = clientIP(r)
+	required, err := checkoutChallengeRequired(db, req.EstablishmentID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if required && !passChallenge(w, r) {
+		return
+	}
+	customerID := currentClaims(r).Sub
+	if !requireLegalAcceptance(w, r, db, "customer", customerID) {
+		return
+	}
+	if err := refreshCustomerFlags(db, req.EstablishmentID, customerID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	o, err := placeOrder(tx, customerID, &req)
+	var ce *checkoutError
+	if errors.As(err, &ce) {
+		writeCodedError(w, r, ce.status, ce.code, ce.msg)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	ordersPlaced.Inc(o.EstablishmentID)
+	// A failed charge doesn't undo the order: the customer can retry through
+	// POST /orders/{id}/payments, and unpaid orders time out like any other.
+	o.Payment, err = startPayment(r.Context(), db, o.ID, req.PaymentToken)
+	if err != nil {
+		log.Printf("payment for order %s: %v", o.ID, err)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(o)
+}
+
+func placeOrder(tx *sql.Tx, customerID string, req *CheckoutRequest) (*Order, error) {
+	var status string
+	err := tx.QueryRow(`SELECT status FROM establishments WHERE id=$1`, req.EstablishmentID).Scan(&status)
+	if err == sql.ErrNoRows || (err == nil && status != "published") {
+		return nil, &checkoutError{http.StatusNotFound, "establishment_unavailable", "establishment is not accepting orders"}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if req.Phone == "" {
+		var phone sql.NullString
+		if err := tx.QueryRow(`SELECT phone FROM customers WHERE id=$1`, customerID).Scan(&phone); err != nil {
+			return nil, err
+		}
+		req.Phone = phone.String
+	}
+	if err := checkCustomerAllowed(tx, req.EstablishmentID, customerID, req.Phone, req.DeviceFingerprint); err != nil {
+		return nil, err
+	}
+
+	if req.CouponCode != nil && strings.TrimSpace(*req.CouponCode) == "" {
+		req.CouponCode = nil
+	}
+	if req.FulfillmentType == "" {
+		req.FulfillmentType = "delivery"
+	}
+	if !validFulfillmentType(req.FulfillmentType) {
+		return nil, &checkoutError{http.StatusBadRequest, "fulfillment_type_invalid", "fulfillment_type must be delivery, pickup or dine_in"}
+	}
+	o := &Order{CustomerID: customerID, EstablishmentID: req.EstablishmentID, CouponCode: req.CouponCode, FulfillmentType: req.FulfillmentType, Items: []OrderItem{}}
+	productIDs := make([]string, len(req.Items))
+	for i, it := range req.Items {
+		productIDs[i] = it.ProductID
+	}
+	products, err := loadCheckoutProducts(tx, productIDs)
+	if err != nil {
+		return nil, err
+	}
+	var subtotal int64
+	for _, it := range req.Items {
+		if it.Quantity <= 0 {
+			return nil, &checkoutError{http.StatusBadRequest, "invalid_quantity", "quantity must be positive"}
+		}
+		p, ok := products[it.ProductID]
+		if !ok || p.establishmentID != req.EstablishmentID {
+			return nil, &checkoutError{http.StatusUnprocessableEntity, "product_unavailable", "product " + it.ProductID + " is not available"}
+		}
+		if !slices.Contains(p.fulfillmentTypes, req.FulfillmentType) {
+			return nil, &checkoutError{http.StatusUnprocessableEntity, "product_not_fulfillable", "product " + it.ProductID + " is not available for " + req.FulfillmentType}
+		}
+		if err := takeStock(tx, req.EstablishmentID, it.ProductID, it.Quantity); errors.Is(err, errOutOfStock) {
+			return nil, &checkoutError{http.StatusConflict, "out_of_stock", "product " + it.ProductID + " is out of stock"}
+		} else if err != nil {
+			return nil, err
+		}
+		item := OrderItem{ProductID: it.ProductID, ProductName: p.name, Quantity: it.Quantity, UnitPriceCents: p.priceCents, TotalPriceCents: p.priceCents * int64(it.Quantity)}
+		o.Items = append(o.Items, item)
+		subtotal += item.TotalPriceCents
+	}
+
+	discount, err := couponDiscount(tx, req.CouponCode, req.EstablishmentID, customerID, subtotal)
+	if err != nil {
+		return nil, err
+	}
+	o.TotalCents = subtotal - discount
+	if err := applyDeliveryFee(tx, o, req); err != nil {
+		return nil, err
+	}
+	if req.StoreCreditCents < 0 {
+		return nil, &checkoutError{http.StatusBadRequest, "store_credit_invalid", "store_credit_cents must not be negative"}
+	}
+	o.PaymentMethod, o.ChangeForCents = req.PaymentMethod, req.ChangeForCents
+	if req.SlotID != nil {
+		startsAt, err := bookSlot(tx, req.EstablishmentID, *req.SlotID)
+		if err != nil {
+			return nil, err
+		}
+		o.SlotID, o.ScheduledFor = req.SlotID, &startsAt
+	}
+
+	// Numbering last keeps the sequence row locked for as little of the
+	// transaction as possible.
+	if o.BusinessDate, o.OrderNumber, err = nextOrderNumber(tx, o.EstablishmentID); err != nil {
+		return nil, err
+	}
+	o.DisplayNumber = formatOrderNumber(o.OrderNumber)
+	err = tx.QueryRow(
+		`INSERT INTO orders (customer_id, establishment_id, coupon_code, total_cents, fulfillment_type, payment_method, change_for_cents, slot_id, scheduled_for,
+		   delivery_address, delivery_lat, delivery_lng, delivery_fee_cents, delivery_fee_details, estimated_delivery_at, business_date, order_number, device_fingerprint)
+		 VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16,$17,NULLIF($18,'')) RETURNING id, status, ordered_at`,
+		o.CustomerID, o.EstablishmentID, o.CouponCode, o.TotalCents, o.FulfillmentType, o.PaymentMethod, o.ChangeForCents, o.SlotID, o.ScheduledFor,
+		o.DeliveryAddress, o.deliveryTo.Lat, o.deliveryTo.Lng, o.DeliveryFeeCents, []byte(o.DeliveryFeeDetails), o.EstimatedDeliveryAt, o.BusinessDate, o.OrderNumber, req.DeviceFingerprint,
+	).Scan(&o.ID, &o.Status, &o.OrderedAt)
+	if err != nil {
+		return nil, err
+	}
+	if err := applyStoreCredit(tx, o, req.StoreCreditCents); err != nil {
+		return nil, err
+	}
+	if req.GiftCardCode != nil && strings.TrimSpace(*req.GiftCardCode) != "" {
+		if err := redeemGiftCard(tx, o, *req.GiftCardCode, o.TotalCents-o.StoreCreditCents); err != nil {
+			return nil, err
+		}
+	}
+	// The payment method only has to cover what credit and gift cards left.
+	if err := checkPaymentMethod(tx, req, o.amountDue()); err != nil {
+		return nil, err
+	}
+	for _, it := range o.Items {
+		_, err := tx.Exec(
+			`INSERT INTO order_items (order_id, product_id, product_name, quantity, unit_price_cents, total_price_cents) VALUES ($1,$2,$3,$4,$5,$6)
+			 ON CONFLICT (order_id, product_id) DO UPDATE SET quantity=order_items.quantity+EXCLUDED.quantity, total_price_cents=order_items.total_price_cents+EXCLUDED.total_price_cents`,
+			o.ID, it.ProductID, it.ProductName, it.Quantity, it.UnitPriceCents, it.TotalPriceCents,
+		)
+		if err != nil {
+			return nil, err
+		}
+	}
+	if o.CouponCode != nil {
+		_, err := tx.Exec(`INSERT INTO coupon_redemptions (coupon_code, customer_id, order_id) VALUES ($1,$2,$3)`, *o.CouponCode, customerID, o.ID)
+		if err != nil {
+			return nil, err
+		}
+		if err := recordCampaignRedemption(tx, *o.CouponCode, customerID, o.ID); err != nil {
+			return nil, err
+		}
+	}
+	if _, err := tx.Exec(`INSERT INTO order_events (order_id, event_type) VALUES ($1,'CREATED')`, o.ID); err != nil {
+		return nil, err
+	}
+	var email string
+	if err := tx.QueryRow(`SELECT email FROM customers WHERE id=$1`, customerID).Scan(&email); err != nil {
+		return nil, err
+	}
+	risk, err := assessOrderRisk(tx, RiskInput{
+		OrderID: o.ID, EstablishmentID: o.EstablishmentID, CustomerID: customerID, Email: email, Phone: req.Phone,
+		Device: req.DeviceFingerprint, IP: req.clientIP, TotalCents: o.TotalCents, PaymentMethod: o.PaymentMethod,
+		DeliveryTo: o.deliveryTo, DeviceLocation: req.DeviceLocation,
+	})
+	if err != nil {
+		return nil, err
+	}
+	o.RiskScore = risk.Score
+	if err := enqueueEvent(tx, Event{Type: eventOrderCreated, OrderID: o.ID, OrderNumber: o.OrderNumber, EstablishmentID: o.EstablishmentID}); err != nil {
+		return nil, err
+	}
+	return o, nil
+}
+
+// couponDiscount validates the coupon for the order. Establishment coupons
+// only apply to that establishment, and campaign coupons only once to each of
+// the campaign's recipients.
+func couponDiscount(tx *sql.Tx, code *string, establishmentID, customerID string, subtotal int64) (int64, error) {
+	if code == nil {
+		return 0, nil
+	}
+	var kind string
+	var value int64
+	var maxUses sql.NullInt64
+	var used int64
+	err := tx.QueryRow(
+		`SELECT discount_type, discount_value, max_uses, (SELECT COUNT(*) FROM coupon_redemptions WHERE coupon_code=c.code)
+		 FROM coupons c WHERE code=$1 AND current_date BETWEEN valid_from AND valid_until
+		   AND (establishment_id IS NULL OR establishment_id=$2)
+		   AND (campaign_id IS NULL OR EXISTS (SELECT 1 FROM campaign_recipients r WHERE r.campaign_id=c.campaign_id AND r.customer_id=$3 AND r.redeemed_at IS NULL))
+		 FOR UPDATE`,
+		*code, establishmentID, customerID,
+	).Scan(&kind, &value, &maxUses, &used)
+	if err == sql.ErrNoRows {
+		return 0, &checkoutError{http.StatusUnprocessableEntity, "coupon_invalid", "coupon is invalid or expired"}
+	}
+	if err != nil {
+		return 0, err
+	}
+	if maxUses.Valid && used >= maxUses.Int64 {
+		return 0, &checkoutError{http.StatusUnprocessableEntity, "coupon_exhausted", "coupon has reached its usage limit"}
+	}
+	discount := value
+	if kind == "percent" {
+		discount = subtotal * value / 100
+	}
+	if discount > subtotal {
+		discount = subtotal
+	}
+	return discount, nil
+}
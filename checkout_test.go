@@ -0,0 +1,14 @@
+package main
+
+import "testing"
+
+// BenchmarkCheckout places an order and rolls it back, so stock and order
+// numbers don't drift between iterations.
+func BenchmarkCheckout(b *testing.B) {
+	db := openTestDB(b)
+	t := seedTestTenant(b, db, 20, 0)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		placeTestOrder(b, db, t, false)
+	}
+}
@@ -0,0 +1,156 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"slices"
+	"sort"
+	"strings"
+	"time"
+)
+
+// histogramBounds are the upper bounds of the printed latency buckets.
+var histogramBounds = []time.Duration{
+	5 * time.Millisecond, 10 * time.Millisecond, 25 * time.Millisecond, 50 * time.Millisecond,
+	100 * time.Millisecond, 250 * time.Millisecond, 500 * time.Millisecond,
+	time.Second, 2500 * time.Millisecond, 5 * time.Second,
+}
+
+// histogram keeps every latency of a scenario; runs are short enough that
+// exact percentiles are cheaper than getting bucket interpolation right.
+type histogram struct {
+	latencies []time.Duration
+	errors    int
+	// sampleErrors keeps the first few distinct failures for the report.
+	sampleErrors []string
+}
+
+func newHistogram() *histogram { return &histogram{} }
+
+func (h *histogram) add(latency time.Duration, err error) {
+	h.latencies = append(h.latencies, latency)
+	if err == nil {
+		return
+	}
+	h.errors++
+	if msg := err.Error(); len(h.sampleErrors) < 5 && !slices.Contains(h.sampleErrors, msg) {
+		h.sampleErrors = append(h.sampleErrors, msg)
+	}
+}
+
+// ScenarioStats summarizes one scenario. Latencies are in milliseconds.
+type ScenarioStats struct {
+	Requests  int     `json:"requests"`
+	Errors    int     `json:"errors"`
+	PerSecond float64 `json:"per_second"`
+	P50       float64 `json:"p50_ms"`
+	P90       float64 `json:"p90_ms"`
+	P95       float64 `json:"p95_ms"`
+	P99       float64 `json:"p99_ms"`
+	Max       float64 `json:"max_ms"`
+	// Buckets counts requests at or under each bound of histogramBounds,
+	// the last entry counting the slower ones.
+	Buckets      []int    `json:"buckets"`
+	SampleErrors []string `json:"sample_errors,omitempty"`
+}
+
+// Summary is the result of a run, also the format of -out and -baseline.
+type Summary struct {
+	DurationSeconds float64                  `json:"duration_seconds"`
+	Scenarios       map[string]ScenarioStats `json:"scenarios"`
+}
+
+func (d *driver) summary(elapsed time.Duration) Summary {
+	d.mu.Lock()
+	defer d.mu.Unlock()
+	s := Summary{DurationSeconds: elapsed.Seconds(), Scenarios: map[string]ScenarioStats{}}
+	for name, h := range d.results {
+		lat := slices.Clone(h.latencies)
+		slices.Sort(lat)
+		st := ScenarioStats{
+			Requests:     len(lat),
+			Errors:       h.errors,
+			PerSecond:    float64(len(lat)) / elapsed.Seconds(),
+			P50:          ms(percentile(lat, 0.50)),
+			P90:          ms(percentile(lat, 0.90)),
+			P95:          ms(percentile(lat, 0.95)),
+			P99:          ms(percentile(lat, 0.99)),
+			Max:          ms(percentile(lat, 1)),
+			Buckets:      make([]int, len(histogramBounds)+1),
+			SampleErrors: h.sampleErrors,
+		}
+		for _, l := range lat {
+			i, _ := slices.BinarySearch(histogramBounds, l)
+			st.Buckets[i]++
+		}
+		s.Scenarios[name] = st
+	}
+	return s
+}
+
+// percentile expects sorted latencies.
+func percentile(sorted []time.Duration, p float64) time.Duration {
+	if len(sorted) == 0 {
+		return 0
+	}
+	i := int(p*float64(len(sorted))+0.5) - 1
+	return sorted[max(0, min(i, len(sorted)-1))]
+}
+
+func ms(d time.Duration) float64 { return float64(d.Microseconds()) / 1000 }
+
+func (s Summary) print(w io.Writer) {
+	for _, name := range s.names() {
+		st := s.Scenarios[name]
+		fmt.Fprintf(w, "\n%s: %d requests (%.1f/s), %d errors\n", name, st.Requests, st.PerSecond, st.Errors)
+		fmt.Fprintf(w, "  p50 %.1fms  p90 %.1fms  p95 %.1fms  p99 %.1fms  max %.1fms\n", st.P50, st.P90, st.P95, st.P99, st.Max)
+		peak := max(1, slices.Max(st.Buckets))
+		for i, n := range st.Buckets {
+			label := "> " + histogramBounds[len(histogramBounds)-1].String()
+			if i < len(histogramBounds) {
+				label = "<= " + histogramBounds[i].String()
+			}
+			fmt.Fprintf(w, "  %9s %7d %s\n", label, n, strings.Repeat("#", n*40/peak))
+		}
+		for _, e := range st.SampleErrors {
+			fmt.Fprintf(w, "  error: %s\n", e)
+		}
+	}
+}
+
+// check reports scenarios whose error rate is above maxErrorRate.
+func (s Summary) check(maxErrorRate float64) []string {
+	var failures []string
+	for _, name := range s.names() {
+		st := s.Scenarios[name]
+		if rate := float64(st.Errors) / float64(max(1, st.Requests)); rate > maxErrorRate {
+			failures = append(failures, fmt.Sprintf("%s: error rate %.2f%% is above %.2f%%", name, rate*100, maxErrorRate*100))
+		}
+	}
+	return failures
+}
+
+// compare reports scenarios whose p95 grew by more than maxRegression over
+// the baseline.
+func (s Summary) compare(base Summary, maxRegression float64) []string {
+	var failures []string
+	for _, name := range s.names() {
+		b, ok := base.Scenarios[name]
+		if !ok || b.P95 == 0 {
+			continue
+		}
+		if p95 := s.Scenarios[name].P95; p95 > b.P95*(1+maxRegression) {
+			failures = append(failures, fmt.Sprintf("%s: p95 %.1fms regressed from %.1fms, over the allowed %.0f%%", name, p95, b.P95, maxRegression*100))
+		}
+	}
+	return failures
+}
+
+func (s Summary) names() []string {
+	names := make([]string, 0, len(s.Scenarios))
+	for name := range s.Scenarios {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
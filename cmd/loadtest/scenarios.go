@@ -0,0 +1,71 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"io"
+	"math/rand/v2"
+	"net/http"
+)
+
+// scenarios are the user journeys the driver mixes. Each returns an error
+// for transport failures and unexpected statuses.
+var scenarios = map[string]func(ctx context.Context, d *driver) error{
+	"menu":     readMenu,
+	"checkout": placeOrder,
+}
+
+// readMenu fetches the public menu, the hottest read path.
+func readMenu(ctx context.Context, d *driver) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, d.target+"/establishments/"+d.tenant.EstablishmentID+"/menu", nil)
+	if err != nil {
+		return err
+	}
+	return d.do(req, http.StatusOK)
+}
+
+// placeOrder checks out one to three random products for pickup as a random
+// customer, paying on delivery so no gateway is involved.
+func placeOrder(ctx context.Context, d *driver) error {
+	type item struct {
+		ProductID string `json:"product_id"`
+		Quantity  int    `json:"quantity"`
+	}
+	items := make([]item, 1+rand.IntN(3))
+	for i := range items {
+		items[i] = item{ProductID: d.tenant.ProductIDs[rand.IntN(len(d.tenant.ProductIDs))], Quantity: 1 + rand.IntN(2)}
+	}
+	body, _ := json.Marshal(map[string]any{
+		"establishment_id": d.tenant.EstablishmentID,
+		"items":            items,
+		"fulfillment_type": "pickup",
+		"payment_method":   "cash",
+	})
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, d.target+"/orders", bytes.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("Authorization", "Bearer "+d.tenant.CustomerTokens[rand.IntN(len(d.tenant.CustomerTokens))])
+	return d.do(req, http.StatusCreated)
+}
+
+// do sends req and drains the body, so the latency covers the whole
+// response.
+func (d *driver) do(req *http.Request, want int) error {
+	resp, err := d.client.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		return err
+	}
+	if resp.StatusCode != want {
+		return fmt.Errorf("%s %s: %d %s", req.Method, req.URL.Path, resp.StatusCode, bytes.TrimSpace(body[:min(len(body), 200)]))
+	}
+	return nil
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"time"
+)
+
+// tenant is the synthetic establishment the run targets.
+type tenant struct {
+	EstablishmentID string
+	ProductIDs      []string
+	CustomerTokens  []string
+}
+
+// seedTenant creates a published establishment with a few categories of
+// products and customers who accepted the current legal documents, and
+// signs a token for each customer. Customers can only sign up through
+// OAuth, so they are created here rather than through the API.
+func seedTenant(db *sql.DB, tag string, products, customers int, secret []byte) (*tenant, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	t := &tenant{}
+	previewToken, err := randomHex(16)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.QueryRow(
+		`INSERT INTO establishments (name, description, status, preview_token, published_at) VALUES ($1, 'Synthetic tenant for load tests', 'published', $2, now()) RETURNING id`,
+		tag, previewToken,
+	).Scan(&t.EstablishmentID)
+	if err != nil {
+		return nil, fmt.Errorf("establishment: %w", err)
+	}
+
+	const categories = 6
+	categoryIDs := make([]string, categories)
+	for i := range categoryIDs {
+		err := tx.QueryRow(
+			`INSERT INTO product_categories (establishment_id, name) VALUES ($1, $2) RETURNING id`,
+			t.EstablishmentID, fmt.Sprintf("Category %d", i+1),
+		).Scan(&categoryIDs[i])
+		if err != nil {
+			return nil, fmt.Errorf("category: %w", err)
+		}
+	}
+	for i := 0; i < products; i++ {
+		var id string
+		err := tx.QueryRow(
+			`INSERT INTO products (establishment_id, category_id, name, description, price_cents) VALUES ($1, $2, $3, $4, $5) RETURNING id`,
+			t.EstablishmentID, categoryIDs[i%categories], fmt.Sprintf("Product %d", i+1), "A synthetic product with a description of realistic length for menu payloads.", 990+(i%30)*150,
+		).Scan(&id)
+		if err != nil {
+			return nil, fmt.Errorf("product: %w", err)
+		}
+		t.ProductIDs = append(t.ProductIDs, id)
+	}
+
+	for i := 0; i < customers; i++ {
+		var id string
+		err := tx.QueryRow(
+			`INSERT INTO customers (name, email, phone, password_hash) VALUES ($1, $2, $3, '!') RETURNING id`,
+			fmt.Sprintf("Customer %d", i+1), fmt.Sprintf("%s-%d@loadtest.invalid", tag, i+1), fmt.Sprintf("119%08d", i+1),
+		).Scan(&id)
+		if err != nil {
+			return nil, fmt.Errorf("customer: %w", err)
+		}
+		_, err = tx.Exec(
+			`INSERT INTO legal_acceptances (kind, version, customer_id)
+			 SELECT DISTINCT ON (kind) kind, version, $1 FROM legal_documents WHERE published_at <= now() ORDER BY kind, version DESC`,
+			id,
+		)
+		if err != nil {
+			return nil, fmt.Errorf("legal acceptance: %w", err)
+		}
+		token, err := signCustomerToken(secret, id)
+		if err != nil {
+			return nil, err
+		}
+		t.CustomerTokens = append(t.CustomerTokens, token)
+	}
+	if len(t.ProductIDs) == 0 || len(t.CustomerTokens) == 0 {
+		return nil, fmt.Errorf("need at least one product and one customer")
+	}
+	return t, tx.Commit()
+}
+
+// signCustomerToken mints an access token the way the API does, valid for
+// a day so it outlasts any run.
+func signCustomerToken(secret []byte, customerID string) (string, error) {
+	jti, err := randomHex(16)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	body, err := json.Marshal(map[string]any{
+		"sub": customerID, "typ": "customer", "jti": jti,
+		"iat": now.Unix(), "exp": now.Add(24 * time.Hour).Unix(),
+	})
+	if err != nil {
+		return "", err
+	}
+	unsigned := base64.RawURLEncoding.EncodeToString([]byte(`{"alg":"HS256","typ":"JWT"}`)) + "." + base64.RawURLEncoding.EncodeToString(body)
+	mac := hmac.New(sha256.New, secret)
+	mac.Write([]byte(unsigned))
+	return unsigned + "." + base64.RawURLEncoding.EncodeToString(mac.Sum(nil)), nil
+}
+
+func randomHex(n int) (string, error) {
+	b := make([]byte, n)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
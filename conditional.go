@@ -0,0 +1,45 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+)
+
+// setLastModified advertises updated_at so clients can send it back in
+// If-Unmodified-Since.
+func setLastModified(w http.ResponseWriter, t time.Time) {
+	w.Header().Set("Last-Modified", t.UTC().Format(http.TimeFormat))
+}
+
+// checkUnmodifiedSince enforces If-Unmodified-Since against the row's
+// updated_at, writing 412 when the row changed after the given time. HTTP
+// dates have one-second precision, so updated_at is truncated before the
+// comparison. Inside a transaction the row stays locked until commit. A
+// missing or unparseable header passes.
+func checkUnmodifiedSince(q queryer, w http.ResponseWriter, r *http.Request, table, id string) bool {
+	header := r.Header.Get("If-Unmodified-Since")
+	if header == "" {
+		return true
+	}
+	since, err := http.ParseTime(header)
+	if err != nil {
+		return true
+	}
+	var updatedAt time.Time
+	err = q.QueryRow(`SELECT updated_at FROM `+table+` WHERE id=$1 FOR UPDATE`, id).Scan(&updatedAt)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, nil)
+		return false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if updatedAt.Truncate(time.Second).After(since) {
+		setLastModified(w, updatedAt)
+		http.Error(w, "resource was modified since "+header, http.StatusPreconditionFailed)
+		return false
+	}
+	return true
+}
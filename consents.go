@@ -0,0 +1,133 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"time"
+)
+
+var consentChannels = []string{"whatsapp", "email", "push"}
+
+// Consent is a customer's opt-in to marketing on one channel. Customers who
+// never answered have no row and are treated as not consenting; every
+// marketing send (campaigns, review requests) checks it with
+// marketingConsent.
+type Consent struct {
+	Channel   string     `json:"channel"`
+	Granted   bool       `json:"granted"`
+	Source    string     `json:"source,omitempty"`
+	UpdatedAt *time.Time `json:"updated_at"`
+}
+
+// marketingConsent returns an SQL condition that holds when the customer
+// opted in to the channel; both arguments are SQL expressions such as a
+// column or a placeholder.
+func marketingConsent(customer, channel string) string {
+	return `EXISTS (SELECT 1 FROM customer_consents cc WHERE cc.customer_id=` + customer + ` AND cc.channel=` + channel + ` AND cc.granted)`
+}
+
+func customerConsentsHandler(db *sql.DB) http.HandlerFunc {
+	return authenticateCustomer(db, func(w http.ResponseWriter, r *http.Request) {
+		switch r.Method {
+		case http.MethodGet:
+			listConsents(w, r, db)
+		case http.MethodPut:
+			updateConsents(w, r, db)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// listConsents returns every channel, including those never answered.
+func listConsents(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	rows, err := db.Query(`SELECT channel, granted, source, updated_at FROM customer_consents WHERE customer_id=$1`, currentClaims(r).Sub)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	byChannel := map[string]Consent{}
+	for rows.Next() {
+		var c Consent
+		if err := rows.Scan(&c.Channel, &c.Granted, &c.Source, &c.UpdatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		byChannel[c.Channel] = c
+	}
+	list := []Consent{}
+	for _, ch := range consentChannels {
+		c, ok := byChannel[ch]
+		if !ok {
+			c = Consent{Channel: ch}
+		}
+		list = append(list, c)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// updateConsents records explicit answers for the given channels. Each change
+// is also appended to customer_consent_log with the request's IP and user
+// agent, as evidence of when and where consent was given or withdrawn.
+func updateConsents(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var req struct {
+		// Source identifies the screen or flow, e.g. "signup" or "settings".
+		Source   string    `json:"source"`
+		Consents []Consent `json:"consents"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Source = sanitizeText(req.Source)
+	if req.Source == "" {
+		req.Source = "settings"
+	}
+	if len(req.Source) > 50 {
+		http.Error(w, "source is too long", http.StatusUnprocessableEntity)
+		return
+	}
+	for _, c := range req.Consents {
+		if !slices.Contains(consentChannels, c.Channel) {
+			http.Error(w, "channel must be whatsapp, email or push", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	customerID := currentClaims(r).Sub
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	for _, c := range req.Consents {
+		_, err := tx.Exec(
+			`INSERT INTO customer_consents (customer_id, channel, granted, source) VALUES ($1,$2,$3,$4)
+			 ON CONFLICT (customer_id, channel) DO UPDATE SET granted=EXCLUDED.granted, source=EXCLUDED.source, updated_at=now()`,
+			customerID, c.Channel, c.Granted, req.Source,
+		)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		_, err = tx.Exec(
+			`INSERT INTO customer_consent_log (customer_id, channel, granted, source, ip, user_agent) VALUES ($1,$2,$3,$4,$5,$6)`,
+			customerID, c.Channel, c.Granted, req.Source, clientIP(r), r.UserAgent(),
+		)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	listConsents(w, r, db)
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"context"
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// The courier app signs in by pairing: staff generate a one-time code for
+// the courier, and the phone redeems it together with its device identifier.
+// The resulting token is bound to that device (the app sends the identifier
+// in X-Device-ID with every request) and a courier has one active device at a
+// time, so pairing a new phone signs the previous one out. Staff see each
+// device's status and last activity and can sign it out.
+
+const (
+	pairingCodeTTL   = 15 * time.Minute
+	courierTokenTTL  = 30 * 24 * time.Hour
+	pairingCodeChars = 8
+)
+
+// pairingAttempts limits code guesses per IP.
+var pairingAttempts = newWindowLimiter(15*time.Minute, 10)
+
+type CourierDevice struct {
+	ID           string     `json:"id"`
+	CourierID    string     `json:"courier_id"`
+	Name         string     `json:"name"`
+	Status       string     `json:"status"`
+	RegisteredAt time.Time  `json:"registered_at"`
+	LastSeenAt   time.Time  `json:"last_seen_at"`
+	RevokedAt    *time.Time `json:"revoked_at,omitempty"`
+}
+
+type PairingCode struct {
+	Code      string    `json:"code"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func newPairingCode() (string, error) {
+	b := make([]byte, pairingCodeChars)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	for i, c := range b {
+		b[i] = giftCardAlphabet[int(c)%len(giftCardAlphabet)]
+	}
+	return string(b), nil
+}
+
+// createPairingCode serves POST /couriers/{id}/pairing_code. A new code
+// replaces any unused one.
+func createPairingCode(w http.ResponseWriter, db *sql.DB, c *Courier) {
+	if !c.Active {
+		http.Error(w, "courier is inactive", http.StatusConflict)
+		return
+	}
+	code, err := newPairingCode()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	p := PairingCode{Code: code}
+	err = db.QueryRow(
+		`UPDATE couriers SET pairing_code_hash=$1, pairing_expires_at=now() + $2 * interval '1 second' WHERE id=$3 RETURNING pairing_expires_at`,
+		hashToken(code), int(pairingCodeTTL.Seconds()), c.ID,
+	).Scan(&p.ExpiresAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(p)
+}
+
+// listCourierDevices serves GET /couriers/{id}/devices, newest first.
+func listCourierDevices(w http.ResponseWriter, db *sql.DB, c *Courier) {
+	rows, err := db.Query(
+		`SELECT id, courier_id, name, revoked_at IS NULL, registered_at, last_seen_at, revoked_at
+		 FROM courier_devices WHERE courier_id=$1 ORDER BY registered_at DESC`, c.ID,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	list := []CourierDevice{}
+	for rows.Next() {
+		var d CourierDevice
+		var active bool
+		if err := rows.Scan(&d.ID, &d.CourierID, &d.Name, &active, &d.RegisteredAt, &d.LastSeenAt, &d.RevokedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		d.Status = "signed_out"
+		if active && c.Active {
+			d.Status = "active"
+		}
+		list = append(list, d)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// revokeCourierDevice serves DELETE /couriers/{id}/devices/{deviceID},
+// signing the device out.
+func revokeCourierDevice(w http.ResponseWriter, r *http.Request, db *sql.DB, c *Courier, deviceID string) {
+	if !uuidPattern.MatchString(deviceID) {
+		http.NotFound(w, nil)
+		return
+	}
+	res, err := db.Exec(`UPDATE courier_devices SET revoked_at=now() WHERE id=$1 AND courier_id=$2 AND revoked_at IS NULL`, deviceID, c.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.NotFound(w, nil)
+		return
+	}
+	if err := recordAudit(db, r, c.EstablishmentID, "courier.device_revoked", "courier", c.ID, map[string]string{"device_id": deviceID}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// registerCourierDevice serves POST /courier_app/register.
+func registerCourierDevice(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	if !pairingAttempts.allow(clientIP(r)) {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "too many attempts", http.StatusTooManyRequests)
+		return
+	}
+	var req struct {
+		Code       string `json:"code"`
+		DeviceID   string `json:"device_id"`
+		DeviceName string `json:"device_name"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.DeviceID == "" {
+		http.Error(w, "device_id is required", http.StatusUnprocessableEntity)
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var courierID string
+	err = tx.QueryRow(
+		`UPDATE couriers SET pairing_code_hash=NULL, pairing_expires_at=NULL
+		 WHERE pairing_code_hash=$1 AND pairing_expires_at > now() AND active RETURNING id`,
+		hashToken(strings.ToUpper(strings.TrimSpace(req.Code))),
+	).Scan(&courierID)
+	if err == sql.ErrNoRows {
+		http.Error(w, "invalid or expired code", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// One active device per courier: pairing signs out the previous phone.
+	if _, err := tx.Exec(`UPDATE courier_devices SET revoked_at=now() WHERE courier_id=$1 AND revoked_at IS NULL`, courierID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var deviceRowID string
+	err = tx.QueryRow(
+		`INSERT INTO courier_devices (courier_id, device_hash, name) VALUES ($1,$2,left($3, 100)) RETURNING id`,
+		courierID, hashToken(req.DeviceID), sanitizeText(req.DeviceName),
+	).Scan(&deviceRowID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tok, err := issueClaims(Claims{Sub: courierID, Typ: "courier", Dev: deviceRowID}, courierTokenTTL)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tok)
+}
+
+// authenticateCourier accepts courier app tokens sent from the device they
+// were issued to, while the device is still signed in and the courier active.
+func authenticateCourier(db *sql.DB, next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		c, err := parseJWT(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer "))
+		if err != nil || c.Typ != "courier" || c.Dev == "" {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		var ok bool
+		err = db.QueryRow(
+			`SELECT EXISTS(SELECT 1 FROM courier_devices d JOIN couriers c ON c.id=d.courier_id
+			   WHERE d.id::text=$1 AND d.courier_id::text=$2 AND d.device_hash=$3 AND d.revoked_at IS NULL AND c.active)`,
+			c.Dev, c.Sub, hashToken(r.Header.Get("X-Device-ID")),
+		).Scan(&ok)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "unauthorized", http.StatusUnauthorized)
+			return
+		}
+		_, err = db.Exec(
+			`UPDATE courier_devices SET last_seen_at=now() WHERE id=$1 AND last_seen_at < now() - $2 * interval '1 second'`,
+			c.Dev, int(sessionTouchInterval.Seconds()),
+		)
+		if err != nil {
+			log.Printf("touch courier device %s: %v", c.Dev, err)
+		}
+		next(w, r.WithContext(context.WithValue(r.Context(), claimsKey{}, c)))
+	}
+}
+
+// courierAppHandler serves the courier app under /courier_app/: pairing,
+// the courier's profile, shifts and availability, location updates and their
+// batches, which they can start and update but not create or cancel.
+func courierAppHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		path := strings.TrimPrefix(r.URL.Path, "/courier_app/")
+		if path == "register" && r.Method == http.MethodPost {
+			registerCourierDevice(w, r, db)
+			return
+		}
+		authenticateCourier(db, func(w http.ResponseWriter, r *http.Request) {
+			claims := currentClaims(r)
+			if path == "logout" && r.Method == http.MethodPost {
+				if _, err := db.Exec(`UPDATE courier_devices SET revoked_at=now() WHERE id=$1`, claims.Dev); err != nil {
+					http.Error(w, err.Error(), http.StatusInternalServerError)
+					return
+				}
+				w.WriteHeader(http.StatusNoContent)
+				return
+			}
+			c, err := loadCourier(db, claims.Sub)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			parts := strings.Split(path, "/")
+			switch {
+			case path == "me" && r.Method == http.MethodGet:
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(c)
+			case path == "location" && r.Method == http.MethodPost:
+				recordCourierLocation(w, r, db, c)
+			case parts[0] == "shift" && len(parts) == 2 && r.Method == http.MethodPost:
+				shiftAction(w, r, db, c, parts[1])
+			case path == "availability" && r.Method == http.MethodPut:
+				setAvailability(w, r, db, c)
+			case path == "shifts" && r.Method == http.MethodGet:
+				listShifts(w, db, c)
+			case parts[0] == "batches":
+				rest := parts[1:]
+				if len(rest) == 0 && r.Method == http.MethodPost || len(rest) == 2 && rest[1] == "cancel" {
+					http.Error(w, "forbidden", http.StatusForbidden)
+					return
+				}
+				batchesRoute(w, r, db, c, rest)
+			default:
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			}
+		})(w, r)
+	}
+}
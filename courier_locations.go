@@ -0,0 +1,141 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Courier positions are only accepted while the courier is out with a batch
+// and only shown to customers whose stop is still ahead. Raw positions are
+// deleted after the establishment's retention window.
+
+// courierPositionMaxAge hides positions too stale to mean anything on a map.
+const courierPositionMaxAge = 5 * time.Minute
+
+type CourierPosition struct {
+	Lat        float64   `json:"lat"`
+	Lng        float64   `json:"lng"`
+	RecordedAt time.Time `json:"recorded_at"`
+}
+
+// recordCourierLocation stores a position ping from the courier app. Pings
+// outside an in-progress batch are refused rather than stored, so the app
+// stops sending once the last stop is confirmed.
+func recordCourierLocation(w http.ResponseWriter, r *http.Request, db *sql.DB, c *Courier) {
+	var req struct {
+		Lat float64 `json:"lat"`
+		Lng float64 `json:"lng"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Lat < -90 || req.Lat > 90 || req.Lng < -180 || req.Lng > 180 {
+		http.Error(w, "invalid coordinates", http.StatusUnprocessableEntity)
+		return
+	}
+	res, err := db.Exec(
+		`INSERT INTO courier_locations (establishment_id, courier_id, batch_id, lat, lng)
+		 SELECT b.establishment_id, b.courier_id, b.id, $2, $3 FROM delivery_batches b JOIN establishments e ON e.id=b.establishment_id
+		 WHERE b.courier_id=$1 AND b.status='in_progress' AND e.courier_location_sharing
+		 ORDER BY b.started_at DESC LIMIT 1`,
+		c.ID, req.Lat, req.Lng,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "location is only shared while delivering", http.StatusConflict)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// latestCourierPosition returns the batch's most recent fresh position, or
+// nil when sharing is off or there is none.
+func latestCourierPosition(db *sql.DB, batchID string) (*CourierPosition, error) {
+	var p CourierPosition
+	err := db.QueryRow(
+		`SELECT l.lat, l.lng, l.recorded_at FROM courier_locations l JOIN establishments e ON e.id=l.establishment_id
+		 WHERE l.batch_id=$1 AND e.courier_location_sharing AND l.recorded_at > now() - $2 * interval '1 second'
+		 ORDER BY l.recorded_at DESC LIMIT 1`,
+		batchID, int(courierPositionMaxAge.Seconds()),
+	).Scan(&p.Lat, &p.Lng, &p.RecordedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// updateCourierLocationSettings turns position sharing on or off and sets how
+// many hours raw positions are kept.
+func updateCourierLocationSettings(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	if !requireRole(w, r, db, establishmentID, "manager") {
+		return
+	}
+	var req struct {
+		Sharing        bool `json:"sharing"`
+		RetentionHours int  `json:"retention_hours"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.RetentionHours < 1 || req.RetentionHours > 24*30 {
+		http.Error(w, "retention_hours must be between 1 and 720", http.StatusUnprocessableEntity)
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	_, err = tx.Exec(
+		`UPDATE establishments SET courier_location_sharing=$1, courier_location_retention_hours=$2, updated_at=now() WHERE id=$3`,
+		req.Sharing, req.RetentionHours, establishmentID,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// Turning sharing off also drops what was collected so far.
+	if !req.Sharing {
+		if _, err := tx.Exec(`DELETE FROM courier_locations WHERE establishment_id=$1`, establishmentID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := recordAudit(tx, r, establishmentID, "establishment.courier_location_updated", "establishment", establishmentID, req); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(req)
+}
+
+func startCourierLocationPurger(db *sql.DB) {
+	go func() {
+		for {
+			_, err := db.Exec(
+				`DELETE FROM courier_locations l USING establishments e
+				 WHERE e.id=l.establishment_id AND l.recorded_at < now() - e.courier_location_retention_hours * interval '1 hour'`,
+			)
+			if err != nil {
+				log.Printf("courier location purge: %v", err)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
@@ -0,0 +1,384 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+type Courier struct {
+	ID              string           `json:"id"`
+	EstablishmentID string           `json:"establishment_id"`
+	Name            string           `json:"name"`
+	Phone           string           `json:"phone"`
+	FeeType         string           `json:"fee_type"`
+	FeeCents        int64            `json:"fee_cents"`
+	PerKmCents      int64            `json:"per_km_cents"`
+	ZoneFees        map[string]int64 `json:"zone_fees"`
+	// ShiftHourlyCents is paid per hour on shift, on top of delivery fees.
+	ShiftHourlyCents int64 `json:"shift_hourly_cents"`
+	Active           bool  `json:"active"`
+	// Availability is offline (not on shift), available or on_break.
+	Availability string `json:"availability"`
+}
+
+type Delivery struct {
+	ID             string    `json:"id"`
+	OrderID        string    `json:"order_id"`
+	CourierID      string    `json:"courier_id"`
+	DistanceMeters int       `json:"distance_meters"`
+	Zone           string    `json:"zone"`
+	FeeCents       int64     `json:"fee_cents"`
+	DeliveredAt    time.Time `json:"delivered_at"`
+	// Proof is what the establishment's delivery_proof setting asks for.
+	Proof *DeliveryProof `json:"proof,omitempty"`
+}
+
+type PayoutPeriod struct {
+	PeriodStart    time.Time `json:"period_start"`
+	PeriodEnd      time.Time `json:"period_end"`
+	Deliveries     int       `json:"deliveries"`
+	DistanceMeters int64     `json:"distance_meters"`
+	// Ratings and QualityScore cover the period's rated deliveries;
+	// QualityScore is nil when none were rated.
+	Ratings      int      `json:"ratings"`
+	QualityScore *float64 `json:"quality_score"`
+	Shifts       int      `json:"shifts"`
+	ShiftMinutes int64    `json:"shift_minutes"`
+	// ShiftPayCents is included in TotalOwedCents.
+	ShiftPayCents  int64 `json:"shift_pay_cents"`
+	TotalOwedCents int64 `json:"total_owed_cents"`
+}
+
+func couriersHandler(db *sql.DB) http.HandlerFunc {
+	return authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		createCourier(w, r, db)
+	})
+}
+
+func courierHandler(db *sql.DB) http.HandlerFunc {
+	return authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/couriers/"), "/")
+		id := parts[0]
+		sub := ""
+		if len(parts) > 1 {
+			sub = parts[1]
+		}
+		var rest []string
+		if len(parts) > 2 {
+			rest = parts[2:]
+		}
+		c, err := loadCourier(db, id)
+		if err == sql.ErrNoRows {
+			http.NotFound(w, nil)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		switch {
+		case sub == "" && r.Method == http.MethodGet:
+			if requireRole(w, r, db, c.EstablishmentID, "staff") {
+				w.Header().Set("Content-Type", "application/json")
+				json.NewEncoder(w).Encode(c)
+			}
+		case sub == "deliveries" && r.Method == http.MethodPost:
+			if requireRole(w, r, db, c.EstablishmentID, "staff") {
+				recordDelivery(w, r, db, c)
+			}
+		case sub == "payouts" && r.Method == http.MethodGet:
+			if requireRole(w, r, db, c.EstablishmentID, "manager") {
+				courierPayouts(w, r, db, c)
+			}
+		case sub == "location" && r.Method == http.MethodPost:
+			if requireRole(w, r, db, c.EstablishmentID, "staff") {
+				recordCourierLocation(w, r, db, c)
+			}
+		case sub == "batches":
+			if requireRole(w, r, db, c.EstablishmentID, "staff") {
+				batchesRoute(w, r, db, c, rest)
+			}
+		case sub == "shift" && len(rest) == 1 && r.Method == http.MethodPost:
+			if requireRole(w, r, db, c.EstablishmentID, "staff") {
+				shiftAction(w, r, db, c, rest[0])
+			}
+		case sub == "ratings" && r.Method == http.MethodGet:
+			if requireRole(w, r, db, c.EstablishmentID, "staff") {
+				courierRatings(w, db, c)
+			}
+		case sub == "shifts" && r.Method == http.MethodGet:
+			if requireRole(w, r, db, c.EstablishmentID, "staff") {
+				listShifts(w, db, c)
+			}
+		case sub == "pairing_code" && r.Method == http.MethodPost:
+			if requireRole(w, r, db, c.EstablishmentID, "staff") {
+				createPairingCode(w, db, c)
+			}
+		case sub == "devices" && len(rest) == 0 && r.Method == http.MethodGet:
+			if requireRole(w, r, db, c.EstablishmentID, "staff") {
+				listCourierDevices(w, db, c)
+			}
+		case sub == "devices" && len(rest) == 1 && r.Method == http.MethodDelete:
+			if requireRole(w, r, db, c.EstablishmentID, "manager") {
+				revokeCourierDevice(w, r, db, c, rest[0])
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func validateCourierFees(c *Courier) string {
+	switch c.FeeType {
+	case "fixed":
+	case "per_km":
+		if c.PerKmCents <= 0 {
+			return "per_km_cents must be positive for per_km couriers"
+		}
+	case "per_zone":
+		if len(c.ZoneFees) == 0 {
+			return "zone_fees must not be empty for per_zone couriers"
+		}
+	default:
+		return "fee_type must be fixed, per_km or per_zone"
+	}
+	if c.FeeCents < 0 || c.PerKmCents < 0 || c.ShiftHourlyCents < 0 {
+		return "fees must not be negative"
+	}
+	for _, v := range c.ZoneFees {
+		if v < 0 {
+			return "fees must not be negative"
+		}
+	}
+	return ""
+}
+
+func createCourier(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var c Courier
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !requireRole(w, r, db, c.EstablishmentID, "manager") {
+		return
+	}
+	c.Name = sanitizeText(c.Name)
+	if msg := validateCourierFees(&c); msg != "" {
+		http.Error(w, msg, http.StatusUnprocessableEntity)
+		return
+	}
+	if c.ZoneFees == nil {
+		c.ZoneFees = map[string]int64{}
+	}
+	zones, _ := json.Marshal(c.ZoneFees)
+	err := db.QueryRow(
+		`INSERT INTO couriers (establishment_id, name, phone, fee_type, fee_cents, per_km_cents, zone_fees, shift_hourly_cents) VALUES ($1,$2,$3,$4,$5,$6,$7,$8) RETURNING id, active, availability`,
+		c.EstablishmentID, c.Name, c.Phone, c.FeeType, c.FeeCents, c.PerKmCents, zones, c.ShiftHourlyCents,
+	).Scan(&c.ID, &c.Active, &c.Availability)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(c)
+}
+
+func loadCourier(db *sql.DB, id string) (*Courier, error) {
+	var c Courier
+	var zones []byte
+	err := db.QueryRow(
+		`SELECT id, establishment_id, name, phone, fee_type, fee_cents, per_km_cents, zone_fees, shift_hourly_cents, active, availability FROM couriers WHERE id=$1`, id,
+	).Scan(&c.ID, &c.EstablishmentID, &c.Name, &c.Phone, &c.FeeType, &c.FeeCents, &c.PerKmCents, &zones, &c.ShiftHourlyCents, &c.Active, &c.Availability)
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(zones, &c.ZoneFees); err != nil {
+		return nil, err
+	}
+	return &c, nil
+}
+
+// deliveryFee computes what the courier is owed for one delivery. Per-km fees
+// are charged per started kilometre on top of the fixed base.
+func (c *Courier) deliveryFee(distanceMeters int, zone string) (int64, string) {
+	switch c.FeeType {
+	case "per_km":
+		km := int64((distanceMeters + 999) / 1000)
+		return c.FeeCents + km*c.PerKmCents, ""
+	case "per_zone":
+		fee, ok := c.ZoneFees[zone]
+		if !ok {
+			return 0, "courier has no fee for zone " + zone
+		}
+		return fee, ""
+	default:
+		return c.FeeCents, ""
+	}
+}
+
+func recordDelivery(w http.ResponseWriter, r *http.Request, db *sql.DB, c *Courier) {
+	var d Delivery
+	if err := json.NewDecoder(r.Body).Decode(&d); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if d.DistanceMeters < 0 {
+		http.Error(w, "distance_meters must not be negative", http.StatusUnprocessableEntity)
+		return
+	}
+	fee, msg := c.deliveryFee(d.DistanceMeters, d.Zone)
+	if msg != "" {
+		http.Error(w, msg, http.StatusUnprocessableEntity)
+		return
+	}
+	d.CourierID, d.FeeCents = c.ID, fee
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	err = insertDelivery(tx, c, &d)
+	if err == sql.ErrNoRows {
+		http.Error(w, "order not found in the courier's establishment", http.StatusUnprocessableEntity)
+		return
+	}
+	if _, ok := err.(deliveryProofError); ok {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(d)
+}
+
+// insertDelivery records the delivery for the courier's payout and announces
+// it. It returns sql.ErrNoRows when the order isn't from the courier's
+// establishment, and a deliveryProofError when the proof isn't enough.
+func insertDelivery(tx *sql.Tx, c *Courier, d *Delivery) error {
+	if err := checkDeliveryProof(tx, c.EstablishmentID, d); err != nil {
+		return err
+	}
+	var proofType, proofKey string
+	var pinVerified bool
+	if d.Proof != nil {
+		proofType, proofKey, pinVerified = d.Proof.Type, d.Proof.ImageKey, d.Proof.PINVerified
+	}
+	err := tx.QueryRow(
+		`INSERT INTO deliveries (order_id, courier_id, distance_meters, zone, fee_cents, proof_type, proof_key, proof_pin_verified)
+		 SELECT id, $2, $3, $4, $5, NULLIF($7,''), NULLIF($8,''), $9 FROM orders WHERE id=$1 AND establishment_id=$6
+		 RETURNING id, delivered_at`,
+		d.OrderID, d.CourierID, d.DistanceMeters, d.Zone, d.FeeCents, c.EstablishmentID, proofType, proofKey, pinVerified,
+	).Scan(&d.ID, &d.DeliveredAt)
+	if err != nil {
+		return err
+	}
+	return enqueueEvent(tx, Event{Type: eventOrderDelivered, OrderID: d.OrderID, EstablishmentID: c.EstablishmentID})
+}
+
+// courierPayouts groups deliveries and shifts into weekly (default) or
+// monthly payout periods; shifts count in the period they started in and are
+// paid at the courier's hourly rate. Each period also carries the quality
+// score of its rated deliveries. ?format=csv returns the same rows for
+// payroll import.
+func courierPayouts(w http.ResponseWriter, r *http.Request, db *sql.DB, c *Courier) {
+	loc, err := establishmentLocation(db, c.EstablishmentID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	from, to, err := reportRange(r, loc)
+	if err != nil {
+		http.Error(w, "from/to must be YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+	period := r.URL.Query().Get("period")
+	if period == "" {
+		period = "week"
+	}
+	if period != "week" && period != "month" {
+		http.Error(w, "period must be week or month", http.StatusBadRequest)
+		return
+	}
+	rows, err := db.Query(
+		`WITH d AS (
+		   SELECT date_trunc($2, d.delivered_at AT TIME ZONE 'UTC' AT TIME ZONE $5) AS p, COUNT(*) AS n, SUM(d.distance_meters) AS meters, SUM(d.fee_cents) AS fees,
+		     COUNT(dr.id) AS ratings, AVG(`+deliveryQualitySQL+`) AS quality
+		   FROM deliveries d LEFT JOIN delivery_ratings dr ON dr.order_id=d.order_id
+		   WHERE d.courier_id=$1 AND d.delivered_at >= $3 AND d.delivered_at < $4
+		   GROUP BY p
+		 ), s AS (
+		   SELECT date_trunc($2, started_at AT TIME ZONE 'UTC' AT TIME ZONE $5) AS p, COUNT(*) AS n,
+		     SUM(EXTRACT(EPOCH FROM COALESCE(ended_at, now()) - started_at))::bigint / 60 AS minutes
+		   FROM courier_shifts WHERE courier_id=$1 AND started_at >= $3 AND started_at < $4
+		   GROUP BY p
+		 )
+		 SELECT COALESCE(d.p, s.p), COALESCE(d.n,0), COALESCE(d.meters,0), COALESCE(d.fees,0), COALESCE(d.ratings,0), d.quality, COALESCE(s.n,0), COALESCE(s.minutes,0)
+		 FROM d FULL JOIN s ON s.p=d.p ORDER BY 1`,
+		c.ID, period, from, to, loc.String(),
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	list := []PayoutPeriod{}
+	for rows.Next() {
+		var p PayoutPeriod
+		if err := rows.Scan(&p.PeriodStart, &p.Deliveries, &p.DistanceMeters, &p.TotalOwedCents, &p.Ratings, &p.QualityScore, &p.Shifts, &p.ShiftMinutes); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		p.ShiftPayCents = p.ShiftMinutes * c.ShiftHourlyCents / 60
+		p.TotalOwedCents += p.ShiftPayCents
+		if period == "week" {
+			p.PeriodEnd = p.PeriodStart.AddDate(0, 0, 7)
+		} else {
+			p.PeriodEnd = p.PeriodStart.AddDate(0, 1, 0)
+		}
+		list = append(list, p)
+	}
+
+	if r.URL.Query().Get("format") == "csv" {
+		w.Header().Set("Content-Type", "text/csv")
+		w.Header().Set("Content-Disposition", `attachment; filename="payouts-`+c.ID+`.csv"`)
+		cw := csv.NewWriter(w)
+		cw.Write([]string{"courier_id", "courier_name", "period_start", "period_end", "deliveries", "distance_meters", "ratings", "quality_score", "shifts", "shift_minutes", "shift_pay_cents", "total_owed_cents"})
+		for _, p := range list {
+			quality := ""
+			if p.QualityScore != nil {
+				quality = strconv.FormatFloat(*p.QualityScore, 'f', 1, 64)
+			}
+			cw.Write([]string{
+				c.ID, c.Name, p.PeriodStart.Format(time.DateOnly), p.PeriodEnd.Format(time.DateOnly),
+				strconv.Itoa(p.Deliveries), strconv.FormatInt(p.DistanceMeters, 10),
+				strconv.Itoa(p.Ratings), quality,
+				strconv.Itoa(p.Shifts), strconv.FormatInt(p.ShiftMinutes, 10), strconv.FormatInt(p.ShiftPayCents, 10),
+				strconv.FormatInt(p.TotalOwedCents, 10),
+			})
+		}
+		cw.Flush()
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// Cuisines are a platform-managed taxonomy (pizzaria, japonesa, lanches...).
+// Establishments pick one or more, must have at least one to publish, and
+// the directory filters by them.
+
+const maxEstablishmentCuisines = 5
+
+var cuisineSlugPattern = regexp.MustCompile(`^[a-z0-9]+(-[a-z0-9]+)*$`)
+
+type Cuisine struct {
+	Slug string `json:"slug"`
+	Name string `json:"name"`
+}
+
+// cuisinesHandler serves GET /cuisines publicly; platform admins add or
+// rename with PUT /cuisines/{slug} and remove with DELETE.
+func cuisinesHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		slug := strings.Trim(strings.TrimPrefix(r.URL.Path, "/cuisines"), "/")
+		switch {
+		case slug == "" && r.Method == http.MethodGet:
+			listCuisines(w, db)
+		case slug != "" && (r.Method == http.MethodPut || r.Method == http.MethodDelete):
+			authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) {
+				if !requirePlatformAdmin(w, r, db) {
+					return
+				}
+				if r.Method == http.MethodPut {
+					putCuisine(w, r, db, slug)
+				} else {
+					deleteCuisine(w, r, db, slug)
+				}
+			})(w, r)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+func listCuisines(w http.ResponseWriter, db *sql.DB) {
+	rows, err := db.Query(`SELECT slug, name FROM cuisines ORDER BY name`)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	list := []Cuisine{}
+	for rows.Next() {
+		var c Cuisine
+		if err := rows.Scan(&c.Slug, &c.Name); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		list = append(list, c)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func putCuisine(w http.ResponseWriter, r *http.Request, db *sql.DB, slug string) {
+	if !cuisineSlugPattern.MatchString(slug) || len(slug) > 40 {
+		http.Error(w, "slug must be lowercase letters, digits and hyphens", http.StatusUnprocessableEntity)
+		return
+	}
+	c := Cuisine{Slug: slug}
+	if err := json.NewDecoder(r.Body).Decode(&c); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c.Slug, c.Name = slug, sanitizeText(c.Name)
+	if c.Name == "" {
+		http.Error(w, "name is required", http.StatusUnprocessableEntity)
+		return
+	}
+	if _, err := db.Exec(`INSERT INTO cuisines (slug, name) VALUES ($1,$2) ON CONFLICT (slug) DO UPDATE SET name=EXCLUDED.name`, c.Slug, c.Name); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := recordAudit(db, r, "", "cuisine.saved", "cuisine", slug, c); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
+
+// deleteCuisine refuses while establishments still use the cuisine, since
+// removing it could leave a published establishment without any.
+func deleteCuisine(w http.ResponseWriter, r *http.Request, db *sql.DB, slug string) {
+	res, err := db.Exec(`DELETE FROM cuisines WHERE slug=$1`, slug)
+	if isForeignKeyViolation(err) {
+		http.Error(w, "cuisine is in use by establishments", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.NotFound(w, nil)
+		return
+	}
+	if err := recordAudit(db, r, "", "cuisine.deleted", "cuisine", slug, nil); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// establishmentCuisinesRoute reads (public) or replaces (managers) the
+// establishment's cuisines.
+func establishmentCuisinesRoute(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	switch r.Method {
+	case http.MethodGet:
+		listEstablishmentCuisines(w, db, establishmentID)
+	case http.MethodPut:
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { setEstablishmentCuisines(w, r, db, establishmentID) })(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func listEstablishmentCuisines(w http.ResponseWriter, db *sql.DB, establishmentID string) {
+	rows, err := db.Query(
+		`SELECT c.slug, c.name FROM establishment_cuisines ec JOIN cuisines c ON c.slug=ec.cuisine
+		 WHERE ec.establishment_id::text=$1 ORDER BY c.name`,
+		establishmentID,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	list := []Cuisine{}
+	for rows.Next() {
+		var c Cuisine
+		if err := rows.Scan(&c.Slug, &c.Name); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		list = append(list, c)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func setEstablishmentCuisines(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	if !requireRole(w, r, db, establishmentID, "manager") {
+		return
+	}
+	var req struct {
+		Cuisines []string `json:"cuisines"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Cuisines) == 0 || len(req.Cuisines) > maxEstablishmentCuisines {
+		http.Error(w, "choose between 1 and 5 cuisines", http.StatusUnprocessableEntity)
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM establishment_cuisines WHERE establishment_id=$1`, establishmentID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec(
+		`INSERT INTO establishment_cuisines (establishment_id, cuisine) SELECT DISTINCT $1, unnest($2::text[])`,
+		establishmentID, pq.Array(req.Cuisines),
+	)
+	if isForeignKeyViolation(err) {
+		http.Error(w, "unknown cuisine", http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	responseCache.Invalidate(establishmentID)
+	listEstablishmentCuisines(w, db, establishmentID)
+}
@@ -0,0 +1,436 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Custom fields are product attributes an establishment defines for its own
+// menu (spice level, wine vintage, serves N). Values live in
+// products.custom_fields keyed by the field's key, are validated against the
+// definitions on every write, are returned with the products in the menu and
+// can filter it: ?cf.{key}=value, and ?cf.{key}.min= / .max= for numbers.
+
+const (
+	maxCustomFields       = 30
+	maxCustomFieldOptions = 50
+	maxCustomFieldText    = 200
+)
+
+var (
+	customFieldTypes      = []string{"text", "number", "boolean", "select", "multiselect"}
+	customFieldKeyPattern = regexp.MustCompile(`^[a-z][a-z0-9_]{0,39}$`)
+)
+
+type CustomField struct {
+	ID              string `json:"id"`
+	EstablishmentID string `json:"establishment_id"`
+	// Key names the value in products' custom_fields and in menu filters;
+	// it can't be changed once created.
+	Key  string `json:"key"`
+	Name string `json:"name"`
+	// Type is text, number, boolean, select or multiselect; the last two
+	// take their values from Options. It can't be changed either.
+	Type      string    `json:"type"`
+	Options   []string  `json:"options"`
+	Required  bool      `json:"required"`
+	Position  int       `json:"position"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+type rowsQueryer interface {
+	Query(query string, args ...any) (*sql.Rows, error)
+}
+
+// customFieldsRoute lists an establishment's fields publicly, so menu
+// clients can label values and build filters; managers create, update and
+// delete them.
+func customFieldsRoute(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID, fieldID string) {
+	if fieldID == "" && r.Method == http.MethodGet {
+		fields, err := loadCustomFields(db, establishmentID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(fields)
+		return
+	}
+	authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) {
+		if !requireRole(w, r, db, establishmentID, "manager") {
+			return
+		}
+		switch {
+		case fieldID == "" && r.Method == http.MethodPost:
+			createCustomField(w, r, db, establishmentID)
+		case fieldID != "" && r.Method == http.MethodPut:
+			updateCustomField(w, r, db, establishmentID, fieldID)
+		case fieldID != "" && r.Method == http.MethodDelete:
+			deleteCustomField(w, r, db, establishmentID, fieldID)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})(w, r)
+}
+
+func loadCustomFields(q rowsQueryer, establishmentID string) ([]CustomField, error) {
+	rows, err := q.Query(
+		`SELECT id, establishment_id, key, name, type, options, required, position, created_at FROM custom_fields
+		 WHERE establishment_id::text=$1 ORDER BY position, name`,
+		establishmentID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []CustomField{}
+	for rows.Next() {
+		var f CustomField
+		if err := rows.Scan(&f.ID, &f.EstablishmentID, &f.Key, &f.Name, &f.Type, pq.Array(&f.Options), &f.Required, &f.Position, &f.CreatedAt); err != nil {
+			return nil, err
+		}
+		list = append(list, f)
+	}
+	return list, rows.Err()
+}
+
+// validateCustomFieldDefinition checks the editable parts of a definition
+// and normalizes its options.
+func validateCustomFieldDefinition(f *CustomField) string {
+	if f.Name = sanitizeText(f.Name); f.Name == "" || len(f.Name) > 60 {
+		return "name must have between 1 and 60 characters"
+	}
+	if f.Type != "select" && f.Type != "multiselect" {
+		f.Options = []string{}
+		return ""
+	}
+	options := []string{}
+	for _, o := range f.Options {
+		if o = sanitizeText(o); o == "" || len(o) > 60 {
+			return "options must have between 1 and 60 characters"
+		}
+		if !slices.Contains(options, o) {
+			options = append(options, o)
+		}
+	}
+	if len(options) == 0 || len(options) > maxCustomFieldOptions {
+		return fmt.Sprintf("%s fields need between 1 and %d options", f.Type, maxCustomFieldOptions)
+	}
+	f.Options = options
+	return ""
+}
+
+func createCustomField(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	var f CustomField
+	if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !customFieldKeyPattern.MatchString(f.Key) {
+		http.Error(w, "key must start with a letter and have up to 40 lowercase letters, digits or underscores", http.StatusUnprocessableEntity)
+		return
+	}
+	if !slices.Contains(customFieldTypes, f.Type) {
+		http.Error(w, "type must be text, number, boolean, select or multiselect", http.StatusUnprocessableEntity)
+		return
+	}
+	if msg := validateCustomFieldDefinition(&f); msg != "" {
+		http.Error(w, msg, http.StatusUnprocessableEntity)
+		return
+	}
+	var count int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM custom_fields WHERE establishment_id=$1`, establishmentID).Scan(&count); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if count >= maxCustomFields {
+		http.Error(w, fmt.Sprintf("an establishment can have at most %d custom fields", maxCustomFields), http.StatusUnprocessableEntity)
+		return
+	}
+	f.EstablishmentID = establishmentID
+	err := db.QueryRow(
+		`INSERT INTO custom_fields (establishment_id, key, name, type, options, required, position) VALUES ($1,$2,$3,$4,$5,$6,$7)
+		 RETURNING id, created_at`,
+		establishmentID, f.Key, f.Name, f.Type, pq.Array(f.Options), f.Required, f.Position,
+	).Scan(&f.ID, &f.CreatedAt)
+	if isUniqueViolation(err) {
+		http.Error(w, "a custom field with this key already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	responseCache.Invalidate(establishmentID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(f)
+}
+
+// updateCustomField changes the name, options, required flag and position.
+// Options still used by a product can't be removed.
+func updateCustomField(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID, fieldID string) {
+	var f CustomField
+	if err := json.NewDecoder(r.Body).Decode(&f); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	var current CustomField
+	err = tx.QueryRow(
+		`SELECT id, establishment_id, key, type, options, created_at FROM custom_fields WHERE id::text=$1 AND establishment_id=$2 FOR UPDATE`,
+		fieldID, establishmentID,
+	).Scan(&current.ID, &current.EstablishmentID, &current.Key, &current.Type, pq.Array(&current.Options), &current.CreatedAt)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, nil)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if (f.Key != "" && f.Key != current.Key) || (f.Type != "" && f.Type != current.Type) {
+		http.Error(w, "key and type can't be changed; create a new field instead", http.StatusUnprocessableEntity)
+		return
+	}
+	f.ID, f.EstablishmentID, f.Key, f.Type, f.CreatedAt = current.ID, current.EstablishmentID, current.Key, current.Type, current.CreatedAt
+	if msg := validateCustomFieldDefinition(&f); msg != "" {
+		http.Error(w, msg, http.StatusUnprocessableEntity)
+		return
+	}
+	var removed []string
+	for _, o := range current.Options {
+		if !slices.Contains(f.Options, o) {
+			removed = append(removed, o)
+		}
+	}
+	if len(removed) > 0 {
+		var inUse bool
+		err := tx.QueryRow(
+			`SELECT EXISTS (SELECT 1 FROM products WHERE establishment_id=$1
+			   AND (custom_fields->>$2 = ANY($3) OR jsonb_typeof(custom_fields->$2)='array' AND custom_fields->$2 ?| $3))`,
+			establishmentID, f.Key, pq.Array(removed),
+		).Scan(&inUse)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if inUse {
+			http.Error(w, "products still use the removed options: "+strings.Join(removed, ", "), http.StatusConflict)
+			return
+		}
+	}
+	_, err = tx.Exec(
+		`UPDATE custom_fields SET name=$2, options=$3, required=$4, position=$5 WHERE id=$1`,
+		f.ID, f.Name, pq.Array(f.Options), f.Required, f.Position,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	responseCache.Invalidate(establishmentID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(f)
+}
+
+// deleteCustomField removes the definition and its values from every
+// product.
+func deleteCustomField(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID, fieldID string) {
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	var key string
+	err = tx.QueryRow(`DELETE FROM custom_fields WHERE id::text=$1 AND establishment_id=$2 RETURNING key`, fieldID, establishmentID).Scan(&key)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, nil)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec(`UPDATE products SET custom_fields=custom_fields - $2, updated_at=now() WHERE establishment_id=$1 AND custom_fields ? $2`, establishmentID, key)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := recordAudit(tx, r, establishmentID, "custom_field.deleted", "custom_field", fieldID, map[string]string{"key": key}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	responseCache.Invalidate(establishmentID)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// validateProductCustomFields checks p.CustomFields against the
+// establishment's definitions and normalizes the values. A nil map on update
+// leaves the stored values alone, so it is only checked for required fields
+// when creating.
+func validateProductCustomFields(tx *sql.Tx, p *Product, creating bool) (string, error) {
+	if p.CustomFields == nil && !creating {
+		return "", nil
+	}
+	fields, err := loadCustomFields(tx, p.EstablishmentID)
+	if err != nil {
+		return "", err
+	}
+	byKey := map[string]CustomField{}
+	for _, f := range fields {
+		byKey[f.Key] = f
+	}
+	values := map[string]any{}
+	for k, v := range p.CustomFields {
+		f, ok := byKey[k]
+		if !ok {
+			return "unknown custom field " + k, nil
+		}
+		if v == nil {
+			continue
+		}
+		if values[k], ok = normalizeCustomFieldValue(f, v); !ok {
+			return customFieldValueHint(f), nil
+		}
+	}
+	for _, f := range fields {
+		if _, ok := values[f.Key]; f.Required && !ok {
+			return "custom field " + f.Key + " is required", nil
+		}
+	}
+	p.CustomFields = values
+	return "", nil
+}
+
+func normalizeCustomFieldValue(f CustomField, v any) (any, bool) {
+	switch f.Type {
+	case "text":
+		s, ok := v.(string)
+		s = sanitizeText(s)
+		return s, ok && s != "" && len(s) <= maxCustomFieldText
+	case "number":
+		n, ok := v.(float64)
+		return n, ok
+	case "boolean":
+		b, ok := v.(bool)
+		return b, ok
+	case "select":
+		s, ok := v.(string)
+		return s, ok && slices.Contains(f.Options, s)
+	case "multiselect":
+		list, ok := v.([]any)
+		if !ok {
+			return nil, false
+		}
+		out := []string{}
+		for _, item := range list {
+			s, ok := item.(string)
+			if !ok || !slices.Contains(f.Options, s) {
+				return nil, false
+			}
+			if !slices.Contains(out, s) {
+				out = append(out, s)
+			}
+		}
+		return out, true
+	}
+	return nil, false
+}
+
+func customFieldValueHint(f CustomField) string {
+	switch f.Type {
+	case "text":
+		return fmt.Sprintf("custom field %s must be text of 1 to %d characters", f.Key, maxCustomFieldText)
+	case "select":
+		return "custom field " + f.Key + " must be one of: " + strings.Join(f.Options, ", ")
+	case "multiselect":
+		return "custom field " + f.Key + " must be a list of: " + strings.Join(f.Options, ", ")
+	}
+	return "custom field " + f.Key + " must be a " + f.Type
+}
+
+// customFieldsParam is the value bound for products.custom_fields: NULL for
+// a nil map, so updates can keep the stored values.
+func customFieldsParam(values map[string]any) any {
+	if values == nil {
+		return nil
+	}
+	data, _ := json.Marshal(values)
+	return data
+}
+
+// customFieldFilters turns the cf.* query parameters into SQL conditions
+// on the products table, numbering placeholders from next.
+func customFieldFilters(q rowsQueryer, establishmentID string, query map[string][]string, next int) (string, []any, string, error) {
+	var fields []CustomField
+	var where strings.Builder
+	var args []any
+	for param, vs := range query {
+		name, ok := strings.CutPrefix(param, "cf.")
+		if !ok {
+			continue
+		}
+		if fields == nil {
+			var err error
+			if fields, err = loadCustomFields(q, establishmentID); err != nil {
+				return "", nil, "", err
+			}
+		}
+		key, bound, _ := strings.Cut(name, ".")
+		i := slices.IndexFunc(fields, func(f CustomField) bool { return f.Key == key })
+		if i < 0 {
+			return "", nil, "unknown custom field " + key, nil
+		}
+		f, v := fields[i], vs[0]
+		p := func(arg any) string {
+			args = append(args, arg)
+			next++
+			return "$" + strconv.Itoa(next-1)
+		}
+		switch {
+		case bound != "" && (f.Type != "number" || bound != "min" && bound != "max"):
+			return "", nil, "only number fields take .min and .max filters", nil
+		case f.Type == "number":
+			n, err := strconv.ParseFloat(v, 64)
+			if err != nil {
+				return "", nil, "cf." + name + " must be a number", nil
+			}
+			op := map[string]string{"": "=", "min": ">=", "max": "<="}[bound]
+			fmt.Fprintf(&where, " AND jsonb_typeof(custom_fields->%s::text)='number' AND (custom_fields->>%[1]s::text)::numeric %s %s", p(key), op, p(n))
+		case f.Type == "boolean":
+			b, err := strconv.ParseBool(v)
+			if err != nil {
+				return "", nil, "cf." + name + " must be true or false", nil
+			}
+			fmt.Fprintf(&where, " AND custom_fields->%s::text = to_jsonb(%s::boolean)", p(key), p(b))
+		case f.Type == "multiselect":
+			fmt.Fprintf(&where, " AND custom_fields->%s::text ? %s", p(key), p(v))
+		default:
+			fmt.Fprintf(&where, " AND custom_fields->>%s::text = %s", p(key), p(v))
+		}
+	}
+	return where.String(), args, "", nil
+}
@@ -0,0 +1,79 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// database/sql connects lazily and reconnects by itself, so these only make
+// the failure visible: startup waits for Postgres, and while it's down
+// requests fail fast with 503 instead of hanging on a dead pool.
+
+const (
+	dbPingTimeout      = 5 * time.Second
+	dbMaxStartupDelay  = 15 * time.Second
+	dbMonitorEvery     = 5 * time.Second
+	dbBreakerThreshold = 3
+)
+
+var dbBreaker = newCircuitBreaker("postgres", dbBreakerThreshold, 10*time.Second)
+
+// waitForDB pings with exponential backoff until Postgres answers, giving up
+// after DB_STARTUP_TIMEOUT seconds (60 by default).
+func waitForDB(db *sql.DB) error {
+	maxWait := 60 * time.Second
+	if s, _ := strconv.Atoi(os.Getenv("DB_STARTUP_TIMEOUT")); s > 0 {
+		maxWait = time.Duration(s) * time.Second
+	}
+	deadline := time.Now().Add(maxWait)
+	delay := 500 * time.Millisecond
+	for attempt := 1; ; attempt++ {
+		ctx, cancel := context.WithTimeout(context.Background(), dbPingTimeout)
+		err := db.PingContext(ctx)
+		cancel()
+		if err == nil {
+			if attempt > 1 {
+				log.Printf("database reachable after %d attempts", attempt)
+			}
+			return nil
+		}
+		if time.Now().Add(delay).After(deadline) {
+			return err
+		}
+		log.Printf("database not reachable (attempt %d), retrying in %s: %v", attempt, delay, err)
+		time.Sleep(delay)
+		delay = min(delay*2, dbMaxStartupDelay)
+	}
+}
+
+// startDBMonitor pings in the background and drives dbBreaker, which opens
+// after dbBreakerThreshold failed pings in a row.
+func startDBMonitor(db *sql.DB) {
+	go func() {
+		for {
+			ctx, cancel := context.WithTimeout(context.Background(), dbPingTimeout)
+			dbBreaker.record(db.PingContext(ctx))
+			cancel()
+			time.Sleep(dbMonitorEvery)
+		}
+	}()
+}
+
+// withDBBreaker answers 503 while the database is known to be down. Metrics
+// and the admin frontend don't need it and stay up.
+func withDBBreaker(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if dbBreaker.isOpen() && !strings.HasPrefix(r.URL.Path, "/metrics") && !strings.HasPrefix(r.URL.Path, "/admin") {
+			w.Header().Set("Retry-After", strconv.Itoa(int(dbBreaker.cooldown.Seconds())))
+			http.Error(w, "database unavailable", http.StatusServiceUnavailable)
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
@@ -0,0 +1,279 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// DeliveryFeeSettings configures how an establishment charges for delivery.
+// In "zone" mode the fee comes from ZoneFees keyed by neighborhood; in
+// "formula" mode it is BaseCents plus PerKmCents for each started kilometre.
+// Either way the fee is waived once the order reaches FreeAboveCents.
+type DeliveryFeeSettings struct {
+	Mode              string           `json:"mode"`
+	ZoneFees          map[string]int64 `json:"zone_fees"`
+	BaseCents         int64            `json:"base_cents"`
+	PerKmCents        int64            `json:"per_km_cents"`
+	FreeAboveCents    *int64           `json:"free_above_cents"`
+	MaxDistanceMeters *int             `json:"max_distance_meters"`
+}
+
+// DeliveryQuote is both the quote endpoint's response and the record of the
+// applied formula stored on the order.
+type DeliveryQuote struct {
+	FeeCents       int64  `json:"fee_cents"`
+	Mode           string `json:"mode"`
+	Zone           string `json:"zone,omitempty"`
+	DistanceMeters *int   `json:"distance_meters,omitempty"`
+	// DistanceSource names the routing provider, or straight_line when the
+	// distance is an estimate.
+	DistanceSource  string `json:"distance_source,omitempty"`
+	DurationSeconds *int   `json:"duration_seconds,omitempty"`
+	EtaMinutes      int    `json:"eta_minutes,omitempty"`
+	BaseCents       int64  `json:"base_cents,omitempty"`
+	PerKmCents      int64  `json:"per_km_cents,omitempty"`
+	FreeAboveCents  *int64 `json:"free_above_cents,omitempty"`
+	SubtotalCents   int64  `json:"subtotal_cents"`
+	Waived          bool   `json:"waived,omitempty"`
+}
+
+func deliveryFeeRoute(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	switch r.Method {
+	case http.MethodGet:
+		s, err := loadDeliveryFeeSettings(db, establishmentID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if s == nil {
+			http.NotFound(w, nil)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(s)
+	case http.MethodPut:
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) {
+			if requireRole(w, r, db, establishmentID, "manager") {
+				putDeliveryFeeSettings(w, r, db, establishmentID)
+			}
+		})(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func putDeliveryFeeSettings(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	var s DeliveryFeeSettings
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	zones := map[string]int64{}
+	for k, v := range s.ZoneFees {
+		if v < 0 {
+			http.Error(w, "zone fees must not be negative", http.StatusUnprocessableEntity)
+			return
+		}
+		zones[zoneKey(k)] = v
+	}
+	s.ZoneFees = zones
+	switch {
+	case s.Mode != "zone" && s.Mode != "formula":
+		http.Error(w, "mode must be zone or formula", http.StatusUnprocessableEntity)
+		return
+	case s.Mode == "zone" && len(s.ZoneFees) == 0:
+		http.Error(w, "zone_fees must not be empty in zone mode", http.StatusUnprocessableEntity)
+		return
+	case s.BaseCents < 0 || s.PerKmCents < 0 || (s.FreeAboveCents != nil && *s.FreeAboveCents < 0):
+		http.Error(w, "fees must not be negative", http.StatusUnprocessableEntity)
+		return
+	case s.MaxDistanceMeters != nil && *s.MaxDistanceMeters <= 0:
+		http.Error(w, "max_distance_meters must be positive", http.StatusUnprocessableEntity)
+		return
+	}
+	zoneJSON, _ := json.Marshal(s.ZoneFees)
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	_, err = tx.Exec(
+		`INSERT INTO establishment_delivery_fees (establishment_id, mode, zone_fees, base_cents, per_km_cents, free_above_cents, max_distance_meters)
+		 VALUES ($1,$2,$3,$4,$5,$6,$7)
+		 ON CONFLICT (establishment_id) DO UPDATE SET mode=EXCLUDED.mode, zone_fees=EXCLUDED.zone_fees, base_cents=EXCLUDED.base_cents,
+		   per_km_cents=EXCLUDED.per_km_cents, free_above_cents=EXCLUDED.free_above_cents, max_distance_meters=EXCLUDED.max_distance_meters, updated_at=now()`,
+		establishmentID, s.Mode, zoneJSON, s.BaseCents, s.PerKmCents, s.FreeAboveCents, s.MaxDistanceMeters,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := recordAudit(tx, r, establishmentID, "establishment.delivery_fee_updated", "establishment", establishmentID, s); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// loadDeliveryFeeSettings returns nil when the establishment charges nothing
+// for delivery.
+func loadDeliveryFeeSettings(q queryer, establishmentID string) (*DeliveryFeeSettings, error) {
+	var s DeliveryFeeSettings
+	var zones []byte
+	err := q.QueryRow(
+		`SELECT mode, zone_fees, base_cents, per_km_cents, free_above_cents, max_distance_meters FROM establishment_delivery_fees WHERE establishment_id=$1`,
+		establishmentID,
+	).Scan(&s.Mode, &zones, &s.BaseCents, &s.PerKmCents, &s.FreeAboveCents, &s.MaxDistanceMeters)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(zones, &s.ZoneFees); err != nil {
+		return nil, err
+	}
+	return &s, nil
+}
+
+func zoneKey(neighborhood string) string {
+	return strings.ToLower(strings.TrimSpace(neighborhood))
+}
+
+// quoteDeliveryFee prices delivery to dest for an order worth subtotal and
+// estimates the delivery time when both ends have coordinates. The fee is zero
+// when the establishment has no fee settings.
+func quoteDeliveryFee(ctx context.Context, q queryer, establishmentID string, dest Address, subtotal int64) (*DeliveryQuote, error) {
+	quote := &DeliveryQuote{Mode: "none", SubtotalCents: subtotal}
+	var origin Address
+	err := q.QueryRow(`SELECT address_lat, address_lng FROM establishments WHERE id=$1`, establishmentID).Scan(&origin.Lat, &origin.Lng)
+	if err != nil {
+		return nil, err
+	}
+	if origin.Lat != nil && dest.Lat != nil {
+		route, err := router.Route(ctx, origin, dest)
+		if err != nil {
+			return nil, err
+		}
+		quote.DistanceMeters, quote.DurationSeconds, quote.DistanceSource = &route.DistanceMeters, &route.DurationSeconds, route.Source
+		quote.EtaMinutes = int((defaultPrepTime + time.Duration(route.DurationSeconds)*time.Second).Minutes())
+	}
+
+	s, err := loadDeliveryFeeSettings(q, establishmentID)
+	if err != nil || s == nil {
+		return quote, err
+	}
+	quote.Mode, quote.FreeAboveCents = s.Mode, s.FreeAboveCents
+	if s.Mode == "formula" || s.MaxDistanceMeters != nil {
+		if quote.DistanceMeters == nil {
+			return nil, &checkoutError{http.StatusUnprocessableEntity, "delivery_location_unknown", "delivery address and establishment need coordinates to price this delivery"}
+		}
+		if s.MaxDistanceMeters != nil && *quote.DistanceMeters > *s.MaxDistanceMeters {
+			return nil, &checkoutError{http.StatusUnprocessableEntity, "delivery_out_of_range", "the address is outside the delivery area"}
+		}
+	}
+
+	switch s.Mode {
+	case "zone":
+		quote.Zone = zoneKey(dest.Neighborhood)
+		fee, ok := s.ZoneFees[quote.Zone]
+		if !ok {
+			return nil, &checkoutError{http.StatusUnprocessableEntity, "delivery_out_of_range", "the establishment does not deliver to " + dest.Neighborhood}
+		}
+		quote.FeeCents = fee
+	case "formula":
+		quote.BaseCents, quote.PerKmCents = s.BaseCents, s.PerKmCents
+		km := int64((*quote.DistanceMeters + 999) / 1000)
+		quote.FeeCents = s.BaseCents + km*s.PerKmCents
+	}
+	if s.FreeAboveCents != nil && subtotal >= *s.FreeAboveCents {
+		quote.FeeCents, quote.Waived = 0, true
+	}
+	return quote, nil
+}
+
+func deliveryQuoteHandler(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	var req struct {
+		Address       Address `json:"address"`
+		SubtotalCents int64   `json:"subtotal_cents"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	quote, err := quoteDeliveryFee(r.Context(), db, establishmentID, req.Address, req.SubtotalCents)
+	if ce, ok := err.(*checkoutError); ok {
+		writeCodedError(w, r, ce.status, ce.code, ce.msg)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(quote)
+}
+
+// loadDeliveryAddress fetches one of the customer's saved addresses.
+func loadDeliveryAddress(q queryer, customerID, addressID string) (*Address, error) {
+	var a Address
+	err := q.QueryRow(
+		`SELECT cep, street, number, complement, neighborhood, city, state, lat, lng FROM customer_addresses WHERE id=$1 AND customer_id=$2`,
+		addressID, customerID,
+	).Scan(&a.CEP, &a.Street, &a.Number, &a.Complement, &a.Neighborhood, &a.City, &a.State, &a.Lat, &a.Lng)
+	if err == sql.ErrNoRows {
+		return nil, &checkoutError{http.StatusUnprocessableEntity, "delivery_address_invalid", "delivery address not found"}
+	}
+	return &a, err
+}
+
+// applyDeliveryFee prices delivery orders and adds the fee to the total.
+func applyDeliveryFee(tx *sql.Tx, o *Order, req *CheckoutRequest) error {
+	if o.FulfillmentType != "delivery" {
+		return nil
+	}
+	var dest Address
+	if req.DeliveryAddressID != nil {
+		a, err := loadDeliveryAddress(tx, o.CustomerID, *req.DeliveryAddressID)
+		if err != nil {
+			return err
+		}
+		dest = *a
+	} else {
+		s, err := loadDeliveryFeeSettings(tx, o.EstablishmentID)
+		if err != nil {
+			return err
+		}
+		if s != nil {
+			return &checkoutError{http.StatusUnprocessableEntity, "delivery_address_required", "delivery_address_id is required for deliveries"}
+		}
+		return nil
+	}
+	quote, err := quoteDeliveryFee(context.Background(), tx, o.EstablishmentID, dest, o.TotalCents)
+	if err != nil {
+		return err
+	}
+	details, err := json.Marshal(quote)
+	if err != nil {
+		return err
+	}
+	o.DeliveryAddress, o.deliveryTo = dest.String(), dest
+	o.DeliveryFeeCents, o.DeliveryFeeDetails = quote.FeeCents, details
+	o.TotalCents += quote.FeeCents
+	if quote.EtaMinutes > 0 && req.SlotID == nil {
+		eta := time.Now().UTC().Add(time.Duration(quote.EtaMinutes) * time.Minute)
+		o.EstimatedDeliveryAt = &eta
+	}
+	return nil
+}
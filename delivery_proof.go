@@ -0,0 +1,127 @@
+package main
+
+import (
+	"crypto/subtle"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Establishments can require proof when a courier marks an order delivered:
+// a photo (delivery_photo upload), the customer's signature
+// (delivery_signature upload) or the 4-digit PIN the customer sees while
+// tracking the order. The proof is stored with the delivery and shown on
+// the order.
+
+var deliveryProofModes = map[string]bool{"none": true, "photo": true, "signature": true, "pin": true}
+
+// deliveryPINAttempts limits wrong PINs per order, so a courier can't try
+// all 10,000.
+var deliveryPINAttempts = newWindowLimiter(15*time.Minute, 5)
+
+type DeliveryProof struct {
+	// Type is photo, signature or pin.
+	Type string `json:"type"`
+	// ImageKey is the photo or signature upload, sent by the courier.
+	ImageKey string `json:"image_key,omitempty"`
+	ImageURL string `json:"image_url,omitempty"`
+	// PIN is only accepted in requests; it is never returned.
+	PIN         string `json:"pin,omitempty"`
+	PINVerified bool   `json:"pin_verified,omitempty"`
+}
+
+// deliveryProofError is a proof that doesn't satisfy the establishment's
+// requirement; its message is meant for the courier.
+type deliveryProofError string
+
+func (e deliveryProofError) Error() string { return string(e) }
+
+func updateDeliveryProofSettings(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	if !requireRole(w, r, db, establishmentID, "manager") {
+		return
+	}
+	var s struct {
+		Mode string `json:"mode"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !deliveryProofModes[s.Mode] {
+		http.Error(w, "mode must be none, photo, signature or pin", http.StatusUnprocessableEntity)
+		return
+	}
+	if _, err := db.Exec(`UPDATE establishments SET delivery_proof=$1, updated_at=now() WHERE id=$2`, s.Mode, establishmentID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := recordAudit(db, r, establishmentID, "establishment.delivery_proof_updated", "establishment", establishmentID, s); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// checkDeliveryProof validates d.Proof against what the establishment
+// requires and leaves in it what is stored: nil when nothing is required,
+// and never the PIN.
+func checkDeliveryProof(tx *sql.Tx, establishmentID string, d *Delivery) error {
+	var mode, pin string
+	err := tx.QueryRow(
+		`SELECT e.delivery_proof, o.delivery_pin FROM orders o JOIN establishments e ON e.id=o.establishment_id
+		 WHERE o.id::text=$1 AND o.establishment_id=$2`,
+		d.OrderID, establishmentID,
+	).Scan(&mode, &pin)
+	if err != nil {
+		return err
+	}
+	p := d.Proof
+	d.Proof = nil
+	if mode == "none" {
+		return nil
+	}
+	if p == nil {
+		return deliveryProofError("this establishment requires a delivery " + mode)
+	}
+	switch mode {
+	case "pin":
+		if !deliveryPINAttempts.allow(d.OrderID) {
+			return deliveryProofError("too many wrong PINs, try again later")
+		}
+		if len(p.PIN) != 4 || subtle.ConstantTimeCompare([]byte(p.PIN), []byte(pin)) != 1 {
+			return deliveryProofError("the PIN doesn't match the customer's")
+		}
+		d.Proof = &DeliveryProof{Type: "pin", PINVerified: true}
+	default:
+		var ok bool
+		err := tx.QueryRow(`SELECT EXISTS (SELECT 1 FROM uploads WHERE key=$1 AND purpose=$2 AND scan_status IN ('pending','clean'))`, p.ImageKey, "delivery_"+mode).Scan(&ok)
+		if err != nil {
+			return err
+		}
+		if !ok {
+			return deliveryProofError("image_key must be a delivery_" + mode + " upload")
+		}
+		d.Proof = &DeliveryProof{Type: mode, ImageKey: p.ImageKey, ImageURL: assetURL(p.ImageKey)}
+	}
+	return nil
+}
+
+// loadDeliveryProof returns the proof stored with the order's delivery, or
+// nil when it was delivered without one or not at all.
+func loadDeliveryProof(db *sql.DB, orderID string) (*DeliveryProof, error) {
+	var p DeliveryProof
+	err := db.QueryRow(
+		`SELECT proof_type, COALESCE(proof_key,''), proof_pin_verified FROM deliveries WHERE order_id=$1 AND proof_type IS NOT NULL`,
+		orderID,
+	).Scan(&p.Type, &p.ImageKey, &p.PINVerified)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	p.ImageURL = assetURL(p.ImageKey)
+	return &p, nil
+}
@@ -0,0 +1,172 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+// After a delivery the customer can rate it apart from the product review:
+// whether it arrived on time, the condition of the food and the courier's
+// courtesy. Ratings belong to the order and the courier who delivered it,
+// and roll up into a 0-100 quality score per courier that dispatch and
+// payouts show next to their other numbers.
+
+const (
+	maxDeliveryRatingComment = 500
+	// courierQualityWindow is how far back ratings count toward the quality
+	// score dispatch shows.
+	courierQualityWindow = 90 * 24 * time.Hour
+)
+
+// deliveryQualitySQL scores the rating aliased dr from 0 to 100, weighing
+// the three questions equally.
+const deliveryQualitySQL = `((CASE WHEN dr.on_time THEN 100 ELSE 0 END) + (dr.food_condition - 1) * 25 + (dr.courtesy - 1) * 25) / 3.0`
+
+type DeliveryRating struct {
+	ID            string    `json:"id"`
+	OrderID       string    `json:"order_id"`
+	CourierID     string    `json:"courier_id"`
+	OnTime        bool      `json:"on_time"`
+	FoodCondition int       `json:"food_condition"`
+	Courtesy      int       `json:"courtesy"`
+	Comment       string    `json:"comment"`
+	CreatedAt     time.Time `json:"created_at"`
+}
+
+type deliveryRatingRequest struct {
+	// Token is a review request token, for rating without signing in.
+	Token         string `json:"token"`
+	OnTime        *bool  `json:"on_time"`
+	FoodCondition int    `json:"food_condition"`
+	Courtesy      int    `json:"courtesy"`
+	Comment       string `json:"comment"`
+}
+
+func validateDeliveryRating(req *deliveryRatingRequest) string {
+	req.Comment = sanitizeText(req.Comment)
+	switch {
+	case req.OnTime == nil:
+		return "on_time is required"
+	case req.FoodCondition < 1 || req.FoodCondition > 5:
+		return "food_condition must be between 1 and 5"
+	case req.Courtesy < 1 || req.Courtesy > 5:
+		return "courtesy must be between 1 and 5"
+	case len([]rune(req.Comment)) > maxDeliveryRatingComment:
+		return "comment is too long"
+	}
+	return ""
+}
+
+// deliveryRatingRoute serves POST /orders/{id}/delivery_rating, from the
+// signed-in customer who placed the order or with the order's review request
+// token.
+func deliveryRatingRoute(w http.ResponseWriter, r *http.Request, db *sql.DB, orderID string) {
+	var req deliveryRatingRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Token != "" {
+		tokenOrderID, err := parseReviewToken(req.Token)
+		if err != nil || tokenOrderID != orderID {
+			http.Error(w, "invalid or expired review link", http.StatusUnauthorized)
+			return
+		}
+		createDeliveryRating(w, db, req, orderID, "")
+		return
+	}
+	authenticateCustomer(db, func(w http.ResponseWriter, r *http.Request) {
+		createDeliveryRating(w, db, req, orderID, currentClaims(r).Sub)
+	})(w, r)
+}
+
+// createDeliveryRating stores the rating for a delivered order. customerID,
+// when set, must have placed the order.
+func createDeliveryRating(w http.ResponseWriter, db *sql.DB, req deliveryRatingRequest, orderID, customerID string) {
+	if msg := validateDeliveryRating(&req); msg != "" {
+		http.Error(w, msg, http.StatusUnprocessableEntity)
+		return
+	}
+	v := DeliveryRating{OrderID: orderID, OnTime: *req.OnTime, FoodCondition: req.FoodCondition, Courtesy: req.Courtesy, Comment: req.Comment}
+	var establishmentID string
+	err := db.QueryRow(
+		`INSERT INTO delivery_ratings (order_id, courier_id, establishment_id, customer_id, on_time, food_condition, courtesy, comment)
+		 SELECT o.id, d.courier_id, o.establishment_id, o.customer_id, $3, $4, $5, $6
+		 FROM orders o JOIN deliveries d ON d.order_id=o.id
+		 WHERE o.id::text=$1 AND ($2='' OR o.customer_id::text=$2)
+		 RETURNING id, courier_id, establishment_id, created_at`,
+		orderID, customerID, v.OnTime, v.FoodCondition, v.Courtesy, v.Comment,
+	).Scan(&v.ID, &v.CourierID, &establishmentID, &v.CreatedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "order not found or not delivered yet", http.StatusUnprocessableEntity)
+		return
+	}
+	if isUniqueViolation(err) {
+		http.Error(w, "this delivery has already been rated", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(v)
+}
+
+type CourierQuality struct {
+	CourierID string `json:"courier_id"`
+	Ratings   int    `json:"ratings"`
+	// Score is 0-100; nil until the courier has been rated.
+	Score            *float64         `json:"score"`
+	OnTimeRate       *float64         `json:"on_time_rate"`
+	AvgFoodCondition *float64         `json:"avg_food_condition"`
+	AvgCourtesy      *float64         `json:"avg_courtesy"`
+	Recent           []DeliveryRating `json:"recent"`
+}
+
+// courierRatings serves GET /couriers/{id}/ratings: the quality score over
+// courierQualityWindow and the latest ratings.
+func courierRatings(w http.ResponseWriter, db *sql.DB, c *Courier) {
+	q := CourierQuality{CourierID: c.ID, Recent: []DeliveryRating{}}
+	err := db.QueryRow(
+		`SELECT COUNT(*), AVG(`+deliveryQualitySQL+`), AVG(dr.on_time::int), AVG(dr.food_condition), AVG(dr.courtesy)
+		 FROM delivery_ratings dr WHERE dr.courier_id=$1 AND dr.created_at > now() - $2 * interval '1 second'`,
+		c.ID, int(courierQualityWindow.Seconds()),
+	).Scan(&q.Ratings, &q.Score, &q.OnTimeRate, &q.AvgFoodCondition, &q.AvgCourtesy)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rows, err := db.Query(
+		`SELECT id, order_id, courier_id, on_time, food_condition, courtesy, comment, created_at
+		 FROM delivery_ratings WHERE courier_id=$1 ORDER BY created_at DESC LIMIT 50`, c.ID,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var v DeliveryRating
+		if err := rows.Scan(&v.ID, &v.OrderID, &v.CourierID, &v.OnTime, &v.FoodCondition, &v.Courtesy, &v.Comment, &v.CreatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		q.Recent = append(q.Recent, v)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(q)
+}
+
+// qualityReason describes a courier's quality score for the dispatch
+// ranking.
+func qualityReason(score *float64, ratings int) string {
+	if score == nil {
+		return "no delivery ratings yet"
+	}
+	return fmt.Sprintf("quality %.0f from %d ratings", *score, ratings)
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultDescriptionsPerHour  = 30
+	maxDescriptionTags          = 10
+	descriptionMaxOutputTokens  = 300
+	defaultOpenAIDescriptionURL = "https://api.openai.com/v1"
+)
+
+type DescriptionPrompt struct {
+	ProductName  string
+	CategoryName string
+	Tags         []string
+}
+
+// DescriptionGenerator proposes a menu description for a product.
+type DescriptionGenerator interface {
+	Name() string
+	Generate(ctx context.Context, p DescriptionPrompt) (string, error)
+}
+
+// descriptionGenerator is nil when no LLM provider is configured.
+var descriptionGenerator DescriptionGenerator
+
+// descriptionLimiter caps generations per establishment per hour.
+var descriptionLimiter = newWindowLimiter(time.Hour, defaultDescriptionsPerHour)
+
+// newDescriptionGeneratorFromEnv picks the provider from LLM_PROVIDER (openai,
+// for any OpenAI-compatible API via LLM_BASE_URL, or anthropic) with
+// LLM_API_KEY and LLM_MODEL. LLM_DESCRIPTIONS_PER_HOUR sets the
+// per-establishment limit.
+func newDescriptionGeneratorFromEnv() DescriptionGenerator {
+	if v := os.Getenv("LLM_DESCRIPTIONS_PER_HOUR"); v != "" {
+		if n, err := strconv.Atoi(v); err == nil && n > 0 {
+			descriptionLimiter = newWindowLimiter(time.Hour, n)
+		} else {
+			log.Printf("invalid LLM_DESCRIPTIONS_PER_HOUR %q, using %d", v, defaultDescriptionsPerHour)
+		}
+	}
+	key, model := os.Getenv("LLM_API_KEY"), os.Getenv("LLM_MODEL")
+	switch os.Getenv("LLM_PROVIDER") {
+	case "openai":
+		u := os.Getenv("LLM_BASE_URL")
+		if u == "" {
+			u = defaultOpenAIDescriptionURL
+		}
+		if model == "" {
+			model = "gpt-4o-mini"
+		}
+		return openAIGenerator{baseURL: strings.TrimSuffix(u, "/"), apiKey: key, model: model}
+	case "anthropic":
+		if model == "" {
+			model = "claude-3-5-haiku-latest"
+		}
+		return anthropicGenerator{apiKey: key, model: model}
+	case "":
+		return nil
+	default:
+		log.Printf("unknown LLM_PROVIDER %q, description generation disabled", os.Getenv("LLM_PROVIDER"))
+		return nil
+	}
+}
+
+// descriptionInstructions is the shared prompt. The generated text is treated
+// like user input and sanitized before it is returned.
+func descriptionInstructions(p DescriptionPrompt) string {
+	var b strings.Builder
+	b.WriteString("Escreva uma descrição curta e apetitosa, em português do Brasil, para um item de cardápio de delivery. ")
+	b.WriteString("Use no máximo 2 frases e 200 caracteres, sem preço, sem emojis e sem inventar ingredientes que não estejam implícitos no nome ou nas etiquetas. ")
+	b.WriteString("Responda apenas com a descrição.\n\n")
+	fmt.Fprintf(&b, "Produto: %s\n", p.ProductName)
+	if p.CategoryName != "" {
+		fmt.Fprintf(&b, "Categoria: %s\n", p.CategoryName)
+	}
+	if len(p.Tags) > 0 {
+		fmt.Fprintf(&b, "Etiquetas: %s\n", strings.Join(p.Tags, ", "))
+	}
+	return b.String()
+}
+
+type openAIGenerator struct {
+	baseURL, apiKey, model string
+}
+
+func (openAIGenerator) Name() string { return "openai" }
+
+func (g openAIGenerator) Generate(ctx context.Context, p DescriptionPrompt) (string, error) {
+	payload := map[string]any{
+		"model":      g.model,
+		"max_tokens": descriptionMaxOutputTokens,
+		"messages":   []map[string]string{{"role": "user", "content": descriptionInstructions(p)}},
+	}
+	var body struct {
+		Choices []struct {
+			Message struct {
+				Content string `json:"content"`
+			} `json:"message"`
+		} `json:"choices"`
+	}
+	headers := map[string]string{"Authorization": "Bearer " + g.apiKey}
+	if err := postJSON(ctx, g.baseURL+"/chat/completions", headers, payload, &body); err != nil {
+		return "", err
+	}
+	if len(body.Choices) == 0 {
+		return "", errors.New("openai: empty response")
+	}
+	return body.Choices[0].Message.Content, nil
+}
+
+type anthropicGenerator struct {
+	apiKey, model string
+}
+
+func (anthropicGenerator) Name() string { return "anthropic" }
+
+func (g anthropicGenerator) Generate(ctx context.Context, p DescriptionPrompt) (string, error) {
+	payload := map[string]any{
+		"model":      g.model,
+		"max_tokens": descriptionMaxOutputTokens,
+		"messages":   []map[string]string{{"role": "user", "content": descriptionInstructions(p)}},
+	}
+	var body struct {
+		Content []struct {
+			Type string `json:"type"`
+			Text string `json:"text"`
+		} `json:"content"`
+	}
+	headers := map[string]string{"x-api-key": g.apiKey, "anthropic-version": "2023-06-01"}
+	if err := postJSON(ctx, "https://api.anthropic.com/v1/messages", headers, payload, &body); err != nil {
+		return "", err
+	}
+	var text strings.Builder
+	for _, c := range body.Content {
+		if c.Type == "text" {
+			text.WriteString(c.Text)
+		}
+	}
+	if text.Len() == 0 {
+		return "", errors.New("anthropic: empty response")
+	}
+	return text.String(), nil
+}
+
+func postJSON(ctx context.Context, endpoint string, headers map[string]string, payload, out any) error {
+	data, err := json.Marshal(payload)
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, endpoint, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	for k, v := range headers {
+		req.Header.Set(k, v)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// generateProductDescription returns a suggested description for the product.
+// Nothing is saved; the client decides whether to PUT it back.
+func generateProductDescription(w http.ResponseWriter, r *http.Request, db *sql.DB, productID string) {
+	var req struct {
+		Tags []string `json:"tags"`
+	}
+	if r.ContentLength != 0 {
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	if len(req.Tags) > maxDescriptionTags {
+		http.Error(w, fmt.Sprintf("at most %d tags are allowed", maxDescriptionTags), http.StatusUnprocessableEntity)
+		return
+	}
+	prompt := DescriptionPrompt{}
+	for _, t := range req.Tags {
+		if t = sanitizeText(t); t != "" {
+			prompt.Tags = append(prompt.Tags, t)
+		}
+	}
+
+	var establishmentID string
+	err := db.QueryRow(
+		`SELECT p.establishment_id, p.name, COALESCE(c.name,'') FROM products p LEFT JOIN product_categories c ON c.id=p.category_id WHERE p.id=$1`,
+		productID,
+	).Scan(&establishmentID, &prompt.ProductName, &prompt.CategoryName)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, nil)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !requireRole(w, r, db, establishmentID, "staff") {
+		return
+	}
+	if descriptionGenerator == nil {
+		http.Error(w, "description generation is not configured", http.StatusServiceUnavailable)
+		return
+	}
+	if !descriptionLimiter.allow(establishmentID) {
+		http.Error(w, "description generation limit reached, try again later", http.StatusTooManyRequests)
+		return
+	}
+
+	text, err := descriptionGenerator.Generate(r.Context(), prompt)
+	if err != nil {
+		log.Printf("description generation via %s failed: %v", descriptionGenerator.Name(), err)
+		http.Error(w, "description provider unavailable", http.StatusBadGateway)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{
+		"suggestion": strings.Trim(sanitizeText(text), `"`),
+		"provider":   descriptionGenerator.Name(),
+	})
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// The directory is the public marketplace listing: published, verified
+// establishments filtered by city, category and cuisine, newest first.
+
+// establishmentCategories are the kinds of business the directory groups
+// establishments by.
+var establishmentCategories = map[string]bool{
+	"restaurante": true,
+	"lanchonete":  true,
+	"pizzaria":    true,
+	"padaria":     true,
+	"cafeteria":   true,
+	"doceria":     true,
+	"bar":         true,
+	"mercado":     true,
+	"bebidas":     true,
+}
+
+type DirectoryEntry struct {
+	ID            string  `json:"id"`
+	Name          string  `json:"name"`
+	Category      string  `json:"category"`
+	City          string  `json:"city"`
+	State         string  `json:"state"`
+	ImageURL      string  `json:"image_url,omitempty"`
+	Verified      bool    `json:"verified"`
+	AverageRating float64 `json:"average_rating"`
+	ReviewCount   int     `json:"review_count"`
+	// Cuisines are cuisine slugs.
+	Cuisines []string `json:"cuisines"`
+	// Open tells whether the current local time is within the
+	// establishment's delivery hours; null when it hasn't set any.
+	Open      *bool     `json:"open"`
+	CreatedAt time.Time `json:"-"`
+}
+
+func directoryHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		cursor, limit, err := pageParams(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		city := strings.TrimSpace(r.URL.Query().Get("city"))
+		category := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("category")))
+		cuisine := strings.ToLower(strings.TrimSpace(r.URL.Query().Get("cuisine")))
+		if category != "" && !establishmentCategories[category] {
+			http.Error(w, "unknown category", http.StatusBadRequest)
+			return
+		}
+		at, id := keysetArgs(cursor)
+		rows, err := db.Query(
+			`SELECT e.id, e.name, COALESCE(e.category,''), COALESCE(e.address_city,''), COALESCE(e.address_state,''), COALESCE(e.image_key,''),
+			   COALESCE(s.rating_sum::float / NULLIF(s.review_count,0), (SELECT AVG(rating) FROM reviews WHERE establishment_id=e.id AND s.establishment_id IS NULL), 0),
+			   COALESCE(s.review_count, (SELECT COUNT(*) FROM reviews WHERE establishment_id=e.id)),
+			   (SELECT (now() AT TIME ZONE 'UTC' AT TIME ZONE e.timezone)::time BETWEEN sr.opens_at AND sr.closes_at
+			    FROM delivery_slot_rules sr WHERE sr.establishment_id=e.id),
+			   ARRAY(SELECT cuisine FROM establishment_cuisines WHERE establishment_id=e.id ORDER BY cuisine),
+			   e.created_at
+			 FROM establishments e LEFT JOIN review_summaries s ON s.establishment_id=e.id
+			 WHERE e.status='published' AND e.verified_at IS NOT NULL
+			   AND ($1='' OR lower(e.address_city)=lower($1)) AND ($2='' OR e.category=$2)
+			   AND ($6='' OR EXISTS (SELECT 1 FROM establishment_cuisines ec WHERE ec.establishment_id=e.id AND ec.cuisine=$6))
+			   AND (e.created_at, e.id) < ($3, $4::uuid)
+			 ORDER BY e.created_at DESC, e.id DESC LIMIT $5`,
+			city, category, at, id, limit+1, cuisine,
+		)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		list := []DirectoryEntry{}
+		for rows.Next() {
+			d := DirectoryEntry{Verified: true}
+			var imageKey string
+			if err := rows.Scan(&d.ID, &d.Name, &d.Category, &d.City, &d.State, &imageKey, &d.AverageRating, &d.ReviewCount, &d.Open, pq.Array(&d.Cuisines), &d.CreatedAt); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if imageKey != "" {
+				d.ImageURL = assetURL(imageKey)
+			}
+			list = append(list, d)
+		}
+		page := newPage(list, limit, func(d DirectoryEntry) pageCursor { return pageCursor{d.CreatedAt, d.ID} })
+		if page.NextCursor != nil {
+			w.Header().Set("X-Next-Cursor", *page.NextCursor)
+		}
+		respond(w, r, "directory", page)
+	}
+}
@@ -0,0 +1,329 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"sort"
+	"time"
+)
+
+// Dispatch ranks the establishment's couriers for a delivery order and
+// assigns it to one by planning a single-stop batch. Every courier starts at
+// 100 points and loses some for each stop they still have to deliver and for
+// each kilometre their last known location is from the restaurant; couriers
+// without a recent location are assumed to be there. Couriers who are off
+// shift or on a break are listed but can't be picked. The ranking, with the
+// reasons behind each score, is stored with every decision, and staff can
+// assign someone other than the top courier. The auto_dispatch setting makes
+// accepted orders get a suggestion or an assignment on their own.
+
+const (
+	dispatchStopPenalty = 20
+	dispatchKmPenalty   = 5
+	// dispatchLocationMaxAge is how old a courier location can be and still
+	// count as where the courier is.
+	dispatchLocationMaxAge = 15 * time.Minute
+)
+
+type DispatchCandidate struct {
+	CourierID string `json:"courier_id"`
+	Name      string `json:"name"`
+	Score     int    `json:"score"`
+	Eligible  bool   `json:"eligible"`
+	OpenStops int    `json:"open_stops"`
+	// DistanceMeters is from the courier's last location to the restaurant;
+	// nil when the courier has no recent location.
+	DistanceMeters *int `json:"distance_meters"`
+	// QualityScore is the courier's 0-100 delivery rating score; it is shown
+	// but doesn't change the ranking.
+	QualityScore *float64 `json:"quality_score"`
+	Reasons      []string `json:"reasons"`
+}
+
+type DispatchDecision struct {
+	ID                 string              `json:"id"`
+	OrderID            string              `json:"order_id"`
+	Mode               string              `json:"mode"` // suggested, auto, manual or override
+	SuggestedCourierID *string             `json:"suggested_courier_id"`
+	CourierID          *string             `json:"courier_id"`
+	BatchID            *string             `json:"batch_id"`
+	Candidates         []DispatchCandidate `json:"candidates"`
+	DecidedBy          *string             `json:"decided_by"`
+	CreatedAt          time.Time           `json:"created_at"`
+}
+
+type dispatchQueryer interface {
+	queryer
+	rowsQueryer
+}
+
+// rankCouriers scores the establishment's active couriers, best first.
+func rankCouriers(q dispatchQueryer, establishmentID string) ([]DispatchCandidate, error) {
+	var origin Address
+	if err := q.QueryRow(`SELECT address_lat, address_lng FROM establishments WHERE id=$1`, establishmentID).Scan(&origin.Lat, &origin.Lng); err != nil {
+		return nil, err
+	}
+	rows, err := q.Query(
+		`SELECT c.id, c.name,
+		   (SELECT COUNT(*) FROM delivery_batch_stops s JOIN delivery_batches b ON b.id=s.batch_id
+		    WHERE b.courier_id=c.id AND b.status IN ('planned','in_progress') AND s.status IN ('pending','en_route')),
+		   l.lat, l.lng, c.availability, q.score, q.ratings
+		 FROM couriers c
+		 LEFT JOIN LATERAL (
+		   SELECT lat, lng FROM courier_locations
+		   WHERE courier_id=c.id AND recorded_at > now() - $2 * interval '1 second'
+		   ORDER BY recorded_at DESC LIMIT 1
+		 ) l ON true
+		 CROSS JOIN LATERAL (
+		   SELECT AVG(`+deliveryQualitySQL+`) AS score, COUNT(*) AS ratings FROM delivery_ratings dr
+		   WHERE dr.courier_id=c.id AND dr.created_at > now() - $3 * interval '1 second'
+		 ) q
+		 WHERE c.establishment_id=$1 AND c.active`,
+		establishmentID, int(dispatchLocationMaxAge.Seconds()), int(courierQualityWindow.Seconds()),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []DispatchCandidate{}
+	for rows.Next() {
+		var c DispatchCandidate
+		var at Address
+		var availability string
+		var ratings int
+		if err := rows.Scan(&c.CourierID, &c.Name, &c.OpenStops, &at.Lat, &at.Lng, &availability, &c.QualityScore, &ratings); err != nil {
+			return nil, err
+		}
+		c.Score, c.Eligible = 100, true
+		switch availability {
+		case "offline":
+			c.Eligible = false
+			c.Reasons = append(c.Reasons, "not on shift")
+		case "on_break":
+			c.Eligible = false
+			c.Reasons = append(c.Reasons, "on a break")
+		}
+		switch c.OpenStops {
+		case 0:
+			c.Reasons = append(c.Reasons, "no open stops")
+		default:
+			penalty := c.OpenStops * dispatchStopPenalty
+			c.Score -= penalty
+			c.Reasons = append(c.Reasons, fmt.Sprintf("%d open stops (-%d)", c.OpenStops, penalty))
+		}
+		if c.OpenStops >= maxBatchStops {
+			c.Eligible = false
+			c.Reasons = append(c.Reasons, fmt.Sprintf("already has the maximum of %d stops", maxBatchStops))
+		}
+		if at.Lat != nil && origin.Lat != nil {
+			d := straightLineMeters(at, origin)
+			penalty := d * dispatchKmPenalty / 1000
+			c.DistanceMeters = &d
+			c.Score -= penalty
+			c.Reasons = append(c.Reasons, fmt.Sprintf("%.1f km from the restaurant (-%d)", float64(d)/1000, penalty))
+		} else {
+			c.Reasons = append(c.Reasons, "no recent location; assumed at the restaurant")
+		}
+		c.Reasons = append(c.Reasons, qualityReason(c.QualityScore, ratings))
+		list = append(list, c)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	sort.SliceStable(list, func(i, j int) bool {
+		if list[i].Eligible != list[j].Eligible {
+			return list[i].Eligible
+		}
+		if list[i].Score != list[j].Score {
+			return list[i].Score > list[j].Score
+		}
+		return list[i].Name < list[j].Name
+	})
+	return list, nil
+}
+
+// dispatchError is a dispatch that can't be done; its message is meant for
+// staff.
+type dispatchError string
+
+func (e dispatchError) Error() string { return string(e) }
+
+// dispatchOrder ranks the couriers for the order and records the decision.
+// With mode "suggested" it only records the top courier; otherwise it
+// assigns the order to courierID, or to the top courier when courierID is
+// empty.
+func dispatchOrder(ctx context.Context, db *sql.DB, orderID, courierID, mode string, decidedBy *string) (*DispatchDecision, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	var establishmentID string
+	if err := tx.QueryRow(`SELECT establishment_id FROM orders WHERE id=$1`, orderID).Scan(&establishmentID); err != nil {
+		return nil, err
+	}
+	candidates, err := lockBatchCandidates(tx, establishmentID, []string{orderID})
+	if err != nil {
+		return nil, err
+	}
+	if len(candidates) == 0 {
+		return nil, dispatchError("order is not an open delivery, or is already on a batch")
+	}
+	ranking, err := rankCouriers(tx, establishmentID)
+	if err != nil {
+		return nil, err
+	}
+	d := DispatchDecision{OrderID: orderID, Mode: mode, Candidates: ranking, DecidedBy: decidedBy}
+	if len(ranking) > 0 && ranking[0].Eligible {
+		d.SuggestedCourierID = &ranking[0].CourierID
+	}
+	if mode != "suggested" {
+		if courierID == "" {
+			if d.SuggestedCourierID == nil {
+				return nil, dispatchError("no courier is available")
+			}
+			courierID = *d.SuggestedCourierID
+		}
+		i := slices.IndexFunc(ranking, func(c DispatchCandidate) bool { return c.CourierID == courierID })
+		if i < 0 {
+			return nil, dispatchError("courier is not an active courier of this establishment")
+		}
+		if !ranking[i].Eligible {
+			return nil, dispatchError("courier is off shift, on a break or can't take more stops")
+		}
+		if mode == "manual" && (d.SuggestedCourierID == nil || courierID != *d.SuggestedCourierID) {
+			d.Mode = "override"
+		}
+		batchID, err := insertBatch(ctx, tx, &Courier{ID: courierID, EstablishmentID: establishmentID}, candidates)
+		if err != nil {
+			return nil, err
+		}
+		d.CourierID, d.BatchID = &courierID, &batchID
+	}
+	details, err := json.Marshal(d.Candidates)
+	if err != nil {
+		return nil, err
+	}
+	err = tx.QueryRow(
+		`INSERT INTO dispatch_decisions (order_id, establishment_id, mode, suggested_courier_id, courier_id, batch_id, candidates, decided_by)
+		 VALUES ($1,$2,$3,$4,$5,$6,$7,$8) RETURNING id, created_at`,
+		orderID, establishmentID, d.Mode, d.SuggestedCourierID, d.CourierID, d.BatchID, details, decidedBy,
+	).Scan(&d.ID, &d.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	return &d, tx.Commit()
+}
+
+// orderDispatchRoute serves GET /orders/{id}/dispatch, the current ranking
+// and the latest decision, and POST, which assigns the order to the courier
+// in the body or, without one, to the top-ranked courier.
+func orderDispatchRoute(w http.ResponseWriter, r *http.Request, db *sql.DB, orderID string) {
+	var establishmentID string
+	err := db.QueryRow(`SELECT establishment_id FROM orders WHERE id=$1`, orderID).Scan(&establishmentID)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, nil)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !requireRole(w, r, db, establishmentID, "staff") {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		ranking, err := rankCouriers(db, establishmentID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		latest, err := latestDispatchDecision(db, orderID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"candidates": ranking, "latest_decision": latest})
+	case http.MethodPost:
+		var req struct {
+			CourierID string `json:"courier_id"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		ctx, cancel := context.WithTimeout(r.Context(), 10*time.Second)
+		defer cancel()
+		d, err := dispatchOrder(ctx, db, orderID, req.CourierID, "manual", &currentClaims(r).Sub)
+		if e, ok := err.(dispatchError); ok {
+			http.Error(w, e.Error(), http.StatusConflict)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := recordAudit(db, r, establishmentID, "order.dispatched", "order", orderID, map[string]any{"courier_id": d.CourierID, "mode": d.Mode}); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(d)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func latestDispatchDecision(db *sql.DB, orderID string) (*DispatchDecision, error) {
+	var d DispatchDecision
+	var candidates []byte
+	err := db.QueryRow(
+		`SELECT id, order_id, mode, suggested_courier_id, courier_id, batch_id, candidates, decided_by, created_at
+		 FROM dispatch_decisions WHERE order_id=$1 ORDER BY created_at DESC LIMIT 1`, orderID,
+	).Scan(&d.ID, &d.OrderID, &d.Mode, &d.SuggestedCourierID, &d.CourierID, &d.BatchID, &candidates, &d.DecidedBy, &d.CreatedAt)
+	if err == sql.ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &d, json.Unmarshal(candidates, &d.Candidates)
+}
+
+// autoDispatchOrders suggests or assigns a courier for accepted delivery
+// orders, following the establishment's auto_dispatch setting. Routing
+// goes through parent, which marks the sandbox.
+func autoDispatchOrders(parent context.Context, db *sql.DB) func(Event) {
+	return func(e Event) {
+		v, err := settingValue(db, e.EstablishmentID, "auto_dispatch")
+		if err != nil {
+			log.Printf("auto-dispatch %s: %v", e.OrderID, err)
+			return
+		}
+		mode := "auto"
+		switch v {
+		case "off":
+			return
+		case "suggest":
+			mode = "suggested"
+		}
+		var delivery bool
+		if err := db.QueryRow(`SELECT fulfillment_type='delivery' FROM orders WHERE id=$1`, e.OrderID).Scan(&delivery); err != nil || !delivery {
+			return
+		}
+		ctx, cancel := context.WithTimeout(parent, 10*time.Second)
+		defer cancel()
+		if _, err := dispatchOrder(ctx, db, e.OrderID, "", mode, nil); err != nil {
+			log.Printf("auto-dispatch %s: %v", e.OrderID, err)
+		}
+	}
+}
@@ -0,0 +1,347 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime/multipart"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const maxEvidenceSize = 5 << 20
+
+type DisputeEvent struct {
+	ProviderDisputeID string
+	// OrderID is set when the provider echoes it back; otherwise the order is
+	// found through ChargeIDs, the gateway ids of the disputed payment.
+	OrderID       string
+	ChargeIDs     []string
+	Status        string
+	Reason        string
+	AmountCents   int64
+	EvidenceDueBy *time.Time
+}
+
+type DisputeProvider interface {
+	ParseDisputeWebhook(r *http.Request, body []byte) (*DisputeEvent, error)
+	SubmitEvidence(ctx context.Context, providerDisputeID, filename string, content []byte) error
+}
+
+var disputeProviders = map[string]DisputeProvider{}
+
+var errIgnoredEvent = errors.New("event ignored")
+
+type Dispute struct {
+	ID                string     `json:"id"`
+	OrderID           string     `json:"order_id"`
+	Provider          string     `json:"provider"`
+	ProviderDisputeID string     `json:"provider_dispute_id"`
+	Status            string     `json:"status"`
+	Reason            string     `json:"reason"`
+	AmountCents       int64      `json:"amount_cents"`
+	EvidenceDueBy     *time.Time `json:"evidence_due_by"`
+	CreatedAt         time.Time  `json:"created_at"`
+	UpdatedAt         time.Time  `json:"updated_at"`
+}
+
+type stripeDisputes struct {
+	secretKey     string
+	webhookSecret string
+}
+
+var stripeDisputeStatus = map[string]string{
+	"warning_needs_response": "open",
+	"needs_response":         "open",
+	"warning_under_review":   "under_review",
+	"under_review":           "under_review",
+	"warning_closed":         "won",
+	"won":                    "won",
+	"lost":                   "lost",
+	"charge_refunded":        "lost",
+}
+
+// ParseDisputeWebhook verifies the Stripe-Signature like payment webhooks:
+// a missing secret or a stale timestamp fails, as a bad signature does.
+func (s stripeDisputes) ParseDisputeWebhook(r *http.Request, body []byte) (*DisputeEvent, error) {
+	if err := verifyStripeSignature(r, body, s.webhookSecret); err != nil {
+		return nil, err
+	}
+
+	var evt struct {
+		Type string `json:"type"`
+		Data struct {
+			Object struct {
+				ID              string `json:"id"`
+				Amount          int64  `json:"amount"`
+				Reason          string `json:"reason"`
+				Status          string `json:"status"`
+				Charge          string `json:"charge"`
+				PaymentIntent   string `json:"payment_intent"`
+				EvidenceDetails struct {
+					DueBy int64 `json:"due_by"`
+				} `json:"evidence_details"`
+				Metadata map[string]string `json:"metadata"`
+			} `json:"object"`
+		} `json:"data"`
+	}
+	if err := json.Unmarshal(body, &evt); err != nil {
+		return nil, err
+	}
+	if !strings.HasPrefix(evt.Type, "charge.dispute.") {
+		return nil, errIgnoredEvent
+	}
+	obj := evt.Data.Object
+	// Disputes don't carry the charge's metadata; payments store the
+	// PaymentIntent id, so match on it as well as the charge.
+	e := &DisputeEvent{
+		ProviderDisputeID: obj.ID,
+		OrderID:           obj.Metadata["order_id"],
+		ChargeIDs:         []string{obj.Charge, obj.PaymentIntent},
+		Status:            stripeDisputeStatus[obj.Status],
+		Reason:            obj.Reason,
+		AmountCents:       obj.Amount,
+	}
+	if e.Status == "" {
+		e.Status = "open"
+	}
+	if obj.EvidenceDetails.DueBy > 0 {
+		t := time.Unix(obj.EvidenceDetails.DueBy, 0)
+		e.EvidenceDueBy = &t
+	}
+	return e, nil
+}
+
+func (s stripeDisputes) SubmitEvidence(ctx context.Context, providerDisputeID, filename string, content []byte) error {
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	mw.WriteField("purpose", "dispute_evidence")
+	fw, err := mw.CreateFormFile("file", filename)
+	if err != nil {
+		return err
+	}
+	fw.Write(content)
+	mw.Close()
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://files.stripe.com/v1/files", &buf)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", mw.FormDataContentType())
+	req.SetBasicAuth(s.secretKey, "")
+	var file struct {
+		ID string `json:"id"`
+	}
+	if err := stripeCall(req, &file); err != nil {
+		return err
+	}
+
+	form := url.Values{"evidence[uncategorized_file]": {file.ID}}
+	req, err = http.NewRequestWithContext(ctx, http.MethodPost, "https://api.stripe.com/v1/disputes/"+url.PathEscape(providerDisputeID), strings.NewReader(form.Encode()))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.SetBasicAuth(s.secretKey, "")
+	return stripeCall(req, nil)
+}
+
+func stripeCall(req *http.Request, out any) error {
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("stripe: status %d: %s", resp.StatusCode, b)
+	}
+	if out == nil {
+		return nil
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+func disputeWebhookHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		provider := strings.TrimPrefix(r.URL.Path, "/webhooks/disputes/")
+		p, ok := disputeProviders[provider]
+		if !ok {
+			http.NotFound(w, nil)
+			return
+		}
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		e, err := p.ParseDisputeWebhook(r, body)
+		if errors.Is(err, errIgnoredEvent) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if e.OrderID == "" {
+			err := db.QueryRow(
+				`SELECT order_id FROM payments WHERE gateway=$1 AND provider_charge_id = ANY($2) ORDER BY created_at DESC LIMIT 1`,
+				provider, pq.Array(e.ChargeIDs),
+			).Scan(&e.OrderID)
+			if err == sql.ErrNoRows {
+				// Not one of our payments; acknowledge so the provider stops
+				// retrying.
+				log.Printf("dispute %s/%s: no matching payment", provider, e.ProviderDisputeID)
+				w.WriteHeader(http.StatusOK)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		if err := recordDispute(db, provider, e); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+func recordDispute(db *sql.DB, provider string, e *DisputeEvent) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var orderID string
+	err = tx.QueryRow(
+		`INSERT INTO disputes (order_id, provider, provider_dispute_id, status, reason, amount_cents, evidence_due_by)
+		 VALUES ($1,$2,$3,$4,$5,$6,$7)
+		 ON CONFLICT (provider, provider_dispute_id) DO UPDATE SET status=EXCLUDED.status, reason=EXCLUDED.reason,
+		   amount_cents=EXCLUDED.amount_cents, evidence_due_by=EXCLUDED.evidence_due_by, updated_at=now()
+		 RETURNING order_id`,
+		e.OrderID, provider, e.ProviderDisputeID, e.Status, e.Reason, e.AmountCents, e.EvidenceDueBy,
+	).Scan(&orderID)
+	if err != nil {
+		return err
+	}
+	payload, _ := json.Marshal(map[string]any{"provider": provider, "dispute_id": e.ProviderDisputeID, "status": e.Status, "amount_cents": e.AmountCents})
+	if _, err := tx.Exec(`INSERT INTO order_events (order_id, event_type, payload) VALUES ($1,'DISPUTE',$2)`, orderID, payload); err != nil {
+		return err
+	}
+	return tx.Commit()
+}
+
+func listDisputes(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	if !requireRole(w, r, db, establishmentID, "manager") {
+		return
+	}
+	q := `SELECT d.id, d.order_id, d.provider, d.provider_dispute_id, d.status, COALESCE(d.reason,''), d.amount_cents, d.evidence_due_by, d.created_at, d.updated_at
+	      FROM disputes d JOIN orders o ON o.id=d.order_id WHERE o.establishment_id=$1`
+	args := []any{establishmentID}
+	if status := r.URL.Query().Get("status"); status != "" {
+		q += ` AND d.status=$2`
+		args = append(args, status)
+	}
+	rows, err := db.Query(q+` ORDER BY d.created_at DESC`, args...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	list := []Dispute{}
+	for rows.Next() {
+		var d Dispute
+		if err := rows.Scan(&d.ID, &d.OrderID, &d.Provider, &d.ProviderDisputeID, &d.Status, &d.Reason, &d.AmountCents, &d.EvidenceDueBy, &d.CreatedAt, &d.UpdatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		list = append(list, d)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func disputeHandler(db *sql.DB) http.HandlerFunc {
+	return authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) {
+		id, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/disputes/"), "/")
+		if sub != "evidence" || r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		uploadDisputeEvidence(w, r, db, id)
+	})
+}
+
+func uploadDisputeEvidence(w http.ResponseWriter, r *http.Request, db *sql.DB, id string) {
+	var establishmentID, provider, providerDisputeID, status string
+	err := db.QueryRow(
+		`SELECT o.establishment_id, d.provider, d.provider_dispute_id, d.status FROM disputes d JOIN orders o ON o.id=d.order_id WHERE d.id=$1`, id,
+	).Scan(&establishmentID, &provider, &providerDisputeID, &status)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, nil)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !requireRole(w, r, db, establishmentID, "manager") {
+		return
+	}
+	if status != "open" {
+		http.Error(w, "dispute is no longer accepting evidence", http.StatusConflict)
+		return
+	}
+	p, ok := disputeProviders[provider]
+	if !ok {
+		http.Error(w, "provider not configured", http.StatusServiceUnavailable)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxEvidenceSize+1024)
+	file, header, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	content, err := io.ReadAll(file)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := p.SubmitEvidence(r.Context(), providerDisputeID, header.Filename, content); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	_, err = db.Exec(
+		`INSERT INTO dispute_evidence (dispute_id, filename, size_bytes, submitted_by) VALUES ($1,$2,$3,$4)`,
+		id, header.Filename, len(content), currentClaims(r).Sub,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]string{"filename": header.Filename, "size_bytes": strconv.Itoa(len(content))})
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestStripeDisputeWebhookSignature(t *testing.T) {
+	body := []byte(`{"type":"charge.dispute.closed","data":{"object":{"id":"dp_1","status":"won","charge":"ch_1"}}}`)
+	sign := func(secret string, at time.Time) string {
+		ts := strconv.FormatInt(at.Unix(), 10)
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(ts + "." + string(body)))
+		return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	for _, tc := range []struct {
+		name     string
+		provider stripeDisputes
+		header   string
+		ok       bool
+	}{
+		{"valid", stripeDisputes{webhookSecret: "whsec"}, sign("whsec", time.Now()), true},
+		{"no secret configured", stripeDisputes{}, sign("", time.Now()), false},
+		{"replayed", stripeDisputes{webhookSecret: "whsec"}, sign("whsec", time.Now().Add(-time.Hour)), false},
+	} {
+		r := httptest.NewRequest("POST", "/webhooks/disputes/stripe", nil)
+		r.Header.Set("Stripe-Signature", tc.header)
+		e, err := tc.provider.ParseDisputeWebhook(r, body)
+		if (err == nil) != tc.ok {
+			t.Errorf("%s: err = %v", tc.name, err)
+		}
+		if tc.ok && (e == nil || e.Status != "won") {
+			t.Errorf("%s: event = %+v", tc.name, e)
+		}
+	}
+}
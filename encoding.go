@@ -0,0 +1,248 @@
+package main
+
+import (
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// ResponseEncoder writes a response body in one representation. CSV and XML
+// use the JSON field names so every format describes the same fields.
+type ResponseEncoder interface {
+	ContentType() string
+	Encode(w io.Writer, root string, v any) error
+}
+
+var responseEncoders = map[string]ResponseEncoder{
+	"json": jsonEncoder{},
+	"csv":  csvEncoder{},
+	"xml":  xmlEncoder{},
+}
+
+// negotiateEncoder honors ?format= first and then the Accept header, in the
+// client's order of preference. JSON is the default.
+func negotiateEncoder(r *http.Request) (ResponseEncoder, bool) {
+	if f := r.URL.Query().Get("format"); f != "" {
+		enc, ok := responseEncoders[f]
+		return enc, ok
+	}
+	accept := r.Header.Get("Accept")
+	if accept == "" {
+		return jsonEncoder{}, true
+	}
+	for _, part := range strings.Split(accept, ",") {
+		mt, _, err := mime.ParseMediaType(strings.TrimSpace(part))
+		if err != nil {
+			continue
+		}
+		switch mt {
+		case "application/json", "application/*", "*/*":
+			return jsonEncoder{}, true
+		case "text/csv":
+			return csvEncoder{}, true
+		case "application/xml", "text/xml":
+			return xmlEncoder{}, true
+		}
+	}
+	return nil, false
+}
+
+// respond encodes v in the negotiated format. root names the XML document
+// element; lists are written as repeated <item> elements.
+func respond(w http.ResponseWriter, r *http.Request, root string, v any) {
+	enc, ok := negotiateEncoder(r)
+	if !ok {
+		http.Error(w, "supported formats are json, csv and xml", http.StatusNotAcceptable)
+		return
+	}
+	w.Header().Set("Content-Type", enc.ContentType())
+	w.Header().Add("Vary", "Accept")
+	enc.Encode(w, root, v)
+}
+
+type jsonEncoder struct{}
+
+func (jsonEncoder) ContentType() string { return "application/json" }
+
+func (jsonEncoder) Encode(w io.Writer, _ string, v any) error {
+	return json.NewEncoder(w).Encode(v)
+}
+
+// tabular is implemented by envelopes whose CSV form is just their rows,
+// such as Page.
+type tabular interface {
+	csvRows() any
+}
+
+type csvEncoder struct{}
+
+func (csvEncoder) ContentType() string { return "text/csv; charset=utf-8" }
+
+// Encode writes one row per element, or a single row for a non-list value.
+// Nested values that don't fit a cell are written as JSON.
+func (csvEncoder) Encode(w io.Writer, _ string, v any) error {
+	if t, ok := v.(tabular); ok {
+		v = t.csvRows()
+	}
+	rv := reflect.Indirect(reflect.ValueOf(v))
+	rowType := rv.Type()
+	var rows []reflect.Value
+	if rv.Kind() == reflect.Slice {
+		rowType = rowType.Elem()
+		for i := 0; i < rv.Len(); i++ {
+			rows = append(rows, reflect.Indirect(rv.Index(i)))
+		}
+	} else {
+		rows = []reflect.Value{rv}
+	}
+	if rowType.Kind() == reflect.Pointer {
+		rowType = rowType.Elem()
+	}
+	cw := csv.NewWriter(w)
+	cw.Write(fieldNames(reflect.New(rowType).Elem()))
+	for _, row := range rows {
+		var record []string
+		for _, f := range structFields(row) {
+			record = append(record, cellString(f.value))
+		}
+		cw.Write(record)
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+type xmlEncoder struct{}
+
+func (xmlEncoder) ContentType() string { return "application/xml; charset=utf-8" }
+
+func (xmlEncoder) Encode(w io.Writer, root string, v any) error {
+	io.WriteString(w, xml.Header)
+	enc := xml.NewEncoder(w)
+	if err := encodeXMLValue(enc, root, reflect.ValueOf(v)); err != nil {
+		return err
+	}
+	return enc.Flush()
+}
+
+func encodeXMLValue(enc *xml.Encoder, name string, v reflect.Value) error {
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	start := xml.StartElement{Name: xml.Name{Local: name}}
+	switch {
+	case v.Type() == reflect.TypeOf(time.Time{}) || v.Type() == reflect.TypeOf(json.RawMessage{}):
+		return enc.EncodeElement(cellString(v), start)
+	case v.Kind() == reflect.Struct:
+		if err := enc.EncodeToken(start); err != nil {
+			return err
+		}
+		for _, f := range structFields(v) {
+			if err := encodeXMLValue(enc, f.name, f.value); err != nil {
+				return err
+			}
+		}
+		return enc.EncodeToken(start.End())
+	case v.Kind() == reflect.Slice:
+		if err := enc.EncodeToken(start); err != nil {
+			return err
+		}
+		for i := 0; i < v.Len(); i++ {
+			if err := encodeXMLValue(enc, "item", v.Index(i)); err != nil {
+				return err
+			}
+		}
+		return enc.EncodeToken(start.End())
+	default:
+		return enc.EncodeElement(cellString(v), start)
+	}
+}
+
+type namedField struct {
+	name  string
+	value reflect.Value
+}
+
+// structFields lists exported fields under their JSON names, flattening
+// embedded structs the way encoding/json does and skipping "-" fields.
+func structFields(v reflect.Value) []namedField {
+	var out []namedField
+	if v.Kind() != reflect.Struct {
+		return []namedField{{"value", v}}
+	}
+	t := v.Type()
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		if !f.IsExported() {
+			continue
+		}
+		name, _, _ := strings.Cut(f.Tag.Get("json"), ",")
+		if name == "-" {
+			continue
+		}
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			out = append(out, structFields(v.Field(i))...)
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		out = append(out, namedField{name, v.Field(i)})
+	}
+	return out
+}
+
+func fieldNames(v reflect.Value) []string {
+	var names []string
+	for _, f := range structFields(v) {
+		names = append(names, f.name)
+	}
+	return names
+}
+
+func cellString(v reflect.Value) string {
+	for v.Kind() == reflect.Pointer || v.Kind() == reflect.Interface {
+		if v.IsNil() {
+			return ""
+		}
+		v = v.Elem()
+	}
+	if (v.Kind() == reflect.Slice || v.Kind() == reflect.Map) && v.IsNil() {
+		return ""
+	}
+	switch x := v.Interface().(type) {
+	case time.Time:
+		return x.Format(time.RFC3339)
+	case json.RawMessage:
+		return string(x)
+	case []string:
+		return strings.Join(x, "|")
+	}
+	switch v.Kind() {
+	case reflect.String:
+		return v.String()
+	case reflect.Bool:
+		return strconv.FormatBool(v.Bool())
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		return strconv.FormatInt(v.Int(), 10)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		return strconv.FormatUint(v.Uint(), 10)
+	case reflect.Float32, reflect.Float64:
+		return strconv.FormatFloat(v.Float(), 'f', -1, 64)
+	}
+	b, err := json.Marshal(v.Interface())
+	if err != nil {
+		return fmt.Sprint(v.Interface())
+	}
+	return string(b)
+}
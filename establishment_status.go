@@ -0,0 +1,139 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+
+	"github.com/lib/pq"
+)
+
+func newPreviewToken() (string, error) {
+	b := make([]byte, 24)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// establishmentVisible writes the appropriate error and returns false when the
+// establishment must not be shown publicly: drafts require their preview token
+// and suspended establishments are unavailable.
+func establishmentVisible(w http.ResponseWriter, r *http.Request, status, previewToken string) bool {
+	switch status {
+	case "published":
+		return true
+	case "draft":
+		if t := r.URL.Query().Get("preview_token"); t != "" && t == previewToken {
+			return true
+		}
+		http.NotFound(w, nil)
+		return false
+	default:
+		http.Error(w, "establishment suspended", http.StatusUnavailableForLegalReasons)
+		return false
+	}
+}
+
+func publishEstablishment(w http.ResponseWriter, db *sql.DB, id string) {
+	var name, address, phone, status string
+	var categories, products, cuisines int
+	err := db.QueryRow(
+		`SELECT e.name, COALESCE(e.address,''), COALESCE(e.phone,''), e.status,
+		   (SELECT COUNT(*) FROM product_categories c WHERE c.establishment_id=e.id),
+		   (SELECT COUNT(*) FROM products p WHERE p.establishment_id=e.id AND p.is_active AND p.price_cents > 0),
+		   (SELECT COUNT(*) FROM establishment_cuisines ec WHERE ec.establishment_id=e.id)
+		 FROM establishments e WHERE e.id=$1`, id,
+	).Scan(&name, &address, &phone, &status, &categories, &products, &cuisines)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, nil)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if status == "suspended" {
+		http.Error(w, "suspended establishments cannot be published", http.StatusConflict)
+		return
+	}
+
+	problems := []string{}
+	if name == "" {
+		problems = append(problems, "name is required")
+	}
+	if address == "" {
+		problems = append(problems, "address is required")
+	}
+	if phone == "" {
+		problems = append(problems, "phone is required")
+	}
+	if categories == 0 {
+		problems = append(problems, "at least one product category is required")
+	}
+	if products == 0 {
+		problems = append(problems, "at least one active product with a price is required")
+	}
+	if cuisines == 0 {
+		problems = append(problems, "at least one cuisine is required")
+	}
+	missingAlt, err := countMissingAltText(db, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if missingAlt > 0 {
+		problems = append(problems, fmt.Sprintf("%d images are missing alt text", missingAlt))
+	}
+	if len(problems) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string][]string{"problems": problems})
+		return
+	}
+
+	// Guarded again here: a suspension applied since the check above must
+	// not be overwritten.
+	res, err := db.Exec(`UPDATE establishments SET status='published', published_at=now(), updated_at=now() WHERE id=$1 AND status IN ('draft','published')`, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "suspended establishments cannot be published", http.StatusConflict)
+		return
+	}
+	responseCache.Invalidate(id, sitemapCacheGroup)
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// setEstablishmentStatus moves the establishment to status if it is in one
+// of the from statuses, and writes 409 otherwise. Suspensions are only lifted
+// by platform admins, back to draft, so owners can't unpublish their way out
+// of one.
+func setEstablishmentStatus(w http.ResponseWriter, db *sql.DB, id, status string, from ...string) {
+	var current string
+	err := db.QueryRow(`SELECT status FROM establishments WHERE id=$1`, id).Scan(&current)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, nil)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res, err := db.Exec(`UPDATE establishments SET status=$1, updated_at=now() WHERE id=$2 AND status = ANY($3)`, status, id, pq.Array(from))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "establishment is "+current, http.StatusConflict)
+		return
+	}
+	responseCache.Invalidate(id, sitemapCacheGroup)
+	w.WriteHeader(http.StatusNoContent)
+}
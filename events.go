@@ -0,0 +1,85 @@
+package main
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+const (
+	eventOrderCreated   = "order.created"
+	eventOrderAccepted  = "order.accepted"
+	eventOrderCancelled = "order.cancelled"
+	eventOrderDelivered = "order.delivered"
+	eventOrderMessage   = "order.message"
+	// eventOrderLate is enqueued once per order when it breaches its SLA.
+	eventOrderLate      = "order.late"
+	eventProductCreated = "product.created"
+	eventProductUpdated = "product.updated"
+	eventProductDeleted = "product.deleted"
+	eventStockChanged   = "stock.changed"
+	eventProductSoldOut = "product.sold_out"
+	// eventPrintJobsQueued goes to liveEvents only, to wake up printer agent
+	// streams.
+	eventPrintJobsQueued = "print_jobs.queued"
+)
+
+type Event struct {
+	Type            string    `json:"type"`
+	OrderID         string    `json:"order_id,omitempty"`
+	OrderNumber     int       `json:"order_number,omitempty"`
+	ProductID       string    `json:"product_id,omitempty"`
+	EstablishmentID string    `json:"establishment_id"`
+	Stock           *int      `json:"stock,omitempty"`
+	At              time.Time `json:"at"`
+}
+
+// EventBus dispatches in-process domain events to subscribers. Handlers run on
+// their own goroutine so publishers never wait on slow consumers.
+type EventBus struct {
+	mu       sync.RWMutex
+	nextID   int
+	handlers map[string]map[int]func(Event)
+}
+
+var events = &EventBus{handlers: map[string]map[int]func(Event){}}
+
+// Subscribe registers fn for eventType. The returned function removes the
+// subscription; long-lived subscribers can ignore it.
+func (b *EventBus) Subscribe(eventType string, fn func(Event)) (unsubscribe func()) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if b.handlers[eventType] == nil {
+		b.handlers[eventType] = map[int]func(Event){}
+	}
+	b.nextID++
+	id := b.nextID
+	b.handlers[eventType][id] = fn
+	return func() {
+		b.mu.Lock()
+		defer b.mu.Unlock()
+		delete(b.handlers[eventType], id)
+	}
+}
+
+func (b *EventBus) Publish(e Event) {
+	if e.At.IsZero() {
+		e.At = time.Now()
+	}
+	b.mu.RLock()
+	handlers := make([]func(Event), 0, len(b.handlers[e.Type]))
+	for _, fn := range b.handlers[e.Type] {
+		handlers = append(handlers, fn)
+	}
+	b.mu.RUnlock()
+	for _, fn := range handlers {
+		go func(fn func(Event)) {
+			defer func() {
+				if p := recover(); p != nil {
+					log.Printf("event %s handler panicked: %v", e.Type, p)
+				}
+			}()
+			fn(e)
+		}(fn)
+	}
+}
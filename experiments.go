@@ -0,0 +1,423 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/json"
+	"math"
+	"net/http"
+	"regexp"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Experiments A/B test a product's photo or description. The first variant
+// is the control; each variant may override image_key and description.
+// Visitors are bucketed by hashing the experiment id with their customer id,
+// or their session id when anonymous, so they keep seeing the same variant.
+// The storefront reports an experiment_exposure analytics event when it
+// shows a variant, and a session converts when it later adds the product to
+// the cart.
+
+const (
+	minExperimentVariants = 2
+	maxExperimentVariants = 4
+	// experimentSignificance is the p-value under which a variant's
+	// difference from the control is reported as significant.
+	experimentSignificance = 0.05
+)
+
+var experimentVariantKeyPattern = regexp.MustCompile(`^[A-Za-z0-9_-]{1,20}$`)
+
+type ExperimentVariant struct {
+	Key string `json:"key"`
+	// Weight is the variant's share of traffic relative to the others.
+	Weight      int     `json:"weight"`
+	ImageKey    *string `json:"image_key,omitempty"`
+	ImageURL    string  `json:"image_url,omitempty"`
+	Description *string `json:"description,omitempty"`
+}
+
+type Experiment struct {
+	ID              string              `json:"id"`
+	EstablishmentID string              `json:"establishment_id"`
+	ProductID       string              `json:"product_id"`
+	Name            string              `json:"name"`
+	Variants        []ExperimentVariant `json:"variants"`
+	// Status is draft, running or stopped. Variants can only change while
+	// draft, and a stopped experiment can't be restarted.
+	Status    string     `json:"status"`
+	StartedAt *time.Time `json:"started_at"`
+	StoppedAt *time.Time `json:"stopped_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+type ExperimentVariantResult struct {
+	Key            string  `json:"key"`
+	Exposures      int     `json:"exposures"`
+	Conversions    int     `json:"conversions"`
+	ConversionRate float64 `json:"conversion_rate"`
+	// Lift, ZScore and PValue compare the variant with the control, using
+	// a two-proportion z-test; they are omitted for the control itself.
+	Lift        *float64 `json:"lift,omitempty"`
+	ZScore      *float64 `json:"z_score,omitempty"`
+	PValue      *float64 `json:"p_value,omitempty"`
+	Significant bool     `json:"significant"`
+}
+
+type ExperimentResults struct {
+	Experiment
+	Results []ExperimentVariantResult `json:"results"`
+}
+
+// ExperimentAssignment is the variant a visitor sees for a running
+// experiment.
+type ExperimentAssignment struct {
+	ExperimentID string            `json:"experiment_id"`
+	ProductID    string            `json:"product_id"`
+	Variant      ExperimentVariant `json:"variant"`
+}
+
+// experimentsRoute serves /establishments/{id}/experiments. The assignments
+// sub-path is public; the rest is for managers.
+func experimentsRoute(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID, experimentID string) {
+	if experimentID == "assignments" && r.Method == http.MethodGet {
+		getExperimentAssignments(w, r, db, establishmentID)
+		return
+	}
+	authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) {
+		if !requireRole(w, r, db, establishmentID, "manager") {
+			return
+		}
+		switch {
+		case experimentID == "" && r.Method == http.MethodGet:
+			listExperiments(w, db, establishmentID)
+		case experimentID == "" && r.Method == http.MethodPost:
+			createExperiment(w, r, db, establishmentID)
+		case experimentID != "" && strings.HasSuffix(r.URL.Path, "/results") && r.Method == http.MethodGet:
+			getExperimentResults(w, db, establishmentID, experimentID)
+		case experimentID != "" && r.Method == http.MethodPut:
+			updateExperiment(w, r, db, establishmentID, experimentID)
+		case experimentID != "" && r.Method == http.MethodDelete:
+			res, err := db.Exec(`DELETE FROM experiments WHERE id::text=$1 AND establishment_id=$2 AND status<>'running'`, experimentID, establishmentID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				http.Error(w, "experiment not found or still running", http.StatusConflict)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})(w, r)
+}
+
+const experimentColumns = `id, establishment_id, product_id, name, variants, status, started_at, stopped_at, created_at`
+
+func scanExperiment(row interface{ Scan(...any) error }) (Experiment, error) {
+	var x Experiment
+	var variants []byte
+	if err := row.Scan(&x.ID, &x.EstablishmentID, &x.ProductID, &x.Name, &variants, &x.Status, &x.StartedAt, &x.StoppedAt, &x.CreatedAt); err != nil {
+		return x, err
+	}
+	if err := json.Unmarshal(variants, &x.Variants); err != nil {
+		return x, err
+	}
+	for i := range x.Variants {
+		if v := &x.Variants[i]; v.ImageKey != nil {
+			v.ImageURL = assetURL(*v.ImageKey)
+		}
+	}
+	return x, nil
+}
+
+func listExperiments(w http.ResponseWriter, db *sql.DB, establishmentID string) {
+	rows, err := db.Query(`SELECT `+experimentColumns+` FROM experiments WHERE establishment_id=$1 ORDER BY created_at DESC`, establishmentID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	list := []Experiment{}
+	for rows.Next() {
+		x, err := scanExperiment(rows)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		list = append(list, x)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// validateExperimentVariants checks keys are unique, defaults weights to 1
+// and sanitizes descriptions. Image keys must be product_image uploads.
+func validateExperimentVariants(db *sql.DB, variants []ExperimentVariant) string {
+	if len(variants) < minExperimentVariants || len(variants) > maxExperimentVariants {
+		return "an experiment needs between 2 and 4 variants"
+	}
+	var keys []string
+	for i := range variants {
+		v := &variants[i]
+		if !experimentVariantKeyPattern.MatchString(v.Key) || slices.Contains(keys, v.Key) {
+			return "variant keys must be unique and have up to 20 letters, digits, hyphens or underscores"
+		}
+		keys = append(keys, v.Key)
+		if v.Weight == 0 {
+			v.Weight = 1
+		}
+		if v.Weight < 1 || v.Weight > 100 {
+			return "variant weights must be between 1 and 100"
+		}
+		if v.Description != nil {
+			sanitizeFields(v.Description)
+		}
+		if v.ImageKey != nil {
+			var ok bool
+			err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM uploads WHERE key=$1 AND purpose='product_image' AND scan_status IN ('pending','clean'))`, *v.ImageKey).Scan(&ok)
+			if err != nil || !ok {
+				return "variant image_key must be a product_image upload"
+			}
+		}
+		v.ImageURL = ""
+	}
+	return ""
+}
+
+func createExperiment(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	var x Experiment
+	if err := json.NewDecoder(r.Body).Decode(&x); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if x.Name = sanitizeText(x.Name); x.Name == "" || len(x.Name) > 100 {
+		http.Error(w, "name must have between 1 and 100 characters", http.StatusUnprocessableEntity)
+		return
+	}
+	var ok bool
+	if err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM products WHERE id::text=$1 AND establishment_id=$2)`, x.ProductID, establishmentID).Scan(&ok); err != nil || !ok {
+		http.Error(w, "product not found", http.StatusUnprocessableEntity)
+		return
+	}
+	if msg := validateExperimentVariants(db, x.Variants); msg != "" {
+		http.Error(w, msg, http.StatusUnprocessableEntity)
+		return
+	}
+	variants, _ := json.Marshal(x.Variants)
+	x, err := scanExperiment(db.QueryRow(
+		`INSERT INTO experiments (establishment_id, product_id, name, variants) VALUES ($1,$2,$3,$4) RETURNING `+experimentColumns,
+		establishmentID, x.ProductID, x.Name, variants,
+	))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(x)
+}
+
+// updateExperiment renames a draft or replaces its variants, and moves the
+// status forward: draft to running to stopped. Only one experiment can run
+// per product at a time.
+func updateExperiment(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID, experimentID string) {
+	var req struct {
+		Name     string              `json:"name"`
+		Variants []ExperimentVariant `json:"variants"`
+		Status   string              `json:"status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	x, err := scanExperiment(db.QueryRow(`SELECT `+experimentColumns+` FROM experiments WHERE id::text=$1 AND establishment_id=$2`, experimentID, establishmentID))
+	if err == sql.ErrNoRows {
+		http.NotFound(w, nil)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if req.Name != "" {
+		if x.Name = sanitizeText(req.Name); x.Name == "" || len(x.Name) > 100 {
+			http.Error(w, "name must have between 1 and 100 characters", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	if req.Variants != nil {
+		if x.Status != "draft" {
+			http.Error(w, "variants can only change before the experiment starts", http.StatusConflict)
+			return
+		}
+		if msg := validateExperimentVariants(db, req.Variants); msg != "" {
+			http.Error(w, msg, http.StatusUnprocessableEntity)
+			return
+		}
+		x.Variants = req.Variants
+	}
+	switch {
+	case req.Status == "" || req.Status == x.Status:
+	case req.Status == "running" && x.Status == "draft", req.Status == "stopped" && x.Status == "running":
+	default:
+		http.Error(w, "status can only go from draft to running to stopped", http.StatusConflict)
+		return
+	}
+	variants, _ := json.Marshal(x.Variants)
+	x, err = scanExperiment(db.QueryRow(
+		`UPDATE experiments SET name=$3, variants=$4, status=COALESCE(NULLIF($5,''), status),
+		   started_at=CASE WHEN $5='running' THEN now() ELSE started_at END,
+		   stopped_at=CASE WHEN $5='stopped' THEN now() ELSE stopped_at END
+		 WHERE id=$1 AND establishment_id=$2 RETURNING `+experimentColumns,
+		x.ID, establishmentID, x.Name, variants, req.Status,
+	))
+	if isUniqueViolation(err) {
+		http.Error(w, "another experiment is already running for this product", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(x)
+}
+
+// experimentBucket picks the subject's variant, proportionally to weight.
+func experimentBucket(experimentID, subject string, variants []ExperimentVariant) ExperimentVariant {
+	sum := sha256.Sum256([]byte(experimentID + ":" + subject))
+	total := 0
+	for _, v := range variants {
+		total += v.Weight
+	}
+	n := int(binary.BigEndian.Uint64(sum[:8]) % uint64(total))
+	for _, v := range variants {
+		if n < v.Weight {
+			return v
+		}
+		n -= v.Weight
+	}
+	return variants[0]
+}
+
+// getExperimentAssignments returns the visitor's variant for each running
+// experiment of the establishment. A customer token buckets by customer, so
+// the variant follows them across devices; otherwise session_id is used.
+func getExperimentAssignments(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	subject := "session:" + r.URL.Query().Get("session_id")
+	if raw, ok := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer "); ok {
+		if c, err := parseJWT(raw); err == nil && c.Typ == "customer" {
+			subject = "customer:" + c.Sub
+		}
+	}
+	if subject == "session:" {
+		http.Error(w, "session_id is required without a customer token", http.StatusBadRequest)
+		return
+	}
+	rows, err := db.Query(`SELECT `+experimentColumns+` FROM experiments WHERE establishment_id::text=$1 AND status='running'`, establishmentID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	list := []ExperimentAssignment{}
+	for rows.Next() {
+		x, err := scanExperiment(rows)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		list = append(list, ExperimentAssignment{ExperimentID: x.ID, ProductID: x.ProductID, Variant: experimentBucket(x.ID, subject, x.Variants)})
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "private, no-store")
+	json.NewEncoder(w).Encode(list)
+}
+
+// getExperimentResults counts, per variant, the sessions exposed and those
+// that added the product to the cart after their first exposure.
+func getExperimentResults(w http.ResponseWriter, db *sql.DB, establishmentID, experimentID string) {
+	x, err := scanExperiment(db.QueryRow(`SELECT `+experimentColumns+` FROM experiments WHERE id::text=$1 AND establishment_id=$2`, experimentID, establishmentID))
+	if err == sql.ErrNoRows {
+		http.NotFound(w, nil)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rows, err := db.Query(
+		`WITH exposed AS (
+		   SELECT variant, session_hash, MIN(occurred_at) AS at FROM analytics_events
+		   WHERE experiment_id=$1 AND kind='experiment_exposure' AND session_hash<>''
+		   GROUP BY variant, session_hash)
+		 SELECT x.variant, COUNT(*), COUNT(*) FILTER (WHERE EXISTS (
+		   SELECT 1 FROM analytics_events a WHERE a.establishment_id=$2 AND a.product_id=$3 AND a.kind='add_to_cart'
+		   AND a.session_hash=x.session_hash AND a.occurred_at >= x.at))
+		 FROM exposed x GROUP BY x.variant`,
+		x.ID, establishmentID, x.ProductID,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	counts := map[string][2]int{}
+	for rows.Next() {
+		var key string
+		var c [2]int
+		if err := rows.Scan(&key, &c[0], &c[1]); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		counts[key] = c
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	res := ExperimentResults{Experiment: x, Results: []ExperimentVariantResult{}}
+	control := counts[x.Variants[0].Key]
+	for i, v := range x.Variants {
+		c := counts[v.Key]
+		vr := ExperimentVariantResult{Key: v.Key, Exposures: c[0], Conversions: c[1]}
+		if c[0] > 0 {
+			vr.ConversionRate = float64(c[1]) / float64(c[0])
+		}
+		if i > 0 {
+			compareWithControl(&vr, control)
+		}
+		res.Results = append(res.Results, vr)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(res)
+}
+
+// compareWithControl fills in the lift and a two-sided two-proportion
+// z-test against the control's exposures and conversions.
+func compareWithControl(vr *ExperimentVariantResult, control [2]int) {
+	n1, n2 := float64(control[0]), float64(vr.Exposures)
+	if n1 == 0 || n2 == 0 {
+		return
+	}
+	p1, p2 := float64(control[1])/n1, vr.ConversionRate
+	if p1 > 0 {
+		lift := (p2 - p1) / p1
+		vr.Lift = &lift
+	}
+	pooled := (float64(control[1]) + float64(vr.Conversions)) / (n1 + n2)
+	se := math.Sqrt(pooled * (1 - pooled) * (1/n1 + 1/n2))
+	if se == 0 {
+		return
+	}
+	z := (p2 - p1) / se
+	p := math.Erfc(math.Abs(z) / math.Sqrt2)
+	vr.ZScore, vr.PValue = &z, &p
+	vr.Significant = p < experimentSignificance
+}
@@ -0,0 +1,434 @@
+package main
+
+import (
+	"archive/zip"
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/csv"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Report exports cover ranges too large to generate within a request.
+// POST /reports/exports queues one in report_exports, a worker writes the
+// CSV or XLSX file to storage, and GET /reports/exports/{id} returns its
+// status and, once done, a download link valid for exportURLTTL.
+
+const (
+	exportPollEvery = 5 * time.Second
+	// exportStaleAfter requeues a running export whose worker died.
+	exportStaleAfter = 15 * time.Minute
+	exportURLTTL     = 15 * time.Minute
+	// exportRetention is how long a finished export can be downloaded.
+	exportRetention = 7 * 24 * time.Hour
+	// maxPendingExports throttles how many exports an establishment can
+	// have queued or running at once.
+	maxPendingExports = 3
+	maxExportDays     = 731
+	// maxExportAttempts gives up on an export that keeps failing.
+	maxExportAttempts = 3
+)
+
+var exportReports = map[string]func(db *sql.DB, x ReportExport) ([][]any, error){
+	"orders":  exportOrders,
+	"revenue": exportRevenue,
+}
+
+var exportContentTypes = map[string]string{
+	"csv":  "text/csv; charset=utf-8",
+	"xlsx": "application/vnd.openxmlformats-officedocument.spreadsheetml.sheet",
+}
+
+type ReportExport struct {
+	ID              string `json:"id"`
+	EstablishmentID string `json:"establishment_id"`
+	// Report is orders (one row per order, archived ones included) or
+	// revenue (one row per day).
+	Report string `json:"report"`
+	// Format is csv or xlsx.
+	Format string `json:"format"`
+	// From and To are calendar days in the establishment's timezone, To
+	// exclusive, like the synchronous reports.
+	From        string     `json:"from"`
+	To          string     `json:"to"`
+	Status      string     `json:"status"`
+	Error       string     `json:"error,omitempty"`
+	DownloadURL string     `json:"download_url,omitempty"`
+	CreatedAt   time.Time  `json:"created_at"`
+	FinishedAt  *time.Time `json:"finished_at"`
+	ExpiresAt   *time.Time `json:"expires_at"`
+}
+
+// reportExportsHandler serves POST /reports/exports and
+// GET /reports/exports/{id}.
+func reportExportsHandler(db *sql.DB) http.HandlerFunc {
+	return authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) {
+		id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/reports/exports"), "/")
+		switch {
+		case id == "" && r.Method == http.MethodPost:
+			createReportExport(w, r, db)
+		case id != "" && r.Method == http.MethodGet:
+			getReportExport(w, r, db, id)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func createReportExport(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var x ReportExport
+	if err := json.NewDecoder(r.Body).Decode(&x); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if x.EstablishmentID == "" {
+		http.Error(w, "establishment_id is required", http.StatusUnprocessableEntity)
+		return
+	}
+	if !requireRole(w, r, db, x.EstablishmentID, "manager") {
+		return
+	}
+	if exportReports[x.Report] == nil {
+		http.Error(w, "report must be orders or revenue", http.StatusUnprocessableEntity)
+		return
+	}
+	if x.Format == "" {
+		x.Format = "csv"
+	}
+	if exportContentTypes[x.Format] == "" {
+		http.Error(w, "format must be csv or xlsx", http.StatusUnprocessableEntity)
+		return
+	}
+	from, err := time.Parse(time.DateOnly, x.From)
+	if err != nil {
+		http.Error(w, "from must be a date (YYYY-MM-DD)", http.StatusUnprocessableEntity)
+		return
+	}
+	to, err := time.Parse(time.DateOnly, x.To)
+	if err != nil {
+		http.Error(w, "to must be a date (YYYY-MM-DD)", http.StatusUnprocessableEntity)
+		return
+	}
+	if days := int(to.Sub(from).Hours() / 24); days < 1 || days > maxExportDays {
+		http.Error(w, fmt.Sprintf("the range must cover between 1 and %d days", maxExportDays), http.StatusUnprocessableEntity)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	// Locking the establishment serializes concurrent requests, so the
+	// pending count below can't be raced past the limit.
+	if _, err := tx.Exec(`SELECT 1 FROM establishments WHERE id=$1 FOR UPDATE`, x.EstablishmentID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var pending int
+	err = tx.QueryRow(
+		`SELECT COUNT(*) FROM report_exports WHERE establishment_id=$1 AND status IN ('queued','running')`,
+		x.EstablishmentID,
+	).Scan(&pending)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if pending >= maxPendingExports {
+		w.Header().Set("Retry-After", strconv.Itoa(int(exportPollEvery.Seconds())*6))
+		http.Error(w, "too many exports in progress for this establishment, try again when they finish", http.StatusTooManyRequests)
+		return
+	}
+	err = tx.QueryRow(
+		`INSERT INTO report_exports (establishment_id, requested_by, report, format, from_day, to_day)
+		 VALUES ($1,$2,$3,$4,$5,$6) RETURNING id, status, created_at`,
+		x.EstablishmentID, currentClaims(r).Sub, x.Report, x.Format, x.From, x.To,
+	).Scan(&x.ID, &x.Status, &x.CreatedAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := recordAudit(tx, r, x.EstablishmentID, "report.export_requested", "report_export", x.ID, x); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Location", "/reports/exports/"+x.ID)
+	w.WriteHeader(http.StatusAccepted)
+	json.NewEncoder(w).Encode(x)
+}
+
+func getReportExport(w http.ResponseWriter, r *http.Request, db *sql.DB, id string) {
+	var x ReportExport
+	var key string
+	err := db.QueryRow(
+		`SELECT id, establishment_id, report, format, from_day::text, to_day::text, status, COALESCE(error,''), COALESCE(storage_key,''), created_at, finished_at, expires_at
+		 FROM report_exports WHERE id::text=$1`,
+		id,
+	).Scan(&x.ID, &x.EstablishmentID, &x.Report, &x.Format, &x.From, &x.To, &x.Status, &x.Error, &key, &x.CreatedAt, &x.FinishedAt, &x.ExpiresAt)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, nil)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !requireRole(w, r, db, x.EstablishmentID, "manager") {
+		return
+	}
+	if x.Status == "done" {
+		if x.ExpiresAt != nil && time.Now().After(*x.ExpiresAt) {
+			x.Status = "expired"
+		} else if x.DownloadURL, err = storage.URL(key, exportURLTTL); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(x)
+}
+
+// startReportExporter generates queued exports one at a time. Several
+// instances can run it: jobs are claimed with SKIP LOCKED.
+func startReportExporter(db *sql.DB) {
+	go func() {
+		for {
+			for {
+				ok, err := runNextReportExport(db)
+				if err != nil {
+					log.Printf("report exports: %v", err)
+				}
+				if err != nil || !ok {
+					break
+				}
+			}
+			time.Sleep(exportPollEvery)
+		}
+	}()
+}
+
+// runNextReportExport claims the oldest queued export, or a running one
+// whose worker stopped, and generates it. It reports whether there was one.
+func runNextReportExport(db *sql.DB) (bool, error) {
+	var x ReportExport
+	var attempts int
+	err := db.QueryRow(
+		`UPDATE report_exports SET status='running', started_at=now(), attempts=attempts+1
+		 WHERE id = (SELECT id FROM report_exports
+		   WHERE status='queued' OR (status='running' AND started_at < $1)
+		   ORDER BY created_at LIMIT 1 FOR UPDATE SKIP LOCKED)
+		 RETURNING id, establishment_id, report, format, from_day::text, to_day::text, attempts`,
+		time.Now().Add(-exportStaleAfter),
+	).Scan(&x.ID, &x.EstablishmentID, &x.Report, &x.Format, &x.From, &x.To, &attempts)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	key, genErr := generateReportExport(db, x)
+	if genErr != nil {
+		status := "queued"
+		if attempts >= maxExportAttempts {
+			status = "failed"
+		}
+		_, err = db.Exec(
+			`UPDATE report_exports SET status=$2, error=$3, finished_at=CASE WHEN $2='failed' THEN now() END WHERE id=$1`,
+			x.ID, status, genErr.Error(),
+		)
+		if err != nil {
+			return true, err
+		}
+		return true, fmt.Errorf("export %s: %w", x.ID, genErr)
+	}
+	_, err = db.Exec(
+		`UPDATE report_exports SET status='done', storage_key=$2, error=NULL, finished_at=now(), expires_at=$3 WHERE id=$1`,
+		x.ID, key, time.Now().Add(exportRetention),
+	)
+	return true, err
+}
+
+// generateReportExport builds the file and stores it, returning its key.
+func generateReportExport(db *sql.DB, x ReportExport) (string, error) {
+	rows, err := exportReports[x.Report](db, x)
+	if err != nil {
+		return "", err
+	}
+	var data []byte
+	if x.Format == "xlsx" {
+		data, err = encodeXLSX(x.Report, rows)
+	} else {
+		data, err = encodeExportCSV(rows)
+	}
+	if err != nil {
+		return "", err
+	}
+	key := fmt.Sprintf("exports/%s/%s-%s_%s-%s.%s", x.EstablishmentID, x.ID, x.Report, x.From, x.To, x.Format)
+	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Minute)
+	defer cancel()
+	return key, storage.Put(ctx, key, exportContentTypes[x.Format], data)
+}
+
+// exportRange returns the export's days as UTC bounds for timestamps,
+// along with the establishment's location.
+func exportRange(db *sql.DB, x ReportExport) (time.Time, time.Time, *time.Location, error) {
+	loc, err := establishmentLocation(db, x.EstablishmentID)
+	if err != nil {
+		return time.Time{}, time.Time{}, nil, err
+	}
+	from, _ := time.Parse(time.DateOnly, x.From)
+	to, _ := time.Parse(time.DateOnly, x.To)
+	return localMidnightUTC(from, loc), localMidnightUTC(to, loc), loc, nil
+}
+
+func exportOrders(db *sql.DB, x ReportExport) ([][]any, error) {
+	from, to, loc, err := exportRange(db, x)
+	if err != nil {
+		return nil, err
+	}
+	const columns = `order_number, business_date::text, (ordered_at AT TIME ZONE 'UTC' AT TIME ZONE $4)::text, status, fulfillment_type, payment_method,
+	  COALESCE(coupon_code,''), total_cents, delivery_fee_cents, store_credit_cents, gift_card_cents, id::text`
+	rows, err := db.Query(
+		`SELECT `+columns+` FROM orders WHERE establishment_id=$1 AND ordered_at >= $2 AND ordered_at < $3
+		 UNION ALL
+		 SELECT `+columns+` FROM orders_archive WHERE establishment_id=$1 AND ordered_at >= $2 AND ordered_at < $3
+		 ORDER BY 3`,
+		x.EstablishmentID, from, to, loc.String(),
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := [][]any{{"order_number", "business_date", "ordered_at", "status", "fulfillment_type", "payment_method",
+		"coupon_code", "total_cents", "delivery_fee_cents", "store_credit_cents", "gift_card_cents", "order_id"}}
+	for rows.Next() {
+		var number int64
+		var day, at, status, fulfillment, payment, coupon, id string
+		var total, fee, credit, gift int64
+		if err := rows.Scan(&number, &day, &at, &status, &fulfillment, &payment, &coupon, &total, &fee, &credit, &gift, &id); err != nil {
+			return nil, err
+		}
+		out = append(out, []any{number, day, at, status, fulfillment, payment, coupon, total, fee, credit, gift, id})
+	}
+	return out, rows.Err()
+}
+
+// exportRevenue has one row per local day, adding the daily aggregates of
+// archived periods to the live orders, as revenueReport does.
+func exportRevenue(db *sql.DB, x ReportExport) ([][]any, error) {
+	from, to, _, err := exportRange(db, x)
+	if err != nil {
+		return nil, err
+	}
+	rows, err := db.Query(
+		`SELECT day::text, SUM(orders), SUM(completed_orders), SUM(revenue_cents) FROM (
+		   SELECT day, orders, completed_orders, revenue_cents FROM order_daily_aggregates
+		   WHERE establishment_id=$1 AND day >= $4::date AND day < $5::date
+		   UNION ALL
+		   SELECT (o.ordered_at AT TIME ZONE 'UTC' AT TIME ZONE e.timezone)::date, 1, (o.status='COMPLETED')::int,
+		     CASE WHEN o.status='COMPLETED' THEN o.total_cents ELSE 0 END
+		   FROM orders o JOIN establishments e ON e.id=o.establishment_id
+		   WHERE o.establishment_id=$1 AND o.ordered_at >= $2 AND o.ordered_at < $3) d
+		 GROUP BY day ORDER BY day`,
+		x.EstablishmentID, from, to, x.From, x.To,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	out := [][]any{{"day", "orders", "completed_orders", "revenue_cents"}}
+	for rows.Next() {
+		var day string
+		var orders, completed, revenue int64
+		if err := rows.Scan(&day, &orders, &completed, &revenue); err != nil {
+			return nil, err
+		}
+		out = append(out, []any{day, orders, completed, revenue})
+	}
+	return out, rows.Err()
+}
+
+func encodeExportCSV(rows [][]any) ([]byte, error) {
+	var buf bytes.Buffer
+	cw := csv.NewWriter(&buf)
+	for _, row := range rows {
+		record := make([]string, len(row))
+		for i, v := range row {
+			record[i] = fmt.Sprint(v)
+		}
+		if err := cw.Write(record); err != nil {
+			return nil, err
+		}
+	}
+	cw.Flush()
+	return buf.Bytes(), cw.Error()
+}
+
+// encodeXLSX writes a single-sheet workbook with the minimum parts Excel
+// and LibreOffice require. Strings are inline, so no shared string table is
+// needed; integers are numeric cells.
+func encodeXLSX(sheet string, rows [][]any) ([]byte, error) {
+	var body bytes.Buffer
+	body.WriteString(xml.Header + `<worksheet xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main"><sheetData>`)
+	for _, row := range rows {
+		body.WriteString(`<row>`)
+		for _, v := range row {
+			switch v := v.(type) {
+			case int64:
+				fmt.Fprintf(&body, `<c><v>%d</v></c>`, v)
+			default:
+				body.WriteString(`<c t="inlineStr"><is><t>`)
+				xml.EscapeText(&body, []byte(fmt.Sprint(v)))
+				body.WriteString(`</t></is></c>`)
+			}
+		}
+		body.WriteString(`</row>`)
+	}
+	body.WriteString(`</sheetData></worksheet>`)
+
+	parts := []struct{ name, data string }{
+		{"[Content_Types].xml", xml.Header + `<Types xmlns="http://schemas.openxmlformats.org/package/2006/content-types">` +
+			`<Default Extension="rels" ContentType="application/vnd.openxmlformats-package.relationships+xml"/>` +
+			`<Default Extension="xml" ContentType="application/xml"/>` +
+			`<Override PartName="/xl/workbook.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.sheet.main+xml"/>` +
+			`<Override PartName="/xl/worksheets/sheet1.xml" ContentType="application/vnd.openxmlformats-officedocument.spreadsheetml.worksheet+xml"/>` +
+			`</Types>`},
+		{"_rels/.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/officeDocument" Target="xl/workbook.xml"/>` +
+			`</Relationships>`},
+		{"xl/workbook.xml", xml.Header + `<workbook xmlns="http://schemas.openxmlformats.org/spreadsheetml/2006/main" xmlns:r="http://schemas.openxmlformats.org/officeDocument/2006/relationships">` +
+			`<sheets><sheet name="` + sheet + `" sheetId="1" r:id="rId1"/></sheets></workbook>`},
+		{"xl/_rels/workbook.xml.rels", xml.Header + `<Relationships xmlns="http://schemas.openxmlformats.org/package/2006/relationships">` +
+			`<Relationship Id="rId1" Type="http://schemas.openxmlformats.org/officeDocument/2006/relationships/worksheet" Target="worksheets/sheet1.xml"/>` +
+			`</Relationships>`},
+		{"xl/worksheets/sheet1.xml", body.String()},
+	}
+	var buf bytes.Buffer
+	zw := zip.NewWriter(&buf)
+	for _, p := range parts {
+		f, err := zw.Create(p.name)
+		if err != nil {
+			return nil, err
+		}
+		if _, err := f.Write([]byte(p.data)); err != nil {
+			return nil, err
+		}
+	}
+	if err := zw.Close(); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
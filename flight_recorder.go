@@ -0,0 +1,326 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// The flight recorder keeps the last requests and responses of
+// establishments that turned debug recording on, so support can see exactly
+// what an integration sent. Recording switches itself off at
+// debug_recording_until. Recordings live in memory on the instance that
+// served the request and are redacted before they are stored.
+
+const (
+	flightRecorderSize     = 200
+	flightRecorderMaxBody  = 16 << 10
+	flightRecorderMaxHours = 24
+)
+
+type RecordedExchange struct {
+	At             time.Time         `json:"at"`
+	Method         string            `json:"method"`
+	Path           string            `json:"path"`
+	Query          string            `json:"query"`
+	RequestHeader  map[string]string `json:"request_header"`
+	RequestBody    string            `json:"request_body"`
+	Status         int               `json:"status"`
+	ResponseHeader map[string]string `json:"response_header"`
+	ResponseBody   string            `json:"response_body"`
+	DurationMs     int64             `json:"duration_ms"`
+}
+
+type flightRecorder struct {
+	mu      sync.Mutex
+	until   map[string]time.Time
+	entries map[string][]RecordedExchange
+	next    map[string]int
+}
+
+var recorder = &flightRecorder{until: map[string]time.Time{}, entries: map[string][]RecordedExchange{}, next: map[string]int{}}
+
+func (f *flightRecorder) active(establishmentID string) bool {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	return time.Now().Before(f.until[establishmentID])
+}
+
+func (f *flightRecorder) setUntil(establishmentID string, until time.Time) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	if until.After(time.Now()) {
+		f.until[establishmentID] = until
+		return
+	}
+	delete(f.until, establishmentID)
+	delete(f.entries, establishmentID)
+	delete(f.next, establishmentID)
+}
+
+func (f *flightRecorder) add(establishmentID string, e RecordedExchange) {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ring := f.entries[establishmentID]
+	if len(ring) < flightRecorderSize {
+		f.entries[establishmentID] = append(ring, e)
+		return
+	}
+	ring[f.next[establishmentID]] = e
+	f.next[establishmentID] = (f.next[establishmentID] + 1) % flightRecorderSize
+}
+
+// recent returns the establishment's recordings, newest first.
+func (f *flightRecorder) recent(establishmentID string) []RecordedExchange {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	ring := f.entries[establishmentID]
+	out := make([]RecordedExchange, 0, len(ring))
+	start := f.next[establishmentID]
+	for i := len(ring) - 1; i >= 0; i-- {
+		out = append(out, ring[(start+i)%len(ring)])
+	}
+	return out
+}
+
+// startFlightRecorderSync reloads which establishments are recording, so
+// turning it on reaches every instance within a minute.
+func startFlightRecorderSync(db *sql.DB) {
+	go func() {
+		for {
+			if err := syncFlightRecorder(db); err != nil {
+				log.Printf("flight recorder sync: %v", err)
+			}
+			time.Sleep(30 * time.Second)
+		}
+	}()
+}
+
+func syncFlightRecorder(db *sql.DB) error {
+	rows, err := db.Query(`SELECT id, debug_recording_until FROM establishments WHERE debug_recording_until > now()`)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	active := map[string]time.Time{}
+	for rows.Next() {
+		var id string
+		var until time.Time
+		if err := rows.Scan(&id, &until); err != nil {
+			return err
+		}
+		active[id] = until
+	}
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	recorder.mu.Lock()
+	ids := make([]string, 0, len(recorder.until))
+	for id := range recorder.until {
+		ids = append(ids, id)
+	}
+	recorder.mu.Unlock()
+	for _, id := range ids {
+		if _, ok := active[id]; !ok {
+			recorder.setUntil(id, time.Time{})
+		}
+	}
+	for id, until := range active {
+		recorder.setUntil(id, until)
+	}
+	return nil
+}
+
+// requestEstablishment finds the establishment a request is about, from
+// /establishments/{id}/... or ?establishment_id=.
+func requestEstablishment(r *http.Request) string {
+	if rest, ok := strings.CutPrefix(r.URL.Path, "/establishments/"); ok {
+		id, _, _ := strings.Cut(rest, "/")
+		return id
+	}
+	return r.URL.Query().Get("establishment_id")
+}
+
+// withFlightRecorder records exchanges for establishments with recording
+// on. Everything else passes straight through.
+func withFlightRecorder(next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		establishmentID := requestEstablishment(r)
+		if establishmentID == "" || !recorder.active(establishmentID) {
+			next.ServeHTTP(w, r)
+			return
+		}
+		var reqBody []byte
+		if r.Body != nil {
+			reqBody, _ = io.ReadAll(io.LimitReader(r.Body, flightRecorderMaxBody))
+			r.Body = struct {
+				io.Reader
+				io.Closer
+			}{io.MultiReader(bytes.NewReader(reqBody), r.Body), r.Body}
+		}
+		rec := &cappedRecorder{ResponseWriter: w, status: http.StatusOK}
+		start := time.Now()
+		next.ServeHTTP(rec, r)
+		recorder.add(establishmentID, RecordedExchange{
+			At:             start,
+			Method:         r.Method,
+			Path:           r.URL.Path,
+			Query:          redactQuery(r.URL.Query()),
+			RequestHeader:  redactHeader(r.Header),
+			RequestBody:    redactBody(reqBody),
+			Status:         rec.status,
+			ResponseHeader: redactHeader(w.Header()),
+			ResponseBody:   redactBody(rec.body.Bytes()),
+			DurationMs:     time.Since(start).Milliseconds(),
+		})
+	})
+}
+
+// cappedRecorder keeps the first flightRecorderMaxBody bytes of a response
+// and still flushes, so event streams keep working while recorded.
+type cappedRecorder struct {
+	http.ResponseWriter
+	status int
+	body   bytes.Buffer
+}
+
+func (rw *cappedRecorder) WriteHeader(status int) {
+	rw.status = status
+	rw.ResponseWriter.WriteHeader(status)
+}
+
+func (rw *cappedRecorder) Write(b []byte) (int, error) {
+	if room := flightRecorderMaxBody - rw.body.Len(); room > 0 {
+		rw.body.Write(b[:min(room, len(b))])
+	}
+	return rw.ResponseWriter.Write(b)
+}
+
+func (rw *cappedRecorder) Flush() {
+	if f, ok := rw.ResponseWriter.(http.Flusher); ok {
+		f.Flush()
+	}
+}
+
+var (
+	// sensitiveKeys matches JSON fields and query parameters whose values
+	// are personal data or secrets.
+	sensitiveKeys  = regexp.MustCompile(`(?i)(password|token|secret|email|phone|whatsapp|cpf|cnpj|document|address|card|pix|(customer|recipient|holder)_?name|^code$|_code$|^lat$|^lng$)`)
+	sensitiveHeads = map[string]bool{"Authorization": true, "Cookie": true, "Set-Cookie": true, "X-Challenge-Token": true, "X-Signature": true}
+	emailPattern   = regexp.MustCompile(`[^\s"@]+@[^\s"@]+\.[^\s"@]+`)
+	phonePattern   = regexp.MustCompile(`\+\d{10,14}|\(\d{2}\)\s?\d{4,5}-?\d{4}`)
+)
+
+const redacted = "[redacted]"
+
+func redactHeader(h http.Header) map[string]string {
+	out := map[string]string{}
+	for k, v := range h {
+		if sensitiveHeads[k] {
+			out[k] = redacted
+		} else {
+			out[k] = strings.Join(v, ", ")
+		}
+	}
+	return out
+}
+
+func redactQuery(q url.Values) string {
+	for k := range q {
+		if sensitiveKeys.MatchString(k) {
+			q[k] = []string{redacted}
+		}
+	}
+	return q.Encode()
+}
+
+// redactBody blanks sensitive fields in JSON bodies. Other bodies only get
+// e-mail addresses and phone numbers masked.
+func redactBody(body []byte) string {
+	var v any
+	if json.Unmarshal(body, &v) == nil {
+		out, _ := json.Marshal(redactJSON(v))
+		return string(out)
+	}
+	s := emailPattern.ReplaceAllString(string(body), redacted)
+	return phonePattern.ReplaceAllString(s, redacted)
+}
+
+func redactJSON(v any) any {
+	switch v := v.(type) {
+	case map[string]any:
+		for k, item := range v {
+			if sensitiveKeys.MatchString(k) {
+				v[k] = redacted
+			} else {
+				v[k] = redactJSON(item)
+			}
+		}
+		return v
+	case []any:
+		for i, item := range v {
+			v[i] = redactJSON(item)
+		}
+		return v
+	case string:
+		return phonePattern.ReplaceAllString(emailPattern.ReplaceAllString(v, redacted), redacted)
+	default:
+		return v
+	}
+}
+
+// debugRecordingRoute lets owners turn recording on for up to
+// flightRecorderMaxHours (PUT {"hours": n}, 0 to stop) and read what was
+// recorded (GET).
+func debugRecordingRoute(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	if !requireRole(w, r, db, establishmentID, "owner") {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(recorder.recent(establishmentID))
+	case http.MethodPut:
+		var req struct {
+			Hours int `json:"hours"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Hours < 0 || req.Hours > flightRecorderMaxHours {
+			http.Error(w, "hours must be between 0 and 24", http.StatusUnprocessableEntity)
+			return
+		}
+		var until *time.Time
+		if req.Hours > 0 {
+			t := time.Now().Add(time.Duration(req.Hours) * time.Hour)
+			until = &t
+		}
+		if _, err := db.Exec(`UPDATE establishments SET debug_recording_until=$1 WHERE id=$2`, until, establishmentID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := recordAudit(db, r, establishmentID, "establishment.debug_recording_updated", "establishment", establishmentID, req); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if until != nil {
+			recorder.setUntil(establishmentID, *until)
+		} else {
+			recorder.setUntil(establishmentID, time.Time{})
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]any{"recording_until": until})
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
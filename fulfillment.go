@@ -0,0 +1,32 @@
+package main
+
+import "slices"
+
+var fulfillmentTypes = []string{"delivery", "pickup", "dine_in"}
+
+func validFulfillmentType(t string) bool {
+	return slices.Contains(fulfillmentTypes, t)
+}
+
+// normalizeFulfillmentTypes defaults an omitted list to every type and
+// rejects unknown or empty lists. Duplicates are removed.
+func normalizeFulfillmentTypes(types *[]string) string {
+	if *types == nil {
+		*types = fulfillmentTypes
+		return ""
+	}
+	out := []string{}
+	for _, t := range *types {
+		if !validFulfillmentType(t) {
+			return "fulfillment_types must contain only delivery, pickup or dine_in"
+		}
+		if !slices.Contains(out, t) {
+			out = append(out, t)
+		}
+	}
+	if len(out) == 0 {
+		return "fulfillment_types must not be empty"
+	}
+	*types = out
+	return ""
+}
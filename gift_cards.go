@@ -0,0 +1,439 @@
+package main
+
+import (
+	"crypto/rand"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"net/mail"
+	"strings"
+	"time"
+)
+
+const (
+	giftCardMinCents     = 10_00
+	giftCardMaxCents     = 2000_00
+	giftCardDefaultValid = 365 // days
+	// giftCardAlphabet leaves out 0/O and 1/I, which get mixed up when codes
+	// are typed from a printed card.
+	giftCardAlphabet = "ABCDEFGHJKLMNPQRSTUVWXYZ23456789"
+)
+
+// giftCardLookups limits balance checks per IP, so codes can't be guessed
+// by brute force through the public endpoint.
+var giftCardLookups = newWindowLimiter(time.Minute, 10)
+
+type GiftCard struct {
+	ID              string `json:"id"`
+	EstablishmentID string `json:"establishment_id"`
+	// Code is only shown once the card is active.
+	Code           string    `json:"code,omitempty"`
+	InitialCents   int64     `json:"initial_cents"`
+	BalanceCents   int64     `json:"balance_cents"`
+	ExpiresOn      string    `json:"expires_on"`
+	Status         string    `json:"status"` // pending_payment, active or disabled
+	RecipientName  string    `json:"recipient_name"`
+	RecipientEmail string    `json:"recipient_email"`
+	Message        string    `json:"message"`
+	CreatedAt      time.Time `json:"created_at"`
+	// Payment is only set in the purchase response.
+	Payment *Payment `json:"payment,omitempty"`
+}
+
+const giftCardColumns = `id, establishment_id, code, initial_cents, balance_cents, expires_on::text, status, recipient_name, recipient_email, message, created_at`
+
+func scanGiftCard(s interface{ Scan(...any) error }, g *GiftCard) error {
+	err := s.Scan(&g.ID, &g.EstablishmentID, &g.Code, &g.InitialCents, &g.BalanceCents, &g.ExpiresOn, &g.Status, &g.RecipientName, &g.RecipientEmail, &g.Message, &g.CreatedAt)
+	if g.Status != "active" {
+		g.Code = ""
+	}
+	return err
+}
+
+func newGiftCardCode() (string, error) {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		return "", err
+	}
+	var sb strings.Builder
+	for i, c := range b {
+		if i > 0 && i%4 == 0 {
+			sb.WriteByte('-')
+		}
+		sb.WriteByte(giftCardAlphabet[int(c)%len(giftCardAlphabet)])
+	}
+	return sb.String(), nil
+}
+
+// normalizeGiftCardCode accepts codes typed in lower case, with spaces or
+// without the dashes.
+func normalizeGiftCardCode(code string) string {
+	var raw []byte
+	for _, c := range strings.ToUpper(code) {
+		if strings.ContainsRune(giftCardAlphabet, c) {
+			raw = append(raw, byte(c))
+		}
+	}
+	var sb strings.Builder
+	for i, c := range raw {
+		if i > 0 && i%4 == 0 {
+			sb.WriteByte('-')
+		}
+		sb.WriteByte(c)
+	}
+	return sb.String()
+}
+
+type giftCardRequest struct {
+	ValueCents     int64  `json:"value_cents"`
+	ExpiresOn      string `json:"expires_on"`
+	RecipientName  string `json:"recipient_name"`
+	RecipientEmail string `json:"recipient_email"`
+	Message        string `json:"message"`
+	// PaymentMethod and PaymentToken are only used for purchases.
+	PaymentMethod string `json:"payment_method"`
+	PaymentToken  string `json:"payment_token"`
+}
+
+func (req *giftCardRequest) validate() error {
+	req.RecipientName = sanitizeText(req.RecipientName)
+	req.Message = sanitizeText(req.Message)
+	req.RecipientEmail = strings.ToLower(strings.TrimSpace(req.RecipientEmail))
+	if req.ValueCents < giftCardMinCents || req.ValueCents > giftCardMaxCents {
+		return fmt.Errorf("value_cents must be between %d and %d", giftCardMinCents, giftCardMaxCents)
+	}
+	if req.RecipientEmail != "" {
+		if _, err := mail.ParseAddress(req.RecipientEmail); err != nil {
+			return fmt.Errorf("recipient_email is invalid")
+		}
+	}
+	if len(req.Message) > 500 {
+		return fmt.Errorf("message is too long")
+	}
+	if req.ExpiresOn == "" {
+		req.ExpiresOn = time.Now().AddDate(0, 0, giftCardDefaultValid).Format("2006-01-02")
+	}
+	d, err := time.Parse("2006-01-02", req.ExpiresOn)
+	if err != nil {
+		return fmt.Errorf("expires_on must be YYYY-MM-DD")
+	}
+	if !d.After(time.Now()) {
+		return fmt.Errorf("expires_on must be in the future")
+	}
+	return nil
+}
+
+func giftCardsRoute(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID, cardID string) {
+	if cardID == "purchase" && r.Method == http.MethodPost {
+		authenticateCustomer(db, func(w http.ResponseWriter, r *http.Request) { purchaseGiftCard(w, r, db, establishmentID) })(w, r)
+		return
+	}
+	authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) {
+		if !requireRole(w, r, db, establishmentID, "manager") {
+			return
+		}
+		switch {
+		case cardID == "" && r.Method == http.MethodGet:
+			listGiftCards(w, db, establishmentID)
+		case cardID == "" && r.Method == http.MethodPost:
+			issueGiftCard(w, r, db, establishmentID)
+		case cardID != "" && r.Method == http.MethodDelete:
+			disableGiftCard(w, r, db, establishmentID, cardID)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})(w, r)
+}
+
+func listGiftCards(w http.ResponseWriter, db *sql.DB, establishmentID string) {
+	rows, err := db.Query(`SELECT `+giftCardColumns+` FROM gift_cards WHERE establishment_id=$1 ORDER BY created_at DESC`, establishmentID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	list := []GiftCard{}
+	for rows.Next() {
+		var g GiftCard
+		if err := scanGiftCard(rows, &g); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		list = append(list, g)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// insertGiftCard creates the card with a fresh code, retrying on the rare
+// code collision.
+func insertGiftCard(db *sql.DB, establishmentID, status string, purchaserID *string, req *giftCardRequest) (*GiftCard, error) {
+	for attempt := 0; ; attempt++ {
+		code, err := newGiftCardCode()
+		if err != nil {
+			return nil, err
+		}
+		var g GiftCard
+		err = scanGiftCard(db.QueryRow(
+			`INSERT INTO gift_cards (establishment_id, code, initial_cents, balance_cents, expires_on, status, recipient_name, recipient_email, message, purchaser_customer_id)
+			 VALUES ($1,$2,$3,$3,$4,$5,$6,$7,$8,$9) RETURNING `+giftCardColumns,
+			establishmentID, code, req.ValueCents, req.ExpiresOn, status, req.RecipientName, req.RecipientEmail, req.Message, purchaserID,
+		), &g)
+		if isUniqueViolation(err) && attempt < 3 {
+			continue
+		}
+		if err != nil {
+			return nil, err
+		}
+		return &g, nil
+	}
+}
+
+// issueGiftCard lets the establishment hand out cards directly, e.g. sold at
+// the counter or given away; they are active immediately.
+func issueGiftCard(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	var req giftCardRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := req.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	g, err := insertGiftCard(db, establishmentID, "active", nil, &req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := recordAudit(db, r, establishmentID, "gift_card.issued", "gift_card", g.ID, map[string]any{"value_cents": g.InitialCents, "recipient_email": g.RecipientEmail}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if g.RecipientEmail != "" {
+		sendGiftCard(db, g.ID)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(g)
+}
+
+// purchaseGiftCard sells a card through the establishment's payment gateway.
+// The card stays pending_payment, with its code hidden, until the gateway
+// confirms the charge; then the code is emailed to the recipient, or to the
+// buyer when no recipient was given.
+func purchaseGiftCard(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	var req giftCardRequest
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if err := req.validate(); err != nil {
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return
+	}
+	if !prepaidMethods[req.PaymentMethod] {
+		http.Error(w, "payment_method must be pix or online_card", http.StatusUnprocessableEntity)
+		return
+	}
+	customerID := currentClaims(r).Sub
+	var gatewayName sql.NullString
+	var status, name, email string
+	err := db.QueryRow(
+		`SELECT e.payment_gateway, e.status, e.name, c.email FROM establishments e, customers c WHERE e.id=$1 AND c.id=$2`,
+		establishmentID, customerID,
+	).Scan(&gatewayName, &status, &name, &email)
+	if err == sql.ErrNoRows || (err == nil && status != "published") {
+		http.NotFound(w, nil)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	gw, ok, err := establishmentGateway(r.Context(), db, establishmentID, gatewayName.String)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !gatewayName.Valid || !ok {
+		http.Error(w, "this establishment doesn't sell gift cards online", http.StatusConflict)
+		return
+	}
+	if req.RecipientEmail == "" {
+		req.RecipientEmail = email
+	}
+
+	g, err := insertGiftCard(db, establishmentID, "pending_payment", &customerID, &req)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	g.Payment, err = runCharge(r.Context(), db, gatewayName.String, gw, "gift_card_id", Charge{
+		Reference:   g.ID,
+		Method:      req.PaymentMethod,
+		AmountCents: g.InitialCents,
+		Description: "Vale-presente " + name,
+		PayerEmail:  email,
+		SourceToken: req.PaymentToken,
+	})
+	if err != nil {
+		log.Printf("gift card %s payment: %v", g.ID, err)
+	}
+	if g.Payment != nil && g.Payment.Status == "paid" {
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+		if _, err := activateGiftCard(tx, g.ID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		g.Status = "active"
+		sendGiftCard(db, g.ID)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(g)
+}
+
+// activateGiftCard reports whether the card went from pending_payment to
+// active, so a repeated webhook doesn't send the code twice.
+func activateGiftCard(tx *sql.Tx, id string) (bool, error) {
+	res, err := tx.Exec(`UPDATE gift_cards SET status='active', updated_at=now() WHERE id=$1 AND status='pending_payment'`, id)
+	if err != nil {
+		return false, err
+	}
+	n, err := res.RowsAffected()
+	return n > 0, err
+}
+
+func sendGiftCard(db *sql.DB, id string) {
+	var g GiftCard
+	var establishment string
+	err := db.QueryRow(
+		`SELECT g.code, g.balance_cents, g.expires_on::text, g.recipient_name, g.recipient_email, g.message, e.name
+		 FROM gift_cards g JOIN establishments e ON e.id=g.establishment_id WHERE g.id=$1`,
+		id,
+	).Scan(&g.Code, &g.BalanceCents, &g.ExpiresOn, &g.RecipientName, &g.RecipientEmail, &g.Message, &establishment)
+	if err != nil {
+		log.Printf("gift card %s: %v", id, err)
+		return
+	}
+	if g.RecipientEmail == "" {
+		return
+	}
+	body := fmt.Sprintf("Olá %s,\n\nVocê recebeu um vale-presente de R$ %d,%02d para usar em %s.\n\nCódigo: %s\nVálido até: %s",
+		g.RecipientName, g.BalanceCents/100, g.BalanceCents%100, establishment, g.Code, g.ExpiresOn)
+	if g.Message != "" {
+		body += "\n\n" + g.Message
+	}
+	if err := mailer.Send(g.RecipientEmail, "Seu vale-presente de "+establishment, body); err != nil {
+		log.Printf("gift card %s: %v", id, err)
+	}
+}
+
+func disableGiftCard(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID, id string) {
+	res, err := db.Exec(`UPDATE gift_cards SET status='disabled', updated_at=now() WHERE id=$1 AND establishment_id=$2`, id, establishmentID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.NotFound(w, nil)
+		return
+	}
+	if err := recordAudit(db, r, establishmentID, "gift_card.disabled", "gift_card", id, nil); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// giftCardBalanceHandler serves GET /gift_cards/{code} for whoever holds
+// the code; it needs no login.
+func giftCardBalanceHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !giftCardLookups.allow(clientIP(r)) {
+			http.Error(w, "too many requests", http.StatusTooManyRequests)
+			return
+		}
+		code := normalizeGiftCardCode(strings.TrimPrefix(r.URL.Path, "/gift_cards/"))
+		var g GiftCard
+		err := scanGiftCard(db.QueryRow(`SELECT `+giftCardColumns+` FROM gift_cards WHERE code=$1 AND status='active'`, code), &g)
+		if err == sql.ErrNoRows {
+			http.NotFound(w, nil)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		// The holder only needs the balance, not who the card was for.
+		g.RecipientName, g.RecipientEmail, g.Message = "", "", ""
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(g)
+	}
+}
+
+// redeemGiftCard takes up to amountDue from the card within the checkout
+// transaction. The row lock makes concurrent redemptions of the same card
+// queue up instead of spending the balance twice.
+func redeemGiftCard(tx *sql.Tx, o *Order, code string, amountDue int64) error {
+	if amountDue <= 0 {
+		return nil
+	}
+	var id string
+	var balance int64
+	err := tx.QueryRow(
+		`SELECT id, balance_cents FROM gift_cards
+		 WHERE code=$1 AND establishment_id=$2 AND status='active' AND expires_on >= current_date FOR UPDATE`,
+		normalizeGiftCardCode(code), o.EstablishmentID,
+	).Scan(&id, &balance)
+	if err == sql.ErrNoRows {
+		return &checkoutError{http.StatusUnprocessableEntity, "gift_card_invalid", "gift card is invalid or expired"}
+	}
+	if err != nil {
+		return err
+	}
+	if balance == 0 {
+		return &checkoutError{http.StatusUnprocessableEntity, "gift_card_empty", "gift card has no balance left"}
+	}
+	amount := min(balance, amountDue)
+	if _, err := tx.Exec(`UPDATE gift_cards SET balance_cents=balance_cents-$1, updated_at=now() WHERE id=$2`, amount, id); err != nil {
+		return err
+	}
+	if _, err := tx.Exec(`INSERT INTO gift_card_transactions (gift_card_id, order_id, amount_cents) VALUES ($1,$2,$3)`, id, o.ID, -amount); err != nil {
+		return err
+	}
+	o.GiftCardCents = amount
+	_, err = tx.Exec(`UPDATE orders SET gift_card_cents=$1 WHERE id=$2`, amount, o.ID)
+	return err
+}
+
+// restoreGiftCards puts back what a cancelled order took from gift cards.
+func restoreGiftCards(tx *sql.Tx, orderID string) error {
+	_, err := tx.Exec(
+		`WITH used AS (
+		   INSERT INTO gift_card_transactions (gift_card_id, order_id, amount_cents)
+		   SELECT gift_card_id, order_id, -SUM(amount_cents) FROM gift_card_transactions WHERE order_id=$1
+		   GROUP BY gift_card_id, order_id HAVING SUM(amount_cents) < 0
+		   RETURNING gift_card_id, amount_cents)
+		 UPDATE gift_cards g SET balance_cents=g.balance_cents+u.amount_cents, updated_at=now() FROM used u WHERE g.id=u.gift_card_id`,
+		orderID,
+	)
+	return err
+}
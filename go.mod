@@ -3,3 +3,7 @@ module cardapio-online-backend
 go 1.23.8
 
 require github.com/lib/pq v1.10.9
+
+require golang.org/x/crypto v0.36.0
+
+require github.com/rabbitmq/amqp091-go v1.15.0
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"sort"
+	"time"
+)
+
+const heatmapPeakCells = 5
+
+// HeatmapCell aggregates the orders placed in one local weekday/hour slot.
+// Prep time runs from acceptance to completion or delivery, since kitchens
+// don't report a separate "ready" step; it is nil when no order in the slot
+// got that far.
+type HeatmapCell struct {
+	Weekday         int      `json:"weekday"` // 0 = Sunday
+	Hour            int      `json:"hour"`
+	Orders          int      `json:"orders"`
+	AvgOrdersPerDay float64  `json:"avg_orders_per_day"`
+	RevenueCents    int64    `json:"revenue_cents"`
+	PrepP50Seconds  *float64 `json:"prep_p50_seconds"`
+	PrepP90Seconds  *float64 `json:"prep_p90_seconds"`
+}
+
+type HeatmapReport struct {
+	From     time.Time `json:"from"`
+	To       time.Time `json:"to"`
+	Timezone string    `json:"timezone"`
+	// Cells has all 168 weekday/hour slots, busiest or not; Peaks repeats the
+	// busiest ones by average orders per day.
+	Cells []HeatmapCell `json:"cells"`
+	Peaks []HeatmapCell `json:"peaks"`
+}
+
+// csvRows makes the CSV form the grid itself, one row per slot.
+func (h HeatmapReport) csvRows() any { return h.Cells }
+
+func heatmapReport(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	loc, err := establishmentLocation(db, establishmentID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	from, to, err := reportRange(r, loc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rows, err := db.Query(
+		`SELECT EXTRACT(DOW FROM local_at)::int, EXTRACT(HOUR FROM local_at)::int, COUNT(*), COALESCE(SUM(total_cents),0),
+		   percentile_cont(0.5) WITHIN GROUP (ORDER BY prep_seconds), percentile_cont(0.9) WITHIN GROUP (ORDER BY prep_seconds)
+		 FROM (
+		   SELECT o.ordered_at AT TIME ZONE 'UTC' AT TIME ZONE $4 AS local_at, o.total_cents,
+		     EXTRACT(EPOCH FROM COALESCE(o.completed_at, d.delivered_at) - o.processed_at) AS prep_seconds
+		   FROM orders o LEFT JOIN deliveries d ON d.order_id=o.id
+		   WHERE o.establishment_id=$1 AND o.status NOT IN ('CANCELLED','FAILED') AND o.ordered_at >= $2 AND o.ordered_at < $3) o
+		 GROUP BY 1, 2`,
+		establishmentID, from, to, loc.String(),
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	rep := HeatmapReport{From: from, To: to, Timezone: loc.String(), Cells: make([]HeatmapCell, 7*24)}
+	for i := range rep.Cells {
+		rep.Cells[i].Weekday, rep.Cells[i].Hour = i/24, i%24
+	}
+	for rows.Next() {
+		var c HeatmapCell
+		var p50, p90 sql.NullFloat64
+		if err := rows.Scan(&c.Weekday, &c.Hour, &c.Orders, &c.RevenueCents, &p50, &p90); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if p50.Valid {
+			c.PrepP50Seconds, c.PrepP90Seconds = &p50.Float64, &p90.Float64
+		}
+		rep.Cells[c.Weekday*24+c.Hour] = c
+	}
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Averages divide by how many times each weekday occurs in the range, so
+	// a range that starts mid-week doesn't skew the comparison.
+	var days [7]int
+	for d := from.In(loc); d.Before(to); d = d.AddDate(0, 0, 1) {
+		days[d.Weekday()]++
+	}
+	for i := range rep.Cells {
+		if n := days[rep.Cells[i].Weekday]; n > 0 {
+			rep.Cells[i].AvgOrdersPerDay = float64(rep.Cells[i].Orders) / float64(n)
+		}
+	}
+	rep.Peaks = []HeatmapCell{}
+	for _, c := range rep.Cells {
+		if c.Orders > 0 {
+			rep.Peaks = append(rep.Peaks, c)
+		}
+	}
+	sort.SliceStable(rep.Peaks, func(i, j int) bool { return rep.Peaks[i].AvgOrdersPerDay > rep.Peaks[j].AvgOrdersPerDay })
+	if len(rep.Peaks) > heatmapPeakCells {
+		rep.Peaks = rep.Peaks[:heatmapPeakCells]
+	}
+	respond(w, r, "heatmap_report", rep)
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"
+	"image/jpeg"
+	_ "image/png"
+)
+
+const (
+	maxImageSide   = 8000
+	maxImagePixels = 40_000_000
+	// jpegReencodeQuality is used when a JPEG has to be re-encoded to apply
+	// its EXIF orientation.
+	jpegReencodeQuality = 90
+)
+
+var errImageMalformed = errors.New("image is malformed")
+
+// minImageSize is the smallest accepted width and height per upload purpose.
+// Banners are wide by nature, so they only have a higher width minimum.
+var minImageSize = map[string][2]int{
+	"establishment_image":  {128, 128},
+	"establishment_banner": {600, 150},
+	"category_image":       {128, 128},
+	"category_banner":      {600, 150},
+	"product_image":        {128, 128},
+	"product_banner":       {600, 150},
+	"review_photo":         {320, 320},
+}
+
+// validateImage checks the image's dimensions for the upload purpose and that
+// it is small enough to decode safely.
+func validateImage(purpose, contentType string, data []byte) error {
+	w, h, err := imageDimensions(contentType, data)
+	if err != nil {
+		return err
+	}
+	if w > maxImageSide || h > maxImageSide || w*h > maxImagePixels {
+		return fmt.Errorf("image is %dx%d, larger than the %dpx / %d megapixel limit", w, h, maxImageSide, maxImagePixels/1_000_000)
+	}
+	if min := minImageSize[purpose]; w < min[0] || h < min[1] {
+		return fmt.Errorf("image is %dx%d, smaller than the %dx%d minimum for %s", w, h, min[0], min[1], purpose)
+	}
+	return nil
+}
+
+func imageDimensions(contentType string, data []byte) (int, int, error) {
+	if contentType == "image/webp" {
+		return webpDimensions(data)
+	}
+	cfg, _, err := image.DecodeConfig(bytes.NewReader(data))
+	if err != nil {
+		return 0, 0, errImageMalformed
+	}
+	return cfg.Width, cfg.Height, nil
+}
+
+// webpDimensions reads the canvas size from the first chunk of a WebP file,
+// which is enough without a full decoder.
+func webpDimensions(data []byte) (int, int, error) {
+	if len(data) < 30 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return 0, 0, errImageMalformed
+	}
+	chunk := data[20:]
+	switch string(data[12:16]) {
+	case "VP8X":
+		w := int(chunk[4]) | int(chunk[5])<<8 | int(chunk[6])<<16
+		h := int(chunk[7]) | int(chunk[8])<<8 | int(chunk[9])<<16
+		return w + 1, h + 1, nil
+	case "VP8 ":
+		if chunk[3] != 0x9d || chunk[4] != 0x01 || chunk[5] != 0x2a {
+			return 0, 0, errImageMalformed
+		}
+		return int(binary.LittleEndian.Uint16(chunk[6:]) & 0x3fff), int(binary.LittleEndian.Uint16(chunk[8:]) & 0x3fff), nil
+	case "VP8L":
+		if chunk[0] != 0x2f {
+			return 0, 0, errImageMalformed
+		}
+		bits := binary.LittleEndian.Uint32(chunk[1:])
+		return int(bits&0x3fff) + 1, int(bits>>14&0x3fff) + 1, nil
+	}
+	return 0, 0, errImageMalformed
+}
+
+// stripImageMetadata removes EXIF, XMP, IPTC and text metadata, which can
+// carry GPS coordinates and device details, without re-encoding the image.
+// JPEGs whose EXIF orientation isn't upright are re-encoded with the rotation
+// applied, since dropping the tag would otherwise display them sideways.
+func stripImageMetadata(contentType string, data []byte) ([]byte, error) {
+	switch contentType {
+	case "image/jpeg":
+		return stripJPEGMetadata(data)
+	case "image/png":
+		return stripPNGMetadata(data)
+	case "image/webp":
+		return stripWebPMetadata(data)
+	}
+	return data, nil
+}
+
+func stripJPEGMetadata(data []byte) ([]byte, error) {
+	if len(data) < 4 || data[0] != 0xff || data[1] != 0xd8 {
+		return nil, errImageMalformed
+	}
+	out := append(make([]byte, 0, len(data)), data[:2]...)
+	orientation := 1
+	for i := 2; i < len(data); {
+		if data[i] != 0xff || i+1 >= len(data) {
+			return nil, errImageMalformed
+		}
+		marker := data[i+1]
+		switch {
+		case marker == 0xff:
+			i++ // fill byte
+			continue
+		case marker == 0xda: // start of scan: the rest is image data
+			out = append(out, data[i:]...)
+			i = len(data)
+			continue
+		case marker == 0x01 || marker >= 0xd0 && marker <= 0xd7:
+			out = append(out, data[i:i+2]...)
+			i += 2
+			continue
+		}
+		if i+4 > len(data) {
+			return nil, errImageMalformed
+		}
+		end := i + 2 + int(binary.BigEndian.Uint16(data[i+2:]))
+		if end > len(data) {
+			return nil, errImageMalformed
+		}
+		segment := data[i:end]
+		switch marker {
+		case 0xe1: // APP1: EXIF or XMP
+			if o := exifOrientation(segment[4:]); o != 0 {
+				orientation = o
+			}
+		case 0xed, 0xfe: // APP13 (IPTC) and comments
+		default:
+			out = append(out, segment...)
+		}
+		i = end
+	}
+	if orientation > 1 && orientation <= 8 {
+		return orientJPEG(out, orientation)
+	}
+	return out, nil
+}
+
+// exifOrientation returns the orientation tag from an APP1 payload, or 0.
+func exifOrientation(payload []byte) int {
+	if len(payload) < 14 || string(payload[:6]) != "Exif\x00\x00" {
+		return 0
+	}
+	tiff := payload[6:]
+	var order binary.ByteOrder
+	switch string(tiff[:2]) {
+	case "II":
+		order = binary.LittleEndian
+	case "MM":
+		order = binary.BigEndian
+	default:
+		return 0
+	}
+	ifd := int(order.Uint32(tiff[4:]))
+	if ifd+2 > len(tiff) {
+		return 0
+	}
+	n := int(order.Uint16(tiff[ifd:]))
+	for e := ifd + 2; e+12 <= len(tiff) && n > 0; e, n = e+12, n-1 {
+		if order.Uint16(tiff[e:]) == 0x0112 {
+			return int(order.Uint16(tiff[e+8:]))
+		}
+	}
+	return 0
+}
+
+// orientJPEG re-encodes a JPEG with the EXIF orientation applied to pixels.
+func orientJPEG(data []byte, orientation int) ([]byte, error) {
+	src, err := jpeg.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errImageMalformed
+	}
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if orientation >= 5 {
+		dw, dh = h, w
+	}
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		for x := 0; x < dw; x++ {
+			var sx, sy int
+			switch orientation {
+			case 2:
+				sx, sy = w-1-x, y
+			case 3:
+				sx, sy = w-1-x, h-1-y
+			case 4:
+				sx, sy = x, h-1-y
+			case 5:
+				sx, sy = y, x
+			case 6:
+				sx, sy = y, h-1-x
+			case 7:
+				sx, sy = w-1-y, h-1-x
+			case 8:
+				sx, sy = w-1-y, x
+			}
+			dst.Set(x, y, src.At(b.Min.X+sx, b.Min.Y+sy))
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, dst, &jpeg.Options{Quality: jpegReencodeQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// errNoThumbnail is returned for formats the standard library can't decode
+// (WebP); callers fall back to the original image.
+var errNoThumbnail = errors.New("thumbnails are not supported for this format")
+
+// thumbnailJPEG scales the image down so its longer side is at most maxSide,
+// averaging each block of source pixels, and encodes it as JPEG. Smaller
+// images are only re-encoded.
+func thumbnailJPEG(contentType string, data []byte, maxSide int) ([]byte, error) {
+	if contentType == "image/webp" {
+		return nil, errNoThumbnail
+	}
+	src, _, err := image.Decode(bytes.NewReader(data))
+	if err != nil {
+		return nil, errImageMalformed
+	}
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dw, dh := w, h
+	if w > maxSide || h > maxSide {
+		if w >= h {
+			dw, dh = maxSide, max(1, h*maxSide/w)
+		} else {
+			dw, dh = max(1, w*maxSide/h), maxSide
+		}
+	}
+	var buf bytes.Buffer
+	if err := jpeg.Encode(&buf, resizeImage(src, dw, dh), &jpeg.Options{Quality: jpegReencodeQuality}); err != nil {
+		return nil, err
+	}
+	return buf.Bytes(), nil
+}
+
+// resizeImage scales src down to dw x dh, averaging each block of source
+// pixels.
+func resizeImage(src image.Image, dw, dh int) *image.RGBA {
+	b := src.Bounds()
+	w, h := b.Dx(), b.Dy()
+	dst := image.NewRGBA(image.Rect(0, 0, dw, dh))
+	for y := 0; y < dh; y++ {
+		y0, y1 := y*h/dh, max((y+1)*h/dh, y*h/dh+1)
+		for x := 0; x < dw; x++ {
+			x0, x1 := x*w/dw, max((x+1)*w/dw, x*w/dw+1)
+			var r, g, bl, a, n uint64
+			for sy := y0; sy < y1; sy++ {
+				for sx := x0; sx < x1; sx++ {
+					pr, pg, pb, pa := src.At(b.Min.X+sx, b.Min.Y+sy).RGBA()
+					r, g, bl, a, n = r+uint64(pr), g+uint64(pg), bl+uint64(pb), a+uint64(pa), n+1
+				}
+			}
+			i := dst.PixOffset(x, y)
+			dst.Pix[i], dst.Pix[i+1], dst.Pix[i+2], dst.Pix[i+3] = uint8(r/n>>8), uint8(g/n>>8), uint8(bl/n>>8), uint8(a/n>>8)
+		}
+	}
+	return dst
+}
+
+var pngMetadataChunks = map[string]bool{"eXIf": true, "tEXt": true, "zTXt": true, "iTXt": true, "tIME": true}
+
+func stripPNGMetadata(data []byte) ([]byte, error) {
+	if len(data) < 8 {
+		return nil, errImageMalformed
+	}
+	out := append(make([]byte, 0, len(data)), data[:8]...)
+	for i := 8; i < len(data); {
+		if i+12 > len(data) {
+			return nil, errImageMalformed
+		}
+		end := i + 12 + int(binary.BigEndian.Uint32(data[i:]))
+		if end > len(data) || end < i {
+			return nil, errImageMalformed
+		}
+		if !pngMetadataChunks[string(data[i+4:i+8])] {
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+	return out, nil
+}
+
+func stripWebPMetadata(data []byte) ([]byte, error) {
+	if len(data) < 12 || string(data[0:4]) != "RIFF" || string(data[8:12]) != "WEBP" {
+		return nil, errImageMalformed
+	}
+	out := append(make([]byte, 0, len(data)), data[:12]...)
+	flagsAt := -1
+	for i := 12; i < len(data); {
+		if i+8 > len(data) {
+			return nil, errImageMalformed
+		}
+		size := int(binary.LittleEndian.Uint32(data[i+4:]))
+		end := i + 8 + size + size%2
+		if end > len(data) || end < i {
+			return nil, errImageMalformed
+		}
+		switch fourCC := string(data[i : i+4]); fourCC {
+		case "EXIF", "XMP ":
+		default:
+			if fourCC == "VP8X" {
+				flagsAt = len(out) + 8
+			}
+			out = append(out, data[i:end]...)
+		}
+		i = end
+	}
+	if flagsAt >= 0 && flagsAt < len(out) {
+		out[flagsAt] &^= 0x08 | 0x04 // EXIF and XMP present flags
+	}
+	binary.LittleEndian.PutUint32(out[4:], uint32(len(out)-8))
+	return out, nil
+}
@@ -0,0 +1,236 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Platform admins (owners.platform_admin) can act as an owner for support.
+// The session is time-boxed, every request made with it is written to the
+// audit log with both identities, and the owner gets an e-mail summary once
+// it ends.
+
+const maxImpersonation = time.Hour
+
+// impersonationBlockedPaths can't be used while impersonating: they change
+// how the owner signs in or end the owner's sessions.
+var impersonationBlockedPaths = []string{"/auth/password", "/auth/email_change", "/auth/2fa/", "/auth/logout_all", "/auth/sessions", "/api_keys"}
+
+type Impersonation struct {
+	ID        string     `json:"id"`
+	AdminID   string     `json:"admin_id"`
+	OwnerID   string     `json:"owner_id"`
+	Reason    string     `json:"reason"`
+	StartedAt time.Time  `json:"started_at"`
+	ExpiresAt time.Time  `json:"expires_at"`
+	EndedAt   *time.Time `json:"ended_at"`
+}
+
+func impersonationsHandler(db *sql.DB) http.HandlerFunc {
+	return authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) {
+		id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/support/impersonations"), "/")
+		switch {
+		case id == "" && r.Method == http.MethodPost:
+			startImpersonation(w, r, db)
+		case id != "" && r.Method == http.MethodDelete:
+			endImpersonation(w, r, db, id)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func startImpersonation(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	c := currentClaims(r)
+	if c.Act != "" || c.KeyID != "" {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	if !requirePlatformAdmin(w, r, db) {
+		return
+	}
+	var req struct {
+		OwnerID string `json:"owner_id"`
+		Reason  string `json:"reason"`
+		Minutes int    `json:"minutes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Reason = sanitizeText(req.Reason)
+	if req.Reason == "" {
+		http.Error(w, "reason is required", http.StatusUnprocessableEntity)
+		return
+	}
+	if req.Minutes <= 0 || time.Duration(req.Minutes)*time.Minute > maxImpersonation {
+		http.Error(w, "minutes must be between 1 and 60", http.StatusUnprocessableEntity)
+		return
+	}
+	if req.OwnerID == c.Sub {
+		http.Error(w, "can't impersonate yourself", http.StatusUnprocessableEntity)
+		return
+	}
+
+	imp := Impersonation{AdminID: c.Sub, OwnerID: req.OwnerID, Reason: req.Reason}
+	err := db.QueryRow(
+		`INSERT INTO impersonations (admin_id, owner_id, reason, expires_at) VALUES ($1,$2,$3, now() + $4 * interval '1 minute')
+		 RETURNING id, started_at, expires_at`,
+		imp.AdminID, imp.OwnerID, imp.Reason, req.Minutes,
+	).Scan(&imp.ID, &imp.StartedAt, &imp.ExpiresAt)
+	if isForeignKeyViolation(err) {
+		http.Error(w, "owner not found", http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	// The session id is the token's jti, so ending the session revokes it.
+	token, err := signJWT(Claims{Sub: imp.OwnerID, Typ: "owner", Act: imp.AdminID, JTI: imp.ID, Iat: imp.StartedAt.Unix(), Exp: imp.ExpiresAt.Unix()})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := recordAudit(db, r, "", "impersonation.started", "owner", imp.OwnerID, imp); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(struct {
+		Impersonation
+		Token TokenResponse `json:"token"`
+	}{imp, TokenResponse{AccessToken: token, TokenType: "Bearer", ExpiresAt: imp.ExpiresAt}})
+}
+
+// requirePlatformAdmin writes 403 and returns false unless the request is
+// from a platform admin signed in as themselves.
+func requirePlatformAdmin(w http.ResponseWriter, r *http.Request, db *sql.DB) bool {
+	c := currentClaims(r)
+	var admin bool
+	if err := db.QueryRow(`SELECT platform_admin FROM owners WHERE id=$1`, c.Sub).Scan(&admin); err != nil && err != sql.ErrNoRows {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if !admin || c.Typ != "owner" || c.Act != "" {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+// endImpersonation closes a session early, either from the admin's own
+// login or from the impersonation token itself.
+func endImpersonation(w http.ResponseWriter, r *http.Request, db *sql.DB, id string) {
+	c := currentClaims(r)
+	adminID := c.Sub
+	if c.Act != "" {
+		adminID = c.Act
+	}
+	res, err := db.Exec(`UPDATE impersonations SET ended_at=now() WHERE id::text=$1 AND admin_id=$2 AND ended_at IS NULL`, id, adminID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.NotFound(w, nil)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// checkImpersonation runs for every request made with an impersonation
+// token: the session must still be open, sign-in settings are off limits,
+// and the request is audited under both identities.
+func checkImpersonation(w http.ResponseWriter, r *http.Request, db *sql.DB, c *Claims) bool {
+	var open bool
+	err := db.QueryRow(
+		`SELECT EXISTS(SELECT 1 FROM impersonations WHERE id::text=$1 AND ended_at IS NULL AND expires_at > now())`,
+		c.JTI,
+	).Scan(&open)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if !open {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return false
+	}
+	for _, p := range impersonationBlockedPaths {
+		if strings.HasPrefix(r.URL.Path, p) {
+			http.Error(w, "not allowed while impersonating", http.StatusForbidden)
+			return false
+		}
+	}
+	details := map[string]string{"method": r.Method, "path": r.URL.Path, "session_id": c.JTI}
+	if err := recordAudit(db, r, requestEstablishment(r), "impersonation.request", "owner", c.Sub, details); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	w.Header().Set("X-Impersonated-By", c.Act)
+	return true
+}
+
+// startImpersonationNotifier e-mails owners a summary of each support
+// session once it has ended or expired.
+func startImpersonationNotifier(db *sql.DB) {
+	go func() {
+		for {
+			if err := notifyEndedImpersonations(db); err != nil {
+				log.Printf("impersonation notifier: %v", err)
+			}
+			time.Sleep(time.Minute)
+		}
+	}()
+}
+
+func notifyEndedImpersonations(db *sql.DB) error {
+	rows, err := db.Query(
+		`SELECT i.id, o.email, a.name, i.reason, i.started_at, LEAST(COALESCE(i.ended_at, i.expires_at), i.expires_at),
+		   (SELECT COUNT(*) FROM audit_log WHERE impersonator_id IS NOT NULL AND details->>'session_id'=i.id::text)
+		 FROM impersonations i JOIN owners o ON o.id=i.owner_id JOIN owners a ON a.id=i.admin_id
+		 WHERE i.notified_at IS NULL AND (i.ended_at IS NOT NULL OR i.expires_at <= now())
+		 LIMIT 50`,
+	)
+	if err != nil {
+		return err
+	}
+	type ended struct {
+		id, email, admin, reason string
+		start, end               time.Time
+		requests                 int
+	}
+	var todo []ended
+	for rows.Next() {
+		var e ended
+		if err := rows.Scan(&e.id, &e.email, &e.admin, &e.reason, &e.start, &e.end, &e.requests); err != nil {
+			rows.Close()
+			return err
+		}
+		todo = append(todo, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	for _, e := range todo {
+		body := fmt.Sprintf(
+			"Nossa equipe de suporte (%s) acessou sua conta de %s a %s.\nMotivo: %s\nRequisições feitas: %d\n\nO registro completo está no log de auditoria.",
+			e.admin, e.start.Format("02/01/2006 15:04"), e.end.Format("15:04"), e.reason, e.requests,
+		)
+		if err := mailer.Send(e.email, "Acesso do suporte à sua conta", body); err != nil {
+			log.Printf("impersonation %s: %v", e.id, err)
+			continue
+		}
+		if _, err := db.Exec(`UPDATE impersonations SET notified_at=now() WHERE id=$1`, e.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
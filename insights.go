@@ -0,0 +1,227 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sort"
+	"time"
+)
+
+// trackingLimiter caps anonymous tracking calls per client IP.
+var trackingLimiter = newWindowLimiter(time.Minute, 120)
+
+type InsightPeriod struct {
+	PeriodStart  time.Time `json:"period_start"`
+	Views        int       `json:"views"`
+	AddToCarts   int       `json:"add_to_carts"`
+	Orders       int       `json:"orders"`
+	UnitsSold    int       `json:"units_sold"`
+	RevenueCents int64     `json:"revenue_cents"`
+	// AvgRating averages the reviews of orders containing the product; nil
+	// when there were none in the period.
+	AvgRating *float64 `json:"avg_rating"`
+	ratings   int
+}
+
+type ProductInsights struct {
+	ProductID      string          `json:"product_id"`
+	From           time.Time       `json:"from"`
+	To             time.Time       `json:"to"`
+	Views          int             `json:"views"`
+	AddToCarts     int             `json:"add_to_carts"`
+	AddToCartRate  float64         `json:"add_to_cart_rate"`
+	Orders         int             `json:"orders"`
+	UnitsSold      int             `json:"units_sold"`
+	ConversionRate float64         `json:"conversion_rate"`
+	RevenueCents   int64           `json:"revenue_cents"`
+	AvgRating      *float64        `json:"avg_rating"`
+	Series         []InsightPeriod `json:"series"`
+}
+
+// csvRows makes the CSV the time series, one row per period.
+func (p ProductInsights) csvRows() any { return p.Series }
+
+// trackProductEvent records a single view or add-to-cart for a product. It is
+// kept for simple clients; frontends should batch through /analytics/events.
+func trackProductEvent(w http.ResponseWriter, r *http.Request, db *sql.DB, productID string) {
+	if !trackingLimiter.allow(clientIP(r)) {
+		http.Error(w, "too many requests", http.StatusTooManyRequests)
+		return
+	}
+	var req struct {
+		Kind      string `json:"kind"`
+		SessionID string `json:"session_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Kind != "view" && req.Kind != "add_to_cart" {
+		http.Error(w, "kind must be view or add_to_cart", http.StatusUnprocessableEntity)
+		return
+	}
+	var establishmentID string
+	err := db.QueryRow(`SELECT establishment_id FROM products WHERE id::text=$1 AND is_active`, productID).Scan(&establishmentID)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, nil)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	kind := req.Kind
+	if kind == "view" {
+		kind = "product_view"
+	}
+	ev := AnalyticsEvent{Kind: kind, EstablishmentID: establishmentID, ProductID: productID}
+	if _, err := recordAnalyticsEvents(db, req.SessionID, []AnalyticsEvent{ev}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// productInsights reports a product's funnel and sales over ?from=&to=, in
+// ?period=day (default), week or month buckets of the establishment's
+// timezone. Conversion is orders containing the product per view.
+func productInsights(w http.ResponseWriter, r *http.Request, db *sql.DB, productID string) {
+	var establishmentID string
+	err := db.QueryRow(`SELECT establishment_id FROM products WHERE id=$1`, productID).Scan(&establishmentID)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, nil)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !requireRole(w, r, db, establishmentID, "manager") {
+		return
+	}
+	loc, err := establishmentLocation(db, establishmentID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	from, to, err := reportRange(r, loc)
+	if err != nil {
+		http.Error(w, "from/to must be YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+	period := r.URL.Query().Get("period")
+	if period == "" {
+		period = "day"
+	}
+	if period != "day" && period != "week" && period != "month" {
+		http.Error(w, "period must be day, week or month", http.StatusBadRequest)
+		return
+	}
+
+	byPeriod := map[time.Time]*InsightPeriod{}
+	bucket := func(t time.Time) *InsightPeriod {
+		if byPeriod[t] == nil {
+			byPeriod[t] = &InsightPeriod{PeriodStart: t}
+		}
+		return byPeriod[t]
+	}
+	args := []any{productID, period, from, to, loc.String()}
+	queries := []struct {
+		sql  string
+		scan func(*sql.Rows) error
+	}{
+		{
+			`SELECT date_trunc($2, occurred_at AT TIME ZONE 'UTC' AT TIME ZONE $5) AS p,
+			   COUNT(*) FILTER (WHERE kind='product_view'), COUNT(*) FILTER (WHERE kind='add_to_cart')
+			 FROM analytics_events WHERE product_id=$1 AND occurred_at >= $3 AND occurred_at < $4 GROUP BY p`,
+			func(rows *sql.Rows) error {
+				var t time.Time
+				var views, carts int
+				if err := rows.Scan(&t, &views, &carts); err != nil {
+					return err
+				}
+				b := bucket(t)
+				b.Views, b.AddToCarts = views, carts
+				return nil
+			},
+		},
+		{
+			`SELECT date_trunc($2, o.ordered_at AT TIME ZONE 'UTC' AT TIME ZONE $5) AS p, COUNT(*), SUM(i.quantity), SUM(i.total_price_cents)
+			 FROM order_items i JOIN orders o ON o.id=i.order_id
+			 WHERE i.product_id=$1 AND o.status NOT IN ('CANCELLED','FAILED') AND o.ordered_at >= $3 AND o.ordered_at < $4 GROUP BY p`,
+			func(rows *sql.Rows) error {
+				var t time.Time
+				var orders, units int
+				var revenue int64
+				if err := rows.Scan(&t, &orders, &units, &revenue); err != nil {
+					return err
+				}
+				b := bucket(t)
+				b.Orders, b.UnitsSold, b.RevenueCents = orders, units, revenue
+				return nil
+			},
+		},
+		{
+			`SELECT date_trunc($2, v.created_at AT TIME ZONE 'UTC' AT TIME ZONE $5) AS p, AVG(v.rating)::float8, COUNT(*)
+			 FROM reviews v JOIN order_items i ON i.order_id=v.order_id
+			 WHERE i.product_id=$1 AND v.created_at >= $3 AND v.created_at < $4 GROUP BY p`,
+			func(rows *sql.Rows) error {
+				var t time.Time
+				var avg float64
+				var n int
+				if err := rows.Scan(&t, &avg, &n); err != nil {
+					return err
+				}
+				b := bucket(t)
+				b.AvgRating, b.ratings = &avg, n
+				return nil
+			},
+		},
+	}
+	for _, q := range queries {
+		rows, err := db.Query(q.sql, args...)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		for rows.Next() {
+			if err := q.scan(rows); err != nil {
+				rows.Close()
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	ins := ProductInsights{ProductID: productID, From: from, To: to, Series: []InsightPeriod{}}
+	var ratingSum float64
+	var ratings int
+	for _, b := range byPeriod {
+		ins.Series = append(ins.Series, *b)
+		ins.Views += b.Views
+		ins.AddToCarts += b.AddToCarts
+		ins.Orders += b.Orders
+		ins.UnitsSold += b.UnitsSold
+		ins.RevenueCents += b.RevenueCents
+		if b.AvgRating != nil {
+			ratingSum += *b.AvgRating * float64(b.ratings)
+			ratings += b.ratings
+		}
+	}
+	sort.Slice(ins.Series, func(i, j int) bool { return ins.Series[i].PeriodStart.Before(ins.Series[j].PeriodStart) })
+	if ins.Views > 0 {
+		ins.AddToCartRate = float64(ins.AddToCarts) / float64(ins.Views)
+		ins.ConversionRate = float64(ins.Orders) / float64(ins.Views)
+	}
+	if ratings > 0 {
+		avg := ratingSum / float64(ratings)
+		ins.AvgRating = &avg
+	}
+	respond(w, r, "product_insights", ins)
+}
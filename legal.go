@@ -0,0 +1,238 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Terms of service and the privacy policy are versioned documents. Owners
+// must accept the current version of each before logging in, and customers
+// before placing an order; until then they get 451 with the documents
+// they're missing.
+
+const legalTokenTTL = 15 * time.Minute
+
+var legalKinds = []string{"terms", "privacy"}
+
+type LegalDocument struct {
+	Kind        string    `json:"kind"`
+	Version     int       `json:"version"`
+	Body        string    `json:"body,omitempty"`
+	PublishedAt time.Time `json:"published_at"`
+}
+
+// pendingLegalDocuments returns the current documents the account hasn't
+// accepted. typ is "owner" or "customer".
+func pendingLegalDocuments(db *sql.DB, typ, accountID string) ([]LegalDocument, error) {
+	column := "customer_id"
+	if typ == "owner" {
+		column = "owner_id"
+	}
+	rows, err := db.Query(
+		`SELECT d.kind, d.version, d.published_at FROM (
+		   SELECT DISTINCT ON (kind) kind, version, published_at FROM legal_documents
+		    WHERE published_at <= now()
+		    ORDER BY kind, version DESC
+		 ) d
+		 WHERE NOT EXISTS (SELECT 1 FROM legal_acceptances a WHERE a.`+column+`=$1 AND a.kind=d.kind AND a.version=d.version)
+		 ORDER BY d.kind`,
+		accountID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var pending []LegalDocument
+	for rows.Next() {
+		var d LegalDocument
+		if err := rows.Scan(&d.Kind, &d.Version, &d.PublishedAt); err != nil {
+			return nil, err
+		}
+		pending = append(pending, d)
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	return pending, nil
+}
+
+// requireLegalAcceptance writes 451 and returns false when documents are
+// pending. Owners, who have no session yet at login, get a short-lived
+// token that can only be used to accept.
+func requireLegalAcceptance(w http.ResponseWriter, r *http.Request, db *sql.DB, typ, accountID string) bool {
+	pending, err := pendingLegalDocuments(db, typ, accountID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if len(pending) == 0 {
+		return true
+	}
+	resp := map[string]any{
+		"error":     localize(r, "legal_acceptance_required", "the current terms must be accepted first"),
+		"code":      "legal_acceptance_required",
+		"documents": pending,
+	}
+	if typ == "owner" {
+		tok, err := issueToken(accountID, "legal", legalTokenTTL)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return false
+		}
+		resp["acceptance_token"] = tok.AccessToken
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnavailableForLegalReasons)
+	json.NewEncoder(w).Encode(resp)
+	return false
+}
+
+func legalHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, "/legal"), "/"), "/")
+		switch {
+		case parts[0] == "acceptances" && r.Method == http.MethodPost:
+			authenticate(db, func(w http.ResponseWriter, r *http.Request) { acceptLegalDocuments(w, r, db) })(w, r)
+		case len(parts) <= 2 && r.Method == http.MethodGet:
+			getLegalDocument(w, db, parts)
+		case len(parts) == 1 && r.Method == http.MethodPost:
+			authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { publishLegalDocument(w, r, db, parts[0]) })(w, r)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// getLegalDocument serves /legal/{kind} (the current version) or
+// /legal/{kind}/{version}.
+func getLegalDocument(w http.ResponseWriter, db *sql.DB, parts []string) {
+	version := 0
+	if len(parts) == 2 {
+		v, err := strconv.Atoi(parts[1])
+		if err != nil {
+			http.NotFound(w, nil)
+			return
+		}
+		version = v
+	}
+	var d LegalDocument
+	err := db.QueryRow(
+		`SELECT kind, version, body, published_at FROM legal_documents
+		 WHERE kind=$1 AND published_at <= now() AND ($2=0 OR version=$2)
+		 ORDER BY version DESC LIMIT 1`,
+		parts[0], version,
+	).Scan(&d.Kind, &d.Version, &d.Body, &d.PublishedAt)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, nil)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(d)
+}
+
+// publishLegalDocument adds the next version of a document; platform admins
+// only. published_at may be in the future to announce a change ahead of
+// time.
+func publishLegalDocument(w http.ResponseWriter, r *http.Request, db *sql.DB, kind string) {
+	if !requirePlatformAdmin(w, r, db) {
+		return
+	}
+	if !slices.Contains(legalKinds, kind) {
+		http.NotFound(w, nil)
+		return
+	}
+	var req struct {
+		Body        string     `json:"body"`
+		PublishedAt *time.Time `json:"published_at"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if strings.TrimSpace(req.Body) == "" {
+		http.Error(w, "body is required", http.StatusUnprocessableEntity)
+		return
+	}
+	d := LegalDocument{Kind: kind, Body: req.Body}
+	err := db.QueryRow(
+		`INSERT INTO legal_documents (kind, version, body, published_at)
+		 SELECT $1, COALESCE(MAX(version),0)+1, $2, COALESCE($3, now()) FROM legal_documents WHERE kind=$1
+		 RETURNING version, published_at`,
+		kind, req.Body, req.PublishedAt,
+	).Scan(&d.Version, &d.PublishedAt)
+	if isUniqueViolation(err) {
+		http.Error(w, "another version was published at the same time", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(d)
+}
+
+// acceptLegalDocuments records acceptance of the given versions. Owners can
+// use the token from the 451 login answer; afterwards they log in again.
+func acceptLegalDocuments(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	c := currentClaims(r)
+	column := map[string]string{"owner": "owner_id", "legal": "owner_id", "customer": "customer_id"}[c.Typ]
+	if column == "" || c.Act != "" {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	var req struct {
+		Documents []struct {
+			Kind    string `json:"kind"`
+			Version int    `json:"version"`
+		} `json:"documents"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Documents) == 0 {
+		http.Error(w, "documents must not be empty", http.StatusUnprocessableEntity)
+		return
+	}
+	var kinds []string
+	var versions []int64
+	for _, d := range req.Documents {
+		kinds = append(kinds, d.Kind)
+		versions = append(versions, int64(d.Version))
+	}
+	_, err := db.Exec(
+		`INSERT INTO legal_acceptances (kind, version, `+column+`, ip)
+		 SELECT d.kind, d.version, $3, $4 FROM legal_documents d
+		 JOIN unnest($1::text[], $2::int[]) AS a(kind, version) ON a.kind=d.kind AND a.version=d.version
+		 WHERE d.published_at <= now()
+		 ON CONFLICT DO NOTHING`,
+		pq.Array(kinds), pq.Array(versions), c.Sub, clientIP(r),
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	pending, err := pendingLegalDocuments(db, map[string]string{"owner_id": "owner", "customer_id": "customer"}[column], c.Sub)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if pending == nil {
+		pending = []LegalDocument{}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"pending": pending})
+}
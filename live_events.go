@@ -0,0 +1,241 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Domain events reach the events bus of the single instance whose outbox
+// relay picked them up, which is right for side effects but not for the
+// SSE streams and response caches every instance holds. Those subscribe to
+// liveEvents instead, which the relay fans out to all instances with
+// pg_notify as it delivers each live topic. Each instance LISTENs on
+// liveEventsChannel; while its listener connection is down it polls the
+// outbox for delivered live events instead, and after reconnecting it
+// catches up on what it missed the same way. A LiveBroker, when configured,
+// replaces pg_notify and LISTEN with the same fallback. Delivery is best
+// effort: streams send a snapshot when they connect, so a missed event only
+// delays an update.
+
+const (
+	liveEventsChannel = "live_events"
+	livePollEvery     = 2 * time.Second
+	// livePollBatch bounds one catch-up query.
+	livePollBatch = 500
+)
+
+// liveTopics are the outbox topics fanned out to every instance.
+var liveTopics = []string{
+	eventOrderCreated, eventOrderAccepted, eventOrderCancelled, eventOrderDelivered, eventOrderLate,
+	eventProductCreated, eventProductUpdated, eventProductDeleted, eventStockChanged, eventProductSoldOut,
+}
+
+// liveEvents carries events to per-instance subscribers on every instance.
+var liveEvents = &EventBus{handlers: map[string]map[int]func(Event){}}
+
+// LiveBroker fans live events out through an external pub/sub service in
+// place of LISTEN/NOTIFY, for deployments whose connection pooler cannot
+// hold a LISTEN session or that already run a broker.
+type LiveBroker interface {
+	Name() string
+	Publish(payload []byte) error
+	// Subscribe delivers every published payload to out until the
+	// connection is lost. It sends an empty payload once subscribed.
+	Subscribe(out chan<- []byte) error
+}
+
+// liveBroker is nil when instances talk through Postgres.
+var liveBroker LiveBroker
+
+// newLiveBrokerFromEnv picks the broker from LIVE_EVENTS_BROKER: "redis"
+// uses Redis pub/sub at REDIS_URL, "postgres" or empty uses LISTEN/NOTIFY.
+func newLiveBrokerFromEnv() LiveBroker {
+	switch os.Getenv("LIVE_EVENTS_BROKER") {
+	case "redis":
+		b, err := newRedisBroker(os.Getenv("REDIS_URL"))
+		if err != nil {
+			log.Printf("invalid REDIS_URL, falling back to LISTEN/NOTIFY: %v", err)
+			return nil
+		}
+		return b
+	case "", "postgres":
+		return nil
+	default:
+		log.Printf("unknown LIVE_EVENTS_BROKER %q, using LISTEN/NOTIFY", os.Getenv("LIVE_EVENTS_BROKER"))
+		return nil
+	}
+}
+
+// liveNotification is the pg_notify payload. ID is the outbox id, or 0 for
+// events that never went through the outbox.
+type liveNotification struct {
+	ID    int64 `json:"id"`
+	Event Event `json:"event"`
+}
+
+// notifyLive sends e to every instance's liveEvents once the caller's
+// transaction commits, or right away outside one. A broker does not take
+// part in the transaction and publishes right away; if the transaction then
+// rolls back the event is simply sent again.
+func notifyLive(q execer, outboxID int64, e Event) error {
+	if e.At.IsZero() {
+		e.At = time.Now()
+	}
+	payload, err := json.Marshal(liveNotification{ID: outboxID, Event: e})
+	if err != nil {
+		return err
+	}
+	if liveBroker != nil {
+		return liveBroker.Publish(payload)
+	}
+	_, err = q.Exec(`SELECT pg_notify($1, $2)`, liveEventsChannel, string(payload))
+	return err
+}
+
+func isLiveTopic(topic string) bool {
+	for _, t := range liveTopics {
+		if t == topic {
+			return true
+		}
+	}
+	return false
+}
+
+// startLiveEventBridge feeds liveEvents from the notifications, falling back
+// to polling the outbox while the listener is disconnected.
+func startLiveEventBridge(db *sql.DB, dbURL string) {
+	if liveBroker != nil {
+		startBrokerBridge(db, liveBroker)
+		return
+	}
+	listener := pq.NewListener(dbURL, time.Second, time.Minute, func(ev pq.ListenerEventType, err error) {
+		switch ev {
+		case pq.ListenerEventDisconnected:
+			log.Printf("live events: listener disconnected, polling: %v", err)
+		case pq.ListenerEventConnectionAttemptFailed:
+			log.Printf("live events: reconnect failed: %v", err)
+		case pq.ListenerEventReconnected:
+			log.Print("live events: listener reconnected")
+		}
+	})
+	if err := listener.Listen(liveEventsChannel); err != nil {
+		log.Printf("live events: listen: %v", err)
+	}
+	payloads := make(chan []byte, 64)
+	go func() {
+		for n := range listener.Notify {
+			if n == nil {
+				// The connection was re-established.
+				payloads <- nil
+				continue
+			}
+			payloads <- []byte(n.Extra)
+		}
+	}()
+	go runLiveEvents(db, payloads, listener.Ping)
+}
+
+// startBrokerBridge subscribes to b, resubscribing whenever the connection
+// drops.
+func startBrokerBridge(db *sql.DB, b LiveBroker) {
+	var subscribed atomic.Bool
+	payloads := make(chan []byte, 64)
+	relay := make(chan []byte, 64)
+	go func() {
+		for p := range relay {
+			if len(p) == 0 {
+				subscribed.Store(true)
+			}
+			payloads <- p
+		}
+	}()
+	go func() {
+		backoff := time.Second
+		for {
+			start := time.Now()
+			err := b.Subscribe(relay)
+			subscribed.Store(false)
+			if time.Since(start) > time.Minute {
+				backoff = time.Second
+			}
+			log.Printf("live events: %s subscription lost, polling: %v", b.Name(), err)
+			time.Sleep(backoff)
+			backoff = min(2*backoff, time.Minute)
+		}
+	}()
+	go runLiveEvents(db, payloads, func() error {
+		if !subscribed.Load() {
+			return fmt.Errorf("%s: not subscribed", b.Name())
+		}
+		return nil
+	})
+}
+
+// runLiveEvents publishes notification payloads on liveEvents. An empty
+// payload marks a (re)connection, after which the events sent while
+// disconnected are caught up from the outbox; while ping fails the outbox is
+// polled instead.
+func runLiveEvents(db *sql.DB, payloads <-chan []byte, ping func() error) {
+	var lastID int64
+	if err := db.QueryRow(`SELECT COALESCE(MAX(id), 0) FROM outbox`).Scan(&lastID); err != nil {
+		log.Printf("live events: %v", err)
+	}
+	ticker := time.NewTicker(livePollEvery)
+	defer ticker.Stop()
+	for {
+		select {
+		case p := <-payloads:
+			if len(p) == 0 {
+				lastID = pollLiveEvents(db, lastID)
+				continue
+			}
+			var ln liveNotification
+			if err := json.Unmarshal(p, &ln); err != nil {
+				log.Printf("live events: %v", err)
+				continue
+			}
+			lastID = max(lastID, ln.ID)
+			liveEvents.Publish(ln.Event)
+		case <-ticker.C:
+			if err := ping(); err != nil {
+				lastID = pollLiveEvents(db, lastID)
+			}
+		}
+	}
+}
+
+// pollLiveEvents publishes live events delivered after lastID and returns
+// the new high-water mark.
+func pollLiveEvents(db *sql.DB, lastID int64) int64 {
+	rows, err := db.Query(
+		`SELECT id, payload FROM outbox WHERE id > $1 AND delivered_at IS NOT NULL AND topic = ANY($2) ORDER BY id LIMIT $3`,
+		lastID, pq.Array(liveTopics), livePollBatch,
+	)
+	if err != nil {
+		log.Printf("live events: poll: %v", err)
+		return lastID
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var id int64
+		var payload []byte
+		if err := rows.Scan(&id, &payload); err != nil {
+			log.Printf("live events: poll: %v", err)
+			return lastID
+		}
+		lastID = id
+		var e Event
+		if err := json.Unmarshal(payload, &e); err != nil {
+			continue
+		}
+		liveEvents.Publish(e)
+	}
+	return lastID
+}
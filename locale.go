@@ -0,0 +1,80 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Timestamps are stored as UTC in TIMESTAMP columns; establishment timezones
+// only affect how calendar days and local times are interpreted.
+const defaultTimezone = "America/Sao_Paulo"
+
+func establishmentLocation(q queryer, establishmentID string) (*time.Location, error) {
+	var tz string
+	err := q.QueryRow(`SELECT timezone FROM establishments WHERE id=$1`, establishmentID).Scan(&tz)
+	if err == sql.ErrNoRows {
+		tz = defaultTimezone
+	} else if err != nil {
+		return nil, err
+	}
+	return time.LoadLocation(tz)
+}
+
+// localMidnightUTC returns the UTC instant at which the given calendar day
+// starts in loc.
+func localMidnightUTC(day time.Time, loc *time.Location) time.Time {
+	return time.Date(day.Year(), day.Month(), day.Day(), 0, 0, 0, 0, loc).UTC()
+}
+
+var errorMessages = map[string]map[string]string{
+	"pt-BR": {
+		"establishment_unavailable":   "o estabelecimento não está aceitando pedidos",
+		"customer_blocked":            "este estabelecimento não está aceitando pedidos deste cliente",
+		"customer_flagged":            "os pedidos deste cliente estão suspensos; entre em contato com o estabelecimento",
+		"invalid_quantity":            "a quantidade deve ser positiva",
+		"product_unavailable":         "um dos produtos não está disponível",
+		"fulfillment_type_invalid":    "o tipo de atendimento deve ser delivery, pickup ou dine_in",
+		"out_of_stock":                "um dos produtos está esgotado",
+		"product_not_fulfillable":     "um dos produtos não está disponível para este tipo de atendimento",
+		"coupon_invalid":              "cupom inválido ou expirado",
+		"coupon_exhausted":            "o cupom atingiu o limite de usos",
+		"payment_method_invalid":      "forma de pagamento inválida",
+		"payment_method_not_accepted": "o estabelecimento não aceita esta forma de pagamento",
+		"card_brand_not_accepted":     "a bandeira do cartão não é aceita",
+		"change_not_applicable":       "troco só se aplica a pagamentos em dinheiro",
+		"change_insufficient":         "o valor para troco deve cobrir o total do pedido",
+		"change_limit_exceeded":       "o troco solicitado excede o que o estabelecimento pode fornecer",
+		"delivery_address_required":   "informe o endereço de entrega",
+		"delivery_address_invalid":    "endereço de entrega não encontrado",
+		"delivery_location_unknown":   "não foi possível calcular a distância até o endereço de entrega",
+		"delivery_out_of_range":       "o endereço está fora da área de entrega",
+		"slot_unavailable":            "o horário de entrega selecionado está lotado ou fechado",
+		"legal_acceptance_required":   "é preciso aceitar a versão atual dos termos de uso e da política de privacidade",
+	},
+}
+
+// preferredLanguage picks pt-BR or en from Accept-Language, honoring the
+// client's order of preference and ignoring quality weights beyond that.
+func preferredLanguage(r *http.Request) string {
+	for _, part := range strings.Split(r.Header.Get("Accept-Language"), ",") {
+		tag, _, _ := strings.Cut(strings.TrimSpace(part), ";")
+		switch lang, _, _ := strings.Cut(strings.ToLower(tag), "-"); lang {
+		case "pt":
+			return "pt-BR"
+		case "en":
+			return "en"
+		}
+	}
+	return "en"
+}
+
+// localize returns the message for code in the request language, falling back
+// to the English message supplied by the caller.
+func localize(r *http.Request, code, fallback string) string {
+	if msg, ok := errorMessages[preferredLanguage(r)][code]; ok {
+		return msg
+	}
+	return fallback
+}
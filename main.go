@@ -1,30 +1,59 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
 	"log"
 	"net/http"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 
-	_ "github.com/lib/pq"
+	"github.com/lib/pq"
 )
 
+var httpClient = newHTTPClientFromEnv()
+
 type Establishment struct {
-	ID          string `json:"id,omitempty"`
-	Name        string `json:"name"`
-	Description string `json:"description"`
-	Address     string `json:"address"`
-	ImageKey    string `json:"image_key"`
-	BannerKey   string `json:"banner_key"`
-	Phone       string `json:"phone"`
+	ID              string  `json:"id,omitempty"`
+	Name            string  `json:"name"`
+	Description     string  `json:"description"`
+	DescriptionHTML string  `json:"description_html,omitempty"`
+	Address         string  `json:"address"`
+	ImageKey        string  `json:"image_key"`
+	BannerKey       string  `json:"banner_key"`
+	Phone           string  `json:"phone"`
+	Whatsapp        string  `json:"whatsapp"`
+	Instagram       string  `json:"instagram"`
+	Website         string  `json:"website"`
+	Email           string  `json:"email"`
+	CNPJ            string  `json:"cnpj"`
+	AddressDetails  Address `json:"address_details"`
+	Timezone        string  `json:"timezone"`
+	// Category is the establishment's kind of business in the directory,
+	// one of establishmentCategories.
+	Category string `json:"category"`
+	Status   string `json:"status"`
+	// Verified is set once a platform admin has checked the establishment's
+	// CNPJ and documents.
+	Verified     bool   `json:"verified"`
+	PreviewToken string `json:"preview_token,omitempty"`
 }
 type ProductCategory struct {
-	ID              string `json:"id,omitempty"`
-	EstablishmentID string `json:"establishment_id"`
-	Name            string `json:"name"`
-	Description     string `json:"description"`
+	ID              string  `json:"id,omitempty"`
+	EstablishmentID string  `json:"establishment_id"`
+	ParentID        *string `json:"parent_id"`
+	Name            string  `json:"name"`
+	Description     string  `json:"description"`
+	DescriptionHTML string  `json:"description_html,omitempty"`
+	ImageKey        string  `json:"image_key"`
+	// AltText describes the image for screen readers.
+	AltText   string `json:"alt_text"`
+	BannerKey string `json:"banner_key"`
+	ImageURL  string `json:"image_url,omitempty"`
+	BannerURL string `json:"banner_url,omitempty"`
 }
 
 type Product struct {
@@ -33,10 +62,29 @@ type Product struct {
 	CategoryID      *string `json:"category_id"`
 	Name            string  `json:"name"`
 	Description     string  `json:"description"`
+	DescriptionHTML string  `json:"description_html,omitempty"`
 	PriceCents      int     `json:"price_cents"`
 	ImageKey        string  `json:"image_key"`
-	BannerKey       string  `json:"banner_key"`
-	IsActive        bool    `json:"is_active"`
+	// AltText describes the image for screen readers. Active products need
+	// it before the establishment can be published.
+	AltText   string `json:"alt_text"`
+	BannerKey string `json:"banner_key"`
+	IsActive  bool   `json:"is_active"`
+	// FulfillmentTypes lists how the product can be served: delivery, pickup
+	// and/or dine_in.
+	FulfillmentTypes []string `json:"fulfillment_types"`
+	// Stock is nil when the product's stock isn't tracked.
+	Stock *int `json:"stock"`
+	// Barcode is the product's GTIN (EAN-8, UPC-A, EAN-13 or GTIN-14).
+	Barcode *string `json:"barcode"`
+	// CustomFields holds values for the establishment's custom fields, by
+	// key. Omitting it on update keeps the stored values.
+	CustomFields map[string]any `json:"custom_fields,omitempty"`
+	// Badges and MachineTranslated are only filled in the menu.
+	Badges            []ProductBadge `json:"badges,omitempty"`
+	MachineTranslated bool           `json:"machine_translated,omitempty"`
+	ImageURL          string         `json:"image_url,omitempty"`
+	BannerURL         string         `json:"banner_url,omitempty"`
 }
 
 func main() {
@@ -50,7 +98,107 @@ func main() {
 		log.Fatalf("failed to connect to database: %v", err)
 	}
 	defer db.Close()
+	if err := waitForDB(db); err != nil {
+		log.Fatalf("database not reachable: %v", err)
+	}
+	startDBMonitor(db)
+
+	if sandboxSchema = os.Getenv("SANDBOX_SCHEMA"); sandboxSchema != "" {
+		if sandboxDB, err = openSandboxDB(dbURL, sandboxSchema); err != nil {
+			log.Fatalf("failed to connect to the sandbox schema: %v", err)
+		}
+		defer sandboxDB.Close()
+	}
 
+	jwtSecret = []byte(os.Getenv("JWT_SECRET"))
+	if len(jwtSecret) == 0 {
+		log.Print("JWT_SECRET not set, using an insecure development secret")
+		jwtSecret = []byte("dev-secret")
+	}
+	if u := os.Getenv("APP_URL"); u != "" {
+		appBaseURL = u
+	}
+	mailer = newMailerFromEnv()
+	storage = newStorageFromEnv()
+	router = sandboxAwareRouter{newRouterFromEnv()}
+	responseCache = newResponseCacheFromEnv()
+	descriptionGenerator = newDescriptionGeneratorFromEnv()
+	imageModerator = newImageModeratorFromEnv()
+	virusScanner = newVirusScannerFromEnv()
+	liveBroker = newLiveBrokerFromEnv()
+	challengeVerifier = newChallengeVerifierFromEnv()
+	productDatabase = newProductDatabaseFromEnv()
+	keyWrapper = newKeyWrapperFromEnv()
+	riskProvider = newRiskProviderFromEnv()
+	translator = newTranslatorFromEnv()
+	registerPaymentGatewaysFromEnv()
+	if key := os.Getenv("STRIPE_SECRET_KEY"); key != "" {
+		if secret := os.Getenv("STRIPE_WEBHOOK_SECRET"); secret != "" {
+			disputeProviders["stripe"] = stripeDisputes{secretKey: key, webhookSecret: secret}
+		} else {
+			log.Print("STRIPE_WEBHOOK_SECRET not set, stripe disputes disabled")
+		}
+	}
+	if id := os.Getenv("GOOGLE_CLIENT_ID"); id != "" {
+		oauthProviders["google"] = googleProvider{clientID: id, clientSecret: os.Getenv("GOOGLE_CLIENT_SECRET")}
+	}
+
+	if b := newBrokerFromEnv(); b != nil {
+		publishers = append(publishers, b)
+	}
+	if u := os.Getenv("OUTBOX_WEBHOOK_URL"); u != "" {
+		publishers = append(publishers, webhookSink{url: u, secret: os.Getenv("OUTBOX_WEBHOOK_SECRET"), db: db})
+	}
+	events.Subscribe(eventOrderCreated, autoAcceptOrders(db))
+	events.Subscribe(eventOrderAccepted, queueOrderTickets(db))
+	events.Subscribe(eventOrderAccepted, autoDispatchOrders(context.Background(), db))
+	events.Subscribe(eventOrderDelivered, scheduleReviewRequests(db))
+	events.Subscribe(eventOrderLate, notifyOrderLate(db))
+	invalidateOnEvents()
+	touchCatalogOnEvents(db)
+	startOutboxRelay(db, publishers, true)
+	startLiveEventBridge(db, dbURL)
+	startAutoCanceller(db)
+	startSyncTombstonePruner(db)
+	startCampaignDispatcher(db)
+	startRefundProcessor(context.Background(), db)
+	startCourierLocationPurger(db)
+	startFlightRecorderSync(db)
+	startSecretRewrapper(db)
+	startImpersonationNotifier(db)
+	startReportExporter(db)
+	startBadgeRefresher(db)
+	startSLAMonitor(db)
+	startUploadSessionPurger(db)
+	startUploadScanner(db)
+	if months, _ := strconv.Atoi(os.Getenv("ORDER_RETENTION_MONTHS")); months > 0 {
+		startArchiver(db, months, os.Getenv("ORDER_ARCHIVE_EXPORT") == "true")
+	}
+	if sandboxDB != nil {
+		startSandboxWorkers(sandboxDB)
+	}
+
+	live := newMux(db)
+	live.HandleFunc("/api_keys", apiKeysHandler(db))
+	live.HandleFunc("/api_keys/", apiKeysHandler(db))
+	var sandbox http.Handler
+	if sandboxDB != nil {
+		m := newMux(sandboxDB)
+		m.HandleFunc("/sandbox/reset", sandboxResetHandler(sandboxDB))
+		sandbox = m
+	}
+	handler := withDBBreaker(withAPIVersions(withFlightRecorder(withAPIKeys(db, live, sandbox))))
+
+	addr := ":8080"
+	log.Printf("listening on %s", addr)
+	if err := http.ListenAndServe(addr, handler); err != nil {
+		log.Fatalf("server error: %v", err)
+	}
+}
+
+// newMux registers every route against db. main builds one for live data and,
+// when the sandbox is enabled, a second one over the sandbox schema.
+func newMux(db *sql.DB) *http.ServeMux {
 	mux := http.NewServeMux()
 	mux.HandleFunc("/establishments", establishmentsHandler(db))
 	mux.HandleFunc("/establishments/", establishmentHandler(db))
@@ -58,12 +206,60 @@ func main() {
 	mux.HandleFunc("/product_categories/", productCategoryHandler(db))
 	mux.HandleFunc("/products", productsHandler(db))
 	mux.HandleFunc("/products/", productHandler(db))
-
-	addr := ":8080"
-	log.Printf("listening on %s", addr)
-	if err := http.ListenAndServe(addr, mux); err != nil {
-		log.Fatalf("server error: %v", err)
+	mux.HandleFunc("/menu_templates", menuTemplatesHandler)
+	mux.HandleFunc("/orders", ordersHandler(db))
+	mux.HandleFunc("/orders/", orderHandler(db))
+	mux.HandleFunc("/order_events", orderEventsHandler(db))
+	mux.HandleFunc("/audit_log", auditLogHandler(db))
+	mux.HandleFunc("/support/impersonations", impersonationsHandler(db))
+	mux.HandleFunc("/support/impersonations/", impersonationsHandler(db))
+	mux.HandleFunc("/legal/", legalHandler(db))
+	mux.HandleFunc("/support/review_photos", reviewPhotoModerationHandler(db))
+	mux.HandleFunc("/support/review_photos/", reviewPhotoModerationHandler(db))
+	mux.HandleFunc("/support/verifications", verificationQueueHandler(db))
+	mux.HandleFunc("/support/verifications/", verificationQueueHandler(db))
+	mux.HandleFunc("/support/risk_blocklist", riskBlocklistHandler(db))
+	mux.HandleFunc("/support/risk_blocklist/", riskBlocklistHandler(db))
+	mux.HandleFunc("/auth/", authHandler(db))
+	mux.HandleFunc("/disputes/", disputeHandler(db))
+	mux.HandleFunc("/uploads", uploadsHandler(db))
+	mux.HandleFunc("/uploads/resumable", resumableUploadsHandler(db))
+	mux.HandleFunc("/uploads/resumable/", resumableUploadsHandler(db))
+	mux.HandleFunc("/directory", directoryHandler(db))
+	mux.HandleFunc("/sitemap.xml", sitemapHandler(db))
+	mux.HandleFunc("/short_links", shortLinksHandler(db))
+	mux.HandleFunc("/s/", shortLinkRedirectHandler(db))
+	mux.HandleFunc("/cuisines", cuisinesHandler(db))
+	mux.HandleFunc("/cuisines/", cuisinesHandler(db))
+	mux.HandleFunc("/reports/exports", reportExportsHandler(db))
+	mux.HandleFunc("/reports/exports/", reportExportsHandler(db))
+	mux.HandleFunc("/organizations", organizationsHandler(db))
+	mux.HandleFunc("/organizations/", organizationHandler(db))
+	mux.HandleFunc("/couriers", couriersHandler(db))
+	mux.HandleFunc("/couriers/", courierHandler(db))
+	mux.HandleFunc("/courier_app/", courierAppHandler(db))
+	mux.HandleFunc("/reviews", reviewsHandler(db))
+	mux.HandleFunc("/gift_cards/", giftCardBalanceHandler(db))
+	mux.HandleFunc("/analytics/events", analyticsEventsHandler(db))
+	mux.HandleFunc("/addresses/lookup", addressLookupHandler())
+	mux.HandleFunc("/customers/me/addresses", customerAddressesHandler(db))
+	mux.HandleFunc("/customers/me/addresses/", customerAddressesHandler(db))
+	mux.HandleFunc("/customers/me/consents", customerConsentsHandler(db))
+	mux.HandleFunc("/customers/me/store_credit", customerStoreCreditHandler(db))
+	mux.HandleFunc("/customers/me/store_credit/", customerStoreCreditHandler(db))
+	mux.HandleFunc("/sync/", syncHandler(db))
+	if ls, ok := storage.(localStorage); ok {
+		mux.Handle("/files/", ls.handler())
 	}
+	mux.HandleFunc("/webhooks/disputes/", disputeWebhookHandler(db))
+	mux.HandleFunc("/webhooks/payments/", paymentWebhookHandler(db))
+	mux.HandleFunc("/webhooks/deliveries", webhookDeliveriesHandler(db))
+	mux.HandleFunc("/webhooks/deliveries/", webhookDeliveriesHandler(db))
+	mux.HandleFunc("/metrics", metricsHandler)
+	mux.HandleFunc("/admin/stats", adminStatsHandler(db))
+	mux.Handle("/admin/", adminHandler())
+	mux.Handle("/admin", http.RedirectHandler("/admin/", http.StatusMovedPermanently))
+	return mux
 }
 
 func establishmentsHandler(db *sql.DB) http.HandlerFunc {
@@ -81,41 +277,196 @@ func establishmentsHandler(db *sql.DB) http.HandlerFunc {
 
 func establishmentHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		id := strings.TrimPrefix(r.URL.Path, "/establishments/")
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/establishments/"), "/")
+		id := parts[0]
+		if len(parts) > 1 {
+			subID := ""
+			if len(parts) > 2 {
+				subID = parts[2]
+			}
+			establishmentSubresource(w, r, db, id, parts[1], subID)
+			return
+		}
 		switch r.Method {
 		case http.MethodGet:
-			getEstablishment(w, db, id)
+			responseCache.Serve(w, r, "establishment", id, func(w http.ResponseWriter, r *http.Request) { getEstablishment(w, r, db, id) })
 		case http.MethodPut:
 			updateEstablishment(w, r, db, id)
 		case http.MethodDelete:
-			deleteEstablishment(w, db, id)
+			deleteEstablishment(w, r, db, id)
 		default:
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		}
 	}
 }
 
+func establishmentSubresource(w http.ResponseWriter, r *http.Request, db *sql.DB, id, sub, subID string) {
+	switch {
+	case sub == "menu" && r.Method == http.MethodGet:
+		responseCache.Serve(w, r, "menu", id, func(w http.ResponseWriter, r *http.Request) { getMenu(w, r, db, id) })
+	case sub == "jsonld" && r.Method == http.MethodGet:
+		responseCache.Serve(w, r, "jsonld", id, func(w http.ResponseWriter, r *http.Request) { getEstablishmentJSONLD(w, db, id) })
+	case sub == "publish" && r.Method == http.MethodPost:
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) {
+			if requireRole(w, r, db, id, "owner") {
+				publishEstablishment(w, db, id)
+			}
+		})(w, r)
+	case sub == "unpublish" && r.Method == http.MethodPost:
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) {
+			if requireRole(w, r, db, id, "owner") {
+				setEstablishmentStatus(w, db, id, "draft", "draft", "published")
+			}
+		})(w, r)
+	case sub == "suspend" && r.Method == http.MethodPost:
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) {
+			if requirePlatformAdmin(w, r, db) {
+				setEstablishmentStatus(w, db, id, "suspended", "draft", "published", "suspended")
+			}
+		})(w, r)
+	case sub == "unsuspend" && r.Method == http.MethodPost:
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) {
+			if requirePlatformAdmin(w, r, db) {
+				setEstablishmentStatus(w, db, id, "draft", "suspended")
+			}
+		})(w, r)
+	case sub == "acceptance" && r.Method == http.MethodPut:
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { updateAcceptanceSettings(w, r, db, id) })(w, r)
+	case sub == "delivery_proof" && r.Method == http.MethodPut:
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { updateDeliveryProofSettings(w, r, db, id) })(w, r)
+	case sub == "review_requests" && r.Method == http.MethodPut:
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { updateReviewRequestSettings(w, r, db, id) })(w, r)
+	case sub == "reviews" && subID == "summary" && r.Method == http.MethodGet:
+		responseCache.Serve(w, r, "review_summary", id, func(w http.ResponseWriter, r *http.Request) { getReviewSummary(w, db, id) })
+	case sub == "reviews" && r.Method == http.MethodGet:
+		listReviews(w, r, db, id)
+	case sub == "cuisines":
+		establishmentCuisinesRoute(w, r, db, id)
+	case sub == "custom_fields":
+		customFieldsRoute(w, r, db, id, subID)
+	case sub == "experiments":
+		experimentsRoute(w, r, db, id, subID)
+	case sub == "translations":
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { translationsRoute(w, r, db, id) })(w, r)
+	case sub == "permissions" && r.Method == http.MethodGet:
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { permissionsMatrix(w, r, db, id) })(w, r)
+	case sub == "settings":
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { settingsRoute(w, r, db, id) })(w, r)
+	case sub == "auto_translate" && r.Method == http.MethodPut:
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { updateAutoTranslate(w, r, db, id) })(w, r)
+	case sub == "badges":
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { establishmentBadgesRoute(w, r, db, id, subID) })(w, r)
+	case sub == "verification":
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { verificationRoute(w, r, db, id) })(w, r)
+	case sub == "qr" && r.Method == http.MethodGet:
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { getEstablishmentQR(w, r, db, id) })(w, r)
+	case sub == "short_links":
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { establishmentShortLinksRoute(w, r, db, id, subID) })(w, r)
+	case sub == "reply_templates":
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { replyTemplatesRoute(w, r, db, id, subID) })(w, r)
+	case sub == "messages" && subID == "unread" && r.Method == http.MethodGet:
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { listUnreadThreads(w, r, db, id) })(w, r)
+	case sub == "review_photo_reports" && r.Method == http.MethodPost:
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { reportReviewPhoto(w, r, db, id) })(w, r)
+	case sub == "gift_cards":
+		giftCardsRoute(w, r, db, id, subID)
+	case sub == "store_credit":
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { storeCreditRoute(w, r, db, id) })(w, r)
+	case sub == "payment_gateway" && r.Method == http.MethodPut:
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { updatePaymentGateway(w, r, db, id) })(w, r)
+	case sub == "debug_recording":
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { debugRecordingRoute(w, r, db, id) })(w, r)
+	case sub == "secrets":
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { secretsRoute(w, r, db, id, subID) })(w, r)
+	case sub == "courier_location" && r.Method == http.MethodPut:
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { updateCourierLocationSettings(w, r, db, id) })(w, r)
+	case sub == "checkout_challenge" && r.Method == http.MethodPut:
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { updateCheckoutChallenge(w, r, db, id) })(w, r)
+	case sub == "security" && r.Method == http.MethodPut:
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { updateEstablishmentSecurity(w, r, db, id) })(w, r)
+	case sub == "products" && subID == "stream" && r.Method == http.MethodGet:
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { streamProducts(w, r, db, id) })(w, r)
+	case sub == "dashboard" && subID == "stream" && r.Method == http.MethodGet:
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { streamDashboard(w, r, db, id) })(w, r)
+	case sub == "stock":
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { stockRoute(w, r, db, id, subID) })(w, r)
+	case sub == "delivery_fee":
+		deliveryFeeRoute(w, r, db, id)
+	case sub == "delivery_quote" && r.Method == http.MethodPost:
+		deliveryQuoteHandler(w, r, db, id)
+	case sub == "slots":
+		slotsRoute(w, r, db, id, subID)
+	case sub == "payment_methods":
+		paymentMethodsRoute(w, r, db, id)
+	case sub == "apply_template" && r.Method == http.MethodPost:
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) {
+			if requireRole(w, r, db, id, "manager") {
+				applyMenuTemplate(w, r, db, id)
+			}
+		})(w, r)
+	case sub == "staff":
+		staffRoute(w, r, db, id)
+	case sub == "segments":
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { segmentsRoute(w, r, db, id, subID) })(w, r)
+	case sub == "campaigns":
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { campaignsRoute(w, r, db, id, subID) })(w, r)
+	case sub == "printers":
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { printersRoute(w, r, db, id, subID) })(w, r)
+	case sub == "print_rules":
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { printRulesRoute(w, r, db, id) })(w, r)
+	case sub == "print_jobs":
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { printJobsRoute(w, r, db, id, subID) })(w, r)
+	case sub == "blocks":
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { customerBlocksRoute(w, r, db, id, subID) })(w, r)
+	case sub == "disputes" && r.Method == http.MethodGet:
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { listDisputes(w, r, db, id) })(w, r)
+	case sub == "reports" && r.Method == http.MethodGet:
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { reportRoute(w, r, db, id, subID) })(w, r)
+	case sub == "customer_flags":
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { customerFlagsRoute(w, r, db, id, subID) })(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
 func createEstablishment(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 	var e Establishment
 	if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	err := db.QueryRow(
-		`INSERT INTO establishments (name, description, address, image_key, banner_key, phone) VALUES ($1,$2,$3,$4,$5,$6) RETURNING id`,
-		e.Name, e.Description, e.Address, e.ImageKey, e.BannerKey, e.Phone,
-	).Scan(&e.ID)
+	if problems := normalizeEstablishment(&e); len(problems) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string][]string{"problems": problems})
+		return
+	}
+	token, err := newPreviewToken()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	err = db.QueryRow(
+		`INSERT INTO establishments (name, description, address, image_key, banner_key, phone, whatsapp, instagram, website, email, cnpj, address_cep, address_street, address_number, address_complement, address_neighborhood, address_city, address_state, address_lat, address_lng, timezone, preview_token, category) VALUES ($1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,$12,$13,$14,$15,$16,$17,$18,$21,$22,$19,$20,NULLIF($23,'')) RETURNING id, status, preview_token`,
+		e.Name, e.Description, e.Address, e.ImageKey, e.BannerKey, e.Phone, e.Whatsapp, e.Instagram, e.Website, e.Email, e.CNPJ, e.AddressDetails.CEP, e.AddressDetails.Street, e.AddressDetails.Number, e.AddressDetails.Complement, e.AddressDetails.Neighborhood, e.AddressDetails.City, e.AddressDetails.State, e.Timezone, token, e.AddressDetails.Lat, e.AddressDetails.Lng, e.Category,
+	).Scan(&e.ID, &e.Status, &e.PreviewToken)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if c, err := parseJWT(strings.TrimPrefix(r.Header.Get("Authorization"), "Bearer ")); err == nil && c.Typ == "owner" {
+		if _, err := db.Exec(`INSERT INTO establishment_staff (establishment_id, owner_id, role) VALUES ($1,$2,'owner')`, e.ID, c.Sub); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(e)
 }
 
 func listEstablishments(w http.ResponseWriter, db *sql.DB) {
-	rows, err := db.Query(`SELECT id, name, description, address, image_key, banner_key, phone FROM establishments`)
+	rows, err := db.Query(`SELECT id, name, description, address, image_key, banner_key, phone, whatsapp, instagram, website, email, cnpj, address_cep, address_street, address_number, address_complement, address_neighborhood, address_city, address_state, address_lat, address_lng, timezone, COALESCE(category,''), status, verified_at IS NOT NULL FROM establishments WHERE status='published'`)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -125,7 +476,7 @@ func listEstablishments(w http.ResponseWriter, db *sql.DB) {
 	list := []Establishment{}
 	for rows.Next() {
 		var e Establishment
-		if err := rows.Scan(&e.ID, &e.Name, &e.Description, &e.Address, &e.ImageKey, &e.BannerKey, &e.Phone); err != nil {
+		if err := rows.Scan(&e.ID, &e.Name, &e.Description, &e.Address, &e.ImageKey, &e.BannerKey, &e.Phone, &e.Whatsapp, &e.Instagram, &e.Website, &e.Email, &e.CNPJ, &e.AddressDetails.CEP, &e.AddressDetails.Street, &e.AddressDetails.Number, &e.AddressDetails.Complement, &e.AddressDetails.Neighborhood, &e.AddressDetails.City, &e.AddressDetails.State, &e.AddressDetails.Lat, &e.AddressDetails.Lng, &e.Timezone, &e.Category, &e.Status, &e.Verified); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
@@ -135,10 +486,12 @@ func listEstablishments(w http.ResponseWriter, db *sql.DB) {
 	json.NewEncoder(w).Encode(list)
 }
 
-func getEstablishment(w http.ResponseWriter, db *sql.DB, id string) {
+func getEstablishment(w http.ResponseWriter, r *http.Request, db *sql.DB, id string) {
 	var e Establishment
-	err := db.QueryRow(`SELECT id, name, description, address, image_key, banner_key, phone FROM establishments WHERE id=$1`, id).Scan(
-		&e.ID, &e.Name, &e.Description, &e.Address, &e.ImageKey, &e.BannerKey, &e.Phone,
+	var token string
+	var updatedAt time.Time
+	err := db.QueryRow(`SELECT id, name, description, address, image_key, banner_key, phone, whatsapp, instagram, website, email, cnpj, address_cep, address_street, address_number, address_complement, address_neighborhood, address_city, address_state, address_lat, address_lng, timezone, COALESCE(category,''), status, verified_at IS NOT NULL, preview_token, updated_at FROM establishments WHERE id=$1`, id).Scan(
+		&e.ID, &e.Name, &e.Description, &e.Address, &e.ImageKey, &e.BannerKey, &e.Phone, &e.Whatsapp, &e.Instagram, &e.Website, &e.Email, &e.CNPJ, &e.AddressDetails.CEP, &e.AddressDetails.Street, &e.AddressDetails.Number, &e.AddressDetails.Complement, &e.AddressDetails.Neighborhood, &e.AddressDetails.City, &e.AddressDetails.State, &e.AddressDetails.Lat, &e.AddressDetails.Lng, &e.Timezone, &e.Category, &e.Status, &e.Verified, &token, &updatedAt,
 	)
 	if err == sql.ErrNoRows {
 		http.NotFound(w, nil)
@@ -148,6 +501,10 @@ func getEstablishment(w http.ResponseWriter, db *sql.DB, id string) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if !establishmentVisible(w, r, e.Status, token) {
+		return
+	}
+	setLastModified(w, updatedAt)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(e)
 }
@@ -158,23 +515,37 @@ func updateEstablishment(w http.ResponseWriter, r *http.Request, db *sql.DB, id
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
+	if problems := normalizeEstablishment(&e); len(problems) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string][]string{"problems": problems})
+		return
+	}
+	if !checkUnmodifiedSince(db, w, r, "establishments", id) {
+		return
+	}
 	_, err := db.Exec(
-		`UPDATE establishments SET name=$1, description=$2, address=$3, image_key=$4, banner_key=$5, phone=$6, updated_at=now() WHERE id=$7`,
-		e.Name, e.Description, e.Address, e.ImageKey, e.BannerKey, e.Phone, id,
+		`UPDATE establishments SET name=$1, description=$2, address=$3, image_key=$4, banner_key=$5, phone=$6, whatsapp=$7, instagram=$8, website=$9, email=$10, verified_at=CASE WHEN cnpj=$11 THEN verified_at END, cnpj=$11, address_cep=$12, address_street=$13, address_number=$14, address_complement=$15, address_neighborhood=$16, address_city=$17, address_state=$18, address_lat=$21, address_lng=$22, timezone=$19, category=NULLIF($23,''), updated_at=now() WHERE id=$20`,
+		e.Name, e.Description, e.Address, e.ImageKey, e.BannerKey, e.Phone, e.Whatsapp, e.Instagram, e.Website, e.Email, e.CNPJ, e.AddressDetails.CEP, e.AddressDetails.Street, e.AddressDetails.Number, e.AddressDetails.Complement, e.AddressDetails.Neighborhood, e.AddressDetails.City, e.AddressDetails.State, e.Timezone, id, e.AddressDetails.Lat, e.AddressDetails.Lng, e.Category,
 	)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	responseCache.Invalidate(id)
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func deleteEstablishment(w http.ResponseWriter, db *sql.DB, id string) {
+func deleteEstablishment(w http.ResponseWriter, r *http.Request, db *sql.DB, id string) {
+	if !checkUnmodifiedSince(db, w, r, "establishments", id) {
+		return
+	}
 	_, err := db.Exec(`DELETE FROM establishments WHERE id=$1`, id)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	responseCache.Invalidate(id)
 	w.WriteHeader(http.StatusNoContent)
 }
 
@@ -193,14 +564,18 @@ func productCategoriesHandler(db *sql.DB) http.HandlerFunc {
 
 func productCategoryHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
-		id := strings.TrimPrefix(r.URL.Path, "/product_categories/")
+		id, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/product_categories/"), "/")
+		if sub == "move_products" && r.Method == http.MethodPost {
+			moveCategoryProducts(w, r, db, id)
+			return
+		}
 		switch r.Method {
 		case http.MethodGet:
 			getProductCategory(w, db, id)
 		case http.MethodPut:
 			updateProductCategory(w, r, db, id)
 		case http.MethodDelete:
-			deleteProductCategory(w, db, id)
+			deleteProductCategory(w, r, db, id)
 		default:
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		}
@@ -213,21 +588,64 @@ func createProductCategory(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	err := db.QueryRow(
-		`INSERT INTO product_categories (establishment_id, name, description) VALUES ($1,$2,$3) RETURNING id`,
-		c.EstablishmentID, c.Name, c.Description,
-	).Scan(&c.ID)
+	sanitizeFields(&c.Name, &c.Description)
+	if msg := normalizeAltText(&c.AltText); msg != "" {
+		http.Error(w, msg, http.StatusUnprocessableEntity)
+		return
+	}
+	tx, err := db.Begin()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext($1))`, c.EstablishmentID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := validateCategoryParent(tx, "", c.EstablishmentID, c.ParentID); err != nil {
+		categoryTreeError(w, err)
+		return
+	}
+	c.ID = ""
+	if err := insertCategory(tx, &c); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	responseCache.Invalidate(c.EstablishmentID)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(c)
 }
 
+// insertCategory inserts c, keeping c.ID when the client chose it (offline
+// POS sync) and filling it in otherwise.
+func insertCategory(tx *sql.Tx, c *ProductCategory) error {
+	var id *string
+	if c.ID != "" {
+		id = &c.ID
+	}
+	return tx.QueryRow(
+		`INSERT INTO product_categories (id, establishment_id, parent_id, name, description, image_key, banner_key, image_alt_text) VALUES (COALESCE($7::uuid, gen_random_uuid()),$1,$2,$3,$4,$5,$6,$8) RETURNING id`,
+		c.EstablishmentID, c.ParentID, c.Name, c.Description, c.ImageKey, c.BannerKey, id, c.AltText,
+	).Scan(&c.ID)
+}
+
+func updateCategoryRow(tx *sql.Tx, id string, c *ProductCategory) error {
+	_, err := tx.Exec(
+		`UPDATE product_categories SET establishment_id=$1, parent_id=$2, name=$3, description=$4, image_key=$5, banner_key=$6, image_alt_text=$8, updated_at=now() WHERE id=$7`,
+		c.EstablishmentID, c.ParentID, c.Name, c.Description, c.ImageKey, c.BannerKey, id, c.AltText,
+	)
+	return err
+}
+
 func listProductCategories(w http.ResponseWriter, db *sql.DB) {
-	rows, err := db.Query(`SELECT id, establishment_id, name, description FROM product_categories`)
+	rows, err := db.Query(`SELECT id, establishment_id, parent_id, name, description, image_key, image_alt_text, banner_key FROM product_categories`)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -237,10 +655,11 @@ func listProductCategories(w http.ResponseWriter, db *sql.DB) {
 	list := []ProductCategory{}
 	for rows.Next() {
 		var c ProductCategory
-		if err := rows.Scan(&c.ID, &c.EstablishmentID, &c.Name, &c.Description); err != nil {
+		if err := rows.Scan(&c.ID, &c.EstablishmentID, &c.ParentID, &c.Name, &c.Description, &c.ImageKey, &c.AltText, &c.BannerKey); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		c.ImageURL, c.BannerURL = assetURL(c.ImageKey), assetURL(c.BannerKey)
 		list = append(list, c)
 	}
 	w.Header().Set("Content-Type", "application/json")
@@ -249,8 +668,9 @@ func listProductCategories(w http.ResponseWriter, db *sql.DB) {
 
 func getProductCategory(w http.ResponseWriter, db *sql.DB, id string) {
 	var c ProductCategory
-	err := db.QueryRow(`SELECT id, establishment_id, name, description FROM product_categories WHERE id=$1`, id).Scan(
-		&c.ID, &c.EstablishmentID, &c.Name, &c.Description,
+	var updatedAt time.Time
+	err := db.QueryRow(`SELECT id, establishment_id, parent_id, name, description, image_key, image_alt_text, banner_key, updated_at FROM product_categories WHERE id=$1`, id).Scan(
+		&c.ID, &c.EstablishmentID, &c.ParentID, &c.Name, &c.Description, &c.ImageKey, &c.AltText, &c.BannerKey, &updatedAt,
 	)
 	if err == sql.ErrNoRows {
 		http.NotFound(w, nil)
@@ -260,6 +680,8 @@ func getProductCategory(w http.ResponseWriter, db *sql.DB, id string) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	c.ImageURL, c.BannerURL = assetURL(c.ImageKey), assetURL(c.BannerKey)
+	setLastModified(w, updatedAt)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(c)
 }
@@ -270,33 +692,122 @@ func updateProductCategory(w http.ResponseWriter, r *http.Request, db *sql.DB, i
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	_, err := db.Exec(
-		`UPDATE product_categories SET establishment_id=$1, name=$2, description=$3 WHERE id=$4`,
-		c.EstablishmentID, c.Name, c.Description, id,
-	)
+	sanitizeFields(&c.Name, &c.Description)
+	if msg := normalizeAltText(&c.AltText); msg != "" {
+		http.Error(w, msg, http.StatusUnprocessableEntity)
+		return
+	}
+	tx, err := db.Begin()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext($1))`, c.EstablishmentID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !checkUnmodifiedSince(tx, w, r, "product_categories", id) {
+		return
+	}
+	if err := validateCategoryParent(tx, id, c.EstablishmentID, c.ParentID); err != nil {
+		categoryTreeError(w, err)
+		return
+	}
+	if err := updateCategoryRow(tx, id, &c); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	responseCache.Invalidate(c.EstablishmentID)
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func deleteProductCategory(w http.ResponseWriter, db *sql.DB, id string) {
-	_, err := db.Exec(`DELETE FROM product_categories WHERE id=$1`, id)
+func deleteProductCategory(w http.ResponseWriter, r *http.Request, db *sql.DB, id string) {
+	tx, err := db.Begin()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	defer tx.Rollback()
+
+	if !checkUnmodifiedSince(tx, w, r, "product_categories", id) {
+		return
+	}
+	establishmentID, err := deleteCategoryRow(tx, id, r.URL.Query().Get("recursive") == "true")
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	responseCache.Invalidate(establishmentID)
 	w.WriteHeader(http.StatusNoContent)
 }
 
+// deleteCategoryRow deletes a category and returns its establishment, or
+// sql.ErrNoRows. Subcategories cascade on delete, so unless recursive is set
+// they are moved up to the deleted category's parent first. Every affected
+// row is touched or tombstoned so POS sync clients see the change.
+func deleteCategoryRow(tx *sql.Tx, id string, recursive bool) (string, error) {
+	var establishmentID string
+	if err := tx.QueryRow(`SELECT establishment_id FROM product_categories WHERE id=$1 FOR UPDATE`, id).Scan(&establishmentID); err != nil {
+		return "", err
+	}
+	ids := []string{id}
+	if recursive {
+		rows, err := tx.Query(
+			`WITH RECURSIVE subtree AS (
+			   SELECT id FROM product_categories WHERE parent_id=$1
+			   UNION ALL
+			   SELECT c.id FROM product_categories c JOIN subtree s ON c.parent_id=s.id
+			 ) SELECT id FROM subtree`, id)
+		if err != nil {
+			return "", err
+		}
+		for rows.Next() {
+			var child string
+			if err := rows.Scan(&child); err != nil {
+				rows.Close()
+				return "", err
+			}
+			ids = append(ids, child)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return "", err
+		}
+	} else {
+		_, err := tx.Exec(`UPDATE product_categories SET parent_id=(SELECT parent_id FROM product_categories WHERE id=$1), updated_at=now() WHERE parent_id=$1`, id)
+		if err != nil {
+			return "", err
+		}
+	}
+	if _, err := tx.Exec(`UPDATE products SET category_id=NULL, updated_at=now() WHERE category_id = ANY($1::uuid[])`, pq.Array(ids)); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(`DELETE FROM product_categories WHERE id=$1`, id); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(`DELETE FROM translations WHERE entity_type='category' AND entity_id = ANY($1::uuid[])`, pq.Array(ids)); err != nil {
+		return "", err
+	}
+	return establishmentID, recordTombstones(tx, establishmentID, "category", ids...)
+}
+
 func productsHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		switch r.Method {
 		case http.MethodPost:
 			createProduct(w, r, db)
 		case http.MethodGet:
-			listProducts(w, db)
+			listProducts(w, r, db)
 		default:
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		}
@@ -306,13 +817,37 @@ func productsHandler(db *sql.DB) http.HandlerFunc {
 func productHandler(db *sql.DB) http.HandlerFunc {
 	return func(w http.ResponseWriter, r *http.Request) {
 		id := strings.TrimPrefix(r.URL.Path, "/products/")
+		if code, ok := strings.CutPrefix(id, "by_barcode/"); ok && r.Method == http.MethodGet {
+			authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { getProductByBarcode(w, r, db, code) })(w, r)
+			return
+		}
+		if id, ok := strings.CutSuffix(id, "/price_history"); ok && r.Method == http.MethodGet {
+			authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { listPriceHistory(w, r, db, id) })(w, r)
+			return
+		}
+		if id, ok := strings.CutSuffix(id, "/insights"); ok && r.Method == http.MethodGet {
+			authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { productInsights(w, r, db, id) })(w, r)
+			return
+		}
+		if id, ok := strings.CutSuffix(id, "/badges"); ok && r.Method == http.MethodPut {
+			authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { setProductBadges(w, r, db, id) })(w, r)
+			return
+		}
+		if id, ok := strings.CutSuffix(id, "/events"); ok && r.Method == http.MethodPost {
+			trackProductEvent(w, r, db, id)
+			return
+		}
+		if id, ok := strings.CutSuffix(id, "/generate_description"); ok && r.Method == http.MethodPost {
+			authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { generateProductDescription(w, r, db, id) })(w, r)
+			return
+		}
 		switch r.Method {
 		case http.MethodGet:
 			getProduct(w, db, id)
 		case http.MethodPut:
 			updateProduct(w, r, db, id)
 		case http.MethodDelete:
-			deleteProduct(w, db, id)
+			deleteProduct(w, r, db, id)
 		default:
 			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
 		}
@@ -325,21 +860,70 @@ func createProduct(w http.ResponseWriter, r *http.Request, db *sql.DB) {
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	err := db.QueryRow(
-		`INSERT INTO products (establishment_id, category_id, name, description, price_cents, image_key, banner_key, is_active) VALUES ($1,$2,$3,$4,$5,$6,$7,$8) RETURNING id`,
-		p.EstablishmentID, p.CategoryID, p.Name, p.Description, p.PriceCents, p.ImageKey, p.BannerKey, p.IsActive,
-	).Scan(&p.ID)
+	if msg := normalizeBarcode(&p.Barcode); msg != "" {
+		http.Error(w, msg, http.StatusUnprocessableEntity)
+		return
+	}
+	enrichFromBarcode(r.Context(), &p)
+	sanitizeFields(&p.Name, &p.Description)
+	if msg := normalizeAltText(&p.AltText); msg != "" {
+		http.Error(w, msg, http.StatusUnprocessableEntity)
+		return
+	}
+	if msg := normalizeFulfillmentTypes(&p.FulfillmentTypes); msg != "" {
+		http.Error(w, msg, http.StatusUnprocessableEntity)
+		return
+	}
+	r, ok := requirePricesPermission(w, r, db, p.EstablishmentID)
+	if !ok {
+		return
+	}
+	tx, err := db.Begin()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	defer tx.Rollback()
+
+	msg, err := validateProductCustomFields(tx, &p, true)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if msg != "" {
+		http.Error(w, msg, http.StatusUnprocessableEntity)
+		return
+	}
+	p.ID = ""
+	err = insertProduct(tx, &p)
+	if isUniqueViolation(err) {
+		http.Error(w, "another product in this establishment has this barcode", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := recordPriceChanges(tx, r, p.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := enqueueEvent(tx, Event{Type: eventProductCreated, ProductID: p.ID, EstablishmentID: p.EstablishmentID}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	responseCache.Invalidate(p.EstablishmentID)
 	w.Header().Set("Content-Type", "application/json")
 	w.WriteHeader(http.StatusCreated)
 	json.NewEncoder(w).Encode(p)
 }
 
-func listProducts(w http.ResponseWriter, db *sql.DB) {
-	rows, err := db.Query(`SELECT id, establishment_id, category_id, name, description, price_cents, image_key, banner_key, is_active FROM products`)
+func listProducts(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	rows, err := db.Query(`SELECT id, establishment_id, category_id, name, description, price_cents, image_key, image_alt_text, banner_key, is_active, fulfillment_types, stock_quantity, barcode, custom_fields FROM products`)
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
@@ -349,20 +933,24 @@ func listProducts(w http.ResponseWriter, db *sql.DB) {
 	list := []Product{}
 	for rows.Next() {
 		var p Product
-		if err := rows.Scan(&p.ID, &p.EstablishmentID, &p.CategoryID, &p.Name, &p.Description, &p.PriceCents, &p.ImageKey, &p.BannerKey, &p.IsActive); err != nil {
+		var custom []byte
+		if err := rows.Scan(&p.ID, &p.EstablishmentID, &p.CategoryID, &p.Name, &p.Description, &p.PriceCents, &p.ImageKey, &p.AltText, &p.BannerKey, &p.IsActive, pq.Array(&p.FulfillmentTypes), &p.Stock, &p.Barcode, &custom); err != nil {
 			http.Error(w, err.Error(), http.StatusInternalServerError)
 			return
 		}
+		json.Unmarshal(custom, &p.CustomFields)
+		p.ImageURL, p.BannerURL = assetURL(p.ImageKey), assetURL(p.BannerKey)
 		list = append(list, p)
 	}
-	w.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(w).Encode(list)
+	respond(w, r, "products", list)
 }
 
 func getProduct(w http.ResponseWriter, db *sql.DB, id string) {
 	var p Product
-	err := db.QueryRow(`SELECT id, establishment_id, category_id, name, description, price_cents, image_key, banner_key, is_active FROM products WHERE id=$1`, id).Scan(
-		&p.ID, &p.EstablishmentID, &p.CategoryID, &p.Name, &p.Description, &p.PriceCents, &p.ImageKey, &p.BannerKey, &p.IsActive,
+	var custom []byte
+	var updatedAt time.Time
+	err := db.QueryRow(`SELECT id, establishment_id, category_id, name, description, price_cents, image_key, image_alt_text, banner_key, is_active, fulfillment_types, stock_quantity, barcode, custom_fields, updated_at FROM products WHERE id=$1`, id).Scan(
+		&p.ID, &p.EstablishmentID, &p.CategoryID, &p.Name, &p.Description, &p.PriceCents, &p.ImageKey, &p.AltText, &p.BannerKey, &p.IsActive, pq.Array(&p.FulfillmentTypes), &p.Stock, &p.Barcode, &custom, &updatedAt,
 	)
 	if err == sql.ErrNoRows {
 		http.NotFound(w, nil)
@@ -372,6 +960,9 @@ func getProduct(w http.ResponseWriter, db *sql.DB, id string) {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	json.Unmarshal(custom, &p.CustomFields)
+	p.ImageURL, p.BannerURL = assetURL(p.ImageKey), assetURL(p.BannerKey)
+	setLastModified(w, updatedAt)
 	w.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(w).Encode(p)
 }
@@ -382,22 +973,170 @@ func updateProduct(w http.ResponseWriter, r *http.Request, db *sql.DB, id string
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	_, err := db.Exec(
-		`UPDATE products SET establishment_id=$1, category_id=$2, name=$3, description=$4, price_cents=$5, image_key=$6, banner_key=$7, is_active=$8, updated_at=now() WHERE id=$9`,
-		p.EstablishmentID, p.CategoryID, p.Name, p.Description, p.PriceCents, p.ImageKey, p.BannerKey, p.IsActive, id,
-	)
+	sanitizeFields(&p.Name, &p.Description)
+	if msg := normalizeAltText(&p.AltText); msg != "" {
+		http.Error(w, msg, http.StatusUnprocessableEntity)
+		return
+	}
+	if msg := normalizeFulfillmentTypes(&p.FulfillmentTypes); msg != "" {
+		http.Error(w, msg, http.StatusUnprocessableEntity)
+		return
+	}
+	if msg := normalizeBarcode(&p.Barcode); msg != "" {
+		http.Error(w, msg, http.StatusUnprocessableEntity)
+		return
+	}
+	tx, err := db.Begin()
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	defer tx.Rollback()
+
+	if !checkUnmodifiedSince(tx, w, r, "products", id) {
+		return
+	}
+	// Product edits are open, but changing the price takes a signed-in owner
+	// the establishment's prices policy allows. Moving the product carries
+	// its price into another menu, so that needs the policy of both.
+	var establishmentID string
+	var price int
+	err = tx.QueryRow(`SELECT establishment_id, price_cents FROM products WHERE id=$1 FOR UPDATE`, id).Scan(&establishmentID, &price)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err == nil && establishmentID != p.EstablishmentID {
+		var ok bool
+		if r, ok = requirePricesPermission(w, r, db, establishmentID, p.EstablishmentID); !ok {
+			return
+		}
+	} else if err == nil && price != p.PriceCents {
+		var ok bool
+		if r, ok = requirePricesPermission(w, r, db, establishmentID); !ok {
+			return
+		}
+	}
+	msg, err := validateProductCustomFields(tx, &p, false)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if msg != "" {
+		http.Error(w, msg, http.StatusUnprocessableEntity)
+		return
+	}
+	err = updateProductRow(tx, id, &p)
+	if isUniqueViolation(err) {
+		http.Error(w, "another product in this establishment has this barcode", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := recordPriceChanges(tx, r, id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := enqueueEvent(tx, Event{Type: eventProductUpdated, ProductID: id, EstablishmentID: p.EstablishmentID}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	responseCache.Invalidate(p.EstablishmentID)
 	w.WriteHeader(http.StatusNoContent)
 }
 
-func deleteProduct(w http.ResponseWriter, db *sql.DB, id string) {
-	_, err := db.Exec(`DELETE FROM products WHERE id=$1`, id)
+// requirePricesPermission asks for a signed-in owner the prices policy of
+// every given establishment allows, and returns the authenticated request.
+func requirePricesPermission(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentIDs ...string) (*http.Request, bool) {
+	allowed := false
+	authenticateOwner(db, func(w http.ResponseWriter, authed *http.Request) {
+		r = authed
+		for _, id := range establishmentIDs {
+			if !requirePermission(w, authed, db, id, "prices") {
+				return
+			}
+		}
+		allowed = true
+	})(w, r)
+	return r, allowed
+}
+
+// insertProduct inserts p, keeping p.ID when the client chose it (offline POS
+// sync) and filling it in otherwise.
+func insertProduct(tx *sql.Tx, p *Product) error {
+	var id *string
+	if p.ID != "" {
+		id = &p.ID
+	}
+	return tx.QueryRow(
+		`INSERT INTO products (id, establishment_id, category_id, name, description, price_cents, image_key, banner_key, is_active, fulfillment_types, stock_quantity, barcode, custom_fields, image_alt_text) VALUES (COALESCE($12::uuid, gen_random_uuid()),$1,$2,$3,$4,$5,$6,$7,$8,$9,$10,$11,COALESCE($13::jsonb,'{}'),$14) RETURNING id`,
+		p.EstablishmentID, p.CategoryID, p.Name, p.Description, p.PriceCents, p.ImageKey, p.BannerKey, p.IsActive, pq.Array(p.FulfillmentTypes), p.Stock, p.Barcode, id, customFieldsParam(p.CustomFields), p.AltText,
+	).Scan(&p.ID)
+}
+
+func updateProductRow(tx *sql.Tx, id string, p *Product) error {
+	_, err := tx.Exec(
+		`UPDATE products SET establishment_id=$1, category_id=$2, name=$3, description=$4, price_cents=$5, image_key=$6, banner_key=$7, is_active=$8, fulfillment_types=$9, barcode=$11, custom_fields=COALESCE($12::jsonb, custom_fields), image_alt_text=$13, updated_at=now() WHERE id=$10`,
+		p.EstablishmentID, p.CategoryID, p.Name, p.Description, p.PriceCents, p.ImageKey, p.BannerKey, p.IsActive, pq.Array(p.FulfillmentTypes), id, p.Barcode, customFieldsParam(p.CustomFields), p.AltText,
+	)
+	return err
+}
+
+func deleteProduct(w http.ResponseWriter, r *http.Request, db *sql.DB, id string) {
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if !checkUnmodifiedSince(tx, w, r, "products", id) {
+		return
+	}
+	var establishmentID string
+	err = tx.QueryRow(`SELECT establishment_id FROM products WHERE id=$1 FOR UPDATE`, id).Scan(&establishmentID)
+	if err == sql.ErrNoRows {
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
 	if err != nil {
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
+	if _, ok := requirePricesPermission(w, r, db, establishmentID); !ok {
+		return
+	}
+	_, err = deleteProductRow(tx, id)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	responseCache.Invalidate(establishmentID)
 	w.WriteHeader(http.StatusNoContent)
 }
+
+// deleteProductRow deletes a product and returns its establishment, or
+// sql.ErrNoRows.
+func deleteProductRow(tx *sql.Tx, id string) (string, error) {
+	var establishmentID string
+	if err := tx.QueryRow(`DELETE FROM products WHERE id=$1 RETURNING establishment_id`, id).Scan(&establishmentID); err != nil {
+		return "", err
+	}
+	if _, err := tx.Exec(`DELETE FROM translations WHERE entity_type='product' AND entity_id=$1`, id); err != nil {
+		return "", err
+	}
+	if err := enqueueEvent(tx, Event{Type: eventProductDeleted, ProductID: id, EstablishmentID: establishmentID}); err != nil {
+		return "", err
+	}
+	return establishmentID, recordTombstones(tx, establishmentID, "product", id)
+}
@@ -0,0 +1,159 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"os"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// openTestDB connects to DATABASE_URL, which must point at a database
+// initialised with sql-init.sql. Tests and benchmarks that need one are
+// skipped when it isn't set.
+func openTestDB(tb testing.TB) *sql.DB {
+	tb.Helper()
+	dbURL := os.Getenv("DATABASE_URL")
+	if dbURL == "" {
+		tb.Skip("DATABASE_URL not set")
+	}
+	db, err := sql.Open("postgres", dbURL)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() { db.Close() })
+	if err := db.Ping(); err != nil {
+		tb.Fatal(err)
+	}
+	return db
+}
+
+// openCountingTestDB is openTestDB with a count of the statements sent to
+// the server, for asserting that a handler's query count doesn't grow with
+// the rows it returns.
+func openCountingTestDB(tb testing.TB) (*sql.DB, *atomic.Int64) {
+	tb.Helper()
+	openTestDB(tb)
+	c := countingConnector{dsn: os.Getenv("DATABASE_URL"), n: &atomic.Int64{}}
+	db := sql.OpenDB(c)
+	tb.Cleanup(func() { db.Close() })
+	return db, c.n
+}
+
+type countingConnector struct {
+	dsn string
+	n   *atomic.Int64
+}
+
+func (c countingConnector) Connect(context.Context) (driver.Conn, error) {
+	conn, err := pq.Driver{}.Open(c.dsn)
+	if err != nil {
+		return nil, err
+	}
+	return countingConn{conn, c.n}, nil
+}
+
+func (c countingConnector) Driver() driver.Driver { return pq.Driver{} }
+
+// countingConn hides pq's Queryer and Execer, so database/sql prepares
+// every statement and Prepare sees all of them.
+type countingConn struct {
+	driver.Conn
+	n *atomic.Int64
+}
+
+func (c countingConn) Prepare(query string) (driver.Stmt, error) {
+	c.n.Add(1)
+	return c.Conn.Prepare(query)
+}
+
+// testTenant is a published establishment with products and a customer
+// who has placed orders there, created by seedTestTenant.
+type testTenant struct {
+	EstablishmentID string
+	ProductIDs      []string
+	CustomerID      string
+}
+
+// seedTestTenant creates a tenant with the given number of products and
+// pickup orders, and deletes it when the test ends.
+func seedTestTenant(tb testing.TB, db *sql.DB, products, orders int) *testTenant {
+	tb.Helper()
+	tag := fmt.Sprintf("test-%d", time.Now().UnixNano())
+	t := &testTenant{}
+	err := db.QueryRow(
+		`INSERT INTO establishments (name, description, status, preview_token, published_at) VALUES ($1, 'Test tenant', 'published', $1, now()) RETURNING id`,
+		tag,
+	).Scan(&t.EstablishmentID)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	tb.Cleanup(func() {
+		for _, q := range []string{`DELETE FROM orders WHERE establishment_id=$1`, `DELETE FROM establishments WHERE id=$1`} {
+			if _, err := db.Exec(q, t.EstablishmentID); err != nil {
+				tb.Logf("cleanup: %v", err)
+			}
+		}
+		if t.CustomerID != "" {
+			if _, err := db.Exec(`DELETE FROM customers WHERE id=$1`, t.CustomerID); err != nil {
+				tb.Logf("cleanup: %v", err)
+			}
+		}
+	})
+	var categoryID string
+	if err := db.QueryRow(`INSERT INTO product_categories (establishment_id, name) VALUES ($1, 'Test') RETURNING id`, t.EstablishmentID).Scan(&categoryID); err != nil {
+		tb.Fatal(err)
+	}
+	for i := 0; i < products; i++ {
+		var id string
+		err := db.QueryRow(
+			`INSERT INTO products (establishment_id, category_id, name, description, price_cents) VALUES ($1, $2, $3, 'Test product', $4) RETURNING id`,
+			t.EstablishmentID, categoryID, fmt.Sprintf("Product %d", i+1), 990+i*10,
+		).Scan(&id)
+		if err != nil {
+			tb.Fatal(err)
+		}
+		t.ProductIDs = append(t.ProductIDs, id)
+	}
+	err = db.QueryRow(
+		`INSERT INTO customers (name, email, phone, password_hash) VALUES ('Test customer', $1, '11999990000', '!') RETURNING id`,
+		tag+"@test.invalid",
+	).Scan(&t.CustomerID)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	for i := 0; i < orders; i++ {
+		placeTestOrder(tb, db, t, true)
+	}
+	return t
+}
+
+// placeTestOrder checks out the tenant's first products for pickup, paying
+// in cash, and commits the order only if commit is set.
+func placeTestOrder(tb testing.TB, db *sql.DB, t *testTenant, commit bool) *Order {
+	tb.Helper()
+	tx, err := db.Begin()
+	if err != nil {
+		tb.Fatal(err)
+	}
+	defer tx.Rollback()
+	req := &CheckoutRequest{EstablishmentID: t.EstablishmentID, FulfillmentType: "pickup", PaymentMethod: "cash"}
+	for _, id := range t.ProductIDs[:min(3, len(t.ProductIDs))] {
+		req.Items = append(req.Items, CheckoutItem{ProductID: id, Quantity: 1})
+	}
+	o, err := placeOrder(tx, t.CustomerID, req)
+	if err != nil {
+		tb.Fatal(err)
+	}
+	if commit {
+		if err := tx.Commit(); err != nil {
+			tb.Fatal(err)
+		}
+	}
+	return o
+}
@@ -0,0 +1,386 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+
+	"github.com/lib/pq"
+)
+
+type MenuCategory struct {
+	ProductCategory
+	// MachineTranslated is set when the name and description come from an
+	// auto-generated translation.
+	MachineTranslated bool           `json:"machine_translated,omitempty"`
+	Products          []Product      `json:"products"`
+	Children          []MenuCategory `json:"children"`
+}
+
+type Menu struct {
+	Establishment  Establishment   `json:"establishment"`
+	PaymentMethods []PaymentMethod `json:"payment_methods"`
+	Categories     []MenuCategory  `json:"categories"`
+	Uncategorized  []Product       `json:"uncategorized"`
+}
+
+// getMenu returns the public menu. With ?description_format=html, descriptions
+// are also rendered from the markdown subset into description_html. Products
+// can be filtered by custom field with cf.* parameters (see custom_fields.go),
+// and ?lang= serves translated names and descriptions (see translations.go).
+// Menus in the source language are streamed (see streamMenu).
+func getMenu(w http.ResponseWriter, r *http.Request, db *sql.DB, id string) {
+	html := r.URL.Query().Get("description_format") == "html"
+	fulfillment := r.URL.Query().Get("fulfillment_type")
+	if fulfillment != "" && !validFulfillmentType(fulfillment) {
+		http.Error(w, "fulfillment_type must be delivery, pickup or dine_in", http.StatusBadRequest)
+		return
+	}
+	lang := r.URL.Query().Get("lang")
+	if _, ok := menuLanguages[lang]; !ok && lang != "" && lang != menuSourceLanguage {
+		http.Error(w, "lang must be pt-BR, en or es", http.StatusBadRequest)
+		return
+	}
+	var m Menu
+	var token string
+	e := &m.Establishment
+	err := db.QueryRow(`SELECT id, name, description, address, image_key, banner_key, phone, whatsapp, instagram, website, email, cnpj, address_cep, address_street, address_number, address_complement, address_neighborhood, address_city, address_state, address_lat, address_lng, timezone, COALESCE(category,''), status, verified_at IS NOT NULL, preview_token FROM establishments WHERE id=$1`, id).Scan(
+		&e.ID, &e.Name, &e.Description, &e.Address, &e.ImageKey, &e.BannerKey, &e.Phone, &e.Whatsapp, &e.Instagram, &e.Website, &e.Email, &e.CNPJ, &e.AddressDetails.CEP, &e.AddressDetails.Street, &e.AddressDetails.Number, &e.AddressDetails.Complement, &e.AddressDetails.Neighborhood, &e.AddressDetails.City, &e.AddressDetails.State, &e.AddressDetails.Lat, &e.AddressDetails.Lng, &e.Timezone, &e.Category, &e.Status, &e.Verified, &token,
+	)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, nil)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !establishmentVisible(w, r, e.Status, token) {
+		return
+	}
+	if html {
+		e.DescriptionHTML = renderMarkdown(e.Description)
+	}
+
+	filters, args, msg, err := customFieldFilters(db, id, r.URL.Query(), 3)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if msg != "" {
+		http.Error(w, msg, http.StatusBadRequest)
+		return
+	}
+	badges, err := loadMenuBadges(db, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if m.PaymentMethods, err = loadPaymentMethods(db, id, true); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	q := menuQuery{id: id, html: html, fulfillment: fulfillment, filters: filters, args: args, badges: badges}
+	if _, ok := menuLanguages[lang]; !ok {
+		streamMenu(w, r, db, &m, q)
+		return
+	}
+
+	// Translations are looked up and generated for the whole menu at once,
+	// so translated menus are built in memory.
+	crows, err := db.Query(`SELECT id, establishment_id, parent_id, name, description, image_key, image_alt_text, banner_key FROM product_categories WHERE establishment_id=$1 ORDER BY name`, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer crows.Close()
+
+	byID := map[string]*MenuCategory{}
+	var order []*MenuCategory
+	for crows.Next() {
+		c := &MenuCategory{Products: []Product{}}
+		if err := crows.Scan(&c.ID, &c.EstablishmentID, &c.ParentID, &c.Name, &c.Description, &c.ImageKey, &c.AltText, &c.BannerKey); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		q.finishCategory(&c.ProductCategory)
+		byID[c.ID] = c
+		order = append(order, c)
+	}
+
+	prows, err := db.Query(`SELECT id, establishment_id, category_id, name, description, price_cents, image_key, image_alt_text, banner_key, is_active, fulfillment_types, stock_quantity, barcode, custom_fields FROM products
+		 WHERE establishment_id=$1 AND is_active AND ($2='' OR $2 = ANY(fulfillment_types))`+filters+` ORDER BY name`, append([]any{id, fulfillment}, args...)...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer prows.Close()
+
+	m.Uncategorized = []Product{}
+	for prows.Next() {
+		var p Product
+		var custom []byte
+		if err := prows.Scan(&p.ID, &p.EstablishmentID, &p.CategoryID, &p.Name, &p.Description, &p.PriceCents, &p.ImageKey, &p.AltText, &p.BannerKey, &p.IsActive, pq.Array(&p.FulfillmentTypes), &p.Stock, &p.Barcode, &custom); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		q.finishProduct(&p, custom)
+		if p.CategoryID != nil {
+			if c, ok := byID[*p.CategoryID]; ok {
+				c.Products = append(c.Products, p)
+				continue
+			}
+		}
+		m.Uncategorized = append(m.Uncategorized, p)
+	}
+
+	var items []translatable
+	add := func(p *Product) {
+		items = append(items, translatable{"product", p.ID, &p.Name, &p.Description, &p.DescriptionHTML, &p.MachineTranslated})
+	}
+	for _, c := range order {
+		items = append(items, translatable{"category", c.ID, &c.Name, &c.Description, &c.DescriptionHTML, &c.MachineTranslated})
+		for i := range c.Products {
+			add(&c.Products[i])
+		}
+	}
+	for i := range m.Uncategorized {
+		add(&m.Uncategorized[i])
+	}
+	if err := translateMenu(r.Context(), db, id, lang, items); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	m.Categories = buildCategoryTree(order, byID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m)
+}
+
+// menuQuery holds what getMenu parsed and preloaded for the category and
+// product rows.
+type menuQuery struct {
+	id, fulfillment string
+	html            bool
+	// filters and args are the custom field conditions, numbered from $3.
+	filters string
+	args    []any
+	badges  map[string][]ProductBadge
+}
+
+func (q menuQuery) finishCategory(c *ProductCategory) {
+	c.ImageURL, c.BannerURL = assetURL(c.ImageKey), assetURL(c.BannerKey)
+	if q.html {
+		c.DescriptionHTML = renderMarkdown(c.Description)
+	}
+}
+
+func (q menuQuery) finishProduct(p *Product, custom []byte) {
+	json.Unmarshal(custom, &p.CustomFields)
+	p.Badges = q.badges[p.ID]
+	p.ImageURL, p.BannerURL = assetURL(p.ImageKey), assetURL(p.BannerKey)
+	if q.html {
+		p.DescriptionHTML = renderMarkdown(p.Description)
+	}
+}
+
+// menuStreamQuery returns the category tree depth first, siblings ordered by
+// name like buildCategoryTree, each category followed by its products, and
+// then the uncategorized products (those with no category, or one outside
+// the tree), all in a single pass. Rows of empty categories have no product;
+// the has-category and has-product flags tell the two halves apart.
+const menuStreamQuery = `WITH RECURSIVE tree AS (
+	SELECT c.id, c.establishment_id, c.parent_id, c.name, c.description, c.image_key, c.image_alt_text, c.banner_key, ARRAY[c.name::text, c.id::text] AS path
+	  FROM product_categories c
+	 WHERE c.establishment_id=$1
+	   AND NOT EXISTS (SELECT 1 FROM product_categories pc WHERE pc.id=c.parent_id AND pc.establishment_id=$1)
+	UNION ALL
+	SELECT c.id, c.establishment_id, c.parent_id, c.name, c.description, c.image_key, c.image_alt_text, c.banner_key, t.path || ARRAY[c.name::text, c.id::text]
+	  FROM product_categories c JOIN tree t ON c.parent_id=t.id
+), menu_products AS (
+	SELECT id, establishment_id, category_id, name, description, price_cents, image_key, image_alt_text, banner_key, is_active, fulfillment_types, stock_quantity, barcode, custom_fields
+	  FROM products
+	 WHERE establishment_id=$1 AND is_active AND ($2='' OR $2 = ANY(fulfillment_types))%s
+)
+SELECT t.id IS NOT NULL, COALESCE(t.id::text,''), COALESCE(t.establishment_id::text,''), t.parent_id, COALESCE(t.name,''), COALESCE(t.description,''), COALESCE(t.image_key,''), COALESCE(t.image_alt_text,''), COALESCE(t.banner_key,''),
+       p.id IS NOT NULL, COALESCE(p.id::text,''), COALESCE(p.establishment_id::text,''), p.category_id, COALESCE(p.name,''), COALESCE(p.description,''), COALESCE(p.price_cents,0), COALESCE(p.image_key,''), COALESCE(p.image_alt_text,''), COALESCE(p.banner_key,''), COALESCE(p.is_active,false), p.fulfillment_types, p.stock_quantity, p.barcode, p.custom_fields
+  FROM tree t FULL JOIN menu_products p ON p.category_id=t.id
+ ORDER BY t.path NULLS LAST, p.name`
+
+// streamMenu writes the menu as it reads menuStreamQuery, so large menus
+// are never held in memory. The output matches the buffered Menu encoding.
+// Errors after the first byte abort the response rather than sending (and
+// caching) a truncated menu.
+func streamMenu(w http.ResponseWriter, r *http.Request, db *sql.DB, m *Menu, q menuQuery) {
+	rows, err := db.QueryContext(r.Context(), fmt.Sprintf(menuStreamQuery, q.filters), append([]any{q.id, q.fulfillment}, q.args...)...)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	mw := &menuWriter{w: w}
+	w.Header().Set("Content-Type", "application/json")
+	mw.raw(`{"establishment":`)
+	mw.value(m.Establishment)
+	mw.raw(`,"payment_methods":`)
+	mw.value(m.PaymentMethods)
+	mw.raw(`,"categories":[`)
+	for rows.Next() {
+		var c ProductCategory
+		var p Product
+		var hasCategory, hasProduct bool
+		var custom []byte
+		err := rows.Scan(
+			&hasCategory, &c.ID, &c.EstablishmentID, &c.ParentID, &c.Name, &c.Description, &c.ImageKey, &c.AltText, &c.BannerKey,
+			&hasProduct, &p.ID, &p.EstablishmentID, &p.CategoryID, &p.Name, &p.Description, &p.PriceCents, &p.ImageKey, &p.AltText, &p.BannerKey, &p.IsActive, pq.Array(&p.FulfillmentTypes), &p.Stock, &p.Barcode, &custom,
+		)
+		if err != nil {
+			mw.abort(err)
+		}
+		if hasCategory {
+			if len(mw.open) == 0 || mw.open[len(mw.open)-1].id != c.ID {
+				q.finishCategory(&c)
+				mw.openCategory(c)
+			}
+		} else {
+			mw.startUncategorized()
+		}
+		if hasProduct {
+			q.finishProduct(&p, custom)
+			mw.product(p)
+		}
+	}
+	if err := rows.Err(); err != nil {
+		mw.abort(err)
+	}
+	mw.startUncategorized()
+	mw.raw("]}\n")
+}
+
+// menuWriter tracks where streamMenu is in the nested categories.
+type menuWriter struct {
+	w    http.ResponseWriter
+	open []openCategory
+	// roots counts top-level categories written.
+	roots         int
+	uncategorized bool
+	// products counts products in the innermost open list.
+	products int
+}
+
+type openCategory struct {
+	id       string
+	children int
+	// inChildren is set once the category's products are closed.
+	inChildren bool
+}
+
+func (mw *menuWriter) raw(s string) {
+	if _, err := io.WriteString(mw.w, s); err != nil {
+		mw.abort(err)
+	}
+}
+
+func (mw *menuWriter) value(v any) {
+	data, err := json.Marshal(v)
+	if err != nil {
+		mw.abort(err)
+	}
+	if _, err := mw.w.Write(data); err != nil {
+		mw.abort(err)
+	}
+}
+
+func (mw *menuWriter) abort(err error) {
+	log.Printf("menu stream: %v", err)
+	panic(http.ErrAbortHandler)
+}
+
+// openCategory closes the open categories that are not c's ancestors and
+// starts c, leaving its products list open.
+func (mw *menuWriter) openCategory(c ProductCategory) {
+	for len(mw.open) > 0 && (c.ParentID == nil || mw.open[len(mw.open)-1].id != *c.ParentID) {
+		mw.closeCategory()
+	}
+	if len(mw.open) == 0 {
+		if mw.roots > 0 {
+			mw.raw(",")
+		}
+		mw.roots++
+	} else {
+		parent := &mw.open[len(mw.open)-1]
+		if !parent.inChildren {
+			mw.raw(`],"children":[`)
+			parent.inChildren = true
+		}
+		if parent.children > 0 {
+			mw.raw(",")
+		}
+		parent.children++
+	}
+	data, err := json.Marshal(c)
+	if err != nil {
+		mw.abort(err)
+	}
+	// Reopen the encoded category to append the lists MenuCategory adds.
+	mw.raw(string(data[:len(data)-1]) + `,"products":[`)
+	mw.open = append(mw.open, openCategory{id: c.ID})
+	mw.products = 0
+}
+
+func (mw *menuWriter) closeCategory() {
+	c := mw.open[len(mw.open)-1]
+	if !c.inChildren {
+		mw.raw(`],"children":[`)
+	}
+	mw.raw("]}")
+	mw.open = mw.open[:len(mw.open)-1]
+}
+
+// startUncategorized closes the category tree and opens the uncategorized
+// list, once.
+func (mw *menuWriter) startUncategorized() {
+	if mw.uncategorized {
+		return
+	}
+	for len(mw.open) > 0 {
+		mw.closeCategory()
+	}
+	mw.raw(`],"uncategorized":[`)
+	mw.uncategorized = true
+	mw.products = 0
+}
+
+func (mw *menuWriter) product(p Product) {
+	if mw.products > 0 {
+		mw.raw(",")
+	}
+	mw.products++
+	mw.value(p)
+}
+
+func buildCategoryTree(order []*MenuCategory, byID map[string]*MenuCategory) []MenuCategory {
+	children := map[string][]*MenuCategory{}
+	var roots []*MenuCategory
+	for _, c := range order {
+		if c.ParentID != nil && byID[*c.ParentID] != nil {
+			children[*c.ParentID] = append(children[*c.ParentID], c)
+			continue
+		}
+		roots = append(roots, c)
+	}
+	var build func(nodes []*MenuCategory) []MenuCategory
+	build = func(nodes []*MenuCategory) []MenuCategory {
+		out := []MenuCategory{}
+		for _, n := range nodes {
+			c := *n
+			c.Children = build(children[n.ID])
+			out = append(out, c)
+		}
+		return out
+	}
+	return build(roots)
+}
@@ -0,0 +1,37 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+func BenchmarkMenu(b *testing.B) {
+	db := openTestDB(b)
+	t := seedTestTenant(b, db, 200, 0)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rec := httptest.NewRecorder()
+		getMenu(rec, httptest.NewRequest(http.MethodGet, "/establishments/"+t.EstablishmentID+"/menu", nil), db, t.EstablishmentID)
+		if rec.Code != http.StatusOK {
+			b.Fatalf("status %d: %s", rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestMenuQueryCount(t *testing.T) {
+	db, queries := openCountingTestDB(t)
+	count := func(products int) int64 {
+		tenant := seedTestTenant(t, db, products, 0)
+		queries.Store(0)
+		rec := httptest.NewRecorder()
+		getMenu(rec, httptest.NewRequest(http.MethodGet, "/establishments/"+tenant.EstablishmentID+"/menu", nil), db, tenant.EstablishmentID)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", rec.Code, rec.Body)
+		}
+		return queries.Load()
+	}
+	if small, large := count(2), count(40); small != large {
+		t.Fatalf("menu with 40 products took %d queries, 2 products took %d", large, small)
+	}
+}
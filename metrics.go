@@ -0,0 +1,101 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// summary accumulates count and sum of observations per label value, which is
+// enough to derive averages in Prometheus.
+type summary struct {
+	name, help, label string
+	mu                sync.Mutex
+	count             map[string]uint64
+	sum               map[string]float64
+}
+
+func newSummary(name, help, label string) *summary {
+	s := &summary{name: name, help: help, label: label, count: map[string]uint64{}, sum: map[string]float64{}}
+	registerMetric(s)
+	return s
+}
+
+func (s *summary) Observe(labelValue string, v float64) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.count[labelValue]++
+	s.sum[labelValue] += v
+}
+
+func (s *summary) write(b *strings.Builder) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s summary\n", s.name, s.help, s.name)
+	keys := make([]string, 0, len(s.count))
+	for k := range s.count {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(b, "%s_sum{%s=%q} %g\n", s.name, s.label, k, s.sum[k])
+		fmt.Fprintf(b, "%s_count{%s=%q} %d\n", s.name, s.label, k, s.count[k])
+	}
+}
+
+// counter counts events per label value.
+type counter struct {
+	name, help, label string
+	mu                sync.Mutex
+	values            map[string]uint64
+}
+
+func newCounter(name, help, label string) *counter {
+	c := &counter{name: name, help: help, label: label, values: map[string]uint64{}}
+	registerMetric(c)
+	return c
+}
+
+func (c *counter) Inc(labelValue string) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.values[labelValue]++
+}
+
+func (c *counter) write(b *strings.Builder) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	fmt.Fprintf(b, "# HELP %s %s\n# TYPE %s counter\n", c.name, c.help, c.name)
+	keys := make([]string, 0, len(c.values))
+	for k := range c.values {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	for _, k := range keys {
+		fmt.Fprintf(b, "%s{%s=%q} %d\n", c.name, c.label, k, c.values[k])
+	}
+}
+
+var (
+	metricsMu sync.Mutex
+	metrics   []interface{ write(*strings.Builder) }
+)
+
+func registerMetric(m interface{ write(*strings.Builder) }) {
+	metricsMu.Lock()
+	defer metricsMu.Unlock()
+	metrics = append(metrics, m)
+}
+
+func metricsHandler(w http.ResponseWriter, r *http.Request) {
+	var b strings.Builder
+	metricsMu.Lock()
+	for _, m := range metrics {
+		m.write(&b)
+	}
+	metricsMu.Unlock()
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	w.Write([]byte(b.String()))
+}
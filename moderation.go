@@ -0,0 +1,117 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+)
+
+type ModerationVerdict struct {
+	Allowed bool   `json:"allowed"`
+	Reason  string `json:"reason,omitempty"`
+}
+
+// ImageModerator decides whether an uploaded image may be published.
+type ImageModerator interface {
+	Name() string
+	Moderate(ctx context.Context, contentType string, data []byte) (ModerationVerdict, error)
+}
+
+// imageModerator is nil when uploads are not moderated.
+var imageModerator ImageModerator
+
+var uploadsRejected = newCounter("uploads_rejected_total", "Image uploads rejected by validation or moderation.", "reason")
+
+// newImageModeratorFromEnv picks the provider from IMAGE_MODERATION_PROVIDER:
+// "webhook" posts each image to IMAGE_MODERATION_URL, "google_vision" uses
+// SafeSearch with GOOGLE_VISION_API_KEY.
+func newImageModeratorFromEnv() ImageModerator {
+	switch os.Getenv("IMAGE_MODERATION_PROVIDER") {
+	case "webhook":
+		return webhookModerator{url: os.Getenv("IMAGE_MODERATION_URL"), secret: os.Getenv("IMAGE_MODERATION_SECRET")}
+	case "google_vision":
+		return visionModerator{apiKey: os.Getenv("GOOGLE_VISION_API_KEY")}
+	case "":
+		return nil
+	default:
+		log.Printf("unknown IMAGE_MODERATION_PROVIDER %q, uploads will not be moderated", os.Getenv("IMAGE_MODERATION_PROVIDER"))
+		return nil
+	}
+}
+
+// webhookModerator POSTs the raw image, signed like outbox webhooks, and
+// expects a ModerationVerdict back.
+type webhookModerator struct {
+	url, secret string
+}
+
+func (webhookModerator) Name() string { return "webhook" }
+
+func (m webhookModerator) Moderate(ctx context.Context, contentType string, data []byte) (ModerationVerdict, error) {
+	var v ModerationVerdict
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, m.url, bytes.NewReader(data))
+	if err != nil {
+		return v, err
+	}
+	mac := hmac.New(sha256.New, []byte(m.secret))
+	mac.Write(data)
+	req.Header.Set("Content-Type", contentType)
+	req.Header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return v, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return v, fmt.Errorf("moderation webhook responded %d", resp.StatusCode)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&v)
+	return v, err
+}
+
+// visionModerator rejects images Google Cloud Vision rates as likely adult,
+// violent or racy content.
+type visionModerator struct {
+	apiKey string
+}
+
+func (visionModerator) Name() string { return "google_vision" }
+
+func (m visionModerator) Moderate(ctx context.Context, _ string, data []byte) (ModerationVerdict, error) {
+	payload := map[string]any{"requests": []any{map[string]any{
+		"image":    map[string]string{"content": base64.StdEncoding.EncodeToString(data)},
+		"features": []map[string]string{{"type": "SAFE_SEARCH_DETECTION"}},
+	}}}
+	var body struct {
+		Responses []struct {
+			SafeSearch map[string]string `json:"safeSearchAnnotation"`
+			Error      *struct {
+				Message string `json:"message"`
+			} `json:"error"`
+		} `json:"responses"`
+	}
+	if err := postJSON(ctx, "https://vision.googleapis.com/v1/images:annotate?key="+m.apiKey, nil, payload, &body); err != nil {
+		return ModerationVerdict{}, err
+	}
+	if len(body.Responses) == 0 {
+		return ModerationVerdict{}, fmt.Errorf("google_vision: empty response")
+	}
+	if e := body.Responses[0].Error; e != nil {
+		return ModerationVerdict{}, fmt.Errorf("google_vision: %s", e.Message)
+	}
+	for _, category := range []string{"adult", "violence", "racy"} {
+		switch body.Responses[0].SafeSearch[category] {
+		case "LIKELY", "VERY_LIKELY":
+			return ModerationVerdict{Allowed: false, Reason: category}, nil
+		}
+	}
+	return ModerationVerdict{Allowed: true}, nil
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+type OAuthIdentity struct {
+	Subject       string
+	Email         string
+	EmailVerified bool
+	Name          string
+}
+
+type OAuthProvider interface {
+	AuthorizeURL(redirectURI, state string) string
+	Exchange(ctx context.Context, code, redirectURI string) (*OAuthIdentity, error)
+}
+
+var oauthProviders = map[string]OAuthProvider{}
+
+type googleProvider struct {
+	clientID     string
+	clientSecret string
+}
+
+func (g googleProvider) AuthorizeURL(redirectURI, state string) string {
+	q := url.Values{
+		"client_id":     {g.clientID},
+		"redirect_uri":  {redirectURI},
+		"response_type": {"code"},
+		"scope":         {"openid email profile"},
+		"state":         {state},
+	}
+	return "https://accounts.google.com/o/oauth2/v2/auth?" + q.Encode()
+}
+
+func (g googleProvider) Exchange(ctx context.Context, code, redirectURI string) (*OAuthIdentity, error) {
+	form := url.Values{
+		"code":          {code},
+		"client_id":     {g.clientID},
+		"client_secret": {g.clientSecret},
+		"redirect_uri":  {redirectURI},
+		"grant_type":    {"authorization_code"},
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, "https://oauth2.googleapis.com/token", strings.NewReader(form.Encode()))
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("google token exchange: status %d", resp.StatusCode)
+	}
+	var tok struct {
+		AccessToken string `json:"access_token"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&tok); err != nil {
+		return nil, err
+	}
+
+	req, err = http.NewRequestWithContext(ctx, http.MethodGet, "https://openidconnect.googleapis.com/v1/userinfo", nil)
+	if err != nil {
+		return nil, err
+	}
+	req.Header.Set("Authorization", "Bearer "+tok.AccessToken)
+	resp, err = httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("google userinfo: status %d", resp.StatusCode)
+	}
+	var info struct {
+		Sub           string `json:"sub"`
+		Email         string `json:"email"`
+		EmailVerified bool   `json:"email_verified"`
+		Name          string `json:"name"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&info); err != nil {
+		return nil, err
+	}
+	if info.Sub == "" {
+		return nil, errors.New("google userinfo: missing subject")
+	}
+	return &OAuthIdentity{Subject: info.Sub, Email: strings.ToLower(info.Email), EmailVerified: info.EmailVerified, Name: info.Name}, nil
+}
+
+func oauthRoute(w http.ResponseWriter, r *http.Request, db *sql.DB, path string) {
+	name, action, _ := strings.Cut(path, "/")
+	p, ok := oauthProviders[name]
+	if !ok {
+		http.NotFound(w, nil)
+		return
+	}
+	switch {
+	case action == "authorize_url" && r.Method == http.MethodGet:
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(map[string]string{
+			"url": p.AuthorizeURL(r.URL.Query().Get("redirect_uri"), r.URL.Query().Get("state")),
+		})
+	case action == "token" && r.Method == http.MethodPost:
+		oauthToken(w, r, db, name, p)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func oauthToken(w http.ResponseWriter, r *http.Request, db *sql.DB, provider string, p OAuthProvider) {
+	var req struct {
+		Code        string `json:"code"`
+		RedirectURI string `json:"redirect_uri"`
+		AccountType string `json:"account_type"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.AccountType == "" {
+		req.AccountType = "owner"
+	}
+	if req.AccountType != "owner" && req.AccountType != "customer" {
+		http.Error(w, "account_type must be owner or customer", http.StatusBadRequest)
+		return
+	}
+
+	ident, err := p.Exchange(r.Context(), req.Code, req.RedirectURI)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+
+	accountID, err := linkOAuthIdentity(db, provider, req.AccountType, ident)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !requireLegalAcceptance(w, r, db, req.AccountType, accountID) {
+		return
+	}
+	var resp any
+	if req.AccountType == "owner" {
+		// Owners go through the same TOTP challenge and enrollment policy
+		// as password logins.
+		resp, err = ownerLoginResponse(db, r, accountID)
+	} else {
+		resp, err = issueAccessToken(accountID, req.AccountType)
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+// linkOAuthIdentity resolves the account for a provider identity. Known
+// identities map straight to their account; otherwise an existing account with
+// the same verified email is linked, or a new passwordless account is created.
+func linkOAuthIdentity(db *sql.DB, provider, accountType string, ident *OAuthIdentity) (string, error) {
+	table, column := "owners", "owner_id"
+	if accountType == "customer" {
+		table, column = "customers", "customer_id"
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return "", err
+	}
+	defer tx.Rollback()
+
+	var id string
+	err = tx.QueryRow(
+		`SELECT `+column+` FROM auth_identities WHERE provider=$1 AND subject=$2 AND `+column+` IS NOT NULL`,
+		provider, ident.Subject,
+	).Scan(&id)
+	if err == nil {
+		return id, tx.Commit()
+	}
+	if err != sql.ErrNoRows {
+		return "", err
+	}
+	if !ident.EmailVerified || ident.Email == "" {
+		return "", errors.New("provider did not return a verified email")
+	}
+
+	err = tx.QueryRow(`SELECT id FROM `+table+` WHERE email=$1`, ident.Email).Scan(&id)
+	if err == sql.ErrNoRows {
+		name := ident.Name
+		if name == "" {
+			name = ident.Email
+		}
+		err = tx.QueryRow(
+			`INSERT INTO `+table+` (name, email, password_hash) VALUES ($1,$2,'') RETURNING id`,
+			name, ident.Email,
+		).Scan(&id)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	_, err = tx.Exec(
+		`INSERT INTO auth_identities (provider, subject, email, `+column+`) VALUES ($1,$2,$3,$4)`,
+		provider, ident.Subject, ident.Email, id,
+	)
+	if err != nil {
+		return "", err
+	}
+	return id, tx.Commit()
+}
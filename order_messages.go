@@ -0,0 +1,240 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Each order has a message thread between the customer and the
+// establishment. It closes by itself once the order is completed, cancelled,
+// failed or delivered. New messages reach the customer as a push or WhatsApp
+// notification and the establishment through the order.message event.
+
+const maxOrderMessage = 1000
+
+type OrderMessage struct {
+	ID      string `json:"id"`
+	OrderID string `json:"order_id"`
+	// Sender is "customer" or "establishment".
+	Sender    string     `json:"sender"`
+	Body      string     `json:"body"`
+	ReadAt    *time.Time `json:"read_at"`
+	CreatedAt time.Time  `json:"created_at"`
+}
+
+type OrderThread struct {
+	Messages []OrderMessage `json:"messages"`
+	// Unread counts messages from the other side that were unread before
+	// this request; fetching the thread marks them read.
+	Unread int  `json:"unread"`
+	Closed bool `json:"closed"`
+}
+
+// orderThreadAccess resolves who is asking about the order's thread: the
+// customer who placed it or staff of its establishment. ok is false after
+// an error has been written.
+func orderThreadAccess(w http.ResponseWriter, r *http.Request, db *sql.DB, orderID string) (sender, customerID, establishmentID string, closed, ok bool) {
+	err := db.QueryRow(
+		`SELECT o.customer_id, o.establishment_id,
+		   o.status IN ('COMPLETED','CANCELLED','FAILED') OR EXISTS (SELECT 1 FROM deliveries d WHERE d.order_id=o.id)
+		 FROM orders o WHERE o.id::text=$1`,
+		orderID,
+	).Scan(&customerID, &establishmentID, &closed)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, nil)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	c := currentClaims(r)
+	switch c.Typ {
+	case "customer":
+		if c.Sub != customerID {
+			http.NotFound(w, nil)
+			return
+		}
+		sender = "customer"
+	case "owner":
+		if !requireRole(w, r, db, establishmentID, "staff") {
+			return
+		}
+		sender = "establishment"
+	default:
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	return sender, customerID, establishmentID, closed, true
+}
+
+func orderMessagesRoute(w http.ResponseWriter, r *http.Request, db *sql.DB, orderID string) {
+	sender, customerID, establishmentID, closed, ok := orderThreadAccess(w, r, db, orderID)
+	if !ok {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		getOrderThread(w, db, orderID, sender, closed)
+	case http.MethodPost:
+		if closed {
+			http.Error(w, "the conversation closed with the order", http.StatusConflict)
+			return
+		}
+		var req struct {
+			Body string `json:"body"`
+			// TemplateID sends one of the establishment's reply templates
+			// instead of Body.
+			TemplateID string `json:"template_id"`
+			// Channel is how the customer is notified: "push" (the default)
+			// or "whatsapp".
+			Channel string `json:"channel"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if sender == "customer" && (req.TemplateID != "" || req.Channel != "") {
+			http.Error(w, "template_id and channel are for establishments", http.StatusUnprocessableEntity)
+			return
+		}
+		if req.Channel == "" {
+			req.Channel = "push"
+		}
+		if req.Channel != "push" && req.Channel != "whatsapp" {
+			http.Error(w, "channel must be push or whatsapp", http.StatusUnprocessableEntity)
+			return
+		}
+		if req.TemplateID != "" {
+			body, err := replyTemplateBody(db, establishmentID, req.TemplateID, orderID)
+			if err == sql.ErrNoRows {
+				http.Error(w, "reply template not found", http.StatusUnprocessableEntity)
+				return
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			req.Body = body
+		}
+		postOrderMessage(w, r, db, OrderMessage{OrderID: orderID, Sender: sender, Body: req.Body}, req.Channel, customerID, establishmentID)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func getOrderThread(w http.ResponseWriter, db *sql.DB, orderID, reader string, closed bool) {
+	t := OrderThread{Messages: []OrderMessage{}, Closed: closed}
+	rows, err := db.Query(
+		`SELECT id, order_id, sender, body, read_at, created_at FROM order_messages WHERE order_id=$1 ORDER BY created_at, id`,
+		orderID,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var m OrderMessage
+		if err := rows.Scan(&m.ID, &m.OrderID, &m.Sender, &m.Body, &m.ReadAt, &m.CreatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if m.Sender != reader && m.ReadAt == nil {
+			t.Unread++
+		}
+		t.Messages = append(t.Messages, m)
+	}
+	if t.Unread > 0 {
+		_, err := db.Exec(`UPDATE order_messages SET read_at=now() WHERE order_id=$1 AND sender<>$2 AND read_at IS NULL`, orderID, reader)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+// postOrderMessage stores the message and fans it out to the other side in
+// the same transaction.
+func postOrderMessage(w http.ResponseWriter, r *http.Request, db *sql.DB, m OrderMessage, channel, customerID, establishmentID string) {
+	m.Body = sanitizeText(m.Body)
+	if m.Body == "" {
+		http.Error(w, "body is required", http.StatusUnprocessableEntity)
+		return
+	}
+	if len([]rune(m.Body)) > maxOrderMessage {
+		http.Error(w, "body is too long", http.StatusUnprocessableEntity)
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	err = tx.QueryRow(
+		`INSERT INTO order_messages (order_id, sender, author_id, body) VALUES ($1,$2,$3,$4) RETURNING id, created_at`,
+		m.OrderID, m.Sender, currentClaims(r).Sub, m.Body,
+	).Scan(&m.ID, &m.CreatedAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if m.Sender == "establishment" {
+		payload, _ := json.Marshal(map[string]string{"order_id": m.OrderID, "message_id": m.ID, "body": m.Body})
+		if _, err := tx.Exec(`INSERT INTO notifications (customer_id, kind, channel, payload) VALUES ($1,'ORDER_MESSAGE',$2,$3)`, customerID, channel, payload); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	} else if err := enqueueEvent(tx, Event{Type: eventOrderMessage, OrderID: m.OrderID, EstablishmentID: establishmentID}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(m)
+}
+
+type UnreadThread struct {
+	OrderID       string    `json:"order_id"`
+	Unread        int       `json:"unread"`
+	LastMessageAt time.Time `json:"last_message_at"`
+}
+
+// listUnreadThreads lists the establishment's orders with customer messages
+// nobody on staff has read yet, most recent first.
+func listUnreadThreads(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	if !requireRole(w, r, db, establishmentID, "staff") {
+		return
+	}
+	rows, err := db.Query(
+		`SELECT m.order_id, COUNT(*), MAX(m.created_at) FROM order_messages m JOIN orders o ON o.id=m.order_id
+		 WHERE o.establishment_id=$1 AND m.sender='customer' AND m.read_at IS NULL
+		 GROUP BY m.order_id ORDER BY MAX(m.created_at) DESC LIMIT 200`,
+		establishmentID,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	list := []UnreadThread{}
+	for rows.Next() {
+		var t UnreadThread
+		if err := rows.Scan(&t.OrderID, &t.Unread, &t.LastMessageAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		list = append(list, t)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
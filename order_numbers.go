@@ -0,0 +1,43 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// nextOrderNumber assigns the next short order number for the establishment's
+// current local day. Numbers restart at 1 every day so they stay easy to call
+// out in the kitchen; the sequence row lock serializes concurrent checkouts of
+// the same establishment until the transaction ends.
+func nextOrderNumber(q queryer, establishmentID string) (string, int, error) {
+	loc, err := establishmentLocation(q, establishmentID)
+	if err != nil {
+		return "", 0, err
+	}
+	day := time.Now().In(loc).Format("2006-01-02")
+	var n int
+	err = q.QueryRow(
+		`INSERT INTO order_number_sequences (establishment_id, business_date, last_number) VALUES ($1, $2, 1)
+		 ON CONFLICT (establishment_id, business_date) DO UPDATE SET last_number = order_number_sequences.last_number + 1
+		 RETURNING last_number`,
+		establishmentID, day,
+	).Scan(&n)
+	return day, n, err
+}
+
+// formatOrderNumber renders an order number the way it is shown to staff and
+// customers, e.g. "#042".
+func formatOrderNumber(n int) string {
+	return fmt.Sprintf("#%03d", n)
+}
+
+// parseOrderNumber accepts "42", "042" or "#042".
+func parseOrderNumber(s string) (int, error) {
+	n, err := strconv.Atoi(strings.TrimPrefix(strings.TrimSpace(s), "#"))
+	if err != nil || n <= 0 {
+		return 0, fmt.Errorf("invalid order number %q", s)
+	}
+	return n, nil
+}
@@ -0,0 +1,582 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"time"
+)
+
+type OrderItem struct {
+	ProductID       string `json:"product_id"`
+	ProductName     string `json:"product_name"`
+	Quantity        int    `json:"quantity"`
+	UnitPriceCents  int64  `json:"unit_price_cents"`
+	TotalPriceCents int64  `json:"total_price_cents"`
+}
+
+type Order struct {
+	ID              string  `json:"id"`
+	CustomerID      string  `json:"customer_id"`
+	EstablishmentID string  `json:"establishment_id"`
+	CouponCode      *string `json:"coupon_code"`
+	LoyaltyPoints   int     `json:"loyalty_points"`
+	TotalCents      int64   `json:"total_cents"`
+	FulfillmentType string  `json:"fulfillment_type"`
+	DeliveryAddress string  `json:"delivery_address"`
+	// DeliveryFeeCents is included in TotalCents; DeliveryFeeDetails records
+	// the formula that produced it.
+	DeliveryFeeCents    int64           `json:"delivery_fee_cents"`
+	DeliveryFeeDetails  json.RawMessage `json:"delivery_fee_details"`
+	EstimatedDeliveryAt *time.Time      `json:"estimated_delivery_at"`
+	deliveryTo          Address
+	PaymentMethod       string     `json:"payment_method"`
+	ChangeForCents      *int64     `json:"change_for_cents"`
+	SlotID              *string    `json:"slot_id"`
+	ScheduledFor        *time.Time `json:"scheduled_for"`
+	Status              string     `json:"status"`
+	OrderedAt           time.Time  `json:"ordered_at"`
+	// OrderNumber restarts every BusinessDate, the establishment's local day
+	// the order was placed; DisplayNumber is its printable form.
+	BusinessDate  string      `json:"business_date"`
+	OrderNumber   int         `json:"order_number"`
+	DisplayNumber string      `json:"display_number"`
+	Items         []OrderItem `json:"items"`
+	// Payment is only set in the checkout response, for orders charged online.
+	Payment *Payment `json:"payment,omitempty"`
+	// StoreCreditCents is the part of TotalCents paid with store credit.
+	StoreCreditCents int64 `json:"store_credit_cents"`
+	// GiftCardCents is the part of TotalCents paid with gift cards.
+	GiftCardCents int64 `json:"gift_card_cents"`
+	// RiskScore is the fraud score from checkout, 0 to 100; orders at or
+	// above the review threshold wait for manual acceptance.
+	RiskScore int `json:"risk_score"`
+	// DeliveryProof is what the courier submitted on delivery, if anything.
+	DeliveryProof *DeliveryProof `json:"delivery_proof,omitempty"`
+}
+
+// amountDue is what is left for the payment method to cover.
+func (o *Order) amountDue() int64 { return o.TotalCents - o.StoreCreditCents - o.GiftCardCents }
+
+type AmendmentOperation struct {
+	Action               string `json:"action"`
+	ProductID            string `json:"product_id"`
+	ReplacementProductID string `json:"replacement_product_id,omitempty"`
+	Quantity             int    `json:"quantity,omitempty"`
+}
+
+type OrderAmendment struct {
+	ID                 string               `json:"id"`
+	OrderID            string               `json:"order_id"`
+	Operations         []AmendmentOperation `json:"operations"`
+	Reason             string               `json:"reason"`
+	PreviousTotalCents int64                `json:"previous_total_cents"`
+	NewTotalCents      int64                `json:"new_total_cents"`
+	DeltaCents         int64                `json:"delta_cents"`
+	CreatedAt          time.Time            `json:"created_at"`
+}
+
+var errAmendment = errors.New("invalid amendment")
+
+func orderHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/orders/"), "/")
+		id := parts[0]
+		sub := ""
+		if len(parts) > 1 {
+			sub = parts[1]
+		}
+		switch {
+		case sub == "" && r.Method == http.MethodGet:
+			authenticate(db, func(w http.ResponseWriter, r *http.Request) { getOrder(w, r, db, id) })(w, r)
+		case sub == "items" && r.Method == http.MethodPatch:
+			authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) {
+				if requireOrderRole(w, r, db, id, "manager") {
+					amendOrderItems(w, r, db, id)
+				}
+			})(w, r)
+		case sub == "amendments" && r.Method == http.MethodGet:
+			authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) {
+				if requireOrderRole(w, r, db, id, "staff") {
+					listOrderAmendments(w, db, id)
+				}
+			})(w, r)
+		case sub == "payments" && r.Method == http.MethodGet:
+			authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) {
+				if requireOrderRole(w, r, db, id, "staff") {
+					listPayments(w, db, id)
+				}
+			})(w, r)
+		case sub == "payments" && r.Method == http.MethodPost:
+			authenticateCustomer(db, func(w http.ResponseWriter, r *http.Request) { retryPayment(w, r, db, id) })(w, r)
+		case sub == "tracking" && r.Method == http.MethodGet:
+			authenticateCustomer(db, func(w http.ResponseWriter, r *http.Request) { orderTracking(w, r, db, id) })(w, r)
+		case sub == "messages":
+			authenticate(db, func(w http.ResponseWriter, r *http.Request) { orderMessagesRoute(w, r, db, id) })(w, r)
+		case sub == "risk" && r.Method == http.MethodGet:
+			authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { getOrderRisk(w, r, db, id) })(w, r)
+		case sub == "delivery_rating" && r.Method == http.MethodPost:
+			deliveryRatingRoute(w, r, db, id)
+		case sub == "sla" && r.Method == http.MethodGet:
+			authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { getOrderSLA(w, r, db, id) })(w, r)
+		case sub == "dispatch":
+			authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { orderDispatchRoute(w, r, db, id) })(w, r)
+		case sub == "accept" && r.Method == http.MethodPost:
+			authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { manualAcceptOrder(w, r, db, id) })(w, r)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	}
+}
+
+// requireOrderRole is requireRole on the order's establishment; it writes a
+// 404 for unknown orders.
+func requireOrderRole(w http.ResponseWriter, r *http.Request, db *sql.DB, orderID, minRole string) bool {
+	var establishmentID string
+	err := db.QueryRow(`SELECT establishment_id FROM orders WHERE id=$1`, orderID).Scan(&establishmentID)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, nil)
+		return false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	return requireRole(w, r, db, establishmentID, minRole)
+}
+
+// getOrder shows an order to the customer who placed it and to the
+// establishment's staff; other customers get a 404.
+func getOrder(w http.ResponseWriter, r *http.Request, db *sql.DB, id string) {
+	var o Order
+	var feeDetails []byte
+	err := db.QueryRow(`SELECT id, customer_id, establishment_id, coupon_code, loyalty_points, total_cents, fulfillment_type, delivery_address, delivery_fee_cents, delivery_fee_details, estimated_delivery_at, payment_method, change_for_cents, slot_id, scheduled_for, status, ordered_at, business_date::text, order_number, store_credit_cents, gift_card_cents, risk_score FROM orders WHERE id=$1`, id).Scan(
+		&o.ID, &o.CustomerID, &o.EstablishmentID, &o.CouponCode, &o.LoyaltyPoints, &o.TotalCents, &o.FulfillmentType, &o.DeliveryAddress, &o.DeliveryFeeCents, &feeDetails, &o.EstimatedDeliveryAt, &o.PaymentMethod, &o.ChangeForCents, &o.SlotID, &o.ScheduledFor, &o.Status, &o.OrderedAt, &o.BusinessDate, &o.OrderNumber, &o.StoreCreditCents, &o.GiftCardCents, &o.RiskScore,
+	)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, nil)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	switch c := currentClaims(r); c.Typ {
+	case "customer":
+		if c.Sub != o.CustomerID {
+			http.NotFound(w, nil)
+			return
+		}
+	case "owner":
+		if !requireRole(w, r, db, o.EstablishmentID, "staff") {
+			return
+		}
+	default:
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	o.DeliveryFeeDetails = feeDetails
+	o.DisplayNumber = formatOrderNumber(o.OrderNumber)
+
+	items, err := loadOrderItems(db, []string{id})
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	o.Items = append([]OrderItem{}, items[id]...)
+	if o.DeliveryProof, err = loadDeliveryProof(db, id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(o)
+}
+
+func amendOrderItems(w http.ResponseWriter, r *http.Request, db *sql.DB, id string) {
+	var req struct {
+		Operations []AmendmentOperation `json:"operations"`
+		Reason     string               `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.Operations) == 0 {
+		http.Error(w, "operations must not be empty", http.StatusBadRequest)
+		return
+	}
+	req.Reason = sanitizeText(req.Reason)
+	if req.Reason == "" {
+		http.Error(w, "reason is required", http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var customerID, establishmentID, status string
+	var total int64
+	err = tx.QueryRow(`SELECT customer_id, establishment_id, status, total_cents FROM orders WHERE id=$1 FOR UPDATE`, id).Scan(
+		&customerID, &establishmentID, &status, &total,
+	)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, nil)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if status != "PENDING" && status != "PROCESSING" {
+		http.Error(w, "order can no longer be amended", http.StatusConflict)
+		return
+	}
+
+	before, err := orderItemsTotal(tx, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, op := range req.Operations {
+		if err := applyAmendment(tx, id, establishmentID, op); err != nil {
+			if errors.Is(err, errAmendment) {
+				http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+				return
+			}
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	after, err := orderItemsTotal(tx, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if after == 0 {
+		http.Error(w, "order must keep at least one item; cancel it instead", http.StatusUnprocessableEntity)
+		return
+	}
+
+	a := OrderAmendment{
+		OrderID:            id,
+		Operations:         req.Operations,
+		Reason:             req.Reason,
+		PreviousTotalCents: total,
+		DeltaCents:         after - before,
+	}
+	a.NewTotalCents = total + a.DeltaCents
+	if a.NewTotalCents < 0 {
+		a.NewTotalCents = 0
+	}
+
+	if _, err := tx.Exec(`UPDATE orders SET total_cents=$1, updated_at=now() WHERE id=$2`, a.NewTotalCents, id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ops, _ := json.Marshal(a.Operations)
+	err = tx.QueryRow(
+		`INSERT INTO order_amendments (order_id, operations, reason, previous_total_cents, new_total_cents, delta_cents) VALUES ($1,$2,$3,$4,$5,$6) RETURNING id, created_at`,
+		id, ops, a.Reason, a.PreviousTotalCents, a.NewTotalCents, a.DeltaCents,
+	).Scan(&a.ID, &a.CreatedAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if delta := a.NewTotalCents - a.PreviousTotalCents; delta != 0 {
+		kind, amount := "charge", delta
+		if delta < 0 {
+			kind, amount = "refund", -delta
+		}
+		_, err = tx.Exec(
+			`INSERT INTO payment_adjustments (order_id, amendment_id, kind, amount_cents) VALUES ($1,$2,$3,$4)`,
+			id, a.ID, kind, amount,
+		)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+
+	payload, _ := json.Marshal(a)
+	if _, err := tx.Exec(`INSERT INTO notifications (customer_id, kind, payload) VALUES ($1,'ORDER_AMENDED',$2)`, customerID, payload); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec(`INSERT INTO order_events (order_id, event_type, payload) VALUES ($1,'AMENDED',$2)`, id, payload); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(a)
+}
+
+func orderItemsTotal(tx *sql.Tx, orderID string) (int64, error) {
+	var sum int64
+	err := tx.QueryRow(`SELECT COALESCE(SUM(total_price_cents),0) FROM order_items WHERE order_id=$1`, orderID).Scan(&sum)
+	return sum, err
+}
+
+func applyAmendment(tx *sql.Tx, orderID, establishmentID string, op AmendmentOperation) error {
+	switch op.Action {
+	case "add":
+		if op.Quantity <= 0 {
+			return fmt.Errorf("%w: add requires a positive quantity", errAmendment)
+		}
+		return addOrderItem(tx, orderID, establishmentID, op.ProductID, op.Quantity)
+	case "remove":
+		var current int
+		err := tx.QueryRow(`SELECT quantity FROM order_items WHERE order_id=$1 AND product_id=$2`, orderID, op.ProductID).Scan(&current)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("%w: product %s is not in the order", errAmendment, op.ProductID)
+		}
+		if err != nil {
+			return err
+		}
+		if op.Quantity > 0 && op.Quantity < current {
+			_, err = tx.Exec(
+				`UPDATE order_items SET quantity=quantity-$1, total_price_cents=(quantity-$1)*unit_price_cents WHERE order_id=$2 AND product_id=$3`,
+				op.Quantity, orderID, op.ProductID,
+			)
+			if err != nil {
+				return err
+			}
+			return restoreStock(tx, establishmentID, op.ProductID, op.Quantity)
+		}
+		if _, err = tx.Exec(`DELETE FROM order_items WHERE order_id=$1 AND product_id=$2`, orderID, op.ProductID); err != nil {
+			return err
+		}
+		return restoreStock(tx, establishmentID, op.ProductID, current)
+	case "replace":
+		if op.ReplacementProductID == "" {
+			return fmt.Errorf("%w: replace requires replacement_product_id", errAmendment)
+		}
+		var current int
+		err := tx.QueryRow(`DELETE FROM order_items WHERE order_id=$1 AND product_id=$2 RETURNING quantity`, orderID, op.ProductID).Scan(&current)
+		if err == sql.ErrNoRows {
+			return fmt.Errorf("%w: product %s is not in the order", errAmendment, op.ProductID)
+		}
+		if err != nil {
+			return err
+		}
+		if err := restoreStock(tx, establishmentID, op.ProductID, current); err != nil {
+			return err
+		}
+		qty := op.Quantity
+		if qty <= 0 {
+			qty = current
+		}
+		return addOrderItem(tx, orderID, establishmentID, op.ReplacementProductID, qty)
+	default:
+		return fmt.Errorf("%w: unknown action %q", errAmendment, op.Action)
+	}
+}
+
+func addOrderItem(tx *sql.Tx, orderID, establishmentID, productID string, qty int) error {
+	var price int64
+	var name string
+	err := tx.QueryRow(
+		`SELECT price_cents, name FROM products
+		 WHERE id=$1 AND establishment_id=$2 AND is_active AND (SELECT fulfillment_type FROM orders WHERE id=$3) = ANY(fulfillment_types)`,
+		productID, establishmentID, orderID,
+	).Scan(&price, &name)
+	if err == sql.ErrNoRows {
+		return fmt.Errorf("%w: product %s is not available", errAmendment, productID)
+	}
+	if err != nil {
+		return err
+	}
+	if err := takeStock(tx, establishmentID, productID, qty); errors.Is(err, errOutOfStock) {
+		return fmt.Errorf("%w: product %s is out of stock", errAmendment, productID)
+	} else if err != nil {
+		return err
+	}
+	_, err = tx.Exec(
+		`INSERT INTO order_items (order_id, product_id, product_name, quantity, unit_price_cents, total_price_cents) VALUES ($1,$2,$3,$4,$5,$6)
+		 ON CONFLICT (order_id, product_id) DO UPDATE SET quantity=order_items.quantity+EXCLUDED.quantity, total_price_cents=(order_items.quantity+EXCLUDED.quantity)*order_items.unit_price_cents`,
+		orderID, productID, name, qty, price, price*int64(qty),
+	)
+	return err
+}
+
+func listOrderAmendments(w http.ResponseWriter, db *sql.DB, id string) {
+	rows, err := db.Query(
+		`SELECT id, order_id, operations, reason, previous_total_cents, new_total_cents, delta_cents, created_at FROM order_amendments WHERE order_id=$1 ORDER BY created_at`,
+		id,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	list := []OrderAmendment{}
+	for rows.Next() {
+		var a OrderAmendment
+		var ops []byte
+		if err := rows.Scan(&a.ID, &a.OrderID, &ops, &a.Reason, &a.PreviousTotalCents, &a.NewTotalCents, &a.DeltaCents, &a.CreatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.Unmarshal(ops, &a.Operations)
+		list = append(list, a)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+type OrderEvent struct {
+	ID         string          `json:"id"`
+	OrderID    string          `json:"order_id"`
+	EventType  string          `json:"event_type"`
+	Payload    json.RawMessage `json:"payload"`
+	OccurredAt time.Time       `json:"occurred_at"`
+}
+
+// listOrders pages through the caller's orders: customers see their own,
+// staff see an establishment's via ?establishment_id=. Items of the whole
+// page are loaded with one query.
+func listOrders(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	cursor, limit, err := pageParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c := currentClaims(r)
+	column, value := "customer_id", c.Sub
+	switch c.Typ {
+	case "customer":
+	case "owner":
+		column, value = "establishment_id", r.URL.Query().Get("establishment_id")
+		if value == "" {
+			http.Error(w, "establishment_id is required", http.StatusBadRequest)
+			return
+		}
+		if !requireRole(w, r, db, value, "staff") {
+			return
+		}
+	default:
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return
+	}
+	var number int
+	if v := r.URL.Query().Get("number"); v != "" {
+		if number, err = parseOrderNumber(v); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+	}
+	date := r.URL.Query().Get("date")
+	if _, err := time.Parse("2006-01-02", date); date != "" && err != nil {
+		http.Error(w, "date must be YYYY-MM-DD", http.StatusBadRequest)
+		return
+	}
+	at, id := keysetArgs(cursor)
+	rows, err := db.Query(
+		`SELECT id, customer_id, establishment_id, coupon_code, loyalty_points, total_cents, fulfillment_type, delivery_address, delivery_fee_cents, delivery_fee_details, estimated_delivery_at, payment_method, change_for_cents, slot_id, scheduled_for, status, ordered_at, business_date::text, order_number
+		 FROM orders WHERE `+column+`=$1 AND ($2='' OR status=$2) AND (ordered_at, id) < ($3, $4::uuid)
+		   AND ($6=0 OR order_number=$6) AND ($7='' OR business_date::text=$7)
+		 ORDER BY ordered_at DESC, id DESC LIMIT $5`,
+		value, r.URL.Query().Get("status"), at, id, limit+1, number, date,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	list := []Order{}
+	for rows.Next() {
+		var o Order
+		var feeDetails []byte
+		if err := rows.Scan(&o.ID, &o.CustomerID, &o.EstablishmentID, &o.CouponCode, &o.LoyaltyPoints, &o.TotalCents, &o.FulfillmentType, &o.DeliveryAddress, &o.DeliveryFeeCents, &feeDetails, &o.EstimatedDeliveryAt, &o.PaymentMethod, &o.ChangeForCents, &o.SlotID, &o.ScheduledFor, &o.Status, &o.OrderedAt, &o.BusinessDate, &o.OrderNumber); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		o.DeliveryFeeDetails = feeDetails
+		o.DisplayNumber = formatOrderNumber(o.OrderNumber)
+		list = append(list, o)
+	}
+	ids := make([]string, len(list))
+	for i, o := range list {
+		ids[i] = o.ID
+	}
+	items, err := loadOrderItems(db, ids)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i := range list {
+		list[i].Items = append([]OrderItem{}, items[list[i].ID]...)
+	}
+	page := newPage(list, limit, func(o Order) pageCursor { return pageCursor{o.OrderedAt, o.ID} })
+	if page.NextCursor != nil {
+		w.Header().Set("X-Next-Cursor", *page.NextCursor)
+	}
+	respond(w, r, "orders", page)
+}
+
+func orderEventsHandler(db *sql.DB) http.HandlerFunc {
+	return authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		establishmentID := r.URL.Query().Get("establishment_id")
+		if establishmentID == "" {
+			http.Error(w, "establishment_id is required", http.StatusBadRequest)
+			return
+		}
+		if !requireRole(w, r, db, establishmentID, "staff") {
+			return
+		}
+		listOrderEvents(w, r, db, establishmentID)
+	})
+}
+
+func listOrderEvents(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	cursor, limit, err := pageParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	at, id := keysetArgs(cursor)
+	rows, err := db.Query(
+		`SELECT e.id, e.order_id, e.event_type, e.payload, e.occurred_at FROM order_events e JOIN orders o ON o.id=e.order_id
+		 WHERE o.establishment_id=$1 AND ($2='' OR e.order_id::text=$2) AND (e.occurred_at, e.id) < ($3, $4::uuid)
+		 ORDER BY e.occurred_at DESC, e.id DESC LIMIT $5`,
+		establishmentID, r.URL.Query().Get("order_id"), at, id, limit+1,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	list := []OrderEvent{}
+	for rows.Next() {
+		var e OrderEvent
+		var payload []byte
+		if err := rows.Scan(&e.ID, &e.OrderID, &e.EventType, &payload, &e.OccurredAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		e.Payload = payload
+		list = append(list, e)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(newPage(list, limit, func(e OrderEvent) pageCursor { return pageCursor{e.OccurredAt, e.ID} }))
+}
@@ -0,0 +1,48 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+)
+
+// customerRequest is a request made with a customer's access token.
+func customerRequest(method, target, customerID string) *http.Request {
+	r := httptest.NewRequest(method, target, nil)
+	return r.WithContext(context.WithValue(r.Context(), claimsKey{}, &Claims{Sub: customerID, Typ: "customer"}))
+}
+
+func BenchmarkListOrders(b *testing.B) {
+	db := openTestDB(b)
+	t := seedTestTenant(b, db, 5, 50)
+	b.ResetTimer()
+	for i := 0; i < b.N; i++ {
+		rec := httptest.NewRecorder()
+		listOrders(rec, customerRequest(http.MethodGet, "/orders?limit=50", t.CustomerID), db)
+		if rec.Code != http.StatusOK {
+			b.Fatalf("status %d: %s", rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestListOrdersQueryCount(t *testing.T) {
+	db, queries := openCountingTestDB(t)
+	tenant := seedTestTenant(t, db, 3, 1)
+	count := func() int64 {
+		queries.Store(0)
+		rec := httptest.NewRecorder()
+		listOrders(rec, customerRequest(http.MethodGet, "/orders?limit=50", tenant.CustomerID), db)
+		if rec.Code != http.StatusOK {
+			t.Fatalf("status %d: %s", rec.Code, rec.Body)
+		}
+		return queries.Load()
+	}
+	one := count()
+	for i := 0; i < 10; i++ {
+		placeTestOrder(t, db, tenant, true)
+	}
+	if many := count(); many != one {
+		t.Fatalf("listing 11 orders took %d queries, 1 order took %d", many, one)
+	}
+}
@@ -0,0 +1,177 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type LocationRevenue struct {
+	EstablishmentID    string `json:"establishment_id"`
+	Name               string `json:"name"`
+	Orders             int    `json:"orders"`
+	RevenueCents       int64  `json:"revenue_cents"`
+	AverageTicketCents int64  `json:"average_ticket_cents"`
+}
+
+type LocationPrice struct {
+	EstablishmentID string `json:"establishment_id"`
+	PriceCents      int    `json:"price_cents"`
+}
+
+type PriceComparison struct {
+	Name          string          `json:"name"`
+	CatalogID     *string         `json:"catalog_product_id"`
+	MinPriceCents int             `json:"min_price_cents"`
+	MaxPriceCents int             `json:"max_price_cents"`
+	Locations     []LocationPrice `json:"locations"`
+}
+
+type TopSeller struct {
+	Name         string  `json:"name"`
+	CatalogID    *string `json:"catalog_product_id"`
+	Quantity     int64   `json:"quantity"`
+	RevenueCents int64   `json:"revenue_cents"`
+	Locations    int     `json:"locations"`
+}
+
+// Products pushed from the catalog are matched by catalog id; local products
+// fall back to a case-insensitive name match.
+const productGroupKey = `COALESCE(p.catalog_product_id::text, lower(p.name))`
+
+func organizationReportRoute(w http.ResponseWriter, r *http.Request, db *sql.DB, orgID, name string) {
+	if !requireOrgRole(w, r, db, orgID, "member") {
+		return
+	}
+	loc, err := time.LoadLocation(defaultTimezone)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	from, to, err := reportRange(r, loc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var locations []string
+	if v := r.URL.Query().Get("locations"); v != "" {
+		locations = strings.Split(v, ",")
+	}
+	switch name {
+	case "revenue_by_location":
+		revenueByLocation(w, r, db, orgID, locations, from, to)
+	case "price_comparison":
+		priceComparison(w, r, db, orgID, locations)
+	case "top_sellers":
+		limit, _ := strconv.Atoi(r.URL.Query().Get("limit"))
+		if limit <= 0 || limit > 100 {
+			limit = 10
+		}
+		topSellers(w, r, db, orgID, locations, from, to, limit)
+	default:
+		http.NotFound(w, nil)
+	}
+}
+
+func revenueByLocation(w http.ResponseWriter, r *http.Request, db *sql.DB, orgID string, locations []string, from, to time.Time) {
+	rows, err := db.Query(
+		`SELECT e.id, e.name,
+		   (SELECT COUNT(*) FROM orders o WHERE o.establishment_id=e.id AND o.status='COMPLETED' AND o.ordered_at >= $3 AND o.ordered_at < $4)
+		     + (SELECT COALESCE(SUM(completed_orders),0) FROM order_daily_aggregates a WHERE a.establishment_id=e.id AND a.day >= ($3 AT TIME ZONE 'UTC' AT TIME ZONE e.timezone)::date AND a.day < ($4 AT TIME ZONE 'UTC' AT TIME ZONE e.timezone)::date) AS orders,
+		   (SELECT COALESCE(SUM(total_cents),0) FROM orders o WHERE o.establishment_id=e.id AND o.status='COMPLETED' AND o.ordered_at >= $3 AND o.ordered_at < $4)
+		     + (SELECT COALESCE(SUM(revenue_cents),0) FROM order_daily_aggregates a WHERE a.establishment_id=e.id AND a.day >= ($3 AT TIME ZONE 'UTC' AT TIME ZONE e.timezone)::date AND a.day < ($4 AT TIME ZONE 'UTC' AT TIME ZONE e.timezone)::date) AS revenue
+		 FROM establishments e
+		 WHERE e.organization_id=$1 AND (COALESCE(cardinality($2::uuid[]),0)=0 OR e.id = ANY($2::uuid[]))
+		 ORDER BY revenue DESC`,
+		orgID, pq.Array(locations), from, to,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	list := []LocationRevenue{}
+	for rows.Next() {
+		var l LocationRevenue
+		if err := rows.Scan(&l.EstablishmentID, &l.Name, &l.Orders, &l.RevenueCents); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if l.Orders > 0 {
+			l.AverageTicketCents = l.RevenueCents / int64(l.Orders)
+		}
+		list = append(list, l)
+	}
+	respond(w, r, "revenue_by_location", list)
+}
+
+func priceComparison(w http.ResponseWriter, r *http.Request, db *sql.DB, orgID string, locations []string) {
+	rows, err := db.Query(
+		`SELECT min(p.name), (array_agg(p.catalog_product_id::text))[1], MIN(p.price_cents), MAX(p.price_cents),
+		   json_agg(json_build_object('establishment_id', p.establishment_id, 'price_cents', p.price_cents) ORDER BY p.price_cents)
+		 FROM products p JOIN establishments e ON e.id=p.establishment_id
+		 WHERE e.organization_id=$1 AND p.is_active AND (COALESCE(cardinality($2::uuid[]),0)=0 OR e.id = ANY($2::uuid[]))
+		 GROUP BY `+productGroupKey+`
+		 HAVING COUNT(DISTINCT p.establishment_id) > 1
+		 ORDER BY MAX(p.price_cents)-MIN(p.price_cents) DESC, 1`,
+		orgID, pq.Array(locations),
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	list := []PriceComparison{}
+	for rows.Next() {
+		var c PriceComparison
+		var prices []byte
+		if err := rows.Scan(&c.Name, &c.CatalogID, &c.MinPriceCents, &c.MaxPriceCents, &prices); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := json.Unmarshal(prices, &c.Locations); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		list = append(list, c)
+	}
+	respond(w, r, "price_comparison", list)
+}
+
+func topSellers(w http.ResponseWriter, r *http.Request, db *sql.DB, orgID string, locations []string, from, to time.Time, limit int) {
+	rows, err := db.Query(
+		`SELECT min(p.name), (array_agg(p.catalog_product_id::text))[1], SUM(i.quantity), SUM(i.total_price_cents), COUNT(DISTINCT o.establishment_id)
+		 FROM order_items i
+		 JOIN orders o ON o.id=i.order_id
+		 JOIN products p ON p.id=i.product_id
+		 JOIN establishments e ON e.id=o.establishment_id
+		 WHERE e.organization_id=$1 AND o.status='COMPLETED' AND o.ordered_at >= $3 AND o.ordered_at < $4
+		   AND (COALESCE(cardinality($2::uuid[]),0)=0 OR e.id = ANY($2::uuid[]))
+		 GROUP BY `+productGroupKey+`
+		 ORDER BY 3 DESC LIMIT $5`,
+		orgID, pq.Array(locations), from, to, limit,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	list := []TopSeller{}
+	for rows.Next() {
+		var t TopSeller
+		if err := rows.Scan(&t.Name, &t.CatalogID, &t.Quantity, &t.RevenueCents, &t.Locations); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		list = append(list, t)
+	}
+	respond(w, r, "top_sellers", list)
+}
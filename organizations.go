@@ -0,0 +1,353 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+type Organization struct {
+	ID               string   `json:"id"`
+	Name             string   `json:"name"`
+	EstablishmentIDs []string `json:"establishment_ids"`
+}
+
+type CatalogProduct struct {
+	ID          string `json:"id"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	PriceCents  int    `json:"price_cents"`
+	ImageKey    string `json:"image_key"`
+}
+
+type CatalogOverride struct {
+	EstablishmentID string `json:"establishment_id"`
+	PriceCents      *int   `json:"price_cents"`
+	IsActive        *bool  `json:"is_active"`
+}
+
+var orgRoleRank = map[string]int{"member": 1, "admin": 2}
+
+// requireOrgRole writes a 403 and returns false unless the authenticated owner
+// holds at least minRole in the organization.
+func requireOrgRole(w http.ResponseWriter, r *http.Request, db *sql.DB, orgID, minRole string) bool {
+	var role string
+	err := db.QueryRow(
+		`SELECT role FROM organization_members WHERE organization_id=$1 AND owner_id=$2`,
+		orgID, currentClaims(r).Sub,
+	).Scan(&role)
+	if err != nil && err != sql.ErrNoRows {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if orgRoleRank[role] < orgRoleRank[minRole] {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func organizationsHandler(db *sql.DB) http.HandlerFunc {
+	return authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		createOrganization(w, r, db)
+	})
+}
+
+func organizationHandler(db *sql.DB) http.HandlerFunc {
+	return authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) {
+		parts := strings.Split(strings.TrimPrefix(r.URL.Path, "/organizations/"), "/")
+		for len(parts) < 5 {
+			parts = append(parts, "")
+		}
+		id, sub, subID := parts[0], parts[1], parts[2]
+		switch {
+		case sub == "" && r.Method == http.MethodGet:
+			if requireOrgRole(w, r, db, id, "member") {
+				getOrganization(w, db, id)
+			}
+		case sub == "establishments" && r.Method == http.MethodPost:
+			if requireOrgRole(w, r, db, id, "admin") {
+				attachEstablishment(w, r, db, id)
+			}
+		case sub == "reports" && r.Method == http.MethodGet:
+			organizationReportRoute(w, r, db, id, subID)
+		case sub == "catalog" && subID == "" && r.Method == http.MethodGet:
+			if requireOrgRole(w, r, db, id, "member") {
+				listCatalog(w, db, id)
+			}
+		case sub == "catalog" && subID == "" && r.Method == http.MethodPost:
+			if requireOrgRole(w, r, db, id, "admin") {
+				saveCatalogProduct(w, r, db, id, "")
+			}
+		case sub == "catalog" && subID == "push" && r.Method == http.MethodPost:
+			if requireOrgRole(w, r, db, id, "admin") {
+				pushCatalog(w, r, db, id)
+			}
+		case sub == "catalog" && parts[3] == "" && r.Method == http.MethodPut:
+			if requireOrgRole(w, r, db, id, "admin") {
+				saveCatalogProduct(w, r, db, id, subID)
+			}
+		case sub == "catalog" && parts[3] == "overrides" && parts[4] != "" && r.Method == http.MethodPut:
+			if requireOrgRole(w, r, db, id, "admin") {
+				putCatalogOverride(w, r, db, id, subID, parts[4])
+			}
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func createOrganization(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var o Organization
+	if err := json.NewDecoder(r.Body).Decode(&o); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	o.Name = sanitizeText(o.Name)
+	if o.Name == "" {
+		http.Error(w, "name is required", http.StatusBadRequest)
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if err := tx.QueryRow(`INSERT INTO organizations (name) VALUES ($1) RETURNING id`, o.Name).Scan(&o.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec(`INSERT INTO organization_members (organization_id, owner_id, role) VALUES ($1,$2,'admin')`, o.ID, currentClaims(r).Sub); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	o.EstablishmentIDs = []string{}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(o)
+}
+
+func getOrganization(w http.ResponseWriter, db *sql.DB, id string) {
+	var o Organization
+	err := db.QueryRow(
+		`SELECT o.id, o.name, COALESCE(array_agg(e.id::text ORDER BY e.name) FILTER (WHERE e.id IS NOT NULL), '{}')
+		 FROM organizations o LEFT JOIN establishments e ON e.organization_id=o.id
+		 WHERE o.id=$1 GROUP BY o.id`, id,
+	).Scan(&o.ID, &o.Name, pq.Array(&o.EstablishmentIDs))
+	if err == sql.ErrNoRows {
+		http.NotFound(w, nil)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(o)
+}
+
+// attachEstablishment moves an establishment into the organization. Only the
+// establishment's owner may hand it over.
+func attachEstablishment(w http.ResponseWriter, r *http.Request, db *sql.DB, orgID string) {
+	var req struct {
+		EstablishmentID string `json:"establishment_id"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !requireRole(w, r, db, req.EstablishmentID, "owner") {
+		return
+	}
+	if _, err := db.Exec(`UPDATE establishments SET organization_id=$1, updated_at=now() WHERE id=$2`, orgID, req.EstablishmentID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func listCatalog(w http.ResponseWriter, db *sql.DB, orgID string) {
+	rows, err := db.Query(`SELECT id, name, description, price_cents, image_key FROM catalog_products WHERE organization_id=$1 ORDER BY name`, orgID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	list := []CatalogProduct{}
+	for rows.Next() {
+		var p CatalogProduct
+		if err := rows.Scan(&p.ID, &p.Name, &p.Description, &p.PriceCents, &p.ImageKey); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		list = append(list, p)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func saveCatalogProduct(w http.ResponseWriter, r *http.Request, db *sql.DB, orgID, id string) {
+	var p CatalogProduct
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	sanitizeFields(&p.Name, &p.Description)
+	if p.Name == "" || p.PriceCents < 0 {
+		http.Error(w, "name is required and price_cents must not be negative", http.StatusUnprocessableEntity)
+		return
+	}
+	var err error
+	status := http.StatusOK
+	if id == "" {
+		status = http.StatusCreated
+		err = db.QueryRow(
+			`INSERT INTO catalog_products (organization_id, name, description, price_cents, image_key) VALUES ($1,$2,$3,$4,$5) RETURNING id`,
+			orgID, p.Name, p.Description, p.PriceCents, p.ImageKey,
+		).Scan(&p.ID)
+	} else {
+		p.ID = id
+		err = db.QueryRow(
+			`UPDATE catalog_products SET name=$1, description=$2, price_cents=$3, image_key=$4, updated_at=now()
+			 WHERE id=$5 AND organization_id=$6 RETURNING id`,
+			p.Name, p.Description, p.PriceCents, p.ImageKey, id, orgID,
+		).Scan(&p.ID)
+	}
+	if err == sql.ErrNoRows {
+		http.NotFound(w, nil)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(p)
+}
+
+func putCatalogOverride(w http.ResponseWriter, r *http.Request, db *sql.DB, orgID, productID, establishmentID string) {
+	var o CatalogOverride
+	if err := json.NewDecoder(r.Body).Decode(&o); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if o.PriceCents != nil && *o.PriceCents < 0 {
+		http.Error(w, "price_cents must not be negative", http.StatusUnprocessableEntity)
+		return
+	}
+	o.EstablishmentID = establishmentID
+	res, err := db.Exec(
+		`INSERT INTO catalog_overrides (catalog_product_id, establishment_id, price_cents, is_active)
+		 SELECT c.id, e.id, $3, $4 FROM catalog_products c JOIN establishments e ON e.organization_id=c.organization_id
+		 WHERE c.id=$1 AND e.id=$2 AND c.organization_id=$5
+		 ON CONFLICT (catalog_product_id, establishment_id) DO UPDATE SET price_cents=EXCLUDED.price_cents, is_active=EXCLUDED.is_active`,
+		productID, establishmentID, o.PriceCents, o.IsActive, orgID,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "catalog product or establishment not found in this organization", http.StatusUnprocessableEntity)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(o)
+}
+
+// pushCatalog copies catalog products into the selected establishments,
+// creating or refreshing the linked local products. Per-location overrides take
+// precedence over the catalog price and availability.
+func pushCatalog(w http.ResponseWriter, r *http.Request, db *sql.DB, orgID string) {
+	var req struct {
+		ProductIDs       []string `json:"product_ids"`
+		EstablishmentIDs []string `json:"establishment_ids"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(req.EstablishmentIDs) == 0 {
+		http.Error(w, "establishment_ids must not be empty", http.StatusBadRequest)
+		return
+	}
+	var foreign int
+	err := db.QueryRow(
+		`SELECT COUNT(*) FROM unnest($1::uuid[]) AS t(id) WHERE NOT EXISTS (SELECT 1 FROM establishments e WHERE e.id=t.id AND e.organization_id=$2)`,
+		pq.Array(req.EstablishmentIDs), orgID,
+	).Scan(&foreign)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if foreign > 0 {
+		http.Error(w, "some establishments do not belong to this organization", http.StatusUnprocessableEntity)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(
+		`INSERT INTO products (establishment_id, catalog_product_id, name, description, price_cents, image_key, banner_key, is_active)
+		 SELECT e.id, c.id, c.name, c.description, COALESCE(o.price_cents, c.price_cents), c.image_key, '', COALESCE(o.is_active, TRUE)
+		 FROM catalog_products c
+		 CROSS JOIN unnest($2::uuid[]) AS e(id)
+		 LEFT JOIN catalog_overrides o ON o.catalog_product_id=c.id AND o.establishment_id=e.id
+		 WHERE c.organization_id=$1 AND (COALESCE(cardinality($3::uuid[]),0)=0 OR c.id = ANY($3::uuid[]))
+		 ON CONFLICT (establishment_id, catalog_product_id) WHERE catalog_product_id IS NOT NULL DO UPDATE SET
+		   name=EXCLUDED.name, description=EXCLUDED.description, price_cents=EXCLUDED.price_cents,
+		   image_key=EXCLUDED.image_key, is_active=EXCLUDED.is_active, updated_at=now()
+		 RETURNING id`,
+		orgID, pq.Array(req.EstablishmentIDs), pq.Array(req.ProductIDs),
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var ids []string
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			rows.Close()
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		ids = append(ids, id)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := recordPriceChanges(tx, r, ids...); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	responseCache.Invalidate(req.EstablishmentIDs...)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]int{"pushed": len(ids)})
+}
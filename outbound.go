@@ -0,0 +1,137 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"math/rand/v2"
+	"net"
+	"net/http"
+	"os"
+	"strconv"
+	"time"
+)
+
+// Every integration talks to the outside through httpClient. Its transport
+// stack is, from the outside in: instrumentation, retries, the provider's
+// circuit breaker, and a pooled transport with per-host connection limits.
+
+const (
+	outboundMaxAttempts = 3
+	outboundBaseBackoff = 200 * time.Millisecond
+	outboundMaxBackoff  = 5 * time.Second
+)
+
+var (
+	outboundRequests = newCounter("outbound_requests_total", "Outbound HTTP attempts per provider.", "provider")
+	outboundFailures = newCounter("outbound_failures_total", "Outbound HTTP attempts per provider that failed or got a 5xx/429.", "provider")
+	outboundRetries  = newCounter("outbound_retries_total", "Outbound HTTP retries per provider.", "provider")
+	outboundDuration = newSummary("outbound_request_duration_seconds", "Outbound HTTP request duration per provider, retries included.", "provider")
+)
+
+// newHTTPClientFromEnv reads HTTP_CLIENT_TIMEOUT (seconds, default 10) for
+// the whole call including retries, and HTTP_MAX_CONNS_PER_HOST (default 20).
+func newHTTPClientFromEnv() *http.Client {
+	timeout := 10 * time.Second
+	if s, _ := strconv.Atoi(os.Getenv("HTTP_CLIENT_TIMEOUT")); s > 0 {
+		timeout = time.Duration(s) * time.Second
+	}
+	maxConns := 20
+	if n, _ := strconv.Atoi(os.Getenv("HTTP_MAX_CONNS_PER_HOST")); n > 0 {
+		maxConns = n
+	}
+	base := &http.Transport{
+		Proxy:                 http.ProxyFromEnvironment,
+		DialContext:           (&net.Dialer{Timeout: 5 * time.Second, KeepAlive: 30 * time.Second}).DialContext,
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          100,
+		MaxIdleConnsPerHost:   min(maxConns, 10),
+		MaxConnsPerHost:       maxConns,
+		IdleConnTimeout:       90 * time.Second,
+		TLSHandshakeTimeout:   5 * time.Second,
+		ResponseHeaderTimeout: timeout,
+		ExpectContinueTimeout: time.Second,
+	}
+	return &http.Client{
+		Timeout:   timeout,
+		Transport: instrumentedTransport{retryTransport{breakerTransport{base}}},
+	}
+}
+
+type instrumentedTransport struct {
+	next http.RoundTripper
+}
+
+func (t instrumentedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	start := time.Now()
+	resp, err := t.next.RoundTrip(req)
+	outboundDuration.Observe(providerName(req.URL.Hostname()), time.Since(start).Seconds())
+	return resp, err
+}
+
+// retryTransport retries idempotent requests after connection errors, 429,
+// 502, 503 and 504, with exponential backoff and full jitter. A Retry-After
+// from the provider is honoured up to outboundMaxBackoff. Requests with a
+// body are only retried when it can be replayed.
+type retryTransport struct {
+	next http.RoundTripper
+}
+
+func (t retryTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	provider := providerName(req.URL.Hostname())
+	for attempt := 1; ; attempt++ {
+		outboundRequests.Inc(provider)
+		resp, err := t.next.RoundTrip(req)
+		retryable := retryableResponse(resp, err)
+		if retryable {
+			outboundFailures.Inc(provider)
+		}
+		if !retryable || attempt == outboundMaxAttempts || !idempotentRequest(req) || errors.Is(err, errCircuitOpen) {
+			return resp, err
+		}
+		wait := rand.N(min(outboundBaseBackoff<<(attempt-1), outboundMaxBackoff)) + time.Millisecond
+		if resp != nil {
+			if s, perr := strconv.Atoi(resp.Header.Get("Retry-After")); perr == nil {
+				wait = min(time.Duration(s)*time.Second, outboundMaxBackoff)
+			}
+			resp.Body.Close()
+		}
+		if req.GetBody != nil {
+			body, berr := req.GetBody()
+			if berr != nil {
+				return nil, berr
+			}
+			req = req.Clone(req.Context())
+			req.Body = body
+		}
+		select {
+		case <-req.Context().Done():
+			return nil, req.Context().Err()
+		case <-time.After(wait):
+		}
+		outboundRetries.Inc(provider)
+	}
+}
+
+func retryableResponse(resp *http.Response, err error) bool {
+	if err != nil {
+		return !errors.Is(err, context.Canceled) && !errors.Is(err, context.DeadlineExceeded)
+	}
+	switch resp.StatusCode {
+	case http.StatusTooManyRequests, http.StatusBadGateway, http.StatusServiceUnavailable, http.StatusGatewayTimeout:
+		return true
+	}
+	return false
+}
+
+// idempotentRequest reports whether sending req twice is safe: the methods
+// HTTP defines as idempotent, or a POST carrying an idempotency key.
+func idempotentRequest(req *http.Request) bool {
+	if req.Body != nil && req.Body != http.NoBody && req.GetBody == nil {
+		return false
+	}
+	switch req.Method {
+	case http.MethodGet, http.MethodHead, http.MethodOptions, http.MethodPut, http.MethodDelete:
+		return true
+	}
+	return req.Header.Get("Idempotency-Key") != "" || req.Header.Get("X-Idempotency-Key") != ""
+}
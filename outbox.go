@@ -0,0 +1,263 @@
+package main
+
+import (
+	"bytes"
+	"cmp"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net/http"
+	"slices"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	outboxBatchSize   = 100
+	outboxMaxBackoff  = time.Hour
+	outboxRetention   = 7 * 24 * time.Hour
+	outboxPollEvery   = time.Second
+	outboxPruneEvery  = time.Hour
+	outboxMaxAttempts = 20
+
+	// outboxLease is how long a relay owns the batch it claimed.
+	outboxLease          = 2 * time.Minute
+	outboxPublishTimeout = 15 * time.Second
+)
+
+// EventPublisher is a destination the outbox relay forwards messages to. A
+// message is marked delivered only once every publisher accepted it; the
+// ones that did are remembered by Name and skipped on retries. Delivery is
+// still at-least-once, so consumers must tolerate duplicates.
+type EventPublisher interface {
+	Name() string
+	Publish(ctx context.Context, topic string, payload []byte) error
+}
+
+var publishers = []EventPublisher{eventBusSink{events}}
+
+// enqueueEvent records the event in the outbox as part of the caller's
+// transaction, so it is published if and only if the state change commits.
+func enqueueEvent(q execer, e Event) error {
+	if e.At.IsZero() {
+		e.At = time.Now()
+	}
+	payload, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec(`INSERT INTO outbox (topic, payload) VALUES ($1,$2)`, e.Type, payload)
+	return err
+}
+
+// eventBusSink hands messages to the in-process subscribers of bus.
+type eventBusSink struct {
+	bus *EventBus
+}
+
+func (eventBusSink) Name() string { return "events" }
+
+func (s eventBusSink) Publish(_ context.Context, _ string, payload []byte) error {
+	var e Event
+	if err := json.Unmarshal(payload, &e); err != nil {
+		return err
+	}
+	s.bus.Publish(e)
+	return nil
+}
+
+// webhookSink POSTs each message to a fixed URL, signing the body with
+// HMAC-SHA256 in the X-Signature header. Attempts are logged to db.
+type webhookSink struct {
+	url, secret string
+	db          *sql.DB
+}
+
+func (s webhookSink) Name() string { return "webhook" }
+
+func (s webhookSink) Publish(ctx context.Context, topic string, payload []byte) error {
+	_, err := s.send(ctx, topic, payload, nil)
+	return err
+}
+
+// send makes one attempt and logs it. The returned delivery is nil only when
+// the attempt couldn't be logged; err reports a failed attempt either way.
+func (s webhookSink) send(ctx context.Context, topic string, payload []byte, retryOf *string) (*WebhookDelivery, error) {
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(payload))
+	if err != nil {
+		return nil, err
+	}
+	mac := hmac.New(sha256.New, []byte(s.secret))
+	mac.Write(payload)
+	req.Header.Set("Content-Type", "application/json")
+	req.Header.Set("X-Event-Topic", topic)
+	req.Header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	d := WebhookDelivery{Topic: topic, URL: s.url, Payload: payload, RetryOf: retryOf}
+	start := time.Now()
+	resp, err := httpClient.Do(req)
+	d.DurationMs = int(time.Since(start).Milliseconds())
+	if err == nil {
+		resp.Body.Close()
+		d.StatusCode = &resp.StatusCode
+		if resp.StatusCode >= 300 {
+			err = fmt.Errorf("webhook responded %d", resp.StatusCode)
+		}
+	}
+	if err != nil {
+		d.Error = err.Error()
+	}
+	if s.db != nil {
+		if logErr := logWebhookDelivery(s.db, &d); logErr != nil {
+			log.Printf("webhook delivery log: %v", logErr)
+			return nil, err
+		}
+	}
+	return &d, err
+}
+
+// startOutboxRelay relays db's outbox to sinks. announceLive fans live
+// topics out to every instance's liveEvents; only the live schema may set
+// it, since the catch-up high-water mark follows live outbox ids.
+func startOutboxRelay(db *sql.DB, sinks []EventPublisher, announceLive bool) {
+	go func() {
+		lastPrune := time.Time{}
+		for {
+			n, err := relayOutbox(db, sinks, announceLive)
+			if err != nil {
+				log.Printf("outbox relay: %v", err)
+			}
+			if time.Since(lastPrune) > outboxPruneEvery {
+				if _, err := db.Exec(`DELETE FROM outbox WHERE delivered_at < $1`, time.Now().Add(-outboxRetention)); err != nil {
+					log.Printf("outbox prune: %v", err)
+				}
+				if _, err := db.Exec(`DELETE FROM webhook_deliveries WHERE attempted_at < $1`, time.Now().Add(-outboxRetention)); err != nil {
+					log.Printf("webhook delivery prune: %v", err)
+				}
+				lastPrune = time.Now()
+			}
+			if n < outboxBatchSize {
+				time.Sleep(outboxPollEvery)
+			}
+		}
+	}()
+}
+
+type outboxMessage struct {
+	id          int64
+	topic       string
+	payload     []byte
+	attempts    int
+	deliveredTo []string
+}
+
+// relayOutbox publishes one batch of due messages. The batch is claimed with
+// a lease in a single statement and published with no transaction or row
+// locks held, so several instances can relay concurrently and a slow sink
+// doesn't pin database connections. Rows left behind by an instance that
+// died mid-batch become due again once the lease lapses.
+func relayOutbox(db *sql.DB, sinks []EventPublisher, announceLive bool) (int, error) {
+	rows, err := db.Query(
+		`UPDATE outbox SET claimed_until = now() + $3 * interval '1 second'
+		 WHERE id IN (SELECT id FROM outbox
+		   WHERE delivered_at IS NULL AND next_attempt_at <= now() AND attempts < $1
+		     AND (claimed_until IS NULL OR claimed_until < now())
+		   ORDER BY id LIMIT $2 FOR UPDATE SKIP LOCKED)
+		 RETURNING id, topic, payload, attempts, delivered_to`,
+		outboxMaxAttempts, outboxBatchSize, outboxLease.Seconds(),
+	)
+	if err != nil {
+		return 0, err
+	}
+	var batch []*outboxMessage
+	for rows.Next() {
+		m := &outboxMessage{}
+		if err := rows.Scan(&m.id, &m.topic, &m.payload, &m.attempts, pq.Array(&m.deliveredTo)); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		batch = append(batch, m)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	slices.SortFunc(batch, func(a, b *outboxMessage) int { return cmp.Compare(a.id, b.id) })
+
+	// Stop early enough that the last publish finishes inside the lease, and
+	// hand the rest back rather than let another instance send them too.
+	deadline := time.Now().Add(outboxLease - outboxPublishTimeout)
+	for i, m := range batch {
+		if time.Now().After(deadline) {
+			ids := make([]int64, 0, len(batch)-i)
+			for _, rest := range batch[i:] {
+				ids = append(ids, rest.id)
+			}
+			_, err := db.Exec(`UPDATE outbox SET claimed_until=NULL WHERE id = ANY($1)`, pq.Array(ids))
+			return i, err
+		}
+		if err := finishOutboxMessage(db, m, publishPending(m, sinks), announceLive); err != nil {
+			return i, err
+		}
+	}
+	return len(batch), nil
+}
+
+// publishPending hands m to every sink that hasn't accepted it yet and
+// records the ones that do in m.deliveredTo, so a retry skips them.
+func publishPending(m *outboxMessage, sinks []EventPublisher) error {
+	ctx, cancel := context.WithTimeout(context.Background(), outboxPublishTimeout)
+	defer cancel()
+	var errs []error
+	for _, s := range sinks {
+		if slices.Contains(m.deliveredTo, s.Name()) {
+			continue
+		}
+		if err := s.Publish(ctx, m.topic, m.payload); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", s.Name(), err))
+			continue
+		}
+		m.deliveredTo = append(m.deliveredTo, s.Name())
+	}
+	return errors.Join(errs...)
+}
+
+// finishOutboxMessage releases the claim on m, marking it delivered or
+// scheduling the next attempt depending on publishErr. Live topics are
+// announced to the other instances once the delivery is committed; that is
+// best effort, since their polling fallback picks up anything missed, so a
+// failure is only logged and never undoes the delivered_to bookkeeping.
+func finishOutboxMessage(db *sql.DB, m *outboxMessage, publishErr error, announceLive bool) error {
+	if publishErr != nil {
+		backoff := min(time.Duration(1<<min(m.attempts, 12))*time.Second, outboxMaxBackoff)
+		_, err := db.Exec(
+			`UPDATE outbox SET attempts=attempts+1, last_error=$2, next_attempt_at=now() + $3 * interval '1 second',
+			   delivered_to=$4, claimed_until=NULL
+			 WHERE id=$1`,
+			m.id, publishErr.Error(), backoff.Seconds(), pq.Array(m.deliveredTo),
+		)
+		return err
+	}
+	_, err := db.Exec(
+		`UPDATE outbox SET delivered_at=now(), attempts=attempts+1, last_error=NULL, delivered_to=$2, claimed_until=NULL WHERE id=$1`,
+		m.id, pq.Array(m.deliveredTo),
+	)
+	if err != nil {
+		return err
+	}
+	if announceLive && isLiveTopic(m.topic) {
+		var e Event
+		if json.Unmarshal(m.payload, &e) == nil {
+			if err := notifyLive(db, m.id, e); err != nil {
+				log.Printf("outbox relay: live notification for %d: %v", m.id, err)
+			}
+		}
+	}
+	return nil
+}
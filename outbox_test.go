@@ -0,0 +1,101 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"slices"
+	"testing"
+	"time"
+)
+
+func TestPublishPendingSkipsDeliveredSinks(t *testing.T) {
+	bus := &EventBus{handlers: map[string]map[int]func(Event){}}
+	seen := make(chan Event, 10)
+	bus.Subscribe(eventOrderCreated, func(e Event) { seen <- e })
+	broker := &memoryPublisher{Fail: errors.New("down")}
+	sinks := []EventPublisher{eventBusSink{bus}, broker}
+
+	payload, _ := json.Marshal(Event{Type: eventOrderCreated, OrderID: "o1"})
+	m := &outboxMessage{id: 1, topic: eventOrderCreated, payload: payload}
+	if err := publishPending(m, sinks); err == nil {
+		t.Fatal("publish with a failing broker succeeded")
+	}
+	if !slices.Equal(m.deliveredTo, []string{"events"}) {
+		t.Fatalf("deliveredTo = %v", m.deliveredTo)
+	}
+
+	broker.Fail = nil
+	if err := publishPending(m, sinks); err != nil {
+		t.Fatal(err)
+	}
+	if !slices.Equal(m.deliveredTo, []string{"events", "memory"}) {
+		t.Fatalf("deliveredTo = %v", m.deliveredTo)
+	}
+	if n := len(broker.Messages()); n != 1 {
+		t.Fatalf("broker got %d messages", n)
+	}
+	select {
+	case e := <-seen:
+		if e.OrderID != "o1" {
+			t.Fatalf("event = %+v", e)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("subscriber not called")
+	}
+	select {
+	case <-seen:
+		t.Fatal("subscriber called again on retry")
+	case <-time.After(50 * time.Millisecond):
+	}
+}
+
+func TestRelayOutbox(t *testing.T) {
+	db := openTestDB(t)
+	const topic = "test.relay"
+	if err := enqueueEvent(db, Event{Type: topic, EstablishmentID: "test"}); err != nil {
+		t.Fatal(err)
+	}
+	var id int64
+	if err := db.QueryRow(`SELECT max(id) FROM outbox WHERE topic=$1`, topic).Scan(&id); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { db.Exec(`DELETE FROM outbox WHERE topic=$1`, topic) })
+
+	broker := &memoryPublisher{Fail: errors.New("down")}
+	if _, err := relayOutbox(db, []EventPublisher{broker}, false); err != nil {
+		t.Fatal(err)
+	}
+	var attempts int
+	var delivered, claimed bool
+	err := db.QueryRow(`SELECT attempts, delivered_at IS NOT NULL, claimed_until IS NOT NULL FROM outbox WHERE id=$1`, id).
+		Scan(&attempts, &delivered, &claimed)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if attempts != 1 || delivered || claimed {
+		t.Fatalf("after failure: attempts=%d delivered=%v claimed=%v", attempts, delivered, claimed)
+	}
+
+	broker.Fail = nil
+	if _, err := db.Exec(`UPDATE outbox SET next_attempt_at=now() WHERE id=$1`, id); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := relayOutbox(db, []EventPublisher{broker}, false); err != nil {
+		t.Fatal(err)
+	}
+	if err := db.QueryRow(`SELECT delivered_at IS NOT NULL FROM outbox WHERE id=$1`, id).Scan(&delivered); err != nil {
+		t.Fatal(err)
+	}
+	if !delivered {
+		t.Fatal("message not marked delivered")
+	}
+	var got int
+	for _, m := range broker.Messages() {
+		if m.Topic == topic {
+			got++
+		}
+	}
+	if got != 1 {
+		t.Fatalf("broker got %d %s messages", got, topic)
+	}
+}
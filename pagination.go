@@ -0,0 +1,91 @@
+package main
+
+import (
+	"encoding/base64"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	defaultPageSize = 50
+	maxPageSize     = 200
+)
+
+var errBadCursor = errors.New("invalid cursor")
+
+// Page is the envelope for cursor-paginated listings. NextCursor is nil on the
+// last page.
+type Page[T any] struct {
+	Data       []T     `json:"data"`
+	NextCursor *string `json:"next_cursor"`
+}
+
+// pageCursor is the position of the last row of a page in (timestamp, id)
+// descending order. Clients treat the encoded form as opaque.
+type pageCursor struct {
+	At time.Time
+	ID string
+}
+
+func (p Page[T]) csvRows() any { return p.Data }
+
+func (c pageCursor) encode() string {
+	return base64.RawURLEncoding.EncodeToString([]byte(c.At.Format(time.RFC3339Nano) + "|" + c.ID))
+}
+
+func decodeCursor(s string) (*pageCursor, error) {
+	raw, err := base64.RawURLEncoding.DecodeString(s)
+	if err != nil {
+		return nil, errBadCursor
+	}
+	at, id, ok := strings.Cut(string(raw), "|")
+	if !ok {
+		return nil, errBadCursor
+	}
+	t, err := time.Parse(time.RFC3339Nano, at)
+	if err != nil {
+		return nil, errBadCursor
+	}
+	return &pageCursor{At: t, ID: id}, nil
+}
+
+// pageParams reads ?cursor= and ?limit=. A nil cursor means the first page.
+func pageParams(r *http.Request) (*pageCursor, int, error) {
+	limit := defaultPageSize
+	if v := r.URL.Query().Get("limit"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n <= 0 {
+			return nil, 0, errors.New("limit must be a positive integer")
+		}
+		limit = min(n, maxPageSize)
+	}
+	if v := r.URL.Query().Get("cursor"); v != "" {
+		c, err := decodeCursor(v)
+		return c, limit, err
+	}
+	return nil, limit, nil
+}
+
+// keysetArgs returns the cursor position as query arguments; the first page
+// uses a position after every row.
+func keysetArgs(c *pageCursor) (time.Time, string) {
+	if c == nil {
+		return time.Date(9999, 1, 1, 0, 0, 0, 0, time.UTC), "ffffffff-ffff-ffff-ffff-ffffffffffff"
+	}
+	return c.At, c.ID
+}
+
+// newPage trims the extra row fetched to detect a following page and builds
+// the next cursor from the last row kept.
+func newPage[T any](rows []T, limit int, key func(T) pageCursor) Page[T] {
+	p := Page[T]{Data: rows}
+	if len(rows) > limit {
+		p.Data = rows[:limit]
+		next := key(rows[limit-1]).encode()
+		p.NextCursor = &next
+	}
+	return p
+}
@@ -0,0 +1,52 @@
+package main
+
+import (
+	"errors"
+	"strings"
+	"unicode"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var commonPasswords = map[string]bool{
+	"12345678": true, "123456789": true, "password": true, "password1": true,
+	"senha123": true, "qwerty123": true, "11111111": true, "abc12345": true,
+}
+
+func hashPassword(password string) (string, error) {
+	b, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(b), err
+}
+
+func checkPassword(hash, password string) bool {
+	return bcrypt.CompareHashAndPassword([]byte(hash), []byte(password)) == nil
+}
+
+func validatePasswordStrength(password, email string) error {
+	if len(password) < 8 {
+		return errors.New("password must have at least 8 characters")
+	}
+	if len(password) > 72 {
+		return errors.New("password must have at most 72 characters")
+	}
+	var letter, digit bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLetter(r):
+			letter = true
+		case unicode.IsDigit(r):
+			digit = true
+		}
+	}
+	if !letter || !digit {
+		return errors.New("password must contain letters and digits")
+	}
+	lower := strings.ToLower(password)
+	if commonPasswords[lower] {
+		return errors.New("password is too common")
+	}
+	if local, _, ok := strings.Cut(strings.ToLower(email), "@"); ok && len(local) >= 4 && strings.Contains(lower, local) {
+		return errors.New("password must not contain the email address")
+	}
+	return nil
+}
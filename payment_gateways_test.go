@@ -0,0 +1,38 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/hex"
+	"net/http/httptest"
+	"strconv"
+	"testing"
+	"time"
+)
+
+func TestVerifyStripeSignature(t *testing.T) {
+	body := []byte(`{"type":"payment_intent.succeeded"}`)
+	signed := func(secret string, at time.Time) string {
+		ts := strconv.FormatInt(at.Unix(), 10)
+		mac := hmac.New(sha256.New, []byte(secret))
+		mac.Write([]byte(ts + "." + string(body)))
+		return "t=" + ts + ",v1=" + hex.EncodeToString(mac.Sum(nil))
+	}
+	for _, tc := range []struct {
+		name, secret, header string
+		ok                   bool
+	}{
+		{"valid", "whsec", signed("whsec", time.Now()), true},
+		{"wrong secret", "whsec", signed("other", time.Now()), false},
+		{"no secret configured", "", signed("", time.Now()), false},
+		{"replayed", "whsec", signed("whsec", time.Now().Add(-time.Hour)), false},
+		{"from the future", "whsec", signed("whsec", time.Now().Add(time.Hour)), false},
+		{"missing header", "whsec", "", false},
+	} {
+		r := httptest.NewRequest("POST", "/webhooks/payments/stripe", nil)
+		r.Header.Set("Stripe-Signature", tc.header)
+		if err := verifyStripeSignature(r, body, tc.secret); (err == nil) != tc.ok {
+			t.Errorf("%s: err = %v", tc.name, err)
+		}
+	}
+}
@@ -0,0 +1,205 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+var paymentMethodKinds = map[string]bool{
+	"pix":                true,
+	"credit_on_delivery": true,
+	"debit_on_delivery":  true,
+	"cash":               true,
+	"online_card":        true,
+}
+
+var cardBrands = map[string]bool{
+	"visa": true, "mastercard": true, "elo": true, "amex": true, "hipercard": true, "diners": true,
+}
+
+type PaymentMethod struct {
+	Method         string   `json:"method"`
+	Enabled        bool     `json:"enabled"`
+	CardBrands     []string `json:"card_brands"`
+	MaxChangeCents *int64   `json:"max_change_cents"`
+}
+
+func isCardMethod(method string) bool {
+	return method == "credit_on_delivery" || method == "debit_on_delivery" || method == "online_card"
+}
+
+func paymentMethodsRoute(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	switch r.Method {
+	case http.MethodGet:
+		list, err := loadPaymentMethods(db, establishmentID, false)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	case http.MethodPut:
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) {
+			if requireRole(w, r, db, establishmentID, "manager") {
+				putPaymentMethods(w, r, db, establishmentID)
+			}
+		})(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func loadPaymentMethods(db *sql.DB, establishmentID string, enabledOnly bool) ([]PaymentMethod, error) {
+	rows, err := db.Query(
+		`SELECT method, enabled, card_brands, max_change_cents FROM establishment_payment_methods
+		 WHERE establishment_id=$1 AND (enabled OR NOT $2) ORDER BY method`,
+		establishmentID, enabledOnly,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	list := []PaymentMethod{}
+	for rows.Next() {
+		var m PaymentMethod
+		if err := rows.Scan(&m.Method, &m.Enabled, pq.Array(&m.CardBrands), &m.MaxChangeCents); err != nil {
+			return nil, err
+		}
+		if m.CardBrands == nil {
+			m.CardBrands = []string{}
+		}
+		list = append(list, m)
+	}
+	return list, rows.Err()
+}
+
+// putPaymentMethods replaces the establishment's whole payment configuration.
+func putPaymentMethods(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	var list []PaymentMethod
+	if err := json.NewDecoder(r.Body).Decode(&list); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	problems := []string{}
+	seen := map[string]bool{}
+	for i := range list {
+		m := &list[i]
+		if !paymentMethodKinds[m.Method] {
+			problems = append(problems, "unknown payment method "+m.Method)
+			continue
+		}
+		if seen[m.Method] {
+			problems = append(problems, "duplicate payment method "+m.Method)
+		}
+		seen[m.Method] = true
+		if len(m.CardBrands) > 0 && !isCardMethod(m.Method) {
+			problems = append(problems, "card_brands only apply to card methods")
+		}
+		for j, b := range m.CardBrands {
+			m.CardBrands[j] = strings.ToLower(strings.TrimSpace(b))
+			if !cardBrands[m.CardBrands[j]] {
+				problems = append(problems, "unknown card brand "+b)
+			}
+		}
+		if m.MaxChangeCents != nil && (m.Method != "cash" || *m.MaxChangeCents < 0) {
+			problems = append(problems, "max_change_cents only applies to cash and must not be negative")
+		}
+		if m.CardBrands == nil {
+			m.CardBrands = []string{}
+		}
+	}
+	if len(problems) > 0 {
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusUnprocessableEntity)
+		json.NewEncoder(w).Encode(map[string][]string{"problems": problems})
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`DELETE FROM establishment_payment_methods WHERE establishment_id=$1`, establishmentID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, m := range list {
+		_, err := tx.Exec(
+			`INSERT INTO establishment_payment_methods (establishment_id, method, enabled, card_brands, max_change_cents) VALUES ($1,$2,$3,$4,$5)`,
+			establishmentID, m.Method, m.Enabled, pq.Array(m.CardBrands), m.MaxChangeCents,
+		)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := recordAudit(tx, r, establishmentID, "payment_methods.updated", "establishment", establishmentID, list); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	responseCache.Invalidate(establishmentID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// checkPaymentMethod validates the checkout's payment choice against the
+// establishment configuration. Establishments that never configured payment
+// methods accept all of them.
+func checkPaymentMethod(tx *sql.Tx, req *CheckoutRequest, totalCents int64) error {
+	if !paymentMethodKinds[req.PaymentMethod] {
+		return &checkoutError{http.StatusBadRequest, "payment_method_invalid", "payment_method must be one of pix, credit_on_delivery, debit_on_delivery, cash, online_card"}
+	}
+	var configured int
+	var m PaymentMethod
+	err := tx.QueryRow(`SELECT COUNT(*) FROM establishment_payment_methods WHERE establishment_id=$1`, req.EstablishmentID).Scan(&configured)
+	if err != nil {
+		return err
+	}
+	if configured > 0 {
+		err = tx.QueryRow(
+			`SELECT method, enabled, card_brands, max_change_cents FROM establishment_payment_methods WHERE establishment_id=$1 AND method=$2`,
+			req.EstablishmentID, req.PaymentMethod,
+		).Scan(&m.Method, &m.Enabled, pq.Array(&m.CardBrands), &m.MaxChangeCents)
+		if err != nil && err != sql.ErrNoRows {
+			return err
+		}
+		if err == sql.ErrNoRows || !m.Enabled {
+			return &checkoutError{http.StatusUnprocessableEntity, "payment_method_not_accepted", "this establishment does not accept " + req.PaymentMethod}
+		}
+	}
+
+	if len(m.CardBrands) > 0 {
+		brand := strings.ToLower(req.CardBrand)
+		ok := false
+		for _, b := range m.CardBrands {
+			ok = ok || b == brand
+		}
+		if !ok {
+			return &checkoutError{http.StatusUnprocessableEntity, "card_brand_not_accepted", "card brand is not accepted; accepted brands: " + strings.Join(m.CardBrands, ", ")}
+		}
+	}
+	if req.ChangeForCents != nil {
+		if req.PaymentMethod != "cash" {
+			return &checkoutError{http.StatusBadRequest, "change_not_applicable", "change_for_cents only applies to cash payments"}
+		}
+		if *req.ChangeForCents < totalCents {
+			return &checkoutError{http.StatusUnprocessableEntity, "change_insufficient", "change_for_cents must cover the order total"}
+		}
+		if m.MaxChangeCents != nil && *req.ChangeForCents-totalCents > *m.MaxChangeCents {
+			return &checkoutError{http.StatusUnprocessableEntity, "change_limit_exceeded", "requested change exceeds what the establishment can provide"}
+		}
+	}
+	return nil
+}
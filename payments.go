@@ -0,0 +1,508 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"io"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	refundEvery     = time.Minute
+	gatewayTimeout  = 20 * time.Second
+	refundBatchSize = 50
+)
+
+// Charge asks a gateway to collect an amount. Reference identifies what is
+// being paid for, an order or a gift card, on the gateway's side.
+type Charge struct {
+	Reference   string
+	Method      string // "pix" or "online_card"
+	AmountCents int64
+	Description string
+	PayerEmail  string
+	// SourceToken is the card token produced by the gateway's frontend SDK;
+	// empty for pix.
+	SourceToken    string
+	IdempotencyKey string
+}
+
+// ChargeResult is the gateway's answer. ClientSecret and PixCode are what the
+// frontend needs to finish the payment, when the gateway wants more from it.
+type ChargeResult struct {
+	ProviderChargeID string
+	Status           string // pending, paid or failed
+	ClientSecret     string
+	PixCode          string
+}
+
+// PaymentEvent is a status change reported by a gateway webhook.
+type PaymentEvent struct {
+	ProviderChargeID string
+	Status           string // pending, paid, failed or refunded
+}
+
+// Gateway charges and refunds orders paid online. Establishments pick one by
+// name; gateways are registered from the environment at startup.
+type Gateway interface {
+	CreateCharge(ctx context.Context, c Charge) (*ChargeResult, error)
+	Refund(ctx context.Context, providerChargeID string, amountCents int64, idempotencyKey string) error
+	ParseWebhook(r *http.Request, body []byte) (*PaymentEvent, error)
+}
+
+var paymentGateways = map[string]Gateway{}
+
+var paymentsByStatus = newCounter("payments_total", "Online payments by final gateway status.", "status")
+
+// registerPaymentGatewaysFromEnv enables each gateway whose credentials are
+// set. Stripe and Mercado Pago also need their webhook secret, without which
+// payment notifications couldn't be verified. PAYMENTS_FAKE_GATEWAY=true adds
+// "fake", which approves everything and is meant for development and
+// automated tests only.
+func registerPaymentGatewaysFromEnv() {
+	if key := os.Getenv("STRIPE_SECRET_KEY"); key != "" {
+		if secret := os.Getenv("STRIPE_PAYMENTS_WEBHOOK_SECRET"); secret != "" {
+			paymentGateways["stripe"] = stripeGateway{secretKey: key, webhookSecret: secret}
+		} else {
+			log.Print("STRIPE_PAYMENTS_WEBHOOK_SECRET not set, stripe payments disabled")
+		}
+	}
+	if token := os.Getenv("MERCADOPAGO_ACCESS_TOKEN"); token != "" {
+		if secret := os.Getenv("MERCADOPAGO_WEBHOOK_SECRET"); secret != "" {
+			paymentGateways["mercadopago"] = mercadoPagoGateway{accessToken: token, webhookSecret: secret}
+		} else {
+			log.Print("MERCADOPAGO_WEBHOOK_SECRET not set, mercadopago payments disabled")
+		}
+	}
+	if token := os.Getenv("PAGSEGURO_TOKEN"); token != "" {
+		base := "https://api.pagseguro.com"
+		if os.Getenv("PAGSEGURO_SANDBOX") == "true" {
+			base = "https://sandbox.api.pagseguro.com"
+		}
+		paymentGateways["pagseguro"] = pagSeguroGateway{baseURL: base, token: token}
+	}
+	if os.Getenv("PAYMENTS_FAKE_GATEWAY") == "true" {
+		paymentGateways["fake"] = fakeGateway{}
+	}
+}
+
+type Payment struct {
+	ID          string `json:"id"`
+	Gateway     string `json:"gateway"`
+	Method      string `json:"method"`
+	AmountCents int64  `json:"amount_cents"`
+	Status      string `json:"status"`
+	// ClientSecret and PixCode are only returned when the charge is created.
+	ClientSecret string    `json:"client_secret,omitempty"`
+	PixCode      string    `json:"pix_code,omitempty"`
+	CreatedAt    time.Time `json:"created_at"`
+}
+
+// startPayment charges the order through its establishment's gateway. It
+// returns nil when the order needs no online payment: cash-like methods,
+// orders fully paid with credit or gift cards, or establishments that settle pix and
+// cards outside the platform.
+func startPayment(ctx context.Context, db *sql.DB, orderID, sourceToken string) (*Payment, error) {
+	var gatewayName sql.NullString
+	var establishmentID, method, email string
+	var amount int64
+	var number int
+	err := db.QueryRow(
+		`SELECT e.id, e.payment_gateway, o.payment_method, o.total_cents - o.store_credit_cents - o.gift_card_cents, o.order_number, c.email
+		 FROM orders o JOIN establishments e ON e.id=o.establishment_id JOIN customers c ON c.id=o.customer_id WHERE o.id=$1`,
+		orderID,
+	).Scan(&establishmentID, &gatewayName, &method, &amount, &number, &email)
+	if err != nil {
+		return nil, err
+	}
+	if !gatewayName.Valid || !prepaidMethods[method] || amount <= 0 {
+		return nil, nil
+	}
+	gw, ok, err := establishmentGateway(ctx, db, establishmentID, gatewayName.String)
+	if err != nil {
+		return nil, err
+	}
+	if !ok {
+		return nil, errors.New("payment gateway " + gatewayName.String + " is not configured")
+	}
+
+	return runCharge(ctx, db, gatewayName.String, gw, "order_id", Charge{
+		Reference:   orderID,
+		Method:      method,
+		AmountCents: amount,
+		Description: "Pedido " + formatOrderNumber(number),
+		PayerEmail:  email,
+		SourceToken: sourceToken,
+	})
+}
+
+// runCharge records a payment for the order or gift card named by
+// c.Reference (refColumn says which) and sends the charge to the gateway.
+func runCharge(ctx context.Context, db *sql.DB, gatewayName string, gw Gateway, refColumn string, c Charge) (*Payment, error) {
+	// The row exists before the gateway call so its id can serve as the
+	// idempotency key, and a crash in between leaves a trace.
+	p := Payment{Gateway: gatewayName, Method: c.Method, AmountCents: c.AmountCents, Status: "pending"}
+	err := db.QueryRow(
+		`INSERT INTO payments (`+refColumn+`, gateway, method, amount_cents) VALUES ($1,$2,$3,$4) RETURNING id, created_at`,
+		c.Reference, p.Gateway, p.Method, p.AmountCents,
+	).Scan(&p.ID, &p.CreatedAt)
+	if err != nil {
+		return nil, err
+	}
+	c.IdempotencyKey = p.ID
+	ctx, cancel := context.WithTimeout(ctx, gatewayTimeout)
+	defer cancel()
+	res, err := gw.CreateCharge(ctx, c)
+	if err != nil {
+		p.Status = "failed"
+		if _, uerr := db.Exec(`UPDATE payments SET status='failed', updated_at=now() WHERE id=$1`, p.ID); uerr != nil {
+			log.Printf("payment %s: %v", p.ID, uerr)
+		}
+		paymentsByStatus.Inc(p.Status)
+		return &p, err
+	}
+	p.Status, p.ClientSecret, p.PixCode = res.Status, res.ClientSecret, res.PixCode
+	if _, err := db.Exec(
+		`UPDATE payments SET provider_charge_id=$1, status=$2, updated_at=now() WHERE id=$3`,
+		res.ProviderChargeID, res.Status, p.ID,
+	); err != nil {
+		return &p, err
+	}
+	if p.Status != "pending" {
+		paymentsByStatus.Inc(p.Status)
+	}
+	return &p, nil
+}
+
+// retryPayment creates a new charge for an order whose payment failed or was
+// abandoned, e.g. after a declined card.
+func retryPayment(w http.ResponseWriter, r *http.Request, db *sql.DB, orderID string) {
+	var req struct {
+		PaymentToken string `json:"payment_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil && err != io.EOF {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var status string
+	var paid bool
+	err := db.QueryRow(
+		`SELECT status, EXISTS (SELECT 1 FROM payments WHERE order_id=o.id AND status IN ('paid','refunded'))
+		 FROM orders o WHERE id=$1 AND customer_id=$2`,
+		orderID, currentClaims(r).Sub,
+	).Scan(&status, &paid)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, nil)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if paid || status == "CANCELLED" || status == "FAILED" {
+		http.Error(w, "order can't be paid again", http.StatusConflict)
+		return
+	}
+	p, err := startPayment(r.Context(), db, orderID, req.PaymentToken)
+	if errors.Is(err, errCircuitOpen) {
+		w.Header().Set("Retry-After", "60")
+		http.Error(w, "the payment provider is unavailable, try again shortly", http.StatusServiceUnavailable)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return
+	}
+	if p == nil {
+		http.Error(w, "order is not paid online", http.StatusConflict)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(p)
+}
+
+func listPayments(w http.ResponseWriter, db *sql.DB, orderID string) {
+	rows, err := db.Query(
+		`SELECT id, gateway, method, amount_cents, status, created_at FROM payments WHERE order_id=$1 ORDER BY created_at`,
+		orderID,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	list := []Payment{}
+	for rows.Next() {
+		var p Payment
+		if err := rows.Scan(&p.ID, &p.Gateway, &p.Method, &p.AmountCents, &p.Status, &p.CreatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		list = append(list, p)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func paymentWebhookHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		name := strings.TrimPrefix(r.URL.Path, "/webhooks/payments/")
+		body, err := io.ReadAll(io.LimitReader(r.Body, 1<<20))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// The charge may have gone through the establishment's own
+		// credentials, so find whose payment it is before verifying.
+		establishmentID, err := paymentEstablishment(db, name, webhookChargeIDs(body))
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		gw, ok := paymentGateways[name]
+		if establishmentID != "" {
+			if gw, ok, err = establishmentGateway(r.Context(), db, establishmentID, name); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		if !ok {
+			http.NotFound(w, nil)
+			return
+		}
+		e, err := gw.ParseWebhook(r, body)
+		if errors.Is(err, errIgnoredEvent) {
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// A body naming several charges must not verify with one
+		// establishment's secret and update another's payment.
+		owner, err := paymentEstablishment(db, name, []string{e.ProviderChargeID})
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if owner != establishmentID {
+			http.Error(w, "charge does not belong to the verified account", http.StatusBadRequest)
+			return
+		}
+		if err := recordPaymentEvent(db, name, e); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// webhookChargeIDs picks the fields of an unverified webhook body that may
+// name the charge: data.object.id and data.object.payment_intent (Stripe),
+// data.id (Mercado Pago), id (PagSeguro) and charge_id (fake).
+func webhookChargeIDs(body []byte) []string {
+	var v struct {
+		ID       string `json:"id"`
+		ChargeID string `json:"charge_id"`
+		Data     struct {
+			ID     string `json:"id"`
+			Object struct {
+				ID            string `json:"id"`
+				PaymentIntent string `json:"payment_intent"`
+			} `json:"object"`
+		} `json:"data"`
+	}
+	if json.Unmarshal(body, &v) != nil {
+		return nil
+	}
+	var ids []string
+	for _, id := range []string{v.ID, v.ChargeID, v.Data.ID, v.Data.Object.ID, v.Data.Object.PaymentIntent} {
+		if id != "" {
+			ids = append(ids, id)
+		}
+	}
+	return ids
+}
+
+// paymentEstablishment returns the establishment of the payment with one of
+// chargeIDs at gateway, or "" when there is none.
+func paymentEstablishment(db *sql.DB, gateway string, chargeIDs []string) (string, error) {
+	var establishmentID string
+	err := db.QueryRow(
+		`SELECT COALESCE(o.establishment_id, g.establishment_id) FROM payments p
+		 LEFT JOIN orders o ON o.id=p.order_id LEFT JOIN gift_cards g ON g.id=p.gift_card_id
+		 WHERE p.gateway=$1 AND p.provider_charge_id = ANY($2)
+		 ORDER BY p.created_at DESC LIMIT 1`,
+		gateway, pq.Array(chargeIDs),
+	).Scan(&establishmentID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return establishmentID, err
+}
+
+// recordPaymentEvent applies a webhook status. Payments never go back from
+// paid or refunded, since gateways may deliver events out of order.
+func recordPaymentEvent(db *sql.DB, gateway string, e *PaymentEvent) error {
+	tx, err := db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	var orderID, giftCardID sql.NullString
+	err = tx.QueryRow(
+		`UPDATE payments SET status=$1, updated_at=now()
+		 WHERE gateway=$2 AND provider_charge_id=$3 AND status NOT IN ($1,'refunded')
+		   AND NOT (status='paid' AND $1 IN ('pending','failed'))
+		 RETURNING order_id, gift_card_id`,
+		e.Status, gateway, e.ProviderChargeID,
+	).Scan(&orderID, &giftCardID)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	if orderID.Valid {
+		payload, _ := json.Marshal(map[string]any{"gateway": gateway, "charge_id": e.ProviderChargeID, "status": e.Status})
+		if _, err := tx.Exec(`INSERT INTO order_events (order_id, event_type, payload) VALUES ($1,'PAYMENT',$2)`, orderID.String, payload); err != nil {
+			return err
+		}
+	}
+	activated := false
+	if giftCardID.Valid && e.Status == "paid" {
+		if activated, err = activateGiftCard(tx, giftCardID.String); err != nil {
+			return err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return err
+	}
+	paymentsByStatus.Inc(e.Status)
+	if activated {
+		sendGiftCard(db, giftCardID.String)
+	}
+	return nil
+}
+
+func updatePaymentGateway(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	if !requirePermission(w, r, db, establishmentID, "payouts") {
+		return
+	}
+	var req struct {
+		// Gateway is empty to settle pix and cards outside the platform.
+		Gateway string `json:"gateway"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	var gateway *string
+	if req.Gateway != "" {
+		_, ok, err := establishmentGateway(r.Context(), db, establishmentID, req.Gateway)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if !ok {
+			http.Error(w, "payment gateway "+req.Gateway+" is not available", http.StatusUnprocessableEntity)
+			return
+		}
+		gateway = &req.Gateway
+	}
+	if _, err := db.Exec(`UPDATE establishments SET payment_gateway=$1, updated_at=now() WHERE id=$2`, gateway, establishmentID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := recordAudit(db, r, establishmentID, "establishment.payment_gateway_updated", "establishment", establishmentID, req); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(req)
+}
+
+// startRefundProcessor sends pending refund adjustments (cancellations and
+// amendments that lowered the total) to the gateway that took the payment.
+// Adjustments for orders paid outside the platform stay PENDING for manual
+// settlement, as before.
+func startRefundProcessor(ctx context.Context, db *sql.DB) {
+	go func() {
+		for {
+			if err := processRefunds(ctx, db); err != nil {
+				log.Printf("refunds: %v", err)
+			}
+			time.Sleep(refundEvery)
+		}
+	}()
+}
+
+func processRefunds(ctx context.Context, db *sql.DB) error {
+	rows, err := db.Query(
+		`SELECT a.id, o.establishment_id, a.amount_cents, p.gateway, p.provider_charge_id
+		 FROM payment_adjustments a JOIN orders o ON o.id=a.order_id
+		 JOIN LATERAL (SELECT gateway, provider_charge_id FROM payments
+		   WHERE order_id=a.order_id AND status='paid' ORDER BY created_at DESC LIMIT 1) p ON true
+		 WHERE a.kind='refund' AND a.status='PENDING' ORDER BY a.created_at LIMIT $1`,
+		refundBatchSize,
+	)
+	if err != nil {
+		return err
+	}
+	type refund struct {
+		id, establishmentID, gateway, chargeID string
+		amount                                 int64
+	}
+	var todo []refund
+	for rows.Next() {
+		var rf refund
+		if err := rows.Scan(&rf.id, &rf.establishmentID, &rf.amount, &rf.gateway, &rf.chargeID); err != nil {
+			rows.Close()
+			return err
+		}
+		todo = append(todo, rf)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	for _, rf := range todo {
+		gw, ok, err := establishmentGateway(ctx, db, rf.establishmentID, rf.gateway)
+		if err != nil {
+			log.Printf("refund %s: %v", rf.id, err)
+			continue
+		}
+		if !ok {
+			continue
+		}
+		refundCtx, cancel := context.WithTimeout(ctx, gatewayTimeout)
+		err = gw.Refund(refundCtx, rf.chargeID, rf.amount, rf.id)
+		cancel()
+		status := "COMPLETED"
+		if err != nil {
+			log.Printf("refund %s via %s: %v", rf.id, rf.gateway, err)
+			status = "FAILED"
+		}
+		if _, err := db.Exec(`UPDATE payment_adjustments SET status=$1, updated_at=now() WHERE id=$2`, status, rf.id); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,21 @@
+package main
+
+import (
+	"slices"
+	"testing"
+)
+
+func TestWebhookChargeIDs(t *testing.T) {
+	for body, want := range map[string][]string{
+		`{"type":"payment_intent.succeeded","data":{"object":{"id":"pi_1","status":"succeeded"}}}`: {"pi_1"},
+		`{"type":"charge.refunded","data":{"object":{"id":"ch_1","payment_intent":"pi_1"}}}`:       {"ch_1", "pi_1"},
+		`{"type":"payment","data":{"id":"123456"}}`:                                                {"123456"},
+		`{"id":"ORDE_1","charges":[]}`:                                                             {"ORDE_1"},
+		`{"charge_id":"fake_1","status":"paid"}`:                                                   {"fake_1"},
+		`not json`:                                                                                 nil,
+	} {
+		if got := webhookChargeIDs([]byte(body)); !slices.Equal(got, want) {
+			t.Errorf("webhookChargeIDs(%s) = %v, want %v", body, got, want)
+		}
+	}
+}
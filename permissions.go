@@ -0,0 +1,109 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+)
+
+// Some actions are guarded by a per-establishment policy instead of a fixed
+// role: owners pick the lowest role allowed to perform them, within the
+// action's floor, through the *_min_role settings. Handlers ask
+// requirePermission (or permitted, inside a transaction) rather than
+// requireRole for these actions.
+
+type permission struct {
+	Action      string
+	Description string
+	// setting holds the minimum role; its default is the role the action
+	// needed before policies existed.
+	setting string
+}
+
+var permissions = []permission{
+	{Action: "prices", Description: "Create and delete products, and change or move their prices.", setting: "prices_min_role"},
+	{Action: "coupons", Description: "Create campaigns that hand out coupons.", setting: "coupons_min_role"},
+	{Action: "payouts", Description: "Choose the payment gateway sales are settled through.", setting: "payouts_min_role"},
+}
+
+func findPermission(action string) permission {
+	for _, p := range permissions {
+		if p.Action == action {
+			return p
+		}
+	}
+	panic("unknown permission " + action)
+}
+
+// permissionRole returns the lowest role allowed to perform the action.
+func permissionRole(q queryer, establishmentID, action string) (string, error) {
+	v, err := settingValue(q, establishmentID, findPermission(action).setting)
+	if err != nil {
+		return "", err
+	}
+	role, _ := v.(string)
+	return role, nil
+}
+
+// permitted reports whether the authenticated owner may perform the action
+// on the establishment.
+func permitted(q queryer, r *http.Request, establishmentID, action string) (bool, error) {
+	minRole, err := permissionRole(q, establishmentID, action)
+	if err != nil {
+		return false, err
+	}
+	role, err := establishmentRole(q, establishmentID, currentClaims(r).Sub)
+	if err != nil {
+		return false, err
+	}
+	return roleRank[role] >= roleRank[minRole], nil
+}
+
+// requirePermission writes a 403 and returns false unless the authenticated
+// owner may perform the action.
+func requirePermission(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID, action string) bool {
+	ok, err := permitted(db, r, establishmentID, action)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if !ok {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+type PermissionEntry struct {
+	Action      string `json:"action"`
+	Description string `json:"description"`
+	MinRole     string `json:"min_role"`
+	DefaultRole string `json:"default_role"`
+	// Roles tells, for each role, whether it may perform the action.
+	Roles map[string]bool `json:"roles"`
+	// Setting is the settings key owners change to move MinRole.
+	Setting string `json:"setting"`
+}
+
+// permissionsMatrix serves GET /establishments/{id}/permissions.
+func permissionsMatrix(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	if !requireRole(w, r, db, establishmentID, "staff") {
+		return
+	}
+	list := []PermissionEntry{}
+	for _, p := range permissions {
+		minRole, err := permissionRole(db, establishmentID, p.Action)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		d, _ := findSetting(p.setting)
+		e := PermissionEntry{Action: p.Action, Description: p.Description, MinRole: minRole, DefaultRole: d.Default.(string), Roles: map[string]bool{}, Setting: p.setting}
+		for role, rank := range roleRank {
+			e.Roles[role] = rank >= roleRank[minRole]
+		}
+		list = append(list, e)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,78 @@
+package main
+
+import (
+	"database/sql"
+	"slices"
+
+	"github.com/lib/pq"
+)
+
+// preload runs query once for all parent ids, which it gets as a text array
+// in $1 (match with "= ANY($1::uuid[])"), and groups the scanned children by
+// the parent id scan returns. Use it instead of a query per parent when
+// assembling nested responses. Parents without children are missing from
+// the map.
+func preload[T any](q rowsQueryer, query string, ids []string, scan func(rows *sql.Rows) (string, T, error)) (map[string][]T, error) {
+	byParent := map[string][]T{}
+	ids = slices.Compact(slices.Sorted(slices.Values(ids)))
+	if len(ids) == 0 {
+		return byParent, nil
+	}
+	rows, err := q.Query(query, pq.Array(ids))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		parent, child, err := scan(rows)
+		if err != nil {
+			return nil, err
+		}
+		byParent[parent] = append(byParent[parent], child)
+	}
+	return byParent, rows.Err()
+}
+
+// loadOrderItems returns the items of the given orders, by order id.
+func loadOrderItems(q rowsQueryer, orderIDs []string) (map[string][]OrderItem, error) {
+	return preload(q,
+		`SELECT order_id, product_id, product_name, quantity, unit_price_cents, total_price_cents FROM order_items WHERE order_id = ANY($1::uuid[])`,
+		orderIDs,
+		func(rows *sql.Rows) (string, OrderItem, error) {
+			var orderID string
+			var it OrderItem
+			err := rows.Scan(&orderID, &it.ProductID, &it.ProductName, &it.Quantity, &it.UnitPriceCents, &it.TotalPriceCents)
+			return orderID, it, err
+		},
+	)
+}
+
+// checkoutProduct is what placeOrder needs of an ordered product.
+type checkoutProduct struct {
+	establishmentID  string
+	name             string
+	priceCents       int64
+	fulfillmentTypes []string
+}
+
+// loadCheckoutProducts returns the active products among ids, by id.
+func loadCheckoutProducts(q rowsQueryer, ids []string) (map[string]checkoutProduct, error) {
+	found, err := preload(q,
+		`SELECT id, establishment_id, name, price_cents, fulfillment_types FROM products WHERE id = ANY($1::uuid[]) AND is_active`,
+		ids,
+		func(rows *sql.Rows) (string, checkoutProduct, error) {
+			var id string
+			var p checkoutProduct
+			err := rows.Scan(&id, &p.establishmentID, &p.name, &p.priceCents, pq.Array(&p.fulfillmentTypes))
+			return id, p, err
+		},
+	)
+	if err != nil {
+		return nil, err
+	}
+	products := map[string]checkoutProduct{}
+	for id, ps := range found {
+		products[id] = ps[0]
+	}
+	return products, nil
+}
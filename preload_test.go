@@ -0,0 +1,41 @@
+package main
+
+import "testing"
+
+func TestPreloadQueryCount(t *testing.T) {
+	db, queries := openCountingTestDB(t)
+	tenant := seedTestTenant(t, db, 5, 4)
+	var orderIDs []string
+	rows, err := db.Query(`SELECT id FROM orders WHERE establishment_id=$1`, tenant.EstablishmentID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for rows.Next() {
+		var id string
+		if err := rows.Scan(&id); err != nil {
+			t.Fatal(err)
+		}
+		orderIDs = append(orderIDs, id)
+	}
+	rows.Close()
+
+	for _, tc := range []struct {
+		name string
+		load func() error
+		want int64
+	}{
+		{"no orders", func() error { _, err := loadOrderItems(db, nil); return err }, 0},
+		{"one order", func() error { _, err := loadOrderItems(db, orderIDs[:1]); return err }, 1},
+		{"all orders", func() error { _, err := loadOrderItems(db, orderIDs); return err }, 1},
+		{"one product", func() error { _, err := loadCheckoutProducts(db, tenant.ProductIDs[:1]); return err }, 1},
+		{"all products", func() error { _, err := loadCheckoutProducts(db, tenant.ProductIDs); return err }, 1},
+	} {
+		queries.Store(0)
+		if err := tc.load(); err != nil {
+			t.Fatalf("%s: %v", tc.name, err)
+		}
+		if got := queries.Load(); got != tc.want {
+			t.Errorf("%s: %d queries, want %d", tc.name, got, tc.want)
+		}
+	}
+}
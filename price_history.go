@@ -0,0 +1,71 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+type PriceChange struct {
+	PriceCents int       `json:"price_cents"`
+	ChangedBy  *string   `json:"changed_by"`
+	ChangedAt  time.Time `json:"changed_at"`
+}
+
+// recordPriceChanges appends a history entry for each product whose current
+// price differs from its last recorded one, so it can be called after any
+// write without checking whether the price actually moved.
+func recordPriceChanges(q execer, r *http.Request, productIDs ...string) error {
+	var actorID *string
+	if c := currentClaims(r); c != nil {
+		actorID = &c.Sub
+	}
+	_, err := q.Exec(
+		`INSERT INTO product_price_history (product_id, price_cents, changed_by)
+		 SELECT p.id, p.price_cents, $2 FROM products p
+		 WHERE p.id = ANY($1::uuid[]) AND p.price_cents IS DISTINCT FROM (
+		   SELECT h.price_cents FROM product_price_history h WHERE h.product_id=p.id ORDER BY h.changed_at DESC, h.id DESC LIMIT 1)`,
+		pq.Array(productIDs), actorID,
+	)
+	return err
+}
+
+func listPriceHistory(w http.ResponseWriter, r *http.Request, db *sql.DB, productID string) {
+	var establishmentID string
+	err := db.QueryRow(`SELECT establishment_id FROM products WHERE id=$1`, productID).Scan(&establishmentID)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, nil)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !requireRole(w, r, db, establishmentID, "staff") {
+		return
+	}
+	rows, err := db.Query(
+		`SELECT price_cents, changed_by, changed_at FROM product_price_history WHERE product_id=$1 ORDER BY changed_at DESC, id DESC`,
+		productID,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	list := []PriceChange{}
+	for rows.Next() {
+		var c PriceChange
+		if err := rows.Scan(&c.PriceCents, &c.ChangedBy, &c.ChangedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		list = append(list, c)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,533 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+)
+
+const printKeepAlive = 25 * time.Second
+
+// Printer is a station printer driven by the establishment's printer agent.
+// Items of categories without a print rule go to the default printer, if any.
+type Printer struct {
+	ID              string    `json:"id"`
+	EstablishmentID string    `json:"establishment_id"`
+	Name            string    `json:"name"`
+	Station         string    `json:"station"`
+	IsDefault       bool      `json:"is_default"`
+	CreatedAt       time.Time `json:"created_at"`
+}
+
+// PrintRule sends a category's items, and those of its subcategories without
+// a rule of their own, to a printer.
+type PrintRule struct {
+	CategoryID string `json:"category_id"`
+	PrinterID  string `json:"printer_id"`
+}
+
+type TicketItem struct {
+	ProductName string `json:"product_name"`
+	Quantity    int    `json:"quantity"`
+}
+
+// PrintTicket is the part of an order a single station has to prepare.
+type PrintTicket struct {
+	OrderID         string       `json:"order_id"`
+	DisplayNumber   string       `json:"display_number"`
+	Station         string       `json:"station"`
+	FulfillmentType string       `json:"fulfillment_type"`
+	DeliveryAddress string       `json:"delivery_address"`
+	OrderedAt       time.Time    `json:"ordered_at"`
+	Items           []TicketItem `json:"items"`
+}
+
+type PrintJob struct {
+	ID        string          `json:"id"`
+	PrinterID string          `json:"printer_id"`
+	OrderID   string          `json:"order_id"`
+	Ticket    json.RawMessage `json:"ticket"`
+	Status    string          `json:"status"`
+	CreatedAt time.Time       `json:"created_at"`
+	// QueuedAt moves forward when a job is sent back to pending to reprint.
+	QueuedAt time.Time `json:"queued_at"`
+}
+
+func printersRoute(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID, printerID string) {
+	role := "manager"
+	if r.Method == http.MethodGet {
+		role = "staff"
+	}
+	if !requireRole(w, r, db, establishmentID, role) {
+		return
+	}
+	switch {
+	case printerID == "" && r.Method == http.MethodGet:
+		listPrinters(w, db, establishmentID)
+	case printerID == "" && r.Method == http.MethodPost:
+		savePrinter(w, r, db, establishmentID, "")
+	case printerID != "" && r.Method == http.MethodPut:
+		savePrinter(w, r, db, establishmentID, printerID)
+	case printerID != "" && r.Method == http.MethodDelete:
+		res, err := db.Exec(`DELETE FROM printers WHERE id=$1 AND establishment_id=$2`, printerID, establishmentID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.NotFound(w, nil)
+			return
+		}
+		if err := recordAudit(db, r, establishmentID, "printer.deleted", "printer", printerID, nil); err != nil {
+			log.Printf("audit printer.deleted %s: %v", printerID, err)
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func listPrinters(w http.ResponseWriter, db *sql.DB, establishmentID string) {
+	rows, err := db.Query(`SELECT id, establishment_id, name, station, is_default, created_at FROM printers WHERE establishment_id=$1 ORDER BY name`, establishmentID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	list := []Printer{}
+	for rows.Next() {
+		var p Printer
+		if err := rows.Scan(&p.ID, &p.EstablishmentID, &p.Name, &p.Station, &p.IsDefault, &p.CreatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		list = append(list, p)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// savePrinter creates a printer, or updates it when printerID is set. Making a
+// printer the default clears the flag on the establishment's other printers.
+func savePrinter(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID, printerID string) {
+	var p Printer
+	if err := json.NewDecoder(r.Body).Decode(&p); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	p.Name, p.Station = sanitizeText(p.Name), sanitizeText(p.Station)
+	if p.Name == "" {
+		http.Error(w, "name is required", http.StatusUnprocessableEntity)
+		return
+	}
+	p.EstablishmentID = establishmentID
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if p.IsDefault {
+		if _, err := tx.Exec(`UPDATE printers SET is_default=false WHERE establishment_id=$1 AND is_default AND id::text<>$2`, establishmentID, printerID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	status, action := http.StatusCreated, "printer.created"
+	if printerID == "" {
+		err = tx.QueryRow(
+			`INSERT INTO printers (establishment_id, name, station, is_default) VALUES ($1,$2,$3,$4) RETURNING id, created_at`,
+			establishmentID, p.Name, p.Station, p.IsDefault,
+		).Scan(&p.ID, &p.CreatedAt)
+	} else {
+		status, action = http.StatusOK, "printer.updated"
+		err = tx.QueryRow(
+			`UPDATE printers SET name=$3, station=$4, is_default=$5 WHERE id=$1 AND establishment_id=$2 RETURNING id, created_at`,
+			printerID, establishmentID, p.Name, p.Station, p.IsDefault,
+		).Scan(&p.ID, &p.CreatedAt)
+	}
+	if err == sql.ErrNoRows {
+		http.NotFound(w, nil)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := recordAudit(tx, r, establishmentID, action, "printer", p.ID, p); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(p)
+}
+
+func printRulesRoute(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	switch r.Method {
+	case http.MethodGet:
+		if requireRole(w, r, db, establishmentID, "staff") {
+			listPrintRules(w, db, establishmentID)
+		}
+	case http.MethodPut:
+		if requireRole(w, r, db, establishmentID, "manager") {
+			putPrintRules(w, r, db, establishmentID)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func listPrintRules(w http.ResponseWriter, db *sql.DB, establishmentID string) {
+	rows, err := db.Query(`SELECT category_id, printer_id FROM print_rules WHERE establishment_id=$1 ORDER BY category_id`, establishmentID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	list := []PrintRule{}
+	for rows.Next() {
+		var pr PrintRule
+		if err := rows.Scan(&pr.CategoryID, &pr.PrinterID); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		list = append(list, pr)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// putPrintRules replaces the establishment's category-to-printer mapping.
+func putPrintRules(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	var list []PrintRule
+	if err := json.NewDecoder(r.Body).Decode(&list); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if _, err := tx.Exec(`DELETE FROM print_rules WHERE establishment_id=$1`, establishmentID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for _, pr := range list {
+		res, err := tx.Exec(
+			`INSERT INTO print_rules (establishment_id, category_id, printer_id)
+			 SELECT $1, c.id, p.id FROM product_categories c, printers p
+			 WHERE c.id::text=$2 AND c.establishment_id=$1 AND p.id::text=$3 AND p.establishment_id=$1`,
+			establishmentID, pr.CategoryID, pr.PrinterID,
+		)
+		if isUniqueViolation(err) {
+			http.Error(w, "category "+pr.CategoryID+" has more than one rule", http.StatusUnprocessableEntity)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.Error(w, fmt.Sprintf("category %s or printer %s does not belong to this establishment", pr.CategoryID, pr.PrinterID), http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	if err := recordAudit(tx, r, establishmentID, "print_rules.updated", "establishment", establishmentID, list); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	listPrintRules(w, db, establishmentID)
+}
+
+// queueOrderTickets splits accepted orders into one ticket per printer and
+// queues them for the printer agent. Jobs are unique per order and printer,
+// so a redelivered event doesn't print twice.
+func queueOrderTickets(db *sql.DB) func(Event) {
+	return func(e Event) {
+		n, err := createPrintJobs(db, e.EstablishmentID, e.OrderID)
+		if err != nil {
+			log.Printf("print jobs %s: %v", e.OrderID, err)
+			return
+		}
+		if n > 0 {
+			// Not an outbox event: it just wakes up connected agent streams,
+			// on whichever instance they are.
+			if err := notifyLive(db, 0, Event{Type: eventPrintJobsQueued, OrderID: e.OrderID, EstablishmentID: e.EstablishmentID}); err != nil {
+				log.Printf("print jobs %s: %v", e.OrderID, err)
+			}
+		}
+	}
+}
+
+func createPrintJobs(db *sql.DB, establishmentID, orderID string) (int, error) {
+	parents := map[string]string{}
+	routes := map[string]string{}
+	rows, err := db.Query(
+		`SELECT c.id, COALESCE(c.parent_id::text,''), COALESCE(r.printer_id::text,'')
+		 FROM product_categories c LEFT JOIN print_rules r ON r.category_id=c.id WHERE c.establishment_id=$1`,
+		establishmentID,
+	)
+	if err != nil {
+		return 0, err
+	}
+	for rows.Next() {
+		var id, parent, printer string
+		if err := rows.Scan(&id, &parent, &printer); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		parents[id] = parent
+		if printer != "" {
+			routes[id] = printer
+		}
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	var defaultPrinter string
+	err = db.QueryRow(`SELECT id FROM printers WHERE establishment_id=$1 AND is_default`, establishmentID).Scan(&defaultPrinter)
+	if err != nil && err != sql.ErrNoRows {
+		return 0, err
+	}
+	if len(routes) == 0 && defaultPrinter == "" {
+		return 0, nil
+	}
+	// printerFor walks up the category tree to the nearest rule.
+	printerFor := func(categoryID string) string {
+		for c, depth := categoryID, 0; c != "" && depth <= maxCategoryDepth; c, depth = parents[c], depth+1 {
+			if p, ok := routes[c]; ok {
+				return p
+			}
+		}
+		return defaultPrinter
+	}
+
+	base := PrintTicket{OrderID: orderID}
+	var number int
+	err = db.QueryRow(`SELECT order_number, fulfillment_type, delivery_address, ordered_at FROM orders WHERE id=$1`, orderID).Scan(
+		&number, &base.FulfillmentType, &base.DeliveryAddress, &base.OrderedAt,
+	)
+	if err != nil {
+		return 0, err
+	}
+	base.DisplayNumber = formatOrderNumber(number)
+	rows, err = db.Query(
+		`SELECT i.product_name, i.quantity, COALESCE(p.category_id::text,'') FROM order_items i LEFT JOIN products p ON p.id=i.product_id
+		 WHERE i.order_id=$1 ORDER BY i.product_name`,
+		orderID,
+	)
+	if err != nil {
+		return 0, err
+	}
+	tickets := map[string]*PrintTicket{}
+	var order []string
+	for rows.Next() {
+		var it TicketItem
+		var categoryID string
+		if err := rows.Scan(&it.ProductName, &it.Quantity, &categoryID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		printer := printerFor(categoryID)
+		if printer == "" {
+			continue
+		}
+		if tickets[printer] == nil {
+			t := base
+			tickets[printer] = &t
+			order = append(order, printer)
+		}
+		tickets[printer].Items = append(tickets[printer].Items, it)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+	queued := 0
+	for _, printer := range order {
+		t := tickets[printer]
+		if err := tx.QueryRow(`SELECT station FROM printers WHERE id=$1`, printer).Scan(&t.Station); err != nil {
+			return 0, err
+		}
+		ticket, err := json.Marshal(t)
+		if err != nil {
+			return 0, err
+		}
+		res, err := tx.Exec(
+			`INSERT INTO print_jobs (establishment_id, printer_id, order_id, ticket) VALUES ($1,$2,$3,$4) ON CONFLICT (order_id, printer_id) DO NOTHING`,
+			establishmentID, printer, orderID, ticket,
+		)
+		if err != nil {
+			return 0, err
+		}
+		n, _ := res.RowsAffected()
+		queued += int(n)
+	}
+	return queued, tx.Commit()
+}
+
+func printJobsRoute(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID, jobID string) {
+	if !requireRole(w, r, db, establishmentID, "staff") {
+		return
+	}
+	switch {
+	case jobID == "stream" && r.Method == http.MethodGet:
+		streamPrintJobs(w, r, db, establishmentID)
+	case jobID != "" && r.Method == http.MethodPut:
+		updatePrintJob(w, r, db, establishmentID, jobID)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// streamPrintJobs is the printer agent channel: it sends every pending job,
+// optionally only those of ?printer_id=, as a server-sent "job" event and
+// then new jobs as they are queued. Jobs stay pending until the agent
+// reports them through updatePrintJob, so a reconnecting agent receives
+// unacknowledged jobs again.
+func streamPrintJobs(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	printerID := r.URL.Query().Get("printer_id")
+
+	wake := make(chan struct{}, 1)
+	defer liveEvents.Subscribe(eventPrintJobsQueued, func(e Event) {
+		if e.EstablishmentID != establishmentID {
+			return
+		}
+		select {
+		case wake <- struct{}{}:
+		default:
+		}
+	})()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	sent := map[string]time.Time{}
+	send := func() error {
+		jobs, err := pendingPrintJobs(db, establishmentID, printerID)
+		if err != nil {
+			return err
+		}
+		for _, j := range jobs {
+			if !sent[j.ID].Equal(j.QueuedAt) {
+				sent[j.ID] = j.QueuedAt
+				writeSSE(w, "job", j)
+			}
+		}
+		return nil
+	}
+	if err := send(); err != nil {
+		log.Printf("print job stream %s: %v", establishmentID, err)
+		return
+	}
+	flusher.Flush()
+
+	ticker := time.NewTicker(printKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case <-wake:
+			if err := send(); err != nil {
+				log.Printf("print job stream %s: %v", establishmentID, err)
+				return
+			}
+		case <-ticker.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		}
+		flusher.Flush()
+	}
+}
+
+func pendingPrintJobs(db *sql.DB, establishmentID, printerID string) ([]PrintJob, error) {
+	rows, err := db.Query(
+		`SELECT id, printer_id, order_id, ticket, status, created_at, queued_at FROM print_jobs
+		 WHERE establishment_id=$1 AND status='pending' AND ($2='' OR printer_id::text=$2) ORDER BY queued_at, id`,
+		establishmentID, printerID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []PrintJob{}
+	for rows.Next() {
+		var j PrintJob
+		var ticket []byte
+		if err := rows.Scan(&j.ID, &j.PrinterID, &j.OrderID, &ticket, &j.Status, &j.CreatedAt, &j.QueuedAt); err != nil {
+			return nil, err
+		}
+		j.Ticket = ticket
+		list = append(list, j)
+	}
+	return list, rows.Err()
+}
+
+// updatePrintJob records the agent's outcome. Setting a job back to pending
+// reprints it.
+func updatePrintJob(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID, jobID string) {
+	var req struct {
+		Status string `json:"status"`
+		Error  string `json:"error"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	switch req.Status {
+	case "printed", "failed", "pending":
+	default:
+		http.Error(w, "status must be printed, failed or pending", http.StatusUnprocessableEntity)
+		return
+	}
+	res, err := db.Exec(
+		`UPDATE print_jobs SET status=$3, error=$4, printed_at=CASE WHEN $3='printed' THEN now() END,
+		   queued_at=CASE WHEN $3='pending' THEN now() ELSE queued_at END
+		 WHERE id=$1 AND establishment_id=$2`,
+		jobID, establishmentID, req.Status, strings.TrimSpace(req.Error),
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.NotFound(w, nil)
+		return
+	}
+	if req.Status == "pending" {
+		if err := notifyLive(db, 0, Event{Type: eventPrintJobsQueued, EstablishmentID: establishmentID}); err != nil {
+			log.Printf("print jobs %s: %v", establishmentID, err)
+		}
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
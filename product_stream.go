@@ -0,0 +1,55 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+
+	"github.com/lib/pq"
+)
+
+const streamFlushEvery = 100
+
+// streamProducts writes the establishment's products as NDJSON in id order,
+// one row at a time. A client that lost the connection resumes by passing the
+// id of the last product it received as ?cursor=.
+func streamProducts(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	if !requireRole(w, r, db, establishmentID, "staff") {
+		return
+	}
+	rows, err := db.QueryContext(r.Context(),
+		`SELECT id, establishment_id, category_id, name, description, price_cents, image_key, image_alt_text, banner_key, is_active, fulfillment_types, stock_quantity, barcode
+		 FROM products WHERE establishment_id=$1 AND ($2='' OR id > $2::uuid) ORDER BY id`,
+		establishmentID, r.URL.Query().Get("cursor"),
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	w.Header().Set("Content-Type", "application/x-ndjson")
+	flusher, _ := w.(http.Flusher)
+	enc := json.NewEncoder(w)
+	n := 0
+	for rows.Next() {
+		var p Product
+		if err := rows.Scan(&p.ID, &p.EstablishmentID, &p.CategoryID, &p.Name, &p.Description, &p.PriceCents, &p.ImageKey, &p.AltText, &p.BannerKey, &p.IsActive, pq.Array(&p.FulfillmentTypes), &p.Stock, &p.Barcode); err != nil {
+			log.Printf("product stream %s: %v", establishmentID, err)
+			return
+		}
+		p.ImageURL, p.BannerURL = assetURL(p.ImageKey), assetURL(p.BannerKey)
+		if err := enc.Encode(p); err != nil {
+			return
+		}
+		if n++; n%streamFlushEvery == 0 && flusher != nil {
+			flusher.Flush()
+		}
+	}
+	// Headers are already sent, so a failure mid-stream can only be logged;
+	// the client notices the truncated stream and resumes from its cursor.
+	if err := rows.Err(); err != nil {
+		log.Printf("product stream %s: %v", establishmentID, err)
+	}
+}
@@ -0,0 +1,221 @@
+package main
+
+import (
+	"bytes"
+	"database/sql"
+	"encoding/hex"
+	"fmt"
+	"html"
+	"image"
+	"image/color"
+	"image/draw"
+	"image/png"
+	"io"
+	"net/http"
+	"net/url"
+	"regexp"
+	"strconv"
+	"strings"
+)
+
+// GET /establishments/{id}/qr renders a QR code for the menu, or for a table
+// with target=table&table=12, so owners can print table tents. Options:
+// format=png|svg, size (pixels, 128 to 2048), color (hex of the dark
+// modules) and logo=true to put the establishment's image in the middle,
+// which switches to the higher error correction level.
+
+const (
+	defaultQRSize = 512
+	minQRSize     = 128
+	maxQRSize     = 2048
+	// qrQuietZone is the blank margin scanners need, in modules.
+	qrQuietZone = 4
+	// maxQRLogoBytes bounds the establishment image downloaded for the logo.
+	maxQRLogoBytes = 5 << 20
+)
+
+var (
+	qrColorPattern = regexp.MustCompile(`^#?[0-9a-fA-F]{6}$`)
+	qrTablePattern = regexp.MustCompile(`^[0-9A-Za-z-]{1,10}$`)
+)
+
+func getEstablishmentQR(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	if !requireRole(w, r, db, establishmentID, "staff") {
+		return
+	}
+	q := r.URL.Query()
+	target := menuPageURL(establishmentID)
+	switch q.Get("target") {
+	case "", "menu":
+	case "table":
+		table := q.Get("table")
+		if !qrTablePattern.MatchString(table) {
+			http.Error(w, "table must have 1 to 10 letters, digits or hyphens", http.StatusBadRequest)
+			return
+		}
+		target += "?mesa=" + url.QueryEscape(table)
+	default:
+		http.Error(w, "target must be menu or table", http.StatusBadRequest)
+		return
+	}
+	size := defaultQRSize
+	if v := q.Get("size"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < minQRSize || n > maxQRSize {
+			http.Error(w, "size must be between 128 and 2048", http.StatusBadRequest)
+			return
+		}
+		size = n
+	}
+	dark := color.RGBA{0, 0, 0, 255}
+	if v := q.Get("color"); v != "" {
+		if !qrColorPattern.MatchString(v) {
+			http.Error(w, "color must be a hex color like #1a2b3c", http.StatusBadRequest)
+			return
+		}
+		b, _ := hex.DecodeString(strings.TrimPrefix(v, "#"))
+		dark = color.RGBA{b[0], b[1], b[2], 255}
+		// Scanners need the modules clearly darker than the white background.
+		if 299*int(b[0])+587*int(b[1])+114*int(b[2]) > 128_000 {
+			http.Error(w, "color is too light to scan", http.StatusBadRequest)
+			return
+		}
+	}
+	format := q.Get("format")
+	if format == "" {
+		format = "png"
+	}
+	if format != "png" && format != "svg" {
+		http.Error(w, "format must be png or svg", http.StatusBadRequest)
+		return
+	}
+
+	var logoKey string
+	level := qrLevelM
+	if q.Get("logo") == "true" {
+		if err := db.QueryRow(`SELECT COALESCE(image_key,'') FROM establishments WHERE id=$1`, establishmentID).Scan(&logoKey); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if logoKey == "" {
+			http.Error(w, "the establishment has no image to use as logo", http.StatusUnprocessableEntity)
+			return
+		}
+		level = qrLevelH
+	}
+	code, err := encodeQR([]byte(target), level)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	if format == "svg" {
+		w.Header().Set("Content-Type", "image/svg+xml")
+		w.Write(qrSVG(code, size, dark, assetURL(logoKey)))
+		return
+	}
+	var logo image.Image
+	if logoKey != "" {
+		if logo, err = fetchQRLogo(r, logoKey); err != nil {
+			http.Error(w, "could not load the establishment image: "+err.Error(), http.StatusBadGateway)
+			return
+		}
+	}
+	var buf bytes.Buffer
+	if err := png.Encode(&buf, qrImage(code, size, dark, logo)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "image/png")
+	w.Write(buf.Bytes())
+}
+
+// qrLogoSide is the logo's side in modules: about a fifth of the symbol,
+// well within what level H recovers.
+func qrLogoSide(code *qrCode) int {
+	return code.size / 5
+}
+
+// qrImage draws the symbol with its quiet zone, scaled by the largest whole
+// number of pixels per module that fits size.
+func qrImage(code *qrCode, size int, dark color.RGBA, logo image.Image) *image.RGBA {
+	modules := code.size + 2*qrQuietZone
+	scale := max(1, size/modules)
+	img := image.NewRGBA(image.Rect(0, 0, modules*scale, modules*scale))
+	draw.Draw(img, img.Bounds(), image.White, image.Point{}, draw.Src)
+	fg := image.NewUniform(dark)
+	for y := 0; y < code.size; y++ {
+		for x := 0; x < code.size; x++ {
+			if code.modules[y][x] {
+				px, py := (x+qrQuietZone)*scale, (y+qrQuietZone)*scale
+				draw.Draw(img, image.Rect(px, py, px+scale, py+scale), fg, image.Point{}, draw.Src)
+			}
+		}
+	}
+	if logo != nil {
+		side := qrLogoSide(code) * scale
+		b := logo.Bounds()
+		lw, lh := side, side
+		if b.Dx() > b.Dy() {
+			lh = max(1, b.Dy()*side/b.Dx())
+		} else {
+			lw = max(1, b.Dx()*side/b.Dy())
+		}
+		c := img.Bounds().Dx() / 2
+		pad := scale
+		draw.Draw(img, image.Rect(c-side/2-pad, c-side/2-pad, c+side/2+pad, c+side/2+pad), image.White, image.Point{}, draw.Src)
+		at := image.Rect(c-lw/2, c-lh/2, c-lw/2+lw, c-lh/2+lh)
+		draw.Draw(img, at, resizeImage(logo, lw, lh), image.Point{}, draw.Over)
+	}
+	return img
+}
+
+// qrSVG writes the dark modules as a single path in a viewBox measured in
+// modules; the logo is referenced by URL.
+func qrSVG(code *qrCode, size int, dark color.RGBA, logoURL string) []byte {
+	modules := code.size + 2*qrQuietZone
+	var b bytes.Buffer
+	fmt.Fprintf(&b, `<svg xmlns="http://www.w3.org/2000/svg" xmlns:xlink="http://www.w3.org/1999/xlink" width="%d" height="%d" viewBox="0 0 %d %d" shape-rendering="crispEdges">`, size, size, modules, modules)
+	fmt.Fprintf(&b, `<rect width="100%%" height="100%%" fill="#ffffff"/><path fill="#%02x%02x%02x" d="`, dark.R, dark.G, dark.B)
+	for y := 0; y < code.size; y++ {
+		for x := 0; x < code.size; x++ {
+			if code.modules[y][x] {
+				fmt.Fprintf(&b, "M%d %dh1v1h-1z", x+qrQuietZone, y+qrQuietZone)
+			}
+		}
+	}
+	b.WriteString(`"/>`)
+	if logoURL != "" {
+		side := qrLogoSide(code)
+		at := float64(modules-side) / 2
+		fmt.Fprintf(&b, `<rect x="%g" y="%g" width="%d" height="%d" fill="#ffffff"/>`, at-1, at-1, side+2, side+2)
+		fmt.Fprintf(&b, `<image x="%g" y="%g" width="%d" height="%d" preserveAspectRatio="xMidYMid meet" xlink:href="%s"/>`, at, at, side, side, html.EscapeString(logoURL))
+	}
+	b.WriteString(`</svg>`)
+	return b.Bytes()
+}
+
+func fetchQRLogo(r *http.Request, key string) (image.Image, error) {
+	u := assetURL(key)
+	if u == "" {
+		return nil, fmt.Errorf("storage is not configured")
+	}
+	req, err := http.NewRequestWithContext(r.Context(), http.MethodGet, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, fmt.Errorf("storage returned %s", resp.Status)
+	}
+	data, err := io.ReadAll(io.LimitReader(resp.Body, maxQRLogoBytes))
+	if err != nil {
+		return nil, err
+	}
+	img, _, err := image.Decode(bytes.NewReader(data))
+	return img, err
+}
@@ -0,0 +1,409 @@
+package main
+
+import "errors"
+
+// A small QR code encoder (ISO/IEC 18004) for the table tent endpoint: byte
+// mode only, versions 1 to 10, error correction levels M and H. That covers
+// URLs of up to 213 bytes at M, which is plenty for menu links.
+
+type qrLevel int
+
+const (
+	qrLevelM qrLevel = iota
+	// qrLevelH recovers up to 30% of the symbol, enough to cover the middle
+	// with a logo.
+	qrLevelH
+)
+
+var errQRTooLong = errors.New("content too long for a QR code")
+
+// qrBlocks describes the error correction blocks of a version and level:
+// EC codewords per block, then count and data codewords of the first and
+// second group.
+type qrBlocks struct {
+	ecLen         int
+	count1, data1 int
+	count2, data2 int
+}
+
+// qrBlockTable is indexed by [version-1][level].
+var qrBlockTable = [10][2]qrBlocks{
+	{{10, 1, 16, 0, 0}, {17, 1, 9, 0, 0}},
+	{{16, 1, 28, 0, 0}, {28, 1, 16, 0, 0}},
+	{{26, 1, 44, 0, 0}, {22, 2, 13, 0, 0}},
+	{{18, 2, 32, 0, 0}, {16, 4, 9, 0, 0}},
+	{{24, 2, 43, 0, 0}, {22, 2, 11, 2, 12}},
+	{{16, 4, 27, 0, 0}, {28, 4, 15, 0, 0}},
+	{{18, 4, 31, 0, 0}, {26, 4, 13, 1, 14}},
+	{{22, 2, 38, 2, 39}, {26, 4, 14, 2, 15}},
+	{{22, 3, 36, 2, 37}, {24, 4, 12, 4, 13}},
+	{{26, 4, 43, 1, 44}, {28, 6, 15, 2, 16}},
+}
+
+var qrAlignmentPositions = [10][]int{
+	{}, {6, 18}, {6, 22}, {6, 26}, {6, 30}, {6, 34},
+	{6, 22, 38}, {6, 24, 42}, {6, 26, 46}, {6, 28, 50},
+}
+
+// qrFormatLevelBits are the level's bits in the format information.
+var qrFormatLevelBits = [2]int{qrLevelM: 0, qrLevelH: 2}
+
+// qrCode is an encoded symbol; modules[y][x] is true for dark modules.
+type qrCode struct {
+	size       int
+	modules    [][]bool
+	isFunction [][]bool
+}
+
+// encodeQR encodes data in the smallest version that fits at the level.
+func encodeQR(data []byte, level qrLevel) (*qrCode, error) {
+	version := 0
+	for v := 1; v <= len(qrBlockTable); v++ {
+		b := qrBlockTable[v-1][level]
+		capacity := (b.count1*b.data1 + b.count2*b.data2) * 8
+		if 4+qrCountBits(v)+8*len(data) <= capacity {
+			version = v
+			break
+		}
+	}
+	if version == 0 {
+		return nil, errQRTooLong
+	}
+	blocks := qrBlockTable[version-1][level]
+	capacity := blocks.count1*blocks.data1 + blocks.count2*blocks.data2
+
+	var bits []bool
+	appendBits := func(v, n int) {
+		for i := n - 1; i >= 0; i-- {
+			bits = append(bits, v>>i&1 == 1)
+		}
+	}
+	appendBits(0b0100, 4)
+	appendBits(len(data), qrCountBits(version))
+	for _, b := range data {
+		appendBits(int(b), 8)
+	}
+	appendBits(0, min(4, capacity*8-len(bits)))
+	appendBits(0, (8-len(bits)%8)%8)
+	codewords := make([]byte, 0, capacity)
+	for i := 0; i < len(bits); i += 8 {
+		var b byte
+		for j := 0; j < 8; j++ {
+			if bits[i+j] {
+				b |= 1 << (7 - j)
+			}
+		}
+		codewords = append(codewords, b)
+	}
+	for pad := byte(0xEC); len(codewords) < capacity; pad ^= 0xEC ^ 0x11 {
+		codewords = append(codewords, pad)
+	}
+
+	q := newQRCode(version)
+	q.drawCodewords(qrInterleave(codewords, blocks))
+	best, bestPenalty := 0, -1
+	for mask := 0; mask < 8; mask++ {
+		q.applyMask(mask)
+		q.drawFormatBits(level, mask)
+		if p := q.penalty(); bestPenalty < 0 || p < bestPenalty {
+			best, bestPenalty = mask, p
+		}
+		q.applyMask(mask)
+	}
+	q.applyMask(best)
+	q.drawFormatBits(level, best)
+	return q, nil
+}
+
+func qrCountBits(version int) int {
+	if version < 10 {
+		return 8
+	}
+	return 16
+}
+
+// qrInterleave splits the data into blocks, appends each block's
+// Reed-Solomon codewords and interleaves the result.
+func qrInterleave(data []byte, b qrBlocks) []byte {
+	divisor := qrRSDivisor(b.ecLen)
+	var dataBlocks, ecBlocks [][]byte
+	for i := 0; i < b.count1+b.count2; i++ {
+		n := b.data1
+		if i >= b.count1 {
+			n = b.data2
+		}
+		block := data[:n]
+		data = data[n:]
+		dataBlocks = append(dataBlocks, block)
+		ecBlocks = append(ecBlocks, qrRSRemainder(block, divisor))
+	}
+	var out []byte
+	for i := 0; i < max(b.data1, b.data2); i++ {
+		for _, block := range dataBlocks {
+			if i < len(block) {
+				out = append(out, block[i])
+			}
+		}
+	}
+	for i := 0; i < b.ecLen; i++ {
+		for _, block := range ecBlocks {
+			out = append(out, block[i])
+		}
+	}
+	return out
+}
+
+// qrMultiply multiplies in GF(2^8) modulo x^8 + x^4 + x^3 + x^2 + 1.
+func qrMultiply(x, y byte) byte {
+	z := 0
+	for i := 7; i >= 0; i-- {
+		z = (z << 1) ^ ((z >> 7) * 0x11D)
+		z ^= int(y>>i&1) * int(x)
+	}
+	return byte(z)
+}
+
+func qrRSDivisor(degree int) []byte {
+	result := make([]byte, degree)
+	result[degree-1] = 1
+	root := byte(1)
+	for i := 0; i < degree; i++ {
+		for j := range result {
+			result[j] = qrMultiply(result[j], root)
+			if j+1 < len(result) {
+				result[j] ^= result[j+1]
+			}
+		}
+		root = qrMultiply(root, 0x02)
+	}
+	return result
+}
+
+func qrRSRemainder(data, divisor []byte) []byte {
+	result := make([]byte, len(divisor))
+	for _, b := range data {
+		factor := b ^ result[0]
+		copy(result, result[1:])
+		result[len(result)-1] = 0
+		for i, d := range divisor {
+			result[i] ^= qrMultiply(d, factor)
+		}
+	}
+	return result
+}
+
+// newQRCode draws the function patterns of the version: finders, timing,
+// alignment, version information and reserved format areas.
+func newQRCode(version int) *qrCode {
+	size := version*4 + 17
+	q := &qrCode{size: size, modules: make([][]bool, size), isFunction: make([][]bool, size)}
+	for i := range q.modules {
+		q.modules[i] = make([]bool, size)
+		q.isFunction[i] = make([]bool, size)
+	}
+	for i := 0; i < size; i++ {
+		q.setFunction(6, i, i%2 == 0)
+		q.setFunction(i, 6, i%2 == 0)
+	}
+	for _, c := range [][2]int{{3, 3}, {size - 4, 3}, {3, size - 4}} {
+		for dy := -4; dy <= 4; dy++ {
+			for dx := -4; dx <= 4; dx++ {
+				x, y := c[0]+dx, c[1]+dy
+				if x >= 0 && x < size && y >= 0 && y < size {
+					d := max(abs(dx), abs(dy))
+					q.setFunction(x, y, d != 2 && d != 4)
+				}
+			}
+		}
+	}
+	pos := qrAlignmentPositions[version-1]
+	n := len(pos)
+	for i := 0; i < n; i++ {
+		for j := 0; j < n; j++ {
+			if (i == 0 && j == 0) || (i == 0 && j == n-1) || (i == n-1 && j == 0) {
+				continue
+			}
+			for dy := -2; dy <= 2; dy++ {
+				for dx := -2; dx <= 2; dx++ {
+					q.setFunction(pos[i]+dx, pos[j]+dy, max(abs(dx), abs(dy)) != 1)
+				}
+			}
+		}
+	}
+	q.drawFormatBits(qrLevelM, 0)
+	if version >= 7 {
+		rem := version
+		for i := 0; i < 12; i++ {
+			rem = (rem << 1) ^ ((rem >> 11) * 0x1F25)
+		}
+		bits := version<<12 | rem
+		for i := 0; i < 18; i++ {
+			dark := bits>>i&1 == 1
+			a, b := size-11+i%3, i/3
+			q.setFunction(a, b, dark)
+			q.setFunction(b, a, dark)
+		}
+	}
+	return q
+}
+
+func abs(n int) int {
+	if n < 0 {
+		return -n
+	}
+	return n
+}
+
+func (q *qrCode) setFunction(x, y int, dark bool) {
+	q.modules[y][x] = dark
+	q.isFunction[y][x] = true
+}
+
+// drawFormatBits writes both copies of the format information, and the
+// dark module next to the bottom-left finder.
+func (q *qrCode) drawFormatBits(level qrLevel, mask int) {
+	data := qrFormatLevelBits[level]<<3 | mask
+	rem := data
+	for i := 0; i < 10; i++ {
+		rem = (rem << 1) ^ ((rem >> 9) * 0x537)
+	}
+	bits := (data<<10 | rem) ^ 0x5412
+	bit := func(i int) bool { return bits>>i&1 == 1 }
+	for i := 0; i <= 5; i++ {
+		q.setFunction(8, i, bit(i))
+	}
+	q.setFunction(8, 7, bit(6))
+	q.setFunction(8, 8, bit(7))
+	q.setFunction(7, 8, bit(8))
+	for i := 9; i < 15; i++ {
+		q.setFunction(14-i, 8, bit(i))
+	}
+	for i := 0; i < 8; i++ {
+		q.setFunction(q.size-1-i, 8, bit(i))
+	}
+	for i := 8; i < 15; i++ {
+		q.setFunction(8, q.size-15+i, bit(i))
+	}
+	q.setFunction(8, q.size-8, true)
+}
+
+// drawCodewords fills the data area in the zigzag order, two columns at a
+// time from the bottom right, skipping the vertical timing pattern.
+func (q *qrCode) drawCodewords(data []byte) {
+	i := 0
+	for right := q.size - 1; right >= 1; right -= 2 {
+		if right == 6 {
+			right = 5
+		}
+		for vert := 0; vert < q.size; vert++ {
+			for j := 0; j < 2; j++ {
+				x := right - j
+				y := vert
+				if (right+1)&2 == 0 {
+					y = q.size - 1 - vert
+				}
+				if !q.isFunction[y][x] && i < len(data)*8 {
+					q.modules[y][x] = data[i>>3]>>(7-i&7)&1 == 1
+					i++
+				}
+			}
+		}
+	}
+}
+
+// applyMask XORs the data area with mask pattern; applying it twice undoes
+// it.
+func (q *qrCode) applyMask(mask int) {
+	for y := 0; y < q.size; y++ {
+		for x := 0; x < q.size; x++ {
+			if q.isFunction[y][x] {
+				continue
+			}
+			var invert bool
+			switch mask {
+			case 0:
+				invert = (x+y)%2 == 0
+			case 1:
+				invert = y%2 == 0
+			case 2:
+				invert = x%3 == 0
+			case 3:
+				invert = (x+y)%3 == 0
+			case 4:
+				invert = (x/3+y/2)%2 == 0
+			case 5:
+				invert = x*y%2+x*y%3 == 0
+			case 6:
+				invert = (x*y%2+x*y%3)%2 == 0
+			case 7:
+				invert = ((x+y)%2+x*y%3)%2 == 0
+			}
+			q.modules[y][x] = q.modules[y][x] != invert
+		}
+	}
+}
+
+// penalty scores the symbol with the standard's four rules; the mask with
+// the lowest score is used.
+func (q *qrCode) penalty() int {
+	n := q.size
+	score := 0
+	finderLike := [][]bool{
+		{true, false, true, true, true, false, true, false, false, false, false},
+		{false, false, false, false, true, false, true, true, true, false, true},
+	}
+	line := make([]bool, n)
+	for pass := 0; pass < 2; pass++ {
+		for a := 0; a < n; a++ {
+			for b := 0; b < n; b++ {
+				if pass == 0 {
+					line[b] = q.modules[a][b]
+				} else {
+					line[b] = q.modules[b][a]
+				}
+			}
+			run := 1
+			for b := 1; b <= n; b++ {
+				if b < n && line[b] == line[b-1] {
+					run++
+					continue
+				}
+				if run >= 5 {
+					score += run - 2
+				}
+				run = 1
+			}
+			for b := 0; b+11 <= n; b++ {
+				for _, p := range finderLike {
+					match := true
+					for k, v := range p {
+						if line[b+k] != v {
+							match = false
+							break
+						}
+					}
+					if match {
+						score += 40
+					}
+				}
+			}
+		}
+	}
+	dark := 0
+	for y := 0; y < n; y++ {
+		for x := 0; x < n; x++ {
+			if q.modules[y][x] {
+				dark++
+			}
+			if x+1 < n && y+1 < n {
+				c := q.modules[y][x]
+				if q.modules[y][x+1] == c && q.modules[y+1][x] == c && q.modules[y+1][x+1] == c {
+					score += 3
+				}
+			}
+		}
+	}
+	total := n * n
+	score += abs(dark*20-total*10) / total * 10
+	return score
+}
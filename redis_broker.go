@@ -0,0 +1,219 @@
+package main
+
+import (
+	"bufio"
+	"crypto/tls"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const redisTimeout = 5 * time.Second
+
+// redisBroker publishes live events on a Redis pub/sub channel. It speaks
+// just enough RESP for AUTH, SELECT, PUBLISH and SUBSCRIBE.
+type redisBroker struct {
+	addr               string
+	useTLS             bool
+	username, password string
+	db                 int
+
+	mu   sync.Mutex
+	conn net.Conn
+	rd   *bufio.Reader
+}
+
+// newRedisBroker parses redis://[user:password@]host[:port][/db]; rediss://
+// connects over TLS.
+func newRedisBroker(rawURL string) (*redisBroker, error) {
+	u, err := url.Parse(rawURL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "redis" && u.Scheme != "rediss" {
+		return nil, fmt.Errorf("unsupported scheme %q", u.Scheme)
+	}
+	b := &redisBroker{addr: u.Host, useTLS: u.Scheme == "rediss"}
+	if u.Port() == "" {
+		b.addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		b.username = u.User.Username()
+		b.password, _ = u.User.Password()
+	}
+	if path := strings.Trim(u.Path, "/"); path != "" {
+		if b.db, err = strconv.Atoi(path); err != nil {
+			return nil, fmt.Errorf("invalid database %q", path)
+		}
+	}
+	return b, nil
+}
+
+func (*redisBroker) Name() string { return "redis" }
+
+func (b *redisBroker) Publish(payload []byte) error {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	// Retry once on a fresh connection in case the pooled one went stale.
+	var err error
+	for attempt := 0; attempt < 2; attempt++ {
+		if b.conn == nil {
+			if b.conn, b.rd, err = b.dial(); err != nil {
+				return err
+			}
+		}
+		b.conn.SetDeadline(time.Now().Add(redisTimeout))
+		if _, err = redisCommand(b.conn, b.rd, "PUBLISH", liveEventsChannel, string(payload)); err == nil {
+			return nil
+		}
+		b.conn.Close()
+		b.conn, b.rd = nil, nil
+	}
+	return err
+}
+
+func (b *redisBroker) Subscribe(out chan<- []byte) error {
+	conn, rd, err := b.dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(redisTimeout))
+	if err := redisWrite(conn, "SUBSCRIBE", liveEventsChannel); err != nil {
+		return err
+	}
+	for {
+		reply, err := redisRead(rd)
+		if err != nil {
+			return err
+		}
+		msg, ok := reply.([]any)
+		if !ok || len(msg) < 3 {
+			return fmt.Errorf("unexpected reply %v", reply)
+		}
+		switch kind, _ := msg[0].(string); kind {
+		case "subscribe":
+			// Subscribed connections only receive; keepalives detect a
+			// dead peer from here on.
+			conn.SetDeadline(time.Time{})
+			out <- nil
+		case "message":
+			if payload, _ := msg[2].(string); payload != "" {
+				out <- []byte(payload)
+			}
+		}
+	}
+}
+
+// dial connects, authenticates and selects the database.
+func (b *redisBroker) dial() (net.Conn, *bufio.Reader, error) {
+	d := &net.Dialer{Timeout: redisTimeout, KeepAlive: 15 * time.Second}
+	var conn net.Conn
+	var err error
+	if b.useTLS {
+		host, _, _ := net.SplitHostPort(b.addr)
+		conn, err = tls.DialWithDialer(d, "tcp", b.addr, &tls.Config{ServerName: host})
+	} else {
+		conn, err = d.Dial("tcp", b.addr)
+	}
+	if err != nil {
+		return nil, nil, err
+	}
+	rd := bufio.NewReader(conn)
+	conn.SetDeadline(time.Now().Add(redisTimeout))
+	if b.password != "" {
+		args := []string{"AUTH", b.password}
+		if b.username != "" {
+			args = []string{"AUTH", b.username, b.password}
+		}
+		if _, err := redisCommand(conn, rd, args...); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+	}
+	if b.db != 0 {
+		if _, err := redisCommand(conn, rd, "SELECT", strconv.Itoa(b.db)); err != nil {
+			conn.Close()
+			return nil, nil, err
+		}
+	}
+	return conn, rd, nil
+}
+
+// redisCommand sends one command and reads its reply, turning error replies
+// into errors.
+func redisCommand(w io.Writer, rd *bufio.Reader, args ...string) (any, error) {
+	if err := redisWrite(w, args...); err != nil {
+		return nil, err
+	}
+	reply, err := redisRead(rd)
+	if err != nil {
+		return nil, err
+	}
+	if e, ok := reply.(error); ok {
+		return nil, e
+	}
+	return reply, nil
+}
+
+func redisWrite(w io.Writer, args ...string) error {
+	var sb strings.Builder
+	fmt.Fprintf(&sb, "*%d\r\n", len(args))
+	for _, a := range args {
+		fmt.Fprintf(&sb, "$%d\r\n%s\r\n", len(a), a)
+	}
+	_, err := io.WriteString(w, sb.String())
+	return err
+}
+
+// redisRead reads one RESP2 reply: strings for simple and bulk strings,
+// int64 for integers, []any for arrays and error for error replies. Nil
+// bulk strings and arrays come back as nil.
+func redisRead(rd *bufio.Reader) (any, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	line = strings.TrimSuffix(line, "\r\n")
+	if line == "" {
+		return nil, errors.New("redis: empty reply")
+	}
+	switch line[0] {
+	case '+':
+		return line[1:], nil
+	case '-':
+		return errors.New("redis: " + line[1:]), nil
+	case ':':
+		return strconv.ParseInt(line[1:], 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		buf := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, buf); err != nil {
+			return nil, err
+		}
+		return string(buf[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line[1:])
+		if err != nil || n < 0 {
+			return nil, err
+		}
+		items := make([]any, n)
+		for i := range items {
+			if items[i], err = redisRead(rd); err != nil {
+				return nil, err
+			}
+		}
+		return items, nil
+	default:
+		return nil, fmt.Errorf("redis: unexpected reply %q", line)
+	}
+}
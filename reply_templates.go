@@ -0,0 +1,223 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"regexp"
+	"slices"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Reply templates are canned messages an establishment sends in the order
+// chat ("Seu pedido saiu para entrega!"). Placeholders are filled in on the
+// server from the order the reply goes to.
+
+const (
+	maxReplyTemplates    = 50
+	maxReplyTemplateName = 60
+)
+
+// replyPlaceholders are the variables a template may use, written as
+// {{name}}.
+var (
+	replyPlaceholders       = []string{"customer_name", "order_number", "eta", "establishment_name"}
+	replyPlaceholderPattern = regexp.MustCompile(`\{\{\s*(\w+)\s*\}\}`)
+)
+
+type ReplyTemplate struct {
+	ID        string    `json:"id"`
+	Name      string    `json:"name"`
+	Body      string    `json:"body"`
+	UpdatedAt time.Time `json:"updated_at"`
+	// Rendered is the body filled in for the order given as order_id when
+	// listing.
+	Rendered string `json:"rendered,omitempty"`
+}
+
+func replyTemplatesRoute(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID, templateID string) {
+	minRole := "manager"
+	if r.Method == http.MethodGet {
+		minRole = "staff"
+	}
+	if !requireRole(w, r, db, establishmentID, minRole) {
+		return
+	}
+	switch {
+	case templateID == "" && r.Method == http.MethodGet:
+		listReplyTemplates(w, r, db, establishmentID)
+	case templateID == "" && r.Method == http.MethodPost:
+		saveReplyTemplate(w, r, db, establishmentID, "")
+	case templateID != "" && r.Method == http.MethodPut:
+		saveReplyTemplate(w, r, db, establishmentID, templateID)
+	case templateID != "" && r.Method == http.MethodDelete:
+		res, err := db.Exec(`DELETE FROM reply_templates WHERE id::text=$1 AND establishment_id=$2`, templateID, establishmentID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.NotFound(w, nil)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// listReplyTemplates returns the templates by name. With ?order_id= each
+// one also comes rendered for that order, ready to send.
+func listReplyTemplates(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	var vars map[string]string
+	if orderID := r.URL.Query().Get("order_id"); orderID != "" {
+		var err error
+		vars, err = replyVariables(db, establishmentID, orderID)
+		if err == sql.ErrNoRows {
+			http.Error(w, "order not found", http.StatusUnprocessableEntity)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	rows, err := db.Query(`SELECT id, name, body, updated_at FROM reply_templates WHERE establishment_id=$1 ORDER BY name`, establishmentID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	list := []ReplyTemplate{}
+	for rows.Next() {
+		var t ReplyTemplate
+		if err := rows.Scan(&t.ID, &t.Name, &t.Body, &t.UpdatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if vars != nil {
+			t.Rendered = renderReply(t.Body, vars)
+		}
+		list = append(list, t)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func saveReplyTemplate(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID, templateID string) {
+	var t ReplyTemplate
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	t.Name, t.Body = sanitizeText(t.Name), sanitizeText(t.Body)
+	if t.Name == "" || len([]rune(t.Name)) > maxReplyTemplateName {
+		http.Error(w, "name is required and must have at most 60 characters", http.StatusUnprocessableEntity)
+		return
+	}
+	if t.Body == "" || len([]rune(t.Body)) > maxOrderMessage {
+		http.Error(w, "body is required and must have at most 1000 characters", http.StatusUnprocessableEntity)
+		return
+	}
+	if unknown := unknownPlaceholders(t.Body); len(unknown) > 0 {
+		http.Error(w, "unknown placeholders: "+strings.Join(unknown, ", "), http.StatusUnprocessableEntity)
+		return
+	}
+	var err error
+	if templateID == "" {
+		err = db.QueryRow(
+			`INSERT INTO reply_templates (establishment_id, name, body)
+			 SELECT $1, $2, $3 WHERE (SELECT COUNT(*) FROM reply_templates WHERE establishment_id=$1) < $4
+			 RETURNING id, updated_at`,
+			establishmentID, t.Name, t.Body, maxReplyTemplates,
+		).Scan(&t.ID, &t.UpdatedAt)
+		if err == sql.ErrNoRows {
+			http.Error(w, "an establishment can have at most 50 reply templates", http.StatusUnprocessableEntity)
+			return
+		}
+	} else {
+		err = db.QueryRow(
+			`UPDATE reply_templates SET name=$3, body=$4, updated_at=now() WHERE id::text=$1 AND establishment_id=$2 RETURNING id, updated_at`,
+			templateID, establishmentID, t.Name, t.Body,
+		).Scan(&t.ID, &t.UpdatedAt)
+		if err == sql.ErrNoRows {
+			http.NotFound(w, nil)
+			return
+		}
+	}
+	if isUniqueViolation(err) {
+		http.Error(w, "a template with this name already exists", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	if templateID == "" {
+		w.WriteHeader(http.StatusCreated)
+	}
+	json.NewEncoder(w).Encode(t)
+}
+
+func unknownPlaceholders(body string) []string {
+	var unknown []string
+	for _, m := range replyPlaceholderPattern.FindAllStringSubmatch(body, -1) {
+		if !slices.Contains(replyPlaceholders, m[1]) {
+			unknown = append(unknown, m[1])
+		}
+	}
+	return unknown
+}
+
+// replyVariables looks up the placeholder values for an order of the
+// establishment. The ETA is a local time, or empty when there is none.
+func replyVariables(db *sql.DB, establishmentID, orderID string) (map[string]string, error) {
+	var customer, establishment string
+	var number sql.NullInt64
+	var eta sql.NullTime
+	err := db.QueryRow(
+		`SELECT c.name, e.name, o.order_number, o.estimated_delivery_at FROM orders o
+		 JOIN customers c ON c.id=o.customer_id JOIN establishments e ON e.id=o.establishment_id
+		 WHERE o.id::text=$1 AND o.establishment_id=$2`,
+		orderID, establishmentID,
+	).Scan(&customer, &establishment, &number, &eta)
+	if err != nil {
+		return nil, err
+	}
+	vars := map[string]string{"customer_name": customer, "establishment_name": establishment, "order_number": "", "eta": ""}
+	if number.Valid {
+		vars["order_number"] = strconv.FormatInt(number.Int64, 10)
+	}
+	if eta.Valid {
+		loc, err := establishmentLocation(db, establishmentID)
+		if err != nil {
+			return nil, err
+		}
+		vars["eta"] = eta.Time.In(loc).Format("15:04")
+	}
+	return vars, nil
+}
+
+func renderReply(body string, vars map[string]string) string {
+	return replyPlaceholderPattern.ReplaceAllStringFunc(body, func(m string) string {
+		return vars[replyPlaceholderPattern.FindStringSubmatch(m)[1]]
+	})
+}
+
+// replyTemplateBody renders one template for an order, for sending it as a
+// chat message.
+func replyTemplateBody(db *sql.DB, establishmentID, templateID, orderID string) (string, error) {
+	var body string
+	err := db.QueryRow(`SELECT body FROM reply_templates WHERE id::text=$1 AND establishment_id=$2`, templateID, establishmentID).Scan(&body)
+	if err != nil {
+		return "", err
+	}
+	vars, err := replyVariables(db, establishmentID, orderID)
+	if err != nil {
+		return "", err
+	}
+	return renderReply(body, vars), nil
+}
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"time"
+)
+
+type RevenueReport struct {
+	From                time.Time `json:"from"`
+	To                  time.Time `json:"to"`
+	Orders              int       `json:"orders"`
+	GrossRevenueCents   int64     `json:"gross_revenue_cents"`
+	DisputedCents       int64     `json:"disputed_cents"`
+	ChargebackLossCents int64     `json:"chargeback_loss_cents"`
+	NetRevenueCents     int64     `json:"net_revenue_cents"`
+}
+
+// reportRange reads the from/to query parameters (YYYY-MM-DD, to exclusive)
+// as calendar days in loc, defaulting to the last 30 days. The bounds are
+// returned in UTC, ready to compare against stored timestamps.
+func reportRange(r *http.Request, loc *time.Location) (time.Time, time.Time, error) {
+	to := time.Now().In(loc).AddDate(0, 0, 1)
+	from := to.AddDate(0, 0, -30)
+	var err error
+	if v := r.URL.Query().Get("from"); v != "" {
+		if from, err = time.Parse(time.DateOnly, v); err != nil {
+			return from, to, err
+		}
+	}
+	if v := r.URL.Query().Get("to"); v != "" {
+		if to, err = time.Parse(time.DateOnly, v); err != nil {
+			return from, to, err
+		}
+	}
+	return localMidnightUTC(from, loc), localMidnightUTC(to, loc), nil
+}
+
+func reportRoute(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID, name string) {
+	if !requireRole(w, r, db, establishmentID, "manager") {
+		return
+	}
+	switch name {
+	case "revenue":
+		revenueReport(w, r, db, establishmentID)
+	case "heatmap":
+		heatmapReport(w, r, db, establishmentID)
+	case "conversion":
+		conversionReport(w, r, db, establishmentID)
+	case "missing_alt_text":
+		missingAltTextReport(w, r, db, establishmentID)
+	case "sla":
+		slaReport(w, r, db, establishmentID)
+	default:
+		http.NotFound(w, nil)
+	}
+}
+
+func revenueReport(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	loc, err := establishmentLocation(db, establishmentID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	from, to, err := reportRange(r, loc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rep := RevenueReport{From: from, To: to}
+	err = db.QueryRow(
+		`WITH o AS (
+		   SELECT id, total_cents FROM orders
+		   WHERE establishment_id=$1 AND status='COMPLETED' AND ordered_at >= $2 AND ordered_at < $3)
+		 , a AS (
+		   SELECT a.completed_orders, a.revenue_cents FROM order_daily_aggregates a JOIN establishments e ON e.id=a.establishment_id
+		   WHERE a.establishment_id=$1 AND a.day >= ($2 AT TIME ZONE 'UTC' AT TIME ZONE e.timezone)::date AND a.day < ($3 AT TIME ZONE 'UTC' AT TIME ZONE e.timezone)::date)
+		 SELECT (SELECT COUNT(*) FROM o) + (SELECT COALESCE(SUM(completed_orders),0) FROM a),
+		   (SELECT COALESCE(SUM(total_cents),0) FROM o) + (SELECT COALESCE(SUM(revenue_cents),0) FROM a),
+		   (SELECT COALESCE(SUM(d.amount_cents),0) FROM disputes d JOIN o ON o.id=d.order_id WHERE d.status IN ('open','under_review')),
+		   (SELECT COALESCE(SUM(d.amount_cents),0) FROM disputes d JOIN o ON o.id=d.order_id WHERE d.status='lost')`,
+		establishmentID, from, to,
+	).Scan(&rep.Orders, &rep.GrossRevenueCents, &rep.DisputedCents, &rep.ChargebackLossCents)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rep.NetRevenueCents = rep.GrossRevenueCents - rep.ChargebackLossCents
+	respond(w, r, "revenue_report", rep)
+}
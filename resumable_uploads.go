@@ -0,0 +1,262 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Resumable uploads follow the tus 1.0 core protocol with the creation and
+// termination extensions, so mobile apps can use a stock tus client. The
+// parts received so far are kept in upload_sessions; a client that loses
+// its connection asks for the offset with HEAD and continues from there.
+// Once the last byte arrives the file goes through the same checks as a
+// regular upload, and the final PATCH answers with the resulting upload.
+// Sessions untouched for uploadSessionTTL are deleted.
+
+const (
+	tusVersion       = "1.0.0"
+	uploadSessionTTL = 24 * time.Hour
+	// maxUploadChunk caps a single PATCH body.
+	maxUploadChunk = 2 << 20
+)
+
+type UploadSession struct {
+	ID        string    `json:"id"`
+	Purpose   string    `json:"purpose"`
+	Length    int       `json:"length"`
+	Offset    int       `json:"offset"`
+	ExpiresAt time.Time `json:"expires_at"`
+}
+
+func resumableUploadsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Tus-Resumable", tusVersion)
+		if r.Method == http.MethodOptions {
+			w.Header().Set("Tus-Version", tusVersion)
+			w.Header().Set("Tus-Extension", "creation,termination")
+			w.Header().Set("Tus-Max-Size", strconv.Itoa(maxUploadSize))
+			w.WriteHeader(http.StatusNoContent)
+			return
+		}
+		authenticate(db, func(w http.ResponseWriter, r *http.Request) {
+			if typ := currentClaims(r).Typ; typ != "owner" && typ != "customer" {
+				http.Error(w, "forbidden", http.StatusForbidden)
+				return
+			}
+			if r.Header.Get("Tus-Resumable") != tusVersion {
+				w.Header().Set("Tus-Version", tusVersion)
+				http.Error(w, "unsupported tus version", http.StatusPreconditionFailed)
+				return
+			}
+			id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/uploads/resumable"), "/")
+			switch {
+			case id == "" && r.Method == http.MethodPost:
+				createUploadSession(w, r, db)
+			case id != "" && r.Method == http.MethodHead:
+				uploadSessionOffset(w, r, db, id)
+			case id != "" && r.Method == http.MethodPatch:
+				appendUploadSession(w, r, db, id)
+			case id != "" && r.Method == http.MethodDelete:
+				deleteUploadSession(w, r, db, id)
+			default:
+				http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			}
+		})(w, r)
+	}
+}
+
+// tusMetadata decodes an Upload-Metadata header: comma-separated pairs of a
+// key and a base64 value.
+func tusMetadata(header string) map[string]string {
+	meta := map[string]string{}
+	for _, pair := range strings.Split(header, ",") {
+		k, v, _ := strings.Cut(strings.TrimSpace(pair), " ")
+		if k == "" {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(v)
+		if err != nil {
+			continue
+		}
+		meta[k] = string(b)
+	}
+	return meta
+}
+
+// createUploadSession serves POST /uploads/resumable. The purpose goes in
+// the Upload-Metadata header.
+func createUploadSession(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	length, err := strconv.Atoi(r.Header.Get("Upload-Length"))
+	if err != nil || length <= 0 {
+		http.Error(w, "Upload-Length is required", http.StatusBadRequest)
+		return
+	}
+	if length > maxUploadSize {
+		http.Error(w, "file too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	purpose := tusMetadata(r.Header.Get("Upload-Metadata"))["purpose"]
+	if !checkUploadPurpose(w, r, purpose) {
+		return
+	}
+	c := currentClaims(r)
+	s := UploadSession{Purpose: purpose, Length: length}
+	err = db.QueryRow(
+		`INSERT INTO upload_sessions (purpose, length, uploader_type, uploader_id) VALUES ($1,$2,$3,$4) RETURNING id, updated_at + $5 * interval '1 second'`,
+		purpose, length, c.Typ, c.Sub, int(uploadSessionTTL.Seconds()),
+	).Scan(&s.ID, &s.ExpiresAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Location", "/uploads/resumable/"+s.ID)
+	w.Header().Set("Upload-Expires", s.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.WriteHeader(http.StatusCreated)
+}
+
+// loadUploadSession returns the authenticated user's session, or false after
+// writing a 404.
+func loadUploadSession(w http.ResponseWriter, r *http.Request, q queryer, id string, lock bool) (*UploadSession, bool) {
+	if !uuidPattern.MatchString(id) {
+		http.NotFound(w, nil)
+		return nil, false
+	}
+	query := `SELECT id, purpose, length, octet_length(data), updated_at + $4 * interval '1 second' FROM upload_sessions
+		 WHERE id=$1 AND uploader_type=$2 AND uploader_id=$3 AND updated_at > now() - $4 * interval '1 second'`
+	if lock {
+		query += ` FOR UPDATE`
+	}
+	c := currentClaims(r)
+	var s UploadSession
+	err := q.QueryRow(query, id, c.Typ, c.Sub, int(uploadSessionTTL.Seconds())).Scan(&s.ID, &s.Purpose, &s.Length, &s.Offset, &s.ExpiresAt)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, nil)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	return &s, true
+}
+
+// uploadSessionOffset serves HEAD /uploads/resumable/{id}.
+func uploadSessionOffset(w http.ResponseWriter, r *http.Request, db *sql.DB, id string) {
+	s, ok := loadUploadSession(w, r, db, id, false)
+	if !ok {
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.Itoa(s.Offset))
+	w.Header().Set("Upload-Length", strconv.Itoa(s.Length))
+	w.Header().Set("Upload-Expires", s.ExpiresAt.UTC().Format(http.TimeFormat))
+	w.Header().Set("Cache-Control", "no-store")
+	w.WriteHeader(http.StatusOK)
+}
+
+// appendUploadSession serves PATCH /uploads/resumable/{id}, appending the
+// body at Upload-Offset. The session row is locked so concurrent PATCHes
+// from a retrying client can't interleave.
+func appendUploadSession(w http.ResponseWriter, r *http.Request, db *sql.DB, id string) {
+	if r.Header.Get("Content-Type") != "application/offset+octet-stream" {
+		http.Error(w, "Content-Type must be application/offset+octet-stream", http.StatusUnsupportedMediaType)
+		return
+	}
+	offset, err := strconv.Atoi(r.Header.Get("Upload-Offset"))
+	if err != nil {
+		http.Error(w, "Upload-Offset is required", http.StatusBadRequest)
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	s, ok := loadUploadSession(w, r, tx, id, true)
+	if !ok {
+		return
+	}
+	if offset != s.Offset {
+		http.Error(w, "Upload-Offset does not match the upload", http.StatusConflict)
+		return
+	}
+	chunk, err := io.ReadAll(io.LimitReader(r.Body, int64(min(maxUploadChunk, s.Length-s.Offset)+1)))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s.Offset+len(chunk) > s.Length {
+		http.Error(w, "chunk runs past Upload-Length", http.StatusRequestEntityTooLarge)
+		return
+	}
+	var data []byte
+	complete := s.Offset+len(chunk) == s.Length
+	query := `UPDATE upload_sessions SET data=data || $2, updated_at=now() WHERE id=$1 RETURNING octet_length(data), ''::bytea`
+	if complete {
+		query = `UPDATE upload_sessions SET data=data || $2, updated_at=now() WHERE id=$1 RETURNING octet_length(data), data`
+	}
+	if err := tx.QueryRow(query, s.ID, chunk).Scan(&s.Offset, &data); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !complete {
+		if err := tx.Commit(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Upload-Offset", strconv.Itoa(s.Offset))
+		w.WriteHeader(http.StatusNoContent)
+		return
+	}
+	// The session goes away only if the file is stored. Otherwise the
+	// transaction rolls back with the parts intact: the client can retry with
+	// an empty PATCH at the final offset, or DELETE the session.
+	if _, err := tx.Exec(`DELETE FROM upload_sessions WHERE id=$1`, s.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	u, ok := storeUpload(w, r, db, s.Purpose, data)
+	if !ok {
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Upload-Offset", strconv.Itoa(s.Offset))
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(u)
+}
+
+// deleteUploadSession serves DELETE /uploads/resumable/{id}.
+func deleteUploadSession(w http.ResponseWriter, r *http.Request, db *sql.DB, id string) {
+	s, ok := loadUploadSession(w, r, db, id, false)
+	if !ok {
+		return
+	}
+	if _, err := db.Exec(`DELETE FROM upload_sessions WHERE id=$1`, s.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// startUploadSessionPurger deletes abandoned resumable uploads.
+func startUploadSessionPurger(db *sql.DB) {
+	go func() {
+		for {
+			_, err := db.Exec(`DELETE FROM upload_sessions WHERE updated_at < now() - $1 * interval '1 second'`, int(uploadSessionTTL.Seconds()))
+			if err != nil {
+				log.Printf("upload session purge: %v", err)
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
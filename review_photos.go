@@ -0,0 +1,249 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Reviews can carry up to maxReviewPhotos photos, uploaded beforehand with
+// purpose review_photo. A photo is public once approved: straight away when
+// uploads go through automated moderation, otherwise after a platform admin
+// looks at it. An owner reporting a photo hides it again until it has been
+// reviewed.
+
+const maxReviewPhotos = 4
+
+var errReviewPhotosInvalid = errors.New("photos must be review_photo uploads of the reviewing customer, used only once")
+
+type ReviewPhoto struct {
+	ID           string `json:"id"`
+	URL          string `json:"url"`
+	ThumbnailURL string `json:"thumbnail_url"`
+	Status       string `json:"status"`
+}
+
+// attachReviewPhotos links the uploads to the review in the order given. The
+// uploads must have been made by the customer the review belongs to.
+func attachReviewPhotos(tx *sql.Tx, reviewID string, keys []string) ([]ReviewPhoto, error) {
+	status := "pending"
+	if imageModerator != nil {
+		status = "approved"
+	}
+	rows, err := tx.Query(
+		`INSERT INTO review_photos (review_id, upload_key, position, status)
+		 SELECT $1, u.key, a.position, $3 FROM unnest($2::text[]) WITH ORDINALITY AS a(key, position)
+		 JOIN uploads u ON u.key=a.key AND u.purpose='review_photo' AND u.scan_status IN ('pending','clean')
+		   AND u.customer_id=(SELECT customer_id FROM reviews WHERE id=$1)
+		 ON CONFLICT (upload_key) DO NOTHING
+		 RETURNING id, upload_key, status`,
+		reviewID, pq.Array(keys), status,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	byKey := map[string]ReviewPhoto{}
+	for rows.Next() {
+		var p ReviewPhoto
+		var key string
+		if err := rows.Scan(&p.ID, &key, &p.Status); err != nil {
+			return nil, err
+		}
+		byKey[key] = p
+	}
+	if err := rows.Err(); err != nil {
+		return nil, err
+	}
+	if len(byKey) != len(keys) {
+		return nil, errReviewPhotosInvalid
+	}
+	photos := []ReviewPhoto{}
+	for _, key := range keys {
+		p := byKey[key]
+		p.URL, p.ThumbnailURL = reviewPhotoURLs(tx, key)
+		photos = append(photos, p)
+	}
+	return photos, nil
+}
+
+func reviewPhotoURLs(q queryer, key string) (string, string) {
+	var thumb sql.NullString
+	q.QueryRow(`SELECT thumbnail_key FROM uploads WHERE key=$1`, key).Scan(&thumb)
+	if !thumb.Valid {
+		thumb.String = key
+	}
+	return assetURL(key), assetURL(thumb.String)
+}
+
+// loadReviewPhotos fills in the approved photos of a page of reviews with a
+// single query.
+func loadReviewPhotos(db *sql.DB, reviews []Review) error {
+	if len(reviews) == 0 {
+		return nil
+	}
+	ids := make([]string, len(reviews))
+	index := map[string]int{}
+	for i := range reviews {
+		ids[i] = reviews[i].ID
+		index[reviews[i].ID] = i
+		reviews[i].Photos = []ReviewPhoto{}
+	}
+	rows, err := db.Query(
+		`SELECT p.review_id, p.id, p.upload_key, COALESCE(u.thumbnail_key, p.upload_key), p.status
+		 FROM review_photos p JOIN uploads u ON u.key=p.upload_key
+		 WHERE p.review_id::text = ANY($1) AND p.status='approved'
+		 ORDER BY p.review_id, p.position`,
+		pq.Array(ids),
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var reviewID, key, thumb string
+		var p ReviewPhoto
+		if err := rows.Scan(&reviewID, &p.ID, &key, &thumb, &p.Status); err != nil {
+			return err
+		}
+		p.URL, p.ThumbnailURL = assetURL(key), assetURL(thumb)
+		i := index[reviewID]
+		reviews[i].Photos = append(reviews[i].Photos, p)
+	}
+	return rows.Err()
+}
+
+// reportReviewPhoto lets the establishment flag a photo on one of its
+// reviews. The photo is hidden until a platform admin reviews it.
+func reportReviewPhoto(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	if !requireRole(w, r, db, establishmentID, "manager") {
+		return
+	}
+	var req struct {
+		PhotoID string `json:"photo_id"`
+		Reason  string `json:"reason"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Reason = sanitizeText(req.Reason)
+	if req.Reason == "" {
+		http.Error(w, "reason is required", http.StatusUnprocessableEntity)
+		return
+	}
+	res, err := db.Exec(
+		`UPDATE review_photos p SET status='pending', reported_at=now(), report_reason=$3
+		 FROM reviews v WHERE v.id=p.review_id AND p.id::text=$1 AND v.establishment_id=$2 AND p.status<>'rejected'`,
+		req.PhotoID, establishmentID, req.Reason,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.NotFound(w, nil)
+		return
+	}
+	if err := recordAudit(db, r, establishmentID, "review_photo.reported", "review_photo", req.PhotoID, req); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusAccepted)
+}
+
+// PendingReviewPhoto is a photo in the moderation queue.
+type PendingReviewPhoto struct {
+	ReviewPhoto
+	ReviewID        string     `json:"review_id"`
+	EstablishmentID string     `json:"establishment_id"`
+	ReportedAt      *time.Time `json:"reported_at"`
+	ReportReason    string     `json:"report_reason"`
+	CreatedAt       time.Time  `json:"created_at"`
+}
+
+// reviewPhotoModerationHandler serves the platform admins' queue:
+// GET /support/review_photos lists pending photos, reported ones first, and
+// PUT /support/review_photos/{id} approves or rejects one.
+func reviewPhotoModerationHandler(db *sql.DB) http.HandlerFunc {
+	return authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) {
+		if !requirePlatformAdmin(w, r, db) {
+			return
+		}
+		id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/support/review_photos"), "/")
+		switch {
+		case id == "" && r.Method == http.MethodGet:
+			listPendingReviewPhotos(w, db)
+		case id != "" && r.Method == http.MethodPut:
+			moderateReviewPhoto(w, r, db, id)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func listPendingReviewPhotos(w http.ResponseWriter, db *sql.DB) {
+	rows, err := db.Query(
+		`SELECT p.id, p.upload_key, COALESCE(u.thumbnail_key, p.upload_key), p.status, p.review_id, v.establishment_id,
+		   p.reported_at, COALESCE(p.report_reason, ''), p.created_at
+		 FROM review_photos p JOIN uploads u ON u.key=p.upload_key JOIN reviews v ON v.id=p.review_id
+		 WHERE p.status='pending'
+		 ORDER BY p.reported_at IS NULL, p.created_at LIMIT 100`,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	list := []PendingReviewPhoto{}
+	for rows.Next() {
+		var p PendingReviewPhoto
+		var key, thumb string
+		if err := rows.Scan(&p.ID, &key, &thumb, &p.Status, &p.ReviewID, &p.EstablishmentID, &p.ReportedAt, &p.ReportReason, &p.CreatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		p.URL, p.ThumbnailURL = assetURL(key), assetURL(thumb)
+		list = append(list, p)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func moderateReviewPhoto(w http.ResponseWriter, r *http.Request, db *sql.DB, id string) {
+	var req struct {
+		Status string `json:"status"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Status != "approved" && req.Status != "rejected" {
+		http.Error(w, "status must be approved or rejected", http.StatusUnprocessableEntity)
+		return
+	}
+	var establishmentID string
+	err := db.QueryRow(
+		`UPDATE review_photos p SET status=$2, moderated_at=now() FROM reviews v
+		 WHERE v.id=p.review_id AND p.id::text=$1 RETURNING v.establishment_id`,
+		id, req.Status,
+	).Scan(&establishmentID)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, nil)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := recordAudit(db, r, establishmentID, "review_photo."+req.Status, "review_photo", id, nil); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
@@ -0,0 +1,138 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"time"
+)
+
+const (
+	// reviewRequestCooldown is the minimum time between two review requests
+	// to the same customer, across establishments.
+	reviewRequestCooldown = 14 * 24 * time.Hour
+	reviewLinkTTL         = 14 * 24 * time.Hour
+)
+
+type ReviewRequestSettings struct {
+	Enabled bool `json:"enabled"`
+	// DelayMinutes is how long after delivery the request is sent.
+	DelayMinutes int `json:"delay_minutes"`
+	// Channel is "push" or "whatsapp".
+	Channel string `json:"channel"`
+}
+
+func updateReviewRequestSettings(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	if !requireRole(w, r, db, establishmentID, "manager") {
+		return
+	}
+	var s ReviewRequestSettings
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if s.DelayMinutes < 0 || s.DelayMinutes > 7*24*60 {
+		http.Error(w, "delay_minutes must be between 0 and 10080", http.StatusUnprocessableEntity)
+		return
+	}
+	if s.Channel == "" {
+		s.Channel = "push"
+	}
+	if s.Channel != "push" && s.Channel != "whatsapp" {
+		http.Error(w, "channel must be push or whatsapp", http.StatusUnprocessableEntity)
+		return
+	}
+	_, err := db.Exec(
+		`UPDATE establishments SET review_requests_enabled=$1, review_request_delay_minutes=$2, review_request_channel=$3, updated_at=now() WHERE id=$4`,
+		s.Enabled, s.DelayMinutes, s.Channel, establishmentID,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := recordAudit(db, r, establishmentID, "establishment.review_requests_updated", "establishment", establishmentID, s); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// newReviewToken signs a review link for the order. It is a JWT of its own
+// type, so it can't be used as an access token.
+func newReviewToken(orderID string) (string, error) {
+	jti, err := randomToken(16)
+	if err != nil {
+		return "", err
+	}
+	now := time.Now()
+	return signJWT(Claims{Sub: orderID, Typ: "review_request", JTI: jti, Iat: now.Unix(), Exp: now.Add(reviewLinkTTL).Unix()})
+}
+
+func parseReviewToken(token string) (string, error) {
+	c, err := parseJWT(token)
+	if err != nil {
+		return "", err
+	}
+	if c.Typ != "review_request" {
+		return "", errInvalidToken
+	}
+	return c.Sub, nil
+}
+
+// scheduleReviewRequests queues a REVIEW_REQUEST notification once an order is
+// delivered, for establishments that opted in. Customers who haven't
+// consented to the channel, were asked recently or already reviewed the order
+// are skipped, which also makes a redelivered event harmless.
+func scheduleReviewRequests(db *sql.DB) func(Event) {
+	return func(e Event) {
+		if err := scheduleReviewRequest(db, e.OrderID); err != nil {
+			log.Printf("review request %s: %v", e.OrderID, err)
+		}
+	}
+}
+
+func scheduleReviewRequest(db *sql.DB, orderID string) error {
+	var enabled bool
+	var delay int
+	var channel, customerID, establishmentID, establishment string
+	var number int
+	err := db.QueryRow(
+		`SELECT e.review_requests_enabled, e.review_request_delay_minutes, e.review_request_channel, o.customer_id, e.id, e.name, o.order_number
+		 FROM orders o JOIN establishments e ON e.id=o.establishment_id WHERE o.id=$1`,
+		orderID,
+	).Scan(&enabled, &delay, &channel, &customerID, &establishmentID, &establishment, &number)
+	if errors.Is(err, sql.ErrNoRows) || (err == nil && !enabled) {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	token, err := newReviewToken(orderID)
+	if err != nil {
+		return err
+	}
+	// Clients append &rating=N to the link for one-tap star buttons.
+	payload, err := json.Marshal(map[string]any{
+		"order_id":           orderID,
+		"establishment_id":   establishmentID,
+		"establishment_name": establishment,
+		"display_number":     formatOrderNumber(number),
+		"review_url":         appBaseURL + "/avaliar?token=" + url.QueryEscape(token),
+	})
+	if err != nil {
+		return err
+	}
+	_, err = db.Exec(
+		`INSERT INTO notifications (customer_id, kind, channel, payload, send_after)
+		 SELECT $1, 'REVIEW_REQUEST', $2, $3, now() + $4 * interval '1 minute'
+		 WHERE `+marketingConsent("$1::uuid", "$2")+`
+		   AND NOT EXISTS (SELECT 1 FROM notifications WHERE customer_id=$1 AND kind='REVIEW_REQUEST' AND created_at > now() - $5 * interval '1 second')
+		   AND NOT EXISTS (SELECT 1 FROM reviews WHERE order_id=$6)`,
+		customerID, channel, payload, delay, int(reviewRequestCooldown.Seconds()), orderID,
+	)
+	return err
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/lib/pq"
+)
+
+// Each establishment keeps a running summary of its reviews: counts per star
+// and how often each term shows up in comments. createReview updates it in
+// the same transaction, so reading it never scans the reviews; an
+// establishment without a summary yet has it built from scratch once.
+
+const reviewSummaryKeywords = 10
+
+// reviewStopwords are left out of the keyword counts.
+var reviewStopwords = map[string]bool{
+	"que": true, "com": true, "para": true, "por": true, "mas": true, "uma": true, "não": true, "nao": true,
+	"muito": true, "mais": true, "foi": true, "era": true, "são": true, "tem": true, "meu": true, "minha": true,
+	"isso": true, "esse": true, "essa": true, "como": true, "bem": true, "dos": true, "das": true, "nos": true,
+	"nas": true, "aos": true, "pelo": true, "pela": true, "the": true, "and": true, "was": true, "for": true,
+	"with": true, "but": true, "not": true, "very": true, "this": true, "that": true, "are": true,
+}
+
+type KeywordCount struct {
+	Term  string `json:"term"`
+	Count int    `json:"count"`
+}
+
+type ReviewSummary struct {
+	EstablishmentID string  `json:"establishment_id"`
+	ReviewCount     int     `json:"review_count"`
+	AverageRating   float64 `json:"average_rating"`
+	// Distribution is the number of reviews per star, keyed "1" to "5".
+	Distribution map[string]int `json:"distribution"`
+	Keywords     []KeywordCount `json:"keywords"`
+	UpdatedAt    time.Time      `json:"updated_at"`
+}
+
+// reviewTerms splits a comment into lowercase words of three to forty
+// letters, dropping stopwords.
+func reviewTerms(comment string) []string {
+	var terms []string
+	for _, word := range strings.FieldsFunc(strings.ToLower(comment), func(r rune) bool { return !unicode.IsLetter(r) }) {
+		if n := len([]rune(word)); n >= 3 && n <= 40 && !reviewStopwords[word] {
+			terms = append(terms, word)
+		}
+	}
+	return terms
+}
+
+// addReviewToSummary counts a new review in the establishment's summary,
+// building the summary first if the establishment doesn't have one.
+func addReviewToSummary(tx *sql.Tx, establishmentID string, rating int, comment string) error {
+	res, err := tx.Exec(
+		`UPDATE review_summaries SET review_count=review_count+1, rating_sum=rating_sum+$2, stars[$2]=stars[$2]+1, updated_at=now()
+		 WHERE establishment_id=$1`,
+		establishmentID, rating,
+	)
+	if err != nil {
+		return err
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		// The review is already inserted, so the rebuild counts it.
+		return rebuildReviewSummary(tx, establishmentID)
+	}
+	return addReviewTerms(tx, establishmentID, reviewTerms(comment))
+}
+
+func addReviewTerms(tx *sql.Tx, establishmentID string, terms []string) error {
+	counts := map[string]int{}
+	for _, t := range terms {
+		counts[t]++
+	}
+	for term, n := range counts {
+		_, err := tx.Exec(
+			`INSERT INTO review_terms (establishment_id, term, count) VALUES ($1,$2,$3)
+			 ON CONFLICT (establishment_id, term) DO UPDATE SET count=review_terms.count+EXCLUDED.count`,
+			establishmentID, term, n,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// rebuildReviewSummary recomputes the summary from every review.
+func rebuildReviewSummary(tx *sql.Tx, establishmentID string) error {
+	if _, err := tx.Exec(`DELETE FROM review_terms WHERE establishment_id=$1`, establishmentID); err != nil {
+		return err
+	}
+	_, err := tx.Exec(
+		`INSERT INTO review_summaries (establishment_id, review_count, rating_sum, stars)
+		 SELECT $1, COUNT(*), COALESCE(SUM(rating),0),
+		   ARRAY[COUNT(*) FILTER (WHERE rating=1), COUNT(*) FILTER (WHERE rating=2), COUNT(*) FILTER (WHERE rating=3),
+		         COUNT(*) FILTER (WHERE rating=4), COUNT(*) FILTER (WHERE rating=5)]
+		 FROM reviews WHERE establishment_id=$1
+		 ON CONFLICT (establishment_id) DO UPDATE SET review_count=EXCLUDED.review_count, rating_sum=EXCLUDED.rating_sum,
+		   stars=EXCLUDED.stars, updated_at=now()`,
+		establishmentID,
+	)
+	if err != nil {
+		return err
+	}
+	rows, err := tx.Query(`SELECT comment FROM reviews WHERE establishment_id=$1 AND comment<>''`, establishmentID)
+	if err != nil {
+		return err
+	}
+	var terms []string
+	for rows.Next() {
+		var comment string
+		if err := rows.Scan(&comment); err != nil {
+			rows.Close()
+			return err
+		}
+		terms = append(terms, reviewTerms(comment)...)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	return addReviewTerms(tx, establishmentID, terms)
+}
+
+func getReviewSummary(w http.ResponseWriter, db *sql.DB, establishmentID string) {
+	s, err := loadReviewSummary(db, establishmentID)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, nil)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+func loadReviewSummary(db *sql.DB, establishmentID string) (*ReviewSummary, error) {
+	s := ReviewSummary{EstablishmentID: establishmentID, Distribution: map[string]int{}, Keywords: []KeywordCount{}}
+	var ratingSum int
+	var stars []int64
+	err := db.QueryRow(
+		`SELECT review_count, rating_sum, stars, updated_at FROM review_summaries WHERE establishment_id::text=$1`,
+		establishmentID,
+	).Scan(&s.ReviewCount, &ratingSum, pq.Array(&stars), &s.UpdatedAt)
+	if err == sql.ErrNoRows {
+		var exists bool
+		if err := db.QueryRow(`SELECT EXISTS(SELECT 1 FROM establishments WHERE id::text=$1)`, establishmentID).Scan(&exists); err != nil {
+			return nil, err
+		}
+		if !exists {
+			return nil, sql.ErrNoRows
+		}
+		tx, err := db.Begin()
+		if err != nil {
+			return nil, err
+		}
+		defer tx.Rollback()
+		if err := rebuildReviewSummary(tx, establishmentID); err != nil {
+			return nil, err
+		}
+		if err := tx.Commit(); err != nil {
+			return nil, err
+		}
+		return loadReviewSummary(db, establishmentID)
+	}
+	if err != nil {
+		return nil, err
+	}
+	for i, n := range stars {
+		s.Distribution[strconv.Itoa(i+1)] = int(n)
+	}
+	if s.ReviewCount > 0 {
+		s.AverageRating = float64(ratingSum) / float64(s.ReviewCount)
+	}
+
+	rows, err := db.Query(
+		`SELECT term, count FROM review_terms WHERE establishment_id=$1 ORDER BY count DESC, term LIMIT $2`,
+		establishmentID, reviewSummaryKeywords,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var k KeywordCount
+		if err := rows.Scan(&k.Term, &k.Count); err != nil {
+			return nil, err
+		}
+		s.Keywords = append(s.Keywords, k)
+	}
+	return &s, rows.Err()
+}
@@ -0,0 +1,173 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const maxReviewComment = 1000
+
+var reviewsReceived = newCounter("reviews_received_total", "Reviews submitted, by source.", "source")
+
+// Review is public, so it doesn't carry the customer.
+type Review struct {
+	ID              string `json:"id"`
+	EstablishmentID string `json:"establishment_id"`
+	OrderID         string `json:"order_id"`
+	Rating          int    `json:"rating"`
+	Comment         string `json:"comment"`
+	// Source is "review_request" for reviews sent through a review request
+	// link and "app" otherwise.
+	Source    string        `json:"source"`
+	Photos    []ReviewPhoto `json:"photos"`
+	CreatedAt time.Time     `json:"created_at"`
+}
+
+type reviewRequest struct {
+	Token   string `json:"token"`
+	OrderID string `json:"order_id"`
+	Rating  int    `json:"rating"`
+	Comment string `json:"comment"`
+	// Photos are keys of review_photo uploads.
+	Photos []string `json:"photos"`
+}
+
+// reviewsHandler accepts a review either with the signed token of a review
+// request link, which needs no login, or from the signed-in customer who
+// placed the order.
+func reviewsHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var req reviewRequest
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if req.Token != "" {
+			orderID, err := parseReviewToken(req.Token)
+			if err != nil {
+				http.Error(w, "invalid or expired review link", http.StatusUnauthorized)
+				return
+			}
+			createReview(w, db, req, orderID, "", "review_request")
+			return
+		}
+		authenticateCustomer(db, func(w http.ResponseWriter, r *http.Request) {
+			createReview(w, db, req, req.OrderID, currentClaims(r).Sub, "app")
+		})(w, r)
+	}
+}
+
+// createReview stores the order's review. customerID, when set, must have
+// placed the order, and the order must have been delivered or completed.
+func createReview(w http.ResponseWriter, db *sql.DB, req reviewRequest, orderID, customerID, source string) {
+	req.Comment = sanitizeText(req.Comment)
+	if req.Rating < 1 || req.Rating > 5 {
+		http.Error(w, "rating must be between 1 and 5", http.StatusUnprocessableEntity)
+		return
+	}
+	if len([]rune(req.Comment)) > maxReviewComment {
+		http.Error(w, "comment is too long", http.StatusUnprocessableEntity)
+		return
+	}
+	if len(req.Photos) > maxReviewPhotos {
+		http.Error(w, fmt.Sprintf("a review can have at most %d photos", maxReviewPhotos), http.StatusUnprocessableEntity)
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	v := Review{OrderID: orderID, Rating: req.Rating, Comment: req.Comment, Source: source, Photos: []ReviewPhoto{}}
+	err = tx.QueryRow(
+		`INSERT INTO reviews (establishment_id, order_id, customer_id, rating, comment, source)
+		 SELECT o.establishment_id, o.id, o.customer_id, $3, $4, $5 FROM orders o
+		 WHERE o.id::text=$1 AND ($2='' OR o.customer_id::text=$2)
+		   AND (o.status='COMPLETED' OR EXISTS (SELECT 1 FROM deliveries d WHERE d.order_id=o.id))
+		 RETURNING id, establishment_id, created_at`,
+		orderID, customerID, v.Rating, v.Comment, v.Source,
+	).Scan(&v.ID, &v.EstablishmentID, &v.CreatedAt)
+	if err == sql.ErrNoRows {
+		http.Error(w, "order not found or not delivered yet", http.StatusUnprocessableEntity)
+		return
+	}
+	if isUniqueViolation(err) {
+		http.Error(w, "this order has already been reviewed", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if len(req.Photos) > 0 {
+		v.Photos, err = attachReviewPhotos(tx, v.ID, req.Photos)
+		if err == errReviewPhotosInvalid {
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := addReviewToSummary(tx, v.EstablishmentID, v.Rating, v.Comment); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	responseCache.Invalidate(v.EstablishmentID)
+	reviewsReceived.Inc(source)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(v)
+}
+
+func listReviews(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	cursor, limit, err := pageParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	at, id := keysetArgs(cursor)
+	rows, err := db.Query(
+		`SELECT id, establishment_id, order_id, rating, comment, source, created_at FROM reviews
+		 WHERE establishment_id=$1 AND (created_at, id) < ($2, $3::uuid)
+		 ORDER BY created_at DESC, id DESC LIMIT $4`,
+		establishmentID, at, id, limit+1,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	list := []Review{}
+	for rows.Next() {
+		var v Review
+		if err := rows.Scan(&v.ID, &v.EstablishmentID, &v.OrderID, &v.Rating, &v.Comment, &v.Source, &v.CreatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		list = append(list, v)
+	}
+	if err := loadReviewPhotos(db, list); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	page := newPage(list, limit, func(v Review) pageCursor { return pageCursor{v.CreatedAt, v.ID} })
+	if page.NextCursor != nil {
+		w.Header().Set("X-Next-Cursor", *page.NextCursor)
+	}
+	respond(w, r, "reviews", page)
+}
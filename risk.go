@@ -0,0 +1,355 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// Every order is scored for fraud risk at checkout, from 0 to 100. The score
+// is the sum of the built-in checks' points (velocity, device location far
+// from the delivery address, platform blocklist), raised to the external
+// provider's score when one is configured. Orders at or above
+// riskReviewThreshold are never auto-accepted: staff have to accept them.
+
+const (
+	defaultRiskReviewThreshold = 60
+	riskProviderTimeout        = 3 * time.Second
+)
+
+var riskBlocklistKinds = map[string]bool{"ip": true, "device": true, "phone": true, "email_domain": true}
+
+// riskReviewThreshold is set from RISK_REVIEW_THRESHOLD.
+var riskReviewThreshold = defaultRiskReviewThreshold
+
+// riskProvider is nil when no external scoring service is configured.
+var riskProvider RiskProvider
+
+var riskAssessments = newCounter("risk_assessments_total", "Orders scored at checkout, by outcome.", "outcome")
+
+type RiskSignal struct {
+	Check  string `json:"check"`
+	Points int    `json:"points"`
+	Detail string `json:"detail"`
+}
+
+type RiskAssessment struct {
+	Score   int          `json:"score"`
+	Signals []RiskSignal `json:"signals"`
+	// Provider is the external service that contributed, if any.
+	Provider string `json:"provider,omitempty"`
+}
+
+// RiskInput is what checks and providers see of an order being placed.
+type RiskInput struct {
+	OrderID         string   `json:"order_id"`
+	EstablishmentID string   `json:"establishment_id"`
+	CustomerID      string   `json:"customer_id"`
+	Email           string   `json:"email"`
+	Phone           string   `json:"phone"`
+	Device          string   `json:"device"`
+	IP              string   `json:"ip"`
+	TotalCents      int64    `json:"total_cents"`
+	PaymentMethod   string   `json:"payment_method"`
+	DeliveryTo      Address  `json:"delivery_to"`
+	DeviceLocation  *Address `json:"device_location,omitempty"`
+}
+
+// riskCheck inspects the order and returns its signals, if any.
+type riskCheck func(tx *sql.Tx, in RiskInput) ([]RiskSignal, error)
+
+var riskChecks = []riskCheck{velocityRisk, locationRisk, blocklistRisk}
+
+// RiskProvider is an external scoring service.
+type RiskProvider interface {
+	Name() string
+	Score(ctx context.Context, in RiskInput) (int, error)
+}
+
+// newRiskProviderFromEnv reads RISK_REVIEW_THRESHOLD and, with
+// RISK_PROVIDER_URL set, sends every order to that URL, authenticated by
+// RISK_PROVIDER_TOKEN.
+func newRiskProviderFromEnv() RiskProvider {
+	if v := os.Getenv("RISK_REVIEW_THRESHOLD"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 || n > 100 {
+			log.Printf("invalid RISK_REVIEW_THRESHOLD %q, using %d", v, riskReviewThreshold)
+		} else {
+			riskReviewThreshold = n
+		}
+	}
+	u := os.Getenv("RISK_PROVIDER_URL")
+	if u == "" {
+		return nil
+	}
+	return httpRiskProvider{url: u, token: os.Getenv("RISK_PROVIDER_TOKEN")}
+}
+
+// httpRiskProvider POSTs the RiskInput as JSON and expects {"score": 0-100}.
+type httpRiskProvider struct {
+	url, token string
+}
+
+func (p httpRiskProvider) Name() string { return "http" }
+
+func (p httpRiskProvider) Score(ctx context.Context, in RiskInput) (int, error) {
+	body, _ := json.Marshal(in)
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, p.url, bytes.NewReader(body))
+	if err != nil {
+		return 0, err
+	}
+	req.Header.Set("Content-Type", "application/json")
+	if p.token != "" {
+		req.Header.Set("Authorization", "Bearer "+p.token)
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return 0, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return 0, fmt.Errorf("risk provider returned %s", resp.Status)
+	}
+	var out struct {
+		Score int `json:"score"`
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&out); err != nil {
+		return 0, err
+	}
+	return min(max(out.Score, 0), 100), nil
+}
+
+// assessOrderRisk scores the order and stores the result on it. A failing
+// provider is logged and left out, so checkout doesn't depend on it.
+func assessOrderRisk(tx *sql.Tx, in RiskInput) (*RiskAssessment, error) {
+	a := &RiskAssessment{Signals: []RiskSignal{}}
+	for _, check := range riskChecks {
+		signals, err := check(tx, in)
+		if err != nil {
+			return nil, err
+		}
+		for _, s := range signals {
+			a.Score += s.Points
+			a.Signals = append(a.Signals, s)
+		}
+	}
+	a.Score = min(a.Score, 100)
+	if riskProvider != nil {
+		ctx, cancel := context.WithTimeout(context.Background(), riskProviderTimeout)
+		score, err := riskProvider.Score(ctx, in)
+		cancel()
+		if err != nil {
+			log.Printf("risk provider for order %s: %v", in.OrderID, err)
+			riskAssessments.Inc("provider_error")
+		} else {
+			a.Provider = riskProvider.Name()
+			a.Score = max(a.Score, score)
+		}
+	}
+	signals, _ := json.Marshal(a)
+	if _, err := tx.Exec(`UPDATE orders SET risk_score=$2, risk_assessment=$3 WHERE id=$1`, in.OrderID, a.Score, signals); err != nil {
+		return nil, err
+	}
+	if a.Score >= riskReviewThreshold {
+		riskAssessments.Inc("review")
+	} else {
+		riskAssessments.Inc("pass")
+	}
+	return a, nil
+}
+
+// velocityRisk flags bursts: many orders from the customer in the last hour,
+// or one device ordering for several customers in a day.
+func velocityRisk(tx *sql.Tx, in RiskInput) ([]RiskSignal, error) {
+	var lastHour, deviceCustomers int
+	err := tx.QueryRow(
+		`SELECT (SELECT COUNT(*) FROM orders WHERE customer_id=$1 AND ordered_at > now() - interval '1 hour' AND id<>$3),
+		   (SELECT COUNT(DISTINCT customer_id) FROM orders
+		    WHERE device_fingerprint=$2 AND $2<>'' AND ordered_at > now() - interval '1 day')`,
+		in.CustomerID, in.Device, in.OrderID,
+	).Scan(&lastHour, &deviceCustomers)
+	if err != nil {
+		return nil, err
+	}
+	var signals []RiskSignal
+	if lastHour >= 3 {
+		signals = append(signals, RiskSignal{"velocity", 25, fmt.Sprintf("%d other orders from the customer in the last hour", lastHour)})
+	}
+	if deviceCustomers >= 3 {
+		signals = append(signals, RiskSignal{"shared_device", 30, fmt.Sprintf("device used by %d customers in the last day", deviceCustomers)})
+	}
+	return signals, nil
+}
+
+// locationRisk flags deliveries far from where the device says it is.
+func locationRisk(tx *sql.Tx, in RiskInput) ([]RiskSignal, error) {
+	if in.DeviceLocation == nil || in.DeviceLocation.Lat == nil || in.DeviceLocation.Lng == nil || in.DeliveryTo.Lat == nil || in.DeliveryTo.Lng == nil {
+		return nil, nil
+	}
+	if km := straightLineMeters(*in.DeviceLocation, in.DeliveryTo) / 1000; km > 100 {
+		return []RiskSignal{{"location_mismatch", 25, fmt.Sprintf("device is %d km from the delivery address", km)}}, nil
+	}
+	return nil, nil
+}
+
+// blocklistRisk matches the order against the platform-wide risk
+// blocklist, which unlike customer_blocks only raises the score.
+func blocklistRisk(tx *sql.Tx, in RiskInput) ([]RiskSignal, error) {
+	domain := ""
+	if i := strings.LastIndex(in.Email, "@"); i >= 0 {
+		domain = strings.ToLower(in.Email[i+1:])
+	}
+	rows, err := tx.Query(
+		`SELECT kind, value FROM risk_blocklist WHERE
+		   (kind='ip' AND value=$1) OR (kind='device' AND value=$2) OR (kind='phone' AND value=$3) OR (kind='email_domain' AND value=$4)`,
+		in.IP, in.Device, digitsOnly(in.Phone), domain,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var signals []RiskSignal
+	for rows.Next() {
+		var kind, value string
+		if err := rows.Scan(&kind, &value); err != nil {
+			return nil, err
+		}
+		signals = append(signals, RiskSignal{"blocklist", 60, kind + " " + value + " is on the blocklist"})
+	}
+	return signals, rows.Err()
+}
+
+// getOrderRisk shows staff why an order was scored the way it was.
+func getOrderRisk(w http.ResponseWriter, r *http.Request, db *sql.DB, orderID string) {
+	var establishmentID string
+	var assessment []byte
+	err := db.QueryRow(`SELECT establishment_id, risk_assessment FROM orders WHERE id::text=$1`, orderID).Scan(&establishmentID, &assessment)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, nil)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !requireRole(w, r, db, establishmentID, "staff") {
+		return
+	}
+	if assessment == nil {
+		assessment = []byte(`{"score":0,"signals":[]}`)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.Write(assessment)
+}
+
+type RiskBlocklistEntry struct {
+	ID        string    `json:"id"`
+	Kind      string    `json:"kind"`
+	Value     string    `json:"value"`
+	Reason    string    `json:"reason"`
+	CreatedAt time.Time `json:"created_at"`
+}
+
+// riskBlocklistHandler lets platform admins manage the blocklist:
+// GET/POST /support/risk_blocklist and DELETE /support/risk_blocklist/{id}.
+func riskBlocklistHandler(db *sql.DB) http.HandlerFunc {
+	return authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) {
+		if !requirePlatformAdmin(w, r, db) {
+			return
+		}
+		id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/support/risk_blocklist"), "/")
+		switch {
+		case id == "" && r.Method == http.MethodGet:
+			listRiskBlocklist(w, db)
+		case id == "" && r.Method == http.MethodPost:
+			addRiskBlocklistEntry(w, r, db)
+		case id != "" && r.Method == http.MethodDelete:
+			res, err := db.Exec(`DELETE FROM risk_blocklist WHERE id::text=$1`, id)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if n, _ := res.RowsAffected(); n == 0 {
+				http.NotFound(w, nil)
+				return
+			}
+			if err := recordAudit(db, r, "", "risk_blocklist.removed", "risk_blocklist", id, nil); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			w.WriteHeader(http.StatusNoContent)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func listRiskBlocklist(w http.ResponseWriter, db *sql.DB) {
+	rows, err := db.Query(`SELECT id, kind, value, COALESCE(reason,''), created_at FROM risk_blocklist ORDER BY created_at DESC LIMIT 500`)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	list := []RiskBlocklistEntry{}
+	for rows.Next() {
+		var e RiskBlocklistEntry
+		if err := rows.Scan(&e.ID, &e.Kind, &e.Value, &e.Reason, &e.CreatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		list = append(list, e)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func addRiskBlocklistEntry(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var e RiskBlocklistEntry
+	if err := json.NewDecoder(r.Body).Decode(&e); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if !riskBlocklistKinds[e.Kind] {
+		http.Error(w, "kind must be ip, device, phone or email_domain", http.StatusUnprocessableEntity)
+		return
+	}
+	e.Value, e.Reason = strings.TrimSpace(e.Value), sanitizeText(e.Reason)
+	switch e.Kind {
+	case "phone":
+		e.Value = digitsOnly(e.Value)
+	case "email_domain":
+		e.Value = strings.ToLower(strings.TrimPrefix(e.Value, "@"))
+	}
+	if e.Value == "" {
+		http.Error(w, "value is required", http.StatusUnprocessableEntity)
+		return
+	}
+	err := db.QueryRow(
+		`INSERT INTO risk_blocklist (kind, value, reason, created_by) VALUES ($1,$2,NULLIF($3,''),$4) RETURNING id, created_at`,
+		e.Kind, e.Value, e.Reason, currentClaims(r).Sub,
+	).Scan(&e.ID, &e.CreatedAt)
+	if isUniqueViolation(err) {
+		http.Error(w, "already on the blocklist", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := recordAudit(db, r, "", "risk_blocklist.added", "risk_blocklist", e.ID, e); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(e)
+}
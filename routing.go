@@ -0,0 +1,246 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"log"
+	"math"
+	"net/http"
+	"net/url"
+	"os"
+	"sync"
+	"time"
+)
+
+const (
+	routeCacheTTL     = 24 * time.Hour
+	routeCacheMaxSize = 10000
+	routeTimeout      = 3 * time.Second
+	// Assumed speed for the straight-line fallback, and the preparation time
+	// added to travel time for customer ETAs.
+	fallbackSpeedKmh = 20
+	defaultPrepTime  = 20 * time.Minute
+)
+
+type Route struct {
+	DistanceMeters  int    `json:"distance_meters"`
+	DurationSeconds int    `json:"duration_seconds"`
+	Source          string `json:"source"`
+}
+
+// Router computes a road route between two addresses with coordinates.
+type Router interface {
+	Name() string
+	Route(ctx context.Context, from, to Address) (*Route, error)
+}
+
+var router Router = newCachedRouter(straightLineRouter{})
+
+// newRouterFromEnv picks the provider from ROUTING_PROVIDER (osrm, google or
+// mapbox). Results are cached and the straight-line estimate is used when the
+// provider fails.
+func newRouterFromEnv() Router {
+	var provider Router
+	switch os.Getenv("ROUTING_PROVIDER") {
+	case "osrm":
+		u := os.Getenv("OSRM_URL")
+		if u == "" {
+			u = "https://router.project-osrm.org"
+		}
+		provider = osrmRouter{baseURL: u}
+	case "google":
+		provider = googleRouter{apiKey: os.Getenv("GOOGLE_MAPS_API_KEY")}
+	case "mapbox":
+		provider = mapboxRouter{token: os.Getenv("MAPBOX_TOKEN")}
+	case "":
+		provider = straightLineRouter{}
+	default:
+		log.Printf("unknown ROUTING_PROVIDER %q, using straight-line distances", os.Getenv("ROUTING_PROVIDER"))
+		provider = straightLineRouter{}
+	}
+	return newCachedRouter(fallbackRouter{provider})
+}
+
+// straightLineMeters is the great-circle distance between two coordinates.
+func straightLineMeters(a, b Address) int {
+	const earthRadius = 6371000.0
+	rad := func(deg float64) float64 { return deg * math.Pi / 180 }
+	dLat, dLng := rad(*b.Lat-*a.Lat), rad(*b.Lng-*a.Lng)
+	h := math.Sin(dLat/2)*math.Sin(dLat/2) + math.Cos(rad(*a.Lat))*math.Cos(rad(*b.Lat))*math.Sin(dLng/2)*math.Sin(dLng/2)
+	return int(math.Round(2 * earthRadius * math.Asin(math.Sqrt(h))))
+}
+
+type straightLineRouter struct{}
+
+func (straightLineRouter) Name() string { return "straight_line" }
+
+func (straightLineRouter) Route(_ context.Context, from, to Address) (*Route, error) {
+	d := straightLineMeters(from, to)
+	return &Route{DistanceMeters: d, DurationSeconds: d * 36 / (fallbackSpeedKmh * 10), Source: "straight_line"}, nil
+}
+
+// fallbackRouter degrades to the straight-line estimate so a provider outage
+// never blocks checkout.
+type fallbackRouter struct {
+	Router
+}
+
+func (f fallbackRouter) Route(ctx context.Context, from, to Address) (*Route, error) {
+	ctx, cancel := context.WithTimeout(ctx, routeTimeout)
+	defer cancel()
+	r, err := f.Router.Route(ctx, from, to)
+	if err != nil {
+		log.Printf("routing via %s: %v; falling back to straight line", f.Name(), err)
+		return straightLineRouter{}.Route(ctx, from, to)
+	}
+	return r, nil
+}
+
+type osrmRouter struct {
+	baseURL string
+}
+
+func (osrmRouter) Name() string { return "osrm" }
+
+func (o osrmRouter) Route(ctx context.Context, from, to Address) (*Route, error) {
+	endpoint := fmt.Sprintf("%s/route/v1/driving/%f,%f;%f,%f?overview=false", o.baseURL, *from.Lng, *from.Lat, *to.Lng, *to.Lat)
+	var body struct {
+		Code   string `json:"code"`
+		Routes []struct {
+			Distance float64 `json:"distance"`
+			Duration float64 `json:"duration"`
+		} `json:"routes"`
+	}
+	if err := getJSON(ctx, endpoint, &body); err != nil {
+		return nil, err
+	}
+	if body.Code != "Ok" || len(body.Routes) == 0 {
+		return nil, fmt.Errorf("osrm: %s", body.Code)
+	}
+	return &Route{DistanceMeters: int(body.Routes[0].Distance), DurationSeconds: int(body.Routes[0].Duration), Source: "osrm"}, nil
+}
+
+type googleRouter struct {
+	apiKey string
+}
+
+func (googleRouter) Name() string { return "google" }
+
+func (g googleRouter) Route(ctx context.Context, from, to Address) (*Route, error) {
+	q := url.Values{
+		"origins":      {fmt.Sprintf("%f,%f", *from.Lat, *from.Lng)},
+		"destinations": {fmt.Sprintf("%f,%f", *to.Lat, *to.Lng)},
+		"mode":         {"driving"},
+		"key":          {g.apiKey},
+	}
+	var body struct {
+		Status string `json:"status"`
+		Rows   []struct {
+			Elements []struct {
+				Status   string `json:"status"`
+				Distance struct {
+					Value int `json:"value"`
+				} `json:"distance"`
+				Duration struct {
+					Value int `json:"value"`
+				} `json:"duration"`
+			} `json:"elements"`
+		} `json:"rows"`
+	}
+	if err := getJSON(ctx, "https://maps.googleapis.com/maps/api/distancematrix/json?"+q.Encode(), &body); err != nil {
+		return nil, err
+	}
+	if body.Status != "OK" || len(body.Rows) == 0 || len(body.Rows[0].Elements) == 0 || body.Rows[0].Elements[0].Status != "OK" {
+		return nil, fmt.Errorf("google: no route (%s)", body.Status)
+	}
+	e := body.Rows[0].Elements[0]
+	return &Route{DistanceMeters: e.Distance.Value, DurationSeconds: e.Duration.Value, Source: "google"}, nil
+}
+
+type mapboxRouter struct {
+	token string
+}
+
+func (mapboxRouter) Name() string { return "mapbox" }
+
+func (m mapboxRouter) Route(ctx context.Context, from, to Address) (*Route, error) {
+	endpoint := fmt.Sprintf("https://api.mapbox.com/directions/v5/mapbox/driving/%f,%f;%f,%f?overview=false&access_token=%s",
+		*from.Lng, *from.Lat, *to.Lng, *to.Lat, url.QueryEscape(m.token))
+	var body struct {
+		Code   string `json:"code"`
+		Routes []struct {
+			Distance float64 `json:"distance"`
+			Duration float64 `json:"duration"`
+		} `json:"routes"`
+	}
+	if err := getJSON(ctx, endpoint, &body); err != nil {
+		return nil, err
+	}
+	if body.Code != "Ok" || len(body.Routes) == 0 {
+		return nil, fmt.Errorf("mapbox: %s", body.Code)
+	}
+	return &Route{DistanceMeters: int(body.Routes[0].Distance), DurationSeconds: int(body.Routes[0].Duration), Source: "mapbox"}, nil
+}
+
+func getJSON(ctx context.Context, endpoint string, out any) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, endpoint, nil)
+	if err != nil {
+		return err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status %d", resp.StatusCode)
+	}
+	return json.NewDecoder(resp.Body).Decode(out)
+}
+
+// cachedRouter memoizes routes by coordinate pair, rounded to about a metre so
+// the same saved address always hits. Fallback estimates are not cached, so
+// the provider is retried on the next request.
+type cachedRouter struct {
+	Router
+	mu      sync.Mutex
+	entries map[string]routeCacheEntry
+}
+
+type routeCacheEntry struct {
+	route   Route
+	expires time.Time
+}
+
+func newCachedRouter(r Router) *cachedRouter {
+	return &cachedRouter{Router: r, entries: map[string]routeCacheEntry{}}
+}
+
+func (c *cachedRouter) Route(ctx context.Context, from, to Address) (*Route, error) {
+	key := fmt.Sprintf("%.5f,%.5f;%.5f,%.5f", *from.Lat, *from.Lng, *to.Lat, *to.Lng)
+	now := time.Now()
+	c.mu.Lock()
+	if e, ok := c.entries[key]; ok && now.Before(e.expires) {
+		c.mu.Unlock()
+		r := e.route
+		return &r, nil
+	}
+	c.mu.Unlock()
+
+	r, err := c.Router.Route(ctx, from, to)
+	if err != nil || (r.Source == "straight_line" && c.Name() != "straight_line") {
+		return r, err
+	}
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	if len(c.entries) >= routeCacheMaxSize {
+		for k, e := range c.entries {
+			if now.After(e.expires) || len(c.entries) >= routeCacheMaxSize {
+				delete(c.entries, k)
+			}
+		}
+	}
+	c.entries[key] = routeCacheEntry{route: *r, expires: now.Add(routeCacheTTL)}
+	return r, nil
+}
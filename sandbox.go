@@ -0,0 +1,124 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/lib/pq"
+)
+
+// The sandbox is a second copy of the schema (SANDBOX_SCHEMA, created by
+// running sql-init.sql with that search_path) served by the same handlers
+// over a separate connection pool. Requests made with a sandbox API key see
+// only sandbox data, and charges and routes go to the fake providers.
+
+var (
+	sandboxDB     *sql.DB
+	sandboxSchema string
+)
+
+// openSandboxDB connects with search_path set to the sandbox schema, so
+// every unqualified table name resolves there.
+func openSandboxDB(dbURL, schema string) (*sql.DB, error) {
+	if strings.HasPrefix(dbURL, "postgres://") || strings.HasPrefix(dbURL, "postgresql://") {
+		u, err := url.Parse(dbURL)
+		if err != nil {
+			return nil, err
+		}
+		q := u.Query()
+		q.Set("search_path", schema)
+		u.RawQuery = q.Encode()
+		dbURL = u.String()
+	} else {
+		dbURL += " search_path=" + schema
+	}
+	return sql.Open("postgres", dbURL)
+}
+
+func isSandbox(ctx context.Context) bool {
+	c, _ := ctx.Value(claimsKey{}).(*Claims)
+	return c != nil && c.Sandbox
+}
+
+// ensureSandboxOwner copies the owner's account into the sandbox schema so
+// sandbox keys resolve to the same owner id there.
+func ensureSandboxOwner(db *sql.DB, ownerID string) error {
+	_, err := db.Exec(
+		`INSERT INTO `+pq.QuoteIdentifier(sandboxSchema)+`.owners SELECT * FROM owners WHERE id=$1 ON CONFLICT (id) DO NOTHING`,
+		ownerID,
+	)
+	return err
+}
+
+// sandboxEvents carries the sandbox's domain events, kept apart from the
+// live bus so live subscribers never act on sandbox rows.
+var sandboxEvents = &EventBus{handlers: map[string]map[int]func(Event){}}
+
+// sandboxContext marks background work on the sandbox schema the way a
+// sandbox API key marks a request, so it reaches the fake providers.
+func sandboxContext() context.Context {
+	return context.WithValue(context.Background(), claimsKey{}, &Claims{Sandbox: true})
+}
+
+// startSandboxWorkers runs the order lifecycle for the sandbox schema: the
+// outbox relay, the subscribers that accept, print and dispatch orders, and
+// the auto-cancel, SLA and refund workers. The relay only feeds the sandbox
+// bus and never announces on the live events channel, whose subscribers and
+// catch-up position belong to the live schema. Brokers and the outbox
+// webhook stay live-only, and so do the e-mails for review requests and late
+// orders.
+func startSandboxWorkers(db *sql.DB) {
+	ctx := sandboxContext()
+	sandboxEvents.Subscribe(eventOrderCreated, autoAcceptOrders(db))
+	sandboxEvents.Subscribe(eventOrderAccepted, queueOrderTickets(db))
+	sandboxEvents.Subscribe(eventOrderAccepted, autoDispatchOrders(ctx, db))
+	startOutboxRelay(db, []EventPublisher{eventBusSink{sandboxEvents}}, false)
+	startAutoCanceller(db)
+	startSLAMonitor(db)
+	startRefundProcessor(ctx, db)
+}
+
+// sandboxAwareRouter answers sandbox requests with the straight-line
+// estimate instead of calling the routing provider.
+type sandboxAwareRouter struct {
+	Router
+}
+
+func (s sandboxAwareRouter) Route(ctx context.Context, from, to Address) (*Route, error) {
+	if isSandbox(ctx) {
+		return straightLineRouter{}.Route(ctx, from, to)
+	}
+	return s.Router.Route(ctx, from, to)
+}
+
+// sandboxResetHandler deletes every establishment the key's owner owns in
+// the sandbox, with everything hanging off them and the outbox messages
+// still queued for them. It only exists on the sandbox handler, so it can't
+// reach live data.
+func sandboxResetHandler(db *sql.DB) http.HandlerFunc {
+	return authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		if !isSandbox(r.Context()) {
+			http.Error(w, "reset needs a sandbox api key", http.StatusForbidden)
+			return
+		}
+		_, err := db.Exec(
+			`WITH gone AS (
+			   DELETE FROM establishments WHERE id IN (SELECT establishment_id FROM establishment_staff WHERE owner_id=$1 AND role='owner')
+			   RETURNING id)
+			 DELETE FROM outbox WHERE payload->>'establishment_id' IN (SELECT id::text FROM gone)`,
+			currentClaims(r).Sub,
+		)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	})
+}
@@ -0,0 +1,122 @@
+package main
+
+import (
+	"html"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+// sanitizeText removes HTML markup from user-supplied text. Tags are dropped,
+// script and style elements lose their content too, and control characters
+// other than newlines and tabs are removed. A "<" that never closes is kept
+// with the rest of the text. Entities are left as typed, so the result never
+// gains markup it did not have.
+func sanitizeText(s string) string {
+	var b strings.Builder
+	for i := 0; i < len(s); {
+		if s[i] != '<' || i+1 == len(s) || !isTagStart(s[i+1]) {
+			b.WriteByte(s[i])
+			i++
+			continue
+		}
+		end := strings.IndexByte(s[i:], '>')
+		if end < 0 {
+			// Not a tag after all, e.g. "a <b" in prose: keep it.
+			b.WriteString(s[i:])
+			break
+		}
+		tag := s[i+1 : i+end]
+		i += end + 1
+		if name := tagName(tag); (name == "script" || name == "style") && tag[0] != '/' {
+			if close := strings.Index(strings.ToLower(s[i:]), "</"+name); close >= 0 {
+				i += close
+			} else {
+				i = len(s)
+			}
+		}
+	}
+	return strings.TrimSpace(strings.Map(func(r rune) rune {
+		if unicode.IsControl(r) && r != '\n' && r != '\t' {
+			return -1
+		}
+		return r
+	}, b.String()))
+}
+
+func isTagStart(c byte) bool {
+	return c == '/' || c == '!' || c == '?' || (c|0x20 >= 'a' && c|0x20 <= 'z')
+}
+
+func tagName(tag string) string {
+	if i := strings.IndexFunc(tag, func(r rune) bool { return unicode.IsSpace(r) || r == '/' }); i >= 0 {
+		tag = tag[:i]
+	}
+	return strings.ToLower(tag)
+}
+
+// sanitizeFields applies sanitizeText to each field in place.
+func sanitizeFields(fields ...*string) {
+	for _, f := range fields {
+		*f = sanitizeText(*f)
+	}
+}
+
+var (
+	markdownBold   = regexp.MustCompile(`\*\*([^*]+)\*\*`)
+	markdownItalic = regexp.MustCompile(`\*([^*]+)\*`)
+	markdownLink   = regexp.MustCompile(`\[([^\]]+)\]\((https?://[^\s)]+)\)`)
+)
+
+// renderMarkdown renders the subset of markdown allowed in descriptions
+// (paragraphs, "- " lists, **bold**, *italic* and http(s) links) to HTML.
+// The text is escaped before any markup is added, so the output only ever
+// contains the tags produced here.
+func renderMarkdown(s string) string {
+	if s == "" {
+		return ""
+	}
+	var b strings.Builder
+	inList := false
+	var para []string
+	flush := func() {
+		if len(para) > 0 {
+			b.WriteString("<p>" + strings.Join(para, "<br>") + "</p>")
+			para = nil
+		}
+		if inList {
+			b.WriteString("</ul>")
+			inList = false
+		}
+	}
+	for _, line := range strings.Split(s, "\n") {
+		line = strings.TrimSpace(line)
+		switch {
+		case line == "":
+			flush()
+		case strings.HasPrefix(line, "- "):
+			if len(para) > 0 {
+				flush()
+			}
+			if !inList {
+				b.WriteString("<ul>")
+				inList = true
+			}
+			b.WriteString("<li>" + renderInline(line[2:]) + "</li>")
+		default:
+			if inList {
+				flush()
+			}
+			para = append(para, renderInline(line))
+		}
+	}
+	flush()
+	return b.String()
+}
+
+func renderInline(s string) string {
+	s = html.EscapeString(s)
+	s = markdownLink.ReplaceAllString(s, `<a href="$2" rel="nofollow noopener">$1</a>`)
+	s = markdownBold.ReplaceAllString(s, "<strong>$1</strong>")
+	return markdownItalic.ReplaceAllString(s, "<em>$1</em>")
+}
@@ -0,0 +1,18 @@
+package main
+
+import "testing"
+
+func TestSanitizeText(t *testing.T) {
+	for in, want := range map[string]string{
+		"Pizza <b>grande</b>":                "Pizza grande",
+		"x<script>alert(1)</script>y":        "xy",
+		"Serve 2 pessoas <3":                 "Serve 2 pessoas <3",
+		"Preço a < b e mais texto":           "Preço a < b e mais texto",
+		"Combo <promo válido até domingo":    "Combo <promo válido até domingo",
+		"<i>Novo</i> combo <dois sabores 2x": "Novo combo <dois sabores 2x",
+	} {
+		if got := sanitizeText(in); got != want {
+			t.Errorf("sanitizeText(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"database/sql"
+	"encoding/base64"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// Provider credentials an establishment brings itself are stored with
+// envelope encryption: each value is sealed with its own data key under
+// AES-GCM, and the data key is wrapped by a master key. Only the wrapping
+// key changes on rotation, and plaintext never leaves this file except to
+// build a provider client.
+
+// KeyWrapper wraps and unwraps data keys. The local keyring is the only
+// implementation so far; a KMS would implement the same two calls.
+type KeyWrapper interface {
+	Wrap(dek []byte) (keyID string, wrapped []byte, err error)
+	Unwrap(keyID string, wrapped []byte) ([]byte, error)
+	ActiveKeyID() string
+}
+
+var keyWrapper KeyWrapper
+
+var errSecretsDisabled = errors.New("secret storage is not configured")
+
+// providerSecretNames are the credentials establishments may store.
+var providerSecretNames = map[string]bool{
+	"stripe.secret_key":          true,
+	"stripe.webhook_secret":      true,
+	"mercadopago.access_token":   true,
+	"mercadopago.webhook_secret": true,
+	"pagseguro.token":            true,
+}
+
+// newKeyWrapperFromEnv reads SECRETS_MASTER_KEYS, a comma-separated list of
+// id:base64 AES-256 keys. The first is used for new secrets; the others are
+// kept to unwrap older ones until they're rewrapped.
+func newKeyWrapperFromEnv() KeyWrapper {
+	v := os.Getenv("SECRETS_MASTER_KEYS")
+	if v == "" {
+		return nil
+	}
+	k := localKeyring{keys: map[string][]byte{}}
+	for _, entry := range strings.Split(v, ",") {
+		id, encoded, ok := strings.Cut(strings.TrimSpace(entry), ":")
+		key, err := base64.StdEncoding.DecodeString(encoded)
+		if !ok || err != nil || len(key) != 32 {
+			log.Printf("SECRETS_MASTER_KEYS: ignoring malformed key %q", id)
+			continue
+		}
+		if k.active == "" {
+			k.active = id
+		}
+		k.keys[id] = key
+	}
+	if k.active == "" {
+		return nil
+	}
+	return k
+}
+
+type localKeyring struct {
+	active string
+	keys   map[string][]byte
+}
+
+func (k localKeyring) ActiveKeyID() string { return k.active }
+
+func (k localKeyring) Wrap(dek []byte) (string, []byte, error) {
+	wrapped, err := sealGCM(k.keys[k.active], dek)
+	return k.active, wrapped, err
+}
+
+func (k localKeyring) Unwrap(keyID string, wrapped []byte) ([]byte, error) {
+	key, ok := k.keys[keyID]
+	if !ok {
+		return nil, errors.New("unknown master key " + keyID)
+	}
+	return openGCM(key, wrapped)
+}
+
+// sealGCM encrypts with a random nonce, which is prepended to the result.
+func sealGCM(key, plaintext []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	nonce := make([]byte, gcm.NonceSize())
+	if _, err := rand.Read(nonce); err != nil {
+		return nil, err
+	}
+	return gcm.Seal(nonce, nonce, plaintext, nil), nil
+}
+
+func openGCM(key, sealed []byte) ([]byte, error) {
+	block, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	gcm, err := cipher.NewGCM(block)
+	if err != nil {
+		return nil, err
+	}
+	if len(sealed) < gcm.NonceSize() {
+		return nil, errors.New("ciphertext too short")
+	}
+	return gcm.Open(nil, sealed[:gcm.NonceSize()], sealed[gcm.NonceSize():], nil)
+}
+
+type SecretInfo struct {
+	Name      string    `json:"name"`
+	KeyID     string    `json:"key_id"`
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+func putSecret(q execer, establishmentID, name, value string) error {
+	if keyWrapper == nil {
+		return errSecretsDisabled
+	}
+	dek := make([]byte, 32)
+	if _, err := rand.Read(dek); err != nil {
+		return err
+	}
+	ciphertext, err := sealGCM(dek, []byte(value))
+	if err != nil {
+		return err
+	}
+	keyID, wrapped, err := keyWrapper.Wrap(dek)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec(
+		`INSERT INTO establishment_secrets (establishment_id, name, ciphertext, wrapped_key, key_id) VALUES ($1,$2,$3,$4,$5)
+		 ON CONFLICT (establishment_id, name) DO UPDATE SET ciphertext=EXCLUDED.ciphertext, wrapped_key=EXCLUDED.wrapped_key, key_id=EXCLUDED.key_id, updated_at=now()`,
+		establishmentID, name, ciphertext, wrapped, keyID,
+	)
+	return err
+}
+
+// getSecret returns the plaintext, or "" when the establishment has none.
+func getSecret(q queryer, establishmentID, name string) (string, error) {
+	var ciphertext, wrapped []byte
+	var keyID string
+	err := q.QueryRow(
+		`SELECT ciphertext, wrapped_key, key_id FROM establishment_secrets WHERE establishment_id=$1 AND name=$2`,
+		establishmentID, name,
+	).Scan(&ciphertext, &wrapped, &keyID)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	if err != nil {
+		return "", err
+	}
+	if keyWrapper == nil {
+		return "", errSecretsDisabled
+	}
+	dek, err := keyWrapper.Unwrap(keyID, wrapped)
+	if err != nil {
+		return "", err
+	}
+	plaintext, err := openGCM(dek, ciphertext)
+	return string(plaintext), err
+}
+
+// establishmentGateway builds the gateway an establishment charges through:
+// the fake one in the sandbox, one with the establishment's own credentials
+// when it stored them, otherwise the platform's. With its own credentials
+// the establishment's webhooks come from its own provider account, so they
+// are verified with the webhook secret it stored alongside (PagSeguro signs
+// with the token itself).
+func establishmentGateway(ctx context.Context, db *sql.DB, establishmentID, name string) (Gateway, bool, error) {
+	if isSandbox(ctx) && name != "" {
+		return fakeGateway{}, true, nil
+	}
+	platform, ok := paymentGateways[name]
+	secretName := map[string]string{"stripe": "stripe.secret_key", "mercadopago": "mercadopago.access_token", "pagseguro": "pagseguro.token"}[name]
+	if secretName == "" {
+		return platform, ok, nil
+	}
+	secret, err := getSecret(db, establishmentID, secretName)
+	if err != nil || secret == "" {
+		return platform, ok, err
+	}
+	switch name {
+	case "stripe":
+		webhookSecret, err := getSecret(db, establishmentID, "stripe.webhook_secret")
+		return stripeGateway{secretKey: secret, webhookSecret: webhookSecret}, true, err
+	case "mercadopago":
+		webhookSecret, err := getSecret(db, establishmentID, "mercadopago.webhook_secret")
+		return mercadoPagoGateway{accessToken: secret, webhookSecret: webhookSecret}, true, err
+	default:
+		p, ok := platform.(pagSeguroGateway)
+		if !ok {
+			p.baseURL = "https://api.pagseguro.com"
+		}
+		return pagSeguroGateway{baseURL: p.baseURL, token: secret}, true, nil
+	}
+}
+
+// secretsRoute lists stored credentials (names and key versions only) and
+// sets or deletes one by name.
+func secretsRoute(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID, name string) {
+	if !requireRole(w, r, db, establishmentID, "owner") {
+		return
+	}
+	switch {
+	case name == "" && r.Method == http.MethodGet:
+		rows, err := db.Query(`SELECT name, key_id, updated_at FROM establishment_secrets WHERE establishment_id=$1 ORDER BY name`, establishmentID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		list := []SecretInfo{}
+		for rows.Next() {
+			var s SecretInfo
+			if err := rows.Scan(&s.Name, &s.KeyID, &s.UpdatedAt); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			list = append(list, s)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	case providerSecretNames[name] && r.Method == http.MethodPut:
+		var req struct {
+			Value string `json:"value"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if strings.TrimSpace(req.Value) == "" {
+			http.Error(w, "value is required", http.StatusUnprocessableEntity)
+			return
+		}
+		err := putSecret(db, establishmentID, name, strings.TrimSpace(req.Value))
+		if err == errSecretsDisabled {
+			http.Error(w, err.Error(), http.StatusServiceUnavailable)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := recordAudit(db, r, establishmentID, "establishment.secret_updated", "secret", name, nil); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case providerSecretNames[name] && r.Method == http.MethodDelete:
+		if _, err := db.Exec(`DELETE FROM establishment_secrets WHERE establishment_id=$1 AND name=$2`, establishmentID, name); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := recordAudit(db, r, establishmentID, "establishment.secret_deleted", "secret", name, nil); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case name != "" && !providerSecretNames[name]:
+		http.NotFound(w, nil)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// startSecretRewrapper moves data keys wrapped by retired master keys onto
+// the active one. Rotating is adding a new key at the front of
+// SECRETS_MASTER_KEYS and removing the old one once this has run.
+func startSecretRewrapper(db *sql.DB) {
+	if keyWrapper == nil {
+		return
+	}
+	go func() {
+		for {
+			n, err := rewrapSecrets(db)
+			if err != nil {
+				log.Printf("secret rewrap: %v", err)
+			} else if n > 0 {
+				log.Printf("secret rewrap: %d data keys moved to master key %s", n, keyWrapper.ActiveKeyID())
+			}
+			time.Sleep(time.Hour)
+		}
+	}()
+}
+
+func rewrapSecrets(db *sql.DB) (int, error) {
+	rows, err := db.Query(`SELECT establishment_id, name, wrapped_key, key_id FROM establishment_secrets WHERE key_id<>$1`, keyWrapper.ActiveKeyID())
+	if err != nil {
+		return 0, err
+	}
+	type stale struct {
+		establishmentID, name, keyID string
+		wrapped                      []byte
+	}
+	var todo []stale
+	for rows.Next() {
+		var s stale
+		if err := rows.Scan(&s.establishmentID, &s.name, &s.wrapped, &s.keyID); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		todo = append(todo, s)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	n := 0
+	for _, s := range todo {
+		dek, err := keyWrapper.Unwrap(s.keyID, s.wrapped)
+		if err != nil {
+			log.Printf("secret %s/%s: %v", s.establishmentID, s.name, err)
+			continue
+		}
+		keyID, wrapped, err := keyWrapper.Wrap(dek)
+		if err != nil {
+			return n, err
+		}
+		// The key_id condition skips rows rewritten since they were read.
+		res, err := db.Exec(
+			`UPDATE establishment_secrets SET wrapped_key=$1, key_id=$2 WHERE establishment_id=$3 AND name=$4 AND key_id=$5`,
+			wrapped, keyID, s.establishmentID, s.name, s.keyID,
+		)
+		if err != nil {
+			return n, err
+		}
+		if c, _ := res.RowsAffected(); c > 0 {
+			n++
+		}
+	}
+	return n, nil
+}
@@ -0,0 +1,267 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"encoding/xml"
+	"fmt"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Search engines get /sitemap.xml, listing the public menu page of every
+// published establishment, and /establishments/{id}/jsonld, the
+// schema.org Restaurant + Menu description of one of them. Each sitemap
+// entry's lastmod follows the establishment's catalog: product events bump
+// establishments.catalog_updated_at, so crawlers only refetch menus that
+// changed.
+
+// maxSitemapURLs is the protocol's limit per file; above it /sitemap.xml
+// becomes an index of /sitemap.xml?page=N.
+const maxSitemapURLs = 50000
+
+// sitemapCacheGroup is the response cache group of the sitemap, which isn't
+// scoped to an establishment.
+const sitemapCacheGroup = "sitemap"
+
+// menuPageURL is where the web app shows an establishment's menu.
+func menuPageURL(establishmentID string) string {
+	return appBaseURL + "/cardapio/" + establishmentID
+}
+
+// touchCatalogOnEvents keeps catalog_updated_at, and with it the sitemap,
+// current as products change.
+func touchCatalogOnEvents(db *sql.DB) {
+	for _, t := range []string{eventProductCreated, eventProductUpdated, eventProductDeleted} {
+		events.Subscribe(t, func(e Event) {
+			if _, err := db.Exec(`UPDATE establishments SET catalog_updated_at=now() WHERE id=$1`, e.EstablishmentID); err != nil {
+				log.Printf("sitemap: touching catalog of %s: %v", e.EstablishmentID, err)
+				return
+			}
+			responseCache.Invalidate(sitemapCacheGroup)
+		})
+	}
+}
+
+type sitemapURL struct {
+	Loc     string `xml:"loc"`
+	LastMod string `xml:"lastmod,omitempty"`
+}
+
+type sitemapURLSet struct {
+	XMLName xml.Name     `xml:"urlset"`
+	XMLNS   string       `xml:"xmlns,attr"`
+	URLs    []sitemapURL `xml:"url"`
+}
+
+type sitemapIndex struct {
+	XMLName  xml.Name     `xml:"sitemapindex"`
+	XMLNS    string       `xml:"xmlns,attr"`
+	Sitemaps []sitemapURL `xml:"sitemap"`
+}
+
+const sitemapXMLNS = "http://www.sitemaps.org/schemas/sitemap/0.9"
+
+func sitemapHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		responseCache.Serve(w, r, "sitemap", sitemapCacheGroup, func(w http.ResponseWriter, r *http.Request) { serveSitemap(w, r, db) })
+	}
+}
+
+func serveSitemap(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var total int
+	if err := db.QueryRow(`SELECT COUNT(*) FROM establishments WHERE status='published'`).Scan(&total); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	page := 0
+	if v := r.URL.Query().Get("page"); v != "" {
+		n, err := strconv.Atoi(v)
+		if err != nil || n < 1 {
+			http.Error(w, "page must be a positive integer", http.StatusBadRequest)
+			return
+		}
+		page = n
+	}
+	var doc any
+	if page == 0 && total > maxSitemapURLs {
+		index := sitemapIndex{XMLNS: sitemapXMLNS}
+		for p := 1; (p-1)*maxSitemapURLs < total; p++ {
+			index.Sitemaps = append(index.Sitemaps, sitemapURL{Loc: fmt.Sprintf("%s/sitemap.xml?page=%d", appBaseURL, p)})
+		}
+		doc = index
+	} else {
+		if page == 0 {
+			page = 1
+		}
+		urls, err := sitemapURLs(db, (page-1)*maxSitemapURLs)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if len(urls) == 0 && page > 1 {
+			http.NotFound(w, nil)
+			return
+		}
+		doc = sitemapURLSet{XMLNS: sitemapXMLNS, URLs: urls}
+	}
+	w.Header().Set("Content-Type", "application/xml; charset=utf-8")
+	w.Write([]byte(xml.Header))
+	xml.NewEncoder(w).Encode(doc)
+}
+
+// sitemapURLs lists one page of published menus. A menu's lastmod is the
+// latest change to the establishment, its products or its categories.
+func sitemapURLs(db *sql.DB, offset int) ([]sitemapURL, error) {
+	rows, err := db.Query(
+		`SELECT e.id, GREATEST(e.updated_at, e.catalog_updated_at,
+		   COALESCE((SELECT MAX(c.updated_at) FROM product_categories c WHERE c.establishment_id=e.id), e.updated_at))
+		 FROM establishments e WHERE e.status='published' ORDER BY e.id LIMIT $1 OFFSET $2`,
+		maxSitemapURLs, offset,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	var urls []sitemapURL
+	for rows.Next() {
+		var id string
+		var lastMod time.Time
+		if err := rows.Scan(&id, &lastMod); err != nil {
+			return nil, err
+		}
+		urls = append(urls, sitemapURL{Loc: menuPageURL(id), LastMod: lastMod.UTC().Format(time.RFC3339)})
+	}
+	return urls, rows.Err()
+}
+
+// getEstablishmentJSONLD describes a published establishment and its active
+// products as a schema.org Restaurant with a Menu, one MenuSection per
+// category, for pages to embed in a <script type="application/ld+json">.
+func getEstablishmentJSONLD(w http.ResponseWriter, db *sql.DB, id string) {
+	var name, description, phone, imageKey, street, number, neighborhood, city, state, cep string
+	var lat, lng sql.NullFloat64
+	var reviewCount int
+	var rating float64
+	var cuisines []string
+	err := db.QueryRow(
+		`SELECT e.name, COALESCE(e.description,''), COALESCE(e.phone,''), COALESCE(e.image_key,''),
+		   e.address_street, e.address_number, e.address_neighborhood, e.address_city, e.address_state, e.address_cep,
+		   e.address_lat, e.address_lng, COALESCE(s.review_count,0), COALESCE(s.rating_sum::float / NULLIF(s.review_count,0), 0),
+		   ARRAY(SELECT c.name FROM establishment_cuisines ec JOIN cuisines c ON c.slug=ec.cuisine WHERE ec.establishment_id=e.id ORDER BY c.name)
+		 FROM establishments e LEFT JOIN review_summaries s ON s.establishment_id=e.id
+		 WHERE e.id::text=$1 AND e.status='published'`,
+		id,
+	).Scan(&name, &description, &phone, &imageKey, &street, &number, &neighborhood, &city, &state, &cep, &lat, &lng, &reviewCount, &rating, pq.Array(&cuisines))
+	if err == sql.ErrNoRows {
+		http.NotFound(w, nil)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	doc := map[string]any{
+		"@context": "https://schema.org",
+		"@type":    "Restaurant",
+		"@id":      menuPageURL(id),
+		"url":      menuPageURL(id),
+		"name":     name,
+		"address": map[string]any{
+			"@type":           "PostalAddress",
+			"streetAddress":   street + ", " + number + " - " + neighborhood,
+			"addressLocality": city,
+			"addressRegion":   state,
+			"postalCode":      cep,
+			"addressCountry":  "BR",
+		},
+	}
+	if description != "" {
+		doc["description"] = description
+	}
+	if phone != "" {
+		doc["telephone"] = phone
+	}
+	if imageKey != "" {
+		doc["image"] = assetURL(imageKey)
+	}
+	if len(cuisines) > 0 {
+		doc["servesCuisine"] = cuisines
+	}
+	if lat.Valid && lng.Valid {
+		doc["geo"] = map[string]any{"@type": "GeoCoordinates", "latitude": lat.Float64, "longitude": lng.Float64}
+	}
+	if reviewCount > 0 {
+		doc["aggregateRating"] = map[string]any{"@type": "AggregateRating", "ratingValue": rating, "reviewCount": reviewCount, "bestRating": 5, "worstRating": 1}
+	}
+
+	sections, err := jsonLDMenuSections(db, id)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	doc["hasMenu"] = map[string]any{"@type": "Menu", "url": menuPageURL(id), "hasMenuSection": sections}
+
+	w.Header().Set("Content-Type", "application/ld+json")
+	json.NewEncoder(w).Encode(doc)
+}
+
+// jsonLDMenuSections groups active products by category, keeping
+// uncategorized ones in a trailing "Outros" section.
+func jsonLDMenuSections(db *sql.DB, establishmentID string) ([]map[string]any, error) {
+	rows, err := db.Query(
+		`SELECT COALESCE(c.name,''), p.name, COALESCE(p.description,''), p.price_cents, COALESCE(p.image_key,'')
+		 FROM products p LEFT JOIN product_categories c ON c.id=p.category_id
+		 WHERE p.establishment_id=$1 AND p.is_active
+		 ORDER BY c.name IS NULL, c.name, p.name`,
+		establishmentID,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	sections := []map[string]any{}
+	var current map[string]any
+	var currentName string
+	for rows.Next() {
+		var category, name, description, imageKey string
+		var price int
+		if err := rows.Scan(&category, &name, &description, &price, &imageKey); err != nil {
+			return nil, err
+		}
+		if category == "" {
+			category = "Outros"
+		}
+		if current == nil || category != currentName {
+			current = map[string]any{"@type": "MenuSection", "name": category, "hasMenuItem": []map[string]any{}}
+			currentName = category
+			sections = append(sections, current)
+		}
+		item := map[string]any{
+			"@type": "MenuItem",
+			"name":  name,
+			"offers": map[string]any{
+				"@type":         "Offer",
+				"price":         fmt.Sprintf("%d.%02d", price/100, price%100),
+				"priceCurrency": "BRL",
+			},
+		}
+		if description != "" {
+			item["description"] = description
+		}
+		if imageKey != "" {
+			item["image"] = assetURL(imageKey)
+		}
+		current["hasMenuItem"] = append(current["hasMenuItem"].([]map[string]any), item)
+	}
+	return sections, rows.Err()
+}
@@ -0,0 +1,250 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Each owner sign-in opens a session, one per device, that its access tokens
+// carry as the sid claim. Revoking a session cuts off its tokens right away;
+// the list shows where the owner is signed in.
+//
+// A session also holds a chain of refresh tokens, stored hashed. Each one is
+// exchanged once for a new access and refresh token; presenting a used one
+// again means it leaked, so the whole session is revoked.
+
+const (
+	// sessionTouchInterval limits how often a session's last_seen_at is
+	// written.
+	sessionTouchInterval = time.Minute
+	// refreshTokenTTL is how long a session lasts without being used.
+	refreshTokenTTL = 30 * 24 * time.Hour
+)
+
+type OwnerSession struct {
+	ID         string    `json:"id"`
+	UserAgent  string    `json:"user_agent"`
+	IP         string    `json:"ip"`
+	CreatedAt  time.Time `json:"created_at"`
+	LastSeenAt time.Time `json:"last_seen_at"`
+	// Current marks the session making the request.
+	Current bool `json:"current"`
+}
+
+// startOwnerSession records a session for the device making the request and
+// issues its first access and refresh tokens.
+func startOwnerSession(db *sql.DB, r *http.Request, ownerID string) (TokenResponse, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	defer tx.Rollback()
+
+	var sid string
+	err = tx.QueryRow(
+		`INSERT INTO owner_sessions (owner_id, user_agent, ip, expires_at) VALUES ($1, left($2, 255), $3, now() + $4 * interval '1 second') RETURNING id`,
+		ownerID, r.UserAgent(), clientIP(r), int(refreshTokenTTL.Seconds()),
+	).Scan(&sid)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	tok, err := issueSessionTokens(tx, ownerID, sid)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	if err := tx.Commit(); err != nil {
+		return TokenResponse{}, err
+	}
+	db.Exec(`DELETE FROM refresh_tokens WHERE expires_at < now()`)
+	return tok, nil
+}
+
+// issueSessionTokens signs an access token for the session and stores the
+// hash of a new refresh token.
+func issueSessionTokens(tx *sql.Tx, ownerID, sid string) (TokenResponse, error) {
+	refresh, err := randomToken(32)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	_, err = tx.Exec(
+		`INSERT INTO refresh_tokens (token_hash, session_id, expires_at) VALUES ($1,$2,now() + $3 * interval '1 second')`,
+		hashToken(refresh), sid, int(refreshTokenTTL.Seconds()),
+	)
+	if err != nil {
+		return TokenResponse{}, err
+	}
+	tok, err := issueClaims(Claims{Sub: ownerID, Typ: "owner", Sid: sid}, accessTokenTTL)
+	tok.RefreshToken = refresh
+	return tok, err
+}
+
+// refreshSession serves POST /auth/refresh, rotating the refresh token.
+func refreshSession(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var sid, ownerID string
+	var used, valid bool
+	err = tx.QueryRow(
+		`SELECT t.session_id, s.owner_id, t.used_at IS NOT NULL, t.expires_at > now() AND s.revoked_at IS NULL
+		 FROM refresh_tokens t JOIN owner_sessions s ON s.id=t.session_id
+		 WHERE t.token_hash=$1 FOR UPDATE OF t, s`,
+		hashToken(req.RefreshToken),
+	).Scan(&sid, &ownerID, &used, &valid)
+	if err == sql.ErrNoRows {
+		http.Error(w, "invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if used {
+		log.Printf("refresh token reused for session %s; revoking it", sid)
+		if _, err := tx.Exec(`UPDATE owner_sessions SET revoked_at=now() WHERE id=$1 AND revoked_at IS NULL`, sid); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Error(w, "invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if !valid {
+		http.Error(w, "invalid refresh token", http.StatusUnauthorized)
+		return
+	}
+	if _, err := tx.Exec(`UPDATE refresh_tokens SET used_at=now() WHERE token_hash=$1`, hashToken(req.RefreshToken)); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = tx.Exec(
+		`UPDATE owner_sessions SET last_seen_at=now(), ip=$2, expires_at=now() + $3 * interval '1 second' WHERE id=$1`,
+		sid, clientIP(r), int(refreshTokenTTL.Seconds()),
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tok, err := issueSessionTokens(tx, ownerID, sid)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tok)
+}
+
+// logoutRefreshToken ends the session of a refresh token, for clients whose
+// access token already expired.
+func logoutRefreshToken(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var req struct {
+		RefreshToken string `json:"refresh_token"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	res, err := db.Exec(
+		`UPDATE owner_sessions SET revoked_at=now()
+		 WHERE id=(SELECT session_id FROM refresh_tokens WHERE token_hash=$1) AND revoked_at IS NULL`,
+		hashToken(req.RefreshToken),
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "unauthorized", http.StatusUnauthorized)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func touchSession(db *sql.DB, r *http.Request, sid string) {
+	_, err := db.Exec(
+		`UPDATE owner_sessions SET last_seen_at=now(), ip=$2 WHERE id=$1 AND last_seen_at < now() - $3 * interval '1 second'`,
+		sid, clientIP(r), int(sessionTouchInterval.Seconds()),
+	)
+	if err != nil {
+		log.Printf("touch session %s: %v", sid, err)
+	}
+}
+
+// sessionsRoute serves GET /auth/sessions, DELETE /auth/sessions (every
+// session but the current one) and DELETE /auth/sessions/{id}.
+func sessionsRoute(w http.ResponseWriter, r *http.Request, db *sql.DB, id string) {
+	c := currentClaims(r)
+	switch {
+	case id == "" && r.Method == http.MethodGet:
+		rows, err := db.Query(
+			`SELECT id, user_agent, ip, created_at, last_seen_at FROM owner_sessions
+			 WHERE owner_id=$1 AND revoked_at IS NULL AND expires_at > now() ORDER BY last_seen_at DESC`,
+			c.Sub,
+		)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		list := []OwnerSession{}
+		for rows.Next() {
+			var s OwnerSession
+			if err := rows.Scan(&s.ID, &s.UserAgent, &s.IP, &s.CreatedAt, &s.LastSeenAt); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			s.Current = s.ID == c.Sid
+			list = append(list, s)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	case id == "" && r.Method == http.MethodDelete:
+		_, err := db.Exec(
+			`UPDATE owner_sessions SET revoked_at=now() WHERE owner_id=$1 AND id::text <> $2 AND revoked_at IS NULL`,
+			c.Sub, c.Sid,
+		)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	case id != "" && r.Method == http.MethodDelete:
+		if !uuidPattern.MatchString(id) {
+			http.NotFound(w, nil)
+			return
+		}
+		res, err := db.Exec(`UPDATE owner_sessions SET revoked_at=now() WHERE id=$1 AND owner_id=$2 AND revoked_at IS NULL`, id, c.Sub)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.NotFound(w, nil)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
@@ -0,0 +1,394 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"slices"
+	"strings"
+)
+
+// Establishment settings are registered below with a type, a default and
+// limits, and read and changed together through
+// GET/PATCH /establishments/{id}/settings. New toggles only need an entry
+// here: their overrides live in establishment_settings and are read with
+// settingValue. Older settings that workers join on keep their establishments
+// column, named by the entry, and the dedicated endpoints that set them keep
+// working.
+
+type settingDef struct {
+	Key         string
+	Type        string // bool, int or enum
+	Default     any
+	Description string
+	// Nullable allows null, meaning the feature is off.
+	Nullable bool
+	Min, Max *int
+	Values   []string
+	// Role is the minimum role allowed to change the setting; manager when
+	// empty.
+	Role string
+	// column is the establishments column holding the value, if any.
+	column string
+	// check validates a new value beyond its type and limits.
+	check func(v any) string
+	// afterSet runs in the transaction that changed the setting.
+	afterSet func(tx *sql.Tx, establishmentID string, v any) error
+}
+
+func intPtr(n int) *int { return &n }
+
+var settingDefs = []settingDef{
+	{
+		Key: "require_2fa", Type: "bool", Default: false, Role: "owner", column: "require_2fa",
+		Description: "Managers and owners must sign in with two-factor authentication.",
+	},
+	{
+		Key: "require_checkout_challenge", Type: "bool", Default: false,
+		Description: "Customers solve a challenge before checking out.",
+		check: func(v any) string {
+			if v == true && challengeVerifier == nil {
+				return "no challenge provider is configured"
+			}
+			return ""
+		},
+	},
+	{
+		Key: "auto_accept", Type: "bool", Default: false, column: "auto_accept",
+		Description: "New orders are accepted automatically.",
+	},
+	{
+		Key: "auto_accept_max_open", Type: "int", Nullable: true, Min: intPtr(1), column: "auto_accept_max_open",
+		Description: "Stop auto-accepting while this many orders are being prepared.",
+	},
+	{
+		Key: "auto_cancel_minutes", Type: "int", Nullable: true, Min: intPtr(1), Max: intPtr(1440), column: "auto_cancel_minutes",
+		Description: "Cancel and refund orders still pending after this many minutes.",
+	},
+	{
+		Key: "review_requests_enabled", Type: "bool", Default: false, column: "review_requests_enabled",
+		Description: "Ask customers for a review after delivery.",
+	},
+	{
+		Key: "review_request_delay_minutes", Type: "int", Default: 60, Min: intPtr(0), Max: intPtr(7 * 24 * 60), column: "review_request_delay_minutes",
+		Description: "How long after delivery the review request is sent.",
+	},
+	{
+		Key: "review_request_channel", Type: "enum", Default: "push", Values: []string{"push", "whatsapp"}, column: "review_request_channel",
+		Description: "How review requests are sent.",
+	},
+	{
+		Key: "delivery_proof", Type: "enum", Default: "none", Values: []string{"none", "photo", "signature", "pin"}, column: "delivery_proof",
+		Description: "Proof couriers must give when marking an order delivered.",
+	},
+	{
+		Key: "courier_location_sharing", Type: "bool", Default: true, column: "courier_location_sharing",
+		Description: "Customers can follow the courier's location.",
+		afterSet: func(tx *sql.Tx, establishmentID string, v any) error {
+			if v == true {
+				return nil
+			}
+			// Turning sharing off also drops what was collected so far.
+			_, err := tx.Exec(`DELETE FROM courier_locations WHERE establishment_id=$1`, establishmentID)
+			return err
+		},
+	},
+	{
+		Key: "courier_location_retention_hours", Type: "int", Default: 24, Min: intPtr(1), Max: intPtr(24 * 30), column: "courier_location_retention_hours",
+		Description: "How long courier locations are kept.",
+	},
+	{
+		Key: "auto_translate", Type: "bool", Default: false,
+		Description: "Machine-translate menu content that has no translation.",
+	},
+	{
+		Key: "auto_dispatch", Type: "enum", Default: "off", Values: []string{"off", "suggest", "assign"},
+		Description: "When a delivery order is accepted, suggest or assign the best-ranked courier.",
+	},
+	{
+		Key: "sla_minutes", Type: "int", Default: defaultSLAMinutes, Min: intPtr(5), Max: intPtr(24 * 60),
+		Description: "Minutes after ordering an order is promised by when it has no schedule or delivery estimate.",
+	},
+	{
+		Key: "prices_min_role", Type: "enum", Default: "staff", Values: []string{"staff", "manager", "owner"}, Role: "owner",
+		Description: "Lowest role allowed to change product prices.",
+	},
+	{
+		Key: "coupons_min_role", Type: "enum", Default: "manager", Values: []string{"manager", "owner"}, Role: "owner",
+		Description: "Lowest role allowed to create campaigns with coupons.",
+	},
+	{
+		Key: "payouts_min_role", Type: "enum", Default: "owner", Values: []string{"manager", "owner"}, Role: "owner",
+		Description: "Lowest role allowed to change the payment gateway.",
+	},
+}
+
+func findSetting(key string) (settingDef, bool) {
+	i := slices.IndexFunc(settingDefs, func(d settingDef) bool { return d.Key == key })
+	if i < 0 {
+		return settingDef{}, false
+	}
+	return settingDefs[i], true
+}
+
+// parse decodes and validates a value for the setting, returning a message
+// when it is invalid.
+func (d settingDef) parse(raw json.RawMessage) (any, string) {
+	if string(raw) == "null" {
+		if d.Nullable {
+			return nil, ""
+		}
+		return nil, d.Key + " must not be null"
+	}
+	var v any
+	switch d.Type {
+	case "bool":
+		var b bool
+		if json.Unmarshal(raw, &b) != nil {
+			return nil, d.Key + " must be a boolean"
+		}
+		v = b
+	case "int":
+		var n int
+		if json.Unmarshal(raw, &n) != nil {
+			return nil, d.Key + " must be an integer"
+		}
+		if d.Min != nil && n < *d.Min || d.Max != nil && n > *d.Max {
+			switch {
+			case d.Max == nil:
+				return nil, fmt.Sprintf("%s must be at least %d", d.Key, *d.Min)
+			case d.Min == nil:
+				return nil, fmt.Sprintf("%s must be at most %d", d.Key, *d.Max)
+			}
+			return nil, fmt.Sprintf("%s must be between %d and %d", d.Key, *d.Min, *d.Max)
+		}
+		v = n
+	case "enum":
+		var s string
+		if json.Unmarshal(raw, &s) != nil || !slices.Contains(d.Values, s) {
+			return nil, d.Key + " must be one of " + strings.Join(d.Values, ", ")
+		}
+		v = s
+	}
+	if d.check != nil {
+		if msg := d.check(v); msg != "" {
+			return nil, msg
+		}
+	}
+	return v, ""
+}
+
+type Setting struct {
+	Key         string   `json:"key"`
+	Type        string   `json:"type"`
+	Value       any      `json:"value"`
+	Default     any      `json:"default"`
+	Description string   `json:"description"`
+	Nullable    bool     `json:"nullable,omitempty"`
+	Min         *int     `json:"min,omitempty"`
+	Max         *int     `json:"max,omitempty"`
+	Values      []string `json:"values,omitempty"`
+}
+
+// loadSettings returns the establishment's effective settings, in registry
+// order, or sql.ErrNoRows.
+func loadSettings(q queryer, establishmentID string) ([]Setting, error) {
+	var row, overrides []byte
+	err := q.QueryRow(
+		`SELECT to_jsonb(e), COALESCE((SELECT jsonb_object_agg(s.key, s.value) FROM establishment_settings s WHERE s.establishment_id=e.id), '{}')
+		 FROM establishments e WHERE e.id=$1`, establishmentID,
+	).Scan(&row, &overrides)
+	if err != nil {
+		return nil, err
+	}
+	var columns, stored map[string]json.RawMessage
+	if err := json.Unmarshal(row, &columns); err != nil {
+		return nil, err
+	}
+	if err := json.Unmarshal(overrides, &stored); err != nil {
+		return nil, err
+	}
+	list := []Setting{}
+	for _, d := range settingDefs {
+		raw, ok := stored[d.Key]
+		if d.column != "" {
+			raw, ok = columns[d.column]
+		}
+		value := d.Default
+		if ok {
+			// A stored value the current limits reject falls back to the
+			// default.
+			if v, msg := d.parse(raw); msg == "" {
+				value = v
+			}
+		}
+		list = append(list, Setting{
+			Key: d.Key, Type: d.Type, Value: value, Default: d.Default, Description: d.Description,
+			Nullable: d.Nullable, Min: d.Min, Max: d.Max, Values: d.Values,
+		})
+	}
+	return list, nil
+}
+
+// settingValue returns a setting kept in establishment_settings, or its
+// default when the establishment hasn't overridden it.
+func settingValue(q queryer, establishmentID, key string) (any, error) {
+	d, ok := findSetting(key)
+	if !ok {
+		return nil, fmt.Errorf("unknown setting %q", key)
+	}
+	var raw []byte
+	err := q.QueryRow(`SELECT value FROM establishment_settings WHERE establishment_id::text=$1 AND key=$2`, establishmentID, key).Scan(&raw)
+	if err == sql.ErrNoRows {
+		return d.Default, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	if v, msg := d.parse(raw); msg == "" {
+		return v, nil
+	}
+	return d.Default, nil
+}
+
+func settingBool(q queryer, establishmentID, key string) (bool, error) {
+	v, err := settingValue(q, establishmentID, key)
+	return v == true, err
+}
+
+// storeSetting writes an already validated value for the setting.
+func storeSetting(q execer, establishmentID string, d settingDef, v any) error {
+	if d.column != "" {
+		_, err := q.Exec(`UPDATE establishments SET `+d.column+`=$1, updated_at=now() WHERE id=$2`, v, establishmentID)
+		return err
+	}
+	value, err := json.Marshal(v)
+	if err != nil {
+		return err
+	}
+	_, err = q.Exec(
+		`INSERT INTO establishment_settings (establishment_id, key, value) VALUES ($1,$2,$3)
+		 ON CONFLICT (establishment_id, key) DO UPDATE SET value=EXCLUDED.value, updated_at=now()`,
+		establishmentID, d.Key, value,
+	)
+	return err
+}
+
+func settingsRoute(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	switch r.Method {
+	case http.MethodGet:
+		if !requireRole(w, r, db, establishmentID, "manager") {
+			return
+		}
+		list, err := loadSettings(db, establishmentID)
+		if err == sql.ErrNoRows {
+			http.NotFound(w, nil)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	case http.MethodPatch:
+		patchSettings(w, r, db, establishmentID)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+type settingChange struct {
+	From any `json:"from"`
+	To   any `json:"to"`
+}
+
+// patchSettings changes the settings in the body, a JSON object of keys and
+// values, all or nothing, and records the changes in the audit log.
+func patchSettings(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	var body map[string]json.RawMessage
+	if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	role := "manager"
+	values := map[string]any{}
+	for key, raw := range body {
+		d, ok := findSetting(key)
+		if !ok {
+			http.Error(w, "unknown setting: "+key, http.StatusUnprocessableEntity)
+			return
+		}
+		v, msg := d.parse(raw)
+		if msg != "" {
+			http.Error(w, msg, http.StatusUnprocessableEntity)
+			return
+		}
+		values[key] = v
+		if d.Role == "owner" {
+			role = "owner"
+		}
+	}
+	if !requireRole(w, r, db, establishmentID, role) {
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT 1 FROM establishments WHERE id=$1 FOR UPDATE`, establishmentID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	before, err := loadSettings(tx, establishmentID)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, nil)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	changes := map[string]settingChange{}
+	for _, s := range before {
+		v, ok := values[s.Key]
+		if !ok || v == s.Value {
+			continue
+		}
+		d, _ := findSetting(s.Key)
+		if err := storeSetting(tx, establishmentID, d, v); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if d.afterSet != nil {
+			if err := d.afterSet(tx, establishmentID, v); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+		}
+		changes[s.Key] = settingChange{From: s.Value, To: v}
+	}
+	if len(changes) > 0 {
+		if err := recordAudit(tx, r, establishmentID, "establishment.settings_updated", "establishment", establishmentID, changes); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	list, err := loadSettings(tx, establishmentID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	responseCache.Invalidate(establishmentID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,171 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// Couriers work in shifts. Starting a shift makes the courier available for
+// deliveries; during it they can go on a break and come back, and ending it
+// takes them offline. Only available couriers can be given batches, and the
+// minutes on shift are paid at the courier's hourly rate in their payouts.
+
+type CourierShift struct {
+	ID        string     `json:"id"`
+	CourierID string     `json:"courier_id"`
+	StartedAt time.Time  `json:"started_at"`
+	EndedAt   *time.Time `json:"ended_at"`
+	Minutes   int64      `json:"minutes"`
+}
+
+// shiftAction serves POST .../shift/start and .../shift/end, from staff or
+// from the courier app.
+func shiftAction(w http.ResponseWriter, r *http.Request, db *sql.DB, c *Courier, action string) {
+	switch action {
+	case "start":
+		startShift(w, r, db, c)
+	case "end":
+		endShift(w, r, db, c)
+	default:
+		http.NotFound(w, nil)
+	}
+}
+
+func startShift(w http.ResponseWriter, r *http.Request, db *sql.DB, c *Courier) {
+	if !c.Active {
+		http.Error(w, "courier is inactive", http.StatusConflict)
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var s CourierShift
+	err = tx.QueryRow(
+		`INSERT INTO courier_shifts (courier_id, establishment_id) VALUES ($1,$2) RETURNING id, courier_id, started_at`,
+		c.ID, c.EstablishmentID,
+	).Scan(&s.ID, &s.CourierID, &s.StartedAt)
+	if isUniqueViolation(err) {
+		http.Error(w, "courier is already on shift", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := tx.Exec(`UPDATE couriers SET availability='available' WHERE id=$1`, c.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := recordAudit(tx, r, c.EstablishmentID, "courier.shift_started", "courier", c.ID, map[string]string{"shift_id": s.ID}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(s)
+}
+
+// endShift closes the open shift. Batches already assigned stay with the
+// courier; they just won't get new ones.
+func endShift(w http.ResponseWriter, r *http.Request, db *sql.DB, c *Courier) {
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var s CourierShift
+	var ended time.Time
+	err = tx.QueryRow(
+		`UPDATE courier_shifts SET ended_at=now() WHERE courier_id=$1 AND ended_at IS NULL
+		 RETURNING id, courier_id, started_at, ended_at, EXTRACT(EPOCH FROM ended_at - started_at)::bigint / 60`,
+		c.ID,
+	).Scan(&s.ID, &s.CourierID, &s.StartedAt, &ended, &s.Minutes)
+	if err == sql.ErrNoRows {
+		http.Error(w, "courier is not on shift", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s.EndedAt = &ended
+	if _, err := tx.Exec(`UPDATE couriers SET availability='offline' WHERE id=$1`, c.ID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := recordAudit(tx, r, c.EstablishmentID, "courier.shift_ended", "courier", c.ID, map[string]any{"shift_id": s.ID, "minutes": s.Minutes}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// setAvailability serves PUT /courier_app/availability, which moves a
+// courier on shift between available and on_break.
+func setAvailability(w http.ResponseWriter, r *http.Request, db *sql.DB, c *Courier) {
+	var req struct {
+		Availability string `json:"availability"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Availability != "available" && req.Availability != "on_break" {
+		http.Error(w, "availability must be available or on_break", http.StatusUnprocessableEntity)
+		return
+	}
+	res, err := db.Exec(`UPDATE couriers SET availability=$1 WHERE id=$2 AND availability <> 'offline'`, req.Availability, c.ID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.Error(w, "courier is not on shift", http.StatusConflict)
+		return
+	}
+	c.Availability = req.Availability
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(c)
+}
+
+// listShifts returns the courier's latest shifts, newest first; an open
+// shift counts its minutes up to now.
+func listShifts(w http.ResponseWriter, db *sql.DB, c *Courier) {
+	rows, err := db.Query(
+		`SELECT id, courier_id, started_at, ended_at, EXTRACT(EPOCH FROM COALESCE(ended_at, now()) - started_at)::bigint / 60
+		 FROM courier_shifts WHERE courier_id=$1 ORDER BY started_at DESC LIMIT 100`, c.ID,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	list := []CourierShift{}
+	for rows.Next() {
+		var s CourierShift
+		if err := rows.Scan(&s.ID, &s.CourierID, &s.StartedAt, &s.EndedAt, &s.Minutes); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		list = append(list, s)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"net/url"
+	"slices"
+	"strings"
+	"time"
+)
+
+// Short links are marketing URLs (/s/{code}) that redirect to an
+// establishment's menu, one of its products or one of its coupons on the web
+// app. UTM parameters saved with the link are added to the target, and ones
+// on the short URL itself are passed through, overriding them. Clicks are
+// counted per day for the stats.
+
+var utmParams = []string{"utm_source", "utm_medium", "utm_campaign", "utm_term", "utm_content"}
+
+type ShortLink struct {
+	ID              string `json:"id"`
+	Code            string `json:"code"`
+	URL             string `json:"url"`
+	EstablishmentID string `json:"establishment_id"`
+	// TargetType is menu, product or coupon; TargetID is the product id or
+	// coupon code and is empty for menu.
+	TargetType    string            `json:"target_type"`
+	TargetID      string            `json:"target_id,omitempty"`
+	UTM           map[string]string `json:"utm"`
+	Clicks        int               `json:"clicks"`
+	LastClickedAt *time.Time        `json:"last_clicked_at"`
+	CreatedAt     time.Time         `json:"created_at"`
+}
+
+type ShortLinkDay struct {
+	Day    string `json:"day"`
+	Clicks int    `json:"clicks"`
+}
+
+type ShortLinkStats struct {
+	ShortLink
+	Daily []ShortLinkDay `json:"daily"`
+}
+
+func shortLinkURL(code string) string {
+	return appBaseURL + "/s/" + code
+}
+
+// shortLinksHandler serves POST /short_links, creating a link for an
+// establishment the caller manages.
+func shortLinksHandler(db *sql.DB) http.HandlerFunc {
+	return authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		var l ShortLink
+		if err := json.NewDecoder(r.Body).Decode(&l); err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if l.EstablishmentID == "" {
+			http.Error(w, "establishment_id is required", http.StatusUnprocessableEntity)
+			return
+		}
+		if !requireRole(w, r, db, l.EstablishmentID, "manager") {
+			return
+		}
+		if msg := validateShortLinkTarget(db, &l); msg != "" {
+			http.Error(w, msg, http.StatusUnprocessableEntity)
+			return
+		}
+		for k, v := range l.UTM {
+			if !slices.Contains(utmParams, k) {
+				http.Error(w, "unknown utm parameter "+k, http.StatusUnprocessableEntity)
+				return
+			}
+			if v = sanitizeText(v); v == "" || len(v) > 100 {
+				http.Error(w, k+" must have between 1 and 100 characters", http.StatusUnprocessableEntity)
+				return
+			}
+			l.UTM[k] = v
+		}
+		if l.UTM == nil {
+			l.UTM = map[string]string{}
+		}
+		utm, _ := json.Marshal(l.UTM)
+		for attempt := 0; ; attempt++ {
+			code, err := randomToken(5)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			err = db.QueryRow(
+				`INSERT INTO short_links (code, establishment_id, target_type, target_id, utm, created_by) VALUES ($1,$2,$3,NULLIF($4,''),$5,$6)
+				 RETURNING id, code, created_at`,
+				code, l.EstablishmentID, l.TargetType, l.TargetID, utm, currentClaims(r).Sub,
+			).Scan(&l.ID, &l.Code, &l.CreatedAt)
+			if isUniqueViolation(err) && attempt < 3 {
+				continue
+			}
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			break
+		}
+		l.URL = shortLinkURL(l.Code)
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(http.StatusCreated)
+		json.NewEncoder(w).Encode(l)
+	})
+}
+
+// validateShortLinkTarget checks the target belongs to the establishment
+// and returns a message when it doesn't.
+func validateShortLinkTarget(db *sql.DB, l *ShortLink) string {
+	var query string
+	switch l.TargetType {
+	case "menu":
+		l.TargetID = ""
+		return ""
+	case "product":
+		query = `SELECT EXISTS (SELECT 1 FROM products WHERE id::text=$1 AND establishment_id::text=$2)`
+	case "coupon":
+		l.TargetID = strings.ToUpper(strings.TrimSpace(l.TargetID))
+		query = `SELECT EXISTS (SELECT 1 FROM coupons WHERE code=$1 AND establishment_id::text=$2)`
+	default:
+		return "target_type must be menu, product or coupon"
+	}
+	var ok bool
+	if err := db.QueryRow(query, l.TargetID, l.EstablishmentID).Scan(&ok); err != nil || !ok {
+		return l.TargetType + " not found"
+	}
+	return ""
+}
+
+// shortLinkTarget builds the web app URL a link redirects to, with the
+// link's UTM parameters and then the ones from the short URL's query.
+func shortLinkTarget(l ShortLink, query url.Values) string {
+	target, _ := url.Parse(menuPageURL(l.EstablishmentID))
+	q := url.Values{}
+	switch l.TargetType {
+	case "product":
+		q.Set("produto", l.TargetID)
+	case "coupon":
+		q.Set("cupom", l.TargetID)
+	}
+	for _, k := range utmParams {
+		if v := query.Get(k); v != "" {
+			q.Set(k, v)
+		} else if v := l.UTM[k]; v != "" {
+			q.Set(k, v)
+		}
+	}
+	target.RawQuery = q.Encode()
+	return target.String()
+}
+
+// shortLinkRedirectHandler serves GET /s/{code}, counting the click.
+func shortLinkRedirectHandler(db *sql.DB) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet && r.Method != http.MethodHead {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		code := strings.TrimPrefix(r.URL.Path, "/s/")
+		tx, err := db.Begin()
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer tx.Rollback()
+		var l ShortLink
+		var utm []byte
+		err = tx.QueryRow(
+			`UPDATE short_links SET clicks=clicks+1, last_clicked_at=now() WHERE code=$1
+			 RETURNING id, establishment_id, target_type, COALESCE(target_id,''), utm`,
+			code,
+		).Scan(&l.ID, &l.EstablishmentID, &l.TargetType, &l.TargetID, &utm)
+		if err == sql.ErrNoRows {
+			http.NotFound(w, nil)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		json.Unmarshal(utm, &l.UTM)
+		_, err = tx.Exec(
+			`INSERT INTO short_link_clicks (link_id, day, clicks) VALUES ($1, CURRENT_DATE, 1)
+			 ON CONFLICT (link_id, day) DO UPDATE SET clicks=short_link_clicks.clicks+1`,
+			l.ID,
+		)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if err := tx.Commit(); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, shortLinkTarget(l, r.URL.Query()), http.StatusFound)
+	}
+}
+
+// establishmentShortLinksRoute lists the establishment's links, newest
+// first, returns one link's daily clicks for the last 90 days, or deletes a
+// link.
+func establishmentShortLinksRoute(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID, linkID string) {
+	if !requireRole(w, r, db, establishmentID, "manager") {
+		return
+	}
+	switch {
+	case linkID == "" && r.Method == http.MethodGet:
+		cursor, limit, err := pageParams(r)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		at, id := keysetArgs(cursor)
+		rows, err := db.Query(
+			`SELECT `+shortLinkColumns+` FROM short_links WHERE establishment_id=$1 AND (created_at, id) < ($2, $3::uuid)
+			 ORDER BY created_at DESC, id DESC LIMIT $4`,
+			establishmentID, at, id, limit+1,
+		)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+		list := []ShortLink{}
+		for rows.Next() {
+			l, err := scanShortLink(rows)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			list = append(list, l)
+		}
+		page := newPage(list, limit, func(l ShortLink) pageCursor { return pageCursor{l.CreatedAt, l.ID} })
+		if page.NextCursor != nil {
+			w.Header().Set("X-Next-Cursor", *page.NextCursor)
+		}
+		respond(w, r, "short_links", page)
+	case linkID != "" && r.Method == http.MethodGet:
+		getShortLinkStats(w, db, establishmentID, linkID)
+	case linkID != "" && r.Method == http.MethodDelete:
+		res, err := db.Exec(`DELETE FROM short_links WHERE id::text=$1 AND establishment_id=$2`, linkID, establishmentID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			http.NotFound(w, nil)
+			return
+		}
+		w.WriteHeader(http.StatusNoContent)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+const shortLinkColumns = `id, code, establishment_id, target_type, COALESCE(target_id,''), utm, clicks, last_clicked_at, created_at`
+
+func scanShortLink(row interface{ Scan(...any) error }) (ShortLink, error) {
+	var l ShortLink
+	var utm []byte
+	if err := row.Scan(&l.ID, &l.Code, &l.EstablishmentID, &l.TargetType, &l.TargetID, &utm, &l.Clicks, &l.LastClickedAt, &l.CreatedAt); err != nil {
+		return l, err
+	}
+	l.URL = shortLinkURL(l.Code)
+	return l, json.Unmarshal(utm, &l.UTM)
+}
+
+func getShortLinkStats(w http.ResponseWriter, db *sql.DB, establishmentID, linkID string) {
+	l, err := scanShortLink(db.QueryRow(`SELECT `+shortLinkColumns+` FROM short_links WHERE id::text=$1 AND establishment_id=$2`, linkID, establishmentID))
+	if err == sql.ErrNoRows {
+		http.NotFound(w, nil)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	s := ShortLinkStats{ShortLink: l, Daily: []ShortLinkDay{}}
+	rows, err := db.Query(
+		`SELECT day::text, clicks FROM short_link_clicks WHERE link_id=$1 AND day > CURRENT_DATE - 90 ORDER BY day`,
+		l.ID,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d ShortLinkDay
+		if err := rows.Scan(&d.Day, &d.Clicks); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		s.Daily = append(s.Daily, d)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
@@ -0,0 +1,322 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"log"
+	"net/http"
+	"time"
+)
+
+// Every order has a promised time: the scheduled time when it was scheduled,
+// otherwise the delivery estimate given at checkout, otherwise ordered_at
+// plus the establishment's sla_minutes. An order that is still open past its
+// promised time breaches its SLA: the monitor marks it once, publishes
+// order.late to the dashboard stream and e-mails the establishment's owners.
+// Orders count as done when delivered or completed.
+
+const (
+	slaCheckEvery       = time.Minute
+	dashboardKeepAlive  = 25 * time.Second
+	defaultSLAMinutes   = 45
+	dashboardOrderLimit = 200
+)
+
+var ordersLate = newCounter("orders_late_total", "Orders still open after their promised time.", "establishment_id")
+
+// slaPromisedAt is the promised time of the order aliased o.
+var slaPromisedAt = fmt.Sprintf(
+	`COALESCE(o.scheduled_for, o.estimated_delivery_at, o.ordered_at + make_interval(mins => COALESCE(
+	   (SELECT (s.value)::int FROM establishment_settings s WHERE s.establishment_id=o.establishment_id AND s.key='sla_minutes'), %d)))`,
+	defaultSLAMinutes,
+)
+
+type OrderSLA struct {
+	OrderID     string     `json:"order_id"`
+	OrderNumber int        `json:"order_number"`
+	Status      string     `json:"status"` // open, on_time or late
+	PromisedAt  time.Time  `json:"promised_at"`
+	DoneAt      *time.Time `json:"done_at"`
+	BreachedAt  *time.Time `json:"breached_at"`
+	// MinutesLate is how far past the promised time the order was finished,
+	// or is now while it is still open; 0 when on time.
+	MinutesLate int `json:"minutes_late"`
+}
+
+// orderSLAColumns selects, for orders o left-joined to deliveries d, what
+// scanOrderSLA reads.
+var orderSLAColumns = `o.id, o.order_number, ` + slaPromisedAt + `, COALESCE(d.delivered_at, o.completed_at), o.sla_breached_at`
+
+func scanOrderSLA(s interface{ Scan(...any) error }) (OrderSLA, error) {
+	var o OrderSLA
+	if err := s.Scan(&o.OrderID, &o.OrderNumber, &o.PromisedAt, &o.DoneAt, &o.BreachedAt); err != nil {
+		return o, err
+	}
+	end := time.Now().UTC()
+	o.Status = "open"
+	if o.DoneAt != nil {
+		end = *o.DoneAt
+		o.Status = "on_time"
+	}
+	if late := end.Sub(o.PromisedAt); late > 0 {
+		o.MinutesLate = int(late.Minutes())
+		if o.DoneAt != nil {
+			o.Status = "late"
+		}
+	}
+	return o, nil
+}
+
+// getOrderSLA serves GET /orders/{id}/sla, the promised time against the
+// actual one.
+func getOrderSLA(w http.ResponseWriter, r *http.Request, db *sql.DB, orderID string) {
+	var establishmentID string
+	err := db.QueryRow(`SELECT establishment_id FROM orders WHERE id::text=$1`, orderID).Scan(&establishmentID)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, nil)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !requireRole(w, r, db, establishmentID, "staff") {
+		return
+	}
+	o, err := scanOrderSLA(db.QueryRow(`SELECT `+orderSLAColumns+` FROM orders o LEFT JOIN deliveries d ON d.order_id=o.id WHERE o.id=$1`, orderID))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	respond(w, r, "order_sla", o)
+}
+
+func startSLAMonitor(db *sql.DB) {
+	go func() {
+		for {
+			if n, err := flagLateOrders(db); err != nil {
+				log.Printf("sla monitor: %v", err)
+			} else if n > 0 {
+				log.Printf("sla monitor: %d orders late", n)
+			}
+			time.Sleep(slaCheckEvery)
+		}
+	}()
+}
+
+// flagLateOrders marks open orders past their promised time and enqueues an
+// order.late event for each, in the same transaction so every breach is
+// announced exactly once.
+func flagLateOrders(db *sql.DB) (int, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return 0, err
+	}
+	defer tx.Rollback()
+
+	rows, err := tx.Query(
+		`UPDATE orders o SET sla_breached_at=now()
+		 WHERE o.status IN ('PENDING','PROCESSING') AND o.sla_breached_at IS NULL AND ` + slaPromisedAt + ` < now()
+		   AND NOT EXISTS (SELECT 1 FROM deliveries d WHERE d.order_id=o.id)
+		 RETURNING o.id, o.establishment_id, o.order_number`,
+	)
+	if err != nil {
+		return 0, err
+	}
+	var late []Event
+	for rows.Next() {
+		e := Event{Type: eventOrderLate}
+		if err := rows.Scan(&e.OrderID, &e.EstablishmentID, &e.OrderNumber); err != nil {
+			rows.Close()
+			return 0, err
+		}
+		late = append(late, e)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return 0, err
+	}
+	for _, e := range late {
+		if err := enqueueEvent(tx, e); err != nil {
+			return 0, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return 0, err
+	}
+	for _, e := range late {
+		ordersLate.Inc(e.EstablishmentID)
+	}
+	return len(late), nil
+}
+
+// notifyOrderLate e-mails the establishment's owners about an SLA breach.
+func notifyOrderLate(db *sql.DB) func(Event) {
+	return func(e Event) {
+		var establishment string
+		var promised time.Time
+		err := db.QueryRow(
+			`SELECT e.name, `+slaPromisedAt+` FROM orders o JOIN establishments e ON e.id=o.establishment_id WHERE o.id=$1`,
+			e.OrderID,
+		).Scan(&establishment, &promised)
+		if err != nil {
+			log.Printf("late order notify %s: %v", e.OrderID, err)
+			return
+		}
+		loc, err := establishmentLocation(db, e.EstablishmentID)
+		if err != nil {
+			log.Printf("late order notify %s: %v", e.OrderID, err)
+			return
+		}
+		rows, err := db.Query(
+			`SELECT o.email FROM establishment_staff s JOIN owners o ON o.id=s.owner_id WHERE s.establishment_id=$1 AND s.role='owner'`,
+			e.EstablishmentID,
+		)
+		if err != nil {
+			log.Printf("late order notify %s: %v", e.OrderID, err)
+			return
+		}
+		var emails []string
+		for rows.Next() {
+			var email string
+			if err := rows.Scan(&email); err == nil {
+				emails = append(emails, email)
+			}
+		}
+		rows.Close()
+		number := formatOrderNumber(e.OrderNumber)
+		body := fmt.Sprintf("O pedido %s em %s estava prometido para %s e ainda não foi entregue.", number, establishment, promised.In(loc).Format("15:04"))
+		for _, email := range emails {
+			if err := mailer.Send(email, "Pedido "+number+" atrasado", body); err != nil {
+				log.Printf("late order notify %s: %v", e.OrderID, err)
+			}
+		}
+	}
+}
+
+// loadOpenOrderSLAs returns the establishment's open orders, the latest
+// ones first.
+func loadOpenOrderSLAs(db *sql.DB, establishmentID string) ([]OrderSLA, error) {
+	rows, err := db.Query(
+		`SELECT `+orderSLAColumns+` FROM orders o LEFT JOIN deliveries d ON d.order_id=o.id
+		 WHERE o.establishment_id=$1 AND o.status IN ('PENDING','PROCESSING') AND d.id IS NULL
+		 ORDER BY o.ordered_at DESC LIMIT $2`,
+		establishmentID, dashboardOrderLimit,
+	)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []OrderSLA{}
+	for rows.Next() {
+		o, err := scanOrderSLA(rows)
+		if err != nil {
+			return nil, err
+		}
+		list = append(list, o)
+	}
+	return list, rows.Err()
+}
+
+// streamDashboard serves GET /establishments/{id}/dashboard/stream: a
+// "snapshot" event with the open orders and how late each one is, then
+// order events as they happen, including order.late when an order breaches
+// its SLA.
+func streamDashboard(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	if !requireRole(w, r, db, establishmentID, "staff") {
+		return
+	}
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	snapshot, err := loadOpenOrderSLAs(db, establishmentID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ch := make(chan Event, 64)
+	forward := func(e Event) {
+		if e.EstablishmentID != establishmentID {
+			return
+		}
+		select {
+		case ch <- e:
+		default: // a stalled client drops events rather than blocking the bus
+		}
+	}
+	for _, t := range []string{eventOrderCreated, eventOrderAccepted, eventOrderCancelled, eventOrderDelivered, eventOrderLate} {
+		defer liveEvents.Subscribe(t, forward)()
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	writeSSE(w, "snapshot", snapshot)
+	flusher.Flush()
+
+	ticker := time.NewTicker(dashboardKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-ch:
+			writeSSE(w, e.Type, e)
+		case <-ticker.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		}
+		flusher.Flush()
+	}
+}
+
+type SLAReport struct {
+	From     time.Time `json:"from"`
+	To       time.Time `json:"to"`
+	Orders   int       `json:"orders"`
+	OnTime   int       `json:"on_time"`
+	Late     int       `json:"late"`
+	LateRate float64   `json:"late_rate"`
+	// AvgMinutesLate and P90MinutesLate are over the late orders only.
+	AvgMinutesLate float64 `json:"avg_minutes_late"`
+	P90MinutesLate float64 `json:"p90_minutes_late"`
+}
+
+// slaReport is the share of finished orders over ?from=&to= that were done
+// after their promised time.
+func slaReport(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	loc, err := establishmentLocation(db, establishmentID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	from, to, err := reportRange(r, loc)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	rep := SLAReport{From: from, To: to}
+	var avg, p90 sql.NullFloat64
+	err = db.QueryRow(
+		`SELECT COUNT(*), COUNT(*) FILTER (WHERE late > 0),
+		   AVG(late) FILTER (WHERE late > 0) / 60, percentile_cont(0.9) WITHIN GROUP (ORDER BY late) FILTER (WHERE late > 0) / 60
+		 FROM (
+		   SELECT EXTRACT(EPOCH FROM COALESCE(d.delivered_at, o.completed_at) - `+slaPromisedAt+`) AS late
+		   FROM orders o LEFT JOIN deliveries d ON d.order_id=o.id
+		   WHERE o.establishment_id=$1 AND o.ordered_at >= $2 AND o.ordered_at < $3
+		     AND (o.status='COMPLETED' OR d.id IS NOT NULL) AND COALESCE(d.delivered_at, o.completed_at) IS NOT NULL) o`,
+		establishmentID, from, to,
+	).Scan(&rep.Orders, &rep.Late, &avg, &p90)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	rep.OnTime = rep.Orders - rep.Late
+	rep.AvgMinutesLate, rep.P90MinutesLate = avg.Float64, p90.Float64
+	if rep.Orders > 0 {
+		rep.LateRate = float64(rep.Late) / float64(rep.Orders)
+	}
+	respond(w, r, "sla_report", rep)
+}
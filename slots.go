@@ -0,0 +1,191 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+type SlotRules struct {
+	IntervalMinutes int    `json:"interval_minutes"`
+	Capacity        int    `json:"capacity"`
+	OpensAt         string `json:"opens_at"`
+	ClosesAt        string `json:"closes_at"`
+}
+
+type DeliverySlot struct {
+	ID       string    `json:"id"`
+	StartsAt time.Time `json:"starts_at"`
+	EndsAt   time.Time `json:"ends_at"`
+	Capacity int       `json:"capacity"`
+	Booked   int       `json:"booked"`
+	Closed   bool      `json:"closed"`
+}
+
+func slotsRoute(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID, slotID string) {
+	switch {
+	case slotID == "" && r.Method == http.MethodGet:
+		listSlots(w, r, db, establishmentID)
+	case slotID == "rules" && r.Method == http.MethodPut:
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) {
+			if requireRole(w, r, db, establishmentID, "manager") {
+				putSlotRules(w, r, db, establishmentID)
+			}
+		})(w, r)
+	case slotID != "" && r.Method == http.MethodPatch:
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) {
+			if requireRole(w, r, db, establishmentID, "staff") {
+				updateSlot(w, r, db, establishmentID, slotID)
+			}
+		})(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func putSlotRules(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	var rules SlotRules
+	if err := json.NewDecoder(r.Body).Decode(&rules); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	opens, err1 := time.Parse("15:04", rules.OpensAt)
+	closes, err2 := time.Parse("15:04", rules.ClosesAt)
+	if err1 != nil || err2 != nil || !closes.After(opens) {
+		http.Error(w, "opens_at and closes_at must be HH:MM with opens_at before closes_at", http.StatusUnprocessableEntity)
+		return
+	}
+	if rules.IntervalMinutes < 5 || rules.IntervalMinutes > 240 || rules.Capacity <= 0 {
+		http.Error(w, "interval_minutes must be between 5 and 240 and capacity must be positive", http.StatusUnprocessableEntity)
+		return
+	}
+	_, err := db.Exec(
+		`INSERT INTO delivery_slot_rules (establishment_id, interval_minutes, capacity, opens_at, closes_at) VALUES ($1,$2,$3,$4,$5)
+		 ON CONFLICT (establishment_id) DO UPDATE SET interval_minutes=EXCLUDED.interval_minutes, capacity=EXCLUDED.capacity,
+		   opens_at=EXCLUDED.opens_at, closes_at=EXCLUDED.closes_at, updated_at=now()`,
+		establishmentID, rules.IntervalMinutes, rules.Capacity, rules.OpensAt, rules.ClosesAt,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// listSlots materializes the day's slots from the establishment rules on first
+// access and returns the ones still bookable. Full and closed slots are only
+// listed for staff asking with ?all=true.
+func listSlots(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	loc, err := establishmentLocation(db, establishmentID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	day := time.Now().In(loc).Format(time.DateOnly)
+	if v := r.URL.Query().Get("date"); v != "" {
+		if _, err := time.Parse(time.DateOnly, v); err != nil {
+			http.Error(w, "date must be YYYY-MM-DD", http.StatusBadRequest)
+			return
+		}
+		day = v
+	}
+	// Rules are in the establishment's local time; slots are stored in UTC.
+	_, err = db.Exec(
+		`INSERT INTO delivery_slots (establishment_id, starts_at, ends_at, capacity)
+		 SELECT r.establishment_id, s AT TIME ZONE $3 AT TIME ZONE 'UTC', (s + make_interval(mins => r.interval_minutes)) AT TIME ZONE $3 AT TIME ZONE 'UTC', r.capacity
+		 FROM delivery_slot_rules r,
+		      generate_series($2::date + r.opens_at, $2::date + r.closes_at - make_interval(mins => r.interval_minutes), make_interval(mins => r.interval_minutes)) s
+		 WHERE r.establishment_id=$1
+		 ON CONFLICT (establishment_id, starts_at) DO NOTHING`,
+		establishmentID, day, loc.String(),
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	all := false
+	if r.URL.Query().Get("all") == "true" {
+		ok := false
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) {
+			ok = requireRole(w, r, db, establishmentID, "staff")
+		})(w, r)
+		if !ok {
+			return
+		}
+		all = true
+	}
+	rows, err := db.Query(
+		`SELECT id, starts_at, ends_at, capacity, booked, closed FROM delivery_slots
+		 WHERE establishment_id=$1 AND (starts_at AT TIME ZONE 'UTC' AT TIME ZONE $4)::date=$2::date
+		   AND ($3 OR (NOT closed AND booked < capacity AND starts_at > now()))
+		 ORDER BY starts_at`,
+		establishmentID, day, all, loc.String(),
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	list := []DeliverySlot{}
+	for rows.Next() {
+		var s DeliverySlot
+		if err := rows.Scan(&s.ID, &s.StartsAt, &s.EndsAt, &s.Capacity, &s.Booked, &s.Closed); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		list = append(list, s)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func updateSlot(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID, slotID string) {
+	var req struct {
+		Closed   *bool `json:"closed"`
+		Capacity *int  `json:"capacity"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Capacity != nil && *req.Capacity < 0 {
+		http.Error(w, "capacity must not be negative", http.StatusUnprocessableEntity)
+		return
+	}
+	var s DeliverySlot
+	err := db.QueryRow(
+		`UPDATE delivery_slots SET closed=COALESCE($1, closed), capacity=COALESCE($2, capacity)
+		 WHERE id=$3 AND establishment_id=$4
+		 RETURNING id, starts_at, ends_at, capacity, booked, closed`,
+		req.Closed, req.Capacity, slotID, establishmentID,
+	).Scan(&s.ID, &s.StartsAt, &s.EndsAt, &s.Capacity, &s.Booked, &s.Closed)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, nil)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
+
+// bookSlot reserves one unit of capacity in the slot. The conditional update
+// makes concurrent checkouts for the last place in a slot race safely.
+func bookSlot(tx *sql.Tx, establishmentID, slotID string) (time.Time, error) {
+	var startsAt time.Time
+	err := tx.QueryRow(
+		`UPDATE delivery_slots SET booked=booked+1
+		 WHERE id=$1 AND establishment_id=$2 AND NOT closed AND booked < capacity AND starts_at > now()
+		 RETURNING starts_at`,
+		slotID, establishmentID,
+	).Scan(&startsAt)
+	if err == sql.ErrNoRows {
+		return startsAt, &checkoutError{http.StatusConflict, "slot_unavailable", "the selected delivery slot is full or closed"}
+	}
+	return startsAt, err
+}
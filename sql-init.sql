@@ -10,6 +10,44 @@ CREATE TABLE establishments (
   image_key     VARCHAR(512),
   banner_key    VARCHAR(512),
   phone         VARCHAR(20),
+  whatsapp      VARCHAR(20),
+  instagram     VARCHAR(30),
+  website       VARCHAR(255),
+  email         VARCHAR(255),
+  cnpj          VARCHAR(14),
+  address_cep          VARCHAR(8)   NOT NULL DEFAULT '',
+  address_street       VARCHAR(255) NOT NULL DEFAULT '',
+  address_number       VARCHAR(20)  NOT NULL DEFAULT '',
+  address_complement   VARCHAR(100) NOT NULL DEFAULT '',
+  address_neighborhood VARCHAR(100) NOT NULL DEFAULT '',
+  address_city         VARCHAR(100) NOT NULL DEFAULT '',
+  address_state        CHAR(2)      NOT NULL DEFAULT '',
+  address_lat          DOUBLE PRECISION,
+  address_lng          DOUBLE PRECISION,
+  timezone      VARCHAR(64) NOT NULL DEFAULT 'America/Sao_Paulo',
+  status        VARCHAR(20) NOT NULL DEFAULT 'draft'
+    CHECK (status IN ('draft','published','suspended')),
+  preview_token VARCHAR(64) NOT NULL,
+  published_at  TIMESTAMP,
+  require_2fa   BOOLEAN     NOT NULL DEFAULT FALSE,
+  courier_location_sharing BOOLEAN NOT NULL DEFAULT TRUE,
+  courier_location_retention_hours INTEGER NOT NULL DEFAULT 24
+    CHECK (courier_location_retention_hours > 0),
+  debug_recording_until TIMESTAMP,
+  verified_at   TIMESTAMP,
+  category      VARCHAR(30),
+  payment_gateway VARCHAR(20),
+  auto_accept   BOOLEAN     NOT NULL DEFAULT FALSE,
+  auto_accept_max_open INTEGER,
+  auto_cancel_minutes INTEGER,
+  review_requests_enabled      BOOLEAN     NOT NULL DEFAULT FALSE,
+  review_request_delay_minutes INTEGER     NOT NULL DEFAULT 60,
+  review_request_channel       VARCHAR(20) NOT NULL DEFAULT 'push'
+    CHECK (review_request_channel IN ('push','whatsapp')),
+  delivery_proof VARCHAR(10) NOT NULL DEFAULT 'none'
+    CHECK (delivery_proof IN ('none','photo','signature','pin')),
+  organization_id UUID,
+  catalog_updated_at TIMESTAMP NOT NULL DEFAULT now(),
   created_at    TIMESTAMP   NOT NULL DEFAULT now(),
   updated_at    TIMESTAMP   NOT NULL DEFAULT now()
 );
@@ -20,9 +58,16 @@ CREATE TABLE product_categories (
   establishment_id UUID        NOT NULL
     REFERENCES establishments(id)
     ON DELETE CASCADE,
+  parent_id        UUID
+    REFERENCES product_categories(id)
+    ON DELETE CASCADE,
   name             VARCHAR(100) NOT NULL,
   description      TEXT,
-  created_at       TIMESTAMP    NOT NULL DEFAULT now()
+  image_key        VARCHAR(512),
+  image_alt_text   VARCHAR(250) NOT NULL DEFAULT '',
+  banner_key       VARCHAR(512),
+  created_at       TIMESTAMP    NOT NULL DEFAULT now(),
+  updated_at       TIMESTAMP    NOT NULL DEFAULT now()
 );
 
 -- 3. PRODUTOS
@@ -38,8 +83,15 @@ CREATE TABLE products (
   description      TEXT,
   price_cents      INTEGER     NOT NULL,
   image_key        VARCHAR(512),
+  image_alt_text   VARCHAR(250) NOT NULL DEFAULT '',
   banner_key       VARCHAR(512),
   is_active        BOOLEAN     NOT NULL DEFAULT TRUE,
+  stock_quantity   INTEGER     CHECK (stock_quantity >= 0),
+  fulfillment_types TEXT[]     NOT NULL DEFAULT '{delivery,pickup,dine_in}'
+    CHECK (fulfillment_types <@ ARRAY['delivery','pickup','dine_in']),
+  catalog_product_id UUID,
+  barcode          VARCHAR(14) CHECK (barcode ~ '^[0-9]{8}([0-9]{4,6})?$'),
+  custom_fields    JSONB       NOT NULL DEFAULT '{}',
   created_at       TIMESTAMP   NOT NULL DEFAULT now(),
   updated_at       TIMESTAMP   NOT NULL DEFAULT now()
 );
@@ -84,6 +136,10 @@ CREATE TABLE coupons (
   valid_from    DATE        NOT NULL,
   valid_until   DATE        NOT NULL,
   max_uses      INTEGER,
+  establishment_id UUID
+    REFERENCES establishments(id)
+    ON DELETE CASCADE,
+  campaign_id   UUID,
   created_at    TIMESTAMP   NOT NULL DEFAULT now()
 );
 
@@ -137,11 +193,32 @@ CREATE TABLE orders (
     ON DELETE SET NULL,
   loyalty_points    INTEGER     NOT NULL DEFAULT 0,
   total_cents       BIGINT      NOT NULL,
+  store_credit_cents BIGINT     NOT NULL DEFAULT 0,
+  gift_card_cents   BIGINT      NOT NULL DEFAULT 0,
+  fulfillment_type  VARCHAR(20) NOT NULL DEFAULT 'delivery'
+    CHECK (fulfillment_type IN ('delivery','pickup','dine_in')),
+  delivery_address  TEXT        NOT NULL DEFAULT '',
+  delivery_lat      DOUBLE PRECISION,
+  delivery_lng      DOUBLE PRECISION,
+  delivery_fee_cents BIGINT     NOT NULL DEFAULT 0,
+  delivery_fee_details JSONB,
+  estimated_delivery_at TIMESTAMP,
+  payment_method    VARCHAR(30) NOT NULL DEFAULT '',
+  change_for_cents  BIGINT,
+  slot_id           UUID,
+  scheduled_for     TIMESTAMP,
+  delivery_pin      CHAR(4)     NOT NULL DEFAULT lpad(floor(random() * 10000)::int::text, 4, '0'),
+  device_fingerprint VARCHAR(255),
+  risk_score        INTEGER     NOT NULL DEFAULT 0,
+  risk_assessment   JSONB,
   status            VARCHAR(20) NOT NULL DEFAULT 'PENDING'
     CHECK (status IN ('PENDING','PROCESSING','COMPLETED','CANCELLED','FAILED')),
   ordered_at        TIMESTAMP   NOT NULL DEFAULT now(),
+  business_date     DATE        NOT NULL,
+  order_number      INTEGER     NOT NULL,
   processed_at      TIMESTAMP,
   completed_at      TIMESTAMP,
+  sla_breached_at   TIMESTAMP,
   updated_at        TIMESTAMP   NOT NULL DEFAULT now()
 );
 
@@ -153,6 +230,7 @@ CREATE TABLE order_items (
   product_id        UUID        NOT NULL
     REFERENCES products(id)
     ON DELETE RESTRICT,
+  product_name      VARCHAR(255) NOT NULL DEFAULT '',
   quantity          INTEGER     NOT NULL CHECK (quantity > 0),
   unit_price_cents  BIGINT      NOT NULL,
   total_price_cents BIGINT      NOT NULL,
@@ -170,7 +248,1338 @@ CREATE TABLE order_events (
   occurred_at TIMESTAMP   NOT NULL DEFAULT now()
 );
 
+-- 14. ALTERAÇÕES DE PEDIDO (audit trail de emendas feitas pelo restaurante)
+CREATE TABLE order_amendments (
+  id                   UUID        PRIMARY KEY DEFAULT gen_random_uuid(),
+  order_id             UUID        NOT NULL
+    REFERENCES orders(id)
+    ON DELETE CASCADE,
+  operations           JSONB       NOT NULL,
+  reason               TEXT        NOT NULL,
+  previous_total_cents BIGINT      NOT NULL,
+  new_total_cents      BIGINT      NOT NULL,
+  delta_cents          BIGINT      NOT NULL,
+  created_at           TIMESTAMP   NOT NULL DEFAULT now()
+);
+
+-- 15. AJUSTES DE PAGAMENTO (estorno ou cobrança extra)
+CREATE TABLE payment_adjustments (
+  id            UUID        PRIMARY KEY DEFAULT gen_random_uuid(),
+  order_id      UUID        NOT NULL
+    REFERENCES orders(id)
+    ON DELETE CASCADE,
+  amendment_id  UUID
+    REFERENCES order_amendments(id)
+    ON DELETE SET NULL,
+  kind          VARCHAR(10) NOT NULL
+    CHECK (kind IN ('refund','charge')),
+  amount_cents  BIGINT      NOT NULL CHECK (amount_cents > 0),
+  status        VARCHAR(20) NOT NULL DEFAULT 'PENDING'
+    CHECK (status IN ('PENDING','COMPLETED','FAILED')),
+  created_at    TIMESTAMP   NOT NULL DEFAULT now(),
+  updated_at    TIMESTAMP   NOT NULL DEFAULT now()
+);
+
+-- 16. NOTIFICAÇÕES PARA CLIENTES
+CREATE TABLE notifications (
+  id            UUID        PRIMARY KEY DEFAULT gen_random_uuid(),
+  customer_id   UUID        NOT NULL
+    REFERENCES customers(id)
+    ON DELETE CASCADE,
+  kind          VARCHAR(50) NOT NULL,
+  channel       VARCHAR(20) NOT NULL DEFAULT 'push',
+  payload       JSONB,
+  send_after    TIMESTAMP   NOT NULL DEFAULT now(),
+  sent_at       TIMESTAMP,
+  created_at    TIMESTAMP   NOT NULL DEFAULT now()
+);
+
+-- 17. DONOS DE ESTABELECIMENTO (contas de acesso ao painel)
+CREATE TABLE owners (
+  id                 UUID        PRIMARY KEY DEFAULT gen_random_uuid(),
+  name               VARCHAR(255) NOT NULL,
+  email              VARCHAR(255) NOT NULL UNIQUE,
+  password_hash      VARCHAR(255) NOT NULL,
+  failed_logins      INTEGER     NOT NULL DEFAULT 0,
+  locked_until       TIMESTAMP,
+  tokens_valid_after TIMESTAMP   NOT NULL DEFAULT date_trunc('second', now()),
+  totp_secret        VARCHAR(64),
+  totp_enabled       BOOLEAN     NOT NULL DEFAULT FALSE,
+  totp_last_step     BIGINT      NOT NULL DEFAULT 0,
+  platform_admin     BOOLEAN     NOT NULL DEFAULT FALSE,
+  created_at         TIMESTAMP   NOT NULL DEFAULT now(),
+  updated_at         TIMESTAMP   NOT NULL DEFAULT now()
+);
+
+-- 18. TOKENS DE REDEFINIÇÃO DE SENHA
+CREATE TABLE password_reset_tokens (
+  token_hash    VARCHAR(64) PRIMARY KEY,
+  owner_id      UUID        NOT NULL
+    REFERENCES owners(id)
+    ON DELETE CASCADE,
+  expires_at    TIMESTAMP   NOT NULL,
+  used_at       TIMESTAMP,
+  created_at    TIMESTAMP   NOT NULL DEFAULT now()
+);
+
+-- 19. SOLICITAÇÕES DE TROCA DE E-MAIL
+CREATE TABLE email_change_requests (
+  token_hash    VARCHAR(64) PRIMARY KEY,
+  owner_id      UUID        NOT NULL
+    REFERENCES owners(id)
+    ON DELETE CASCADE,
+  new_email     VARCHAR(255) NOT NULL,
+  expires_at    TIMESTAMP   NOT NULL,
+  confirmed_at  TIMESTAMP,
+  created_at    TIMESTAMP   NOT NULL DEFAULT now()
+);
+
+-- 20. TOKENS REVOGADOS (logout antes da expiração)
+CREATE TABLE revoked_tokens (
+  jti           VARCHAR(64) PRIMARY KEY,
+  subject_id    UUID        NOT NULL,
+  expires_at    TIMESTAMP   NOT NULL,
+  revoked_at    TIMESTAMP   NOT NULL DEFAULT now()
+);
+
+-- 21. IDENTIDADES DE PROVEDORES OAUTH (Google, Apple...)
+CREATE TABLE auth_identities (
+  id            UUID        PRIMARY KEY DEFAULT gen_random_uuid(),
+  provider      VARCHAR(20) NOT NULL,
+  subject       VARCHAR(255) NOT NULL,
+  email         VARCHAR(255),
+  owner_id      UUID
+    REFERENCES owners(id)
+    ON DELETE CASCADE,
+  customer_id   UUID
+    REFERENCES customers(id)
+    ON DELETE CASCADE,
+  created_at    TIMESTAMP   NOT NULL DEFAULT now(),
+  CHECK ((owner_id IS NULL) <> (customer_id IS NULL))
+);
+
+-- 22. EQUIPE DO ESTABELECIMENTO (papéis por estabelecimento)
+CREATE TABLE establishment_staff (
+  establishment_id UUID        NOT NULL
+    REFERENCES establishments(id)
+    ON DELETE CASCADE,
+  owner_id         UUID        NOT NULL
+    REFERENCES owners(id)
+    ON DELETE CASCADE,
+  role             VARCHAR(20) NOT NULL
+    CHECK (role IN ('staff','manager','owner')),
+  created_at       TIMESTAMP   NOT NULL DEFAULT now(),
+  PRIMARY KEY (establishment_id, owner_id)
+);
+
+-- 23. CÓDIGOS DE BACKUP DO 2FA
+CREATE TABLE owner_backup_codes (
+  owner_id      UUID        NOT NULL
+    REFERENCES owners(id)
+    ON DELETE CASCADE,
+  code_hash     VARCHAR(64) NOT NULL,
+  used_at       TIMESTAMP,
+  created_at    TIMESTAMP   NOT NULL DEFAULT now(),
+  PRIMARY KEY (owner_id, code_hash)
+);
+
+-- 24. BLOQUEIOS DE CLIENTES POR ESTABELECIMENTO
+CREATE TABLE customer_blocks (
+  id               UUID        PRIMARY KEY DEFAULT gen_random_uuid(),
+  establishment_id UUID        NOT NULL
+    REFERENCES establishments(id)
+    ON DELETE CASCADE,
+  kind             VARCHAR(20) NOT NULL
+    CHECK (kind IN ('customer','phone','device')),
+  value            VARCHAR(255) NOT NULL,
+  reason           TEXT,
+  created_at       TIMESTAMP   NOT NULL DEFAULT now(),
+  UNIQUE (establishment_id, kind, value)
+);
+
+-- 25. SINALIZAÇÕES AUTOMÁTICAS DE FRAUDE
+CREATE TABLE customer_flags (
+  id               UUID        PRIMARY KEY DEFAULT gen_random_uuid(),
+  establishment_id UUID        NOT NULL
+    REFERENCES establishments(id)
+    ON DELETE CASCADE,
+  customer_id      UUID        NOT NULL
+    REFERENCES customers(id)
+    ON DELETE CASCADE,
+  reason           VARCHAR(50) NOT NULL
+    CHECK (reason IN ('repeated_cancellations','payment_failures')),
+  occurrences      INTEGER     NOT NULL,
+  created_at       TIMESTAMP   NOT NULL DEFAULT now(),
+  cleared_at       TIMESTAMP
+);
+
+-- 26. DISPUTAS E CHARGEBACKS
+CREATE TABLE disputes (
+  id                  UUID        PRIMARY KEY DEFAULT gen_random_uuid(),
+  order_id            UUID        NOT NULL
+    REFERENCES orders(id)
+    ON DELETE CASCADE,
+  provider            VARCHAR(30) NOT NULL,
+  provider_dispute_id VARCHAR(255) NOT NULL,
+  status              VARCHAR(20) NOT NULL
+    CHECK (status IN ('open','under_review','won','lost')),
+  reason              VARCHAR(100),
+  amount_cents        BIGINT      NOT NULL,
+  evidence_due_by     TIMESTAMP,
+  created_at          TIMESTAMP   NOT NULL DEFAULT now(),
+  updated_at          TIMESTAMP   NOT NULL DEFAULT now(),
+  UNIQUE (provider, provider_dispute_id)
+);
+
+-- 27. EVIDÊNCIAS ENVIADAS AO PROVEDOR
+CREATE TABLE dispute_evidence (
+  id            UUID        PRIMARY KEY DEFAULT gen_random_uuid(),
+  dispute_id    UUID        NOT NULL
+    REFERENCES disputes(id)
+    ON DELETE CASCADE,
+  filename      VARCHAR(255) NOT NULL,
+  size_bytes    INTEGER     NOT NULL,
+  submitted_by  UUID
+    REFERENCES owners(id)
+    ON DELETE SET NULL,
+  submitted_at  TIMESTAMP   NOT NULL DEFAULT now()
+);
+
+-- 28. ARQUIVOS ENVIADOS (imagens de produtos, categorias, estabelecimentos)
+CREATE TABLE uploads (
+  key           VARCHAR(512) PRIMARY KEY,
+  purpose       VARCHAR(50) NOT NULL,
+  content_type  VARCHAR(100) NOT NULL,
+  size_bytes    INTEGER     NOT NULL,
+  owner_id      UUID
+    REFERENCES owners(id)
+    ON DELETE SET NULL,
+  customer_id   UUID
+    REFERENCES customers(id)
+    ON DELETE SET NULL,
+  thumbnail_key VARCHAR(512),
+  -- pending: arquivo ainda em scan_pending/; infected/failed: movido para quarantine/
+  scan_status   VARCHAR(10) NOT NULL DEFAULT 'clean'
+    CHECK (scan_status IN ('pending','clean','infected','failed')),
+  scan_signature VARCHAR(200),
+  scan_attempts INTEGER     NOT NULL DEFAULT 0,
+  scan_next_at  TIMESTAMP   NOT NULL DEFAULT now(),
+  scanned_at    TIMESTAMP,
+  created_at    TIMESTAMP   NOT NULL DEFAULT now()
+);
+
+-- 29. ENDEREÇOS DE ENTREGA DOS CLIENTES
+CREATE TABLE customer_addresses (
+  id            UUID        PRIMARY KEY DEFAULT gen_random_uuid(),
+  customer_id   UUID        NOT NULL
+    REFERENCES customers(id)
+    ON DELETE CASCADE,
+  label         VARCHAR(50) NOT NULL DEFAULT '',
+  cep           VARCHAR(8)  NOT NULL,
+  street        VARCHAR(255) NOT NULL,
+  number        VARCHAR(20) NOT NULL DEFAULT '',
+  complement    VARCHAR(100) NOT NULL DEFAULT '',
+  neighborhood  VARCHAR(100) NOT NULL DEFAULT '',
+  city          VARCHAR(100) NOT NULL,
+  state         CHAR(2)     NOT NULL,
+  lat           DOUBLE PRECISION,
+  lng           DOUBLE PRECISION,
+  created_at    TIMESTAMP   NOT NULL DEFAULT now()
+);
+
+-- 30. FORMAS DE PAGAMENTO ACEITAS POR ESTABELECIMENTO
+CREATE TABLE establishment_payment_methods (
+  establishment_id UUID        NOT NULL
+    REFERENCES establishments(id)
+    ON DELETE CASCADE,
+  method           VARCHAR(30) NOT NULL
+    CHECK (method IN ('pix','credit_on_delivery','debit_on_delivery','cash','online_card')),
+  enabled          BOOLEAN     NOT NULL DEFAULT TRUE,
+  card_brands      TEXT[]      NOT NULL DEFAULT '{}',
+  max_change_cents BIGINT,
+  PRIMARY KEY (establishment_id, method)
+);
+
+-- 31. REGRAS DE JANELAS DE ENTREGA
+CREATE TABLE delivery_slot_rules (
+  establishment_id UUID        PRIMARY KEY
+    REFERENCES establishments(id)
+    ON DELETE CASCADE,
+  interval_minutes INTEGER     NOT NULL CHECK (interval_minutes > 0),
+  capacity         INTEGER     NOT NULL CHECK (capacity > 0),
+  opens_at         TIME        NOT NULL,
+  closes_at        TIME        NOT NULL,
+  updated_at       TIMESTAMP   NOT NULL DEFAULT now()
+);
+
+-- 32. JANELAS DE ENTREGA (geradas a partir das regras)
+CREATE TABLE delivery_slots (
+  id               UUID        PRIMARY KEY DEFAULT gen_random_uuid(),
+  establishment_id UUID        NOT NULL
+    REFERENCES establishments(id)
+    ON DELETE CASCADE,
+  starts_at        TIMESTAMP   NOT NULL,
+  ends_at          TIMESTAMP   NOT NULL,
+  capacity         INTEGER     NOT NULL CHECK (capacity >= 0),
+  booked           INTEGER     NOT NULL DEFAULT 0,
+  closed           BOOLEAN     NOT NULL DEFAULT FALSE,
+  UNIQUE (establishment_id, starts_at)
+);
+
+ALTER TABLE orders ADD CONSTRAINT fk_orders_slot
+  FOREIGN KEY (slot_id) REFERENCES delivery_slots(id) ON DELETE SET NULL;
+
+-- 33. ENTREGADORES
+CREATE TABLE couriers (
+  id               UUID        PRIMARY KEY DEFAULT gen_random_uuid(),
+  establishment_id UUID        NOT NULL
+    REFERENCES establishments(id)
+    ON DELETE CASCADE,
+  name             VARCHAR(255) NOT NULL,
+  phone            VARCHAR(20) NOT NULL DEFAULT '',
+  fee_type         VARCHAR(10) NOT NULL
+    CHECK (fee_type IN ('fixed','per_km','per_zone')),
+  fee_cents        BIGINT      NOT NULL DEFAULT 0,
+  per_km_cents     BIGINT      NOT NULL DEFAULT 0,
+  zone_fees        JSONB       NOT NULL DEFAULT '{}',
+  shift_hourly_cents BIGINT    NOT NULL DEFAULT 0,
+  active           BOOLEAN     NOT NULL DEFAULT TRUE,
+  availability     VARCHAR(10) NOT NULL DEFAULT 'offline'
+    CHECK (availability IN ('offline','available','on_break')),
+  pairing_code_hash  VARCHAR(64) UNIQUE,
+  pairing_expires_at TIMESTAMP,
+  created_at       TIMESTAMP   NOT NULL DEFAULT now()
+);
+
+-- 34. ENTREGAS REALIZADAS (base para o repasse aos entregadores)
+CREATE TABLE deliveries (
+  id               UUID        PRIMARY KEY DEFAULT gen_random_uuid(),
+  order_id         UUID        UNIQUE
+    REFERENCES orders(id)
+    ON DELETE SET NULL,
+  courier_id       UUID        NOT NULL
+    REFERENCES couriers(id)
+    ON DELETE RESTRICT,
+  distance_meters  INTEGER     NOT NULL DEFAULT 0,
+  zone             VARCHAR(50) NOT NULL DEFAULT '',
+  fee_cents        BIGINT      NOT NULL,
+  proof_type       VARCHAR(10)
+    CHECK (proof_type IN ('photo','signature','pin')),
+  proof_key        VARCHAR(512),
+  proof_pin_verified BOOLEAN   NOT NULL DEFAULT FALSE,
+  delivered_at     TIMESTAMP   NOT NULL DEFAULT now()
+);
+
+-- 35. ORGANIZAÇÕES (redes e franquias com vários estabelecimentos)
+CREATE TABLE organizations (
+  id            UUID        PRIMARY KEY DEFAULT gen_random_uuid(),
+  name          VARCHAR(255) NOT NULL,
+  created_at    TIMESTAMP   NOT NULL DEFAULT now()
+);
+
+ALTER TABLE establishments ADD CONSTRAINT fk_establishments_organization
+  FOREIGN KEY (organization_id) REFERENCES organizations(id) ON DELETE SET NULL;
+
+-- 36. MEMBROS DA ORGANIZAÇÃO
+CREATE TABLE organization_members (
+  organization_id UUID        NOT NULL
+    REFERENCES organizations(id)
+    ON DELETE CASCADE,
+  owner_id        UUID        NOT NULL
+    REFERENCES owners(id)
+    ON DELETE CASCADE,
+  role            VARCHAR(10) NOT NULL
+    CHECK (role IN ('member','admin')),
+  PRIMARY KEY (organization_id, owner_id)
+);
+
+-- 37. CATÁLOGO MESTRE DA ORGANIZAÇÃO
+CREATE TABLE catalog_products (
+  id              UUID        PRIMARY KEY DEFAULT gen_random_uuid(),
+  organization_id UUID        NOT NULL
+    REFERENCES organizations(id)
+    ON DELETE CASCADE,
+  name            VARCHAR(255) NOT NULL,
+  description     TEXT        NOT NULL DEFAULT '',
+  price_cents     INTEGER     NOT NULL,
+  image_key       VARCHAR(512) NOT NULL DEFAULT '',
+  created_at      TIMESTAMP   NOT NULL DEFAULT now(),
+  updated_at      TIMESTAMP   NOT NULL DEFAULT now()
+);
+
+ALTER TABLE products ADD CONSTRAINT fk_products_catalog
+  FOREIGN KEY (catalog_product_id) REFERENCES catalog_products(id) ON DELETE SET NULL;
+
+-- 38. AJUSTES DO CATÁLOGO POR UNIDADE
+CREATE TABLE catalog_overrides (
+  catalog_product_id UUID     NOT NULL
+    REFERENCES catalog_products(id)
+    ON DELETE CASCADE,
+  establishment_id   UUID     NOT NULL
+    REFERENCES establishments(id)
+    ON DELETE CASCADE,
+  price_cents        INTEGER,
+  is_active          BOOLEAN,
+  PRIMARY KEY (catalog_product_id, establishment_id)
+);
+
+-- 39. AGREGADOS DIÁRIOS DE PEDIDOS (preservados após o arquivamento)
+CREATE TABLE order_daily_aggregates (
+  establishment_id UUID        NOT NULL
+    REFERENCES establishments(id)
+    ON DELETE CASCADE,
+  day              DATE        NOT NULL,
+  orders           INTEGER     NOT NULL DEFAULT 0,
+  completed_orders INTEGER     NOT NULL DEFAULT 0,
+  revenue_cents    BIGINT      NOT NULL DEFAULT 0,
+  PRIMARY KEY (establishment_id, day)
+);
+
+-- 40. ARQUIVO DE PEDIDOS ANTIGOS (mesma estrutura, sem chaves estrangeiras)
+CREATE TABLE orders_archive (LIKE orders INCLUDING DEFAULTS);
+ALTER TABLE orders_archive ADD COLUMN archived_at TIMESTAMP NOT NULL DEFAULT now();
+CREATE TABLE order_items_archive (LIKE order_items INCLUDING DEFAULTS);
+CREATE TABLE order_events_archive (LIKE order_events INCLUDING DEFAULTS);
+CREATE TABLE order_amendments_archive (LIKE order_amendments INCLUDING DEFAULTS);
+CREATE TABLE payment_adjustments_archive (LIKE payment_adjustments INCLUDING DEFAULTS);
+
+-- 41. LOG DE AUDITORIA (alterações administrativas)
+CREATE TABLE audit_log (
+  id               UUID        PRIMARY KEY DEFAULT gen_random_uuid(),
+  establishment_id UUID,
+  actor_id         UUID,
+  actor_type       VARCHAR(20) NOT NULL,
+  impersonator_id  UUID,
+  action           VARCHAR(64) NOT NULL,
+  entity_type      VARCHAR(32) NOT NULL,
+  entity_id        VARCHAR(64) NOT NULL,
+  details          JSONB,
+  created_at       TIMESTAMP   NOT NULL DEFAULT now()
+);
+
+-- 42. OUTBOX TRANSACIONAL (eventos publicados após o commit pelo relay)
+CREATE TABLE outbox (
+  id              BIGSERIAL   PRIMARY KEY,
+  topic           VARCHAR(64) NOT NULL,
+  payload         JSONB       NOT NULL,
+  attempts        INTEGER     NOT NULL DEFAULT 0,
+  last_error      TEXT,
+  next_attempt_at TIMESTAMP   NOT NULL DEFAULT now(),
+  delivered_at    TIMESTAMP,
+  delivered_to    TEXT[]      NOT NULL DEFAULT '{}',
+  claimed_until   TIMESTAMP,
+  created_at      TIMESTAMP   NOT NULL DEFAULT now()
+);
+
+-- 43. HISTÓRICO DE PREÇOS DOS PRODUTOS
+CREATE TABLE product_price_history (
+  id          BIGSERIAL   PRIMARY KEY,
+  product_id  UUID        NOT NULL
+    REFERENCES products(id)
+    ON DELETE CASCADE,
+  price_cents INTEGER     NOT NULL,
+  changed_by  UUID,
+  changed_at  TIMESTAMP   NOT NULL DEFAULT now()
+);
+
+-- 44. TAXA DE ENTREGA POR ESTABELECIMENTO (por bairro ou fórmula por distância)
+CREATE TABLE establishment_delivery_fees (
+  establishment_id    UUID        PRIMARY KEY
+    REFERENCES establishments(id)
+    ON DELETE CASCADE,
+  mode                VARCHAR(10) NOT NULL
+    CHECK (mode IN ('zone','formula')),
+  zone_fees           JSONB       NOT NULL DEFAULT '{}',
+  base_cents          BIGINT      NOT NULL DEFAULT 0,
+  per_km_cents        BIGINT      NOT NULL DEFAULT 0,
+  free_above_cents    BIGINT,
+  max_distance_meters INTEGER,
+  updated_at          TIMESTAMP   NOT NULL DEFAULT now()
+);
+
+-- 45. EXCLUSÕES PARA SINCRONIZAÇÃO DE PDV
+CREATE TABLE sync_tombstones (
+  entity_type      VARCHAR(20) NOT NULL
+    CHECK (entity_type IN ('product','category')),
+  entity_id        UUID        NOT NULL,
+  establishment_id UUID        NOT NULL
+    REFERENCES establishments(id)
+    ON DELETE CASCADE,
+  deleted_at       TIMESTAMP   NOT NULL DEFAULT now(),
+  PRIMARY KEY (entity_type, entity_id)
+);
+
+-- 46. SEQUÊNCIA DIÁRIA DE NÚMEROS DE PEDIDO (por estabelecimento, no dia local)
+CREATE TABLE order_number_sequences (
+  establishment_id UUID    NOT NULL
+    REFERENCES establishments(id)
+    ON DELETE CASCADE,
+  business_date    DATE    NOT NULL,
+  last_number      INTEGER NOT NULL,
+  PRIMARY KEY (establishment_id, business_date)
+);
+
+-- 47. IMPRESSORAS POR ESTAÇÃO (cozinha, bar, ...)
+CREATE TABLE printers (
+  id               UUID         PRIMARY KEY DEFAULT gen_random_uuid(),
+  establishment_id UUID         NOT NULL
+    REFERENCES establishments(id)
+    ON DELETE CASCADE,
+  name             VARCHAR(100) NOT NULL,
+  station          VARCHAR(50)  NOT NULL DEFAULT '',
+  is_default       BOOLEAN      NOT NULL DEFAULT false,
+  created_at       TIMESTAMP    NOT NULL DEFAULT now()
+);
+
+-- 48. REGRAS DE IMPRESSÃO (categoria → impressora)
+CREATE TABLE print_rules (
+  category_id      UUID PRIMARY KEY
+    REFERENCES product_categories(id)
+    ON DELETE CASCADE,
+  establishment_id UUID NOT NULL
+    REFERENCES establishments(id)
+    ON DELETE CASCADE,
+  printer_id       UUID NOT NULL
+    REFERENCES printers(id)
+    ON DELETE CASCADE
+);
+
+-- 49. FILA DE IMPRESSÃO (um ticket por pedido e impressora, consumido pelo agente)
+CREATE TABLE print_jobs (
+  id               UUID        PRIMARY KEY DEFAULT gen_random_uuid(),
+  establishment_id UUID        NOT NULL
+    REFERENCES establishments(id)
+    ON DELETE CASCADE,
+  printer_id       UUID        NOT NULL
+    REFERENCES printers(id)
+    ON DELETE CASCADE,
+  order_id         UUID        NOT NULL,
+  ticket           JSONB       NOT NULL,
+  status           VARCHAR(20) NOT NULL DEFAULT 'pending'
+    CHECK (status IN ('pending','printed','failed')),
+  error            TEXT        NOT NULL DEFAULT '',
+  created_at       TIMESTAMP   NOT NULL DEFAULT now(),
+  queued_at        TIMESTAMP   NOT NULL DEFAULT now(),
+  printed_at       TIMESTAMP,
+  UNIQUE (order_id, printer_id)
+);
+
+-- 50. AVALIAÇÕES DE PEDIDOS (uma por pedido; source indica a origem)
+CREATE TABLE reviews (
+  id               UUID        PRIMARY KEY DEFAULT gen_random_uuid(),
+  establishment_id UUID        NOT NULL
+    REFERENCES establishments(id)
+    ON DELETE CASCADE,
+  order_id         UUID        NOT NULL UNIQUE,
+  customer_id      UUID        NOT NULL
+    REFERENCES customers(id)
+    ON DELETE CASCADE,
+  rating           SMALLINT    NOT NULL
+    CHECK (rating BETWEEN 1 AND 5),
+  comment          TEXT        NOT NULL DEFAULT '',
+  source           VARCHAR(20) NOT NULL DEFAULT 'app'
+    CHECK (source IN ('app','review_request')),
+  created_at       TIMESTAMP   NOT NULL DEFAULT now()
+);
+
+-- 51. SEGMENTOS DE CLIENTES (critérios avaliados sobre os pedidos do estabelecimento)
+CREATE TABLE customer_segments (
+  id               UUID         PRIMARY KEY DEFAULT gen_random_uuid(),
+  establishment_id UUID         NOT NULL
+    REFERENCES establishments(id)
+    ON DELETE CASCADE,
+  name             VARCHAR(100) NOT NULL,
+  kind             VARCHAR(20)  NOT NULL
+    CHECK (kind IN ('frequent','inactive','big_spender')),
+  min_orders       INTEGER      NOT NULL DEFAULT 1,
+  min_spent_cents  BIGINT       NOT NULL DEFAULT 0,
+  inactive_days    INTEGER      NOT NULL DEFAULT 0,
+  lookback_days    INTEGER      NOT NULL DEFAULT 0,
+  created_at       TIMESTAMP    NOT NULL DEFAULT now()
+);
+
+-- 52. CAMPANHAS (notificação com cupom para um segmento)
+CREATE TABLE campaigns (
+  id                UUID         PRIMARY KEY DEFAULT gen_random_uuid(),
+  establishment_id  UUID         NOT NULL
+    REFERENCES establishments(id)
+    ON DELETE CASCADE,
+  segment_id        UUID         NOT NULL
+    REFERENCES customer_segments(id)
+    ON DELETE RESTRICT,
+  name              VARCHAR(100) NOT NULL,
+  message           TEXT         NOT NULL,
+  channel           VARCHAR(20)  NOT NULL DEFAULT 'push'
+    CHECK (channel IN ('push','whatsapp','email')),
+  discount_type     VARCHAR(10)
+    CHECK (discount_type IN ('percent','fixed')),
+  discount_value    INTEGER,
+  coupon_valid_days INTEGER      NOT NULL DEFAULT 7,
+  coupon_code       VARCHAR(50)
+    REFERENCES coupons(code)
+    ON DELETE SET NULL,
+  status            VARCHAR(20)  NOT NULL DEFAULT 'draft'
+    CHECK (status IN ('draft','scheduled','sent')),
+  send_at           TIMESTAMP,
+  sent_at           TIMESTAMP,
+  created_at        TIMESTAMP    NOT NULL DEFAULT now()
+);
+
+-- 53. DESTINATÁRIOS DE CAMPANHAS (envio e resgate do cupom)
+CREATE TABLE campaign_recipients (
+  campaign_id     UUID      NOT NULL
+    REFERENCES campaigns(id)
+    ON DELETE CASCADE,
+  customer_id     UUID      NOT NULL
+    REFERENCES customers(id)
+    ON DELETE CASCADE,
+  notification_id UUID
+    REFERENCES notifications(id)
+    ON DELETE SET NULL,
+  order_id        UUID,
+  redeemed_at     TIMESTAMP,
+  PRIMARY KEY (campaign_id, customer_id)
+);
+
+-- 54. CONSENTIMENTOS DE MARKETING (LGPD: estado atual por cliente e canal)
+CREATE TABLE customer_consents (
+  customer_id UUID        NOT NULL
+    REFERENCES customers(id)
+    ON DELETE CASCADE,
+  channel     VARCHAR(20) NOT NULL
+    CHECK (channel IN ('whatsapp','email','push')),
+  granted     BOOLEAN     NOT NULL,
+  source      VARCHAR(50) NOT NULL,
+  updated_at  TIMESTAMP   NOT NULL DEFAULT now(),
+  PRIMARY KEY (customer_id, channel)
+);
+
+-- 55. HISTÓRICO DE CONSENTIMENTOS (registro imutável de cada alteração)
+CREATE TABLE customer_consent_log (
+  id          BIGSERIAL   PRIMARY KEY,
+  customer_id UUID        NOT NULL
+    REFERENCES customers(id)
+    ON DELETE CASCADE,
+  channel     VARCHAR(20) NOT NULL,
+  granted     BOOLEAN     NOT NULL,
+  source      VARCHAR(50) NOT NULL,
+  ip          VARCHAR(45) NOT NULL DEFAULT '',
+  user_agent  TEXT        NOT NULL DEFAULT '',
+  created_at  TIMESTAMP   NOT NULL DEFAULT now()
+);
+
+-- 56. EVENTOS DE ANALYTICS (visualizações de cardápio/produto e adições ao
+-- carrinho). Tabela só de inserção: sem chaves estrangeiras nem atualizações,
+-- para que a gravação em lote seja barata; os ids são validados na entrada.
+CREATE TABLE analytics_events (
+  id               BIGSERIAL   PRIMARY KEY,
+  establishment_id UUID        NOT NULL,
+  product_id       UUID,
+  kind             VARCHAR(20) NOT NULL
+    CHECK (kind IN ('menu_view','product_view','add_to_cart','experiment_exposure')),
+  session_hash     VARCHAR(64) NOT NULL DEFAULT '',
+  occurred_at      TIMESTAMP   NOT NULL DEFAULT now(),
+  experiment_id    UUID,
+  variant          VARCHAR(20)
+);
+
+-- 57. PAGAMENTOS ONLINE (cobranças feitas pelo gateway do estabelecimento)
+CREATE TABLE payments (
+  id                 UUID        PRIMARY KEY DEFAULT gen_random_uuid(),
+  -- Cada pagamento é de um pedido ou da compra de um vale-presente.
+  order_id           UUID
+    REFERENCES orders(id)
+    ON DELETE CASCADE,
+  gift_card_id       UUID,
+  gateway            VARCHAR(20) NOT NULL,
+  provider_charge_id VARCHAR(100),
+  method             VARCHAR(20) NOT NULL,
+  amount_cents       BIGINT      NOT NULL CHECK (amount_cents > 0),
+  status             VARCHAR(20) NOT NULL DEFAULT 'pending'
+    CHECK (status IN ('pending','paid','failed','refunded')),
+  created_at         TIMESTAMP   NOT NULL DEFAULT now(),
+  updated_at         TIMESTAMP   NOT NULL DEFAULT now(),
+  UNIQUE (gateway, provider_charge_id),
+  CHECK ((order_id IS NULL) <> (gift_card_id IS NULL))
+);
+CREATE TABLE payments_archive (LIKE payments INCLUDING DEFAULTS);
+
+-- 58. SALDOS DE CRÉDITO NA LOJA (por cliente e estabelecimento)
+CREATE TABLE store_credit_balances (
+  customer_id      UUID        NOT NULL
+    REFERENCES customers(id)
+    ON DELETE CASCADE,
+  establishment_id UUID        NOT NULL
+    REFERENCES establishments(id)
+    ON DELETE CASCADE,
+  balance_cents    BIGINT      NOT NULL DEFAULT 0 CHECK (balance_cents >= 0),
+  updated_at       TIMESTAMP   NOT NULL DEFAULT now(),
+  PRIMARY KEY (customer_id, establishment_id)
+);
+
+-- 59. EXTRATO DE CRÉDITO NA LOJA (créditos positivos, débitos negativos)
+CREATE TABLE store_credit_ledger (
+  id               UUID        PRIMARY KEY DEFAULT gen_random_uuid(),
+  customer_id      UUID        NOT NULL
+    REFERENCES customers(id)
+    ON DELETE CASCADE,
+  establishment_id UUID        NOT NULL
+    REFERENCES establishments(id)
+    ON DELETE CASCADE,
+  amount_cents     BIGINT      NOT NULL CHECK (amount_cents <> 0),
+  reason           VARCHAR(20) NOT NULL
+    CHECK (reason IN ('refund','promotion','adjustment','order','cancellation')),
+  order_id         UUID,
+  note             TEXT        NOT NULL DEFAULT '',
+  created_at       TIMESTAMP   NOT NULL DEFAULT now()
+);
+
+-- 60. VALES-PRESENTE (emitidos pelo estabelecimento ou comprados por clientes)
+CREATE TABLE gift_cards (
+  id                    UUID        PRIMARY KEY DEFAULT gen_random_uuid(),
+  establishment_id      UUID        NOT NULL
+    REFERENCES establishments(id)
+    ON DELETE CASCADE,
+  code                  VARCHAR(19) NOT NULL UNIQUE,
+  initial_cents         BIGINT      NOT NULL CHECK (initial_cents > 0),
+  balance_cents         BIGINT      NOT NULL CHECK (balance_cents >= 0),
+  expires_on            DATE        NOT NULL,
+  status                VARCHAR(20) NOT NULL DEFAULT 'active'
+    CHECK (status IN ('pending_payment','active','disabled')),
+  recipient_name        VARCHAR(255) NOT NULL DEFAULT '',
+  recipient_email       VARCHAR(255) NOT NULL DEFAULT '',
+  message               TEXT        NOT NULL DEFAULT '',
+  purchaser_customer_id UUID
+    REFERENCES customers(id)
+    ON DELETE SET NULL,
+  created_at            TIMESTAMP   NOT NULL DEFAULT now(),
+  updated_at            TIMESTAMP   NOT NULL DEFAULT now()
+);
+
+-- 61. MOVIMENTAÇÕES DE VALES-PRESENTE (resgates negativos, estornos positivos)
+CREATE TABLE gift_card_transactions (
+  id            UUID        PRIMARY KEY DEFAULT gen_random_uuid(),
+  gift_card_id  UUID        NOT NULL
+    REFERENCES gift_cards(id)
+    ON DELETE CASCADE,
+  order_id      UUID,
+  amount_cents  BIGINT      NOT NULL CHECK (amount_cents <> 0),
+  created_at    TIMESTAMP   NOT NULL DEFAULT now()
+);
+
+-- 62. LOTES DE ENTREGA (várias entregas numa mesma saída do entregador)
+CREATE TABLE delivery_batches (
+  id               UUID        PRIMARY KEY DEFAULT gen_random_uuid(),
+  establishment_id UUID        NOT NULL
+    REFERENCES establishments(id)
+    ON DELETE CASCADE,
+  courier_id       UUID        NOT NULL
+    REFERENCES couriers(id)
+    ON DELETE CASCADE,
+  status           VARCHAR(20) NOT NULL DEFAULT 'planned'
+    CHECK (status IN ('planned','in_progress','completed','cancelled')),
+  created_at       TIMESTAMP   NOT NULL DEFAULT now(),
+  started_at       TIMESTAMP,
+  completed_at     TIMESTAMP
+);
+
+-- 63. PARADAS DO LOTE (ordem da rota e situação de cada entrega)
+CREATE TABLE delivery_batch_stops (
+  batch_id     UUID        NOT NULL
+    REFERENCES delivery_batches(id)
+    ON DELETE CASCADE,
+  order_id     UUID        NOT NULL
+    REFERENCES orders(id)
+    ON DELETE CASCADE,
+  sequence     INTEGER     NOT NULL CHECK (sequence > 0),
+  status       VARCHAR(20) NOT NULL DEFAULT 'pending'
+    CHECK (status IN ('pending','en_route','delivered','failed','cancelled')),
+  leg_meters   INTEGER     NOT NULL DEFAULT 0,
+  leg_seconds  INTEGER     NOT NULL DEFAULT 0,
+  delivered_at TIMESTAMP,
+  PRIMARY KEY (batch_id, order_id),
+  UNIQUE (batch_id, sequence)
+);
+
+-- 64. POSIÇÕES DOS ENTREGADORES (só durante um lote em andamento; expurgadas após a retenção)
+CREATE TABLE courier_locations (
+  id               BIGSERIAL   PRIMARY KEY,
+  establishment_id UUID        NOT NULL
+    REFERENCES establishments(id)
+    ON DELETE CASCADE,
+  courier_id       UUID        NOT NULL
+    REFERENCES couriers(id)
+    ON DELETE CASCADE,
+  batch_id         UUID        NOT NULL
+    REFERENCES delivery_batches(id)
+    ON DELETE CASCADE,
+  lat              DOUBLE PRECISION NOT NULL,
+  lng              DOUBLE PRECISION NOT NULL,
+  recorded_at      TIMESTAMP   NOT NULL DEFAULT now()
+);
+
+-- 65. CHAVES DE API (só o hash é guardado; chaves de sandbox usam o schema de testes)
+CREATE TABLE api_keys (
+  id           UUID        PRIMARY KEY DEFAULT gen_random_uuid(),
+  owner_id     UUID        NOT NULL
+    REFERENCES owners(id)
+    ON DELETE CASCADE,
+  name         VARCHAR(100) NOT NULL,
+  prefix       VARCHAR(16) NOT NULL,
+  key_hash     VARCHAR(64) NOT NULL UNIQUE,
+  sandbox      BOOLEAN     NOT NULL DEFAULT FALSE,
+  created_at   TIMESTAMP   NOT NULL DEFAULT now(),
+  last_used_at TIMESTAMP,
+  revoked_at   TIMESTAMP
+);
+
+-- 66. ENTREGAS DE WEBHOOK (cada tentativa, com status e tempo de resposta)
+CREATE TABLE webhook_deliveries (
+  id               UUID        PRIMARY KEY DEFAULT gen_random_uuid(),
+  establishment_id UUID
+    REFERENCES establishments(id)
+    ON DELETE CASCADE,
+  topic            VARCHAR(100) NOT NULL,
+  url              TEXT        NOT NULL,
+  payload          JSONB       NOT NULL,
+  status_code      INTEGER,
+  error            TEXT        NOT NULL DEFAULT '',
+  duration_ms      INTEGER     NOT NULL DEFAULT 0,
+  retry_of         UUID
+    REFERENCES webhook_deliveries(id)
+    ON DELETE SET NULL,
+  attempted_at     TIMESTAMP   NOT NULL DEFAULT now()
+);
+
+-- 67. SEGREDOS DE PROVEDORES POR ESTABELECIMENTO (criptografia envelope: chave de dados cifrada pela chave mestra)
+CREATE TABLE establishment_secrets (
+  establishment_id UUID        NOT NULL
+    REFERENCES establishments(id)
+    ON DELETE CASCADE,
+  name             VARCHAR(64) NOT NULL,
+  ciphertext       BYTEA       NOT NULL,
+  wrapped_key      BYTEA       NOT NULL,
+  key_id           VARCHAR(64) NOT NULL,
+  created_at       TIMESTAMP   NOT NULL DEFAULT now(),
+  updated_at       TIMESTAMP   NOT NULL DEFAULT now(),
+  PRIMARY KEY (establishment_id, name)
+);
+
+-- 68. SESSÕES DE SUPORTE (administrador da plataforma agindo como proprietário, com prazo)
+CREATE TABLE impersonations (
+  id          UUID        PRIMARY KEY DEFAULT gen_random_uuid(),
+  admin_id    UUID        NOT NULL
+    REFERENCES owners(id)
+    ON DELETE CASCADE,
+  owner_id    UUID        NOT NULL
+    REFERENCES owners(id)
+    ON DELETE CASCADE,
+  reason      TEXT        NOT NULL,
+  started_at  TIMESTAMP   NOT NULL DEFAULT now(),
+  expires_at  TIMESTAMP   NOT NULL,
+  ended_at    TIMESTAMP,
+  notified_at TIMESTAMP
+);
+
+-- 69. DOCUMENTOS LEGAIS (termos de uso e política de privacidade, versionados)
+CREATE TABLE legal_documents (
+  kind         VARCHAR(20) NOT NULL
+    CHECK (kind IN ('terms','privacy')),
+  version      INT         NOT NULL,
+  body         TEXT        NOT NULL,
+  published_at TIMESTAMP   NOT NULL DEFAULT now(),
+  created_at   TIMESTAMP   NOT NULL DEFAULT now(),
+  PRIMARY KEY (kind, version)
+);
+
+-- 70. ACEITES DE DOCUMENTOS LEGAIS (por proprietário ou cliente)
+CREATE TABLE legal_acceptances (
+  id          UUID        PRIMARY KEY DEFAULT gen_random_uuid(),
+  kind        VARCHAR(20) NOT NULL,
+  version     INT         NOT NULL,
+  owner_id    UUID
+    REFERENCES owners(id)
+    ON DELETE CASCADE,
+  customer_id UUID
+    REFERENCES customers(id)
+    ON DELETE CASCADE,
+  ip          VARCHAR(64),
+  accepted_at TIMESTAMP   NOT NULL DEFAULT now(),
+  FOREIGN KEY (kind, version) REFERENCES legal_documents(kind, version),
+  CHECK ((owner_id IS NULL) <> (customer_id IS NULL))
+);
+
+-- 71. FOTOS DAS AVALIAÇÕES (moderadas antes de ficarem públicas)
+CREATE TABLE review_photos (
+  id            UUID         PRIMARY KEY DEFAULT gen_random_uuid(),
+  review_id     UUID         NOT NULL
+    REFERENCES reviews(id)
+    ON DELETE CASCADE,
+  upload_key    VARCHAR(512) NOT NULL UNIQUE
+    REFERENCES uploads(key),
+  position      SMALLINT     NOT NULL,
+  status        VARCHAR(20)  NOT NULL DEFAULT 'pending'
+    CHECK (status IN ('pending','approved','rejected')),
+  reported_at   TIMESTAMP,
+  report_reason TEXT,
+  moderated_at  TIMESTAMP,
+  created_at    TIMESTAMP    NOT NULL DEFAULT now()
+);
+
+-- 72. RESUMO DAS AVALIAÇÕES (mantido a cada nova avaliação)
+CREATE TABLE review_summaries (
+  establishment_id UUID      PRIMARY KEY
+    REFERENCES establishments(id)
+    ON DELETE CASCADE,
+  review_count     INT       NOT NULL DEFAULT 0,
+  rating_sum       INT       NOT NULL DEFAULT 0,
+  stars            INT[]     NOT NULL DEFAULT '{0,0,0,0,0}',
+  updated_at       TIMESTAMP NOT NULL DEFAULT now()
+);
+
+-- 73. TERMOS MAIS CITADOS NAS AVALIAÇÕES
+CREATE TABLE review_terms (
+  establishment_id UUID        NOT NULL
+    REFERENCES establishments(id)
+    ON DELETE CASCADE,
+  term             VARCHAR(40) NOT NULL,
+  count            INT         NOT NULL,
+  PRIMARY KEY (establishment_id, term)
+);
+
+-- 74. MENSAGENS DO PEDIDO (conversa entre cliente e estabelecimento)
+CREATE TABLE order_messages (
+  id         UUID        PRIMARY KEY DEFAULT gen_random_uuid(),
+  order_id   UUID        NOT NULL
+    REFERENCES orders(id)
+    ON DELETE CASCADE,
+  sender     VARCHAR(20) NOT NULL
+    CHECK (sender IN ('customer','establishment')),
+  author_id  UUID        NOT NULL,
+  body       TEXT        NOT NULL,
+  read_at    TIMESTAMP,
+  created_at TIMESTAMP   NOT NULL DEFAULT now()
+);
+
+-- 75. RESPOSTAS PRONTAS (modelos de mensagem do estabelecimento, com variáveis)
+CREATE TABLE reply_templates (
+  id               UUID        PRIMARY KEY DEFAULT gen_random_uuid(),
+  establishment_id UUID        NOT NULL
+    REFERENCES establishments(id)
+    ON DELETE CASCADE,
+  name             VARCHAR(60) NOT NULL,
+  body             TEXT        NOT NULL,
+  created_at       TIMESTAMP   NOT NULL DEFAULT now(),
+  updated_at       TIMESTAMP   NOT NULL DEFAULT now(),
+  UNIQUE (establishment_id, name)
+);
+
+-- 76. VERIFICAÇÃO DE ESTABELECIMENTOS (CNPJ e documentos analisados pela plataforma)
+CREATE TABLE establishment_verifications (
+  id               UUID        PRIMARY KEY DEFAULT gen_random_uuid(),
+  establishment_id UUID        NOT NULL
+    REFERENCES establishments(id)
+    ON DELETE CASCADE,
+  cnpj             VARCHAR(14) NOT NULL,
+  document_keys    TEXT[]      NOT NULL,
+  status           VARCHAR(20) NOT NULL DEFAULT 'submitted'
+    CHECK (status IN ('submitted','approved','rejected')),
+  review_note      TEXT,
+  submitted_by     UUID        NOT NULL
+    REFERENCES owners(id)
+    ON DELETE CASCADE,
+  reviewed_by      UUID
+    REFERENCES owners(id)
+    ON DELETE SET NULL,
+  submitted_at     TIMESTAMP   NOT NULL DEFAULT now(),
+  reviewed_at      TIMESTAMP
+);
+
+-- 77. TIPOS DE COZINHA (taxonomia mantida pela plataforma)
+CREATE TABLE cuisines (
+  slug       VARCHAR(40)  PRIMARY KEY,
+  name       VARCHAR(100) NOT NULL,
+  created_at TIMESTAMP    NOT NULL DEFAULT now()
+);
+
+INSERT INTO cuisines (slug, name) VALUES
+  ('pizzaria', 'Pizzaria'),
+  ('japonesa', 'Japonesa'),
+  ('lanches', 'Lanches'),
+  ('brasileira', 'Brasileira'),
+  ('italiana', 'Italiana'),
+  ('arabe', 'Árabe'),
+  ('chinesa', 'Chinesa'),
+  ('mexicana', 'Mexicana'),
+  ('vegetariana', 'Vegetariana'),
+  ('saudavel', 'Saudável'),
+  ('doces-e-bolos', 'Doces e bolos'),
+  ('acai', 'Açaí'),
+  ('churrasco', 'Churrasco'),
+  ('frutos-do-mar', 'Frutos do mar'),
+  ('padaria', 'Padaria');
+
+-- 78. COZINHAS DE CADA ESTABELECIMENTO
+CREATE TABLE establishment_cuisines (
+  establishment_id UUID        NOT NULL
+    REFERENCES establishments(id)
+    ON DELETE CASCADE,
+  cuisine          VARCHAR(40) NOT NULL
+    REFERENCES cuisines(slug),
+  PRIMARY KEY (establishment_id, cuisine)
+);
+
+-- 79. LINKS CURTOS DE MARKETING
+CREATE TABLE short_links (
+  id               UUID        PRIMARY KEY DEFAULT gen_random_uuid(),
+  code             VARCHAR(16) NOT NULL UNIQUE,
+  establishment_id UUID        NOT NULL
+    REFERENCES establishments(id)
+    ON DELETE CASCADE,
+  target_type      VARCHAR(10) NOT NULL
+    CHECK (target_type IN ('menu','product','coupon')),
+  target_id        VARCHAR(100),
+  utm              JSONB       NOT NULL DEFAULT '{}',
+  clicks           INTEGER     NOT NULL DEFAULT 0,
+  last_clicked_at  TIMESTAMP,
+  created_by       UUID,
+  created_at       TIMESTAMP   NOT NULL DEFAULT now()
+);
+
+-- 80. CLIQUES DIÁRIOS DOS LINKS CURTOS
+CREATE TABLE short_link_clicks (
+  link_id UUID    NOT NULL
+    REFERENCES short_links(id)
+    ON DELETE CASCADE,
+  day     DATE    NOT NULL,
+  clicks  INTEGER NOT NULL DEFAULT 0,
+  PRIMARY KEY (link_id, day)
+);
+
+-- 81. LISTA DE BLOQUEIO DE RISCO (plataforma; só aumenta a pontuação do pedido)
+CREATE TABLE risk_blocklist (
+  id         UUID         PRIMARY KEY DEFAULT gen_random_uuid(),
+  kind       VARCHAR(20)  NOT NULL
+    CHECK (kind IN ('ip','device','phone','email_domain')),
+  value      VARCHAR(255) NOT NULL,
+  reason     TEXT,
+  created_by UUID,
+  created_at TIMESTAMP    NOT NULL DEFAULT now(),
+  UNIQUE (kind, value)
+);
+
+-- 82. EXPORTAÇÕES DE RELATÓRIOS (fila processada em segundo plano)
+CREATE TABLE report_exports (
+  id               UUID        PRIMARY KEY DEFAULT gen_random_uuid(),
+  establishment_id UUID        NOT NULL
+    REFERENCES establishments(id)
+    ON DELETE CASCADE,
+  requested_by     UUID        NOT NULL,
+  report           VARCHAR(20) NOT NULL
+    CHECK (report IN ('orders','revenue')),
+  format           VARCHAR(10) NOT NULL
+    CHECK (format IN ('csv','xlsx')),
+  from_day         DATE        NOT NULL,
+  to_day           DATE        NOT NULL,
+  status           VARCHAR(20) NOT NULL DEFAULT 'queued'
+    CHECK (status IN ('queued','running','done','failed')),
+  attempts         INTEGER     NOT NULL DEFAULT 0,
+  storage_key      TEXT,
+  error            TEXT,
+  created_at       TIMESTAMP   NOT NULL DEFAULT now(),
+  started_at       TIMESTAMP,
+  finished_at      TIMESTAMP,
+  expires_at       TIMESTAMP
+);
+
+-- 83. CAMPOS PERSONALIZADOS DOS PRODUTOS (definidos por estabelecimento; valores em products.custom_fields)
+CREATE TABLE custom_fields (
+  id               UUID        PRIMARY KEY DEFAULT gen_random_uuid(),
+  establishment_id UUID        NOT NULL
+    REFERENCES establishments(id)
+    ON DELETE CASCADE,
+  key              VARCHAR(40) NOT NULL,
+  name             VARCHAR(60) NOT NULL,
+  type             VARCHAR(20) NOT NULL
+    CHECK (type IN ('text','number','boolean','select','multiselect')),
+  options          TEXT[]      NOT NULL DEFAULT '{}',
+  required         BOOLEAN     NOT NULL DEFAULT FALSE,
+  position         INTEGER     NOT NULL DEFAULT 0,
+  created_at       TIMESTAMP   NOT NULL DEFAULT now(),
+  UNIQUE (establishment_id, key)
+);
+
+-- 84. SELOS DOS PRODUTOS ("Novo", "Mais pedido"; com regra, atribuídos automaticamente)
+CREATE TABLE badges (
+  id               UUID        PRIMARY KEY DEFAULT gen_random_uuid(),
+  establishment_id UUID        NOT NULL
+    REFERENCES establishments(id)
+    ON DELETE CASCADE,
+  label            VARCHAR(40) NOT NULL,
+  color            CHAR(7)     NOT NULL,
+  text_color       CHAR(7)     NOT NULL DEFAULT '#ffffff',
+  rule             VARCHAR(20)
+    CHECK (rule IN ('top_sellers','new_products')),
+  rule_days        INTEGER     NOT NULL DEFAULT 0,
+  rule_limit       INTEGER     NOT NULL DEFAULT 0,
+  expires_at       TIMESTAMP,
+  created_at       TIMESTAMP   NOT NULL DEFAULT now()
+);
+
+-- 85. SELOS ATRIBUÍDOS AOS PRODUTOS
+CREATE TABLE product_badges (
+  product_id UUID      NOT NULL
+    REFERENCES products(id)
+    ON DELETE CASCADE,
+  badge_id   UUID      NOT NULL
+    REFERENCES badges(id)
+    ON DELETE CASCADE,
+  automatic  BOOLEAN   NOT NULL DEFAULT FALSE,
+  expires_at TIMESTAMP,
+  PRIMARY KEY (product_id, badge_id)
+);
+
+-- 86. EXPERIMENTOS A/B DO CARDÁPIO (variantes de foto ou descrição de um produto)
+CREATE TABLE experiments (
+  id               UUID         PRIMARY KEY DEFAULT gen_random_uuid(),
+  establishment_id UUID         NOT NULL
+    REFERENCES establishments(id)
+    ON DELETE CASCADE,
+  product_id       UUID         NOT NULL
+    REFERENCES products(id)
+    ON DELETE CASCADE,
+  name             VARCHAR(100) NOT NULL,
+  variants         JSONB        NOT NULL,
+  status           VARCHAR(20)  NOT NULL DEFAULT 'draft'
+    CHECK (status IN ('draft','running','stopped')),
+  started_at       TIMESTAMP,
+  stopped_at       TIMESTAMP,
+  created_at       TIMESTAMP    NOT NULL DEFAULT now()
+);
+
+-- 87. TRADUÇÕES DO CARDÁPIO (produtos e categorias; auto_generated = tradução automática ainda não revisada)
+CREATE TABLE translations (
+  establishment_id UUID         NOT NULL
+    REFERENCES establishments(id)
+    ON DELETE CASCADE,
+  entity_type      VARCHAR(20)  NOT NULL
+    CHECK (entity_type IN ('product','category')),
+  entity_id        UUID         NOT NULL,
+  lang             VARCHAR(10)  NOT NULL,
+  name             VARCHAR(255) NOT NULL,
+  description      TEXT         NOT NULL DEFAULT '',
+  auto_generated   BOOLEAN      NOT NULL DEFAULT FALSE,
+  provider         VARCHAR(20),
+  source_hash      VARCHAR(16)  NOT NULL DEFAULT '',
+  updated_at       TIMESTAMP    NOT NULL DEFAULT now(),
+  PRIMARY KEY (entity_type, entity_id, lang)
+);
+
+-- 88. CONFIGURAÇÕES DO ESTABELECIMENTO (valores que substituem o padrão de cada chave registrada em settings.go)
+CREATE TABLE establishment_settings (
+  establishment_id UUID        NOT NULL
+    REFERENCES establishments(id)
+    ON DELETE CASCADE,
+  key              VARCHAR(64) NOT NULL,
+  value            JSONB       NOT NULL,
+  updated_at       TIMESTAMP   NOT NULL DEFAULT now(),
+  PRIMARY KEY (establishment_id, key)
+);
+
+-- 89. SESSÕES DE PROPRIETÁRIOS (um registro por dispositivo conectado; revoked_at encerra a sessão)
+CREATE TABLE owner_sessions (
+  id            UUID         PRIMARY KEY DEFAULT gen_random_uuid(),
+  owner_id      UUID         NOT NULL
+    REFERENCES owners(id)
+    ON DELETE CASCADE,
+  user_agent    VARCHAR(255) NOT NULL DEFAULT '',
+  ip            VARCHAR(45)  NOT NULL DEFAULT '',
+  created_at    TIMESTAMP    NOT NULL DEFAULT now(),
+  last_seen_at  TIMESTAMP    NOT NULL DEFAULT now(),
+  expires_at    TIMESTAMP    NOT NULL,
+  revoked_at    TIMESTAMP
+);
+
+-- 90. REFRESH TOKENS (hash SHA-256; cada token é trocado uma vez, reuso revoga a sessão)
+CREATE TABLE refresh_tokens (
+  token_hash    VARCHAR(64) PRIMARY KEY,
+  session_id    UUID        NOT NULL
+    REFERENCES owner_sessions(id)
+    ON DELETE CASCADE,
+  expires_at    TIMESTAMP   NOT NULL,
+  used_at       TIMESTAMP,
+  created_at    TIMESTAMP   NOT NULL DEFAULT now()
+);
+
+-- 91. DISPOSITIVOS DO APP DO ENTREGADOR (um ativo por entregador; device_hash = SHA-256 do identificador do aparelho)
+CREATE TABLE courier_devices (
+  id            UUID         PRIMARY KEY DEFAULT gen_random_uuid(),
+  courier_id    UUID         NOT NULL
+    REFERENCES couriers(id)
+    ON DELETE CASCADE,
+  device_hash   VARCHAR(64)  NOT NULL,
+  name          VARCHAR(100) NOT NULL DEFAULT '',
+  registered_at TIMESTAMP    NOT NULL DEFAULT now(),
+  last_seen_at  TIMESTAMP    NOT NULL DEFAULT now(),
+  revoked_at    TIMESTAMP
+);
+
+-- 92. DECISÕES DE DESPACHO (ranking de entregadores com justificativa; override = equipe escolheu outro que não o sugerido)
+CREATE TABLE dispatch_decisions (
+  id                   UUID        PRIMARY KEY DEFAULT gen_random_uuid(),
+  order_id             UUID        NOT NULL
+    REFERENCES orders(id)
+    ON DELETE CASCADE,
+  establishment_id     UUID        NOT NULL
+    REFERENCES establishments(id)
+    ON DELETE CASCADE,
+  mode                 VARCHAR(10) NOT NULL
+    CHECK (mode IN ('suggested','auto','manual','override')),
+  suggested_courier_id UUID
+    REFERENCES couriers(id)
+    ON DELETE SET NULL,
+  courier_id           UUID
+    REFERENCES couriers(id)
+    ON DELETE SET NULL,
+  batch_id             UUID
+    REFERENCES delivery_batches(id)
+    ON DELETE SET NULL,
+  candidates           JSONB       NOT NULL DEFAULT '[]',
+  decided_by           UUID,
+  created_at           TIMESTAMP   NOT NULL DEFAULT now()
+);
+
+-- 93. TURNOS DE ENTREGADORES (no máximo um turno aberto por entregador; minutos em turno entram no repasse)
+CREATE TABLE courier_shifts (
+  id               UUID      PRIMARY KEY DEFAULT gen_random_uuid(),
+  courier_id       UUID      NOT NULL
+    REFERENCES couriers(id)
+    ON DELETE CASCADE,
+  establishment_id UUID      NOT NULL
+    REFERENCES establishments(id)
+    ON DELETE CASCADE,
+  started_at       TIMESTAMP NOT NULL DEFAULT now(),
+  ended_at         TIMESTAMP,
+  CHECK (ended_at IS NULL OR ended_at >= started_at)
+);
+
+-- 94. AVALIAÇÕES DE ENTREGA (pontualidade, estado da comida e cortesia do entregador; uma por pedido)
+CREATE TABLE delivery_ratings (
+  id               UUID        PRIMARY KEY DEFAULT gen_random_uuid(),
+  order_id         UUID        NOT NULL UNIQUE,
+  courier_id       UUID        NOT NULL
+    REFERENCES couriers(id)
+    ON DELETE CASCADE,
+  establishment_id UUID        NOT NULL
+    REFERENCES establishments(id)
+    ON DELETE CASCADE,
+  customer_id      UUID        NOT NULL
+    REFERENCES customers(id)
+    ON DELETE CASCADE,
+  on_time          BOOLEAN     NOT NULL,
+  food_condition   SMALLINT    NOT NULL
+    CHECK (food_condition BETWEEN 1 AND 5),
+  courtesy         SMALLINT    NOT NULL
+    CHECK (courtesy BETWEEN 1 AND 5),
+  comment          TEXT        NOT NULL DEFAULT '',
+  created_at       TIMESTAMP   NOT NULL DEFAULT now()
+);
+
+-- 95. SESSÕES DE UPLOAD RETOMÁVEL (protocolo tus; partes acumuladas em data até completar Upload-Length)
+CREATE TABLE upload_sessions (
+  id            UUID        PRIMARY KEY DEFAULT gen_random_uuid(),
+  purpose       VARCHAR(50) NOT NULL,
+  length        INTEGER     NOT NULL CHECK (length > 0),
+  data          BYTEA       NOT NULL DEFAULT ''::bytea,
+  uploader_type VARCHAR(10) NOT NULL
+    CHECK (uploader_type IN ('owner','customer')),
+  uploader_id   UUID        NOT NULL,
+  created_at    TIMESTAMP   NOT NULL DEFAULT now(),
+  updated_at    TIMESTAMP   NOT NULL DEFAULT now()
+);
+
 -- Índices adicionais para performance (exemplos)
 CREATE INDEX idx_products_estab ON products(establishment_id);
 CREATE INDEX idx_orders_customer ON orders(customer_id);
 CREATE INDEX idx_orders_status ON orders(status);
+CREATE INDEX idx_order_amendments_order ON order_amendments(order_id);
+CREATE INDEX idx_notifications_pending ON notifications(send_after) WHERE sent_at IS NULL;
+CREATE INDEX idx_revoked_tokens_expiry ON revoked_tokens(expires_at);
+CREATE UNIQUE INDEX idx_auth_identities_owner ON auth_identities(provider, subject) WHERE owner_id IS NOT NULL;
+CREATE UNIQUE INDEX idx_auth_identities_customer ON auth_identities(provider, subject) WHERE customer_id IS NOT NULL;
+CREATE INDEX idx_establishment_staff_owner ON establishment_staff(owner_id);
+CREATE UNIQUE INDEX idx_customer_flags_active ON customer_flags(establishment_id, customer_id, reason) WHERE cleared_at IS NULL;
+CREATE INDEX idx_disputes_order ON disputes(order_id);
+CREATE INDEX idx_product_categories_parent ON product_categories(parent_id);
+CREATE INDEX idx_customer_addresses_customer ON customer_addresses(customer_id);
+CREATE INDEX idx_deliveries_courier_time ON deliveries(courier_id, delivered_at);
+CREATE INDEX idx_establishments_organization ON establishments(organization_id);
+CREATE UNIQUE INDEX idx_products_catalog ON products(establishment_id, catalog_product_id) WHERE catalog_product_id IS NOT NULL;
+CREATE INDEX idx_orders_archive_establishment ON orders_archive(establishment_id, ordered_at);
+CREATE INDEX idx_order_items_archive_order ON order_items_archive(order_id);
+CREATE INDEX idx_audit_log_establishment ON audit_log(establishment_id, created_at DESC, id DESC);
+CREATE INDEX idx_orders_customer_keyset ON orders(customer_id, ordered_at DESC, id DESC);
+CREATE INDEX idx_orders_establishment_keyset ON orders(establishment_id, ordered_at DESC, id DESC);
+CREATE INDEX idx_order_events_keyset ON order_events(occurred_at DESC, id DESC);
+CREATE INDEX idx_outbox_pending ON outbox(next_attempt_at) WHERE delivered_at IS NULL;
+CREATE INDEX idx_product_price_history_product ON product_price_history(product_id, changed_at DESC, id DESC);
+CREATE UNIQUE INDEX idx_products_barcode ON products(establishment_id, barcode) WHERE barcode IS NOT NULL;
+CREATE INDEX idx_sync_tombstones_establishment ON sync_tombstones(establishment_id, deleted_at);
+CREATE INDEX idx_products_sync ON products(establishment_id, updated_at);
+CREATE INDEX idx_orders_sync ON orders(establishment_id, updated_at);
+CREATE UNIQUE INDEX idx_orders_daily_number ON orders(establishment_id, business_date, order_number);
+CREATE UNIQUE INDEX idx_printers_default ON printers(establishment_id) WHERE is_default;
+CREATE INDEX idx_print_rules_establishment ON print_rules(establishment_id);
+CREATE INDEX idx_print_jobs_pending ON print_jobs(establishment_id, queued_at) WHERE status = 'pending';
+CREATE INDEX idx_reviews_establishment_keyset ON reviews(establishment_id, created_at DESC, id DESC);
+CREATE INDEX idx_notifications_customer_kind ON notifications(customer_id, kind, created_at);
+CREATE INDEX idx_campaigns_due ON campaigns(send_at) WHERE status = 'scheduled';
+CREATE INDEX idx_customer_consent_log_customer ON customer_consent_log(customer_id, created_at);
+CREATE INDEX idx_analytics_events_establishment ON analytics_events(establishment_id, occurred_at);
+CREATE INDEX idx_analytics_events_product ON analytics_events(product_id, occurred_at) WHERE product_id IS NOT NULL;
+CREATE INDEX idx_analytics_events_occurred ON analytics_events USING brin(occurred_at);
+CREATE INDEX idx_order_items_product ON order_items(product_id);
+CREATE INDEX idx_payments_order ON payments(order_id, created_at);
+CREATE INDEX idx_store_credit_ledger_customer ON store_credit_ledger(establishment_id, customer_id, created_at DESC);
+CREATE INDEX idx_store_credit_ledger_order ON store_credit_ledger(order_id) WHERE order_id IS NOT NULL;
+CREATE INDEX idx_gift_cards_establishment ON gift_cards(establishment_id, created_at DESC);
+CREATE INDEX idx_gift_card_transactions_order ON gift_card_transactions(order_id);
+CREATE INDEX idx_delivery_batches_courier ON delivery_batches(courier_id, created_at) WHERE status IN ('planned','in_progress');
+CREATE UNIQUE INDEX idx_delivery_batch_stops_open ON delivery_batch_stops(order_id) WHERE status IN ('pending','en_route');
+CREATE INDEX idx_courier_locations_batch ON courier_locations(batch_id, recorded_at DESC);
+CREATE INDEX idx_courier_locations_recorded ON courier_locations USING brin(recorded_at);
+CREATE INDEX idx_api_keys_owner ON api_keys(owner_id) WHERE revoked_at IS NULL;
+CREATE INDEX idx_webhook_deliveries_establishment ON webhook_deliveries(establishment_id, attempted_at DESC, id DESC);
+CREATE INDEX idx_establishment_secrets_key ON establishment_secrets(key_id);
+CREATE INDEX idx_impersonations_unnotified ON impersonations(expires_at) WHERE notified_at IS NULL;
+CREATE INDEX idx_audit_log_impersonation ON audit_log((details->>'session_id')) WHERE impersonator_id IS NOT NULL;
+CREATE UNIQUE INDEX idx_legal_acceptances_owner ON legal_acceptances(owner_id, kind, version) WHERE owner_id IS NOT NULL;
+CREATE UNIQUE INDEX idx_legal_acceptances_customer ON legal_acceptances(customer_id, kind, version) WHERE customer_id IS NOT NULL;
+CREATE INDEX idx_review_photos_review ON review_photos(review_id, position);
+CREATE INDEX idx_review_photos_pending ON review_photos(created_at) WHERE status = 'pending';
+CREATE INDEX idx_review_terms_top ON review_terms(establishment_id, count DESC);
+CREATE INDEX idx_order_messages_order ON order_messages(order_id, created_at);
+CREATE INDEX idx_order_messages_unread ON order_messages(order_id) WHERE read_at IS NULL AND sender = 'customer';
+CREATE UNIQUE INDEX idx_establishment_verifications_open ON establishment_verifications(establishment_id) WHERE status = 'submitted';
+CREATE INDEX idx_establishment_verifications_queue ON establishment_verifications(submitted_at) WHERE status = 'submitted';
+CREATE INDEX idx_establishments_directory ON establishments(lower(address_city), category, created_at DESC, id DESC) WHERE status = 'published' AND verified_at IS NOT NULL;
+CREATE INDEX idx_establishment_cuisines_cuisine ON establishment_cuisines(cuisine, establishment_id);
+CREATE INDEX idx_short_links_establishment ON short_links(establishment_id, created_at DESC, id DESC);
+CREATE INDEX idx_orders_device_fingerprint ON orders(device_fingerprint, ordered_at) WHERE device_fingerprint IS NOT NULL;
+CREATE INDEX idx_report_exports_pending ON report_exports(created_at) WHERE status IN ('queued','running');
+CREATE INDEX idx_products_custom_fields ON products USING gin(custom_fields);
+CREATE INDEX idx_product_badges_badge ON product_badges(badge_id);
+CREATE UNIQUE INDEX idx_experiments_running_product ON experiments(product_id) WHERE status='running';
+CREATE INDEX idx_analytics_events_experiment ON analytics_events(experiment_id, session_hash) WHERE experiment_id IS NOT NULL;
+CREATE INDEX idx_translations_establishment ON translations(establishment_id, lang);
+CREATE INDEX idx_owner_sessions_owner ON owner_sessions(owner_id) WHERE revoked_at IS NULL;
+CREATE INDEX idx_refresh_tokens_session ON refresh_tokens(session_id);
+CREATE UNIQUE INDEX idx_courier_devices_active ON courier_devices(courier_id) WHERE revoked_at IS NULL;
+CREATE INDEX idx_dispatch_decisions_order ON dispatch_decisions(order_id, created_at);
+CREATE UNIQUE INDEX idx_courier_shifts_open ON courier_shifts(courier_id) WHERE ended_at IS NULL;
+CREATE INDEX idx_courier_shifts_courier ON courier_shifts(courier_id, started_at);
+CREATE INDEX idx_orders_sla_open ON orders(ordered_at) WHERE status IN ('PENDING','PROCESSING') AND sla_breached_at IS NULL;
+CREATE INDEX idx_delivery_ratings_courier ON delivery_ratings(courier_id, created_at);
+CREATE INDEX idx_upload_sessions_updated ON upload_sessions(updated_at);
+CREATE INDEX idx_uploads_scan_pending ON uploads(created_at) WHERE scan_status='pending';
+CREATE INDEX idx_order_events_order ON order_events(order_id, event_type);
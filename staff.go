@@ -0,0 +1,123 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+)
+
+var roleRank = map[string]int{"staff": 1, "manager": 2, "owner": 3}
+
+type StaffMember struct {
+	OwnerID string `json:"owner_id"`
+	Name    string `json:"name"`
+	Email   string `json:"email"`
+	Role    string `json:"role"`
+}
+
+func establishmentRole(q queryer, establishmentID, ownerID string) (string, error) {
+	var role string
+	err := q.QueryRow(
+		`SELECT role FROM establishment_staff WHERE establishment_id=$1 AND owner_id=$2`,
+		establishmentID, ownerID,
+	).Scan(&role)
+	if err == sql.ErrNoRows {
+		return "", nil
+	}
+	return role, err
+}
+
+// requireRole writes a 403 and returns false unless the authenticated owner
+// holds at least minRole on the establishment.
+func requireRole(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID, minRole string) bool {
+	role, err := establishmentRole(db, establishmentID, currentClaims(r).Sub)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return false
+	}
+	if roleRank[role] < roleRank[minRole] {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func staffRoute(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	switch r.Method {
+	case http.MethodGet:
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) {
+			if requireRole(w, r, db, establishmentID, "manager") {
+				listStaff(w, db, establishmentID)
+			}
+		})(w, r)
+	case http.MethodPut:
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) {
+			if requireRole(w, r, db, establishmentID, "owner") {
+				putStaffMember(w, r, db, establishmentID)
+			}
+		})(w, r)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func listStaff(w http.ResponseWriter, db *sql.DB, establishmentID string) {
+	rows, err := db.Query(
+		`SELECT o.id, o.name, o.email, s.role FROM establishment_staff s JOIN owners o ON o.id=s.owner_id WHERE s.establishment_id=$1 ORDER BY o.name`,
+		establishmentID,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	list := []StaffMember{}
+	for rows.Next() {
+		var m StaffMember
+		if err := rows.Scan(&m.OwnerID, &m.Name, &m.Email, &m.Role); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		list = append(list, m)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func putStaffMember(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	var m StaffMember
+	if err := json.NewDecoder(r.Body).Decode(&m); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, ok := roleRank[m.Role]; !ok {
+		http.Error(w, "role must be staff, manager or owner", http.StatusBadRequest)
+		return
+	}
+	err := db.QueryRow(`SELECT id, name FROM owners WHERE email=$1`, strings.ToLower(strings.TrimSpace(m.Email))).Scan(&m.OwnerID, &m.Name)
+	if err == sql.ErrNoRows {
+		http.Error(w, "no account with this email", http.StatusNotFound)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	_, err = db.Exec(
+		`INSERT INTO establishment_staff (establishment_id, owner_id, role) VALUES ($1,$2,$3)
+		 ON CONFLICT (establishment_id, owner_id) DO UPDATE SET role=EXCLUDED.role`,
+		establishmentID, m.OwnerID, m.Role,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := recordAudit(db, r, establishmentID, "staff.role_changed", "owner", m.OwnerID, map[string]string{"role": m.Role}); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(m)
+}
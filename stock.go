@@ -0,0 +1,212 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"time"
+)
+
+const stockKeepAlive = 25 * time.Second
+
+var errOutOfStock = errors.New("out of stock")
+
+type StockLevel struct {
+	ProductID string `json:"product_id"`
+	Stock     *int   `json:"stock"`
+}
+
+// takeStock decrements a tracked product's stock inside the order
+// transaction. Products with NULL stock are not tracked and always succeed.
+func takeStock(tx *sql.Tx, establishmentID, productID string, qty int) error {
+	var stock sql.NullInt64
+	err := tx.QueryRow(
+		`UPDATE products SET stock_quantity=stock_quantity-$1, updated_at=now()
+		 WHERE id=$2 AND establishment_id=$3 AND stock_quantity IS NOT NULL AND stock_quantity >= $1
+		 RETURNING stock_quantity`,
+		qty, productID, establishmentID,
+	).Scan(&stock)
+	if err == sql.ErrNoRows {
+		var tracked bool
+		if err := tx.QueryRow(`SELECT stock_quantity IS NOT NULL FROM products WHERE id=$1`, productID).Scan(&tracked); err != nil {
+			return err
+		}
+		if tracked {
+			return errOutOfStock
+		}
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return enqueueStockEvents(tx, establishmentID, productID, int(stock.Int64))
+}
+
+// restoreStock gives qty back to a tracked product, for items taken off an
+// order.
+func restoreStock(tx *sql.Tx, establishmentID, productID string, qty int) error {
+	var stock int
+	err := tx.QueryRow(
+		`UPDATE products SET stock_quantity=stock_quantity+$1, updated_at=now()
+		 WHERE id=$2 AND establishment_id=$3 AND stock_quantity IS NOT NULL
+		 RETURNING stock_quantity`,
+		qty, productID, establishmentID,
+	).Scan(&stock)
+	if err == sql.ErrNoRows {
+		return nil
+	}
+	if err != nil {
+		return err
+	}
+	return enqueueStockEvents(tx, establishmentID, productID, stock)
+}
+
+func enqueueStockEvents(q execer, establishmentID, productID string, stock int) error {
+	if err := enqueueEvent(q, Event{Type: eventStockChanged, ProductID: productID, EstablishmentID: establishmentID, Stock: &stock}); err != nil {
+		return err
+	}
+	if stock == 0 {
+		return enqueueEvent(q, Event{Type: eventProductSoldOut, ProductID: productID, EstablishmentID: establishmentID, Stock: &stock})
+	}
+	return nil
+}
+
+func stockRoute(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID, productID string) {
+	switch {
+	case productID == "stream" && r.Method == http.MethodGet:
+		if requireRole(w, r, db, establishmentID, "staff") {
+			streamStock(w, r, db, establishmentID)
+		}
+	case productID != "" && r.Method == http.MethodPut:
+		if requireRole(w, r, db, establishmentID, "staff") {
+			setStock(w, r, db, establishmentID, productID)
+		}
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+// setStock sets or clears (with "stock": null) a product's stock counter.
+func setStock(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID, productID string) {
+	var req struct {
+		Stock *int `json:"stock"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Stock != nil && *req.Stock < 0 {
+		http.Error(w, "stock must not be negative", http.StatusUnprocessableEntity)
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	res, err := tx.Exec(`UPDATE products SET stock_quantity=$1, updated_at=now() WHERE id=$2 AND establishment_id=$3`, req.Stock, productID, establishmentID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if n, _ := res.RowsAffected(); n == 0 {
+		http.NotFound(w, nil)
+		return
+	}
+	if req.Stock != nil {
+		err = enqueueStockEvents(tx, establishmentID, productID, *req.Stock)
+	} else {
+		err = enqueueEvent(tx, Event{Type: eventStockChanged, ProductID: productID, EstablishmentID: establishmentID})
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := recordAudit(tx, r, establishmentID, "stock.set", "product", productID, req); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	responseCache.Invalidate(establishmentID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(StockLevel{ProductID: productID, Stock: req.Stock})
+}
+
+// streamStock sends the tracked stock levels as a "snapshot" event and then
+// every stock change and sell-out for the establishment as server-sent
+// events. Changes reach the stream through the outbox relay and liveEvents,
+// so they lag the commit by up to the relay poll interval.
+func streamStock(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		http.Error(w, "streaming unsupported", http.StatusInternalServerError)
+		return
+	}
+	snapshot, err := loadStockLevels(db, establishmentID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	ch := make(chan Event, 64)
+	forward := func(e Event) {
+		if e.EstablishmentID != establishmentID {
+			return
+		}
+		select {
+		case ch <- e:
+		default: // a stalled client drops events rather than blocking the bus
+		}
+	}
+	defer liveEvents.Subscribe(eventStockChanged, forward)()
+	defer liveEvents.Subscribe(eventProductSoldOut, forward)()
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("X-Accel-Buffering", "no")
+	writeSSE(w, "snapshot", snapshot)
+	flusher.Flush()
+
+	ticker := time.NewTicker(stockKeepAlive)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e := <-ch:
+			writeSSE(w, e.Type, e)
+		case <-ticker.C:
+			fmt.Fprint(w, ": keep-alive\n\n")
+		}
+		flusher.Flush()
+	}
+}
+
+func writeSSE(w http.ResponseWriter, event string, data any) {
+	payload, _ := json.Marshal(data)
+	fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, payload)
+}
+
+func loadStockLevels(db *sql.DB, establishmentID string) ([]StockLevel, error) {
+	rows, err := db.Query(`SELECT id, stock_quantity FROM products WHERE establishment_id=$1 AND stock_quantity IS NOT NULL ORDER BY name`, establishmentID)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	list := []StockLevel{}
+	for rows.Next() {
+		var s StockLevel
+		if err := rows.Scan(&s.ProductID, &s.Stock); err != nil {
+			return nil, err
+		}
+		list = append(list, s)
+	}
+	return list, rows.Err()
+}
@@ -0,0 +1,468 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/rsa"
+	"crypto/sha256"
+	"crypto/x509"
+	"encoding/hex"
+	"encoding/json"
+	"encoding/pem"
+	"errors"
+	"fmt"
+	"io"
+	"io/fs"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const (
+	assetURLTTL = time.Hour
+	// privateAssetURLTTL bounds how long a link to a private asset, such as
+	// a fiscal document, can be shared.
+	privateAssetURLTTL = 15 * time.Minute
+)
+
+// Storage keeps uploaded objects on S3, GCS or local disk. URL returns a
+// link that expires after ttl; backends whose objects are public anyway may
+// ignore it. Deleting a missing object is not an error.
+type Storage interface {
+	Put(ctx context.Context, key, contentType string, data []byte) error
+	Get(ctx context.Context, key string) ([]byte, error)
+	Delete(ctx context.Context, key string) error
+	URL(key string, ttl time.Duration) (string, error)
+}
+
+var storage Storage
+
+// cdnBaseURL, from CDN_HOST, is where public assets are served from when the
+// bucket sits behind a CDN. Private assets never go through it.
+var cdnBaseURL string
+
+// privateKeyPrefixes are the upload purposes and generated files that are
+// only ever served through short-lived signed URLs.
+var privateKeyPrefixes = []string{"verification_document/", "delivery_photo/", "delivery_signature/", "exports/", "archive/", scanPendingPrefix, quarantinePrefix}
+
+func isPrivateKey(key string) bool {
+	for _, p := range privateKeyPrefixes {
+		if strings.HasPrefix(key, p) {
+			return true
+		}
+	}
+	return false
+}
+
+// assetURL returns a readable URL for a stored object, or "" when there is no
+// key or no storage configured. Public assets use the CDN when one is
+// configured; private ones always get a signed URL valid for
+// privateAssetURLTTL.
+func assetURL(key string) string {
+	if key == "" || storage == nil {
+		return ""
+	}
+	if isPrivateKey(key) {
+		u, err := storage.URL(key, privateAssetURLTTL)
+		if err != nil {
+			return ""
+		}
+		return u
+	}
+	if cdnBaseURL != "" {
+		return cdnBaseURL + "/" + awsEscape(key, false)
+	}
+	u, err := storage.URL(key, assetURLTTL)
+	if err != nil {
+		return ""
+	}
+	return u
+}
+
+type localStorage struct {
+	dir     string
+	baseURL string
+}
+
+func (l localStorage) Put(_ context.Context, key, _ string, data []byte) error {
+	path := filepath.Join(l.dir, filepath.FromSlash(key))
+	if err := os.MkdirAll(filepath.Dir(path), 0o755); err != nil {
+		return err
+	}
+	return os.WriteFile(path, data, 0o644)
+}
+
+func (l localStorage) Get(_ context.Context, key string) ([]byte, error) {
+	return os.ReadFile(filepath.Join(l.dir, filepath.FromSlash(key)))
+}
+
+func (l localStorage) Delete(_ context.Context, key string) error {
+	err := os.Remove(filepath.Join(l.dir, filepath.FromSlash(key)))
+	if errors.Is(err, fs.ErrNotExist) {
+		return nil
+	}
+	return err
+}
+
+// URL links to the file server. Private keys get an expiry and an HMAC
+// signature that handler checks.
+func (l localStorage) URL(key string, ttl time.Duration) (string, error) {
+	u := strings.TrimSuffix(l.baseURL, "/") + "/" + key
+	if !isPrivateKey(key) {
+		return u, nil
+	}
+	expires := strconv.FormatInt(time.Now().Add(ttl).Unix(), 10)
+	return u + "?expires=" + expires + "&sig=" + localFileSignature(key, expires), nil
+}
+
+func localFileSignature(key, expires string) string {
+	return hex.EncodeToString(hmacSHA256(jwtSecret, "files\n"+key+"\n"+expires))
+}
+
+// handler serves the stored files under baseURL, refusing private files
+// without a valid, unexpired signature.
+func (l localStorage) handler() http.Handler {
+	files := http.StripPrefix(l.baseURL+"/", http.FileServer(http.Dir(l.dir)))
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		key := strings.TrimPrefix(r.URL.Path, l.baseURL+"/")
+		if isPrivateKey(key) {
+			expires := r.URL.Query().Get("expires")
+			at, err := strconv.ParseInt(expires, 10, 64)
+			if err != nil || time.Now().Unix() > at || !hmac.Equal([]byte(r.URL.Query().Get("sig")), []byte(localFileSignature(key, expires))) {
+				http.NotFound(w, r)
+				return
+			}
+			w.Header().Set("Cache-Control", "private, no-store")
+		}
+		files.ServeHTTP(w, r)
+	})
+}
+
+type s3Storage struct {
+	bucket    string
+	region    string
+	endpoint  string
+	accessKey string
+	secretKey string
+}
+
+func (s s3Storage) host() string {
+	if s.endpoint != "" {
+		return s.endpoint
+	}
+	return s.bucket + ".s3." + s.region + ".amazonaws.com"
+}
+
+func (s s3Storage) path(key string) string {
+	p := "/" + awsEscape(key, false)
+	if s.endpoint != "" {
+		p = "/" + s.bucket + p
+	}
+	return p
+}
+
+func (s s3Storage) Put(ctx context.Context, key, contentType string, data []byte) error {
+	now := time.Now().UTC()
+	sum := sha256.Sum256(data)
+	payloadHash := hex.EncodeToString(sum[:])
+	headers := map[string]string{
+		"content-type":         contentType,
+		"host":                 s.host(),
+		"x-amz-content-sha256": payloadHash,
+		"x-amz-date":           now.Format("20060102T150405Z"),
+	}
+	names := make([]string, 0, len(headers))
+	for k := range headers {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + headers[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+	canonical := strings.Join([]string{http.MethodPut, s.path(key), "", canonHeaders.String(), signed, payloadHash}, "\n")
+	scope, sig := s.sign(now, canonical)
+
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, "https://"+s.host()+s.path(key), bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	for k, v := range headers {
+		if k != "host" {
+			req.Header.Set(k, v)
+		}
+	}
+	req.Header.Set("Authorization", fmt.Sprintf("AWS4-HMAC-SHA256 Credential=%s/%s, SignedHeaders=%s, Signature=%s", s.accessKey, scope, signed, sig))
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("s3 put: status %d: %s", resp.StatusCode, b)
+	}
+	return nil
+}
+
+// URL returns a SigV4 presigned GET URL valid for ttl.
+func (s s3Storage) URL(key string, ttl time.Duration) (string, error) {
+	return s.presign(http.MethodGet, key, ttl), nil
+}
+
+func (s s3Storage) Get(ctx context.Context, key string) ([]byte, error) {
+	return fetchSigned(ctx, http.MethodGet, s.presign(http.MethodGet, key, time.Minute))
+}
+
+func (s s3Storage) Delete(ctx context.Context, key string) error {
+	_, err := fetchSigned(ctx, http.MethodDelete, s.presign(http.MethodDelete, key, time.Minute))
+	return err
+}
+
+func (s s3Storage) presign(method, key string, ttl time.Duration) string {
+	now := time.Now().UTC()
+	date := now.Format("20060102")
+	q := url.Values{
+		"X-Amz-Algorithm":     {"AWS4-HMAC-SHA256"},
+		"X-Amz-Credential":    {s.accessKey + "/" + date + "/" + s.region + "/s3/aws4_request"},
+		"X-Amz-Date":          {now.Format("20060102T150405Z")},
+		"X-Amz-Expires":       {fmt.Sprint(int(ttl.Seconds()))},
+		"X-Amz-SignedHeaders": {"host"},
+	}
+	query := awsQuery(q)
+	canonical := strings.Join([]string{method, s.path(key), query, "host:" + s.host() + "\n", "host", "UNSIGNED-PAYLOAD"}, "\n")
+	_, sig := s.sign(now, canonical)
+	return "https://" + s.host() + s.path(key) + "?" + query + "&X-Amz-Signature=" + sig
+}
+
+// fetchSigned sends a body-less request to a presigned URL and returns the
+// response body. A missing object is not an error for DELETE.
+func fetchSigned(ctx context.Context, method, u string) ([]byte, error) {
+	req, err := http.NewRequestWithContext(ctx, method, u, nil)
+	if err != nil {
+		return nil, err
+	}
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if method == http.MethodDelete && resp.StatusCode == http.StatusNotFound {
+		return nil, nil
+	}
+	if resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return nil, fmt.Errorf("storage %s: status %d: %s", strings.ToLower(method), resp.StatusCode, b)
+	}
+	return io.ReadAll(io.LimitReader(resp.Body, maxUploadSize+1))
+}
+
+func (s s3Storage) sign(now time.Time, canonical string) (scope, signature string) {
+	date := now.Format("20060102")
+	scope = date + "/" + s.region + "/s3/aws4_request"
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := "AWS4-HMAC-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(sum[:])
+	key := hmacSHA256([]byte("AWS4"+s.secretKey), date)
+	key = hmacSHA256(key, s.region)
+	key = hmacSHA256(key, "s3")
+	key = hmacSHA256(key, "aws4_request")
+	return scope, hex.EncodeToString(hmacSHA256(key, toSign))
+}
+
+// gcsStorage talks to the Cloud Storage XML API with V4 signed URLs made
+// from a service account key, so uploads need no OAuth token exchange.
+type gcsStorage struct {
+	bucket      string
+	clientEmail string
+	key         *rsa.PrivateKey
+}
+
+// newGCSStorage reads a service account JSON key file.
+func newGCSStorage(bucket, credentialsFile string) (gcsStorage, error) {
+	data, err := os.ReadFile(credentialsFile)
+	if err != nil {
+		return gcsStorage{}, err
+	}
+	var creds struct {
+		ClientEmail string `json:"client_email"`
+		PrivateKey  string `json:"private_key"`
+	}
+	if err := json.Unmarshal(data, &creds); err != nil {
+		return gcsStorage{}, err
+	}
+	block, _ := pem.Decode([]byte(creds.PrivateKey))
+	if block == nil {
+		return gcsStorage{}, errors.New("credentials have no PEM private key")
+	}
+	parsed, err := x509.ParsePKCS8PrivateKey(block.Bytes)
+	if err != nil {
+		return gcsStorage{}, err
+	}
+	key, ok := parsed.(*rsa.PrivateKey)
+	if !ok {
+		return gcsStorage{}, errors.New("credentials key is not RSA")
+	}
+	return gcsStorage{bucket: bucket, clientEmail: creds.ClientEmail, key: key}, nil
+}
+
+const gcsHost = "storage.googleapis.com"
+
+// signedURL returns a V4 signed URL for method on key. headers are signed
+// along with host and must be sent unchanged.
+func (g gcsStorage) signedURL(method, key string, ttl time.Duration, headers map[string]string) (string, error) {
+	now := time.Now().UTC()
+	scope := now.Format("20060102") + "/auto/storage/goog4_request"
+	all := map[string]string{"host": gcsHost}
+	for k, v := range headers {
+		all[strings.ToLower(k)] = v
+	}
+	names := make([]string, 0, len(all))
+	for k := range all {
+		names = append(names, k)
+	}
+	sort.Strings(names)
+	var canonHeaders strings.Builder
+	for _, k := range names {
+		canonHeaders.WriteString(k + ":" + all[k] + "\n")
+	}
+	signed := strings.Join(names, ";")
+	q := url.Values{
+		"X-Goog-Algorithm":     {"GOOG4-RSA-SHA256"},
+		"X-Goog-Credential":    {g.clientEmail + "/" + scope},
+		"X-Goog-Date":          {now.Format("20060102T150405Z")},
+		"X-Goog-Expires":       {fmt.Sprint(int(ttl.Seconds()))},
+		"X-Goog-SignedHeaders": {signed},
+	}
+	query := awsQuery(q)
+	path := "/" + g.bucket + "/" + awsEscape(key, false)
+	canonical := strings.Join([]string{method, path, query, canonHeaders.String(), signed, "UNSIGNED-PAYLOAD"}, "\n")
+	sum := sha256.Sum256([]byte(canonical))
+	toSign := sha256.Sum256([]byte("GOOG4-RSA-SHA256\n" + now.Format("20060102T150405Z") + "\n" + scope + "\n" + hex.EncodeToString(sum[:])))
+	sig, err := rsa.SignPKCS1v15(rand.Reader, g.key, crypto.SHA256, toSign[:])
+	if err != nil {
+		return "", err
+	}
+	return "https://" + gcsHost + path + "?" + query + "&X-Goog-Signature=" + hex.EncodeToString(sig), nil
+}
+
+func (g gcsStorage) Put(ctx context.Context, key, contentType string, data []byte) error {
+	u, err := g.signedURL(http.MethodPut, key, 5*time.Minute, map[string]string{"content-type": contentType})
+	if err != nil {
+		return err
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodPut, u, bytes.NewReader(data))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("Content-Type", contentType)
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode >= 300 {
+		b, _ := io.ReadAll(io.LimitReader(resp.Body, 1024))
+		return fmt.Errorf("gcs put: status %d: %s", resp.StatusCode, b)
+	}
+	return nil
+}
+
+// URL returns a V4 signed GET URL valid for ttl.
+func (g gcsStorage) URL(key string, ttl time.Duration) (string, error) {
+	return g.signedURL(http.MethodGet, key, ttl, nil)
+}
+
+func (g gcsStorage) Get(ctx context.Context, key string) ([]byte, error) {
+	u, err := g.signedURL(http.MethodGet, key, time.Minute, nil)
+	if err != nil {
+		return nil, err
+	}
+	return fetchSigned(ctx, http.MethodGet, u)
+}
+
+func (g gcsStorage) Delete(ctx context.Context, key string) error {
+	u, err := g.signedURL(http.MethodDelete, key, time.Minute, nil)
+	if err != nil {
+		return err
+	}
+	_, err = fetchSigned(ctx, http.MethodDelete, u)
+	return err
+}
+
+func hmacSHA256(key []byte, data string) []byte {
+	mac := hmac.New(sha256.New, key)
+	mac.Write([]byte(data))
+	return mac.Sum(nil)
+}
+
+func awsEscape(s string, encodeSlash bool) string {
+	var b strings.Builder
+	for _, c := range []byte(s) {
+		switch {
+		case c >= 'A' && c <= 'Z', c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '_', c == '.', c == '~':
+			b.WriteByte(c)
+		case c == '/' && !encodeSlash:
+			b.WriteByte(c)
+		default:
+			fmt.Fprintf(&b, "%%%02X", c)
+		}
+	}
+	return b.String()
+}
+
+func awsQuery(q url.Values) string {
+	keys := make([]string, 0, len(q))
+	for k := range q {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+	parts := make([]string, 0, len(keys))
+	for _, k := range keys {
+		parts = append(parts, awsEscape(k, true)+"="+awsEscape(q.Get(k), true))
+	}
+	return strings.Join(parts, "&")
+}
+
+// newStorageFromEnv picks S3 when S3_BUCKET is set, GCS when GCS_BUCKET is,
+// and local disk otherwise. Each bucket lives in one region (S3_REGION, or
+// the GCS bucket's location); CDN_HOST puts a CDN in front of it for public
+// assets.
+func newStorageFromEnv() Storage {
+	if host := strings.TrimSuffix(os.Getenv("CDN_HOST"), "/"); host != "" {
+		if !strings.Contains(host, "://") {
+			host = "https://" + host
+		}
+		cdnBaseURL = host
+	}
+	if bucket := os.Getenv("S3_BUCKET"); bucket != "" {
+		return s3Storage{
+			bucket:    bucket,
+			region:    os.Getenv("S3_REGION"),
+			endpoint:  os.Getenv("S3_ENDPOINT"),
+			accessKey: os.Getenv("AWS_ACCESS_KEY_ID"),
+			secretKey: os.Getenv("AWS_SECRET_ACCESS_KEY"),
+		}
+	}
+	if bucket := os.Getenv("GCS_BUCKET"); bucket != "" {
+		s, err := newGCSStorage(bucket, os.Getenv("GCS_CREDENTIALS_FILE"))
+		if err != nil {
+			log.Fatalf("gcs storage: %v", err)
+		}
+		return s
+	}
+	dir := os.Getenv("UPLOADS_DIR")
+	if dir == "" {
+		dir = "uploads"
+	}
+	return localStorage{dir: dir, baseURL: "/files"}
+}
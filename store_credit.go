@@ -0,0 +1,254 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Store credit is kept per customer and establishment: credit granted by one
+// restaurant can only be spent there.
+
+type StoreCreditBalance struct {
+	EstablishmentID   string    `json:"establishment_id"`
+	EstablishmentName string    `json:"establishment_name"`
+	BalanceCents      int64     `json:"balance_cents"`
+	UpdatedAt         time.Time `json:"updated_at"`
+}
+
+// StoreCreditEntry is one ledger line. AmountCents is positive for credits
+// and negative for debits; the balance is always the ledger's sum.
+type StoreCreditEntry struct {
+	ID          string    `json:"id"`
+	CustomerID  string    `json:"customer_id"`
+	AmountCents int64     `json:"amount_cents"`
+	Reason      string    `json:"reason"`
+	OrderID     *string   `json:"order_id"`
+	Note        string    `json:"note"`
+	CreatedAt   time.Time `json:"created_at"`
+}
+
+var errInsufficientCredit = errors.New("insufficient store credit")
+
+// storeCreditReasons are the ones managers may post; "order" and
+// "cancellation" are written by checkout and auto-cancel.
+var storeCreditReasons = map[string]bool{"refund": true, "promotion": true, "adjustment": true}
+
+// postStoreCredit moves the balance and writes the ledger line in the
+// caller's transaction. Debits only succeed when the balance covers them,
+// which the conditional update checks atomically.
+func postStoreCredit(tx *sql.Tx, customerID, establishmentID string, amount int64, reason string, orderID *string, note string) error {
+	if amount < 0 {
+		res, err := tx.Exec(
+			`UPDATE store_credit_balances SET balance_cents=balance_cents+$3, updated_at=now()
+			 WHERE customer_id=$1 AND establishment_id=$2 AND balance_cents+$3 >= 0`,
+			customerID, establishmentID, amount,
+		)
+		if err != nil {
+			return err
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			return errInsufficientCredit
+		}
+	} else {
+		_, err := tx.Exec(
+			`INSERT INTO store_credit_balances (customer_id, establishment_id, balance_cents) VALUES ($1,$2,$3)
+			 ON CONFLICT (customer_id, establishment_id) DO UPDATE SET balance_cents=store_credit_balances.balance_cents+EXCLUDED.balance_cents, updated_at=now()`,
+			customerID, establishmentID, amount,
+		)
+		if err != nil {
+			return err
+		}
+	}
+	_, err := tx.Exec(
+		`INSERT INTO store_credit_ledger (customer_id, establishment_id, amount_cents, reason, order_id, note) VALUES ($1,$2,$3,$4,$5,$6)`,
+		customerID, establishmentID, amount, reason, orderID, note,
+	)
+	return err
+}
+
+// applyStoreCredit debits up to the order's total from the customer's
+// balance and records how much was used. Call it after the order row exists.
+func applyStoreCredit(tx *sql.Tx, o *Order, requested int64) error {
+	if requested <= 0 {
+		return nil
+	}
+	if requested > o.TotalCents {
+		requested = o.TotalCents
+	}
+	err := postStoreCredit(tx, o.CustomerID, o.EstablishmentID, -requested, "order", &o.ID, "")
+	if err == errInsufficientCredit {
+		return &checkoutError{http.StatusUnprocessableEntity, "store_credit_insufficient", "store credit balance is too low"}
+	}
+	if err != nil {
+		return err
+	}
+	o.StoreCreditCents = requested
+	_, err = tx.Exec(`UPDATE orders SET store_credit_cents=$1 WHERE id=$2`, requested, o.ID)
+	return err
+}
+
+func customerStoreCreditHandler(db *sql.DB) http.HandlerFunc {
+	return authenticateCustomer(db, func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != http.MethodGet {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		customerID := currentClaims(r).Sub
+		if establishmentID := strings.Trim(strings.TrimPrefix(r.URL.Path, "/customers/me/store_credit"), "/"); establishmentID != "" {
+			listStoreCreditLedger(w, r, db, establishmentID, customerID)
+			return
+		}
+		rows, err := db.Query(
+			`SELECT b.establishment_id, e.name, b.balance_cents, b.updated_at
+			 FROM store_credit_balances b JOIN establishments e ON e.id=b.establishment_id
+			 WHERE b.customer_id=$1 AND b.balance_cents > 0 ORDER BY e.name`,
+			customerID,
+		)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		defer rows.Close()
+
+		list := []StoreCreditBalance{}
+		for rows.Next() {
+			var b StoreCreditBalance
+			if err := rows.Scan(&b.EstablishmentID, &b.EstablishmentName, &b.BalanceCents, &b.UpdatedAt); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			list = append(list, b)
+		}
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(list)
+	})
+}
+
+// storeCreditRoute lets managers read a customer's ledger (?customer_id=) and
+// grant or adjust credit.
+func storeCreditRoute(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	if !requireRole(w, r, db, establishmentID, "manager") {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		customerID := r.URL.Query().Get("customer_id")
+		if customerID == "" {
+			http.Error(w, "customer_id is required", http.StatusBadRequest)
+			return
+		}
+		listStoreCreditLedger(w, r, db, establishmentID, customerID)
+	case http.MethodPost:
+		grantStoreCredit(w, r, db, establishmentID)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func listStoreCreditLedger(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID, customerID string) {
+	rows, err := db.Query(
+		`SELECT id, customer_id, amount_cents, reason, order_id, note, created_at FROM store_credit_ledger
+		 WHERE establishment_id=$1 AND customer_id=$2 ORDER BY created_at DESC LIMIT 200`,
+		establishmentID, customerID,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	list := []StoreCreditEntry{}
+	for rows.Next() {
+		var e StoreCreditEntry
+		if err := rows.Scan(&e.ID, &e.CustomerID, &e.AmountCents, &e.Reason, &e.OrderID, &e.Note, &e.CreatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		list = append(list, e)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// grantStoreCredit credits (or, for adjustments, debits) a customer. Refunds
+// must name an order of this establishment and can't exceed what was paid
+// for it, counting earlier refunds to credit.
+func grantStoreCredit(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	var req struct {
+		CustomerID  string  `json:"customer_id"`
+		AmountCents int64   `json:"amount_cents"`
+		Reason      string  `json:"reason"`
+		OrderID     *string `json:"order_id"`
+		Note        string  `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Note = sanitizeText(req.Note)
+	if !storeCreditReasons[req.Reason] {
+		http.Error(w, "reason must be refund, promotion or adjustment", http.StatusUnprocessableEntity)
+		return
+	}
+	if req.AmountCents == 0 || (req.AmountCents < 0 && req.Reason != "adjustment") {
+		http.Error(w, "amount_cents must be positive; only adjustments may debit", http.StatusUnprocessableEntity)
+		return
+	}
+	if req.Reason == "refund" && req.OrderID == nil {
+		http.Error(w, "refunds need an order_id", http.StatusUnprocessableEntity)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	if req.OrderID != nil {
+		var refundable int64
+		err := tx.QueryRow(
+			`SELECT o.total_cents - COALESCE((SELECT SUM(amount_cents) FROM store_credit_ledger WHERE order_id=o.id AND reason='refund'),0)
+			 FROM orders o WHERE o.id=$1 AND o.establishment_id=$2 AND o.customer_id=$3 FOR UPDATE`,
+			*req.OrderID, establishmentID, req.CustomerID,
+		).Scan(&refundable)
+		if err == sql.ErrNoRows {
+			http.Error(w, "order not found for this customer", http.StatusUnprocessableEntity)
+			return
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if req.Reason == "refund" && req.AmountCents > refundable {
+			http.Error(w, "amount exceeds what is left to refund on the order", http.StatusUnprocessableEntity)
+			return
+		}
+	}
+	err = postStoreCredit(tx, req.CustomerID, establishmentID, req.AmountCents, req.Reason, req.OrderID, req.Note)
+	if err == errInsufficientCredit {
+		http.Error(w, "balance can't go below zero", http.StatusUnprocessableEntity)
+		return
+	}
+	if isForeignKeyViolation(err) {
+		http.Error(w, "customer not found", http.StatusUnprocessableEntity)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := recordAudit(tx, r, establishmentID, "store_credit.posted", "customer", req.CustomerID, req); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	listStoreCreditLedger(w, r, db, establishmentID, req.CustomerID)
+}
@@ -0,0 +1,548 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"regexp"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+const (
+	// syncSettleWindow keeps the returned cursor behind the database clock so
+	// rows written by transactions that started earlier but committed later
+	// are still picked up. Changes may therefore be sent more than once and
+	// clients apply them idempotently.
+	syncSettleWindow       = time.Minute
+	syncTombstoneRetention = 90 * 24 * time.Hour
+	// syncInitialOrderWindow bounds the orders sent on a first sync.
+	syncInitialOrderWindow = 24 * time.Hour
+	maxSyncPushChanges     = 500
+
+	syncLastWriteWins = "last_write_wins"
+	syncVersion       = "version"
+)
+
+type SyncProduct struct {
+	Product
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type SyncCategory struct {
+	ProductCategory
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type SyncOrder struct {
+	Order
+	UpdatedAt time.Time `json:"updated_at"`
+}
+
+type SyncDeletion struct {
+	Type      string    `json:"type"`
+	ID        string    `json:"id"`
+	DeletedAt time.Time `json:"deleted_at"`
+}
+
+type SyncChanges struct {
+	Products   []SyncProduct  `json:"products"`
+	Categories []SyncCategory `json:"categories"`
+	Orders     []SyncOrder    `json:"orders"`
+	Deleted    []SyncDeletion `json:"deleted"`
+	Cursor     string         `json:"cursor"`
+}
+
+// SyncPushChange is a change made on a POS client. BaseUpdatedAt is the
+// server updated_at the client last saw (nil for rows created offline) and
+// ClientUpdatedAt is when the change was made on the client.
+type SyncPushChange struct {
+	Type            string          `json:"type"`
+	Op              string          `json:"op"`
+	ID              string          `json:"id"`
+	BaseUpdatedAt   *time.Time      `json:"base_updated_at"`
+	ClientUpdatedAt time.Time       `json:"client_updated_at"`
+	Data            json.RawMessage `json:"data"`
+}
+
+// SyncPushResult reports the outcome of one change: applied, conflict (with
+// the server's current row, nil when it was deleted) or rejected.
+type SyncPushResult struct {
+	Type   string `json:"type"`
+	ID     string `json:"id"`
+	Status string `json:"status"`
+	Error  string `json:"error,omitempty"`
+	Server any    `json:"server,omitempty"`
+}
+
+var (
+	syncTables  = map[string]string{"product": "products", "category": "product_categories"}
+	uuidPattern = regexp.MustCompile(`^[0-9a-fA-F]{8}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{4}-[0-9a-fA-F]{12}$`)
+)
+
+func syncHandler(db *sql.DB) http.HandlerFunc {
+	return authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) {
+		switch path := strings.TrimPrefix(r.URL.Path, "/sync/"); {
+		case path == "changes" && r.Method == http.MethodGet:
+			syncChanges(w, r, db)
+		case path == "push" && r.Method == http.MethodPost:
+			syncPush(w, r, db)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// recordTombstones remembers deleted rows so sync clients learn about them.
+func recordTombstones(q execer, establishmentID, entityType string, ids ...string) error {
+	_, err := q.Exec(
+		`INSERT INTO sync_tombstones (establishment_id, entity_type, entity_id)
+		 SELECT $1, $2, unnest($3::uuid[])
+		 ON CONFLICT (entity_type, entity_id) DO UPDATE SET deleted_at=now()`,
+		establishmentID, entityType, pq.Array(ids),
+	)
+	return err
+}
+
+func startSyncTombstonePruner(db *sql.DB) {
+	go func() {
+		for {
+			if _, err := db.Exec(`DELETE FROM sync_tombstones WHERE deleted_at < now() - $1 * interval '1 second'`, int(syncTombstoneRetention.Seconds())); err != nil {
+				log.Printf("sync tombstone prune: %v", err)
+			}
+			time.Sleep(24 * time.Hour)
+		}
+	}()
+}
+
+// syncChanges returns the establishment's products, categories and orders
+// changed since ?since= (all products and categories, and recent orders, when
+// absent), plus deletions, and the cursor for the next call.
+func syncChanges(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	establishmentID := r.URL.Query().Get("establishment_id")
+	if establishmentID == "" {
+		http.Error(w, "establishment_id is required", http.StatusBadRequest)
+		return
+	}
+	if !requireRole(w, r, db, establishmentID, "staff") {
+		return
+	}
+	var since time.Time
+	initial := true
+	if v := r.URL.Query().Get("since"); v != "" {
+		c, err := decodeCursor(v)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		if time.Since(c.At) > syncTombstoneRetention {
+			http.Error(w, "cursor expired, sync again without since", http.StatusGone)
+			return
+		}
+		since, initial = c.At, false
+	}
+
+	// The cursor is taken before reading so nothing written meanwhile is lost.
+	var next time.Time
+	if err := db.QueryRow(`SELECT localtimestamp - make_interval(secs => $1)`, syncSettleWindow.Seconds()).Scan(&next); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	changes := SyncChanges{Products: []SyncProduct{}, Categories: []SyncCategory{}, Orders: []SyncOrder{}, Deleted: []SyncDeletion{}}
+	if err := loadSyncChanges(db, establishmentID, since, initial, &changes); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if next.Before(since) {
+		next = since
+	}
+	changes.Cursor = pageCursor{At: next}.encode()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(changes)
+}
+
+func loadSyncChanges(db *sql.DB, establishmentID string, since time.Time, initial bool, c *SyncChanges) error {
+	rows, err := db.Query(
+		`SELECT id, establishment_id, category_id, name, description, price_cents, image_key, image_alt_text, banner_key, is_active, fulfillment_types, stock_quantity, barcode, updated_at
+		 FROM products WHERE establishment_id=$1 AND updated_at > $2 ORDER BY updated_at`,
+		establishmentID, since,
+	)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var p SyncProduct
+		if err := rows.Scan(&p.ID, &p.EstablishmentID, &p.CategoryID, &p.Name, &p.Description, &p.PriceCents, &p.ImageKey, &p.AltText, &p.BannerKey, &p.IsActive, pq.Array(&p.FulfillmentTypes), &p.Stock, &p.Barcode, &p.UpdatedAt); err != nil {
+			rows.Close()
+			return err
+		}
+		p.ImageURL, p.BannerURL = assetURL(p.ImageKey), assetURL(p.BannerKey)
+		c.Products = append(c.Products, p)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = db.Query(
+		`SELECT id, establishment_id, parent_id, name, description, image_key, image_alt_text, banner_key, updated_at
+		 FROM product_categories WHERE establishment_id=$1 AND updated_at > $2 ORDER BY updated_at`,
+		establishmentID, since,
+	)
+	if err != nil {
+		return err
+	}
+	for rows.Next() {
+		var cat SyncCategory
+		if err := rows.Scan(&cat.ID, &cat.EstablishmentID, &cat.ParentID, &cat.Name, &cat.Description, &cat.ImageKey, &cat.AltText, &cat.BannerKey, &cat.UpdatedAt); err != nil {
+			rows.Close()
+			return err
+		}
+		cat.ImageURL, cat.BannerURL = assetURL(cat.ImageKey), assetURL(cat.BannerKey)
+		c.Categories = append(c.Categories, cat)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	rows, err = db.Query(
+		`SELECT id, customer_id, establishment_id, coupon_code, loyalty_points, total_cents, fulfillment_type, delivery_address, delivery_fee_cents, delivery_fee_details, estimated_delivery_at, payment_method, change_for_cents, slot_id, scheduled_for, status, ordered_at, business_date::text, order_number, updated_at
+		 FROM orders WHERE establishment_id=$1 AND updated_at > $2 AND (NOT $3 OR updated_at > localtimestamp - $4 * interval '1 second')
+		 ORDER BY updated_at`,
+		establishmentID, since, initial, int(syncInitialOrderWindow.Seconds()),
+	)
+	if err != nil {
+		return err
+	}
+	byID := map[string]int{}
+	var orderIDs []string
+	for rows.Next() {
+		var o SyncOrder
+		var feeDetails []byte
+		if err := rows.Scan(&o.ID, &o.CustomerID, &o.EstablishmentID, &o.CouponCode, &o.LoyaltyPoints, &o.TotalCents, &o.FulfillmentType, &o.DeliveryAddress, &o.DeliveryFeeCents, &feeDetails, &o.EstimatedDeliveryAt, &o.PaymentMethod, &o.ChangeForCents, &o.SlotID, &o.ScheduledFor, &o.Status, &o.OrderedAt, &o.BusinessDate, &o.OrderNumber, &o.UpdatedAt); err != nil {
+			rows.Close()
+			return err
+		}
+		o.DeliveryFeeDetails = feeDetails
+		o.DisplayNumber = formatOrderNumber(o.OrderNumber)
+		o.Items = []OrderItem{}
+		byID[o.ID] = len(c.Orders)
+		orderIDs = append(orderIDs, o.ID)
+		c.Orders = append(c.Orders, o)
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+	if len(orderIDs) > 0 {
+		rows, err = db.Query(`SELECT order_id, product_id, product_name, quantity, unit_price_cents, total_price_cents FROM order_items WHERE order_id = ANY($1::uuid[])`, pq.Array(orderIDs))
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var orderID string
+			var it OrderItem
+			if err := rows.Scan(&orderID, &it.ProductID, &it.ProductName, &it.Quantity, &it.UnitPriceCents, &it.TotalPriceCents); err != nil {
+				rows.Close()
+				return err
+			}
+			o := &c.Orders[byID[orderID]]
+			o.Items = append(o.Items, it)
+		}
+		rows.Close()
+		if err := rows.Err(); err != nil {
+			return err
+		}
+	}
+
+	if initial {
+		return nil
+	}
+	rows, err = db.Query(
+		`SELECT entity_type, entity_id, deleted_at FROM sync_tombstones WHERE establishment_id=$1 AND deleted_at > $2 ORDER BY deleted_at`,
+		establishmentID, since,
+	)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var d SyncDeletion
+		if err := rows.Scan(&d.Type, &d.ID, &d.DeletedAt); err != nil {
+			return err
+		}
+		c.Deleted = append(c.Deleted, d)
+	}
+	return rows.Err()
+}
+
+// syncPush applies client changes one transaction each, so one conflict or
+// invalid change does not hold back the rest. With last_write_wins the most
+// recent change by timestamp wins; with version a change only applies when
+// the row is still at the client's base_updated_at.
+func syncPush(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var req struct {
+		EstablishmentID string           `json:"establishment_id"`
+		Strategy        string           `json:"strategy"`
+		Changes         []SyncPushChange `json:"changes"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if req.Strategy == "" {
+		req.Strategy = syncVersion
+	}
+	if req.Strategy != syncVersion && req.Strategy != syncLastWriteWins {
+		http.Error(w, "strategy must be version or last_write_wins", http.StatusUnprocessableEntity)
+		return
+	}
+	if len(req.Changes) > maxSyncPushChanges {
+		http.Error(w, fmt.Sprintf("at most %d changes per push", maxSyncPushChanges), http.StatusRequestEntityTooLarge)
+		return
+	}
+	if req.EstablishmentID == "" {
+		http.Error(w, "establishment_id is required", http.StatusBadRequest)
+		return
+	}
+	if !requireRole(w, r, db, req.EstablishmentID, "staff") {
+		return
+	}
+
+	results := []SyncPushResult{}
+	applied := false
+	for _, ch := range req.Changes {
+		res, err := applySyncChange(db, r, req.EstablishmentID, req.Strategy, ch)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		applied = applied || res.Status == "applied"
+		results = append(results, res)
+	}
+	if applied {
+		responseCache.Invalidate(req.EstablishmentID)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]any{"results": results})
+}
+
+// applySyncChange returns an error only for server failures; invalid changes
+// and conflicts are reported in the result.
+func applySyncChange(db *sql.DB, r *http.Request, establishmentID, strategy string, ch SyncPushChange) (SyncPushResult, error) {
+	res := SyncPushResult{Type: ch.Type, ID: ch.ID, Status: "rejected"}
+	table, ok := syncTables[ch.Type]
+	switch {
+	case !ok:
+		res.Error = "type must be product or category"
+	case ch.Op != "upsert" && ch.Op != "delete":
+		res.Error = "op must be upsert or delete"
+	case !uuidPattern.MatchString(ch.ID):
+		res.Error = "id must be a UUID"
+	case strategy == syncLastWriteWins && ch.ClientUpdatedAt.IsZero():
+		res.Error = "client_updated_at is required for last_write_wins"
+	}
+	if res.Error != "" {
+		return res, nil
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		return res, err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext($1))`, establishmentID); err != nil {
+		return res, err
+	}
+	var owner string
+	var serverUpdated time.Time
+	err = tx.QueryRow(`SELECT establishment_id, updated_at FROM `+table+` WHERE id=$1 FOR UPDATE`, ch.ID).Scan(&owner, &serverUpdated)
+	exists := err == nil
+	if err != nil && err != sql.ErrNoRows {
+		return res, err
+	}
+	if exists && owner != establishmentID {
+		res.Error = "not found in this establishment"
+		return res, nil
+	}
+
+	switch {
+	case exists && syncConflict(strategy, ch, serverUpdated):
+		res.Status = "conflict"
+		res.Server, err = loadSyncEntity(tx, ch.Type, ch.ID)
+		return res, err
+	case !exists && ch.Op == "delete":
+		res.Status = "applied"
+		return res, nil
+	case !exists && ch.BaseUpdatedAt != nil:
+		// The client edited a row that was deleted here since it last synced.
+		var deletedAt time.Time
+		err := tx.QueryRow(`SELECT deleted_at FROM sync_tombstones WHERE entity_type=$1 AND entity_id=$2`, ch.Type, ch.ID).Scan(&deletedAt)
+		if err != nil && err != sql.ErrNoRows {
+			return res, err
+		}
+		if strategy == syncVersion || !ch.ClientUpdatedAt.After(deletedAt) {
+			res.Status, res.Error = "conflict", "deleted on the server"
+			return res, nil
+		}
+	}
+
+	if ch.Op == "delete" {
+		if ch.Type == "product" {
+			var allowed bool
+			if allowed, err = permitted(tx, r, establishmentID, "prices"); err == nil && !allowed {
+				res.Error = "your role can't remove products in this establishment"
+				return res, nil
+			}
+			if err == nil {
+				_, err = deleteProductRow(tx, ch.ID)
+			}
+		} else {
+			_, err = deleteCategoryRow(tx, ch.ID, false)
+		}
+		if err != nil {
+			res.Error = err.Error()
+			return res, nil
+		}
+	} else {
+		if msg := upsertSyncEntity(tx, r, establishmentID, ch, exists); msg != "" {
+			res.Error = msg
+			return res, nil
+		}
+		if _, err := tx.Exec(`DELETE FROM sync_tombstones WHERE entity_type=$1 AND entity_id=$2`, ch.Type, ch.ID); err != nil {
+			return res, err
+		}
+		if res.Server, err = loadSyncEntity(tx, ch.Type, ch.ID); err != nil {
+			return res, err
+		}
+	}
+	if err := tx.Commit(); err != nil {
+		return res, err
+	}
+	res.Status = "applied"
+	return res, nil
+}
+
+func syncConflict(strategy string, ch SyncPushChange, serverUpdated time.Time) bool {
+	if strategy == syncVersion {
+		return ch.BaseUpdatedAt == nil || serverUpdated.After(*ch.BaseUpdatedAt)
+	}
+	return !ch.ClientUpdatedAt.After(serverUpdated)
+}
+
+// upsertSyncEntity validates and writes an upsert the same way the REST
+// endpoints do, returning a message when the change is invalid. Database
+// errors are returned as messages too, since they usually stem from the data.
+func upsertSyncEntity(tx *sql.Tx, r *http.Request, establishmentID string, ch SyncPushChange, exists bool) string {
+	if ch.Type == "category" {
+		var c ProductCategory
+		if err := json.Unmarshal(ch.Data, &c); err != nil {
+			return err.Error()
+		}
+		c.ID, c.EstablishmentID = ch.ID, establishmentID
+		sanitizeFields(&c.Name, &c.Description)
+		if msg := normalizeAltText(&c.AltText); msg != "" {
+			return msg
+		}
+		existingID := ""
+		if exists {
+			existingID = ch.ID
+		}
+		if err := validateCategoryParent(tx, existingID, establishmentID, c.ParentID); err != nil {
+			return err.Error()
+		}
+		var err error
+		if exists {
+			err = updateCategoryRow(tx, ch.ID, &c)
+		} else {
+			err = insertCategory(tx, &c)
+		}
+		if err != nil {
+			return err.Error()
+		}
+		return ""
+	}
+
+	var p Product
+	if err := json.Unmarshal(ch.Data, &p); err != nil {
+		return err.Error()
+	}
+	p.ID, p.EstablishmentID = ch.ID, establishmentID
+	sanitizeFields(&p.Name, &p.Description)
+	if msg := normalizeAltText(&p.AltText); msg != "" {
+		return msg
+	}
+	if msg := normalizeFulfillmentTypes(&p.FulfillmentTypes); msg != "" {
+		return msg
+	}
+	if msg := normalizeBarcode(&p.Barcode); msg != "" {
+		return msg
+	}
+	msg, err := validateProductCustomFields(tx, &p, !exists)
+	if err != nil {
+		return err.Error()
+	}
+	if msg != "" {
+		return msg
+	}
+	var price int
+	if exists {
+		if err := tx.QueryRow(`SELECT price_cents FROM products WHERE id=$1`, ch.ID).Scan(&price); err != nil {
+			return err.Error()
+		}
+	}
+	if !exists || price != p.PriceCents {
+		allowed, err := permitted(tx, r, establishmentID, "prices")
+		if err != nil {
+			return err.Error()
+		}
+		if !allowed {
+			return "your role can't change prices in this establishment"
+		}
+	}
+	eventType := eventProductUpdated
+	if exists {
+		err = updateProductRow(tx, ch.ID, &p)
+	} else {
+		err = insertProduct(tx, &p)
+		eventType = eventProductCreated
+	}
+	if isUniqueViolation(err) {
+		return "another product in this establishment has this barcode"
+	}
+	if err != nil {
+		return err.Error()
+	}
+	if err := recordPriceChanges(tx, r, ch.ID); err != nil {
+		return err.Error()
+	}
+	if err := enqueueEvent(tx, Event{Type: eventType, ProductID: ch.ID, EstablishmentID: establishmentID}); err != nil {
+		return err.Error()
+	}
+	return ""
+}
+
+func loadSyncEntity(q queryer, entityType, id string) (any, error) {
+	if entityType == "category" {
+		var c SyncCategory
+		err := q.QueryRow(`SELECT id, establishment_id, parent_id, name, description, image_key, image_alt_text, banner_key, updated_at FROM product_categories WHERE id=$1`, id).Scan(
+			&c.ID, &c.EstablishmentID, &c.ParentID, &c.Name, &c.Description, &c.ImageKey, &c.AltText, &c.BannerKey, &c.UpdatedAt,
+		)
+		c.ImageURL, c.BannerURL = assetURL(c.ImageKey), assetURL(c.BannerKey)
+		return c, err
+	}
+	var p SyncProduct
+	var custom []byte
+	err := q.QueryRow(`SELECT id, establishment_id, category_id, name, description, price_cents, image_key, image_alt_text, banner_key, is_active, fulfillment_types, stock_quantity, barcode, custom_fields, updated_at FROM products WHERE id=$1`, id).Scan(
+		&p.ID, &p.EstablishmentID, &p.CategoryID, &p.Name, &p.Description, &p.PriceCents, &p.ImageKey, &p.AltText, &p.BannerKey, &p.IsActive, pq.Array(&p.FulfillmentTypes), &p.Stock, &p.Barcode, &custom, &p.UpdatedAt,
+	)
+	json.Unmarshal(custom, &p.CustomFields)
+	p.ImageURL, p.BannerURL = assetURL(p.ImageKey), assetURL(p.BannerKey)
+	return p, err
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"sort"
+)
+
+type TemplateCategory struct {
+	Name     string   `json:"name"`
+	Products []string `json:"products"`
+}
+
+type MenuTemplate struct {
+	Key        string             `json:"key"`
+	Name       string             `json:"name"`
+	Categories []TemplateCategory `json:"categories"`
+}
+
+// menuTemplates is the built-in starter menu library. Products are created
+// inactive and unpriced so a template never publishes placeholder items.
+var menuTemplates = map[string]MenuTemplate{
+	"pizzaria": {Key: "pizzaria", Name: "Pizzaria", Categories: []TemplateCategory{
+		{Name: "Pizzas salgadas", Products: []string{"Margherita", "Calabresa", "Portuguesa", "Quatro queijos", "Frango com catupiry"}},
+		{Name: "Pizzas doces", Products: []string{"Chocolate", "Romeu e Julieta"}},
+		{Name: "Bebidas", Products: []string{"Refrigerante lata", "Refrigerante 2L", "Água mineral"}},
+	}},
+	"hamburgueria": {Key: "hamburgueria", Name: "Hamburgueria", Categories: []TemplateCategory{
+		{Name: "Hambúrgueres", Products: []string{"X-Burguer", "X-Salada", "X-Bacon", "X-Tudo"}},
+		{Name: "Acompanhamentos", Products: []string{"Batata frita", "Onion rings"}},
+		{Name: "Bebidas", Products: []string{"Refrigerante lata", "Suco natural", "Milkshake"}},
+	}},
+	"japones": {Key: "japones", Name: "Japonês", Categories: []TemplateCategory{
+		{Name: "Entradas", Products: []string{"Sunomono", "Guioza", "Missoshiru"}},
+		{Name: "Sushis e sashimis", Products: []string{"Niguiri de salmão", "Sashimi de salmão", "Uramaki Filadélfia", "Hot roll"}},
+		{Name: "Temakis", Products: []string{"Temaki de salmão", "Temaki Califórnia"}},
+		{Name: "Combinados", Products: []string{"Combinado 20 peças", "Combinado 40 peças"}},
+		{Name: "Bebidas", Products: []string{"Refrigerante lata", "Chá verde"}},
+	}},
+}
+
+func menuTemplatesHandler(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	list := []MenuTemplate{}
+	for _, t := range menuTemplates {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].Key < list[j].Key })
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// applyMenuTemplate creates the template's categories and placeholder products
+// in one transaction. Applying a template twice creates a second copy; it is
+// meant for new establishments.
+func applyMenuTemplate(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	var req struct {
+		Template string `json:"template"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	t, ok := menuTemplates[req.Template]
+	if !ok {
+		http.Error(w, "unknown template", http.StatusUnprocessableEntity)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.Exec(`SELECT pg_advisory_xact_lock(hashtext($1))`, establishmentID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	var productIDs []string
+	categories := 0
+	for _, c := range t.Categories {
+		var categoryID string
+		err := tx.QueryRow(
+			`INSERT INTO product_categories (establishment_id, name, description, image_key, banner_key) VALUES ($1,$2,'','','') RETURNING id`,
+			establishmentID, c.Name,
+		).Scan(&categoryID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		categories++
+		for _, name := range c.Products {
+			var productID string
+			err := tx.QueryRow(
+				`INSERT INTO products (establishment_id, category_id, name, description, price_cents, image_key, banner_key, is_active) VALUES ($1,$2,$3,'',0,'','',false) RETURNING id`,
+				establishmentID, categoryID, name,
+			).Scan(&productID)
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			if err := enqueueEvent(tx, Event{Type: eventProductCreated, ProductID: productID, EstablishmentID: establishmentID}); err != nil {
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			productIDs = append(productIDs, productID)
+		}
+	}
+	if err := recordPriceChanges(tx, r, productIDs...); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := recordAudit(tx, r, establishmentID, "menu.template_applied", "establishment", establishmentID, req); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	responseCache.Invalidate(establishmentID)
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(map[string]int{"categories": categories, "products": len(productIDs)})
+}
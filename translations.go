@@ -0,0 +1,401 @@
+package main
+
+import (
+	"context"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"log"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Menus are written in Portuguese. Owners can translate product and
+// category names and descriptions into the languages below, and the menu
+// serves them with ?lang=. When a translation is missing and the
+// establishment opted into auto_translate, the menu asks the configured
+// provider, stores the result flagged as auto-generated and serves it; the
+// owner can review and overwrite it later. Auto-generated translations are
+// redone when the source text changes; the owner's are never overwritten.
+
+const (
+	menuSourceLanguage = "pt-BR"
+	// translationBatchSize bounds the texts sent per provider call.
+	translationBatchSize = 50
+	translationTimeout   = 10 * time.Second
+	// defaultTranslationsPerHour caps provider calls per establishment.
+	defaultTranslationsPerHour = 20
+)
+
+// menuLanguages maps each supported target language to the codes DeepL and
+// Google use for it.
+var menuLanguages = map[string]struct{ deepl, google string }{
+	"en": {"EN-US", "en"},
+	"es": {"ES", "es"},
+}
+
+// Translator machine-translates texts from menuSourceLanguage into lang,
+// returning them in the same order.
+type Translator interface {
+	Name() string
+	Translate(ctx context.Context, texts []string, lang string) ([]string, error)
+}
+
+// translator is nil when no provider is configured.
+var translator Translator
+
+var translationLimiter = newWindowLimiter(time.Hour, defaultTranslationsPerHour)
+
+type Translation struct {
+	EntityType  string `json:"entity_type"`
+	EntityID    string `json:"entity_id"`
+	Lang        string `json:"lang"`
+	Name        string `json:"name"`
+	Description string `json:"description"`
+	// AutoGenerated is true until the owner saves the translation.
+	AutoGenerated bool      `json:"auto_generated"`
+	Provider      string    `json:"provider,omitempty"`
+	UpdatedAt     time.Time `json:"updated_at"`
+}
+
+// newTranslatorFromEnv picks the provider from TRANSLATION_PROVIDER (deepl
+// or google) with TRANSLATION_API_KEY. DeepL free-plan keys, ending in
+// ":fx", use the free API host.
+func newTranslatorFromEnv() Translator {
+	key := os.Getenv("TRANSLATION_API_KEY")
+	switch os.Getenv("TRANSLATION_PROVIDER") {
+	case "deepl":
+		host := "https://api.deepl.com"
+		if strings.HasSuffix(key, ":fx") {
+			host = "https://api-free.deepl.com"
+		}
+		return deeplTranslator{baseURL: host, apiKey: key}
+	case "google":
+		return googleTranslator{apiKey: key}
+	case "":
+		return nil
+	default:
+		log.Printf("unknown TRANSLATION_PROVIDER %q, machine translation disabled", os.Getenv("TRANSLATION_PROVIDER"))
+		return nil
+	}
+}
+
+type deeplTranslator struct {
+	baseURL, apiKey string
+}
+
+func (deeplTranslator) Name() string { return "deepl" }
+
+func (t deeplTranslator) Translate(ctx context.Context, texts []string, lang string) ([]string, error) {
+	payload := map[string]any{"text": texts, "source_lang": "PT", "target_lang": menuLanguages[lang].deepl}
+	var body struct {
+		Translations []struct {
+			Text string `json:"text"`
+		} `json:"translations"`
+	}
+	headers := map[string]string{"Authorization": "DeepL-Auth-Key " + t.apiKey}
+	if err := postJSON(ctx, t.baseURL+"/v2/translate", headers, payload, &body); err != nil {
+		return nil, err
+	}
+	out := make([]string, len(body.Translations))
+	for i, tr := range body.Translations {
+		out[i] = tr.Text
+	}
+	return out, nil
+}
+
+type googleTranslator struct {
+	apiKey string
+}
+
+func (googleTranslator) Name() string { return "google" }
+
+func (t googleTranslator) Translate(ctx context.Context, texts []string, lang string) ([]string, error) {
+	payload := map[string]any{"q": texts, "source": "pt", "target": menuLanguages[lang].google, "format": "text"}
+	var body struct {
+		Data struct {
+			Translations []struct {
+				TranslatedText string `json:"translatedText"`
+			} `json:"translations"`
+		} `json:"data"`
+	}
+	endpoint := "https://translation.googleapis.com/language/translate/v2?key=" + url.QueryEscape(t.apiKey)
+	if err := postJSON(ctx, endpoint, nil, payload, &body); err != nil {
+		return nil, err
+	}
+	out := make([]string, len(body.Data.Translations))
+	for i, tr := range body.Data.Translations {
+		out[i] = tr.TranslatedText
+	}
+	return out, nil
+}
+
+// translatable points at the fields of a menu entry that get translated.
+type translatable struct {
+	entityType, id   string
+	name, desc, html *string
+	machine          *bool
+}
+
+// sourceHash identifies the text an auto-generated translation was made
+// from.
+func (t translatable) sourceHash() string {
+	sum := sha256.Sum256([]byte(*t.name + "\x00" + *t.desc))
+	return hex.EncodeToString(sum[:8])
+}
+
+// translateMenu replaces names and descriptions with their lang
+// translations, machine-translating missing ones when the establishment
+// allows it. Provider failures are logged and leave the source text.
+func translateMenu(ctx context.Context, db *sql.DB, establishmentID, lang string, items []translatable) error {
+	if len(items) == 0 {
+		return nil
+	}
+	ids := make([]string, len(items))
+	for i, it := range items {
+		ids[i] = it.id
+	}
+	rows, err := db.Query(
+		`SELECT entity_type, entity_id, name, description, auto_generated, source_hash FROM translations
+		 WHERE establishment_id=$1 AND lang=$2 AND entity_id::text = ANY($3)`,
+		establishmentID, lang, pq.Array(ids),
+	)
+	if err != nil {
+		return err
+	}
+	type stored struct {
+		name, desc, hash string
+		auto             bool
+	}
+	found := map[string]stored{}
+	for rows.Next() {
+		var entityType, id string
+		var s stored
+		if err := rows.Scan(&entityType, &id, &s.name, &s.desc, &s.auto, &s.hash); err != nil {
+			rows.Close()
+			return err
+		}
+		found[entityType+":"+id] = s
+	}
+	rows.Close()
+	if err := rows.Err(); err != nil {
+		return err
+	}
+
+	var missing []translatable
+	for _, it := range items {
+		s, ok := found[it.entityType+":"+it.id]
+		if !ok || s.auto && s.hash != it.sourceHash() {
+			missing = append(missing, it)
+			continue
+		}
+		applyTranslation(it, s.name, s.desc, s.auto)
+	}
+	if len(missing) == 0 || translator == nil {
+		return nil
+	}
+	enabled, err := settingBool(db, establishmentID, "auto_translate")
+	if err != nil {
+		return err
+	}
+	if !enabled {
+		return nil
+	}
+	for start := 0; start < len(missing); start += translationBatchSize {
+		batch := missing[start:min(start+translationBatchSize, len(missing))]
+		if !translationLimiter.allow(establishmentID) {
+			log.Printf("machine translation limit reached for establishment %s", establishmentID)
+			return nil
+		}
+		if err := machineTranslate(ctx, db, establishmentID, lang, batch); err != nil {
+			log.Printf("machine translation via %s failed: %v", translator.Name(), err)
+			return nil
+		}
+	}
+	return nil
+}
+
+// machineTranslate translates the batch's names and non-empty descriptions
+// in one provider call, stores them and applies them.
+func machineTranslate(ctx context.Context, db *sql.DB, establishmentID, lang string, batch []translatable) error {
+	var texts []string
+	for _, it := range batch {
+		texts = append(texts, *it.name)
+		if *it.desc != "" {
+			texts = append(texts, *it.desc)
+		}
+	}
+	ctx, cancel := context.WithTimeout(ctx, translationTimeout)
+	defer cancel()
+	out, err := translator.Translate(ctx, texts, lang)
+	if err != nil {
+		return err
+	}
+	if len(out) != len(texts) {
+		return errors.New("provider returned a different number of texts")
+	}
+	for _, it := range batch {
+		name, desc := sanitizeText(out[0]), ""
+		out = out[1:]
+		if *it.desc != "" {
+			desc, out = sanitizeText(out[0]), out[1:]
+		}
+		_, err := db.Exec(
+			`INSERT INTO translations (establishment_id, entity_type, entity_id, lang, name, description, auto_generated, provider, source_hash)
+			 VALUES ($1,$2,$3,$4,$5,$6,true,$7,$8)
+			 ON CONFLICT (entity_type, entity_id, lang) DO UPDATE SET name=EXCLUDED.name, description=EXCLUDED.description,
+			   provider=EXCLUDED.provider, source_hash=EXCLUDED.source_hash, updated_at=now()
+			 WHERE translations.auto_generated`,
+			establishmentID, it.entityType, it.id, lang, name, desc, translator.Name(), it.sourceHash(),
+		)
+		if err != nil {
+			return err
+		}
+		applyTranslation(it, name, desc, true)
+	}
+	return nil
+}
+
+func applyTranslation(it translatable, name, desc string, auto bool) {
+	if name != "" {
+		*it.name = name
+	}
+	if desc != "" {
+		*it.desc = desc
+		if it.html != nil && *it.html != "" {
+			*it.html = renderMarkdown(desc)
+		}
+	}
+	*it.machine = auto
+}
+
+// translationsRoute lists the establishment's translations for ?lang= and
+// saves the owner's edits with PUT, which clears the auto-generated flag.
+func translationsRoute(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	if !requireRole(w, r, db, establishmentID, "manager") {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		listTranslations(w, r, db, establishmentID)
+	case http.MethodPut:
+		saveTranslation(w, r, db, establishmentID)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func listTranslations(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	lang := r.URL.Query().Get("lang")
+	if _, ok := menuLanguages[lang]; !ok {
+		http.Error(w, "lang must be en or es", http.StatusBadRequest)
+		return
+	}
+	rows, err := db.Query(
+		`SELECT entity_type, entity_id, lang, name, description, auto_generated, COALESCE(provider,''), updated_at FROM translations
+		 WHERE establishment_id=$1 AND lang=$2 ORDER BY auto_generated DESC, entity_type, name`,
+		establishmentID, lang,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	list := []Translation{}
+	for rows.Next() {
+		var t Translation
+		if err := rows.Scan(&t.EntityType, &t.EntityID, &t.Lang, &t.Name, &t.Description, &t.AutoGenerated, &t.Provider, &t.UpdatedAt); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		list = append(list, t)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+func saveTranslation(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	var t Translation
+	if err := json.NewDecoder(r.Body).Decode(&t); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, ok := menuLanguages[t.Lang]; !ok {
+		http.Error(w, "lang must be en or es", http.StatusUnprocessableEntity)
+		return
+	}
+	var table string
+	switch t.EntityType {
+	case "product":
+		table = "products"
+	case "category":
+		table = "product_categories"
+	default:
+		http.Error(w, "entity_type must be product or category", http.StatusUnprocessableEntity)
+		return
+	}
+	sanitizeFields(&t.Name, &t.Description)
+	if t.Name == "" {
+		http.Error(w, "name is required", http.StatusUnprocessableEntity)
+		return
+	}
+	var ok bool
+	err := db.QueryRow(`SELECT EXISTS (SELECT 1 FROM `+table+` WHERE id::text=$1 AND establishment_id=$2)`, t.EntityID, establishmentID).Scan(&ok)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if !ok {
+		http.Error(w, t.EntityType+" not found", http.StatusUnprocessableEntity)
+		return
+	}
+	err = db.QueryRow(
+		`INSERT INTO translations (establishment_id, entity_type, entity_id, lang, name, description, auto_generated)
+		 VALUES ($1,$2,$3,$4,$5,$6,false)
+		 ON CONFLICT (entity_type, entity_id, lang) DO UPDATE SET name=EXCLUDED.name, description=EXCLUDED.description,
+		   auto_generated=false, provider=NULL, source_hash='', updated_at=now()
+		 RETURNING updated_at`,
+		establishmentID, t.EntityType, t.EntityID, t.Lang, t.Name, t.Description,
+	).Scan(&t.UpdatedAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	t.AutoGenerated, t.Provider = false, ""
+	responseCache.Invalidate(establishmentID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(t)
+}
+
+// updateAutoTranslate turns machine translation of the menu on or off.
+func updateAutoTranslate(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	if !requireRole(w, r, db, establishmentID, "manager") {
+		return
+	}
+	var s struct {
+		Enabled bool `json:"enabled"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&s); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	d, _ := findSetting("auto_translate")
+	if err := storeSetting(db, establishmentID, d, s.Enabled); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := recordAudit(db, r, establishmentID, "establishment.auto_translate_updated", "establishment", establishmentID, s); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	responseCache.Invalidate(establishmentID)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(s)
+}
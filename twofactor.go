@@ -0,0 +1,413 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"database/sql"
+	"encoding/base32"
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	totpIssuer      = "Cardapio"
+	totpPeriod      = 30
+	mfaTokenTTL     = 5 * time.Minute
+	enrollTokenTTL  = 15 * time.Minute
+	backupCodeCount = 10
+	// mfaTokenMaxFailures wrong codes burn an mfa token, forcing a new
+	// password login; they also count toward the account lockout.
+	mfaTokenMaxFailures = 3
+)
+
+var totpEncoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// mfaFailures counts wrong codes per mfa token. allow fails once the token
+// already has mfaTokenMaxFailures-1 recorded, i.e. on the last permitted one.
+var mfaFailures = newWindowLimiter(mfaTokenTTL, mfaTokenMaxFailures-1)
+
+type LoginResponse struct {
+	*TokenResponse
+	MFARequired        bool   `json:"mfa_required,omitempty"`
+	MFAToken           string `json:"mfa_token,omitempty"`
+	EnrollmentRequired bool   `json:"enrollment_required,omitempty"`
+	EnrollmentToken    string `json:"enrollment_token,omitempty"`
+}
+
+func totpCode(secret []byte, step int64) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], uint64(step))
+	mac := hmac.New(sha1.New, secret)
+	mac.Write(msg[:])
+	sum := mac.Sum(nil)
+	off := sum[len(sum)-1] & 0x0f
+	v := binary.BigEndian.Uint32(sum[off:off+4]) & 0x7fffffff
+	return fmt.Sprintf("%06d", v%1000000)
+}
+
+// verifyTOTP accepts codes from the previous, current and next period but
+// never a period at or before lastStep, so a code cannot be replayed.
+func verifyTOTP(secretB32, code string, lastStep int64) (int64, bool) {
+	secret, err := totpEncoding.DecodeString(secretB32)
+	if err != nil {
+		return 0, false
+	}
+	now := time.Now().Unix() / totpPeriod
+	for _, step := range []int64{now - 1, now, now + 1} {
+		if step > lastStep && hmac.Equal([]byte(totpCode(secret, step)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// ownerLoginResponse decides what a successful password check yields: a full
+// access token, a short-lived token to complete the TOTP challenge, or a
+// token restricted to 2FA enrollment when an establishment policy demands it.
+func ownerLoginResponse(db *sql.DB, r *http.Request, ownerID string) (LoginResponse, error) {
+	var enabled, required bool
+	err := db.QueryRow(
+		`SELECT totp_enabled, EXISTS(
+		   SELECT 1 FROM establishment_staff s JOIN establishments e ON e.id=s.establishment_id
+		   WHERE s.owner_id=o.id AND e.require_2fa AND s.role IN ('manager','owner'))
+		 FROM owners o WHERE o.id=$1`,
+		ownerID,
+	).Scan(&enabled, &required)
+	if err != nil {
+		return LoginResponse{}, err
+	}
+	switch {
+	case enabled:
+		tok, err := issueToken(ownerID, "mfa", mfaTokenTTL)
+		return LoginResponse{MFARequired: true, MFAToken: tok.AccessToken}, err
+	case required:
+		tok, err := issueToken(ownerID, "owner_enroll", enrollTokenTTL)
+		return LoginResponse{EnrollmentRequired: true, EnrollmentToken: tok.AccessToken}, err
+	default:
+		tok, err := startOwnerSession(db, r, ownerID)
+		return LoginResponse{TokenResponse: &tok}, err
+	}
+}
+
+func twoFactorRoute(w http.ResponseWriter, r *http.Request, db *sql.DB, action string) {
+	if r.Method != http.MethodPost {
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	switch action {
+	case "enroll":
+		authenticate(db, func(w http.ResponseWriter, r *http.Request) { enrollTwoFactor(w, r, db) })(w, r)
+	case "activate":
+		authenticate(db, func(w http.ResponseWriter, r *http.Request) { activateTwoFactor(w, r, db) })(w, r)
+	case "disable":
+		authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) { disableTwoFactor(w, r, db) })(w, r)
+	case "verify":
+		verifyTwoFactor(w, r, db)
+	default:
+		http.NotFound(w, nil)
+	}
+}
+
+func enrollingOwner(w http.ResponseWriter, r *http.Request) (string, bool) {
+	c := currentClaims(r)
+	if c.Typ != "owner" && c.Typ != "owner_enroll" {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return "", false
+	}
+	return c.Sub, true
+}
+
+func enrollTwoFactor(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	ownerID, ok := enrollingOwner(w, r)
+	if !ok {
+		return
+	}
+	secret := make([]byte, 20)
+	if _, err := rand.Read(secret); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	encoded := totpEncoding.EncodeToString(secret)
+
+	var email string
+	var enabled bool
+	err := db.QueryRow(
+		`UPDATE owners SET totp_secret=CASE WHEN totp_enabled THEN totp_secret ELSE $1 END WHERE id=$2 RETURNING email, totp_enabled`,
+		encoded, ownerID,
+	).Scan(&email, &enabled)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if enabled {
+		http.Error(w, "two-factor authentication already enabled", http.StatusConflict)
+		return
+	}
+
+	q := url.Values{"secret": {encoded}, "issuer": {totpIssuer}, "period": {fmt.Sprint(totpPeriod)}, "digits": {"6"}}
+	uri := "otpauth://totp/" + url.PathEscape(totpIssuer+":"+email) + "?" + q.Encode()
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]string{"secret": encoded, "provisioning_uri": uri})
+}
+
+func activateTwoFactor(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	ownerID, ok := enrollingOwner(w, r)
+	if !ok {
+		return
+	}
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+
+	var secret sql.NullString
+	var enabled bool
+	err = tx.QueryRow(`SELECT totp_secret, totp_enabled FROM owners WHERE id=$1 FOR UPDATE`, ownerID).Scan(&secret, &enabled)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if enabled || !secret.Valid {
+		http.Error(w, "no pending two-factor enrollment", http.StatusConflict)
+		return
+	}
+	step, ok := verifyTOTP(secret.String, req.Code, 0)
+	if !ok {
+		http.Error(w, "invalid code", http.StatusUnprocessableEntity)
+		return
+	}
+	if _, err := tx.Exec(`UPDATE owners SET totp_enabled=true, totp_last_step=$1, updated_at=now() WHERE id=$2`, step, ownerID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	codes, err := replaceBackupCodes(tx, ownerID)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	resp := map[string]any{"backup_codes": codes}
+	if currentClaims(r).Typ == "owner_enroll" {
+		tok, err := startOwnerSession(db, r, ownerID)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		resp["token"] = tok
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(resp)
+}
+
+func replaceBackupCodes(tx *sql.Tx, ownerID string) ([]string, error) {
+	if _, err := tx.Exec(`DELETE FROM owner_backup_codes WHERE owner_id=$1`, ownerID); err != nil {
+		return nil, err
+	}
+	codes := make([]string, backupCodeCount)
+	for i := range codes {
+		b := make([]byte, 5)
+		if _, err := rand.Read(b); err != nil {
+			return nil, err
+		}
+		code := strings.ToLower(totpEncoding.EncodeToString(b))
+		codes[i] = code
+		if _, err := tx.Exec(`INSERT INTO owner_backup_codes (owner_id, code_hash) VALUES ($1,$2)`, ownerID, hashToken(code)); err != nil {
+			return nil, err
+		}
+	}
+	return codes, nil
+}
+
+func disableTwoFactor(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var req struct {
+		Code string `json:"code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	ownerID := currentClaims(r).Sub
+	var secret sql.NullString
+	var lastStep int64
+	var required bool
+	err := db.QueryRow(
+		`SELECT totp_secret, totp_last_step, EXISTS(
+		   SELECT 1 FROM establishment_staff s JOIN establishments e ON e.id=s.establishment_id
+		   WHERE s.owner_id=o.id AND e.require_2fa AND s.role IN ('manager','owner'))
+		 FROM owners o WHERE o.id=$1 AND o.totp_enabled`,
+		ownerID,
+	).Scan(&secret, &lastStep, &required)
+	if err == sql.ErrNoRows {
+		http.Error(w, "two-factor authentication is not enabled", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if required {
+		http.Error(w, "an establishment you manage requires two-factor authentication", http.StatusConflict)
+		return
+	}
+	if _, ok := verifyTOTP(secret.String, req.Code, lastStep); !ok {
+		http.Error(w, "invalid code", http.StatusUnprocessableEntity)
+		return
+	}
+	if _, err := db.Exec(`UPDATE owners SET totp_enabled=false, totp_secret=NULL, totp_last_step=0, updated_at=now() WHERE id=$1`, ownerID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if _, err := db.Exec(`DELETE FROM owner_backup_codes WHERE owner_id=$1`, ownerID); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+func verifyTwoFactor(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	var req struct {
+		MFAToken   string `json:"mfa_token"`
+		Code       string `json:"code"`
+		BackupCode string `json:"backup_code"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	c, err := parseJWT(req.MFAToken)
+	if err != nil || c.Typ != "mfa" {
+		http.Error(w, "invalid or expired mfa token", http.StatusUnauthorized)
+		return
+	}
+	var revoked, locked bool
+	err = db.QueryRow(
+		`SELECT EXISTS(SELECT 1 FROM revoked_tokens WHERE jti=$1), COALESCE((SELECT locked_until > now() FROM owners WHERE id=$2), false)`,
+		c.JTI, c.Sub,
+	).Scan(&revoked, &locked)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if revoked {
+		http.Error(w, "invalid or expired mfa token", http.StatusUnauthorized)
+		return
+	}
+	if locked {
+		http.Error(w, "account temporarily locked", http.StatusLocked)
+		return
+	}
+
+	if req.BackupCode != "" {
+		res, err := db.Exec(
+			`UPDATE owner_backup_codes SET used_at=now() WHERE owner_id=$1 AND code_hash=$2 AND used_at IS NULL`,
+			c.Sub, hashToken(strings.ToLower(strings.TrimSpace(req.BackupCode))),
+		)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			failTwoFactor(w, db, c)
+			return
+		}
+	} else {
+		var secret string
+		var lastStep int64
+		err := db.QueryRow(`SELECT totp_secret, totp_last_step FROM owners WHERE id=$1 AND totp_enabled`, c.Sub).Scan(&secret, &lastStep)
+		if err != nil {
+			failTwoFactor(w, db, c)
+			return
+		}
+		step, ok := verifyTOTP(secret, req.Code, lastStep)
+		if !ok {
+			failTwoFactor(w, db, c)
+			return
+		}
+		res, err := db.Exec(`UPDATE owners SET totp_last_step=$1 WHERE id=$2 AND totp_last_step < $1`, step, c.Sub)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		if n, _ := res.RowsAffected(); n == 0 {
+			failTwoFactor(w, db, c)
+			return
+		}
+	}
+
+	if _, err := db.Exec(`UPDATE owners SET failed_logins=0, locked_until=NULL WHERE id=$1`, c.Sub); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := revokeToken(db, c); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	tok, err := startOwnerSession(db, r, c.Sub)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(tok)
+}
+
+func updateEstablishmentSecurity(w http.ResponseWriter, r *http.Request, db *sql.DB, id string) {
+	if !requireRole(w, r, db, id, "owner") {
+		return
+	}
+	var req struct {
+		Require2FA bool `json:"require_2fa"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if _, err := db.Exec(`UPDATE establishments SET require_2fa=$1, updated_at=now() WHERE id=$2`, req.Require2FA, id); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := recordAudit(db, r, id, "establishment.security_updated", "establishment", id, req); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// failTwoFactor answers a wrong code. The failure counts toward the owner's
+// login lockout, and the mfa token is revoked once it reaches
+// mfaTokenMaxFailures or the account locks, so codes can't be brute-forced
+// within the token's lifetime.
+func failTwoFactor(w http.ResponseWriter, db *sql.DB, c *Claims) {
+	locked, err := recordFailedLogin(db, c.Sub)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if locked || !mfaFailures.allow(c.JTI) {
+		if err := revokeToken(db, c); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	http.Error(w, "invalid code", http.StatusUnauthorized)
+}
@@ -0,0 +1,219 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"io"
+	"log"
+	"net/http"
+	"time"
+)
+
+const maxUploadSize = 10 << 20
+
+var uploadPurposes = map[string]bool{
+	"establishment_image":   true,
+	"establishment_banner":  true,
+	"category_image":        true,
+	"category_banner":       true,
+	"product_image":         true,
+	"product_banner":        true,
+	"review_photo":          true,
+	"verification_document": true,
+	"delivery_photo":        true,
+	"delivery_signature":    true,
+}
+
+// customerUploadPurposes are the purposes customers may upload for; every
+// other purpose is for owners only.
+var customerUploadPurposes = map[string]bool{"review_photo": true}
+
+// documentPurposes also accept PDFs, which are stored as uploaded.
+var documentPurposes = map[string]bool{"verification_document": true}
+
+// thumbnailPurposes get a thumbnail, stored next to the image, whose longer
+// side is at most this many pixels.
+var thumbnailPurposes = map[string]int{"review_photo": 320}
+
+var imageExtensions = map[string]string{
+	"image/jpeg": ".jpg",
+	"image/png":  ".png",
+	"image/webp": ".webp",
+	"image/gif":  ".gif",
+}
+
+type Upload struct {
+	Key         string `json:"key"`
+	Purpose     string `json:"purpose"`
+	ContentType string `json:"content_type"`
+	SizeBytes   int    `json:"size_bytes"`
+	// URL and ThumbnailURL are empty while ScanStatus is pending.
+	URL string `json:"url"`
+	// ThumbnailURL is only set for purposes that get a thumbnail.
+	ThumbnailURL string `json:"thumbnail_url,omitempty"`
+	// ScanStatus is pending until the virus scanner has cleared the file.
+	ScanStatus string    `json:"scan_status"`
+	CreatedAt  time.Time `json:"created_at"`
+}
+
+func uploadsHandler(db *sql.DB) http.HandlerFunc {
+	return authenticate(db, func(w http.ResponseWriter, r *http.Request) {
+		if typ := currentClaims(r).Typ; typ != "owner" && typ != "customer" {
+			http.Error(w, "forbidden", http.StatusForbidden)
+			return
+		}
+		if r.Method != http.MethodPost {
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+			return
+		}
+		createUpload(w, r, db)
+	})
+}
+
+// checkUploadPurpose writes an error and returns false unless the
+// authenticated user may upload for purpose.
+func checkUploadPurpose(w http.ResponseWriter, r *http.Request, purpose string) bool {
+	if !uploadPurposes[purpose] {
+		http.Error(w, "unknown upload purpose", http.StatusBadRequest)
+		return false
+	}
+	if currentClaims(r).Typ == "customer" && !customerUploadPurposes[purpose] {
+		http.Error(w, "forbidden", http.StatusForbidden)
+		return false
+	}
+	return true
+}
+
+func createUpload(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	r.Body = http.MaxBytesReader(w, r.Body, maxUploadSize+1<<20)
+	purpose := r.FormValue("purpose")
+	if !checkUploadPurpose(w, r, purpose) {
+		return
+	}
+	file, _, err := r.FormFile("file")
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	defer file.Close()
+	data, err := io.ReadAll(io.LimitReader(file, maxUploadSize+1))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	if len(data) > maxUploadSize {
+		http.Error(w, "file too large", http.StatusRequestEntityTooLarge)
+		return
+	}
+	u, ok := storeUpload(w, r, db, purpose, data)
+	if !ok {
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(u)
+}
+
+// storeUpload validates the file for its purpose, stores it with its
+// thumbnail and records it for the authenticated user. It returns false
+// after writing the error.
+func storeUpload(w http.ResponseWriter, r *http.Request, db *sql.DB, purpose string, data []byte) (*Upload, bool) {
+	c := currentClaims(r)
+	contentType := http.DetectContentType(data)
+	ext, ok := imageExtensions[contentType]
+	switch {
+	case documentPurposes[purpose] && contentType == "application/pdf":
+		ext = ".pdf"
+	case !ok:
+		uploadsRejected.Inc("content_type")
+		http.Error(w, "unsupported file type "+contentType, http.StatusUnsupportedMediaType)
+		return nil, false
+	default:
+		if data, ok = checkImageUpload(w, r, purpose, contentType, data); !ok {
+			return nil, false
+		}
+	}
+
+	name, err := randomToken(18)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	u := Upload{Key: purpose + "/" + name + ext, Purpose: purpose, ContentType: contentType, SizeBytes: len(data), ScanStatus: "clean"}
+	if virusScanner != nil {
+		u.ScanStatus = "pending"
+	}
+	if err := storage.Put(r.Context(), storedKey(u.Key), contentType, data); err != nil {
+		http.Error(w, err.Error(), http.StatusBadGateway)
+		return nil, false
+	}
+	var thumbnailKey *string
+	if side, ok := thumbnailPurposes[purpose]; ok {
+		thumb, err := thumbnailJPEG(contentType, data, side)
+		switch {
+		case err == errNoThumbnail:
+			thumbnailKey = &u.Key
+		case err != nil:
+			http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+			return nil, false
+		default:
+			key := purpose + "/thumb/" + name + ".jpg"
+			if err := storage.Put(r.Context(), storedKey(key), "image/jpeg", thumb); err != nil {
+				http.Error(w, err.Error(), http.StatusBadGateway)
+				return nil, false
+			}
+			thumbnailKey = &key
+		}
+		if u.ScanStatus == "clean" {
+			u.ThumbnailURL = assetURL(*thumbnailKey)
+		}
+	}
+	ownerID, customerID := &c.Sub, (*string)(nil)
+	if c.Typ == "customer" {
+		ownerID, customerID = nil, &c.Sub
+	}
+	err = db.QueryRow(
+		`INSERT INTO uploads (key, purpose, content_type, size_bytes, owner_id, customer_id, thumbnail_key, scan_status) VALUES ($1,$2,$3,$4,$5,$6,$7,$8) RETURNING created_at`,
+		u.Key, u.Purpose, u.ContentType, u.SizeBytes, ownerID, customerID, thumbnailKey, u.ScanStatus,
+	).Scan(&u.CreatedAt)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	if u.ScanStatus == "clean" {
+		u.URL = assetURL(u.Key)
+	}
+	return &u, true
+}
+
+// checkImageUpload validates, strips and moderates an image upload. It
+// returns the image to store, or false after writing the error.
+func checkImageUpload(w http.ResponseWriter, r *http.Request, purpose, contentType string, data []byte) ([]byte, bool) {
+	if err := validateImage(purpose, contentType, data); err != nil {
+		uploadsRejected.Inc("dimensions")
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return nil, false
+	}
+	data, err := stripImageMetadata(contentType, data)
+	if err != nil {
+		uploadsRejected.Inc("malformed")
+		http.Error(w, err.Error(), http.StatusUnprocessableEntity)
+		return nil, false
+	}
+	// Moderation fails closed: nothing is stored, and so nothing can become
+	// visible, until the provider has approved the image.
+	if imageModerator != nil {
+		verdict, err := imageModerator.Moderate(r.Context(), contentType, data)
+		if err != nil {
+			log.Printf("image moderation via %s failed: %v", imageModerator.Name(), err)
+			http.Error(w, "image moderation unavailable, try again later", http.StatusBadGateway)
+			return nil, false
+		}
+		if !verdict.Allowed {
+			uploadsRejected.Inc("moderation")
+			http.Error(w, "image rejected by moderation: "+verdict.Reason, http.StatusUnprocessableEntity)
+			return nil, false
+		}
+	}
+	return data, true
+}
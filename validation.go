@@ -0,0 +1,121 @@
+package main
+
+import (
+	"net/mail"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+var (
+	e164Pattern      = regexp.MustCompile(`^\+[1-9][0-9]{7,14}$`)
+	instagramPattern = regexp.MustCompile(`^[A-Za-z0-9._]{1,30}$`)
+)
+
+func digitsOnly(s string) string {
+	return strings.Map(func(r rune) rune {
+		if r >= '0' && r <= '9' {
+			return r
+		}
+		return -1
+	}, s)
+}
+
+func validCNPJ(cnpj string) bool {
+	if len(cnpj) != 14 || strings.Count(cnpj, cnpj[:1]) == 14 {
+		return false
+	}
+	check := func(n int) byte {
+		weights := []int{6, 5, 4, 3, 2, 9, 8, 7, 6, 5, 4, 3, 2}[13-n:]
+		sum := 0
+		for i, wgt := range weights {
+			sum += int(cnpj[i]-'0') * wgt
+		}
+		d := sum % 11
+		if d < 2 {
+			return '0'
+		}
+		return byte('0' + 11 - d)
+	}
+	return cnpj[12] == check(12) && cnpj[13] == check(13)
+}
+
+func validE164(phone string) bool {
+	return e164Pattern.MatchString(phone)
+}
+
+// normalizePhone rewrites a phone number as typed, e.g. "(11) 99999-8888",
+// "011 99999 8888" or "+55 11 99999-8888", in E.164. Numbers without a
+// country code are taken as Brazilian. The result is only a valid E.164
+// number if the input was a plausible phone number; check with validE164.
+func normalizePhone(phone string) string {
+	phone = strings.TrimSpace(phone)
+	digits := digitsOnly(phone)
+	switch {
+	case digits == "":
+		return ""
+	case strings.HasPrefix(phone, "+"):
+	case strings.HasPrefix(digits, "00"):
+		digits = digits[2:]
+	case strings.HasPrefix(digits, "0") && (len(digits) == 11 || len(digits) == 12):
+		digits = "55" + digits[1:]
+	case len(digits) == 10 || len(digits) == 11:
+		digits = "55" + digits
+	}
+	return "+" + digits
+}
+
+// normalizeEstablishment trims and canonicalizes the contact fields in place
+// and returns a list of validation problems, empty when everything is valid.
+func normalizeEstablishment(e *Establishment) []string {
+	problems := []string{}
+	sanitizeFields(&e.Name, &e.Description, &e.Address)
+	e.Phone = strings.TrimSpace(e.Phone)
+	if e.Phone != "" && !validE164(e.Phone) {
+		problems = append(problems, "phone must be in E.164 format, e.g. +5511999998888")
+	}
+	e.Whatsapp = strings.TrimSpace(e.Whatsapp)
+	if e.Whatsapp != "" && !validE164(e.Whatsapp) {
+		problems = append(problems, "whatsapp must be in E.164 format, e.g. +5511999998888")
+	}
+	e.Instagram = strings.TrimPrefix(strings.TrimSpace(e.Instagram), "@")
+	if e.Instagram != "" && !instagramPattern.MatchString(e.Instagram) {
+		problems = append(problems, "instagram must be a valid handle")
+	}
+	e.Website = strings.TrimSpace(e.Website)
+	if e.Website != "" {
+		u, err := url.Parse(e.Website)
+		if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+			problems = append(problems, "website must be an http(s) URL")
+		}
+	}
+	e.Email = strings.ToLower(strings.TrimSpace(e.Email))
+	if e.Email != "" {
+		if a, err := mail.ParseAddress(e.Email); err != nil || a.Address != e.Email {
+			problems = append(problems, "email is invalid")
+		}
+	}
+	if e.CNPJ != "" {
+		e.CNPJ = digitsOnly(e.CNPJ)
+		if !validCNPJ(e.CNPJ) {
+			problems = append(problems, "cnpj is invalid")
+		}
+	}
+	e.Category = strings.ToLower(strings.TrimSpace(e.Category))
+	if e.Category != "" && !establishmentCategories[e.Category] {
+		problems = append(problems, "category is not one of the directory categories")
+	}
+	e.Timezone = strings.TrimSpace(e.Timezone)
+	if e.Timezone == "" {
+		e.Timezone = defaultTimezone
+	}
+	if _, err := time.LoadLocation(e.Timezone); err != nil || e.Timezone == "Local" {
+		problems = append(problems, "timezone must be an IANA zone such as America/Sao_Paulo")
+	}
+	problems = append(problems, normalizeAddress(&e.AddressDetails)...)
+	if e.AddressDetails != (Address{}) {
+		e.Address = e.AddressDetails.String()
+	}
+	return problems
+}
@@ -0,0 +1,21 @@
+package main
+
+import "testing"
+
+func TestNormalizePhone(t *testing.T) {
+	for in, want := range map[string]string{
+		"+5511999998888":      "+5511999998888",
+		"+55 (11) 99999-8888": "+5511999998888",
+		"(11) 99999-8888":     "+5511999998888",
+		"11 3333-4444":        "+551133334444",
+		"011 99999 8888":      "+5511999998888",
+		"0055 11 99999-8888":  "+5511999998888",
+		"5511999998888":       "+5511999998888",
+		"+1 415 555 2671":     "+14155552671",
+		"":                    "",
+	} {
+		if got := normalizePhone(in); got != want {
+			t.Errorf("normalizePhone(%q) = %q, want %q", in, got, want)
+		}
+	}
+}
@@ -0,0 +1,237 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+	"time"
+
+	"github.com/lib/pq"
+)
+
+// Owners ask for their establishment to be verified by sending its CNPJ and
+// supporting documents (verification_document uploads). A platform admin
+// reviews the submission; approval sets establishments.verified_at, which
+// public responses show as "verified". Changing the CNPJ afterwards clears
+// it.
+
+const maxVerificationDocuments = 5
+
+type Verification struct {
+	ID              string     `json:"id"`
+	EstablishmentID string     `json:"establishment_id"`
+	CNPJ            string     `json:"cnpj"`
+	Documents       []string   `json:"documents"`
+	DocumentURLs    []string   `json:"document_urls,omitempty"`
+	Status          string     `json:"status"`
+	ReviewNote      string     `json:"review_note,omitempty"`
+	SubmittedAt     time.Time  `json:"submitted_at"`
+	ReviewedAt      *time.Time `json:"reviewed_at"`
+}
+
+func verificationRoute(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	if !requireRole(w, r, db, establishmentID, "owner") {
+		return
+	}
+	switch r.Method {
+	case http.MethodGet:
+		getLatestVerification(w, db, establishmentID)
+	case http.MethodPost:
+		submitVerification(w, r, db, establishmentID)
+	default:
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+	}
+}
+
+func submitVerification(w http.ResponseWriter, r *http.Request, db *sql.DB, establishmentID string) {
+	var req struct {
+		CNPJ      string   `json:"cnpj"`
+		Documents []string `json:"documents"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.CNPJ = digitsOnly(req.CNPJ)
+	if !validCNPJ(req.CNPJ) {
+		http.Error(w, "cnpj is invalid", http.StatusUnprocessableEntity)
+		return
+	}
+	if len(req.Documents) == 0 || len(req.Documents) > maxVerificationDocuments {
+		http.Error(w, "send between 1 and 5 documents", http.StatusUnprocessableEntity)
+		return
+	}
+	var owned int
+	err := db.QueryRow(
+		`SELECT COUNT(*) FROM uploads WHERE key = ANY($1) AND purpose='verification_document' AND owner_id=$2 AND scan_status IN ('pending','clean')`,
+		pq.Array(req.Documents), currentClaims(r).Sub,
+	).Scan(&owned)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if owned != len(req.Documents) {
+		http.Error(w, "documents must be verification_document uploads of yours", http.StatusUnprocessableEntity)
+		return
+	}
+	v := Verification{EstablishmentID: establishmentID, CNPJ: req.CNPJ, Documents: req.Documents, Status: "submitted"}
+	err = db.QueryRow(
+		`INSERT INTO establishment_verifications (establishment_id, cnpj, document_keys, submitted_by) VALUES ($1,$2,$3,$4)
+		 RETURNING id, submitted_at`,
+		establishmentID, v.CNPJ, pq.Array(v.Documents), currentClaims(r).Sub,
+	).Scan(&v.ID, &v.SubmittedAt)
+	if isUniqueViolation(err) {
+		http.Error(w, "a submission is already waiting for review", http.StatusConflict)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := recordAudit(db, r, establishmentID, "establishment.verification_submitted", "verification", v.ID, nil); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(http.StatusCreated)
+	json.NewEncoder(w).Encode(v)
+}
+
+const verificationColumns = `id, establishment_id, cnpj, document_keys, status, COALESCE(review_note, ''), submitted_at, reviewed_at`
+
+func scanVerification(row interface{ Scan(...any) error }) (Verification, error) {
+	var v Verification
+	err := row.Scan(&v.ID, &v.EstablishmentID, &v.CNPJ, pq.Array(&v.Documents), &v.Status, &v.ReviewNote, &v.SubmittedAt, &v.ReviewedAt)
+	for _, key := range v.Documents {
+		v.DocumentURLs = append(v.DocumentURLs, assetURL(key))
+	}
+	return v, err
+}
+
+func getLatestVerification(w http.ResponseWriter, db *sql.DB, establishmentID string) {
+	v, err := scanVerification(db.QueryRow(
+		`SELECT `+verificationColumns+` FROM establishment_verifications WHERE establishment_id=$1 ORDER BY submitted_at DESC LIMIT 1`,
+		establishmentID,
+	))
+	if err == sql.ErrNoRows {
+		http.NotFound(w, nil)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(v)
+}
+
+// verificationQueueHandler is the platform admins' side:
+// GET /support/verifications lists submissions waiting for review, oldest
+// first, and PUT /support/verifications/{id} approves or rejects one.
+func verificationQueueHandler(db *sql.DB) http.HandlerFunc {
+	return authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) {
+		if !requirePlatformAdmin(w, r, db) {
+			return
+		}
+		id := strings.Trim(strings.TrimPrefix(r.URL.Path, "/support/verifications"), "/")
+		switch {
+		case id == "" && r.Method == http.MethodGet:
+			listPendingVerifications(w, db)
+		case id != "" && r.Method == http.MethodPut:
+			reviewVerification(w, r, db, id)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+func listPendingVerifications(w http.ResponseWriter, db *sql.DB) {
+	rows, err := db.Query(`SELECT ` + verificationColumns + ` FROM establishment_verifications WHERE status='submitted' ORDER BY submitted_at LIMIT 100`)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+	list := []Verification{}
+	for rows.Next() {
+		v, err := scanVerification(rows)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		list = append(list, v)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(list)
+}
+
+// reviewVerification records the decision. Approving also stores the
+// verified CNPJ on the establishment, and the owner who submitted is told
+// by e-mail either way.
+func reviewVerification(w http.ResponseWriter, r *http.Request, db *sql.DB, id string) {
+	var req struct {
+		Status string `json:"status"`
+		Note   string `json:"note"`
+	}
+	if err := json.NewDecoder(r.Body).Decode(&req); err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	req.Note = sanitizeText(req.Note)
+	if req.Status != "approved" && req.Status != "rejected" {
+		http.Error(w, "status must be approved or rejected", http.StatusUnprocessableEntity)
+		return
+	}
+	if req.Status == "rejected" && req.Note == "" {
+		http.Error(w, "note is required when rejecting", http.StatusUnprocessableEntity)
+		return
+	}
+	tx, err := db.Begin()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer tx.Rollback()
+	var establishmentID, cnpj, email, name string
+	err = tx.QueryRow(
+		`UPDATE establishment_verifications v SET status=$2, review_note=NULLIF($3,''), reviewed_by=$4, reviewed_at=now()
+		 FROM owners o, establishments e
+		 WHERE v.id::text=$1 AND v.status='submitted' AND o.id=v.submitted_by AND e.id=v.establishment_id
+		 RETURNING v.establishment_id, v.cnpj, o.email, e.name`,
+		id, req.Status, req.Note, currentClaims(r).Sub,
+	).Scan(&establishmentID, &cnpj, &email, &name)
+	if err == sql.ErrNoRows {
+		http.NotFound(w, nil)
+		return
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if req.Status == "approved" {
+		if _, err := tx.Exec(`UPDATE establishments SET cnpj=$2, verified_at=now(), updated_at=now() WHERE id=$1`, establishmentID, cnpj); err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if err := recordAudit(tx, r, establishmentID, "establishment.verification_"+req.Status, "verification", id, req); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	if err := tx.Commit(); err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	responseCache.Invalidate(establishmentID)
+
+	subject, body := "Estabelecimento verificado", "A verificação de "+name+" foi aprovada. O selo de verificado já aparece para os clientes."
+	if req.Status == "rejected" {
+		subject, body = "Verificação não aprovada", "A verificação de "+name+" não foi aprovada.\nMotivo: "+req.Note+"\n\nVocê pode enviar os documentos novamente pelo painel."
+	}
+	if err := mailer.Send(email, subject, body); err != nil {
+		log.Printf("verification %s: %v", id, err)
+	}
+	w.WriteHeader(http.StatusNoContent)
+}
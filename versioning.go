@@ -0,0 +1,93 @@
+package main
+
+import (
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// The public API is versioned by path prefix: /v1/orders is the current
+// /orders. Unversioned paths keep working as v1 but are announced as
+// deprecated. A new version gets its own entry in apiVersions once an
+// incompatible change needs it.
+
+const currentAPIVersion = "v1"
+
+var apiVersions = map[string]bool{"v1": true}
+
+// unversionedPrefixes are called by providers or operators rather than API
+// clients, so they are neither versioned nor deprecated.
+var unversionedPrefixes = []string{"/webhooks/", "/metrics", "/admin", "/files/"}
+
+// Deprecation marks the endpoints under Prefix in Version as going away.
+// Sunset is when they stop answering; zero means no date yet. Successor is
+// the path clients should move to, sent as a Link header.
+type Deprecation struct {
+	Version   string
+	Prefix    string
+	Sunset    time.Time
+	Successor string
+}
+
+var deprecations []Deprecation
+
+// deprecateEndpoint registers a deprecation. Call it during startup.
+func deprecateEndpoint(d Deprecation) {
+	deprecations = append(deprecations, d)
+}
+
+// withAPIVersions strips the version prefix before routing and adds the
+// Deprecation, Sunset and Link headers for deprecated endpoints.
+// Unversioned requests are served as the current version; their sunset date
+// comes from API_UNVERSIONED_SUNSET (YYYY-MM-DD) when set.
+func withAPIVersions(next http.Handler) http.Handler {
+	var unversionedSunset time.Time
+	if v := os.Getenv("API_UNVERSIONED_SUNSET"); v != "" {
+		unversionedSunset, _ = time.Parse("2006-01-02", v)
+	}
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		for _, p := range unversionedPrefixes {
+			if strings.HasPrefix(r.URL.Path, p) {
+				next.ServeHTTP(w, r)
+				return
+			}
+		}
+		version, rest, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/"), "/")
+		if !apiVersions[version] {
+			if strings.HasPrefix(version, "v") && len(version) > 1 && strings.Trim(version[1:], "0123456789") == "" {
+				http.Error(w, "unsupported api version "+version, http.StatusNotFound)
+				return
+			}
+			setDeprecationHeaders(w, Deprecation{Sunset: unversionedSunset, Successor: "/" + currentAPIVersion + r.URL.Path})
+			w.Header().Set("API-Version", currentAPIVersion)
+			next.ServeHTTP(w, r)
+			return
+		}
+
+		r2 := new(http.Request)
+		*r2 = *r
+		u := *r.URL
+		u.Path = "/" + rest
+		u.RawPath = ""
+		r2.URL = &u
+		w.Header().Set("API-Version", version)
+		for _, d := range deprecations {
+			if d.Version == version && strings.HasPrefix(u.Path, d.Prefix) {
+				setDeprecationHeaders(w, d)
+				break
+			}
+		}
+		next.ServeHTTP(w, r2)
+	})
+}
+
+func setDeprecationHeaders(w http.ResponseWriter, d Deprecation) {
+	w.Header().Set("Deprecation", "true")
+	if !d.Sunset.IsZero() {
+		w.Header().Set("Sunset", d.Sunset.UTC().Format(http.TimeFormat))
+	}
+	if d.Successor != "" {
+		w.Header().Add("Link", "<"+d.Successor+`>; rel="successor-version"`)
+	}
+}
@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"strings"
+	"time"
+)
+
+// When a virus scanner is configured, uploads are written under
+// scanPendingPrefix and recorded as pending; their real key doesn't exist
+// yet, so products and reviews pointing at it show nothing until the scan
+// is done. The scanner worker then either copies a clean file (and its
+// thumbnail) to the real key or moves an infected one under
+// quarantinePrefix and e-mails the platform admins. Files that still can't
+// be scanned after scanMaxAttempts are quarantined as failed: the scan fails
+// closed.
+
+const (
+	scanPendingPrefix = "scan_pending/"
+	quarantinePrefix  = "quarantine/"
+	scanEvery         = 10 * time.Second
+	scanMaxAttempts   = 5
+)
+
+var uploadsScanned = newCounter("uploads_scanned_total", "Uploads scanned for viruses, by result.", "result")
+
+type ScanVerdict struct {
+	Infected  bool   `json:"infected"`
+	Signature string `json:"signature,omitempty"`
+}
+
+// VirusScanner checks a file for malware.
+type VirusScanner interface {
+	Name() string
+	Scan(ctx context.Context, data []byte) (ScanVerdict, error)
+}
+
+// virusScanner is nil when uploads are not scanned.
+var virusScanner VirusScanner
+
+// newVirusScannerFromEnv picks the scanner from VIRUS_SCAN_PROVIDER:
+// "clamav" streams files to clamd at CLAMAV_ADDR (host:port, or
+// unix:/path/to/clamd.sock), "webhook" posts them to VIRUS_SCAN_URL.
+func newVirusScannerFromEnv() VirusScanner {
+	switch os.Getenv("VIRUS_SCAN_PROVIDER") {
+	case "clamav":
+		network, addr := "tcp", os.Getenv("CLAMAV_ADDR")
+		if path, ok := strings.CutPrefix(addr, "unix:"); ok {
+			network, addr = "unix", path
+		}
+		return clamdScanner{network: network, addr: addr}
+	case "webhook":
+		return webhookScanner{url: os.Getenv("VIRUS_SCAN_URL"), secret: os.Getenv("VIRUS_SCAN_SECRET")}
+	case "":
+		return nil
+	default:
+		log.Printf("unknown VIRUS_SCAN_PROVIDER %q, uploads will not be scanned", os.Getenv("VIRUS_SCAN_PROVIDER"))
+		return nil
+	}
+}
+
+// clamdScanner speaks clamd's INSTREAM command.
+type clamdScanner struct {
+	network, addr string
+}
+
+func (clamdScanner) Name() string { return "clamav" }
+
+func (s clamdScanner) Scan(ctx context.Context, data []byte) (ScanVerdict, error) {
+	var v ScanVerdict
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, s.network, s.addr)
+	if err != nil {
+		return v, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+	if _, err := conn.Write([]byte("zINSTREAM\x00")); err != nil {
+		return v, err
+	}
+	const chunk = 64 << 10
+	size := make([]byte, 4)
+	for len(data) > 0 {
+		n := min(chunk, len(data))
+		binary.BigEndian.PutUint32(size, uint32(n))
+		if _, err := conn.Write(size); err != nil {
+			return v, err
+		}
+		if _, err := conn.Write(data[:n]); err != nil {
+			return v, err
+		}
+		data = data[n:]
+	}
+	binary.BigEndian.PutUint32(size, 0)
+	if _, err := conn.Write(size); err != nil {
+		return v, err
+	}
+	reply, err := io.ReadAll(io.LimitReader(conn, 1024))
+	if err != nil {
+		return v, err
+	}
+	// Replies look like "stream: OK" or "stream: Eicar-Signature FOUND".
+	result := strings.TrimSpace(strings.TrimRight(string(reply), "\x00"))
+	result = strings.TrimPrefix(result, "stream: ")
+	switch {
+	case result == "OK":
+		return v, nil
+	case strings.HasSuffix(result, " FOUND"):
+		return ScanVerdict{Infected: true, Signature: strings.TrimSuffix(result, " FOUND")}, nil
+	default:
+		return v, fmt.Errorf("clamd: %s", result)
+	}
+}
+
+// webhookScanner POSTs the raw file, signed like the moderation webhook, and
+// expects a ScanVerdict back.
+type webhookScanner struct {
+	url, secret string
+}
+
+func (webhookScanner) Name() string { return "webhook" }
+
+func (s webhookScanner) Scan(ctx context.Context, data []byte) (ScanVerdict, error) {
+	var v ScanVerdict
+	req, err := http.NewRequestWithContext(ctx, http.MethodPost, s.url, bytes.NewReader(data))
+	if err != nil {
+		return v, err
+	}
+	mac := hmac.New(sha256.New, []byte(s.secret))
+	mac.Write(data)
+	req.Header.Set("Content-Type", "application/octet-stream")
+	req.Header.Set("X-Signature", "sha256="+hex.EncodeToString(mac.Sum(nil)))
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return v, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return v, fmt.Errorf("scan webhook responded %d", resp.StatusCode)
+	}
+	err = json.NewDecoder(resp.Body).Decode(&v)
+	return v, err
+}
+
+// storedKey is where an upload is written: its own key, or the pending
+// area while it waits for the scanner.
+func storedKey(key string) string {
+	if virusScanner == nil {
+		return key
+	}
+	return scanPendingPrefix + key
+}
+
+func startUploadScanner(db *sql.DB) {
+	if virusScanner == nil {
+		return
+	}
+	go func() {
+		for {
+			for {
+				more, err := scanNextUpload(db)
+				if err != nil {
+					log.Printf("upload scan: %v", err)
+				}
+				if !more || err != nil {
+					break
+				}
+			}
+			time.Sleep(scanEvery)
+		}
+	}()
+}
+
+// scanNextUpload scans the oldest pending upload. It reports whether there
+// was one.
+func scanNextUpload(db *sql.DB) (bool, error) {
+	tx, err := db.Begin()
+	if err != nil {
+		return false, err
+	}
+	defer tx.Rollback()
+
+	var key, contentType string
+	var thumbnailKey sql.NullString
+	var attempts int
+	err = tx.QueryRow(
+		`SELECT key, content_type, thumbnail_key, scan_attempts FROM uploads
+		 WHERE scan_status='pending' AND scan_next_at <= now()
+		 ORDER BY created_at LIMIT 1 FOR UPDATE SKIP LOCKED`,
+	).Scan(&key, &contentType, &thumbnailKey, &attempts)
+	if err == sql.ErrNoRows {
+		return false, nil
+	}
+	if err != nil {
+		return false, err
+	}
+	ctx, cancel := context.WithTimeout(context.Background(), time.Minute)
+	defer cancel()
+
+	data, err := storage.Get(ctx, scanPendingPrefix+key)
+	var v ScanVerdict
+	if err == nil {
+		v, err = virusScanner.Scan(ctx, data)
+	}
+	status := "clean"
+	switch {
+	case err != nil && attempts+1 < scanMaxAttempts:
+		log.Printf("upload scan %s via %s: %v", key, virusScanner.Name(), err)
+		_, err = tx.Exec(
+			`UPDATE uploads SET scan_attempts=scan_attempts+1, scan_next_at=now() + $2 * interval '1 second' WHERE key=$1`,
+			key, int((time.Duration(1<<attempts) * time.Minute).Seconds()),
+		)
+		if err != nil {
+			return true, err
+		}
+		return true, tx.Commit()
+	case err != nil:
+		status, v.Signature = "failed", err.Error()
+	case v.Infected:
+		status = "infected"
+	}
+
+	if status == "clean" {
+		err = promoteScannedUpload(ctx, key, contentType, thumbnailKey, data)
+	} else if data != nil {
+		err = storage.Put(ctx, quarantinePrefix+key, contentType, data)
+	}
+	if err != nil {
+		return true, err
+	}
+	_, err = tx.Exec(
+		`UPDATE uploads SET scan_status=$2, scan_signature=NULLIF(left($3, 200), ''), scanned_at=now(), scan_attempts=scan_attempts+1 WHERE key=$1`,
+		key, status, v.Signature,
+	)
+	if err != nil {
+		return true, err
+	}
+	if err := tx.Commit(); err != nil {
+		return true, err
+	}
+	uploadsScanned.Inc(status)
+	removePendingUpload(ctx, key, thumbnailKey)
+	if status != "clean" {
+		alertAdminsOfInfectedUpload(db, key, status, v.Signature)
+	}
+	return true, nil
+}
+
+// promoteScannedUpload copies a clean upload and its thumbnail to their
+// real keys.
+func promoteScannedUpload(ctx context.Context, key, contentType string, thumbnailKey sql.NullString, data []byte) error {
+	if err := storage.Put(ctx, key, contentType, data); err != nil {
+		return err
+	}
+	if !thumbnailKey.Valid || thumbnailKey.String == key {
+		return nil
+	}
+	thumb, err := storage.Get(ctx, scanPendingPrefix+thumbnailKey.String)
+	if err != nil {
+		return err
+	}
+	return storage.Put(ctx, thumbnailKey.String, "image/jpeg", thumb)
+}
+
+func removePendingUpload(ctx context.Context, key string, thumbnailKey sql.NullString) {
+	keys := []string{key}
+	if thumbnailKey.Valid && thumbnailKey.String != key {
+		keys = append(keys, thumbnailKey.String)
+	}
+	for _, k := range keys {
+		if err := storage.Delete(ctx, scanPendingPrefix+k); err != nil {
+			log.Printf("upload scan: removing pending %s: %v", k, err)
+		}
+	}
+}
+
+func alertAdminsOfInfectedUpload(db *sql.DB, key, status, signature string) {
+	rows, err := db.Query(`SELECT email FROM owners WHERE platform_admin`)
+	if err != nil {
+		log.Printf("upload scan alert %s: %v", key, err)
+		return
+	}
+	var emails []string
+	for rows.Next() {
+		var email string
+		if err := rows.Scan(&email); err == nil {
+			emails = append(emails, email)
+		}
+	}
+	rows.Close()
+	var uploader string
+	db.QueryRow(`SELECT COALESCE(owner_id::text, customer_id::text, '') FROM uploads WHERE key=$1`, key).Scan(&uploader)
+	subject := "Upload em quarentena: " + key
+	body := fmt.Sprintf("O arquivo %s foi colocado em quarentena (%s).\nResultado: %s\nEnviado por: %s", key, status, signature, uploader)
+	for _, email := range emails {
+		if err := mailer.Send(email, subject, body); err != nil {
+			log.Printf("upload scan alert %s: %v", key, err)
+		}
+	}
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// Every POST the webhook sink makes is logged in webhook_deliveries with the
+// response status and timing, so integrators can see what was sent and
+// replay it after fixing their endpoint.
+
+type WebhookDelivery struct {
+	ID              string          `json:"id"`
+	EstablishmentID *string         `json:"establishment_id"`
+	Topic           string          `json:"topic"`
+	URL             string          `json:"url"`
+	Payload         json.RawMessage `json:"payload"`
+	StatusCode      *int            `json:"status_code"`
+	Error           string          `json:"error"`
+	DurationMs      int             `json:"duration_ms"`
+	RetryOf         *string         `json:"retry_of"`
+	AttemptedAt     time.Time       `json:"attempted_at"`
+}
+
+// logWebhookDelivery records one attempt. The establishment is read from
+// the event so each owner only sees their own deliveries.
+func logWebhookDelivery(db *sql.DB, d *WebhookDelivery) error {
+	var e Event
+	if err := json.Unmarshal(d.Payload, &e); err == nil && e.EstablishmentID != "" {
+		d.EstablishmentID = &e.EstablishmentID
+	}
+	return db.QueryRow(
+		`INSERT INTO webhook_deliveries (establishment_id, topic, url, payload, status_code, error, duration_ms, retry_of)
+		 VALUES ($1,$2,$3,$4,$5,$6,$7,$8) RETURNING id, attempted_at`,
+		d.EstablishmentID, d.Topic, d.URL, []byte(d.Payload), d.StatusCode, d.Error, d.DurationMs, d.RetryOf,
+	).Scan(&d.ID, &d.AttemptedAt)
+}
+
+func webhookDeliveriesHandler(db *sql.DB) http.HandlerFunc {
+	return authenticateOwner(db, func(w http.ResponseWriter, r *http.Request) {
+		rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/webhooks/deliveries"), "/")
+		id, action, _ := strings.Cut(rest, "/")
+		switch {
+		case id == "" && r.Method == http.MethodGet:
+			listWebhookDeliveries(w, r, db)
+		case id != "" && action == "" && r.Method == http.MethodGet:
+			d, ok := loadWebhookDelivery(w, r, db, id)
+			if !ok {
+				return
+			}
+			w.Header().Set("Content-Type", "application/json")
+			json.NewEncoder(w).Encode(d)
+		case id != "" && action == "retry" && r.Method == http.MethodPost:
+			retryWebhookDelivery(w, r, db, id)
+		default:
+			http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		}
+	})
+}
+
+// listWebhookDeliveries pages through an establishment's deliveries, newest
+// first. ?status=failed keeps only attempts without a 2xx response.
+func listWebhookDeliveries(w http.ResponseWriter, r *http.Request, db *sql.DB) {
+	establishmentID := r.URL.Query().Get("establishment_id")
+	if establishmentID == "" {
+		http.Error(w, "establishment_id is required", http.StatusBadRequest)
+		return
+	}
+	if !requireRole(w, r, db, establishmentID, "manager") {
+		return
+	}
+	status := r.URL.Query().Get("status")
+	if status != "" && status != "failed" && status != "succeeded" {
+		http.Error(w, "status must be failed or succeeded", http.StatusBadRequest)
+		return
+	}
+	cursor, limit, err := pageParams(r)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	at, id := keysetArgs(cursor)
+	rows, err := db.Query(
+		`SELECT id, establishment_id, topic, url, payload, status_code, error, duration_ms, retry_of, attempted_at FROM webhook_deliveries
+		 WHERE establishment_id=$1 AND (attempted_at, id) < ($2, $3::uuid)
+		   AND ($4='' OR ($4='succeeded') = COALESCE(status_code BETWEEN 200 AND 299, false))
+		 ORDER BY attempted_at DESC, id DESC LIMIT $5`,
+		establishmentID, at, id, status, limit+1,
+	)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	defer rows.Close()
+
+	list := []WebhookDelivery{}
+	for rows.Next() {
+		d, err := scanWebhookDelivery(rows)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		list = append(list, *d)
+	}
+	page := newPage(list, limit, func(d WebhookDelivery) pageCursor { return pageCursor{d.AttemptedAt, d.ID} })
+	if page.NextCursor != nil {
+		w.Header().Set("X-Next-Cursor", *page.NextCursor)
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(page)
+}
+
+func scanWebhookDelivery(row interface{ Scan(...any) error }) (*WebhookDelivery, error) {
+	var d WebhookDelivery
+	var payload []byte
+	err := row.Scan(&d.ID, &d.EstablishmentID, &d.Topic, &d.URL, &payload, &d.StatusCode, &d.Error, &d.DurationMs, &d.RetryOf, &d.AttemptedAt)
+	d.Payload = payload
+	return &d, err
+}
+
+// loadWebhookDelivery fetches a delivery the caller may manage, answering
+// 404 for anyone else.
+func loadWebhookDelivery(w http.ResponseWriter, r *http.Request, db *sql.DB, id string) (*WebhookDelivery, bool) {
+	d, err := scanWebhookDelivery(db.QueryRow(
+		`SELECT id, establishment_id, topic, url, payload, status_code, error, duration_ms, retry_of, attempted_at FROM webhook_deliveries WHERE id::text=$1`,
+		id,
+	))
+	if err == sql.ErrNoRows || (err == nil && d.EstablishmentID == nil) {
+		http.NotFound(w, nil)
+		return nil, false
+	}
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	role, err := establishmentRole(db, *d.EstablishmentID, currentClaims(r).Sub)
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+	if roleRank[role] < roleRank["manager"] {
+		http.NotFound(w, nil)
+		return nil, false
+	}
+	return d, true
+}
+
+// retryWebhookDelivery sends the logged payload again to the currently
+// configured webhook and returns the new attempt. It doesn't touch the
+// outbox, so in-process subscribers don't see the event twice.
+func retryWebhookDelivery(w http.ResponseWriter, r *http.Request, db *sql.DB, id string) {
+	d, ok := loadWebhookDelivery(w, r, db, id)
+	if !ok {
+		return
+	}
+	var sink *webhookSink
+	for _, p := range publishers {
+		if s, ok := p.(webhookSink); ok {
+			sink = &s
+			break
+		}
+	}
+	if sink == nil {
+		http.Error(w, "no webhook is configured", http.StatusConflict)
+		return
+	}
+	ctx, cancel := context.WithTimeout(r.Context(), 15*time.Second)
+	defer cancel()
+	attempt, err := sink.send(ctx, d.Topic, d.Payload, &d.ID)
+	if attempt == nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(attempt)
+}